@@ -0,0 +1,286 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+var aggregateSingletCollection uint16 = 0xFFFC
+var aggregateSingletCollectionName string = "aggr"
+
+func init() {
+	registerSingletFactory(aggregateSingletCollection, aggregateSingletCollectionName, func(identifier []byte) (Singlet, error) {
+		return aggregateSinglet{tabletKey: TabletKey(identifier)}, nil
+	})
+}
+
+// TabletAggregateSum extracts from a tablet row the value it adds to the sum of the aggregate of
+// its tablet, see `RegisterTabletAggregate`.
+type TabletAggregateSum func(row TabletRow) (int64, error)
+
+var tabletAggregates = map[uint16]TabletAggregateSum{}
+
+// RegisterTabletAggregate declares an aggregate maintained by FluxDB for each tablet of the
+// collection: the amount of rows of the tablet and the sum of `sum` over them (always 0 when
+// `sum` is nil). It's updated incrementally at each block mutating the tablet and read with
+// `ReadTabletAggregateAt`.
+//
+// **Important** Only the rows written once registered are accounted for, the aggregate must be
+// registered before the first write of the collection. Maintaining it costs a read of the
+// previous version of each row mutated, once per write batch.
+func RegisterTabletAggregate(collection uint16, sum TabletAggregateSum) {
+	if _, found := tabletFactories[collection]; !found {
+		panic(fmt.Errorf("collection 0x%04X is not a registered tablet collection, register its tablet factory first", collection))
+	}
+
+	if _, found := tabletAggregates[collection]; found {
+		panic(fmt.Errorf("an aggregate is already registered for collection 0x%04X", collection))
+	}
+
+	if sum == nil {
+		sum = func(row TabletRow) (int64, error) { return 0, nil }
+	}
+
+	tabletAggregates[collection] = sum
+}
+
+// TabletAggregate is the aggregate of a tablet at a given height, see `RegisterTabletAggregate`.
+type TabletAggregate struct {
+	// Height is the height the aggregate last changed at, 0 when the tablet never had any row
+	Height uint64
+
+	RowCount uint64
+	Sum      int64
+}
+
+// ReadTabletAggregateAt returns the aggregate of the tablet at `height`, the collection of the
+// tablet must have an aggregate registered, see `RegisterTabletAggregate`. Only the irreversible
+// rows are accounted for, the speculative writes are not.
+func (fdb *FluxDB) ReadTabletAggregateAt(ctx context.Context, tablet Tablet, height uint64) (*TabletAggregate, error) {
+	if _, found := tabletAggregates[tablet.Collection()]; !found {
+		return nil, fmt.Errorf("no aggregate registered for collection 0x%04X", tablet.Collection())
+	}
+
+	tabletKey := KeyForTablet(tablet)
+	ctx, err := fdb.interceptRead(ctx, ReadOperationSingletEntry, nil, aggregateSinglet{tabletKey: tabletKey}, height)
+	if err != nil {
+		return nil, err
+	}
+
+	if height, err = fdb.committedReadHeight(ctx, height, nil); err != nil {
+		return nil, err
+	}
+
+	return fdb.fetchTabletAggregate(ctx, tabletKey, height)
+}
+
+func (fdb *FluxDB) fetchTabletAggregate(ctx context.Context, tabletKey TabletKey, height uint64) (*TabletAggregate, error) {
+	singlet := aggregateSinglet{tabletKey: tabletKey}
+	key, value, err := fdb.store.FetchSingletEntry(ctx, KeyForSingletAt(singlet, height), KeyForSingletAt(singlet, 0))
+	if err != nil {
+		return nil, fmt.Errorf("fetch tablet aggregate: %w", err)
+	}
+
+	if len(key) == 0 {
+		return &TabletAggregate{}, nil
+	}
+
+	entry, err := NewSingletEntry(singlet, key, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tablet aggregate %q: %w", Key(key), err)
+	}
+
+	value = entry.(BaseSingletEntry).Value()
+	if len(value) != 16 {
+		return nil, fmt.Errorf("invalid tablet aggregate %q: expected 16 bytes, got %d", Key(key), len(value))
+	}
+
+	return &TabletAggregate{
+		Height:   entry.Height(),
+		RowCount: bigEndian.Uint64(value),
+		Sum:      int64(bigEndian.Uint64(value[8:])),
+	}, nil
+}
+
+// aggregateSinglet holds the aggregate of a tablet, its entries are stored at the heights the
+// aggregate changed at.
+type aggregateSinglet struct {
+	tabletKey TabletKey
+}
+
+func (s aggregateSinglet) Collection() uint16 {
+	return aggregateSingletCollection
+}
+
+func (s aggregateSinglet) Identifier() []byte {
+	return s.tabletKey
+}
+
+func (s aggregateSinglet) Entry(at uint64, value []byte) (SingletEntry, error) {
+	return NewBaseSingletEntry(s, at, value), nil
+}
+
+func (s aggregateSinglet) String() string {
+	return aggregateSingletCollectionName + ":" + hex.EncodeToString(s.tabletKey)
+}
+
+// rawPrimaryKey is the primary key of a row as stored
+type rawPrimaryKey []byte
+
+func (k rawPrimaryKey) Bytes() []byte {
+	return k
+}
+
+func (k rawPrimaryKey) String() string {
+	return hex.EncodeToString(k)
+}
+
+// aggregateWriter maintains the aggregates of the tablets mutated by a write batch. The state
+// of the tablets and rows before the batch is read at `readHeight`, the last height written
+// before it, the mutations of the batch being tracked in memory as they are written.
+type aggregateWriter struct {
+	fdb        *FluxDB
+	readHeight uint64
+
+	aggregates    map[string]*TabletAggregate
+	contributions map[string]aggregateContribution
+
+	// The tablets whose aggregate changed in the block being written
+	changed map[string]bool
+}
+
+// aggregateContribution is what a row adds to the aggregate of its tablet
+type aggregateContribution struct {
+	present bool
+	value   int64
+}
+
+// newAggregateWriter returns the aggregate writer of a batch starting at `height`, `nil` when
+// no aggregate is registered.
+func (fdb *FluxDB) newAggregateWriter(height uint64) *aggregateWriter {
+	if len(tabletAggregates) == 0 {
+		return nil
+	}
+
+	readHeight := uint64(0)
+	if height > 0 {
+		readHeight = height - 1
+	}
+
+	return &aggregateWriter{
+		fdb:           fdb,
+		readHeight:    readHeight,
+		aggregates:    map[string]*TabletAggregate{},
+		contributions: map[string]aggregateContribution{},
+		changed:       map[string]bool{},
+	}
+}
+
+// observe accounts for the row being written in the aggregate of its tablet. Safe to call on
+// a `nil` writer, in which case nothing is maintained.
+func (a *aggregateWriter) observe(ctx context.Context, row TabletRow) error {
+	if a == nil {
+		return nil
+	}
+
+	tablet := row.Tablet()
+	sum, found := tabletAggregates[tablet.Collection()]
+	if !found {
+		return nil
+	}
+
+	tabletKey := KeyForTablet(tablet)
+	aggregate, found := a.aggregates[string(tabletKey)]
+	if !found {
+		var err error
+		if aggregate, err = a.fdb.fetchTabletAggregate(ctx, tabletKey, a.readHeight); err != nil {
+			return err
+		}
+
+		a.aggregates[string(tabletKey)] = aggregate
+	}
+
+	rowKey := string(tabletKey) + string(row.PrimaryKey())
+	previous, found := a.contributions[rowKey]
+	if !found {
+		previousRow, err := a.fdb.ReadTabletRowAt(ctx, a.readHeight, tablet, rawPrimaryKey(row.PrimaryKey()), nil)
+		if err != nil {
+			return fmt.Errorf("read previous row: %w", err)
+		}
+
+		if previousRow != nil {
+			if previous, err = newAggregateContribution(previousRow, sum); err != nil {
+				return err
+			}
+		}
+	}
+
+	next, err := newAggregateContribution(row, sum)
+	if err != nil {
+		return err
+	}
+
+	if previous.present {
+		aggregate.RowCount--
+		aggregate.Sum -= previous.value
+	}
+
+	if next.present {
+		aggregate.RowCount++
+		aggregate.Sum += next.value
+	}
+
+	a.contributions[rowKey] = next
+	a.changed[string(tabletKey)] = true
+	return nil
+}
+
+func newAggregateContribution(row TabletRow, sum TabletAggregateSum) (aggregateContribution, error) {
+	if row.IsDeletion() {
+		return aggregateContribution{}, nil
+	}
+
+	value, err := sum(row)
+	if err != nil {
+		return aggregateContribution{}, fmt.Errorf("sum of row %s: %w", row, err)
+	}
+
+	return aggregateContribution{present: true, value: value}, nil
+}
+
+// write adds to the batch the aggregates of the tablets changed by the block at `height`.
+func (a *aggregateWriter) write(batch store.Batch, height uint64) {
+	if a == nil {
+		return
+	}
+
+	for tabletKey := range a.changed {
+		aggregate := a.aggregates[tabletKey]
+		aggregate.Height = height
+
+		value := make([]byte, 16)
+		bigEndian.PutUint64(value, aggregate.RowCount)
+		bigEndian.PutUint64(value[8:], uint64(aggregate.Sum))
+
+		batch.SetRow(KeyForSingletAt(aggregateSinglet{tabletKey: TabletKey(tabletKey)}, height), value)
+	}
+
+	a.changed = map[string]bool{}
+}
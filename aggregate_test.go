@@ -0,0 +1,73 @@
+package fluxdb
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTabletAggregateAt(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	RegisterTabletAggregate(testTabletCollection, func(row TabletRow) (int64, error) {
+		return strconv.ParseInt(row.(testTabletRow).data(), 10, 64)
+	})
+	defer delete(tabletAggregates, testTabletCollection)
+
+	tablet := newTestTablet("tbl")
+	otherTablet := newTestTablet("oth")
+
+	writeBatchOfRequests(t, db,
+		tabletRows(1, tablet.row(t, 1, "001", "10"), tablet.row(t, 1, "002", "20")),
+		tabletRows(2, tablet.row(t, 2, "001", "15"), tablet.row(t, 2, "003", "5"), tablet.row(t, 2, "003", "7")),
+	)
+	writeBatchOfRequests(t, db,
+		tabletRows(3, tablet.row(t, 3, "002", ""), otherTablet.row(t, 3, "001", "100")),
+		tabletRows(4, tablet.row(t, 4, "002", "1"), tablet.row(t, 4, "004", "")),
+		tabletRows(5, otherTablet.row(t, 5, "001", "50")),
+	)
+
+	tests := []struct {
+		name     string
+		tablet   Tablet
+		height   uint64
+		expected *TabletAggregate
+	}{
+		{"before first row", tablet, 0, &TabletAggregate{}},
+		{"inserts", tablet, 1, &TabletAggregate{Height: 1, RowCount: 2, Sum: 30}},
+		{"update and same block versions", tablet, 2, &TabletAggregate{Height: 2, RowCount: 3, Sum: 42}},
+		{"deletion", tablet, 3, &TabletAggregate{Height: 3, RowCount: 2, Sum: 22}},
+		{"insert and deletion of unknown row", tablet, 4, &TabletAggregate{Height: 4, RowCount: 3, Sum: 23}},
+		{"unchanged above last change", tablet, 5, &TabletAggregate{Height: 4, RowCount: 3, Sum: 23}},
+		{"other tablet", otherTablet, 5, &TabletAggregate{Height: 5, RowCount: 1, Sum: 50}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aggregate, err := db.ReadTabletAggregateAt(ctx, test.tablet, test.height)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, aggregate)
+		})
+	}
+}
+
+func TestReadTabletAggregateAt_NotRegistered(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	_, err := db.ReadTabletAggregateAt(context.Background(), newTestTablet("tbl"), 1)
+	assert.EqualError(t, err, "no aggregate registered for collection 0xFFF2")
+}
+
+func TestRegisterTabletAggregate(t *testing.T) {
+	RegisterTabletAggregate(testTabletCollection, nil)
+	defer delete(tabletAggregates, testTabletCollection)
+
+	assert.Panics(t, func() { RegisterTabletAggregate(testTabletCollection, nil) })
+	assert.Panics(t, func() { RegisterTabletAggregate(0xFFFB, nil) })
+}
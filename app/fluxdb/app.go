@@ -16,18 +16,28 @@ package fluxdb
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
 	"github.com/dfuse-io/dmetrics"
 	"github.com/dfuse-io/dstore"
 	"github.com/dfuse-io/fluxdb"
 	"github.com/dfuse-io/fluxdb/metrics"
 	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/dualwrite"
+	"github.com/dfuse-io/fluxdb/store/keydict"
+	"github.com/dfuse-io/fluxdb/store/kv"
+	"github.com/dfuse-io/fluxdb/store/namespace"
+	"github.com/dfuse-io/fluxdb/store/shadowread"
 	pbblockmeta "github.com/dfuse-io/pbgo/dfuse/blockmeta/v1"
 	"github.com/dfuse-io/shutter"
 	"go.uber.org/zap"
@@ -35,31 +45,159 @@ import (
 
 type Config struct {
 	StoreDSN                 string // Storage connection string
+	DualWriteStoreDSN        string // When set, all writes are also written to this store, reads being served by the primary store only, used for zero-downtime backend migrations
+	StoreMaxValueSize        uint64 // When non-zero, values larger than this amount of bytes are split in chunks across multiple keys, for backends capping the size of their values
 	BlockStreamAddr          string // gRPC endpoint to get real-time blocks
 	EnableServerMode         bool   // Enables flux server mode, launch a server
 	EnableInjectMode         bool   // Enables flux inject mode, writes into kvd
+	ReadOnly                 bool   // Serve-only replica of a store owned by another writer, every write to the store is rejected whatever the rest of the configuration, cannot be set with inject or reproc modes
 	EnableReprocSharderMode  bool   // Enables flux reproc shard mode, exclusive option, cannot be set if either server, injector or reproc-injector mode is set
 	EnableReprocInjectorMode bool   // Enables flux reproc injector mode, exclusive option, cannot be set if either server, injector or reproc-shard mode is set
 	BlockStoreURL            string // dbin blocks store
+	ChainID                  string // Identity of the chain (e.g. chain id or network name) of the configured source, bound to the store on first write and validated at startup, refusing to mix the data of different chains
+	SnapshotStoreURL         string // When set and the store is empty, loads snapshot segments from this location as the base state before starting the pipeline (inject mode only)
+
+	// Multi-chain, several app instances (one per chain, possibly in the same process) write into
+	// their own namespace of a shared store, the instances of a process opening each store once
+	StoreNamespace string // When set, confines this instance to this namespace of the stores, also naming its pipeline metrics, the stores are then shared by DSN with the other instances of the process, configured by the first one opening them
+
+	// Source tuning, trades catch-up throughput for memory
+	FileSourceParallelDownloads uint64 // Amount of blocks files downloaded concurrently while catching up from the blocks store, 0 means a default of 2
+	LiveSourceBufferSize        uint64 // Amount of live blocks buffered while the blocks store source catches up, 0 means a default of 250
+	DisableLiveSource           bool   // Only streams blocks from the blocks store, the live block stream is never joined
+
+	// Irreversibility, for chains without native finality, bound to the store on first write and
+	// validated at startup, the written blocks being irreversible according to it
+	IrreversibilityCondition string // Either native (the default, the last irreversible block reported by each block) or confirmation-depth:<blocks>
+
+	// Shadow-read verification, a sample of the reads is mirrored against this store and compared,
+	// divergences being logged and counted, used to validate a migrated or repaired store
+	ShadowReadStoreDSN   string
+	ShadowReadSampleRate float64 // Ratio, between 0 and 1, of the reads mirrored against the shadow-read store, 0 means a default of 0.01
+
+	// Overflow storage, row values of pathological size are stored in this dstore bucket, the KV store
+	// only keeping a reference to them, keeping it lean
+	OverflowStoreURL  string
+	OverflowThreshold uint64 // Row values larger than this amount of bytes are stored in the overflow store, 0 means a default of 1 MiB
+	OverflowCacheSize uint64 // Amount of bytes of overflow values kept in memory, 0 means a default of 64 MiB
+
+	// Scan budget, protects the backend from runaway tablet rows scans, a scan exceeding it fails
+	// the read instead of holding the backend iterator open
+	ScanBudgetMaxBytes    uint64        // When non-zero, amount of key and value bytes a single tablet rows scan may stream
+	ScanBudgetMaxDuration time.Duration // When non-zero, time a single tablet rows scan may take
+
+	// Store operation metrics, makes the performance of the storage backend observable whatever it is
+	EnableStoreOperationMetrics bool // Records the count, latency and error codes of each operation performed on the backend (store_operation_* metrics)
+
+	// Partitioned flush retry, keys rejected by the backend (key too large, quota) are isolated and
+	// skipped, logged as errors, instead of the whole batch failing and stalling the pipeline
+	FlushRetryMaxRejectedKeys uint64 // When non-zero, retries failed flushes by partitions, failing as before once more than this amount of keys are rejected
+
+	// Key dictionary, the tablets repeated in every row key are replaced by short identifiers, for
+	// backends without key compression, must be enabled on an empty store and never disabled
+	EnableKeyDictionary bool
+
+	// Audit log, write batches, purges, prunes, index rebuilds and administrative operations are
+	// recorded, with their time and identity, as JSON lines objects appended to this dstore bucket,
+	// an operation fails when its event cannot be written
+	AuditLogStoreURL string
+
+	// Incremental backup, each written batch is also appended to this dstore bucket, from which
+	// any store state can be rebuilt by replay (inject mode only)
+	IncrementalBackupStoreURL string
+
+	// Collection write stats, usage tracking without scanning the store, served by the admin API
+	CollectionWriteStatsInterval uint64 // When non-zero (inject mode only), maintains the amount of rows, deletions and bytes written to each collection, persisted every this amount of blocks
 
 	// Available for reproc mode only (either reproc shard or reproc injector)
 	ReprocShardStoreURL string
 	ReprocShardCount    uint64
+	ReprocShardFunction string // Name of the function assigning singlets and tablets to shards (see fluxdb.RegisterShardFunction, e.g. "collection-modulo" to co-locate the tablets of each collection), recorded in the sharding config, empty means the default hash of the whole key
 
 	// Available for reproc-shard only
 	ReprocSharderStartBlockNum    uint64
 	ReprocSharderStopBlockNum     uint64
 	ReprocSharderScratchDirectory string
+	ReprocSharderCollections      []uint16 // When set, only the singlet entries and tablet rows of those collections are retained in the shards, recorded in the sharding config validated at injection time
+	ReprocSharderStreamingUploads bool     // Uploads the segment of each shard while it's being written instead of once complete, the scratch directory is then not used
+	ReprocSharderSegmentBytes     uint64   // When non-zero, cuts the segments before the stop block as soon as one shard's segment reaches approximately this size in bytes (before compression)
+	ReprocSharderFilenamePadding  uint64   // Zero-padding width of the block numbers in segment file names, 0 means a default of 10, use 20 for chains with block numbers above 32-bit
 
 	// Available for reproc-injector only
-	ReprocInjectorShardIndex uint64
+	ReprocInjectorShardIndex    uint64
+	ReprocInjectorIndexOnly     bool          // Assumes rows already exist in the store and only (re)builds index snapshots and checkpoints, present for index recovery jobs
+	ReprocInjectorWatchInterval time.Duration // When non-zero, keeps watching the shards store at this interval for newly uploaded shard files instead of exiting once all current ones are injected
+	ReprocInjectorLeaseTTL      time.Duration // When non-zero, holds a lease on the injected shard (renewed periodically, expiring after this TTL) so two injectors cannot write the same shard concurrently
+	ReprocInjectorLeaseTakeover bool          // Forcefully acquires the shard lease even if held by another injector, the other injector stops as soon as it notices
+	ReprocInjectorDryRun        bool          // Only decodes and validates the shard files, reporting what would be written, nothing is written to the store
+	ReprocInjectorVerify        bool          // Compares the shard files against the data already in the store, reporting any divergence, nothing is written to the store
 
 	DisableIndexing            bool   // Disables indexing when injecting data in write mode, should never be used in production, present for repair jobs
 	DisableShardReconciliation bool   // Do not reconcile all shard last written block to the current active last written block, should never be used in production, present for repair jobs
 	DisablePipeline            bool   // Connects to blocks pipeline, can be used to have a development server only fluxdb
+	DeferIndexing              bool   // Bulk-load mode, skips inline indexing while catching up and builds deferred indexes once ready (or at the end of a reproc injection)
+	DeferIndexingInterval      uint64 // When deferring indexing, also builds deferred indexes each time this amount of blocks was written, 0 means only at the end
+	AsyncIndexing              bool   // Builds tablet indexes in a background indexer instead of inline on the write path, reads fall back to scans until the index lands
+	AsyncIndexingQueueSize     uint64 // When indexing asynchronously, maximum amount of pending indexing schedules before writes are blocked waiting for the indexer, 0 means a default of 10
+	AdaptiveIndexing           bool   // Tracks tablet reads to index more often tablets read often and expensively, and less often tablets never read
 	IgnoreIndexRangeStart      uint64 // When indexing a tablet, ignore an existing an index if it's between this range start boundary, both start/stop must be defined to be taken into account
 	IgnoreIndexRangeStop       uint64 // When indexing a tablet, ignore an existing an index if it's between this range stop boundary, both start/stop must be defined to be taken into account
 	WriteOnEachBlock           bool   // Writes to storage engine at each irreversible block, can be used in development to flush more rapidly to storage
+	WriteElisionCacheSize      uint64 // When non-zero, skips writing singlet entries and tablet rows identical to the last value written at the same key, remembering the last value of up to this amount of keys
+	MaxRowSize                 uint64 // When non-zero, singlet entries and tablet rows whose value is larger than this amount of bytes are handled according to the max row size policy
+	MaxRowSizePolicy           string // One of reject (fails the write, the default), skip (the row is not written) or truncate (the value is truncated to the max row size)
+	PipelinedFlushes           bool   // Hands full write batches over to a background flush so processing of the next blocks overlaps with the storage engine round-trip
+	TabletRowOrder             string // One of ascending (the default) or descending, the order by primary key of the rows returned by the tablet reads
+	CommittedReads             bool   // Fails the reads above the last fully committed block (the commit marker flushed after the rows of each batch), so the rows of a block partially written by a crashed flush are never served
+	BlockIDIndex               bool   // Indexes the ID of the written blocks by height, so the reads can state the block each row or entry was resolved at
+	BlockTimeIndex             bool   // Indexes the written blocks by time, so the reads can be performed at a given time
+	StartupSelfCheck           bool   // Before writing, verifies nothing was written above the last written checkpoint (scanning the whole store), refusing to start when the store looks torn by a crashed flush
+	StartupSelfCheckRepair     bool   // When the startup self-check finds keys written above the last written checkpoint, purges them instead of refusing to start
+	StartupGarbageCollection   bool   // Before writing, deletes the keys that can never be read (keys above the last written checkpoint, index snapshots of tablets without rows, orphan chunks), scanning the whole store
+
+	// Writer lease, enforces a single writer instance per store (inject mode only)
+	WriterLeaseTTL      time.Duration // When non-zero, holds a writer lease on the store (renewed periodically, expiring after this TTL) so a second writer instance fails fast instead of interleaving its writes
+	WriterLeaseTakeover bool          // Forcefully acquires the writer lease even if held by another writer, the other writer stops as soon as it notices
+
+	// Tombstone compaction, trades history below the index snapshots for storage
+	TombstoneCompactionInterval time.Duration // When non-zero (inject mode only), compacts at this interval the deletions covered by an index snapshot at or below the last irreversible block, along with the row versions they shadow, reads below the covering index of a compacted tablet then behave as if the compacted rows never existed
+
+	// Shadowed row compaction, trades history older than the retention for storage
+	HistoryRetentionBlocks        uint64        // Amount of blocks below the last irreversible block whose reads must stay exact, the shadowed row compaction never deletes a row version they need
+	HistoryRetentionMinVersions   uint64        // Minimum amount of shadowed versions a primary key must have for them to be compacted, 0 means any
+	ShadowedRowCompactionInterval time.Duration // When non-zero (inject mode only), compacts at this interval the row versions shadowed at or below the latest index snapshot before the history retention, reads below it then behave as if the compacted rows never existed
+
+	// Index fetch, tunes the multi-gets of the rows referenced by the tablet indexes on reads
+	IndexFetchChunkSize    uint64        // Amount of row keys fetched by each multi-get, 0 means a default of 5000
+	IndexFetchParallelism  uint64        // Amount of multi-gets fetched concurrently for a single tablet read, 0 means a default of 4
+	IndexFetchChunkTimeout time.Duration // When non-zero, deadline of each multi-get, a multi-get not completed in time fails the read
+
+	// Read limiting, protects the store from read storms (e.g. clients retrying during an incident)
+	MaxConcurrentReads uint64        // When non-zero, amount of heavy reads (full tablet resolutions) performed concurrently, the others being queued
+	ReadQueueTimeout   time.Duration // When non-zero, time a heavy read may be queued before failing with a too many requests error, 0 means as long as its context allows
+
+	// Read coalescing, collapses the thundering herd of identical requests hitting a popular tablet
+	EnableReadCoalescing bool // Concurrent reads of the same tablet at the same height share a single resolution
+
+	// Missing keys cache, avoids scanning the store again for tablets and singlets known to not exist
+	MissingKeysCacheSize uint64 // When non-zero, amount of tablets and singlets remembered to have no row up to a committed height, least recently used ones evicted first
+
+	// Tablet existence cache, answers the tablet existence probes from memory for the tablets known to exist
+	TabletExistenceCacheSize              uint64  // When non-zero, amount of tablets the bloom filter of the tablets known to exist is sized for, cleared once reached
+	TabletExistenceCacheFalsePositiveRate float64 // Probability of a tablet that never saw a row being reported as existing, 0 means a default of 0.000001
+
+	// Primary key bloom filters, answers the reads of absent rows without fetching the tablet index
+	EnablePrimaryKeyBloomFilters           bool    // Writes a bloom filter of the primary keys of the tablet along with each index snapshot, and uses them for the reads of a single row
+	PrimaryKeyBloomFilterFalsePositiveRate float64 // Probability of an absent primary key being reported as possibly present, 0 means a default of 0.01
+
+	// Hot keys detection, helps diagnosing storage engine hotspotting caused by skewed tablet keys
+	HotKeysSampleRate uint64        // When non-zero, samples one out of this amount of read/write keys to report the hottest tablets and row prefixes
+	HotKeysWindow     time.Duration // Sliding window over which the hottest tablets and row prefixes are reported, 0 means a default of 5 minutes
+	HotKeysTopN       uint64        // Amount of hottest tablets and row prefixes reported, 0 means a default of 20
+
+	// Cache warm-up, avoids the latency spike of the first reads after a deploy
+	WarmUpTabletKeys []string // Hex encoded keys (collection and identifier) of hot tablets whose index snapshots are preloaded at startup, before the process is declared ready
+	WarmUpRows       bool     // Also resolves the rows of the warm-up tablets, so the storage engine caches are hot too
 }
 
 type Modules struct {
@@ -70,8 +208,9 @@ type Modules struct {
 	StartBlockResolver bstream.StartBlockResolver
 
 	// Optional dependencies
-	BlockFilter func(blk *bstream.Block) error
-	BlockMeta   pbblockmeta.BlockIDClient
+	BlockFilter     func(blk *bstream.Block) error
+	BlockMeta       pbblockmeta.BlockIDClient
+	ForkableOptions []forkable.Option // Appended to the options of the pipeline forkable handler
 }
 
 type App struct {
@@ -96,11 +235,51 @@ func (a *App) Run() error {
 		return fmt.Errorf("invalid app config: %w", err)
 	}
 
-	kvStore, err := fluxdb.NewKVStore(a.config.StoreDSN)
+	kvStore, err := a.openKVStore(a.config.StoreDSN)
 	if err != nil {
 		return fmt.Errorf("unable to create store: %w", err)
 	}
 
+	if a.config.DualWriteStoreDSN != "" {
+		secondaryStore, err := a.openKVStore(a.config.DualWriteStoreDSN)
+		if err != nil {
+			return fmt.Errorf("unable to create dual-write store: %w", err)
+		}
+
+		zlog.Info("dual-write mode enabled, writes are duplicated to secondary store")
+		kvStore = dualwrite.NewStore(kvStore, secondaryStore)
+	}
+
+	if a.config.ShadowReadStoreDSN != "" {
+		shadowStore, err := a.openKVStore(a.config.ShadowReadStoreDSN)
+		if err != nil {
+			return fmt.Errorf("unable to create shadow-read store: %w", err)
+		}
+
+		shadowReadStore := shadowread.NewStore(kvStore, shadowStore)
+		if a.config.ShadowReadSampleRate > 0 {
+			shadowReadStore.SetSampleRate(a.config.ShadowReadSampleRate)
+		}
+
+		zlog.Info("shadow-read mode enabled, a sample of the reads is mirrored against shadow store", zap.Float64("sample_rate", a.config.ShadowReadSampleRate))
+		kvStore = shadowReadStore
+	}
+
+	if a.config.EnableKeyDictionary {
+		identities, err := fluxdb.KeyDictionaryIdentities()
+		if err != nil {
+			return fmt.Errorf("unable to determine key dictionary identities: %w", err)
+		}
+
+		dictionaryStore, err := keydict.NewStore(context.Background(), kvStore, identities)
+		if err != nil {
+			return fmt.Errorf("unable to load key dictionary: %w", err)
+		}
+
+		zlog.Info("key dictionary enabled, tablets are compressed in the rows keys", zap.Int("identity_count", dictionaryStore.IdentityCount()))
+		kvStore = dictionaryStore
+	}
+
 	blocksStore, err := dstore.NewDBinStore(a.config.BlockStoreURL)
 	if err != nil {
 		return fmt.Errorf("setting up source blocks store: %w", err)
@@ -121,12 +300,274 @@ func (a *App) Run() error {
 	return errors.New("invalid configuration, don't know what to start for fluxdb")
 }
 
+// The stores opened by the app instances of the process running with a store namespace, by DSN
+var sharedKVStores = struct {
+	sync.Mutex
+	byDSN map[string]store.KVStore
+}{byDSN: map[string]store.KVStore{}}
+
+// openKVStore opens the store at `dsn`, confined to the store namespace when one is configured,
+// the underlying store being then shared with the other instances of the process.
+func (a *App) openKVStore(dsn string) (store.KVStore, error) {
+	if a.config.StoreNamespace == "" {
+		return a.newKVStore(dsn)
+	}
+
+	sharedKVStores.Lock()
+	defer sharedKVStores.Unlock()
+
+	kvStore, found := sharedKVStores.byDSN[dsn]
+	if !found {
+		var err error
+		if kvStore, err = a.newKVStore(dsn); err != nil {
+			return nil, err
+		}
+
+		sharedKVStores.byDSN[dsn] = kvStore
+	}
+
+	zlog.Info("confining store to namespace", zap.String("namespace", a.config.StoreNamespace), zap.Bool("shared", found))
+	return namespace.NewStore(kvStore, a.config.StoreNamespace)
+}
+
+func (a *App) newKVStore(dsn string) (store.KVStore, error) {
+	kvStore, err := fluxdb.NewKVStore(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.StoreMaxValueSize == 0 && a.config.OverflowStoreURL == "" && a.config.ScanBudgetMaxBytes == 0 && a.config.ScanBudgetMaxDuration == 0 && !a.config.EnableStoreOperationMetrics && a.config.FlushRetryMaxRejectedKeys == 0 {
+		return kvStore, nil
+	}
+
+	engineStore, ok := kvStore.(*kv.KVStore)
+	if !ok {
+		return nil, fmt.Errorf("store of type %T does not support values chunking, overflow storage, scan budgets, operation metrics nor partitioned flush retries", kvStore)
+	}
+
+	if a.config.EnableStoreOperationMetrics {
+		engineStore.EnableOperationMetrics()
+	}
+
+	if a.config.FlushRetryMaxRejectedKeys > 0 {
+		engineStore.EnablePartitionedFlushRetry(int(a.config.FlushRetryMaxRejectedKeys))
+	}
+
+	if a.config.ScanBudgetMaxBytes > 0 || a.config.ScanBudgetMaxDuration > 0 {
+		engineStore.SetScanBudget(store.ScanBudget{
+			MaxBytes:    int(a.config.ScanBudgetMaxBytes),
+			MaxDuration: a.config.ScanBudgetMaxDuration,
+		})
+	}
+
+	if a.config.StoreMaxValueSize > 0 {
+		engineStore.SetMaxValueSize(int(a.config.StoreMaxValueSize))
+	}
+
+	if a.config.OverflowStoreURL != "" {
+		overflowStore, err := dstore.NewStore(a.config.OverflowStoreURL, "payload.zst", "zstd", false)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create overflow store: %w", err)
+		}
+
+		threshold := a.config.OverflowThreshold
+		if threshold == 0 {
+			threshold = 1024 * 1024
+		}
+
+		cacheSize := a.config.OverflowCacheSize
+		if cacheSize == 0 {
+			cacheSize = 64 * 1024 * 1024
+		}
+
+		engineStore.EnableOverflowStorage(overflowStore, int(threshold), int(cacheSize))
+	}
+
+	return engineStore, nil
+}
+
+func (a *App) enableAuditLog(db *fluxdb.FluxDB) error {
+	if a.config.AuditLogStoreURL == "" {
+		return nil
+	}
+
+	auditStore, err := dstore.NewStore(a.config.AuditLogStoreURL, "jsonl", "", false)
+	if err != nil {
+		return fmt.Errorf("unable to create audit log store: %w", err)
+	}
+
+	zlog.Info("setting up audit log", zap.String("store_url", a.config.AuditLogStoreURL))
+	db.EnableAuditLog(auditStore)
+
+	return nil
+}
+
+func (a *App) enableIncrementalBackup(db *fluxdb.FluxDB) error {
+	if a.config.IncrementalBackupStoreURL == "" || !a.config.EnableInjectMode {
+		return nil
+	}
+
+	backupStore, err := dstore.NewStore(a.config.IncrementalBackupStoreURL, "backup.zst", "zstd", true)
+	if err != nil {
+		return fmt.Errorf("unable to create incremental backup store: %w", err)
+	}
+
+	zlog.Info("setting up incremental backup", zap.String("store_url", a.config.IncrementalBackupStoreURL))
+	db.EnableIncrementalBackup(backupStore)
+
+	return nil
+}
+
 func (a *App) startStandard(blocksStore dstore.Store, kvStore store.KVStore) error {
 	db := fluxdb.New(kvStore, a.modules.BlockFilter, a.modules.BlockMapper, a.config.DisableIndexing)
+	if a.config.ReadOnly {
+		zlog.Info("setting up read-only mode, all writes to the store are rejected")
+		db.SetReadOnly()
+	}
+
+	if a.config.StoreNamespace != "" {
+		db.SetPipelineName(a.config.StoreNamespace)
+	}
+
 	if a.config.IgnoreIndexRangeStart != 0 && a.config.IgnoreIndexRangeStop != 0 {
 		db.SetIgnoreIndexRange(a.config.IgnoreIndexRangeStart, a.config.IgnoreIndexRangeStop)
 	}
 
+	if a.config.DeferIndexing {
+		zlog.Info("setting up deferred indexing", zap.Uint64("interval", a.config.DeferIndexingInterval))
+		db.SetDeferIndexing(int(a.config.DeferIndexingInterval))
+	}
+
+	if a.config.AsyncIndexing {
+		queueSize := a.config.AsyncIndexingQueueSize
+		if queueSize == 0 {
+			queueSize = 10
+		}
+
+		zlog.Info("setting up background indexer", zap.Uint64("queue_size", queueSize))
+		db.EnableAsyncIndexing(int(queueSize))
+	}
+
+	if a.config.AdaptiveIndexing {
+		zlog.Info("setting up adaptive indexing")
+		db.EnableAdaptiveIndexing()
+	}
+
+	if a.config.HotKeysSampleRate != 0 {
+		window := a.config.HotKeysWindow
+		if window == 0 {
+			window = 5 * time.Minute
+		}
+
+		topN := a.config.HotKeysTopN
+		if topN == 0 {
+			topN = 20
+		}
+
+		zlog.Info("setting up hot keys sampling", zap.Uint64("sample_rate", a.config.HotKeysSampleRate), zap.Duration("window", window), zap.Uint64("top_n", topN))
+		db.EnableHotKeysSampling(int(a.config.HotKeysSampleRate), window, int(topN))
+	}
+
+	if a.config.WriteElisionCacheSize != 0 {
+		zlog.Info("setting up write elision", zap.Uint64("cache_size", a.config.WriteElisionCacheSize))
+		db.EnableWriteElision(int(a.config.WriteElisionCacheSize))
+	}
+
+	if a.config.MaxRowSize != 0 {
+		// Already validated, see `Config.Validate`
+		policy, _ := maxRowSizePolicy(a.config.MaxRowSizePolicy)
+
+		zlog.Info("setting up max row size", zap.Uint64("max_row_size", a.config.MaxRowSize), zap.Stringer("policy", policy))
+		db.SetMaxRowSize(int(a.config.MaxRowSize), policy)
+	}
+
+	if err := a.enableAuditLog(db); err != nil {
+		return err
+	}
+
+	if err := a.enableIncrementalBackup(db); err != nil {
+		return err
+	}
+
+	if a.config.PipelinedFlushes {
+		zlog.Info("setting up pipelined flushes")
+		db.EnablePipelinedFlushes()
+	}
+
+	if a.config.CollectionWriteStatsInterval > 0 {
+		zlog.Info("setting up collection write stats", zap.Uint64("interval", a.config.CollectionWriteStatsInterval))
+		db.EnableCollectionWriteStats(int(a.config.CollectionWriteStatsInterval))
+	}
+
+	if a.config.IndexFetchChunkSize > 0 || a.config.IndexFetchParallelism > 0 || a.config.IndexFetchChunkTimeout > 0 {
+		options := fluxdb.IndexFetchOptions{
+			ChunkSize:    int(a.config.IndexFetchChunkSize),
+			Parallelism:  int(a.config.IndexFetchParallelism),
+			ChunkTimeout: a.config.IndexFetchChunkTimeout,
+		}
+
+		zlog.Info("setting up index fetch", zap.Reflect("options", options))
+		db.SetIndexFetchOptions(options)
+	}
+
+	if a.config.MaxConcurrentReads > 0 {
+		zlog.Info("setting up concurrent reads limit", zap.Uint64("max_concurrent_reads", a.config.MaxConcurrentReads), zap.Duration("queue_timeout", a.config.ReadQueueTimeout))
+		db.SetMaxConcurrentReads(int(a.config.MaxConcurrentReads), a.config.ReadQueueTimeout)
+	}
+
+	if a.config.EnableReadCoalescing {
+		zlog.Info("enabling read coalescing, concurrent reads of the same tablet at the same height share a single resolution")
+		db.EnableReadCoalescing()
+	}
+
+	if a.config.MissingKeysCacheSize > 0 {
+		zlog.Info("enabling missing keys cache", zap.Uint64("size", a.config.MissingKeysCacheSize))
+		db.EnableMissingKeysCache(int(a.config.MissingKeysCacheSize))
+	}
+
+	if a.config.TabletExistenceCacheSize > 0 {
+		zlog.Info("enabling tablet existence cache", zap.Uint64("size", a.config.TabletExistenceCacheSize), zap.Float64("false_positive_rate", a.config.TabletExistenceCacheFalsePositiveRate))
+		db.EnableTabletExistenceCache(int(a.config.TabletExistenceCacheSize), a.config.TabletExistenceCacheFalsePositiveRate)
+	}
+
+	if a.config.EnablePrimaryKeyBloomFilters {
+		zlog.Info("enabling primary key bloom filters", zap.Float64("false_positive_rate", a.config.PrimaryKeyBloomFilterFalsePositiveRate))
+		db.EnablePrimaryKeyBloomFilters(a.config.PrimaryKeyBloomFilterFalsePositiveRate)
+	}
+
+	if a.config.TabletRowOrder != "" {
+		// Already validated, see `Config.Validate`
+		order, _ := tabletRowOrder(a.config.TabletRowOrder)
+
+		zlog.Info("setting up tablet row order", zap.Stringer("order", order))
+		db.SetTabletRowOrder(order)
+	}
+
+	if a.config.CommittedReads {
+		zlog.Info("setting up committed reads")
+		db.EnableCommittedReads()
+	}
+
+	if a.config.BlockIDIndex {
+		zlog.Info("setting up block id index")
+		db.EnableBlockIDIndex()
+	}
+
+	if a.config.BlockTimeIndex {
+		zlog.Info("setting up block time index")
+		db.EnableBlockTimeIndex()
+	}
+
+	if len(a.config.WarmUpTabletKeys) > 0 {
+		tablets, err := warmUpTablets(a.config.WarmUpTabletKeys)
+		if err != nil {
+			return fmt.Errorf("invalid warm-up tablets: %w", err)
+		}
+
+		zlog.Info("setting up cache warm-up", zap.Int("tablet_count", len(tablets)), zap.Bool("resolve_rows", a.config.WarmUpRows))
+		db.EnableCacheWarmUp(tablets, a.config.WarmUpRows)
+	}
+
 	zlog.Info("initiating fluxdb handler")
 	fluxDBHandler := fluxdb.NewHandler(db)
 
@@ -139,7 +580,78 @@ func (a *App) startStandard(blocksStore dstore.Store, kvStore store.KVStore) err
 
 	db.OnTerminated(a.Shutdown)
 
+	if err := a.checkChainIdentity(db, a.config.EnableInjectMode); err != nil {
+		return err
+	}
+
+	if err := a.checkIrreversibilityCondition(db, a.config.EnableInjectMode); err != nil {
+		return err
+	}
+
+	if err := a.migrateSchema(db, a.config.EnableInjectMode); err != nil {
+		return err
+	}
+
+	if a.config.EnableServerMode && !a.config.EnableInjectMode {
+		if err := a.discoverShards(db); err != nil {
+			return err
+		}
+	}
+
+	if a.config.EnableInjectMode && a.config.WriterLeaseTTL != 0 {
+		owner := leaseOwner()
+		zlog.Info("setting up writer lease", zap.String("owner", owner), zap.Duration("ttl", a.config.WriterLeaseTTL), zap.Bool("takeover", a.config.WriterLeaseTakeover))
+		db.SetWriterLease(owner, a.config.WriterLeaseTTL, a.config.WriterLeaseTakeover)
+
+		if err := db.AcquireWriterLease(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	if a.config.EnableInjectMode && a.config.SnapshotStoreURL != "" {
+		if err := a.bootstrapFromSnapshot(db); err != nil {
+			return fmt.Errorf("bootstrap from snapshot: %w", err)
+		}
+	}
+
+	if a.config.EnableInjectMode && a.config.StartupSelfCheck {
+		if err := a.checkConsistency(db); err != nil {
+			return err
+		}
+	}
+
+	if a.config.EnableInjectMode && a.config.StartupGarbageCollection {
+		if err := a.collectGarbage(db); err != nil {
+			return err
+		}
+	}
+
+	if a.config.EnableInjectMode && a.config.TombstoneCompactionInterval > 0 {
+		zlog.Info("setting up tombstone compaction", zap.Duration("interval", a.config.TombstoneCompactionInterval))
+		db.EnableTombstoneCompaction(a.config.TombstoneCompactionInterval)
+	}
+
+	if a.config.EnableInjectMode && a.config.ShadowedRowCompactionInterval > 0 {
+		zlog.Info("setting up shadowed row compaction",
+			zap.Duration("interval", a.config.ShadowedRowCompactionInterval),
+			zap.Uint64("history_retention_blocks", a.config.HistoryRetentionBlocks),
+			zap.Uint64("history_retention_min_versions", a.config.HistoryRetentionMinVersions),
+		)
+		db.SetRetentionPolicy(fluxdb.RetentionPolicy{
+			HistoryBlocks:       a.config.HistoryRetentionBlocks,
+			MinShadowedVersions: int(a.config.HistoryRetentionMinVersions),
+		})
+		db.EnableShadowedRowCompaction(a.config.ShadowedRowCompactionInterval)
+	}
+
 	if a.config.EnableInjectMode || !a.config.DisablePipeline {
+		db.SetSourceOptions(fluxdb.SourceOptions{
+			FileSourceParallelDownloads: int(a.config.FileSourceParallelDownloads),
+			LiveSourceBufferSize:        int(a.config.LiveSourceBufferSize),
+			DisableLiveSource:           a.config.DisableLiveSource,
+			ForkableOptions:             a.modules.ForkableOptions,
+		})
+
 		db.BuildPipeline(a.modules.BlockMeta, fluxDBHandler.InitializeStartBlockID, fluxDBHandler, blocksStore, a.config.BlockStreamAddr)
 	}
 
@@ -166,6 +678,128 @@ func (a *App) startStandard(blocksStore dstore.Store, kvStore store.KVStore) err
 	return nil
 }
 
+func (a *App) bootstrapFromSnapshot(db *fluxdb.FluxDB) error {
+	snapshotStore, err := dstore.NewStore(a.config.SnapshotStoreURL, "shard.zst", "zstd", false)
+	if err != nil {
+		return fmt.Errorf("unable to create snapshot store at %s: %w", a.config.SnapshotStoreURL, err)
+	}
+
+	_, err = db.BootstrapFromSnapshot(context.Background(), snapshotStore)
+	return err
+}
+
+func maxRowSizePolicy(name string) (fluxdb.RowSizePolicy, error) {
+	if name == "" {
+		return fluxdb.RowSizePolicyReject, nil
+	}
+
+	return fluxdb.ParseRowSizePolicy(name)
+}
+
+func tabletRowOrder(name string) (fluxdb.TabletRowOrder, error) {
+	if name == "" {
+		return fluxdb.TabletRowOrderAscending, nil
+	}
+
+	return fluxdb.ParseTabletRowOrder(name)
+}
+
+func (a *App) checkChainIdentity(db *fluxdb.FluxDB, persist bool) error {
+	if a.config.ChainID == "" {
+		zlog.Warn("no chain identity configured, the store is not protected against the data of another chain")
+		return nil
+	}
+
+	if err := db.CheckChainIdentity(context.Background(), a.config.ChainID, persist); err != nil {
+		return fmt.Errorf("chain identity check: %w", err)
+	}
+
+	return nil
+}
+
+// irreversibilityCondition returns the configured irreversibility condition, already validated,
+// see `Config.Validate`.
+func (a *App) irreversibilityCondition() fluxdb.IrreversibilityCondition {
+	condition, _ := fluxdb.ParseIrreversibilityCondition(a.config.IrreversibilityCondition)
+	return condition
+}
+
+func (a *App) checkIrreversibilityCondition(db *fluxdb.FluxDB, persist bool) error {
+	db.SetIrreversibilityCondition(a.irreversibilityCondition())
+
+	if err := db.CheckIrreversibilityCondition(context.Background(), persist); err != nil {
+		return fmt.Errorf("irreversibility condition check: %w", err)
+	}
+
+	return nil
+}
+
+// migrateSchema applies the pending schema migrations when `migrate` is true (i.e. the instance
+// writes), otherwise only ensures the store schema is supported by this binary.
+func (a *App) migrateSchema(db *fluxdb.FluxDB, migrate bool) error {
+	if !migrate {
+		return db.CheckSchemaVersion(context.Background())
+	}
+
+	if err := db.MigrateSchema(context.Background(), leaseOwner()); err != nil {
+		return fmt.Errorf("schema migration: %w", err)
+	}
+
+	return nil
+}
+
+// discoverShards discovers the shards of a sharded injection writing the served store, if any,
+// so the safe serve block accounts for them without configuring the shard count.
+func (a *App) discoverShards(db *fluxdb.FluxDB) error {
+	ctx := context.Background()
+	shardCount, err := db.DiscoverShards(ctx)
+	if err != nil {
+		return fmt.Errorf("discover shards: %w", err)
+	}
+
+	if shardCount == 0 {
+		return nil
+	}
+
+	height, block, err := db.FetchSafeServeBlock(ctx)
+	var hole *fluxdb.ErrHoleInShards
+	if errors.As(err, &hole) {
+		// Committed reads fail until all shards progressed, the injection might not have started for all of them yet
+		zlog.Warn("serving a store written by shards, some shards have no progress yet", zap.Int("shard_count", shardCount), zap.Error(err))
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("fetch safe serve block: %w", err)
+	}
+
+	zlog.Info("serving a store written by shards", zap.Int("shard_count", shardCount), zap.Uint64("safe_serve_height", height), zap.Stringer("safe_serve_block", block))
+	return nil
+}
+
+func (a *App) checkConsistency(db *fluxdb.FluxDB) error {
+	zlog.Info("running startup self-check", zap.Bool("repair", a.config.StartupSelfCheckRepair))
+	report, err := db.CheckConsistency(context.Background(), a.config.StartupSelfCheckRepair)
+	if err != nil {
+		return fmt.Errorf("startup self-check: %w", err)
+	}
+
+	if !report.IsConsistent() {
+		return fmt.Errorf("startup self-check failed, %d keys were written above last written checkpoint height %d, store looks torn by a crashed flush, restart with self-check repair to purge them", report.TornKeyCount, report.CheckpointHeight)
+	}
+
+	return nil
+}
+
+func (a *App) collectGarbage(db *fluxdb.FluxDB) error {
+	zlog.Info("running startup garbage collection")
+	if _, err := db.CollectGarbage(context.Background(), false); err != nil {
+		return fmt.Errorf("startup garbage collection: %w", err)
+	}
+
+	return nil
+}
+
 func (a *App) startReprocSharder(blocksStore dstore.Store) error {
 	shardsStore, err := dstore.NewStore(a.config.ReprocShardStoreURL, "shard.zst", "zstd", true)
 	if err != nil {
@@ -183,10 +817,51 @@ func (a *App) startReprocSharder(blocksStore dstore.Store) error {
 		return fmt.Errorf("unable to create sharder: %w", err)
 	}
 
+	if err := shardingPipe.SetShardFunction(a.config.ReprocShardFunction); err != nil {
+		return fmt.Errorf("unable to set sharder shard function: %w", err)
+	}
+
+	if len(a.config.ReprocSharderCollections) > 0 {
+		zlog.Info("setting up sharder collection filter", zap.Reflect("collections", a.config.ReprocSharderCollections))
+		shardingPipe.SetCollectionFilter(a.config.ReprocSharderCollections)
+	}
+
+	if a.config.ReprocSharderStreamingUploads {
+		zlog.Info("setting up sharder streaming uploads")
+		shardingPipe.SetStreamingUploads(true)
+	}
+
+	if a.config.ReprocSharderSegmentBytes != 0 {
+		zlog.Info("setting up sharder segment byte budget", zap.Uint64("segment_bytes", a.config.ReprocSharderSegmentBytes))
+		shardingPipe.SetSegmentByteBudget(int(a.config.ReprocSharderSegmentBytes))
+	}
+
+	if a.config.ReprocSharderFilenamePadding != 0 {
+		zlog.Info("setting up sharder filename padding", zap.Uint64("width", a.config.ReprocSharderFilenamePadding))
+		shardingPipe.SetFilenamePadding(int(a.config.ReprocSharderFilenamePadding))
+	}
+
+	// The reprocessing pipeline has no FluxDB instance, the irreversibility condition is applied by its block filter
+	blockFilter, blockMeta := a.modules.BlockFilter, a.modules.BlockMeta
+	if condition := a.irreversibilityCondition(); !condition.IsNative() {
+		zlog.Info("setting up sharder irreversibility condition", zap.Stringer("condition", condition))
+		blockFilter = func(blk *bstream.Block) error {
+			condition.Apply(blk)
+			if a.modules.BlockFilter == nil {
+				return nil
+			}
+
+			return a.modules.BlockFilter(blk)
+		}
+
+		// The irreversibility checker would move the last irreversible block natively
+		blockMeta = nil
+	}
+
 	source, err := fluxdb.BuildReprocessingPipeline(
-		a.modules.BlockFilter,
+		blockFilter,
 		a.modules.BlockMapper,
-		a.modules.BlockMeta,
+		blockMeta,
 		a.modules.StartBlockResolver,
 		shardingPipe,
 		blocksStore,
@@ -206,6 +881,11 @@ func (a *App) startReprocSharder(blocksStore dstore.Store) error {
 			err = nil
 		}
 
+		// Discards the segment being written when stopped before the stop block, no-op otherwise
+		if abortErr := shardingPipe.Abort(); abortErr != nil && err == nil {
+			err = abortErr
+		}
+
 		a.Shutdown(err)
 	})
 
@@ -232,6 +912,33 @@ func appendPath(baseURL string, suffix string) (string, error) {
 	return storeURL.String(), nil
 }
 
+// leaseOwner returns an identifier unique to this process, used as the owner of shard leases
+func leaseOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+func warmUpTablets(tabletKeys []string) ([]fluxdb.Tablet, error) {
+	tablets := make([]fluxdb.Tablet, len(tabletKeys))
+	for i, tabletKey := range tabletKeys {
+		key, err := hex.DecodeString(tabletKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tablet key %q: %w", tabletKey, err)
+		}
+
+		tablets[i], err = fluxdb.NewTablet(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tablet key %q: %w", tabletKey, err)
+		}
+	}
+
+	return tablets, nil
+}
+
 func (a *App) startReprocInjector(kvStore store.KVStore) error {
 	db := fluxdb.New(kvStore, a.modules.BlockFilter, a.modules.BlockMapper, a.config.DisableIndexing)
 	if a.config.IgnoreIndexRangeStart != 0 && a.config.IgnoreIndexRangeStop != 0 {
@@ -239,15 +946,71 @@ func (a *App) startReprocInjector(kvStore store.KVStore) error {
 	}
 
 	db.SetSharding(int(a.config.ReprocInjectorShardIndex), int(a.config.ReprocShardCount))
+	if err := db.SetShardFunction(a.config.ReprocShardFunction); err != nil {
+		return fmt.Errorf("unable to set injector shard function: %w", err)
+	}
+
+	if a.config.DeferIndexing {
+		zlog.Info("setting up deferred indexing", zap.Uint64("interval", a.config.DeferIndexingInterval))
+		db.SetDeferIndexing(int(a.config.DeferIndexingInterval))
+	}
+
+	if a.config.ReprocInjectorIndexOnly {
+		zlog.Info("setting up injector in index only mode, rows are not written")
+		db.SetIndexOnly(true)
+	}
+
+	if a.config.WriteElisionCacheSize != 0 {
+		zlog.Info("setting up write elision", zap.Uint64("cache_size", a.config.WriteElisionCacheSize))
+		db.EnableWriteElision(int(a.config.WriteElisionCacheSize))
+	}
+
+	if a.config.MaxRowSize != 0 {
+		// Already validated, see `Config.Validate`
+		policy, _ := maxRowSizePolicy(a.config.MaxRowSizePolicy)
+
+		zlog.Info("setting up max row size", zap.Uint64("max_row_size", a.config.MaxRowSize), zap.Stringer("policy", policy))
+		db.SetMaxRowSize(int(a.config.MaxRowSize), policy)
+	}
+
+	if err := a.enableAuditLog(db); err != nil {
+		return err
+	}
+
+	if a.config.PipelinedFlushes {
+		zlog.Info("setting up pipelined flushes")
+		db.EnablePipelinedFlushes()
+	}
+
+	readOnly := a.config.ReprocInjectorDryRun || a.config.ReprocInjectorVerify
+
+	if err := a.checkChainIdentity(db, !readOnly); err != nil {
+		return err
+	}
+
+	if err := a.checkIrreversibilityCondition(db, !readOnly); err != nil {
+		return err
+	}
+
+	if err := a.migrateSchema(db, !readOnly); err != nil {
+		return err
+	}
 
 	// We allow re-injecting shards when disable shard reconciliation is set to true, which mean we are doing a
-	// repair job. Hence when the option is not set, we ensure the database is clean before proceeding.
-	if !a.config.DisableShardReconciliation {
+	// repair job. Hence when the option is not set, we ensure the database is clean before proceeding, the check
+	// always passing in index only mode.
+	if !a.config.DisableShardReconciliation && !readOnly {
 		if err := db.CheckCleanDBForSharding(); err != nil {
 			return fmt.Errorf("db is not clean before injecting shards: %w", err)
 		}
 	}
 
+	if a.config.StartupSelfCheck && !readOnly {
+		if err := a.checkConsistency(db); err != nil {
+			return err
+		}
+	}
+
 	shardStoreFullURL, err := appendPath(a.config.ReprocShardStoreURL, fmt.Sprintf("%03d", a.config.ReprocInjectorShardIndex))
 	if err != nil {
 		return fmt.Errorf("invalid URL, cannot append shardindex path: %w", err)
@@ -260,6 +1023,26 @@ func (a *App) startReprocInjector(kvStore store.KVStore) error {
 	}
 
 	shardInjector := fluxdb.NewShardInjector(shardStore, db)
+	if a.config.ReprocInjectorWatchInterval != 0 {
+		zlog.Info("setting up injector in watch mode", zap.Duration("watch_interval", a.config.ReprocInjectorWatchInterval))
+		shardInjector.SetWatchInterval(a.config.ReprocInjectorWatchInterval)
+	}
+
+	if a.config.ReprocInjectorLeaseTTL != 0 {
+		owner := leaseOwner()
+		zlog.Info("setting up injector shard lease", zap.String("owner", owner), zap.Duration("ttl", a.config.ReprocInjectorLeaseTTL), zap.Bool("takeover", a.config.ReprocInjectorLeaseTakeover))
+		shardInjector.SetLease(owner, a.config.ReprocInjectorLeaseTTL, a.config.ReprocInjectorLeaseTakeover)
+	}
+
+	if a.config.ReprocInjectorDryRun {
+		zlog.Info("setting up injector in dry-run mode, nothing is written")
+		shardInjector.SetMode(fluxdb.ShardInjectorModeDryRun)
+	}
+
+	if a.config.ReprocInjectorVerify {
+		zlog.Info("setting up injector in verify mode, nothing is written")
+		shardInjector.SetMode(fluxdb.ShardInjectorModeVerify)
+	}
 
 	a.OnTerminating(func(_ error) {
 		shardInjector.Shutdown(nil)
@@ -271,6 +1054,12 @@ func (a *App) startReprocInjector(kvStore store.KVStore) error {
 		return fmt.Errorf("injector failed: %w", err)
 	}
 
+	if readOnly {
+		zlog.Info("injector read only run completed, exiting", zap.Reflect("report", shardInjector.Report()))
+		a.Shutdown(nil)
+		return nil
+	}
+
 	ctx := context.Background()
 	stats, err := db.VerifyAllShardsWritten(ctx)
 	if err != nil {
@@ -315,10 +1104,50 @@ func (config *Config) Validate() error {
 		return errors.New("reproc injector mode is an exclusive option, cannot be set while any of enable server, enable injector or enable reproc injector is set")
 	}
 
+	if config.ReadOnly && (injector || reprocSharder || reprocInjector) {
+		return errors.New("read-only mode can only be used with server mode, cannot be set while any of enable injector, enable reproc sharder or enable reproc injector is set")
+	}
+
 	if (reprocSharder || reprocInjector) && config.ReprocShardCount <= 0 {
 		return errors.New("reproc mode requires you to set a shard count value higher than 0")
 	}
 
+	if config.DeferIndexing && config.DisableIndexing {
+		return errors.New("deferred indexing cannot be used while indexing is disabled")
+	}
+
+	if config.AsyncIndexing && config.DisableIndexing {
+		return errors.New("asynchronous indexing cannot be used while indexing is disabled")
+	}
+
+	if config.ReprocInjectorDryRun && config.ReprocInjectorVerify {
+		return errors.New("reproc injector dry-run and verify modes are mutually exclusive")
+	}
+
+	if config.ReprocSharderStreamingUploads && config.ReprocSharderSegmentBytes != 0 {
+		return errors.New("reproc sharder segment bytes cannot be set while streaming uploads, streamed segments cannot be cut")
+	}
+
+	if config.AdaptiveIndexing && config.DisableIndexing {
+		return errors.New("adaptive indexing cannot be used while indexing is disabled")
+	}
+
+	if config.ReprocInjectorIndexOnly && config.DisableIndexing {
+		return errors.New("reproc injector index only mode cannot be used while indexing is disabled")
+	}
+
+	if _, err := maxRowSizePolicy(config.MaxRowSizePolicy); err != nil {
+		return fmt.Errorf("invalid max row size policy: %w", err)
+	}
+
+	if _, err := tabletRowOrder(config.TabletRowOrder); err != nil {
+		return fmt.Errorf("invalid tablet row order: %w", err)
+	}
+
+	if _, err := fluxdb.ParseIrreversibilityCondition(config.IrreversibilityCondition); err != nil {
+		return fmt.Errorf("invalid irreversibility condition: %w", err)
+	}
+
 	if reprocInjector && config.ReprocInjectorShardIndex >= config.ReprocShardCount {
 		return fmt.Errorf("reproc injector mode shard index invalid, got index %d but it's outside possible value for a shard count of %d", config.ReprocInjectorShardIndex, config.ReprocShardCount)
 	}
@@ -0,0 +1,149 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+)
+
+// AuditEvent is a single entry of the audit log, see `EnableAuditLog`.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+
+	// Instance identifies the process that performed the operation
+	Instance string `json:"instance"`
+
+	// Identity is the caller on behalf of which the operation was performed (see `WithCaller`),
+	// empty for operations performed by the process itself (e.g. writing blocks)
+	Identity string `json:"identity,omitempty"`
+
+	Operation string                 `json:"operation"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+// EnableAuditLog records the write batches, purges, prunes, index rebuilds and administrative
+// operations (see `RecordAuditEvent`) in an append-only audit log. Each event is written as a
+// JSON line to its own object of `auditStore` before the operation returns, and the operation
+// fails when its event cannot be written, so no audited operation goes unrecorded. Objects are
+// named after the time they were written at and the process instance, so they never collide
+// and sort chronologically.
+func (fdb *FluxDB) EnableAuditLog(auditStore dstore.Store) {
+	fdb.auditLog = newAuditLog(auditStore, auditInstance())
+}
+
+// RecordAuditEvent records an operation in the audit log, for administrative operations
+// performed outside of FluxDB (e.g. admin API invocations). Does nothing if the audit log is
+// not enabled, returns an error when the event could not be written.
+func (fdb *FluxDB) RecordAuditEvent(ctx context.Context, operation string, details map[string]interface{}, err error) error {
+	return fdb.auditLog.record(ctx, operation, details, err)
+}
+
+// recordAuditEvent records the outcome of an operation, `err` being the operation's error, which
+// is set when the event could not be written and the operation succeeded otherwise.
+func (fdb *FluxDB) recordAuditEvent(ctx context.Context, operation string, details map[string]interface{}, err *error) {
+	if auditErr := fdb.auditLog.record(ctx, operation, details, *err); auditErr != nil && *err == nil {
+		*err = auditErr
+	}
+}
+
+func (fdb *FluxDB) auditWriteBatch(ctx context.Context, requests []*WriteRequest, err *error) {
+	if fdb.auditLog == nil || len(requests) == 0 {
+		return
+	}
+
+	singletEntryCount, tabletRowCount := 0, 0
+	for _, request := range requests {
+		singletEntryCount += len(request.SingletEntries)
+		tabletRowCount += len(request.TabletRows)
+	}
+
+	fdb.recordAuditEvent(ctx, "write_batch", map[string]interface{}{
+		"first_height":        requests[0].Height,
+		"last_height":         requests[len(requests)-1].Height,
+		"block_count":         len(requests),
+		"singlet_entry_count": singletEntryCount,
+		"tablet_row_count":    tabletRowCount,
+	}, err)
+}
+
+func tabletString(tablet Tablet) string {
+	if tablet == nil {
+		return ""
+	}
+
+	return tablet.String()
+}
+
+type auditLog struct {
+	store    dstore.Store
+	instance string
+
+	// Serializes the writes, so objects are written in order
+	lock     sync.Mutex
+	sequence uint64
+}
+
+func newAuditLog(auditStore dstore.Store, instance string) *auditLog {
+	return &auditLog{store: auditStore, instance: instance}
+}
+
+func auditInstance() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// record writes an event to a new object of the audit store, safe to call on a `nil` audit log,
+// in which case nothing is recorded.
+func (l *auditLog) record(ctx context.Context, operation string, details map[string]interface{}, err error) error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	event := &AuditEvent{Time: time.Now().UTC(), Instance: l.instance, Operation: operation, Details: details}
+	event.Identity, _ = CallerFromContext(ctx)
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(buffer).Encode(event); err != nil {
+		return fmt.Errorf("encode audit event %q: %w", operation, err)
+	}
+
+	// The sequence keeps names unique and ordered for events recorded within the same timestamp
+	l.sequence++
+	name := fmt.Sprintf("%s-%s-%010d", event.Time.Format("20060102T150405.000000000Z"), l.instance, l.sequence)
+	if err := l.store.WriteObject(ctx, name, buffer); err != nil {
+		return fmt.Errorf("write audit event %q to object %q: %w", operation, name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package fluxdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	dir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	auditStore, err := dstore.NewLocalStore(dir, "", "", false)
+	require.NoError(t, err)
+	db.EnableAuditLog(auditStore)
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 1, "002", "r #1")}},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), TabletRows: []TabletRow{tablet.row(t, 2, "002", "r #2")}},
+	)
+
+	start, end := []byte{0x00}, []byte{0x01}
+	_, err = db.DeleteRange(ctx, store.RowsTable, start, end, DeleteRangeOptions{DryRun: true})
+	require.NoError(t, err)
+
+	adminCtx := WithCaller(ctx, "operator")
+	_, err = db.DeleteRange(adminCtx, store.RowsTable, start, end, DeleteRangeOptions{ConfirmationToken: DeleteRangeConfirmationToken(store.RowsTable, start, end)})
+	require.NoError(t, err)
+
+	require.NoError(t, db.RecordAuditEvent(adminCtx, "admin_call", map[string]interface{}{"path": "/v0/reindex"}, errors.New("failed")))
+
+	events := readAuditEvents(t, auditStore)
+	require.Len(t, events, 3)
+
+	assert.Equal(t, "write_batch", events[0].Operation)
+	assert.Equal(t, "", events[0].Identity)
+	assert.Equal(t, map[string]interface{}{
+		"first_height":        float64(1),
+		"last_height":         float64(2),
+		"block_count":         float64(2),
+		"singlet_entry_count": float64(0),
+		"tablet_row_count":    float64(3),
+	}, events[0].Details)
+
+	assert.Equal(t, "delete_range", events[1].Operation)
+	assert.Equal(t, "operator", events[1].Identity)
+	assert.Equal(t, "rows", events[1].Details["table"])
+	assert.Equal(t, "", events[1].Error)
+
+	assert.Equal(t, "admin_call", events[2].Operation)
+	assert.Equal(t, "operator", events[2].Identity)
+	assert.Equal(t, "failed", events[2].Error)
+
+	for _, event := range events {
+		assert.NotEmpty(t, event.Instance)
+		assert.False(t, event.Time.IsZero())
+	}
+}
+
+func TestAuditLog_Disabled(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	// Must not panic when the audit log is not enabled
+	require.NoError(t, db.RecordAuditEvent(context.Background(), "admin_call", nil, nil))
+}
+
+func TestAuditLog_WriteFailure(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	dir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	auditStore, err := dstore.NewLocalStore(dir, "", "", false)
+	require.NoError(t, err)
+	db.EnableAuditLog(auditStore)
+
+	// The audit store directory is replaced by a file, so writing the event fails, and the operation with it
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, ioutil.WriteFile(dir, nil, 0644))
+
+	tablet := newTestTablet("tbl")
+	err = db.WriteBatch(context.Background(), []*WriteRequest{
+		{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1")}},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "write audit event \"write_batch\"")
+
+	assert.Error(t, db.RecordAuditEvent(context.Background(), "admin_call", nil, nil))
+}
+
+func readAuditEvents(t *testing.T, auditStore dstore.Store) (events []*AuditEvent) {
+	ctx := context.Background()
+	require.NoError(t, auditStore.Walk(ctx, "", "", func(filename string) error {
+		reader, err := auditStore.OpenObject(ctx, filename)
+		require.NoError(t, err)
+		defer reader.Close()
+
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			event := &AuditEvent{}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), event))
+			events = append(events, event)
+		}
+
+		return scanner.Err()
+	}))
+
+	return events
+}
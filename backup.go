@@ -0,0 +1,90 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/dbin"
+	"github.com/dfuse-io/dstore"
+	"github.com/golang/protobuf/proto"
+)
+
+// The zero-padding width of the heights in the incremental backup object names, wide enough for
+// any 64-bit height so the objects are listed in height order
+const incrementalBackupFilenamePadding = 20
+
+type incrementalBackup struct {
+	store dstore.Store
+}
+
+// EnableIncrementalBackup appends each write batch, before it's committed, to the received
+// store as an object named `<first height>-<last height>`, in the same format as the reproc
+// sharder segments, forming a continuous incremental backup from which any store state can be
+// rebuilt by replay, see `ReplayIncrementalBackup`. Compression is the one of the store.
+//
+// A batch failing to be backed up fails the write, so the backup never has holes. A batch whose
+// commit failed after being backed up is backed up again when retried, replays skip the heights
+// already written.
+func (fdb *FluxDB) EnableIncrementalBackup(backupStore dstore.Store) {
+	fdb.backup = &incrementalBackup{store: backupStore}
+}
+
+func (b *incrementalBackup) write(ctx context.Context, w []*WriteRequest) error {
+	if b == nil || len(w) == 0 {
+		return nil
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	encoder := dbin.NewWriter(buffer)
+	if err := encoder.WriteHeader(shardBinaryContentType, shardBinaryVersion); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	for _, req := range w {
+		protoRequest, err := req.ToProto()
+		if err != nil {
+			return fmt.Errorf("request to proto: %w", err)
+		}
+
+		message, err := proto.Marshal(protoRequest)
+		if err != nil {
+			return fmt.Errorf("marshal proto: %w", err)
+		}
+
+		if err := encoder.WriteMessage(message); err != nil {
+			return fmt.Errorf("write message: %w", err)
+		}
+	}
+
+	name := fmt.Sprintf("%0*d-%0*d", incrementalBackupFilenamePadding, w[0].Height, incrementalBackupFilenamePadding, w[len(w)-1].Height)
+	if err := b.store.WriteObject(ctx, name, buffer); err != nil {
+		return fmt.Errorf("write object %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// ReplayIncrementalBackup writes the batches of the incremental backup store (see
+// `EnableIncrementalBackup`) above the last written checkpoint, up to `stopHeight` included (all
+// of them when 0), and returns the height of the last written block, see `RebuildFromArchive`.
+//
+// **Important** The incremental backup must not be enabled with the replayed backup store as
+// its destination.
+func (fdb *FluxDB) ReplayIncrementalBackup(ctx context.Context, backupStore dstore.Store, stopHeight uint64) (lastHeight uint64, err error) {
+	return fdb.RebuildFromArchive(ctx, backupStore, RebuildOptions{StopHeight: stopHeight})
+}
@@ -0,0 +1,72 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrementalBackup(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	dir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	backupStore, err := dstore.NewLocalStore(dir, "", "", true)
+	require.NoError(t, err)
+	db.EnableIncrementalBackup(backupStore)
+
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), BlockTime: base, TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1")}},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), BlockTime: base.Add(time.Second), SingletEntries: []SingletEntry{singlet.entry(t, 2, "s #2")}},
+	)
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), BlockTime: base.Add(2 * time.Second), TabletRows: []TabletRow{tablet.row(t, 3, "001", "")}},
+	)
+
+	filenames, err := backupStore.ListFiles(ctx, "", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"00000000000000000001-00000000000000000002", "00000000000000000003-00000000000000000003"}, filenames)
+
+	t.Run("replay up to stop height", func(t *testing.T) {
+		replayed, closer := NewTestDB(t)
+		defer closer()
+
+		replayed.EnableBlockTimeIndex()
+
+		lastHeight, err := replayed.ReplayIncrementalBackup(ctx, backupStore, 2)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), lastHeight)
+
+		rows, err := replayed.ReadTabletAt(ctx, 2, tablet, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "r #1")}, rows)
+
+		entry, err := replayed.ReadSingletEntryAt(ctx, singlet, 2, nil)
+		require.NoError(t, err)
+		assert.Equal(t, singlet.entry(t, 2, "s #2"), entry)
+
+		blockTime, err := replayed.ResolveTimeForHeight(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, base.Add(time.Second), blockTime)
+
+		// Resuming skips what was already replayed
+		lastHeight, err = replayed.ReplayIncrementalBackup(ctx, backupStore, 0)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), lastHeight)
+
+		rows, err = replayed.ReadTabletAt(ctx, 3, tablet, nil)
+		require.NoError(t, err)
+		assert.Empty(t, rows)
+	})
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+)
+
+var blockIDSingletCollection uint16 = 0xFFFD
+var blockIDSingletCollectionName string = "blkid"
+
+func init() {
+	registerSingletFactory(blockIDSingletCollection, blockIDSingletCollectionName, func(identifier []byte) (Singlet, error) {
+		return blockIDSinglet{}, nil
+	})
+}
+
+// blockIDSinglet indexes the written blocks by height, its entries are stored at the block
+// height, their value being the block ID.
+type blockIDSinglet struct{}
+
+func (s blockIDSinglet) Collection() uint16 {
+	return blockIDSingletCollection
+}
+
+func (s blockIDSinglet) Identifier() []byte {
+	return nil
+}
+
+func (s blockIDSinglet) Entry(at uint64, value []byte) (SingletEntry, error) {
+	return NewBaseSingletEntry(s, at, value), nil
+}
+
+func (s blockIDSinglet) String() string {
+	return blockIDSingletCollectionName
+}
+
+func newBlockIDEntry(height uint64, blockID string) BaseSingletEntry {
+	return NewBaseSingletEntry(blockIDSinglet{}, height, []byte(blockID))
+}
+
+// EnableBlockIDIndex indexes the ID of the written blocks by height, so the reads resolving the
+// rows and entries (see `ReadTabletAtResolved`) can state the ID of the block they were last
+// mutated at. The blocks written before it was enabled have no block ID.
+func (fdb *FluxDB) EnableBlockIDIndex() {
+	fdb.blockIDIndex = true
+}
+
+// ResolvedAt is the height, and the ID of the block at that height, a row or an entry read was
+// last mutated at, see `ReadTabletAtResolved` and `ReadSingletEntryAtResolved`.
+type ResolvedAt struct {
+	Height uint64
+
+	// BlockID is empty when unknown, i.e. when the block is neither one of the speculative writes
+	// nor indexed (see `EnableBlockIDIndex`) and the row has no provenance
+	BlockID string
+}
+
+// ReadTabletAtResolved reads the rows of the tablet like `ReadTabletAt`, returning along with
+// them the height and block ID each of them was resolved at, `resolved[i]` being the one of
+// `rows[i]`.
+func (fdb *FluxDB) ReadTabletAtResolved(
+	ctx context.Context,
+	height uint64,
+	tablet Tablet,
+	speculativeWrites []*WriteRequest,
+) (rows []TabletRow, resolved []ResolvedAt, err error) {
+	rows, err = fdb.ReadTabletAt(ctx, height, tablet, speculativeWrites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolver := fdb.newBlockIDResolver(speculativeWrites)
+	resolved = make([]ResolvedAt, len(rows))
+	for i, row := range rows {
+		blockID, found := "", false
+		if provenance, hasProvenance := TabletRowProvenance(row); hasProvenance {
+			blockID, found = provenance.BlockID, true
+		}
+
+		if !found {
+			if blockID, err = resolver.resolve(ctx, row.Height()); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		resolved[i] = ResolvedAt{Height: row.Height(), BlockID: blockID}
+	}
+
+	return rows, resolved, nil
+}
+
+// ReadSingletEntryAtResolved reads the entry of the singlet like `ReadSingletEntryAt`,
+// returning along with it the height and block ID it was resolved at, zero when there is no
+// entry.
+func (fdb *FluxDB) ReadSingletEntryAtResolved(
+	ctx context.Context,
+	singlet Singlet,
+	height uint64,
+	speculativeWrites []*WriteRequest,
+) (entry SingletEntry, resolved ResolvedAt, err error) {
+	entry, err = fdb.ReadSingletEntryAt(ctx, singlet, height, speculativeWrites)
+	if err != nil || entry == nil {
+		return nil, ResolvedAt{}, err
+	}
+
+	blockID, err := fdb.newBlockIDResolver(speculativeWrites).resolve(ctx, entry.Height())
+	if err != nil {
+		return nil, ResolvedAt{}, err
+	}
+
+	return entry, ResolvedAt{Height: entry.Height(), BlockID: blockID}, nil
+}
+
+// blockIDResolver resolves the block ID of heights, from the speculative writes first and
+// then from the block ID index, caching the ones already resolved.
+type blockIDResolver struct {
+	fdb      *FluxDB
+	blockIDs map[uint64]string
+}
+
+func (fdb *FluxDB) newBlockIDResolver(speculativeWrites []*WriteRequest) *blockIDResolver {
+	blockIDs := map[uint64]string{}
+	for _, write := range speculativeWrites {
+		if write.BlockRef != nil {
+			blockIDs[write.Height] = write.BlockRef.ID()
+		}
+	}
+
+	return &blockIDResolver{fdb: fdb, blockIDs: blockIDs}
+}
+
+func (r *blockIDResolver) resolve(ctx context.Context, height uint64) (string, error) {
+	if blockID, found := r.blockIDs[height]; found {
+		return blockID, nil
+	}
+
+	// Read from the store directly, it's an internal read not subject to the read interceptors
+	singlet := blockIDSinglet{}
+	key, value, err := r.fdb.store.FetchSingletEntry(ctx, KeyForSingletAt(singlet, height), KeyForSingletAt(singlet, 0))
+	if err != nil {
+		return "", fmt.Errorf("read block id index: %w", err)
+	}
+
+	blockID := ""
+	if len(key) > 0 {
+		entry, err := NewSingletEntry(singlet, key, value)
+		if err != nil {
+			return "", fmt.Errorf("invalid block id index entry %q: %w", Key(key), err)
+		}
+
+		// A lower entry is the one of another block, the one at height was not indexed
+		if entry.Height() == height {
+			blockID = string(entry.(BaseSingletEntry).Value())
+		}
+	}
+
+	r.blockIDs[height] = blockID
+	return blockID, nil
+}
@@ -0,0 +1,56 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTabletAtResolved(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+
+	// Written before the block ID index is enabled, its block ID is unknown
+	writeBatchOfRequests(t, db, &WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "a")}})
+
+	db.EnableBlockIDIndex()
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:         2,
+			BlockRef:       bstream.NewBlockRef("00000002aa", 2),
+			TabletRows:     []TabletRow{tablet.row(t, 2, "002", "b")},
+			SingletEntries: []SingletEntry{singlet.entry(t, 2, "s")},
+		},
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3)},
+	)
+
+	speculativeWrites := []*WriteRequest{
+		{Height: 4, BlockRef: bstream.NewBlockRef("00000004aa", 4), PreviousBlockID: "00000003aa", TabletRows: []TabletRow{tablet.row(t, 4, "003", "c")}},
+	}
+
+	rows, resolved, err := db.ReadTabletAtResolved(ctx, 4, tablet, speculativeWrites)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "a"), tablet.row(t, 2, "002", "b"), tablet.row(t, 4, "003", "c")}, rows)
+	assert.Equal(t, []ResolvedAt{
+		{Height: 1},
+		{Height: 2, BlockID: "00000002aa"},
+		{Height: 4, BlockID: "00000004aa"},
+	}, resolved)
+
+	entry, resolvedEntry, err := db.ReadSingletEntryAtResolved(ctx, singlet, 3, nil)
+	require.NoError(t, err)
+	assert.Equal(t, singlet.entry(t, 2, "s"), entry)
+	assert.Equal(t, ResolvedAt{Height: 2, BlockID: "00000002aa"}, resolvedEntry)
+
+	entry, resolvedEntry, err = db.ReadSingletEntryAtResolved(ctx, singlet, 1, nil)
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+	assert.Equal(t, ResolvedAt{}, resolvedEntry)
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoBlockAtTime is returned when resolving a time at which no block was written yet.
+var ErrNoBlockAtTime = errors.New("no block written at or before time")
+
+// ErrNoBlockAtHeight is returned when resolving a height at which no block whose time is known
+// was written yet.
+var ErrNoBlockAtHeight = errors.New("no block written at or below height")
+
+var blockTimeSingletCollection uint16 = 0xFFFE
+var blockTimeSingletCollectionName string = "blktime"
+
+// Kinds of block time index, used as the identifier of their singlet
+const (
+	blockTimeToHeight byte = 't'
+	blockHeightToTime byte = 'h'
+)
+
+func init() {
+	registerSingletFactory(blockTimeSingletCollection, blockTimeSingletCollectionName, func(identifier []byte) (Singlet, error) {
+		if len(identifier) < 1 || (identifier[0] != blockTimeToHeight && identifier[0] != blockHeightToTime) {
+			return nil, fmt.Errorf("unknown block time index kind %q", identifier)
+		}
+
+		return blockTimeSinglet{kind: identifier[0]}, nil
+	})
+}
+
+// EnableBlockTimeIndex indexes the written blocks by time, see `ReadTabletAtTime`. The blocks
+// written before it was enabled, or without a block time, are not indexed.
+func (fdb *FluxDB) EnableBlockTimeIndex() {
+	fdb.blockTimeIndex = true
+}
+
+// blockTimeSinglet indexes the written blocks by time. The entries of the time to height index
+// are stored at the block time, in milliseconds since the Unix epoch, instead of at a height,
+// their value being the height of the last block written at that time, so reading the entry at a
+// given time resolves the height of the last block written at or before it. The entries of the
+// height to time index are stored at the block height, their value being the block time.
+type blockTimeSinglet struct {
+	kind byte
+}
+
+func (s blockTimeSinglet) Collection() uint16 {
+	return blockTimeSingletCollection
+}
+
+func (s blockTimeSinglet) Identifier() []byte {
+	return []byte{s.kind}
+}
+
+func (s blockTimeSinglet) Entry(at uint64, value []byte) (SingletEntry, error) {
+	if len(value) != 8 {
+		return nil, fmt.Errorf("invalid block time index value length, expected 8 bytes, got %d", len(value))
+	}
+
+	return blockTimeSingletEntry{BaseSingletEntry: NewBaseSingletEntry(s, at, value)}, nil
+}
+
+func (s blockTimeSinglet) String() string {
+	return blockTimeSingletCollectionName + ":" + string(s.kind)
+}
+
+type blockTimeSingletEntry struct {
+	BaseSingletEntry
+}
+
+func newBlockTimeToHeightEntry(blockTime time.Time, height uint64) blockTimeSingletEntry {
+	value := make([]byte, 8)
+	bigEndian.PutUint64(value, height)
+
+	return blockTimeSingletEntry{
+		BaseSingletEntry: NewBaseSingletEntry(blockTimeSinglet{kind: blockTimeToHeight}, blockTimeIndexAt(blockTime), value),
+	}
+}
+
+func newBlockHeightToTimeEntry(blockTime time.Time, height uint64) blockTimeSingletEntry {
+	value := make([]byte, 8)
+	bigEndian.PutUint64(value, blockTimeIndexAt(blockTime))
+
+	return blockTimeSingletEntry{
+		BaseSingletEntry: NewBaseSingletEntry(blockTimeSinglet{kind: blockHeightToTime}, height, value),
+	}
+}
+
+func (e blockTimeSingletEntry) value() uint64 {
+	return bigEndian.Uint64(e.Value())
+}
+
+func blockTimeIndexAt(blockTime time.Time) uint64 {
+	return uint64(blockTime.UnixNano() / int64(time.Millisecond))
+}
+
+func blockTimeFromIndex(at uint64) time.Time {
+	return time.Unix(0, int64(at)*int64(time.Millisecond)).UTC()
+}
+
+// ReadTabletAtTime reads the tablet as it was at the last block written at or before
+// `blockTime`, returning the rows along with the height they were read at, see
+// `ResolveHeightForTime`.
+func (fdb *FluxDB) ReadTabletAtTime(ctx context.Context, blockTime time.Time, tablet Tablet) ([]TabletRow, uint64, error) {
+	height, err := fdb.ResolveHeightForTime(ctx, blockTime)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := fdb.ReadTabletAt(ctx, height, tablet, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rows, height, nil
+}
+
+// ResolveHeightForTime returns the height of the last block written at or before `blockTime`,
+// `ErrNoBlockAtTime` when there is none. Only blocks whose time is known, those mapped by the
+// pipeline (see `NewPreprocessBlock`), are indexed by time, once enabled (see
+// `EnableBlockTimeIndex`).
+func (fdb *FluxDB) ResolveHeightForTime(ctx context.Context, blockTime time.Time) (uint64, error) {
+	if blockTime.Before(time.Unix(0, 0)) {
+		return 0, fmt.Errorf("%w %s", ErrNoBlockAtTime, blockTime)
+	}
+
+	height, found, err := fdb.readBlockTimeIndex(ctx, blockTimeToHeight, blockTimeIndexAt(blockTime))
+	if err != nil {
+		return 0, err
+	}
+
+	if !found {
+		return 0, fmt.Errorf("%w %s", ErrNoBlockAtTime, blockTime)
+	}
+
+	return height, nil
+}
+
+// ResolveTimeForHeight returns the time, with a millisecond precision, of the block written at
+// `height`, or of the last block written below it when the time of this one is unknown,
+// `ErrNoBlockAtHeight` when there is none.
+func (fdb *FluxDB) ResolveTimeForHeight(ctx context.Context, height uint64) (time.Time, error) {
+	at, found, err := fdb.readBlockTimeIndex(ctx, blockHeightToTime, height)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !found {
+		return time.Time{}, fmt.Errorf("%w %d", ErrNoBlockAtHeight, height)
+	}
+
+	return blockTimeFromIndex(at), nil
+}
+
+// readBlockTimeIndex returns the value of the entry of the block time index of `kind` stored at
+// or below `at`, if any.
+func (fdb *FluxDB) readBlockTimeIndex(ctx context.Context, kind byte, at uint64) (value uint64, found bool, err error) {
+	// Read from the store directly, it's an internal read not subject to the read interceptors
+	singlet := blockTimeSinglet{kind: kind}
+	key, rawValue, err := fdb.store.FetchSingletEntry(ctx, KeyForSingletAt(singlet, at), KeyForSingletAt(singlet, 0))
+	if err != nil {
+		return 0, false, fmt.Errorf("read block time index: %w", err)
+	}
+
+	if len(key) == 0 {
+		return 0, false, nil
+	}
+
+	entry, err := NewSingletEntry(singlet, key, rawValue)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid block time index entry %q: %w", Key(key), err)
+	}
+
+	return entry.(blockTimeSingletEntry).value(), true, nil
+}
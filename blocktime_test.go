@@ -0,0 +1,132 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTabletAtTime(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.EnableBlockTimeIndex()
+
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), BlockTime: base, TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1")}},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), BlockTime: base.Add(500 * time.Millisecond), TabletRows: []TabletRow{tablet.row(t, 2, "002", "r #2")}},
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), TabletRows: []TabletRow{tablet.row(t, 3, "003", "r #3")}},
+		&WriteRequest{Height: 4, BlockRef: bstream.NewBlockRef("00000004aa", 4), BlockTime: base.Add(2 * time.Second), TabletRows: []TabletRow{tablet.row(t, 4, "001", "r #4")}},
+	)
+
+	tests := []struct {
+		name           string
+		at             time.Time
+		expectedHeight uint64
+		expectedRows   []TabletRow
+	}{
+		{"exactly at first block", base, 1, []TabletRow{tablet.row(t, 1, "001", "r #1")}},
+		{"between blocks", base.Add(time.Second), 2, []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 2, "002", "r #2")}},
+		{"after last block", base.Add(time.Hour), 4, []TabletRow{tablet.row(t, 4, "001", "r #4"), tablet.row(t, 2, "002", "r #2"), tablet.row(t, 3, "003", "r #3")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, height, err := db.ReadTabletAtTime(ctx, test.at, tablet)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expectedHeight, height)
+			assert.ElementsMatch(t, test.expectedRows, rows)
+		})
+	}
+
+	_, _, err := db.ReadTabletAtTime(ctx, base.Add(-time.Millisecond), tablet)
+	assert.True(t, errors.Is(err, ErrNoBlockAtTime), "expected no block error, got %s", err)
+
+	report, err := db.CheckConsistency(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.TornKeyCount, "block time index entries must not be seen as written above the checkpoint")
+}
+
+func TestResolveHeightAndTime(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.EnableBlockTimeIndex()
+
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), BlockTime: base},
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), BlockTime: base.Add(1500 * time.Millisecond)},
+		&WriteRequest{Height: 4, BlockRef: bstream.NewBlockRef("00000004aa", 4)},
+	)
+
+	height, err := db.ResolveHeightForTime(ctx, base.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), height)
+
+	_, err = db.ResolveHeightForTime(ctx, base.Add(-time.Second))
+	assert.True(t, errors.Is(err, ErrNoBlockAtTime), "expected no block error, got %s", err)
+
+	blockTime, err := db.ResolveTimeForHeight(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, base.Add(1500*time.Millisecond), blockTime)
+
+	blockTime, err = db.ResolveTimeForHeight(ctx, 4)
+	require.NoError(t, err)
+	assert.Equal(t, base.Add(1500*time.Millisecond), blockTime, "time of a block not indexed should be the one of the previous block")
+
+	_, err = db.ResolveTimeForHeight(ctx, 1)
+	assert.True(t, errors.Is(err, ErrNoBlockAtHeight), "expected no block error, got %s", err)
+}
+
+func TestBlockTimeIndex_NotEnabled(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeBatchOfRequests(t, db, &WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), BlockTime: base})
+
+	_, err := db.ResolveHeightForTime(ctx, base)
+	assert.True(t, errors.Is(err, ErrNoBlockAtTime), "expected no block error, got %s", err)
+
+	_, err = db.ResolveTimeForHeight(ctx, 1)
+	assert.True(t, errors.Is(err, ErrNoBlockAtHeight), "expected no block error, got %s", err)
+}
+
+func TestWriteRequest_ProtoBlockTime(t *testing.T) {
+	singlet := newTestSinglet("sgl")
+	request := &WriteRequest{
+		Height:         1,
+		BlockRef:       bstream.NewBlockRef("00000001aa", 1),
+		BlockTime:      time.Date(2021, 1, 1, 0, 0, 1, int(250*time.Millisecond), time.UTC),
+		SingletEntries: []SingletEntry{singlet.entry(t, 1, "s #1")},
+	}
+
+	protoRequest, err := request.ToProto()
+	require.NoError(t, err)
+
+	decoded, err := NewWriteRequestFromProto(protoRequest)
+	require.NoError(t, err)
+	assert.Equal(t, request.BlockTime, decoded.BlockTime)
+	assert.Equal(t, request.SingletEntries, decoded.SingletEntries, "the block time entry is not part of the singlet entries")
+
+	request.BlockTime = time.Time{}
+	protoRequest, err = request.ToProto()
+	require.NoError(t, err)
+
+	decoded, err = NewWriteRequestFromProto(protoRequest)
+	require.NoError(t, err)
+	assert.True(t, decoded.BlockTime.IsZero())
+	assert.Equal(t, request.SingletEntries, decoded.SingletEntries)
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter is a set of keys answering whether a key was added to it with false positives but
+// no false negatives, in a fixed amount of memory. It's not safe for concurrent use.
+type bloomFilter struct {
+	bits      []uint64
+	hashCount int
+}
+
+// newBloomFilter returns a filter sized so a key that was not added is reported as added with a
+// probability of `falsePositiveRate` (between 0 and 1, exclusive) once `capacity` keys were.
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	// The optimal size of the filter is `-n * ln(p) / ln(2)^2` bits, probed by `m / n * ln(2)` hashes
+	bitCount := int(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashCount := int(math.Round(float64(bitCount) / float64(capacity) * math.Ln2))
+	if hashCount < 1 {
+		hashCount = 1
+	}
+
+	return &bloomFilter{
+		bits:      make([]uint64, (bitCount+63)/64),
+		hashCount: hashCount,
+	}
+}
+
+func (f *bloomFilter) add(key []byte) {
+	h1, h2 := bloomHashes(key)
+	for i := 0; i < f.hashCount; i++ {
+		bit := f.bit(h1, h2, i)
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// contains returns whether the key was possibly added, `false` meaning it was definitely not.
+func (f *bloomFilter) contains(key []byte) bool {
+	h1, h2 := bloomHashes(key)
+	for i := 0; i < f.hashCount; i++ {
+		bit := f.bit(h1, h2, i)
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *bloomFilter) clear() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
+
+// bit returns the bit of the filter set by the i-th hash, derived from the two hashes of the key
+// as `h1 + i * h2` (Kirsch-Mitzenmacher), which performs as well as independent hashes.
+func (f *bloomFilter) bit(h1, h2 uint64, i int) uint64 {
+	return (h1 + uint64(i)*h2) % uint64(len(f.bits)*64)
+}
+
+// bloomHashes returns the two hashes the ones of the filter are derived from, see `bit`.
+func bloomHashes(key []byte) (uint64, uint64) {
+	hasher := fnv.New64a()
+	hasher.Write(key)
+	sum := hasher.Sum64()
+
+	return sum, sum>>32 | 1
+}
+
+// The persisted filter is the CRC32 (IEEE) checksum (4 bytes) of the rest of the value, the
+// amount of hashes (1 byte) and the bits of the filter (8 bytes per word), all big endian
+const bloomFilterHeaderSize = 5
+
+func (f *bloomFilter) marshal() []byte {
+	value := make([]byte, bloomFilterHeaderSize+8*len(f.bits))
+	value[4] = byte(f.hashCount)
+	for i, word := range f.bits {
+		bigEndian.PutUint64(value[bloomFilterHeaderSize+8*i:], word)
+	}
+
+	bigEndian.PutUint32(value, crc32.ChecksumIEEE(value[4:]))
+	return value
+}
+
+func unmarshalBloomFilter(value []byte) (*bloomFilter, error) {
+	if len(value) <= bloomFilterHeaderSize || (len(value)-bloomFilterHeaderSize)%8 != 0 {
+		return nil, fmt.Errorf("invalid bloom filter length %d", len(value))
+	}
+
+	expected := bigEndian.Uint32(value)
+	if actual := crc32.ChecksumIEEE(value[4:]); actual != expected {
+		return nil, fmt.Errorf("checksum mismatch, expected %08x, got %08x", expected, actual)
+	}
+
+	if value[4] == 0 {
+		return nil, fmt.Errorf("invalid bloom filter hash count 0")
+	}
+
+	filter := &bloomFilter{
+		bits:      make([]uint64, (len(value)-bloomFilterHeaderSize)/8),
+		hashCount: int(value[4]),
+	}
+	for i := range filter.bits {
+		filter.bits[i] = bigEndian.Uint64(value[bloomFilterHeaderSize+8*i:])
+	}
+
+	return filter, nil
+}
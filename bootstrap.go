@@ -0,0 +1,194 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// IsEmpty returns `true` when nothing was ever written to the underlying store, i.e.
+// when there is no last written checkpoint for this instance.
+func (fdb *FluxDB) IsEmpty(ctx context.Context) (bool, error) {
+	_, lastBlock, err := fdb.FetchLastWrittenCheckpoint(ctx)
+	if err != nil {
+		return false, fmt.Errorf("fetch last written checkpoint: %w", err)
+	}
+
+	return bstream.EqualsBlockRefs(lastBlock, bstream.BlockRefEmpty), nil
+}
+
+// BootstrapFromSnapshot loads the snapshot segments found in `snapshotStore` as the base
+// state of an empty database. The rows of the segments are written as is, without going
+// through the write path of the blocks, and a single checkpoint is written at the snapshot's
+// height H once all of them are, so the pipeline naturally starts back at H+1. The tablets
+// are indexed once loaded.
+//
+// Snapshot segments are in the exact same format as the reproc sharder output for a single
+// shard, i.e. `<first>-<last>` named files containing a stream of write requests. The first
+// segment can start at any height, but following segments must be contiguous.
+//
+// When the database is not empty, this is a no-op and `false` is returned.
+func (fdb *FluxDB) BootstrapFromSnapshot(ctx context.Context, snapshotStore dstore.Store) (bootstrapped bool, err error) {
+	if err := fdb.checkWritable("bootstrap from snapshot"); err != nil {
+		return false, err
+	}
+
+	empty, err := fdb.IsEmpty(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if !empty {
+		zlog.Info("database is not empty, skipping bootstrap from snapshot")
+		return false, nil
+	}
+
+	zlog.Info("database is empty, bootstrapping from snapshot")
+
+	batch := fdb.store.NewBatch(zlog)
+
+	var lastNum uint64
+	var last *WriteRequest
+	segmentCount := 0
+	err = snapshotStore.Walk(ctx, "", "", func(filename string) error {
+		if filename == shardingConfigFilename {
+			return nil
+		}
+
+		fileFirst, fileLast, err := parseFileName(filename)
+		if err != nil {
+			return err
+		}
+
+		if segmentCount > 0 && fileFirst != lastNum+1 {
+			return fmt.Errorf("snapshot segment %s starts at block %d, we were expecting to start right after %d, there is a hole in your snapshot segments", filename, fileFirst, lastNum)
+		}
+
+		zlog.Info("loading snapshot segment", zap.String("filename", filename))
+		reader, err := snapshotStore.OpenObject(ctx, filename)
+		if err != nil {
+			return fmt.Errorf("opening object from snapshot store %q: %w", filename, err)
+		}
+		defer reader.Close()
+
+		requests, err := ReadShard(reader, 0)
+		if err != nil {
+			return fmt.Errorf("unable to read all write requests in segment %q: %w", filename, err)
+		}
+
+		for _, request := range requests {
+			if err := fdb.loadSnapshotRequest(ctx, batch, request); err != nil {
+				return fmt.Errorf("load segment %q: %w", filename, err)
+			}
+
+			last = request
+		}
+
+		lastNum = fileLast
+		segmentCount++
+		return nil
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("walking snapshot store: %w", err)
+	}
+
+	if last == nil {
+		zlog.Warn("snapshot store contains no write request, nothing bootstrapped", zap.Int("segment_count", segmentCount))
+		return false, nil
+	}
+
+	// The rows flushed so far are not visible until the checkpoint is written, a bootstrap
+	// interrupted before it is started over on an empty database
+	if err := fdb.setLastCheckpoint(batch, last.Height, last.BlockRef); err != nil {
+		return false, fmt.Errorf("set last written checkpoint: %w", err)
+	}
+
+	if err := fdb.setCheckpoint(batch, lastIrreversibleRowKey, last.Height, last.BlockRef); err != nil {
+		return false, fmt.Errorf("set last irreversible checkpoint: %w", err)
+	}
+
+	if err := batch.Flush(ctx); err != nil {
+		return false, fmt.Errorf("final flush: %w", err)
+	}
+
+	if err := fdb.writeCommitMarker(ctx, last.Height, last.BlockRef); err != nil {
+		return false, fmt.Errorf("write commit marker: %w", err)
+	}
+
+	if err := fdb.IndexTables(ctx); err != nil {
+		return false, fmt.Errorf("index tables: %w", err)
+	}
+
+	zlog.Info("bootstrapped database from snapshot",
+		zap.Int("segment_count", segmentCount),
+		zap.Uint64("height", last.Height),
+		zap.Stringer("block", last.BlockRef),
+	)
+	return true, nil
+}
+
+// loadSnapshotRequest adds the singlet entries and tablet rows of the snapshot write request to
+// the batch, accounting for the tablet rows in indexing.
+func (fdb *FluxDB) loadSnapshotRequest(ctx context.Context, batch store.Batch, request *WriteRequest) error {
+	for _, entry := range request.SingletEntries {
+		var value []byte
+		if !entry.IsDeletion() {
+			var err error
+			if value, err = entry.MarshalValue(); err != nil {
+				return fmt.Errorf("singlet to proto: %w", err)
+			}
+		}
+
+		batch.SetRow(KeyForSingletEntry(entry), value)
+	}
+
+	ordinals := tabletRowOrdinals(request.TabletRows)
+	for i, row := range request.TabletRows {
+		tablet := row.Tablet()
+
+		ordinal := uint32(LastTabletRowOrdinal)
+		if ordinals != nil {
+			ordinal = ordinals[i]
+		}
+
+		value, err := marshalTabletRowValue(row)
+		if err != nil {
+			return fmt.Errorf("tablet to proto: %w", err)
+		}
+
+		batch.SetRow(KeyForTabletRowVersion(tablet, row.Height(), ordinal, row.PrimaryKey()), value)
+
+		if !fdb.disableIndexing {
+			tabletKey := KeyForTablet(tablet)
+			fdb.idxCache.IncCount(tabletKey)
+			if fdb.idxCache.shouldTriggerIndexing(tabletKey) {
+				fdb.idxCache.ScheduleIndex(tabletKey, request.Height)
+			}
+		}
+	}
+
+	if _, err := batch.FlushIfFull(ctx); err != nil {
+		return fmt.Errorf("flushing if full: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package fluxdb
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapFromSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	shardsStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+
+	sharder, err := NewSharder(shardsStore, "", 1, 1, 2)
+	require.NoError(t, err)
+
+	tablet := newTestTablet("tb1")
+	singlet := newTestSinglet("sg1")
+
+	streamBlock(t, sharder, "00000001aa", "", writeRequest(
+		[]SingletEntry{singlet.entry(t, 1, "s1 e #1")},
+		[]TabletRow{tablet.row(t, 1, "001", "t1 r1 #1")}),
+	)
+
+	streamBlock(t, sharder, "00000002aa", "", writeRequest(
+		[]SingletEntry{singlet.entry(t, 2, "s1 e #2")},
+		[]TabletRow{tablet.row(t, 2, "002", "t1 r2 #2")}),
+	)
+
+	endBlock(t, sharder, "00000003aa")
+
+	snapshotStore, err := dstore.NewLocalStore(path.Join(storeDir, "000"), "", "", false)
+	require.NoError(t, err)
+
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	var reports []FlushReport
+	require.True(t, db.OnFlush(func(report FlushReport) {
+		reports = append(reports, report)
+	}))
+
+	bootstrapped, err := db.BootstrapFromSnapshot(ctx, snapshotStore)
+	require.NoError(t, err)
+	require.True(t, bootstrapped)
+
+	// The rows are loaded directly, along a single checkpoint at H, not block per block
+	require.Len(t, reports, 1)
+	require.Contains(t, reports[0].Tables, "rows")
+	assert.Equal(t, 4, reports[0].Tables["rows"].MutationCount)
+	require.Contains(t, reports[0].Tables, "checkpoint")
+	assert.Equal(t, 2, reports[0].Tables["checkpoint"].MutationCount)
+
+	height, blockRef, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), height)
+	assert.Equal(t, "00000002aa", blockRef.ID())
+
+	entry, err := db.ReadSingletEntryAt(ctx, singlet, 2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, singlet.entry(t, 2, "s1 e #2"), entry)
+
+	row, err := db.ReadTabletRowAt(ctx, 2, tablet, testTabletRowPrimaryKey("001"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, tablet.row(t, 1, "001", "t1 r1 #1"), row)
+
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "t1 r1 #1"), tablet.row(t, 2, "002", "t1 r2 #2")}, rows)
+
+	bootstrapped, err = db.BootstrapFromSnapshot(ctx, snapshotStore)
+	require.NoError(t, err)
+	assert.False(t, bootstrapped, "a non-empty database should never be bootstrapped again")
+}
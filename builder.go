@@ -0,0 +1,185 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+)
+
+// WriteRequestBuilder builds the write request of a block, validating its rows and entries as
+// they are appended, see `NewWriteRequestFor`.
+type WriteRequestBuilder struct {
+	request *WriteRequest
+	err     error
+
+	// Only set when keeping the last mutations only, see `KeepLastMutations`
+	rowIndexByKey   map[string]int
+	entryIndexByKey map[string]int
+}
+
+// NewWriteRequestFor starts building the write request of the block, its height, reference and
+// time being the ones of the block. The errors of the appended rows and entries are reported by
+// `Build`, the calls can then be chained:
+//
+//	request, err := fluxdb.NewWriteRequestFor(blk).AppendRow(row).DeleteRow(tablet, primaryKey).Build()
+func NewWriteRequestFor(block *bstream.Block) *WriteRequestBuilder {
+	if block == nil {
+		return &WriteRequestBuilder{request: &WriteRequest{}, err: errors.New("block is required")}
+	}
+
+	return &WriteRequestBuilder{request: &WriteRequest{
+		Height:          block.Num(),
+		BlockRef:        block.AsRef(),
+		PreviousBlockID: block.PreviousID(),
+		BlockTime:       block.Time(),
+	}}
+}
+
+// Height returns the height of the request, the one of the rows and entries appended to it.
+func (b *WriteRequestBuilder) Height() uint64 {
+	return b.request.Height
+}
+
+// KeepLastMutations only keeps the last mutation of a row or entry appended more than once,
+// at the position of its first append, instead of all of them.
+func (b *WriteRequestBuilder) KeepLastMutations() *WriteRequestBuilder {
+	b.rowIndexByKey = map[string]int{}
+	b.entryIndexByKey = map[string]int{}
+	return b
+}
+
+// AppendRow appends the mutation of a tablet row, it must be at the height of the request.
+func (b *WriteRequestBuilder) AppendRow(row TabletRow) *WriteRequestBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if row == nil {
+		b.err = fmt.Errorf("tablet row #%d: row is required", len(b.request.TabletRows))
+		return b
+	}
+
+	key := KeyForTabletRow(row)
+	if err := b.validate(key, row.Height(), row.IsDeletion(), row.MarshalValue); err != nil {
+		b.err = fmt.Errorf("tablet row %s: %w", row, err)
+		return b
+	}
+
+	if b.rowIndexByKey != nil {
+		if index, found := b.rowIndexByKey[string(key)]; found {
+			b.request.TabletRows[index] = row
+			return b
+		}
+
+		b.rowIndexByKey[string(key)] = len(b.request.TabletRows)
+	}
+
+	b.request.TabletRows = append(b.request.TabletRows, row)
+	return b
+}
+
+// DeleteRow appends the deletion of the tablet row with the primary key.
+func (b *WriteRequestBuilder) DeleteRow(tablet Tablet, primaryKey []byte) *WriteRequestBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	row, err := tablet.Row(b.request.Height, primaryKey, nil)
+	if err != nil {
+		b.err = fmt.Errorf("tablet %s deletion row %q: %w", tablet, Key(primaryKey), err)
+		return b
+	}
+
+	return b.AppendRow(row)
+}
+
+// AppendEntry appends the mutation of a singlet entry, it must be at the height of the request.
+func (b *WriteRequestBuilder) AppendEntry(entry SingletEntry) *WriteRequestBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if entry == nil {
+		b.err = fmt.Errorf("singlet entry #%d: entry is required", len(b.request.SingletEntries))
+		return b
+	}
+
+	key := KeyForSingletEntry(entry)
+	if err := b.validate(key, entry.Height(), entry.IsDeletion(), entry.MarshalValue); err != nil {
+		b.err = fmt.Errorf("singlet entry %s: %w", entry, err)
+		return b
+	}
+
+	if b.entryIndexByKey != nil {
+		if index, found := b.entryIndexByKey[string(key)]; found {
+			b.request.SingletEntries[index] = entry
+			return b
+		}
+
+		b.entryIndexByKey[string(key)] = len(b.request.SingletEntries)
+	}
+
+	b.request.SingletEntries = append(b.request.SingletEntries, entry)
+	return b
+}
+
+// DeleteEntry appends the deletion of the singlet.
+func (b *WriteRequestBuilder) DeleteEntry(singlet Singlet) *WriteRequestBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	entry, err := singlet.Entry(b.request.Height, nil)
+	if err != nil {
+		b.err = fmt.Errorf("singlet %s deletion entry: %w", singlet, err)
+		return b
+	}
+
+	return b.AppendEntry(entry)
+}
+
+func (b *WriteRequestBuilder) validate(key []byte, height uint64, isDeletion bool, marshalValue func() ([]byte, error)) error {
+	if height != b.request.Height {
+		return fmt.Errorf("height %d does not match the request height %d", height, b.request.Height)
+	}
+
+	if _, found := collections[collectionFromKey(key)]; !found {
+		return fmt.Errorf("unknown collection 0x%04X", collectionFromKey(key))
+	}
+
+	if isDeletion {
+		return nil
+	}
+
+	value, err := marshalValue()
+	if err != nil {
+		return fmt.Errorf("marshal value: %w", err)
+	}
+
+	return validateValue(key, value)
+}
+
+// Build returns the write request, or the first error of the appended rows and entries. The
+// builder must not be used anymore afterwards.
+func (b *WriteRequestBuilder) Build() (*WriteRequest, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return b.request, nil
+}
@@ -0,0 +1,79 @@
+package fluxdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteRequestBuilder(t *testing.T) {
+	blockTime := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	blk := &bstream.Block{Id: "00000005aa", Number: 5, PreviousId: "00000004aa", Timestamp: blockTime}
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+
+	request, err := NewWriteRequestFor(blk).
+		AppendRow(tablet.row(t, 5, "001", "a")).
+		AppendRow(tablet.row(t, 5, "001", "b")).
+		DeleteRow(tablet, []byte("002")).
+		AppendEntry(singlet.entry(t, 5, "c")).
+		DeleteEntry(newTestSinglet("del")).
+		Build()
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(5), request.Height)
+	assert.Equal(t, blk.AsRef(), request.BlockRef)
+	assert.Equal(t, "00000004aa", request.PreviousBlockID)
+	assert.Equal(t, blockTime, request.BlockTime)
+
+	deletedRow, err := tablet.Row(5, []byte("002"), nil)
+	require.NoError(t, err)
+	deletedEntry, err := newTestSinglet("del").Entry(5, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []TabletRow{tablet.row(t, 5, "001", "a"), tablet.row(t, 5, "001", "b"), deletedRow}, request.TabletRows)
+	assert.Equal(t, []SingletEntry{singlet.entry(t, 5, "c"), deletedEntry}, request.SingletEntries)
+
+	request, err = NewWriteRequestFor(blk).KeepLastMutations().
+		AppendRow(tablet.row(t, 5, "001", "a")).
+		AppendRow(tablet.row(t, 5, "002", "b")).
+		AppendRow(tablet.row(t, 5, "001", "")).
+		AppendEntry(singlet.entry(t, 5, "c")).
+		AppendEntry(singlet.entry(t, 5, "d")).
+		Build()
+	require.NoError(t, err)
+
+	assert.Equal(t, []TabletRow{tablet.row(t, 5, "001", ""), tablet.row(t, 5, "002", "b")}, request.TabletRows)
+	assert.Equal(t, []SingletEntry{singlet.entry(t, 5, "d")}, request.SingletEntries)
+}
+
+func TestWriteRequestBuilder_Errors(t *testing.T) {
+	blk := &bstream.Block{Id: "00000005aa", Number: 5}
+	tablet := newTestTablet("tbl")
+
+	_, err := NewWriteRequestFor(nil).Build()
+	assert.Equal(t, errors.New("block is required"), err)
+
+	_, err = NewWriteRequestFor(blk).AppendRow(nil).Build()
+	assert.Equal(t, errors.New("tablet row #0: row is required"), err)
+
+	_, err = NewWriteRequestFor(blk).AppendRow(tablet.row(t, 4, "001", "a")).AppendRow(tablet.row(t, 5, "002", "b")).Build()
+	assert.EqualError(t, err, "tablet row tst:tbl:0000000000000004:001: height 4 does not match the request height 5")
+
+	RegisterValueValidator(testTabletCollection, func(value []byte) error {
+		return errors.New("rejected")
+	})
+	defer delete(valueValidators, testTabletCollection)
+
+	_, err = NewWriteRequestFor(blk).AppendRow(tablet.row(t, 5, "001", "a")).Build()
+	var invalid *ErrInvalidValue
+	assert.True(t, errors.As(err, &invalid))
+
+	_, err = NewWriteRequestFor(blk).DeleteRow(tablet, []byte("001")).Build()
+	assert.NoError(t, err, "deletions are not validated")
+}
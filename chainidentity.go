@@ -0,0 +1,76 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// The checkpoint table key under which the identity of the chain the store belongs to is
+// persisted, must not start with `shard-` since this prefix is reserved to the shards last
+// written checkpoint.
+var chainIdentityKey = []byte("config-chain-identity")
+
+// ErrChainIdentityMismatch is the error returned by `CheckChainIdentity` when the store belongs
+// to another chain than the configured one.
+var ErrChainIdentityMismatch = errors.New("chain identity mismatch")
+
+// CheckChainIdentity validates that the store belongs to the chain identified by `chainID` (e.g.
+// the chain id or network name of the configured source), returning an error wrapping
+// `ErrChainIdentityMismatch` if it belongs to another one, so a pipeline can never write the
+// data of a chain into the store of another one. When the store has no chain identity yet, it's
+// persisted if `persist` is true, the store then belongs to this chain from now on.
+func (fdb *FluxDB) CheckChainIdentity(ctx context.Context, chainID string, persist bool) error {
+	if chainID == "" {
+		return errors.New("chain identity cannot be empty")
+	}
+
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, chainIdentityKey)
+	if errors.Is(err, store.ErrNotFound) {
+		if !persist {
+			zlog.Info("store has no chain identity yet, not persisting it", zap.String("chain_id", chainID))
+			return nil
+		}
+
+		zlog.Info("persisting chain identity", zap.String("chain_id", chainID))
+		return fdb.writeChainIdentity(ctx, chainID)
+	}
+
+	if err != nil {
+		return fmt.Errorf("fetch persisted chain identity: %w", err)
+	}
+
+	if persisted := string(value); persisted != chainID {
+		return fmt.Errorf("store belongs to chain %q but configured chain is %q: %w", persisted, chainID, ErrChainIdentityMismatch)
+	}
+
+	return nil
+}
+
+func (fdb *FluxDB) writeChainIdentity(ctx context.Context, chainID string) error {
+	batch := fdb.store.NewBatch(zlog)
+	batch.SetLastCheckpoint(chainIdentityKey, []byte(chainID))
+
+	if err := batch.Flush(ctx); err != nil {
+		return fmt.Errorf("write chain identity: %w", err)
+	}
+
+	return nil
+}
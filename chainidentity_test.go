@@ -0,0 +1,29 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckChainIdentity(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	require.NoError(t, db.CheckChainIdentity(ctx, "testnet", false))
+	require.NoError(t, db.CheckChainIdentity(ctx, "mainnet", false), "nothing was persisted without persist")
+
+	require.NoError(t, db.CheckChainIdentity(ctx, "mainnet", true))
+	require.NoError(t, db.CheckChainIdentity(ctx, "mainnet", true))
+	require.NoError(t, db.CheckChainIdentity(ctx, "mainnet", false))
+
+	err := db.CheckChainIdentity(ctx, "testnet", true)
+	assert.True(t, errors.Is(err, ErrChainIdentityMismatch), "expected chain identity mismatch, got %s", err)
+	assert.EqualError(t, err, `store belongs to chain "mainnet" but configured chain is "testnet": chain identity mismatch`)
+
+	assert.Error(t, db.CheckChainIdentity(ctx, "", true))
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// TabletChange is a mutation of a tablet row, see `IterateTabletChanges`.
+type TabletChange struct {
+	Height     uint64
+	PrimaryKey []byte
+
+	// Old is the row before the mutation, `nil` when the row did not exist
+	Old TabletRow
+
+	// New is the row after the mutation, `nil` when the row was deleted
+	New TabletRow
+}
+
+// IsInsertion returns whether the row did not exist before the mutation.
+func (c *TabletChange) IsInsertion() bool {
+	return c.Old == nil
+}
+
+// IsDeletion returns whether the row does not exist anymore after the mutation.
+func (c *TabletChange) IsDeletion() bool {
+	return c.New == nil
+}
+
+// IterateTabletChanges calls `onChange` with each mutation of the tablet rows stored at a height
+// within [fromHeight, toHeight], ordered by height, then by primary key (by ordinal first for
+// collections with row ordinals enabled, see `EnableTabletRowOrdinals`). Each mutation holds the
+// row before it, as of the tablet at `fromHeight - 1` or the previous mutation of the range, and
+// the row after it, so the evolution of the tablet can be replayed block by block. Return
+// `store.BreakScan` from `onChange` to stop the iteration early.
+//
+// The rows before the range are read once, with a single filtered read of the tablet limited to
+// the primary keys mutated in the range, which are scanned beforehand without their values.
+//
+// **Important** Only the stored versions are iterated, the deletions of rows that did not exist
+// are skipped and the rows elided at write time (see `EnableWriteElision`) or compacted (see
+// `CompactShadowedRows`) are not part of the evolution.
+func (fdb *FluxDB) IterateTabletChanges(ctx context.Context, tablet Tablet, fromHeight, toHeight uint64, onChange func(change *TabletChange) error) error {
+	if fromHeight > toHeight {
+		return fmt.Errorf("invalid height range, from height %d is above to height %d", fromHeight, toHeight)
+	}
+
+	ctx, err := fdb.interceptRead(ctx, ReadOperationTablet, tablet, nil, toHeight)
+	if err != nil {
+		return err
+	}
+
+	if toHeight, err = fdb.committedReadHeight(ctx, toHeight, nil); err != nil {
+		return err
+	}
+
+	if fromHeight > toHeight {
+		return nil
+	}
+
+	startKey := KeyForTabletAt(tablet, fromHeight)
+	endKey := keySuccessor(KeyForTablet(tablet))
+	if toHeight < math.MaxUint64 {
+		endKey = KeyForTabletAt(tablet, toHeight+1)
+	}
+
+	mutated := map[string]bool{}
+	err = fdb.store.ScanTableKeys(ctx, store.RowsTable, startKey, endKey, func(key []byte) error {
+		row, err := NewTabletRow(tablet, key, nil)
+		if err != nil {
+			return fmt.Errorf("tablet new row %q: %w", Key(key), err)
+		}
+
+		mutated[string(row.PrimaryKey())] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scan tablet %s row keys: %w", tablet, err)
+	}
+
+	if len(mutated) == 0 {
+		return nil
+	}
+
+	current := make(map[string]TabletRow, len(mutated))
+	if fromHeight > 0 {
+		filter := &TabletRowFilter{Match: func(primaryKey []byte) bool { return mutated[string(primaryKey)] }}
+		rows, err := fdb.ReadTabletAtWithFilter(ctx, fromHeight-1, tablet, filter, nil)
+		if err != nil {
+			return fmt.Errorf("read tablet %s before height %d: %w", tablet, fromHeight, err)
+		}
+
+		for _, row := range rows {
+			current[string(row.PrimaryKey())] = row
+		}
+	}
+
+	err = fdb.store.ScanTabletRows(ctx, startKey, endKey, func(key []byte, value []byte) error {
+		row, err := NewTabletRow(tablet, key, value)
+		if err != nil {
+			return fmt.Errorf("tablet new row %q: %w", Key(key), err)
+		}
+
+		primaryKey := string(row.PrimaryKey())
+		change := &TabletChange{Height: row.Height(), PrimaryKey: row.PrimaryKey(), Old: current[primaryKey]}
+		if !row.IsDeletion() {
+			change.New = row
+		}
+
+		if change.Old == nil && change.New == nil {
+			return nil
+		}
+
+		current[primaryKey] = change.New
+		return onChange(change)
+	})
+	if err != nil && err != store.BreakScan {
+		return fmt.Errorf("scan tablet %s rows: %w", tablet, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterateTabletChanges(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	otherTablet := newTestTablet("oth")
+	writeBatchOfRequests(t, db,
+		tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b")),
+		tabletRows(2, tablet.row(t, 2, "001", "c"), tablet.row(t, 2, "003", "d"), otherTablet.row(t, 2, "001", "x")),
+		tabletRows(3, tablet.row(t, 3, "002", ""), tablet.row(t, 3, "004", "")),
+		tabletRows(4, tablet.row(t, 4, "002", "e"), tablet.row(t, 4, "003", "f")),
+	)
+
+	tests := []struct {
+		name       string
+		fromHeight uint64
+		toHeight   uint64
+		expected   []string
+	}{
+		{"whole history", 0, 10, []string{
+			"1 001 <nil> -> a",
+			"1 002 <nil> -> b",
+			"2 001 a -> c",
+			"2 003 <nil> -> d",
+			"3 002 b -> <nil>",
+			"4 002 <nil> -> e",
+			"4 003 d -> f",
+		}},
+		{"old rows before range", 3, 4, []string{
+			"3 002 b -> <nil>",
+			"4 002 <nil> -> e",
+			"4 003 d -> f",
+		}},
+		{"single height", 2, 2, []string{
+			"2 001 a -> c",
+			"2 003 <nil> -> d",
+		}},
+		{"no change in range", 5, 10, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var changes []string
+			err := db.IterateTabletChanges(ctx, tablet, test.fromHeight, test.toHeight, func(change *TabletChange) error {
+				changes = append(changes, fmt.Sprintf("%d %s %s -> %s", change.Height, change.PrimaryKey, testChangeData(change.Old), testChangeData(change.New)))
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, changes)
+		})
+	}
+
+	count := 0
+	err := db.IterateTabletChanges(ctx, tablet, 0, 10, func(change *TabletChange) error {
+		count++
+		return store.BreakScan
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	err = db.IterateTabletChanges(ctx, tablet, 5, 4, nil)
+	assert.EqualError(t, err, "invalid height range, from height 5 is above to height 4")
+}
+
+func testChangeData(row TabletRow) string {
+	if row == nil {
+		return "<nil>"
+	}
+
+	return row.(testTabletRow).data()
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client reads a remote FluxDB instance, served by the `server/remote` package, through
+// the same `fluxdb.Reader` interface as an embedded `*fluxdb.FluxDB`, so application code can
+// switch between embedded and remote deployments without changes. The collections read must be
+// registered in the client process too, the rows and entries being decoded by their factories.
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/dfuse-io/fluxdb/server/remote"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Client is a `fluxdb.Reader` reading a remote FluxDB instance, safe for concurrent use.
+//
+// A read canceled or whose deadline expired returns an error wrapping `context.Canceled` or
+// `context.DeadlineExceeded`, the other failures are gRPC status errors (see `status.Code`),
+// `codes.ResourceExhausted` for a server out of read slots (see `fluxdb.ErrTooManyRequests`),
+// which can be retried later, and `codes.OutOfRange` for a read above the last block committed
+// by the server (see `fluxdb.ErrUncommittedHeight`).
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+var _ fluxdb.Reader = (*Client)(nil)
+
+// Dial returns a client of the read service at `address` (`<host>:<port>`), connected lazily
+// over a plain text connection unless `options` specify otherwise.
+func Dial(address string, options ...grpc.DialOption) (*Client, error) {
+	conn, err := grpc.Dial(address, append([]grpc.DialOption{grpc.WithInsecure()}, options...)...)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", address, err)
+	}
+
+	return New(conn), nil
+}
+
+// New returns a client of the read service reached through `conn`, owned by the client from now
+// on, see `Close`.
+func New(conn *grpc.ClientConn) *Client {
+	return &Client{conn: conn}
+}
+
+// Close closes the connection of the client.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) ReadTabletAt(ctx context.Context, height uint64, tablet fluxdb.Tablet, speculativeWrites []*fluxdb.WriteRequest) ([]fluxdb.TabletRow, error) {
+	request, err := newReadRequest(height, speculativeWrites)
+	if err != nil {
+		return nil, err
+	}
+	request.TabletKey = fluxdb.KeyForTablet(tablet)
+
+	response := &remote.ReadResponse{}
+	if err := c.invoke(ctx, remote.MethodReadTablet, request, response); err != nil {
+		return nil, err
+	}
+
+	rows := make([]fluxdb.TabletRow, len(response.Entries))
+	for i, entry := range response.Entries {
+		if rows[i], err = fluxdb.NewTabletRowFromStorage(entry.Key, entry.Value); err != nil {
+			return nil, fmt.Errorf("tablet row %q: %w", fluxdb.Key(entry.Key), err)
+		}
+	}
+
+	return rows, nil
+}
+
+func (c *Client) ReadTabletRowAt(ctx context.Context, height uint64, tablet fluxdb.Tablet, primaryKey fluxdb.TabletRowPrimaryKey, speculativeWrites []*fluxdb.WriteRequest) (fluxdb.TabletRow, error) {
+	request, err := newReadRequest(height, speculativeWrites)
+	if err != nil {
+		return nil, err
+	}
+	request.TabletKey = fluxdb.KeyForTablet(tablet)
+	request.PrimaryKey = primaryKey.Bytes()
+
+	response := &remote.ReadResponse{}
+	if err := c.invoke(ctx, remote.MethodReadTabletRow, request, response); err != nil {
+		return nil, err
+	}
+
+	if len(response.Entries) == 0 {
+		return nil, nil
+	}
+
+	row, err := fluxdb.NewTabletRowFromStorage(response.Entries[0].Key, response.Entries[0].Value)
+	if err != nil {
+		return nil, fmt.Errorf("tablet row %q: %w", fluxdb.Key(response.Entries[0].Key), err)
+	}
+
+	return row, nil
+}
+
+func (c *Client) ReadSingletEntryAt(ctx context.Context, singlet fluxdb.Singlet, height uint64, speculativeWrites []*fluxdb.WriteRequest) (fluxdb.SingletEntry, error) {
+	request, err := newReadRequest(height, speculativeWrites)
+	if err != nil {
+		return nil, err
+	}
+	request.SingletKey = fluxdb.KeyForSinglet(singlet)
+
+	response := &remote.ReadResponse{}
+	if err := c.invoke(ctx, remote.MethodReadSingletEntry, request, response); err != nil {
+		return nil, err
+	}
+
+	if len(response.Entries) == 0 {
+		return nil, nil
+	}
+
+	entry, err := fluxdb.NewSingletEntryFromStorage(response.Entries[0].Key, response.Entries[0].Value)
+	if err != nil {
+		return nil, fmt.Errorf("singlet entry %q: %w", fluxdb.Key(response.Entries[0].Key), err)
+	}
+
+	return entry, nil
+}
+
+// HeadBlock returns the last block written to the store of the remote instance,
+// `bstream.BlockRefEmpty` when nothing was written yet.
+func (c *Client) HeadBlock(ctx context.Context) (bstream.BlockRef, error) {
+	response := &remote.HeadBlockResponse{}
+	if err := c.invoke(ctx, remote.MethodHeadBlock, &remote.HeadBlockRequest{}, response); err != nil {
+		return nil, err
+	}
+
+	if response.BlockID == "" {
+		return bstream.BlockRefEmpty, nil
+	}
+
+	return bstream.NewBlockRef(response.BlockID, response.BlockNum), nil
+}
+
+func newReadRequest(height uint64, speculativeWrites []*fluxdb.WriteRequest) (*remote.ReadRequest, error) {
+	encoded, err := remote.EncodeSpeculativeWrites(speculativeWrites)
+	if err != nil {
+		return nil, fmt.Errorf("encode speculative writes: %w", err)
+	}
+
+	return &remote.ReadRequest{Height: height, SpeculativeWrites: encoded}, nil
+}
+
+func (c *Client) invoke(ctx context.Context, method string, request interface{}, response interface{}) error {
+	err := c.conn.Invoke(ctx, "/"+remote.ServiceName+"/"+method, request, response, grpc.CallContentSubtype(remote.CodecName))
+	if err == nil {
+		return nil
+	}
+
+	switch status.Code(err) {
+	case codes.Canceled:
+		return fmt.Errorf("remote call: %w", context.Canceled)
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("remote call: %w", context.DeadlineExceeded)
+	}
+
+	return err
+}
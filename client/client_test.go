@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/dfuse-io/fluxdb/fluxdbtest"
+	"github.com/dfuse-io/fluxdb/server/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClient(t *testing.T) {
+	db, closer := fluxdbtest.NewTestDB(t)
+	defer closer()
+
+	tablet := fluxdbtest.NewTablet("tbl")
+	singlet := fluxdbtest.NewSinglet("sgl")
+	fluxdbtest.WriteBatchOfRequests(t, db,
+		&fluxdb.WriteRequest{
+			Height:         1,
+			BlockRef:       bstream.NewBlockRef("00000001a", 1),
+			TabletRows:     []fluxdb.TabletRow{tablet.MustRow(t, 1, "001", "a"), tablet.MustRow(t, 1, "002", "b")},
+			SingletEntries: []fluxdb.SingletEntry{singlet.MustEntry(t, 1, "s")},
+		},
+	)
+
+	client, closeClient := newTestClient(t, db)
+	defer closeClient()
+	ctx := context.Background()
+
+	var reader fluxdb.Reader = client
+	rows, err := reader.ReadTabletAt(ctx, 1, tablet, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, tablet.MustRow(t, 1, "001", "a"), rows[0])
+	assert.Equal(t, tablet.MustRow(t, 1, "002", "b"), rows[1])
+
+	rows, err = reader.ReadTabletAt(ctx, 1, fluxdbtest.NewTablet("oth"), nil)
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+
+	// The speculative writes are applied by the server
+	speculative := []*fluxdb.WriteRequest{{
+		Height:          2,
+		BlockRef:        bstream.NewBlockRef("00000002a", 2),
+		PreviousBlockID: "00000001a",
+		TabletRows:      []fluxdb.TabletRow{tablet.MustRow(t, 2, "001", "")},
+	}}
+	rows, err = reader.ReadTabletAt(ctx, 1, tablet, speculative)
+	require.NoError(t, err)
+	assert.Equal(t, []fluxdb.TabletRow{tablet.MustRow(t, 1, "002", "b")}, rows)
+
+	row, err := reader.ReadTabletRowAt(ctx, 1, tablet, primaryKey("002"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, tablet.MustRow(t, 1, "002", "b"), row)
+
+	row, err = reader.ReadTabletRowAt(ctx, 1, tablet, primaryKey("003"), nil)
+	require.NoError(t, err)
+	assert.Nil(t, row)
+
+	entry, err := reader.ReadSingletEntryAt(ctx, singlet, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, singlet.MustEntry(t, 1, "s"), entry)
+
+	entry, err = reader.ReadSingletEntryAt(ctx, fluxdbtest.NewSinglet("oth"), 1, nil)
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	head, err := client.HeadBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "00000001a", head.ID())
+	assert.Equal(t, uint64(1), head.Num())
+}
+
+func TestClient_Errors(t *testing.T) {
+	db, closer := fluxdbtest.NewTestDB(t)
+	defer closer()
+
+	client, closeClient := newTestClient(t, db)
+	defer closeClient()
+
+	head, err := client.HeadBlock(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, bstream.BlockRefEmpty, head)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = client.ReadTabletAt(ctx, 1, fluxdbtest.NewTablet("tbl"), nil)
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+
+	fluxdbtest.WriteBatchOfRequests(t, db, &fluxdb.WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001a", 1)})
+
+	// The speculative writes must connect to the last written block
+	speculative := []*fluxdb.WriteRequest{{Height: 2, BlockRef: bstream.NewBlockRef("00000002a", 2), PreviousBlockID: "00000001b"}}
+	_, err = client.ReadSingletEntryAt(context.Background(), fluxdbtest.NewSinglet("sgl"), 1, speculative)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "got %v", err)
+}
+
+// newTestClient serves the read API of the instance on a local port and dials it, the returned
+// closer stops both the client and the server.
+func newTestClient(t *testing.T, db *fluxdb.FluxDB) (*Client, func()) {
+	server := newTestServer(t, db)
+
+	client, err := Dial(server.address)
+	require.NoError(t, err)
+
+	return client, func() {
+		client.Close()
+		server.Stop()
+	}
+}
+
+// testServer serves the read API of an instance on a local port, counting the calls received.
+type testServer struct {
+	*grpc.Server
+	address string
+
+	// Accessed atomically
+	calls uint32
+}
+
+func newTestServer(t *testing.T, db *fluxdb.FluxDB) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &testServer{address: listener.Addr().String()}
+	server.Server = grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddUint32(&server.calls, 1)
+		return handler(ctx, request)
+	}))
+
+	remote.NewServer(db).Register(server.Server)
+	go server.Serve(listener)
+
+	return server
+}
+
+func (s *testServer) callCount() int {
+	return int(atomic.LoadUint32(&s.calls))
+}
+
+type primaryKey string
+
+func (k primaryKey) Bytes() []byte  { return []byte(k) }
+func (k primaryKey) String() string { return string(k) }
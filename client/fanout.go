@@ -0,0 +1,75 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// DialFanOut dials a client for each of the `addresses` and returns a `fluxdb.FanOutReader`
+// spreading the reads across them, see `NewReplicaReader`. The clients are closed when the
+// reader is shut down.
+func DialFanOut(addresses []string, options ...grpc.DialOption) (*fluxdb.FanOutReader, error) {
+	clients := make([]*Client, 0, len(addresses))
+	closeClients := func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}
+
+	replicas := make([]*fluxdb.ReplicaReader, len(addresses))
+	for i, address := range addresses {
+		client, err := Dial(address, options...)
+		if err != nil {
+			closeClients()
+			return nil, fmt.Errorf("replica %d: %w", i, err)
+		}
+
+		clients = append(clients, client)
+		replicas[i] = NewReplicaReader(address, client)
+	}
+
+	reader := fluxdb.NewFanOutReader(replicas)
+	reader.OnTerminating(func(_ error) {
+		closeClients()
+	})
+
+	return reader, nil
+}
+
+// NewReplicaReader returns the replica of a `fluxdb.FanOutReader` read through `client`, its head
+// block being the one of the remote instance (see `Client.HeadBlock`), unknown while it cannot be
+// fetched so the replica is excluded by the lag exclusion until it answers again.
+func NewReplicaReader(name string, client *Client) *fluxdb.ReplicaReader {
+	return &fluxdb.ReplicaReader{
+		Name:   name,
+		Reader: client,
+		HeadBlock: func(ctx context.Context) bstream.BlockRef {
+			head, err := client.HeadBlock(ctx)
+			if err != nil {
+				zlog.Debug("unable to fetch replica head block", zap.String("replica", name), zap.Error(err))
+				return nil
+			}
+
+			return head
+		},
+	}
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/dfuse-io/fluxdb/fluxdbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialFanOut_Balancing(t *testing.T) {
+	singlet := fluxdbtest.NewSinglet("sgl")
+	first, closeFirst := newTestReplica(t, 1, singlet.MustEntry(t, 1, "value"))
+	defer closeFirst()
+	second, closeSecond := newTestReplica(t, 1, singlet.MustEntry(t, 1, "value"))
+	defer closeSecond()
+
+	reader, err := DialFanOut([]string{first.address, second.address})
+	require.NoError(t, err)
+	defer reader.Shutdown(nil)
+
+	for i := 0; i < 10; i++ {
+		entry, err := reader.ReadSingletEntryAt(context.Background(), singlet, 1, nil)
+		require.NoError(t, err)
+		assert.Equal(t, singlet.MustEntry(t, 1, "value"), entry)
+	}
+
+	assert.Equal(t, 5, first.callCount())
+	assert.Equal(t, 5, second.callCount())
+}
+
+func TestDialFanOut_Failover(t *testing.T) {
+	singlet := fluxdbtest.NewSinglet("sgl")
+	first, closeFirst := newTestReplica(t, 1, singlet.MustEntry(t, 1, "value"))
+	defer closeFirst()
+	second, closeSecond := newTestReplica(t, 1, singlet.MustEntry(t, 1, "value"))
+	defer closeSecond()
+
+	reader, err := DialFanOut([]string{first.address, second.address})
+	require.NoError(t, err)
+	defer reader.Shutdown(nil)
+
+	first.Stop()
+
+	for i := 0; i < 4; i++ {
+		entry, err := reader.ReadSingletEntryAt(context.Background(), singlet, 1, nil)
+		require.NoError(t, err)
+		assert.Equal(t, singlet.MustEntry(t, 1, "value"), entry)
+	}
+
+	assert.Equal(t, 4, second.callCount())
+
+	second.Stop()
+
+	_, err = reader.ReadSingletEntryAt(context.Background(), singlet, 1, nil)
+	assert.Error(t, err)
+}
+
+func TestDialFanOut_LagExclusion(t *testing.T) {
+	singlet := fluxdbtest.NewSinglet("sgl")
+	upToDate, closeUpToDate := newTestReplica(t, 10, singlet.MustEntry(t, 1, "value"))
+	defer closeUpToDate()
+	lagging, closeLagging := newTestReplica(t, 1, singlet.MustEntry(t, 1, "value"))
+	defer closeLagging()
+
+	reader, err := DialFanOut([]string{upToDate.address, lagging.address})
+	require.NoError(t, err)
+	defer reader.Shutdown(nil)
+
+	reader.EnableLagExclusion(5, time.Hour)
+	headBlockCalls := upToDate.callCount()
+
+	for i := 0; i < 4; i++ {
+		_, err := reader.ReadSingletEntryAt(context.Background(), singlet, 1, nil)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, headBlockCalls+4, upToDate.callCount())
+	assert.Equal(t, headBlockCalls, lagging.callCount())
+}
+
+// newTestReplica serves an instance holding `entry` whose last written block is `headBlockNum`,
+// the returned closer stops the server and closes the instance.
+func newTestReplica(t *testing.T, headBlockNum uint64, entry fluxdb.SingletEntry) (*testServer, func()) {
+	db, closer := fluxdbtest.NewTestDB(t)
+
+	write := fluxdbtest.SingletEntries(1, entry)
+	write.BlockRef = bstream.NewBlockRef("00000001a", 1)
+	fluxdbtest.WriteBatchOfRequests(t, db, write)
+
+	if headBlockNum > 1 {
+		fluxdbtest.WriteBatchOfRequests(t, db, &fluxdb.WriteRequest{Height: headBlockNum, BlockRef: bstream.NewBlockRef(fmt.Sprintf("%08xa", headBlockNum), headBlockNum)})
+	}
+
+	server := newTestServer(t, db)
+	return server, func() {
+		server.Stop()
+		closer()
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/dfuse-io/fluxdb"
+)
+
+// runCopyStore copies a whole store to another one, possibly of a different backend. An
+// interrupted copy is resumed by running the command again with the same arguments.
+func runCopyStore(args []string) error {
+	flags := flag.NewFlagSet("copy-store", flag.ContinueOnError)
+	srcDSN := flags.String("src", "", "Storage connection string of the source store")
+	dstDSN := flags.String("dst", "", "Storage connection string of the destination store")
+	workers := flags.Int("workers", 4, "Amount of key ranges copied in parallel, must be the same when resuming")
+	batchSize := flags.Int("batch-size", 1000, "Amount of keys written to the destination at once")
+	verify := flags.Bool("verify", false, "Compare the checksums of each range in both stores once copied")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *srcDSN == "" || *dstDSN == "" {
+		return errors.New("both --src and --dst must be provided")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	stats, err := fluxdb.CopyStore(ctx, *srcDSN, *dstDSN, fluxdb.CopyStoreOptions{
+		Workers:   *workers,
+		BatchSize: *batchSize,
+		Verify:    *verify,
+		OnProgress: func(progress fluxdb.CopyStoreProgress) {
+			fmt.Fprintf(os.Stderr, "range %d: copied %d keys, last key %x\n", progress.Range, progress.CopiedCount, progress.LastKey)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Copied %d rows and %d checkpoints (%d ranges resumed)\n", stats.RowCount, stats.CheckpointCount, stats.ResumedRanges)
+	if stats.Verified {
+		fmt.Println("All checksums verified")
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// runDeleteRange deletes a key range of a storage table. Without `--confirm`, it runs in dry
+// run, reporting the keys that would be deleted along with the confirmation token to pass to
+// actually delete them.
+func runDeleteRange(args []string) error {
+	flags := flag.NewFlagSet("delete-range", flag.ContinueOnError)
+	dsn := flags.String("dsn", "", "Storage connection string of the store")
+	tableName := flags.String("table", "rows", "Storage table of the range, either 'rows' or 'checkpoint'")
+	start := flags.String("start", "", "Hex encoded start key of the range (inclusive, without table prefix)")
+	end := flags.String("end", "", "Hex encoded end key of the range (exclusive, without table prefix)")
+	confirm := flags.String("confirm", "", "Confirmation token reported by the dry run, deletes the range when provided")
+	batchSize := flags.Int("batch-size", 1000, "Amount of keys deleted at once")
+	rate := flags.Int("rate", 0, "Maximum amount of keys deleted per second, 0 means unlimited")
+	auditLogStoreURL := flags.String("audit-log-store-url", "", "When set, records the deletion, along with the current user, in the audit log of this dstore bucket")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *dsn == "" || *start == "" || *end == "" {
+		return errors.New("all of --dsn, --start and --end must be provided")
+	}
+
+	table, err := tableFromName(*tableName)
+	if err != nil {
+		return err
+	}
+
+	keyStart, err := hex.DecodeString(*start)
+	if err != nil {
+		return fmt.Errorf("invalid start key: %w", err)
+	}
+
+	keyEnd, err := hex.DecodeString(*end)
+	if err != nil {
+		return fmt.Errorf("invalid end key: %w", err)
+	}
+
+	kvStore, err := fluxdb.NewKVStore(*dsn)
+	if err != nil {
+		return fmt.Errorf("unable to create store: %w", err)
+	}
+
+	db := fluxdb.New(kvStore, nil, nil, false)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *auditLogStoreURL != "" {
+		auditStore, err := dstore.NewStore(*auditLogStoreURL, "jsonl", "", false)
+		if err != nil {
+			return fmt.Errorf("unable to create audit log store: %w", err)
+		}
+
+		db.EnableAuditLog(auditStore)
+		ctx = fluxdb.WithCaller(ctx, currentUser())
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	dryRun := *confirm == ""
+	progress, err := db.DeleteRange(ctx, table, keyStart, keyEnd, fluxdb.DeleteRangeOptions{
+		DryRun:            dryRun,
+		ConfirmationToken: *confirm,
+		BatchSize:         *batchSize,
+		MaxKeysPerSecond:  *rate,
+		OnProgress: func(progress fluxdb.DeleteRangeProgress) {
+			fmt.Fprintf(os.Stderr, "scanned %d keys, deleted %d keys, last key %x\n", progress.ScannedCount, progress.DeletedCount, progress.LastKey)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		fmt.Printf("Deleted %d keys from table %q in range [%s, %s[\n", progress.DeletedCount, *tableName, *start, *end)
+		return nil
+	}
+
+	fmt.Printf("Dry run, %d keys would be deleted from table %q in range [%s, %s[\n", progress.ScannedCount, *tableName, *start, *end)
+	if progress.ScannedCount > 0 {
+		fmt.Printf("  First key: %x\n", progress.FirstKey)
+		fmt.Printf("  Last key:  %x\n", progress.LastKey)
+	}
+	fmt.Printf("\nTo delete them, run again with --confirm %s\n", fluxdb.DeleteRangeConfirmationToken(table, keyStart, keyEnd))
+
+	return nil
+}
+
+func currentUser() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+func tableFromName(name string) (store.Table, error) {
+	if table, found := store.LookupTable(name); found {
+		return table, nil
+	}
+
+	return 0, fmt.Errorf("unknown table %q, valid tables are 'rows' and 'checkpoint'", name)
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb"
+	"github.com/dfuse-io/fluxdb/store/kv"
+)
+
+// runKeyDump pretty-prints a raw KV key, and optionally its value, both hex encoded as found
+// in the store (i.e. prefixed by the storage table prefix).
+func runKeyDump(args []string) error {
+	flags := flag.NewFlagSet("keydump", flag.ContinueOnError)
+	decode := flags.Bool("decode", false, "Decode the value using the decoder registered for its collection")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("expected a hex encoded key and optionally a hex encoded value")
+	}
+
+	key, err := hex.DecodeString(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid key: %w", err)
+	}
+
+	var value []byte
+	if flags.NArg() == 2 {
+		if value, err = hex.DecodeString(flags.Arg(1)); err != nil {
+			return fmt.Errorf("invalid value: %w", err)
+		}
+	}
+
+	table, tableKey, err := kv.UnpackKey(key)
+	if err != nil {
+		return err
+	}
+
+	dump, err := fluxdb.DumpKey(table, tableKey, value, *decode)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(dump)
+	return nil
+}
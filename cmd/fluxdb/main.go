@@ -0,0 +1,67 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command fluxdb regroups operator tools to inspect a FluxDB store.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"copy-store":     {"--src <dsn> --dst <dsn> [--workers <count>] [--batch-size <count>] [--verify]", runCopyStore},
+	"delete-range":   {"--dsn <dsn> [--table <table>] --start <key hex> --end <key hex> [--confirm <token>] [--rate <keys/s>] [--batch-size <count>]", runDeleteRange},
+	"keydump":        {"[--decode] <key hex> [<value hex>]", runKeyDump},
+	"rebuild":        {"--dsn <dsn> --archive-store-url <url> [--format backup|shard] [--start-height <height>] [--stop-height <height>] [--decode-workers <count>] [--bulk-load=false]", runRebuild},
+	"shards balance": {"--shards-store-url <url> | --dsn <dsn> [--shard-function <name>] --shard-count <count> [--top <count>] [--json]", runShardsBalance},
+	"shards status":  {"[--watch] [--interval <duration>] --dsn <dsn> --shard-count <count>", runShardsStatus},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	// Commands are either a single word or grouped, like `shards status`
+	command, found := commands[os.Args[1]]
+	args := os.Args[2:]
+	if !found && len(os.Args) >= 3 {
+		command, found = commands[os.Args[1]+" "+os.Args[2]]
+		args = os.Args[3:]
+	}
+
+	if !found {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := command.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	for name, command := range commands {
+		fmt.Fprintf(os.Stderr, "  fluxdb %s %s\n", name, command.usage)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/fluxdb"
+)
+
+// runRebuild replays an archive, either an incremental backup or the segments of a single shard
+// (or snapshot), into a store, our standard disaster-recovery procedure. An interrupted rebuild
+// is resumed by running the command again with the same arguments.
+func runRebuild(args []string) error {
+	flags := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	dsn := flags.String("dsn", "", "Storage connection string of the rebuilt store, should be empty unless resuming")
+	archiveStoreURL := flags.String("archive-store-url", "", "URL of the dstore bucket of the archive")
+	format := flags.String("format", "backup", "Format of the archive, either 'backup' (incremental backup) or 'shard' (shard or snapshot segments)")
+	startHeight := flags.Uint64("start-height", 0, "First height written when the store is empty, the state below it must already be in the store, 0 means the start of the archive")
+	stopHeight := flags.Uint64("stop-height", 0, "Last height written, 0 means the end of the archive")
+	decodeWorkers := flags.Int("decode-workers", 4, "Amount of archive objects decoded in parallel, ahead of the writes")
+	bulkLoad := flags.Bool("bulk-load", true, "Defers indexing until the whole archive was written")
+	bulkLoadInterval := flags.Int("bulk-load-interval", 0, "When bulk loading, also builds deferred indexes each time this amount of blocks was written, 0 means only at the end")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *dsn == "" || *archiveStoreURL == "" {
+		return errors.New("both --dsn and --archive-store-url must be provided")
+	}
+
+	var extension string
+	switch *format {
+	case "backup":
+		extension = "backup.zst"
+	case "shard":
+		extension = "shard.zst"
+	default:
+		return fmt.Errorf("invalid format %q, expected either 'backup' or 'shard'", *format)
+	}
+
+	archiveStore, err := dstore.NewStore(*archiveStoreURL, extension, "zstd", false)
+	if err != nil {
+		return fmt.Errorf("unable to create archive store: %w", err)
+	}
+
+	kvStore, err := fluxdb.NewKVStore(*dsn)
+	if err != nil {
+		return fmt.Errorf("unable to create store: %w", err)
+	}
+
+	db := fluxdb.New(kvStore, nil, nil, false)
+	defer db.Close()
+
+	if *bulkLoad {
+		db.SetDeferIndexing(*bulkLoadInterval)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	lastHeight, err := db.RebuildFromArchive(ctx, archiveStore, fluxdb.RebuildOptions{
+		StartHeight:       *startHeight,
+		StopHeight:        *stopHeight,
+		DecodeParallelism: *decodeWorkers,
+		OnProgress: func(progress fluxdb.RebuildProgress) {
+			fmt.Fprintf(os.Stderr, "%s: wrote %d blocks, last height %d (%s elapsed)\n", progress.Filename, progress.RequestCount, progress.LastHeight, progress.Elapsed)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rebuilt store up to height %d\n", lastHeight)
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/fluxdb"
+)
+
+// runShardsStatus renders the last block written by each shard of a sharded injection, and
+// its lag behind the most advanced shard. In watch mode, the table is refreshed at each
+// interval until interrupted.
+func runShardsStatus(args []string) error {
+	flags := flag.NewFlagSet("shards status", flag.ContinueOnError)
+	dsn := flags.String("dsn", "", "Storage connection string of the injected store")
+	shardCount := flags.Int("shard-count", 0, "Amount of shards of the sharded injection")
+	watch := flags.Bool("watch", false, "Keep refreshing the shards status until interrupted")
+	interval := flags.Duration("interval", 2*time.Second, "Delay between each refresh in watch mode")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *dsn == "" || *shardCount <= 0 {
+		return errors.New("both --dsn and --shard-count must be provided")
+	}
+
+	kvStore, err := fluxdb.NewKVStore(*dsn)
+	if err != nil {
+		return fmt.Errorf("unable to create store: %w", err)
+	}
+
+	db := fluxdb.New(kvStore, nil, nil, false)
+	defer db.Close()
+
+	db.SetSharding(0, *shardCount)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	for {
+		progress, err := db.ShardsProgress(ctx)
+		if err != nil {
+			return err
+		}
+
+		if *watch {
+			// Clears the terminal so the table is rendered in place
+			fmt.Print("\033[H\033[2J")
+		}
+
+		renderShardsStatus(os.Stdout, progress)
+		if !*watch {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func renderShardsStatus(out io.Writer, progress []fluxdb.ShardProgress) {
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "SHARD\tLAST BLOCK\tLAG\t")
+	for _, shard := range progress {
+		lastBlock := "-"
+		if !bstream.EqualsBlockRefs(shard.LastBlock, bstream.BlockRefEmpty) {
+			lastBlock = shard.LastBlock.String()
+		}
+
+		fmt.Fprintf(writer, "%03d\t%s\t%d\t\n", shard.ShardIndex, lastBlock, shard.Lag)
+	}
+
+	writer.Flush()
+}
+
+// runShardsBalance renders the per-shard singlet entries, tablet rows and bytes, along with the
+// heaviest tablets of each shard, either of the shard archives produced by a sharder or of the
+// live store as if it was sharded, so a pathological skew is detected before injecting.
+func runShardsBalance(args []string) error {
+	flags := flag.NewFlagSet("shards balance", flag.ContinueOnError)
+	shardsStoreURL := flags.String("shards-store-url", "", "URL of the shards store produced by the sharder, containing one directory per shard")
+	dsn := flags.String("dsn", "", "Storage connection string of a live store to analyze instead of shard archives")
+	shardCount := flags.Int("shard-count", 0, "Amount of shards of the sharded run")
+	shardFunction := flags.String("shard-function", "", "Name of the shard function used to assign the live store rows to shards, the default one when empty")
+	heaviestCount := flags.Int("top", 5, "Amount of heaviest tablets reported per shard")
+	asJSON := flags.Bool("json", false, "Output the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if (*shardsStoreURL == "") == (*dsn == "") || *shardCount <= 0 {
+		return errors.New("exactly one of --shards-store-url or --dsn, and --shard-count must be provided")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	var report *fluxdb.ShardBalanceReport
+	if *shardsStoreURL != "" {
+		shardsStore, err := dstore.NewStore(*shardsStoreURL, "shard.zst", "zstd", false)
+		if err != nil {
+			return fmt.Errorf("unable to create shards store: %w", err)
+		}
+
+		if report, err = fluxdb.AnalyzeShardArchives(ctx, shardsStore, *shardCount, *heaviestCount); err != nil {
+			return err
+		}
+	} else {
+		kvStore, err := fluxdb.NewKVStore(*dsn)
+		if err != nil {
+			return fmt.Errorf("unable to create store: %w", err)
+		}
+
+		db := fluxdb.New(kvStore, nil, nil, false)
+		defer db.Close()
+
+		if err := db.SetShardFunction(*shardFunction); err != nil {
+			return err
+		}
+
+		if report, err = db.AnalyzeShardBalance(ctx, *shardCount, *heaviestCount); err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	renderShardsBalance(os.Stdout, report)
+	return nil
+}
+
+func renderShardsBalance(out io.Writer, report *fluxdb.ShardBalanceReport) {
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "SHARD\tSINGLET ENTRIES\tTABLET ROWS\tBYTES\t")
+	for _, shard := range report.Shards {
+		fmt.Fprintf(writer, "%03d\t%d\t%d\t%d\t\n", shard.ShardIndex, shard.SingletEntryCount, shard.TabletRowCount, shard.ByteCount)
+	}
+	writer.Flush()
+
+	fmt.Fprintf(out, "\nSkew (heaviest shard bytes over mean): %.2f\n", report.Skew)
+
+	for _, shard := range report.Shards {
+		if len(shard.HeaviestTablets) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(out, "\nHeaviest tablets of shard %03d:\n", shard.ShardIndex)
+		writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "COLLECTION\tTABLET\tROWS\tBYTES\t")
+		for _, tablet := range shard.HeaviestTablets {
+			fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t\n", tablet.Collection, tablet.Tablet, tablet.RowCount, tablet.ByteCount)
+		}
+		writer.Flush()
+	}
+}
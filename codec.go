@@ -0,0 +1,126 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// RawPayloadCodec is the codec available for every collection, it encodes the raw value as a
+// JSON string of its hexadecimal form.
+const RawPayloadCodec = "raw"
+
+// PayloadCodec turns the raw value of a singlet entry or tablet row into JSON, see
+// `RegisterPayloadCodec`.
+type PayloadCodec func(value []byte) (json.RawMessage, error)
+
+var payloadCodecs = map[uint16]map[string]PayloadCodec{}
+
+// RegisterPayloadCodec registers, under `name`, a codec decoding the values of the singlet
+// entries or tablet rows of the received collection into JSON (e.g. ABI decoding of contract
+// rows), so read APIs can return decoded values, the codec being selected by name per request
+// (see `DecodeTabletRows` and `DecodeSingletEntry`).
+func RegisterPayloadCodec(collection uint16, name string, codec PayloadCodec) {
+	if _, found := collections[collection]; !found {
+		panic(fmt.Errorf("collection 0x%04X is not registered, register its factory first", collection))
+	}
+
+	if name == RawPayloadCodec {
+		panic(fmt.Errorf("payload codec name %q is reserved", RawPayloadCodec))
+	}
+
+	if payloadCodecs[collection] == nil {
+		payloadCodecs[collection] = map[string]PayloadCodec{}
+	}
+
+	payloadCodecs[collection][name] = codec
+}
+
+// PayloadCodecs returns the names, sorted, of the codecs available for the collection, the raw
+// one included.
+func PayloadCodecs(collection uint16) (names []string) {
+	names = append(names, RawPayloadCodec)
+	for name := range payloadCodecs[collection] {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// DecodedTabletRow is a tablet row whose value was decoded by a payload codec.
+type DecodedTabletRow struct {
+	Height     uint64          `json:"height"`
+	PrimaryKey string          `json:"primary_key"`
+	Value      json.RawMessage `json:"value"`
+}
+
+// DecodedSingletEntry is a singlet entry whose value was decoded by a payload codec.
+type DecodedSingletEntry struct {
+	Height uint64          `json:"height"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// DecodeTabletRows decodes the value of the rows, as returned by the read APIs, using the
+// payload codec named `codec` of their collection, the primary keys are hex encoded.
+func DecodeTabletRows(rows []TabletRow, codec string) ([]*DecodedTabletRow, error) {
+	out := make([]*DecodedTabletRow, len(rows))
+	for i, row := range rows {
+		value, err := decodePayload(row.Tablet().Collection(), codec, row)
+		if err != nil {
+			return nil, fmt.Errorf("tablet row %s: %w", KeyForTabletRow(row), err)
+		}
+
+		out[i] = &DecodedTabletRow{Height: row.Height(), PrimaryKey: hex.EncodeToString(row.PrimaryKey()), Value: value}
+	}
+
+	return out, nil
+}
+
+// DecodeSingletEntry decodes the value of the entry, as returned by the read APIs, using the
+// payload codec named `codec` of its collection, `nil` if the entry is `nil`.
+func DecodeSingletEntry(entry SingletEntry, codec string) (*DecodedSingletEntry, error) {
+	if entry == nil {
+		return nil, nil
+	}
+
+	value, err := decodePayload(entry.Singlet().Collection(), codec, entry)
+	if err != nil {
+		return nil, fmt.Errorf("singlet entry %s: %w", KeyForSingletEntry(entry), err)
+	}
+
+	return &DecodedSingletEntry{Height: entry.Height(), Value: value}, nil
+}
+
+func decodePayload(collection uint16, codecName string, marshaller interface{ MarshalValue() ([]byte, error) }) (json.RawMessage, error) {
+	codec, found := payloadCodecs[collection][codecName]
+	if !found && codecName != RawPayloadCodec {
+		return nil, fmt.Errorf("unknown payload codec %q for collection %s, available codecs are %v", codecName, collectionName(collection), PayloadCodecs(collection))
+	}
+
+	value, err := marshaller.MarshalValue()
+	if err != nil {
+		return nil, fmt.Errorf("marshal value: %w", err)
+	}
+
+	if codecName == RawPayloadCodec {
+		return json.Marshal(hex.EncodeToString(value))
+	}
+
+	return codec(value)
+}
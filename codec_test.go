@@ -0,0 +1,43 @@
+package fluxdb
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeTabletRows(t *testing.T) {
+	RegisterPayloadCodec(testTabletCollection, "upper", func(value []byte) (json.RawMessage, error) {
+		return json.Marshal(strings.ToUpper(string(value)))
+	})
+	defer delete(payloadCodecs, testTabletCollection)
+
+	assert.Equal(t, []string{"raw", "upper"}, PayloadCodecs(testTabletCollection))
+	assert.Equal(t, []string{"raw"}, PayloadCodecs(testSingletCollection))
+
+	tablet := newTestTablet("tbl")
+	rows := []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 2, "002", "r #2")}
+
+	decoded, err := DecodeTabletRows(rows, "upper")
+	require.NoError(t, err)
+	assert.Equal(t, []*DecodedTabletRow{
+		{Height: 1, PrimaryKey: "303031", Value: json.RawMessage(`"R #1"`)},
+		{Height: 2, PrimaryKey: "303032", Value: json.RawMessage(`"R #2"`)},
+	}, decoded)
+
+	decoded, err = DecodeTabletRows(rows[0:1], RawPayloadCodec)
+	require.NoError(t, err)
+	assert.Equal(t, []*DecodedTabletRow{{Height: 1, PrimaryKey: "303031", Value: json.RawMessage(`"72202331"`)}}, decoded)
+
+	_, err = DecodeTabletRows(rows, "unknown")
+	assert.Error(t, err)
+
+	entry, err := DecodeSingletEntry(nil, RawPayloadCodec)
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	assert.Panics(t, func() { RegisterPayloadCodec(testTabletCollection, RawPayloadCodec, nil) })
+}
@@ -0,0 +1,263 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// The checkpoint table keys under which the write statistics of each collection are persisted,
+// followed by the hex encoded collection, must not start with `shard-` since this prefix is
+// reserved to the shards last written checkpoint.
+var collectionStatsKeyPrefix = []byte("stats-")
+
+// CollectionWriteStats are the cumulative write statistics of a collection, see
+// `EnableCollectionWriteStats`.
+type CollectionWriteStats struct {
+	Collection uint16 `json:"collection"`
+	Name       string `json:"name"`
+
+	// Height is the height of the block the statistics were persisted at
+	Height uint64 `json:"height"`
+
+	// RowCount is the amount of singlet entries and tablet rows written, deletions excluded
+	RowCount uint64 `json:"row_count"`
+
+	// DeletionCount is the amount of singlet entries and tablet rows deletions written
+	DeletionCount uint64 `json:"deletion_count"`
+
+	// ByteCount is the size of the keys and values written, deletions included
+	ByteCount uint64 `json:"byte_count"`
+}
+
+// EnableCollectionWriteStats maintains the amount of rows, deletions and bytes written to each
+// collection, persisted with the checkpoint of every `interval` blocks and read with
+// `FetchCollectionWriteStats`, so usage can be tracked without scanning the store.
+//
+// Only the writes performed once enabled are accounted for. The statistics are persisted along
+// with the last written checkpoint, the blocks written since they were last persisted are
+// however not accounted for when the writer restarts, they are accurate within `interval`
+// blocks per restart. Ignored when writing a shard of a sharded injection.
+func (fdb *FluxDB) EnableCollectionWriteStats(interval int) {
+	if interval <= 0 {
+		interval = 1
+	}
+
+	fdb.collectionStats = &collectionStatsTracker{
+		interval:  interval,
+		committed: map[uint16]*CollectionWriteStats{},
+		pending:   map[uint16]*CollectionWriteStats{},
+	}
+}
+
+// FetchCollectionWriteStats returns the last persisted write statistics of the collections
+// written since they are maintained, ordered by collection, see `EnableCollectionWriteStats`.
+func (fdb *FluxDB) FetchCollectionWriteStats(ctx context.Context) ([]*CollectionWriteStats, error) {
+	var out []*CollectionWriteStats
+	err := fdb.store.ScanLastShardsWrittenCheckpoint(ctx, collectionStatsKeyPrefix, func(key []byte, value []byte) error {
+		stats, err := unmarshalCollectionWriteStats(key, value)
+		if err != nil {
+			return err
+		}
+
+		out = append(out, stats)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan collection write stats: %w", err)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Collection < out[j].Collection })
+	return out, nil
+}
+
+// collectionStatsTracker accumulates the write statistics of the collections, the ones of the
+// write batch in progress are pending until it's flushed, a failed batch must not be accounted
+// for when retried.
+type collectionStatsTracker struct {
+	interval int
+	loaded   bool
+
+	committed          map[uint16]*CollectionWriteStats
+	blocksSincePersist int
+
+	// The statistics and blocks count of the batch in progress
+	pending                   map[uint16]*CollectionWriteStats
+	pendingBlocksSincePersist int
+}
+
+// loadCollectionStats initializes the tracker from the persisted statistics the first time a
+// batch is written.
+func (fdb *FluxDB) loadCollectionStats(ctx context.Context) error {
+	if fdb.collectionStats == nil || fdb.collectionStats.loaded {
+		return nil
+	}
+
+	if fdb.IsSharding() {
+		zlog.Warn("collection write stats are not maintained while writing a shard, ignoring")
+		fdb.collectionStats = nil
+		return nil
+	}
+
+	persisted, err := fdb.FetchCollectionWriteStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, stats := range persisted {
+		fdb.collectionStats.committed[stats.Collection] = stats
+	}
+
+	zlog.Info("loaded persisted collection write stats", zap.Int("collection_count", len(persisted)))
+	fdb.collectionStats.loaded = true
+	return nil
+}
+
+func (t *collectionStatsTracker) observe(collection uint16, byteCount int, deletion bool) {
+	if t == nil {
+		return
+	}
+
+	stats := t.pending[collection]
+	if stats == nil {
+		stats = &CollectionWriteStats{Collection: collection}
+		t.pending[collection] = stats
+	}
+
+	if deletion {
+		stats.DeletionCount++
+	} else {
+		stats.RowCount++
+	}
+	stats.ByteCount += uint64(byteCount)
+}
+
+// persistIfDue writes the statistics to the batch, to be flushed along with the checkpoint of
+// the block at `height`, once `interval` blocks were written since they were last persisted.
+func (t *collectionStatsTracker) persistIfDue(batch store.Batch, height uint64) {
+	if t == nil {
+		return
+	}
+
+	t.pendingBlocksSincePersist++
+	if t.pendingBlocksSincePersist < t.interval {
+		return
+	}
+
+	collections := map[uint16]bool{}
+	for collection := range t.committed {
+		collections[collection] = true
+	}
+	for collection := range t.pending {
+		collections[collection] = true
+	}
+
+	for collection := range collections {
+		stats := t.merged(collection)
+		stats.Height = height
+
+		batch.SetLastCheckpoint(collectionStatsKey(collection), marshalCollectionWriteStats(stats))
+	}
+
+	t.pendingBlocksSincePersist = 0
+}
+
+// merged returns the committed statistics of the collection with the pending ones added.
+func (t *collectionStatsTracker) merged(collection uint16) *CollectionWriteStats {
+	stats := &CollectionWriteStats{Collection: collection}
+	for _, source := range []*CollectionWriteStats{t.committed[collection], t.pending[collection]} {
+		if source == nil {
+			continue
+		}
+
+		stats.RowCount += source.RowCount
+		stats.DeletionCount += source.DeletionCount
+		stats.ByteCount += source.ByteCount
+	}
+
+	return stats
+}
+
+// commit accounts for the pending statistics once their batch was flushed.
+func (t *collectionStatsTracker) commit() {
+	if t == nil {
+		return
+	}
+
+	for collection := range t.pending {
+		t.committed[collection] = t.merged(collection)
+	}
+
+	t.blocksSincePersist = t.pendingBlocksSincePersist
+	t.reset()
+}
+
+// rollback drops the pending statistics of a batch that failed.
+func (t *collectionStatsTracker) rollback() {
+	if t == nil {
+		return
+	}
+
+	t.reset()
+}
+
+func (t *collectionStatsTracker) reset() {
+	t.pending = map[uint16]*CollectionWriteStats{}
+	t.pendingBlocksSincePersist = t.blocksSincePersist
+}
+
+func collectionStatsKey(collection uint16) []byte {
+	identifier := make([]byte, 2)
+	bigEndian.PutUint16(identifier, collection)
+
+	return append(append([]byte(nil), collectionStatsKeyPrefix...), hex.EncodeToString(identifier)...)
+}
+
+func marshalCollectionWriteStats(stats *CollectionWriteStats) []byte {
+	value := make([]byte, 32)
+	bigEndian.PutUint64(value, stats.Height)
+	bigEndian.PutUint64(value[8:], stats.RowCount)
+	bigEndian.PutUint64(value[16:], stats.DeletionCount)
+	bigEndian.PutUint64(value[24:], stats.ByteCount)
+
+	return value
+}
+
+func unmarshalCollectionWriteStats(key []byte, value []byte) (*CollectionWriteStats, error) {
+	identifier, err := hex.DecodeString(string(key[len(collectionStatsKeyPrefix):]))
+	if err != nil || len(identifier) != 2 {
+		return nil, fmt.Errorf("invalid collection write stats key %q", key)
+	}
+
+	if len(value) != 32 {
+		return nil, fmt.Errorf("invalid collection write stats value of collection 0x%X, expected 32 bytes, got %d", identifier, len(value))
+	}
+
+	collection := bigEndian.Uint16(identifier)
+	return &CollectionWriteStats{
+		Collection:    collection,
+		Name:          collectionName(collection),
+		Height:        bigEndian.Uint64(value),
+		RowCount:      bigEndian.Uint64(value[8:]),
+		DeletionCount: bigEndian.Uint64(value[16:]),
+		ByteCount:     bigEndian.Uint64(value[24:]),
+	}, nil
+}
@@ -0,0 +1,84 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectionWriteStats(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	db.EnableCollectionWriteStats(2)
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b")))
+
+	stats, err := db.FetchCollectionWriteStats(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, stats, "persisted every 2 blocks only")
+
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:         2,
+		TabletRows:     []TabletRow{tablet.row(t, 2, "001", "")},
+		SingletEntries: []SingletEntry{singlet.entry(t, 2, "s")},
+	})
+
+	stats, err = db.FetchCollectionWriteStats(ctx)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, testSingletCollection, stats[0].Collection)
+	assert.Equal(t, uint64(1), stats[0].RowCount)
+	assert.Equal(t, uint64(0), stats[0].DeletionCount)
+
+	assert.Equal(t, testTabletCollection, stats[1].Collection)
+	assert.Equal(t, collectionName(testTabletCollection), stats[1].Name)
+	assert.Equal(t, uint64(2), stats[1].Height)
+	assert.Equal(t, uint64(2), stats[1].RowCount)
+	assert.Equal(t, uint64(1), stats[1].DeletionCount)
+	assert.True(t, stats[1].ByteCount > 0)
+
+	// A restarted writer continues from the persisted statistics
+	restarted := New(db.store, nil, nil, false)
+	restarted.EnableCollectionWriteStats(2)
+	writeBatchOfRequests(t, restarted,
+		tabletRows(3, tablet.row(t, 3, "003", "c")),
+		tabletRows(4, tablet.row(t, 4, "004", "d")),
+	)
+
+	stats, err = restarted.FetchCollectionWriteStats(ctx)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, uint64(4), stats[0].Height, "all collections are persisted")
+	assert.Equal(t, uint64(1), stats[0].RowCount)
+	assert.Equal(t, uint64(4), stats[1].Height)
+	assert.Equal(t, uint64(4), stats[1].RowCount)
+	assert.Equal(t, uint64(1), stats[1].DeletionCount)
+}
+
+func TestCollectionStatsTracker_Rollback(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.EnableCollectionWriteStats(1)
+	tracker := db.collectionStats
+
+	tracker.observe(testTabletCollection, 10, false)
+	tracker.persistIfDue(db.store.NewBatch(zlog), 1)
+	tracker.rollback()
+
+	assert.Empty(t, tracker.committed)
+	assert.Equal(t, 0, tracker.pendingBlocksSincePersist)
+
+	tracker.observe(testTabletCollection, 10, false)
+	tracker.observe(testTabletCollection, 4, true)
+	tracker.commit()
+
+	assert.Equal(t, &CollectionWriteStats{Collection: testTabletCollection, RowCount: 1, DeletionCount: 1, ByteCount: 14}, tracker.committed[testTabletCollection])
+}
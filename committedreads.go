@@ -0,0 +1,214 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/logging"
+	"go.uber.org/zap"
+)
+
+// The commit marker is the height of the last block of the last fully committed batch, written in
+// its own flush once all the flushes of the batch succeeded, the flushes of a batch being
+// unordered across tables, the last written checkpoint could otherwise be written before some of
+// the rows of its block. A height is fully committed once it's at or below the commit marker,
+// anything above it might be a partial write of a crashed flush. It's only written when committed
+// reads are enabled, the writes then resuming after it (see `fetchResumeCheckpoint`).
+type committedReads struct {
+	// Accessed atomically, the highest committed height seen so far, it only ever grows
+	height uint64
+}
+
+// ErrUncommittedHeight is the error of a read above the last fully committed block when committed
+// reads are enabled (see `EnableCommittedReads`), the read can be retried at `CommittedHeight` or
+// once the block is committed.
+type ErrUncommittedHeight struct {
+	Height          uint64
+	CommittedHeight uint64
+}
+
+func (e *ErrUncommittedHeight) Error() string {
+	return fmt.Sprintf("height %d is above last committed height %d", e.Height, e.CommittedHeight)
+}
+
+// EnableCommittedReads fails with an `*ErrUncommittedHeight` the reads above the last fully
+// committed block, so the rows of a partially written block, left by a crashed flush on a backend
+// without transactions, are never served. A read with speculative writes covering all the blocks
+// above the last committed one is still served, at the requested height.
+//
+// The committed height is cached, the commit marker is only fetched when a read is above it. For
+// stores without commit marker, written by a previous version or by a sharded injection still in
+// progress, the safe serve block (see `FetchSafeServeBlock`) is used instead.
+//
+// **Important** The commit marker is only written by a writer with committed reads enabled, they
+// must be enabled on the writer as well as on the replicas serving its store, the marker being
+// otherwise missing or stale.
+func (fdb *FluxDB) EnableCommittedReads() {
+	fdb.committedReads = &committedReads{}
+}
+
+func (c *committedReads) load() uint64 {
+	return atomic.LoadUint64(&c.height)
+}
+
+func (c *committedReads) advance(height uint64) {
+	if c == nil {
+		return
+	}
+
+	for {
+		current := atomic.LoadUint64(&c.height)
+		if height <= current || atomic.CompareAndSwapUint64(&c.height, current, height) {
+			return
+		}
+	}
+}
+
+// committedReadHeight returns the height the store must be read at for a read at `height`, i.e.
+// `height` itself unless committed reads are enabled and it's above the last fully committed
+// block, the speculative writes then covering the blocks above it. Otherwise, the read fails with
+// an `*ErrUncommittedHeight`.
+func (fdb *FluxDB) committedReadHeight(ctx context.Context, height uint64, speculativeWrites []*WriteRequest) (uint64, error) {
+	// Shards are written concurrently, the last written checkpoint of this one is meaningless for reads
+	if fdb.committedReads == nil || fdb.IsSharding() {
+		return height, nil
+	}
+
+	if height <= fdb.committedReads.load() {
+		return height, nil
+	}
+
+	committed, err := fdb.fetchCommittedHeight(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	fdb.committedReads.advance(committed)
+
+	if height <= committed {
+		return height, nil
+	}
+
+	if coversHeightsAbove(speculativeWrites, committed) {
+		return committed, nil
+	}
+
+	logging.Logger(ctx, zlog).Debug("read above last committed block", zap.Uint64("height", height), zap.Uint64("committed_height", committed))
+	return 0, &ErrUncommittedHeight{Height: height, CommittedHeight: committed}
+}
+
+func (fdb *FluxDB) fetchCommittedHeight(ctx context.Context) (uint64, error) {
+	committed, block, err := fdb.fetchCommitMarker(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if block == nil {
+		committed, _, err = fdb.FetchSafeServeBlock(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("fetch safe serve block: %w", err)
+		}
+	}
+
+	return committed, nil
+}
+
+// fetchCommitMarker returns the last fully committed block, a `nil` block when the store has no
+// commit marker.
+func (fdb *FluxDB) fetchCommitMarker(ctx context.Context) (height uint64, block bstream.BlockRef, err error) {
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, commitMarkerRowKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil, nil
+	}
+
+	if err != nil {
+		return 0, nil, fmt.Errorf("fetch commit marker: %w", err)
+	}
+
+	height, block, err = unmarshalCheckpoint(value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to unmarshal commit marker: %w", err)
+	}
+
+	return height, block, nil
+}
+
+// fetchResumeCheckpoint returns the block the writes resume after, the last written checkpoint
+// unless committed reads are enabled and the commit marker is below it, the blocks above the
+// last fully committed one being then written again, they might have been partially written.
+func (fdb *FluxDB) fetchResumeCheckpoint(ctx context.Context) (height uint64, block bstream.BlockRef, err error) {
+	height, block, err = fdb.FetchLastWrittenCheckpoint(ctx)
+	if err != nil || fdb.committedReads == nil || fdb.IsSharding() {
+		return height, block, err
+	}
+
+	committedHeight, committedBlock, err := fdb.fetchCommitMarker(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if committedBlock != nil && committedHeight < height {
+		zlog.Info("last written block not fully committed, resuming after the last committed block",
+			zap.Stringer("last_written_block", block),
+			zap.Stringer("committed_block", committedBlock),
+		)
+		return committedHeight, committedBlock, nil
+	}
+
+	return height, block, nil
+}
+
+// coversHeightsAbove determines if the speculative writes start at the block following
+// `height`, so they hold all the blocks above it.
+func coversHeightsAbove(speculativeWrites []*WriteRequest, height uint64) bool {
+	if len(speculativeWrites) == 0 {
+		return false
+	}
+
+	lowest := speculativeWrites[0].Height
+	for _, write := range speculativeWrites[1:] {
+		if write.Height < lowest {
+			lowest = write.Height
+		}
+	}
+
+	return lowest <= height+1
+}
+
+// writeCommitMarker marks the blocks up to `height` as fully committed, in its own flush so it's
+// only ever written once all the rows of the blocks are. Nothing is written unless committed reads
+// are enabled.
+func (fdb *FluxDB) writeCommitMarker(ctx context.Context, height uint64, block bstream.BlockRef) error {
+	if fdb.committedReads == nil {
+		return nil
+	}
+
+	batch := fdb.store.NewBatch(zlog)
+	if err := fdb.setCheckpoint(batch, commitMarkerRowKey, height, block); err != nil {
+		return err
+	}
+
+	if err := batch.Flush(ctx); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return nil
+}
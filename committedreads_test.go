@@ -0,0 +1,185 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommittedReads(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.EnableCommittedReads()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:         1,
+			TabletRows:     []TabletRow{tablet.row(t, 1, "001", "a")},
+			SingletEntries: []SingletEntry{singlet.entry(t, 1, "a")},
+		},
+	)
+
+	// A partial write of block 2, as left by a crashed flush, the last written checkpoint made it
+	// to the store but not the commit marker, still at 1
+	batch := db.store.NewBatch(zlog)
+	batch.SetRow(KeyForTabletRow(tablet.row(t, 2, "001", "")), nil)
+	batch.SetRow(KeyForTabletRow(tablet.row(t, 2, "002", "b")), []byte("b"))
+	batch.SetRow(KeyForSingletEntry(singlet.entry(t, 2, "b")), []byte("b"))
+	require.NoError(t, db.setLastCheckpoint(batch, 2, bstream.NewBlockRef("00000002aa", 2)))
+	require.NoError(t, batch.Flush(ctx))
+
+	var uncommitted *ErrUncommittedHeight
+	_, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.True(t, errors.As(err, &uncommitted), "got %v", err)
+	assert.Equal(t, &ErrUncommittedHeight{Height: 2, CommittedHeight: 1}, uncommitted)
+
+	_, err = db.ReadTabletRowAt(ctx, 2, tablet, testTabletRowPrimaryKey("002"), nil)
+	assert.True(t, errors.As(err, &uncommitted), "got %v", err)
+
+	_, err = db.ReadSingletEntryAt(ctx, singlet, 2, nil)
+	assert.True(t, errors.As(err, &uncommitted), "got %v", err)
+
+	// The committed height is still served
+	entry, err := db.ReadSingletEntryAt(ctx, singlet, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, singlet.entry(t, 1, "a"), entry)
+
+	// Speculative writes covering the blocks above the last committed one are still served
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, []*WriteRequest{tabletRows(2, tablet.row(t, 2, "003", "c"))})
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "a"), tablet.row(t, 2, "003", "c")}, rows)
+
+	_, err = db.ReadTabletAt(ctx, 3, tablet, []*WriteRequest{tabletRows(3, tablet.row(t, 3, "003", "c"))})
+	assert.True(t, errors.As(err, &uncommitted), "got %v", err)
+
+	// Once block 2 is fully committed, it's read again
+	require.NoError(t, db.writeCommitMarker(ctx, 2, bstream.NewBlockRef("00000002aa", 2)))
+
+	rows, err = db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 2, "002", "b")}, rows)
+}
+
+func TestCommittedReadsCachedHeight(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.EnableCommittedReads()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a")), tabletRows(2, tablet.row(t, 2, "002", "b")))
+	assert.Equal(t, uint64(2), db.committedReads.load())
+
+	height, err := db.committedReadHeight(ctx, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), height)
+
+	_, err = db.committedReadHeight(ctx, 5, nil)
+	assert.Equal(t, &ErrUncommittedHeight{Height: 5, CommittedHeight: 2}, err)
+
+	height, err = db.committedReadHeight(ctx, 5, []*WriteRequest{tabletRows(3), tabletRows(4), tabletRows(5)})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), height)
+}
+
+func TestCommittedReads_WithoutCommitMarker(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	// A store written before the commit marker existed, only its last written checkpoint is set
+	batch := db.store.NewBatch(zlog)
+	batch.SetRow(KeyForTabletRow(tablet.row(t, 1, "001", "a")), []byte("a"))
+	require.NoError(t, db.setLastCheckpoint(batch, 1, bstream.NewBlockRef("00000001aa", 1)))
+	require.NoError(t, batch.Flush(ctx))
+
+	db.EnableCommittedReads()
+
+	rows, err := db.ReadTabletAt(ctx, 1, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "a")}, rows)
+
+	_, err = db.ReadTabletAt(ctx, 2, tablet, nil)
+	assert.Equal(t, &ErrUncommittedHeight{Height: 2, CommittedHeight: 1}, err)
+}
+
+func TestCommittedReads_DisabledWritesNoCommitMarker(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a")))
+
+	_, block, err := db.fetchCommitMarker(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, block)
+
+	db.EnableCommittedReads()
+	writeBatchOfRequests(t, db, tabletRows(2, tablet.row(t, 2, "002", "b")))
+
+	height, block, err := db.fetchCommitMarker(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, block)
+	assert.Equal(t, uint64(2), height)
+}
+
+func TestFetchResumeCheckpoint(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:     1,
+		BlockRef:   bstream.NewBlockRef("00000001aa", 1),
+		TabletRows: []TabletRow{tablet.row(t, 1, "001", "a")},
+	})
+
+	// A partial write of block 2, its last written checkpoint made it to the store but not the commit marker
+	batch := db.store.NewBatch(zlog)
+	batch.SetRow(KeyForTabletRow(tablet.row(t, 2, "002", "b")), []byte("b"))
+	require.NoError(t, db.setLastCheckpoint(batch, 2, bstream.NewBlockRef("00000002aa", 2)))
+	require.NoError(t, batch.Flush(ctx))
+
+	// Without committed reads, the commit marker is not maintained and the writes resume after the last written block
+	height, block, err := db.fetchResumeCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), height)
+	assert.Equal(t, "00000002aa", block.ID())
+
+	db.EnableCommittedReads()
+	require.NoError(t, db.writeCommitMarker(ctx, 1, bstream.NewBlockRef("00000001aa", 1)))
+
+	height, block, err = db.fetchResumeCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), height)
+	assert.Equal(t, "00000001aa", block.ID())
+
+	// Block 2 written again from the last committed block, the writes resume after it
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:     2,
+		BlockRef:   bstream.NewBlockRef("00000002aa", 2),
+		TabletRows: []TabletRow{tablet.row(t, 2, "002", "b")},
+	})
+
+	height, block, err = db.fetchResumeCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), height)
+	assert.Equal(t, "00000002aa", block.ID())
+}
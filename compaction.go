@@ -0,0 +1,307 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// CompactionReport is the outcome of `CompactTombstones`.
+type CompactionReport struct {
+	// Height is the last irreversible block height, only the tablets indexed at or below it
+	// are compacted
+	Height uint64
+
+	TabletCount       int
+	TombstoneCount    int
+	ShadowedRowCount  int
+	DeletedIndexCount int
+}
+
+// EnableTombstoneCompaction runs `CompactTombstones` in background every `interval`, until
+// FluxDB is terminated.
+func (fdb *FluxDB) EnableTombstoneCompaction(interval time.Duration) {
+	fdb.runPeriodically(interval, "tombstone compaction", func(ctx context.Context) error {
+		_, err := fdb.CompactTombstones(ctx, nil, false)
+		return err
+	})
+}
+
+// runPeriodically runs the background `task` every `interval` until FluxDB is terminated, a
+// failure being retried at the next interval.
+func (fdb *FluxDB) runPeriodically(interval time.Duration, name string, task func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fdb.OnTerminating(func(_ error) {
+		stopOnce.Do(func() {
+			ticker.Stop()
+			cancel()
+			close(stop)
+		})
+	})
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := task(ctx); err != nil && ctx.Err() == nil {
+					zlog.Warn("background task failed, will retry at next interval", zap.String("task", name), zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// CompactTombstones deletes, for each tablet (starting at `lowerBound` when set), the deletions
+// (tombstones) covered by the latest index snapshot at or below the last irreversible block,
+// along with the row versions they shadow. The index snapshot, taken after the deletion, does
+// not reference them anymore, so reads at or above its height are unaffected.
+//
+// **Important** This trades history for storage, reads of a compacted tablet below the height
+// of its covering index behave as if the compacted rows never existed. The older index snapshots
+// of a compacted tablet referencing one of the compacted rows are deleted too, the others are
+// kept.
+func (fdb *FluxDB) CompactTombstones(ctx context.Context, lowerBound Tablet, dryRun bool) (report *CompactionReport, err error) {
+	if fdb.IsSharding() {
+		return nil, errors.New("tombstone compaction is not supported when sharding")
+	}
+
+	height, _, err := fdb.LastIrreversibleBlock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch last irreversible block: %w", err)
+	}
+
+	report = &CompactionReport{Height: height}
+	if height == 0 {
+		return report, nil
+	}
+
+	if !dryRun {
+		defer func() {
+			fdb.recordAuditEvent(ctx, "compact_tombstones", map[string]interface{}{
+				"height":              height,
+				"lower_bound":         tabletString(lowerBound),
+				"tablet_count":        report.TabletCount,
+				"tombstone_count":     report.TombstoneCount,
+				"shadowed_row_count":  report.ShadowedRowCount,
+				"deleted_index_count": report.DeletedIndexCount,
+			}, &err)
+		}()
+	}
+
+	// Every version up to the last deletion of the primary key goes
+	counts, err := fdb.compactTablets(ctx, height, lowerBound, true, dryRun, func(versions []rowVersion) (compacted int) {
+		for i, version := range versions {
+			if version.deletion {
+				compacted = i + 1
+			}
+		}
+
+		for _, version := range versions[:compacted] {
+			if version.deletion {
+				report.TombstoneCount++
+			}
+		}
+
+		return compacted
+	})
+
+	report.TabletCount = counts.tabletCount
+	report.ShadowedRowCount = counts.rowCount - report.TombstoneCount
+	report.DeletedIndexCount = counts.deletedIndexCount
+	if err != nil {
+		return report, err
+	}
+
+	zlog.Info("tombstones compacted",
+		zap.Uint64("height", height),
+		zap.Int("tablet_count", report.TabletCount),
+		zap.Int("tombstone_count", report.TombstoneCount),
+		zap.Int("shadowed_row_count", report.ShadowedRowCount),
+		zap.Int("deleted_index_count", report.DeletedIndexCount),
+		zap.Bool("dry_run", dryRun),
+	)
+
+	return report, nil
+}
+
+// rowVersion is a version of a primary key considered for compaction, `deletion` is only known
+// when the rows are scanned with their values.
+type rowVersion struct {
+	key      []byte
+	height   uint64
+	deletion bool
+}
+
+// compactionCounts is the outcome of `compactTablets`, `rowCount` including the deletions.
+type compactionCounts struct {
+	tabletCount       int
+	rowCount          int
+	deletedIndexCount int
+}
+
+// compactTablets deletes, for each tablet (starting at `lowerBound` when set) indexed at or below
+// `height`, the leading versions of each primary key selected by `compactable` among the versions
+// (in height order) at or below the latest index snapshot at or below `height`.
+//
+// That index snapshot is kept, and so are the older ones not referencing any compacted version,
+// the others, which would resolve a primary key to a compacted version, are deleted.
+func (fdb *FluxDB) compactTablets(ctx context.Context, height uint64, lowerBound Tablet, withValues bool, dryRun bool, compactable func(versions []rowVersion) int) (counts compactionCounts, err error) {
+	indexesPerTablet, _, err := fdb.fetchTabletIndexes(ctx, height, lowerBound)
+	if err != nil {
+		return counts, fmt.Errorf("scan indexes: %w", err)
+	}
+
+	batch := fdb.store.NewBatch(zlog)
+	for _, tabletKey := range orderedIndexTabletKeys(indexesPerTablet) {
+		indexes := indexesPerTablet[tabletKey]
+
+		tablet, err := NewTablet([]byte(tabletKey))
+		if err != nil {
+			return counts, fmt.Errorf("new tablet for key %x: %w", []byte(tabletKey), err)
+		}
+
+		covering := indexes[0]
+		for _, index := range indexes[1:] {
+			if index.Height() > covering.Height() {
+				covering = index
+			}
+		}
+
+		garbage, referencedSpans, err := fdb.compactableRows(ctx, tablet, covering.Height(), withValues, compactable)
+		if err != nil {
+			return counts, fmt.Errorf("tablet %s: %w", tablet, err)
+		}
+
+		if len(garbage) == 0 {
+			continue
+		}
+
+		counts.tabletCount++
+		counts.rowCount += len(garbage)
+
+		for _, index := range indexes {
+			if index.Height() < covering.Height() && referencedSpans.contain(index.Height()) {
+				counts.deletedIndexCount++
+				garbage = append(garbage, KeyForSingletEntry(index))
+			}
+		}
+
+		if dryRun {
+			zlog.Debug("would compact tablet rows", zap.Stringer("tablet", tablet), zap.Uint64("index_height", covering.Height()), zap.Int("key_count", len(garbage)))
+			continue
+		}
+
+		for _, key := range garbage {
+			batch.PurgeRow(key)
+		}
+
+		if _, err := batch.FlushIfFull(ctx); err != nil {
+			return counts, fmt.Errorf("purge rows: %w", err)
+		}
+	}
+
+	if err := batch.Flush(ctx); err != nil {
+		return counts, fmt.Errorf("purge rows: %w", err)
+	}
+
+	return counts, nil
+}
+
+// heightSpans are half-open `[start, end)` height ranges.
+type heightSpans [][2]uint64
+
+func (s heightSpans) contain(height uint64) bool {
+	for _, span := range s {
+		if height >= span[0] && height < span[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compactableRows returns the keys of the rows of the tablet at or below `height` selected by
+// `compactable`, along with the heights at which an index snapshot would resolve a primary key to
+// one of them, from its first compacted version up to the version shadowing its last compacted
+// one (a deletion shadowing nothing, as index snapshots do not reference them).
+func (fdb *FluxDB) compactableRows(ctx context.Context, tablet Tablet, height uint64, withValues bool, compactable func(versions []rowVersion) int) (keys [][]byte, referencedSpans heightSpans, err error) {
+	// The versions of each primary key, in height (and ordinal) order
+	versionsByPrimaryKey := map[string][]rowVersion{}
+	var primaryKeys []string
+
+	onRow := func(key []byte, value []byte) error {
+		row, err := NewTabletRow(tablet, key, value)
+		if err != nil {
+			return fmt.Errorf("tablet new row %q: %w", Key(key), err)
+		}
+
+		primaryKey := string(row.PrimaryKey())
+		if _, found := versionsByPrimaryKey[primaryKey]; !found {
+			primaryKeys = append(primaryKeys, primaryKey)
+		}
+
+		version := rowVersion{key: append([]byte(nil), key...), height: row.Height(), deletion: withValues && row.IsDeletion()}
+		versionsByPrimaryKey[primaryKey] = append(versionsByPrimaryKey[primaryKey], version)
+
+		return nil
+	}
+
+	startKey, endKey := KeyForTabletAt(tablet, 0), KeyForTabletAt(tablet, height+1)
+	if withValues {
+		err = fdb.store.ScanTabletRows(ctx, startKey, endKey, onRow)
+	} else {
+		err = fdb.store.ScanTableKeys(ctx, store.RowsTable, startKey, endKey, func(key []byte) error {
+			return onRow(key, nil)
+		})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, primaryKey := range primaryKeys {
+		versions := versionsByPrimaryKey[primaryKey]
+
+		compacted := compactable(versions)
+		if compacted == 0 {
+			continue
+		}
+
+		for _, version := range versions[:compacted] {
+			keys = append(keys, version.key)
+		}
+
+		end := versions[compacted-1].height
+		if compacted < len(versions) {
+			end = versions[compacted].height
+		}
+
+		referencedSpans = append(referencedSpans, [2]uint64{versions[0].height, end})
+	}
+
+	return keys, referencedSpans, nil
+}
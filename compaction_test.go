@@ -0,0 +1,112 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactTombstones(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	olderIndex := NewTabletIndex()
+	olderIndex.AtHeight = 2
+	olderIndex.PrimaryKeyToHeight.put([]byte("001"), 2)
+	olderIndex.PrimaryKeyToHeight.put([]byte("002"), 1)
+
+	coveringIndex := NewTabletIndex()
+	coveringIndex.AtHeight = 4
+	coveringIndex.PrimaryKeyToHeight.put([]byte("002"), 1)
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b")}},
+		&WriteRequest{
+			Height:         2,
+			BlockRef:       bstream.NewBlockRef("00000002aa", 2),
+			TabletRows:     []TabletRow{tablet.row(t, 2, "001", "c")},
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), olderIndex)},
+		},
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), TabletRows: []TabletRow{tablet.row(t, 3, "001", "")}},
+		&WriteRequest{
+			Height:         4,
+			BlockRef:       bstream.NewBlockRef("00000004aa", 4),
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), coveringIndex)},
+		},
+		&WriteRequest{Height: 5, BlockRef: bstream.NewBlockRef("00000005aa", 5), TabletRows: []TabletRow{tablet.row(t, 5, "003", "d")}},
+	)
+
+	report, err := db.CompactTombstones(ctx, nil, true)
+	require.NoError(t, err)
+	assert.Equal(t, &CompactionReport{Height: 5, TabletCount: 1, TombstoneCount: 1, ShadowedRowCount: 2, DeletedIndexCount: 1}, report)
+
+	report, err = db.CompactTombstones(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, &CompactionReport{Height: 5, TabletCount: 1, TombstoneCount: 1, ShadowedRowCount: 2, DeletedIndexCount: 1}, report)
+
+	report, err = db.CompactTombstones(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, &CompactionReport{Height: 5}, report)
+
+	rows, err := db.ReadTabletAt(ctx, 5, tablet, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, []byte("002"), rows[0].PrimaryKey())
+	assert.Equal(t, []byte("003"), rows[1].PrimaryKey())
+
+	rows, err = db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 1, "history below the covering index no longer has the compacted rows")
+	assert.Equal(t, []byte("002"), rows[0].PrimaryKey())
+}
+
+func TestCompactTombstones_KeepsUnreferencingIndexes(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	olderIndex := NewTabletIndex()
+	olderIndex.AtHeight = 2
+	olderIndex.PrimaryKeyToHeight.put([]byte("001"), 1)
+
+	coveringIndex := NewTabletIndex()
+	coveringIndex.AtHeight = 5
+	coveringIndex.PrimaryKeyToHeight.put([]byte("001"), 1)
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "a")}},
+		&WriteRequest{
+			Height:         2,
+			BlockRef:       bstream.NewBlockRef("00000002aa", 2),
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), olderIndex)},
+		},
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), TabletRows: []TabletRow{tablet.row(t, 3, "002", "b")}},
+		&WriteRequest{Height: 4, BlockRef: bstream.NewBlockRef("00000004aa", 4), TabletRows: []TabletRow{tablet.row(t, 4, "002", "")}},
+		&WriteRequest{
+			Height:         5,
+			BlockRef:       bstream.NewBlockRef("00000005aa", 5),
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), coveringIndex)},
+		},
+	)
+
+	report, err := db.CompactTombstones(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, &CompactionReport{Height: 5, TabletCount: 1, TombstoneCount: 1, ShadowedRowCount: 1}, report, "the older index does not reference the compacted rows")
+
+	index, err := db.ReadTabletIndexAt(ctx, tablet, 2)
+	require.NoError(t, err)
+	require.NotNil(t, index)
+	assert.Equal(t, uint64(2), index.AtHeight)
+
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "a")}, rows)
+}
@@ -15,3 +15,10 @@
 package fluxdb
 
 var lastCheckpointRowKey = []byte("checkpoint")
+
+// The checkpoint table key tracking the last irreversible block, separately from the last
+// written one, must not start with `shard-` since this prefix is reserved to the shards.
+var lastIrreversibleRowKey = []byte("irreversible")
+
+// The checkpoint table key of the commit marker, see `committedReads`.
+var commitMarkerRowKey = []byte("committed")
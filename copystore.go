@@ -0,0 +1,432 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sync"
+
+	"github.com/abourget/llerrgroup"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+const defaultCopyStoreWorkers = 4
+const defaultCopyStoreBatchSize = 1000
+
+// copyStoreProgressPrefix prefixes the destination checkpoint table keys tracking the last key
+// copied of each range, so an interrupted copy resumes where it stopped. They are deleted once
+// the copy completes.
+var copyStoreProgressPrefix = []byte("copy-progress-")
+
+// CopyStoreOptions controls a `CopyStore` operation.
+type CopyStoreOptions struct {
+	// Workers is the amount of key ranges of the rows table copied in parallel, defaults to 4,
+	// an interrupted copy must be resumed with the same amount of workers
+	Workers int
+
+	// BatchSize is the amount of keys written to the destination at once, defaults to 1000
+	BatchSize int
+
+	// Verify compares the checksums of each range in both stores once copied
+	Verify bool
+
+	// OnProgress, when set, is called after each batch written to the destination, it's called
+	// concurrently by the workers
+	OnProgress func(progress CopyStoreProgress)
+}
+
+// CopyStoreProgress reports the keys of a range copied so far by a `CopyStore` operation.
+type CopyStoreProgress struct {
+	Range       int
+	CopiedCount int
+	LastKey     []byte
+}
+
+// CopyStoreStats summarizes a completed `CopyStore` operation.
+type CopyStoreStats struct {
+	RowCount        int
+	CheckpointCount int
+	ResumedRanges   int
+	Verified        bool
+
+	// CustomTableRowCount is the amount of rows copied from the custom tables, see
+	// `store.RegisterTable`
+	CustomTableRowCount int
+}
+
+// CopyStore copies all the rows, indexes, custom tables (see `store.RegisterTable`) and checkpoints
+// of the store at `srcDSN` to the one at `dstDSN`, possibly of a different backend, so the
+// backend can be changed without replaying the chain. The rows table is split in key ranges copied in parallel, each range tracking its
+// progress in the destination so an interrupted copy resumes where it stopped. The checkpoints
+// are copied last, once all the rows are, so the destination is never considered more advanced
+// than it is.
+func CopyStore(ctx context.Context, srcDSN, dstDSN string, options CopyStoreOptions) (*CopyStoreStats, error) {
+	src, err := NewKVStore(srcDSN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create source store: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := NewKVStore(dstDSN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create destination store: %w", err)
+	}
+	defer dst.Close()
+
+	return copyStore(ctx, src, dst, options)
+}
+
+func copyStore(ctx context.Context, src, dst store.KVStore, options CopyStoreOptions) (*CopyStoreStats, error) {
+	workers := options.Workers
+	if workers <= 0 {
+		workers = defaultCopyStoreWorkers
+	}
+
+	if workers > 256 {
+		return nil, fmt.Errorf("invalid workers count %d, at most 256 ranges are supported", workers)
+	}
+
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultCopyStoreBatchSize
+	}
+
+	if err := checkCopyProgress(ctx, dst, workers); err != nil {
+		return nil, fmt.Errorf("check copy progress: %w", err)
+	}
+
+	zlog.Info("copying store", zap.Int("workers", workers), zap.Bool("verify", options.Verify))
+
+	stats := &CopyStoreStats{Verified: options.Verify}
+	statsLock := sync.Mutex{}
+
+	eg := llerrgroup.New(workers)
+	for i := 0; i < workers; i++ {
+		if eg.Stop() {
+			break
+		}
+
+		copier := &rangeCopier{
+			src:        src,
+			dst:        dst,
+			index:      i,
+			rangeCount: workers,
+			batchSize:  batchSize,
+			onProgress: options.OnProgress,
+		}
+		copier.keyStart, copier.keyEnd = copyStoreRange(i, workers)
+
+		eg.Go(func() error {
+			copiedCount, resumed, err := copier.copy(ctx)
+			if err != nil {
+				return fmt.Errorf("copy range %d: %w", copier.index, err)
+			}
+
+			if options.Verify {
+				if err := verifyCopiedRange(ctx, src, dst, store.RowsTable, copier.keyStart, copier.keyEnd); err != nil {
+					return fmt.Errorf("verify range %d: %w", copier.index, err)
+				}
+			}
+
+			statsLock.Lock()
+			defer statsLock.Unlock()
+
+			stats.RowCount += copiedCount
+			if resumed {
+				stats.ResumedRanges++
+			}
+
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, table := range store.CustomTables() {
+		count, err := copyCustomTable(ctx, src, dst, table, batchSize)
+		if err != nil {
+			return nil, fmt.Errorf("copy table %q: %w", table, err)
+		}
+		stats.CustomTableRowCount += count
+
+		if options.Verify {
+			if err := verifyCopiedRange(ctx, src, dst, table, nil, nil); err != nil {
+				return nil, fmt.Errorf("verify table %q: %w", table, err)
+			}
+		}
+	}
+
+	checkpointCount, err := copyCheckpoints(ctx, src, dst)
+	if err != nil {
+		return nil, fmt.Errorf("copy checkpoints: %w", err)
+	}
+	stats.CheckpointCount = checkpointCount
+
+	if err := dst.DeleteShardsCheckpoint(ctx, copyStoreProgressPrefix); err != nil {
+		return nil, fmt.Errorf("delete copy progress: %w", err)
+	}
+
+	if options.Verify {
+		if err := verifyCopiedRange(ctx, src, dst, store.CheckpointsTable, nil, nil); err != nil {
+			return nil, fmt.Errorf("verify checkpoints: %w", err)
+		}
+	}
+
+	zlog.Info("store copied",
+		zap.Int("row_count", stats.RowCount),
+		zap.Int("checkpoint_count", stats.CheckpointCount),
+		zap.Int("resumed_ranges", stats.ResumedRanges),
+	)
+
+	return stats, nil
+}
+
+// copyStoreRange splits the key space in `rangeCount` ranges on the first byte of the keys,
+// the first range starting at the beginning of the table and the last one ending at its end.
+func copyStoreRange(index, rangeCount int) (keyStart, keyEnd []byte) {
+	if index > 0 {
+		keyStart = []byte{byte(index * 256 / rangeCount)}
+	}
+
+	if index < rangeCount-1 {
+		keyEnd = []byte{byte((index + 1) * 256 / rangeCount)}
+	}
+
+	return
+}
+
+type rangeCopier struct {
+	src, dst   store.KVStore
+	index      int
+	rangeCount int
+	keyStart   []byte
+	keyEnd     []byte
+	batchSize  int
+	onProgress func(progress CopyStoreProgress)
+}
+
+func (c *rangeCopier) progressKey() []byte {
+	return append(append([]byte(nil), copyStoreProgressPrefix...), fmt.Sprintf("%03d", c.index)...)
+}
+
+func (c *rangeCopier) copy(ctx context.Context) (copiedCount int, resumed bool, err error) {
+	start := c.keyStart
+
+	lastKey, err := c.resumeKey(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if lastKey != nil {
+		zlog.Info("resuming range copy", zap.Int("range", c.index), zap.Stringer("last_key", Key(lastKey)))
+		start = append(lastKey, 0x00)
+		resumed = true
+	}
+
+	batch := c.dst.NewBatch(zlog)
+	pending := 0
+	flush := func(lastKey []byte) error {
+		// The progress is written in the same batch, the checkpoint table being flushed after the
+		// rows one, it's never ahead of the rows actually written
+		batch.SetLastCheckpoint(c.progressKey(), c.marshalProgress(lastKey))
+		if err := batch.Flush(ctx); err != nil {
+			return fmt.Errorf("flush: %w", err)
+		}
+
+		copiedCount += pending
+		pending = 0
+
+		if c.onProgress != nil {
+			c.onProgress(CopyStoreProgress{Range: c.index, CopiedCount: copiedCount, LastKey: lastKey})
+		}
+
+		return nil
+	}
+
+	var previousKey []byte
+	err = c.src.ScanTable(ctx, store.RowsTable, start, c.keyEnd, func(key []byte, value []byte) error {
+		previousKey = append([]byte(nil), key...)
+		batch.SetRow(previousKey, append([]byte(nil), value...))
+
+		pending++
+		if pending >= c.batchSize {
+			return flush(previousKey)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return copiedCount, resumed, fmt.Errorf("scan source: %w", err)
+	}
+
+	if pending > 0 {
+		if err := flush(previousKey); err != nil {
+			return copiedCount, resumed, err
+		}
+	}
+
+	return copiedCount, resumed, nil
+}
+
+func (c *rangeCopier) marshalProgress(lastKey []byte) []byte {
+	value := make([]byte, 4+len(lastKey))
+	bigEndian.PutUint32(value, uint32(c.rangeCount))
+	copy(value[4:], lastKey)
+
+	return value
+}
+
+func (c *rangeCopier) resumeKey(ctx context.Context) ([]byte, error) {
+	value, err := c.dst.FetchLastWrittenCheckpoint(ctx, c.progressKey())
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("fetch copy progress: %w", err)
+	}
+
+	if len(value) < 4 {
+		return nil, fmt.Errorf("invalid copy progress value %x", value)
+	}
+
+	return append([]byte(nil), value[4:]...), nil
+}
+
+// checkCopyProgress ensures an interrupted copy is resumed with the same amount of ranges
+// before any range is copied.
+func checkCopyProgress(ctx context.Context, dst store.KVStore, rangeCount int) error {
+	return dst.ScanLastShardsWrittenCheckpoint(ctx, copyStoreProgressPrefix, func(key []byte, value []byte) error {
+		if len(value) < 4 {
+			return fmt.Errorf("invalid copy progress value %x", value)
+		}
+
+		if previousRangeCount := int(bigEndian.Uint32(value)); previousRangeCount != rangeCount {
+			return fmt.Errorf("interrupted copy used %d workers, it must be resumed with the same amount, got %d", previousRangeCount, rangeCount)
+		}
+
+		return nil
+	})
+}
+
+// copyCheckpoints copies the checkpoint table, except leases which are only meaningful
+// for the injectors running against the source store.
+func copyCheckpoints(ctx context.Context, src, dst store.KVStore) (count int, err error) {
+	batch := dst.NewBatch(zlog)
+	err = src.ScanTable(ctx, store.CheckpointsTable, nil, nil, func(key []byte, value []byte) error {
+		if skipCopiedCheckpoint(key) {
+			return nil
+		}
+
+		batch.SetLastCheckpoint(append([]byte(nil), key...), append([]byte(nil), value...))
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("scan source: %w", err)
+	}
+
+	if err := batch.Flush(ctx); err != nil {
+		return 0, fmt.Errorf("flush: %w", err)
+	}
+
+	return count, nil
+}
+
+// copyCustomTable copies the custom table, it's copied whole on each run, custom tables being
+// expected to be small compared to the rows table.
+func copyCustomTable(ctx context.Context, src, dst store.KVStore, table store.Table, batchSize int) (count int, err error) {
+	batch := dst.NewBatch(zlog)
+	err = src.ScanTable(ctx, table, nil, nil, func(key []byte, value []byte) error {
+		batch.SetTableRow(table, append([]byte(nil), key...), append([]byte(nil), value...))
+		count++
+
+		if count%batchSize == 0 {
+			return batch.Flush(ctx)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("scan source: %w", err)
+	}
+
+	if err := batch.Flush(ctx); err != nil {
+		return 0, fmt.Errorf("flush: %w", err)
+	}
+
+	return count, nil
+}
+
+func skipCopiedCheckpoint(key []byte) bool {
+	return bytes.HasPrefix(key, []byte("lock-")) || bytes.HasPrefix(key, copyStoreProgressPrefix)
+}
+
+func verifyCopiedRange(ctx context.Context, src, dst store.KVStore, table store.Table, keyStart, keyEnd []byte) error {
+	srcChecksum, srcCount, err := rangeChecksum(ctx, src, table, keyStart, keyEnd)
+	if err != nil {
+		return fmt.Errorf("source checksum: %w", err)
+	}
+
+	dstChecksum, dstCount, err := rangeChecksum(ctx, dst, table, keyStart, keyEnd)
+	if err != nil {
+		return fmt.Errorf("destination checksum: %w", err)
+	}
+
+	if srcChecksum != dstChecksum {
+		return fmt.Errorf("checksum mismatch, source has %d keys (checksum %s), destination has %d keys (checksum %s)", srcCount, srcChecksum, dstCount, dstChecksum)
+	}
+
+	return nil
+}
+
+// rangeChecksum computes the checksum of all the keys and values of the range, the checkpoint
+// table keys not copied by `CopyStore` being ignored.
+func rangeChecksum(ctx context.Context, kvStore store.KVStore, table store.Table, keyStart, keyEnd []byte) (checksum string, count int, err error) {
+	hasher := sha256.New()
+	err = kvStore.ScanTable(ctx, table, keyStart, keyEnd, func(key []byte, value []byte) error {
+		if table == store.CheckpointsTable && skipCopiedCheckpoint(key) {
+			return nil
+		}
+
+		writeChecksumPart(hasher, key)
+		writeChecksumPart(hasher, value)
+		count++
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), count, nil
+}
+
+// writeChecksumPart writes the length before the data so different key/value splits of the
+// same bytes do not collide.
+func writeChecksumPart(hasher hash.Hash, data []byte) {
+	length := make([]byte, 4)
+	bigEndian.PutUint32(length, uint32(len(data)))
+
+	hasher.Write(length)
+	hasher.Write(data)
+}
@@ -0,0 +1,133 @@
+package fluxdb
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyStore(t *testing.T) {
+	src, srcCloser := NewTestDB(t)
+	defer srcCloser()
+
+	dst, dstCloser := NewTestDB(t)
+	defer dstCloser()
+
+	ctx := context.Background()
+	batch := src.store.NewBatch(zlog)
+	for _, key := range []string{"\x00a", "\x00b", "\x10a", "\x80a", "\x80b", "\x80c", "\xffa"} {
+		batch.SetRow([]byte(key), []byte("v"+key))
+	}
+	batch.SetRow([]byte("\x80d"), nil)
+	batch.SetLastCheckpoint([]byte("checkpoint"), []byte("c"))
+	batch.SetLastCheckpoint([]byte("lock-shard-000"), []byte("l"))
+	require.NoError(t, batch.Flush(ctx))
+
+	var progressCount int32
+	stats, err := copyStore(ctx, src.store, dst.store, CopyStoreOptions{
+		Workers:    3,
+		BatchSize:  2,
+		Verify:     true,
+		OnProgress: func(progress CopyStoreProgress) { atomic.AddInt32(&progressCount, 1) },
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, &CopyStoreStats{RowCount: 8, CheckpointCount: 1, Verified: true}, stats)
+	assert.Equal(t, int32(5), progressCount)
+	assert.Equal(t, tableContent(t, src.store, store.RowsTable), tableContent(t, dst.store, store.RowsTable))
+	assert.Equal(t, map[string]string{"checkpoint": "c"}, tableContent(t, dst.store, store.CheckpointsTable))
+}
+
+const testCustomTable = 0xF0
+
+func init() {
+	store.RegisterTable(testCustomTable, "test-meta")
+}
+
+func TestCopyStore_CustomTables(t *testing.T) {
+	src, srcCloser := NewTestDB(t)
+	defer srcCloser()
+
+	dst, dstCloser := NewTestDB(t)
+	defer dstCloser()
+
+	ctx := context.Background()
+	batch := src.store.NewBatch(zlog)
+	batch.SetRow([]byte("\x00a"), []byte("v"))
+	for _, key := range []string{"a", "b", "c"} {
+		batch.SetTableRow(testCustomTable, []byte(key), []byte("m"+key))
+	}
+	require.NoError(t, batch.Flush(ctx))
+
+	stats, err := copyStore(ctx, src.store, dst.store, CopyStoreOptions{BatchSize: 2, Verify: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, &CopyStoreStats{RowCount: 1, CustomTableRowCount: 3, Verified: true}, stats)
+	assert.Equal(t, map[string]string{"a": "ma", "b": "mb", "c": "mc"}, tableContent(t, dst.store, testCustomTable))
+}
+
+func TestCopyStore_Resume(t *testing.T) {
+	src, srcCloser := NewTestDB(t)
+	defer srcCloser()
+
+	dst, dstCloser := NewTestDB(t)
+	defer dstCloser()
+
+	ctx := context.Background()
+	batch := src.store.NewBatch(zlog)
+	for _, key := range []string{"\x00a", "\x00b", "\x00c", "\x80a"} {
+		batch.SetRow([]byte(key), []byte("v"))
+	}
+	require.NoError(t, batch.Flush(ctx))
+
+	// Range 0 of an interrupted copy with 2 workers stopped after "\x00b"
+	copier := &rangeCopier{index: 0, rangeCount: 2}
+	batch = dst.store.NewBatch(zlog)
+	batch.SetLastCheckpoint(copier.progressKey(), copier.marshalProgress([]byte("\x00b")))
+	require.NoError(t, batch.Flush(ctx))
+
+	_, err := copyStore(ctx, src.store, dst.store, CopyStoreOptions{Workers: 3})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "interrupted copy used 2 workers, it must be resumed with the same amount, got 3")
+	assert.Empty(t, tableContent(t, dst.store, store.RowsTable))
+
+	stats, err := copyStore(ctx, src.store, dst.store, CopyStoreOptions{Workers: 2})
+	require.NoError(t, err)
+
+	assert.Equal(t, &CopyStoreStats{RowCount: 2, ResumedRanges: 1}, stats)
+	assert.Equal(t, map[string]string{"\x00c": "v", "\x80a": "v"}, tableContent(t, dst.store, store.RowsTable))
+	assert.Empty(t, tableContent(t, dst.store, store.CheckpointsTable))
+}
+
+func TestCopyStoreRange(t *testing.T) {
+	tests := []struct {
+		index, rangeCount int
+		expectedStart     []byte
+		expectedEnd       []byte
+	}{
+		{0, 1, nil, nil},
+		{0, 2, nil, []byte{0x80}},
+		{1, 2, []byte{0x80}, nil},
+		{1, 3, []byte{0x55}, []byte{0xAA}},
+	}
+
+	for _, test := range tests {
+		start, end := copyStoreRange(test.index, test.rangeCount)
+		assert.Equal(t, test.expectedStart, start)
+		assert.Equal(t, test.expectedEnd, end)
+	}
+}
+
+func tableContent(t *testing.T, kvStore store.KVStore, table store.Table) map[string]string {
+	out := map[string]string{}
+	require.NoError(t, kvStore.ScanTable(context.Background(), table, nil, nil, func(key []byte, value []byte) error {
+		out[string(key)] = string(value)
+		return nil
+	}))
+
+	return out
+}
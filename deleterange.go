@@ -0,0 +1,197 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+const defaultDeleteRangeBatchSize = 1000
+
+// DeleteRangeOptions controls a `DeleteRange` operation.
+type DeleteRangeOptions struct {
+	// DryRun only counts the keys that would be deleted, no confirmation token is required
+	DryRun bool
+
+	// ConfirmationToken must be equal to `DeleteRangeConfirmationToken` of the deleted range,
+	// ensuring the range deleted is the one that was reviewed in dry run
+	ConfirmationToken string
+
+	// BatchSize is the amount of keys deleted at once, defaults to 1000
+	BatchSize int
+
+	// MaxKeysPerSecond rate limits the deletions, 0 means unlimited
+	MaxKeysPerSecond int
+
+	// OnProgress, when set, is called after each batch of keys scanned (and deleted)
+	OnProgress func(progress DeleteRangeProgress)
+}
+
+// DeleteRangeProgress reports the keys of a `DeleteRange` operation processed so far.
+type DeleteRangeProgress struct {
+	ScannedCount int
+	DeletedCount int
+	FirstKey     []byte
+	LastKey      []byte
+}
+
+// DeleteRangeConfirmationToken returns the token confirming the deletion of the range
+// [keyStart, keyEnd[ of the table, derived from the range itself so a token reviewed for a
+// range cannot be used to delete another one.
+func DeleteRangeConfirmationToken(table store.Table, keyStart, keyEnd []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(table.String()))
+	hash.Write([]byte(hex.EncodeToString(keyStart)))
+	hash.Write([]byte{':'})
+	hash.Write([]byte(hex.EncodeToString(keyEnd)))
+
+	return hex.EncodeToString(hash.Sum(nil))[0:12]
+}
+
+// DeleteRange completely deletes the keys in range [keyStart, keyEnd[ of the storage table, for
+// surgical cleanup of garbage written under a collection prefix by a faulty mapper. Both bounds
+// are mandatory, the deletion bypasses the write path and is not undoable, hence the mandatory
+// confirmation token (see `DeleteRangeOptions`).
+func (fdb *FluxDB) DeleteRange(ctx context.Context, table store.Table, keyStart, keyEnd []byte, options DeleteRangeOptions) (progress *DeleteRangeProgress, err error) {
+	if !table.IsKnown() {
+		return nil, fmt.Errorf("unknown table %s", table)
+	}
+
+	if len(keyStart) == 0 || len(keyEnd) == 0 {
+		return nil, errors.New("both start and end keys must be provided, deleting a whole table is not supported")
+	}
+
+	if bytes.Compare(keyStart, keyEnd) >= 0 {
+		return nil, fmt.Errorf("start key %q must be lower than end key %q", Key(keyStart), Key(keyEnd))
+	}
+
+	if !options.DryRun {
+		expectedToken := DeleteRangeConfirmationToken(table, keyStart, keyEnd)
+		if options.ConfirmationToken != expectedToken {
+			return nil, fmt.Errorf("invalid confirmation token %q, run a dry run first to review the range and obtain its token", options.ConfirmationToken)
+		}
+	}
+
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultDeleteRangeBatchSize
+	}
+
+	zlog.Info("deleting range",
+		zap.Stringer("table", table),
+		zap.Stringer("start", Key(keyStart)),
+		zap.Stringer("end", Key(keyEnd)),
+		zap.Bool("dry_run", options.DryRun),
+	)
+
+	progress = &DeleteRangeProgress{}
+	if !options.DryRun {
+		defer func() {
+			fdb.recordAuditEvent(ctx, "delete_range", map[string]interface{}{
+				"table":         table.String(),
+				"start":         Key(keyStart).String(),
+				"end":           Key(keyEnd).String(),
+				"deleted_count": progress.DeletedCount,
+			}, &err)
+		}()
+	}
+
+	startedAt := time.Now()
+	start := keyStart
+	for {
+		keys := make([][]byte, 0, batchSize)
+		err := fdb.store.ScanTableKeys(ctx, table, start, keyEnd, func(key []byte) error {
+			keys = append(keys, append([]byte(nil), key...))
+			if len(keys) >= batchSize {
+				return store.BreakScan
+			}
+
+			return nil
+		})
+		if err != nil {
+			return progress, fmt.Errorf("scan range: %w", err)
+		}
+
+		if len(keys) <= 0 {
+			break
+		}
+
+		if !options.DryRun {
+			if err := waitDeleteRate(ctx, startedAt, progress.DeletedCount+len(keys), options.MaxKeysPerSecond); err != nil {
+				return progress, err
+			}
+
+			if err := fdb.store.DeleteTableKeys(ctx, table, keys); err != nil {
+				return progress, fmt.Errorf("delete keys: %w", err)
+			}
+
+			progress.DeletedCount += len(keys)
+		}
+
+		if progress.FirstKey == nil {
+			progress.FirstKey = keys[0]
+		}
+		progress.LastKey = keys[len(keys)-1]
+		progress.ScannedCount += len(keys)
+
+		if options.OnProgress != nil {
+			options.OnProgress(*progress)
+		}
+
+		if len(keys) < batchSize {
+			break
+		}
+
+		// Resumes right after the last key processed, the smallest key greater than it
+		start = append(append([]byte(nil), progress.LastKey...), 0x00)
+	}
+
+	zlog.Info("range deleted",
+		zap.Int("scanned_count", progress.ScannedCount),
+		zap.Int("deleted_count", progress.DeletedCount),
+		zap.Duration("elapsed", time.Since(startedAt)),
+	)
+
+	return progress, nil
+}
+
+// waitDeleteRate blocks until deleting up to `count` keys since `startedAt` respects the
+// maximum rate.
+func waitDeleteRate(ctx context.Context, startedAt time.Time, count int, maxKeysPerSecond int) error {
+	if maxKeysPerSecond <= 0 {
+		return nil
+	}
+
+	wait := time.Duration(count)*time.Second/time.Duration(maxKeysPerSecond) - time.Since(startedAt)
+	if wait <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteRange(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	batch := db.store.NewBatch(zlog)
+	for _, key := range []string{"a0", "b1", "b2", "b3", "b4", "c0"} {
+		batch.SetRow([]byte(key), []byte("v"))
+	}
+	require.NoError(t, batch.Flush(ctx))
+
+	start, end := []byte("b"), []byte("c")
+
+	var progresses []DeleteRangeProgress
+	progress, err := db.DeleteRange(ctx, store.RowsTable, start, end, DeleteRangeOptions{
+		DryRun:     true,
+		BatchSize:  3,
+		OnProgress: func(progress DeleteRangeProgress) { progresses = append(progresses, progress) },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &DeleteRangeProgress{ScannedCount: 4, FirstKey: []byte("b1"), LastKey: []byte("b4")}, progress)
+	assert.Len(t, progresses, 2)
+	assert.Equal(t, []string{"a0", "b1", "b2", "b3", "b4", "c0"}, rowKeys(t, db))
+
+	_, err = db.DeleteRange(ctx, store.RowsTable, start, end, DeleteRangeOptions{ConfirmationToken: "wrong"})
+	assert.Error(t, err)
+
+	_, err = db.DeleteRange(ctx, store.RowsTable, end, start, DeleteRangeOptions{DryRun: true})
+	assert.EqualError(t, err, `start key "63" must be lower than end key "62"`)
+
+	_, err = db.DeleteRange(ctx, store.RowsTable, nil, end, DeleteRangeOptions{DryRun: true})
+	assert.Error(t, err)
+
+	progress, err = db.DeleteRange(ctx, store.RowsTable, start, end, DeleteRangeOptions{
+		ConfirmationToken: DeleteRangeConfirmationToken(store.RowsTable, start, end),
+		BatchSize:         3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 4, progress.DeletedCount)
+	assert.Equal(t, []string{"a0", "c0"}, rowKeys(t, db))
+}
+
+func TestDeleteRangeConfirmationToken(t *testing.T) {
+	token := DeleteRangeConfirmationToken(store.RowsTable, []byte("b"), []byte("c"))
+
+	assert.Len(t, token, 12)
+	assert.Equal(t, token, DeleteRangeConfirmationToken(store.RowsTable, []byte("b"), []byte("c")))
+	assert.NotEqual(t, token, DeleteRangeConfirmationToken(store.CheckpointsTable, []byte("b"), []byte("c")))
+	assert.NotEqual(t, token, DeleteRangeConfirmationToken(store.RowsTable, []byte("b"), []byte("d")))
+}
+
+func rowKeys(t *testing.T, db *FluxDB) (out []string) {
+	require.NoError(t, db.store.ScanTableKeys(context.Background(), store.RowsTable, nil, nil, func(key []byte) error {
+		out = append(out, string(key))
+		return nil
+	}))
+
+	return
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"container/list"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+)
+
+// EnableWriteElision skips the write of a singlet entry or a tablet row when its value is
+// byte-identical to the last value written for the same singlet or tablet primary key, many
+// chains re-emit unchanged table rows every block. The last written values of up to `cacheSize`
+// keys are kept in memory (least recently written ones are evicted first), a key not in the
+// cache is always written.
+//
+// Reading back an elided row (or singlet entry) returns the previous identical one, so its
+// height is the one at which its value last changed, not the one at which it was last emitted.
+func (fdb *FluxDB) EnableWriteElision(cacheSize int) {
+	fdb.writeElider = newWriteElider(cacheSize)
+}
+
+// writeElider is a bounded cache of the last value written per key, it's accessed only by
+// the writing goroutine and as such is not safe for concurrent use.
+type writeElider struct {
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type elidedValue struct {
+	key   string
+	value []byte
+}
+
+func newWriteElider(capacity int) *writeElider {
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	return &writeElider{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// shouldElide returns true when `value` is identical to the last value recorded for `key` (a
+// singlet key or a tablet key followed by the row primary key),
+// otherwise records it as the last value of `key`. Safe to call on a `nil` elider, in which
+// case nothing is ever elided.
+func (e *writeElider) shouldElide(key []byte, value []byte) bool {
+	if e == nil {
+		return false
+	}
+
+	if element, found := e.entries[string(key)]; found {
+		e.order.MoveToFront(element)
+
+		previous := element.Value.(*elidedValue)
+		if bytes.Equal(previous.value, value) && (previous.value == nil) == (value == nil) {
+			metrics.ElidedWriteCount.Inc(collectionName(collectionFromKey(key)))
+			return true
+		}
+
+		previous.value = value
+		return false
+	}
+
+	e.entries[string(key)] = e.order.PushFront(&elidedValue{key: string(key), value: value})
+	if e.order.Len() > e.capacity {
+		oldest := e.order.Back()
+		e.order.Remove(oldest)
+		delete(e.entries, oldest.Value.(*elidedValue).key)
+	}
+
+	return false
+}
+
+// forget drops the value recorded for `key`, if any, so the next value of `key` is always
+// written. Safe to call on a `nil` elider.
+func (e *writeElider) forget(key []byte) {
+	if e == nil {
+		return
+	}
+
+	if element, found := e.entries[string(key)]; found {
+		e.order.Remove(element)
+		delete(e.entries, string(key))
+	}
+}
+
+// reset forgets all recorded values, must be called when a write fails since the recorded
+// values might then not be the ones in the store.
+func (e *writeElider) reset() {
+	if e == nil {
+		return
+	}
+
+	e.entries = make(map[string]*list.Element, e.capacity)
+	e.order.Init()
+}
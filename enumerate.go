@@ -0,0 +1,156 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// ScanTablets calls `onTablet`, in key order, with each distinct tablet having rows in the store
+// whose key starts with `prefix`, the collection (2 bytes) possibly followed by the start of the
+// tablet identifiers (e.g. the contract of the tables to list). The rows of each tablet are
+// skipped over, so the cost is proportional to the amount of tablets, not to the amount of rows.
+// Return `store.BreakScan` from `onTablet` to stop the scan early.
+//
+// **Important** Tablets whose rows were all deleted are still listed, their deletion rows being
+// present in the store.
+func (fdb *FluxDB) ScanTablets(ctx context.Context, prefix []byte, onTablet func(tablet Tablet) error) error {
+	if len(prefix) < collectionBytes {
+		return fmt.Errorf("invalid prefix length, expected at least %d bytes (the collection), got %d", collectionBytes, len(prefix))
+	}
+
+	if _, found := tabletFactories[collectionFromKey(prefix)]; !found {
+		return fmt.Errorf("unknown tablet collection 0x%04X", collectionFromKey(prefix))
+	}
+
+	start, end := prefix, keySuccessor(prefix)
+	for {
+		key, _, err := fdb.firstRow(ctx, start, end, true)
+		if err != nil {
+			return err
+		}
+
+		if key == nil {
+			return nil
+		}
+
+		tablet, err := NewTablet(key)
+		if err != nil {
+			return fmt.Errorf("invalid tablet row key %q: %w", Key(key), err)
+		}
+
+		if err := onTablet(tablet); err != nil {
+			if err == store.BreakScan {
+				return nil
+			}
+
+			return err
+		}
+
+		if start = keySuccessor(KeyForTablet(tablet)); start == nil {
+			return nil
+		}
+	}
+}
+
+// ScanSinglets calls `onSinglet`, in key order, with each distinct singlet having entries in the
+// store whose key starts with `prefix`, the collection (2 bytes) possibly followed by the start
+// of the singlet identifiers, along with the height of its latest entry and whether this entry is
+// a deletion. The older entries of each singlet are skipped over, so the cost is proportional to
+// the amount of singlets, not to the amount of entries. Return `store.BreakScan` from
+// `onSinglet` to stop the scan early.
+func (fdb *FluxDB) ScanSinglets(ctx context.Context, prefix []byte, onSinglet func(singlet Singlet, latestHeight uint64, deleted bool) error) error {
+	if len(prefix) < collectionBytes {
+		return fmt.Errorf("invalid prefix length, expected at least %d bytes (the collection), got %d", collectionBytes, len(prefix))
+	}
+
+	if _, found := singletFactories[collectionFromKey(prefix)]; !found {
+		return fmt.Errorf("unknown singlet collection 0x%04X", collectionFromKey(prefix))
+	}
+
+	start, end := prefix, keySuccessor(prefix)
+	for {
+		// Heights are inverted in singlet entry keys, the first entry of a singlet is its latest one
+		key, value, err := fdb.firstRow(ctx, start, end, false)
+		if err != nil {
+			return err
+		}
+
+		if key == nil {
+			return nil
+		}
+
+		singlet, err := NewSinglet(key)
+		if err != nil {
+			return fmt.Errorf("invalid singlet entry key %q: %w", Key(key), err)
+		}
+
+		singletKey := KeyForSinglet(singlet)
+		if len(key) < len(singletKey)+heightBytes {
+			return fmt.Errorf("invalid singlet entry key %q: too short", Key(key))
+		}
+
+		if err := onSinglet(singlet, ^bigEndian.Uint64(key[len(singletKey):]), len(value) == 0); err != nil {
+			if err == store.BreakScan {
+				return nil
+			}
+
+			return err
+		}
+
+		if start = keySuccessor(singletKey); start == nil {
+			return nil
+		}
+	}
+}
+
+// firstRow returns the first key, and its value unless `keyOnly` is set, of range [start, end[
+// of the rows table, `nil` if the range is empty.
+func (fdb *FluxDB) firstRow(ctx context.Context, start, end []byte, keyOnly bool) (key []byte, value []byte, err error) {
+	onRow := func(rowKey []byte, rowValue []byte) error {
+		key = append([]byte(nil), rowKey...)
+		value = rowValue
+		return store.BreakScan
+	}
+
+	if keyOnly {
+		err = fdb.store.ScanTableKeys(ctx, store.RowsTable, start, end, func(rowKey []byte) error { return onRow(rowKey, nil) })
+	} else {
+		err = fdb.store.ScanTable(ctx, store.RowsTable, start, end, onRow)
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("scan rows: %w", err)
+	}
+
+	return key, value, nil
+}
+
+// keySuccessor returns the smallest key greater than all the keys starting with `prefix`, `nil`
+// when there is none (the prefix is made only of 0xFF bytes).
+func keySuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xFF {
+			out := append([]byte(nil), prefix[:i+1]...)
+			out[i]++
+			return out
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanTablets(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	aaa, aab, bbb := newTestTablet("aaa"), newTestTablet("aab"), newTestTablet("bbb")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1),
+			TabletRows:     []TabletRow{aaa.row(t, 1, "001", "r #1"), aaa.row(t, 1, "002", "r #1"), bbb.row(t, 1, "001", "r #1")},
+			SingletEntries: []SingletEntry{newTestSinglet("sgl").entry(t, 1, "s #1")},
+		},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), TabletRows: []TabletRow{aaa.row(t, 2, "001", "r #2"), aab.row(t, 2, "001", "r #2")}},
+	)
+
+	scan := func(prefix []byte, limit int) (tablets []Tablet) {
+		require.NoError(t, db.ScanTablets(ctx, prefix, func(tablet Tablet) error {
+			tablets = append(tablets, tablet)
+			if len(tablets) >= limit {
+				return store.BreakScan
+			}
+			return nil
+		}))
+
+		return
+	}
+
+	collection := []byte{0xFF, 0xF2}
+	assert.Equal(t, []Tablet{aaa, aab, bbb}, scan(collection, 10))
+	assert.Equal(t, []Tablet{aaa, aab}, scan(append(collection, 'a'), 10))
+	assert.Equal(t, []Tablet{aab}, scan(append(collection, 'a', 'a', 'b'), 10))
+	assert.Equal(t, []Tablet{aaa}, scan(collection, 1))
+	assert.Empty(t, scan(append(collection, 'c'), 10))
+
+	assert.Error(t, db.ScanTablets(ctx, []byte{0xFF}, func(Tablet) error { return nil }))
+	assert.Error(t, db.ScanTablets(ctx, []byte{0xFF, 0xF1}, func(Tablet) error { return nil }), "singlet collection")
+}
+
+func TestKeySuccessor(t *testing.T) {
+	assert.Equal(t, []byte{0x01, 0x03}, keySuccessor([]byte{0x01, 0x02}))
+	assert.Equal(t, []byte{0x02}, keySuccessor([]byte{0x01, 0xFF}))
+	assert.Nil(t, keySuccessor([]byte{0xFF, 0xFF}))
+}
+
+func TestScanSinglets(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	sga, sgb, sgc := newTestSinglet("sga"), newTestSinglet("sgb"), newTestSinglet("sgc")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1),
+			SingletEntries: []SingletEntry{sga.entry(t, 1, "a #1"), sgb.entry(t, 1, "b #1"), sgc.entry(t, 1, "c #1")},
+			TabletRows:     []TabletRow{newTestTablet("tbl").row(t, 1, "001", "r #1")},
+		},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), SingletEntries: []SingletEntry{sga.entry(t, 2, "a #2")}},
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), SingletEntries: []SingletEntry{sgc.entry(t, 3, "")}},
+	)
+
+	type scanned struct {
+		singlet      Singlet
+		latestHeight uint64
+		deleted      bool
+	}
+
+	scan := func(prefix []byte, limit int) (singlets []scanned) {
+		require.NoError(t, db.ScanSinglets(ctx, prefix, func(singlet Singlet, latestHeight uint64, deleted bool) error {
+			singlets = append(singlets, scanned{singlet, latestHeight, deleted})
+			if len(singlets) >= limit {
+				return store.BreakScan
+			}
+			return nil
+		}))
+
+		return
+	}
+
+	collection := []byte{0xFF, 0xF1}
+	assert.Equal(t, []scanned{{sga, 2, false}, {sgb, 1, false}, {sgc, 3, true}}, scan(collection, 10))
+	assert.Equal(t, []scanned{{sgb, 1, false}}, scan(append(collection, 's', 'g', 'b'), 10))
+	assert.Equal(t, []scanned{{sga, 2, false}, {sgb, 1, false}}, scan(collection, 2))
+
+	assert.Error(t, db.ScanSinglets(ctx, []byte{0xFF, 0xF2}, func(Singlet, uint64, bool) error { return nil }), "tablet collection")
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"sync"
+
+	"github.com/dfuse-io/bstream"
+)
+
+// BlockCommitted is emitted for each block of a `WriteBatch` once the whole batch was
+// successfully written to the store.
+type BlockCommitted struct {
+	Height   uint64
+	BlockRef bstream.BlockRef
+	Stats    BlockCommittedStats
+}
+
+// BlockCommittedStats are the amount of elements the committed block write request contained.
+type BlockCommittedStats struct {
+	SingletEntryCount int
+	TabletRowCount    int
+}
+
+// BlockCommittedSubscription receives the `BlockCommitted` events emitted after it was
+// created, in order, see `FluxDB.Subscribe`.
+type BlockCommittedSubscription struct {
+	bus    *eventBus
+	events chan BlockCommitted
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Events returns the channel on which the events are received, it's closed once the
+// subscription is closed.
+func (s *BlockCommittedSubscription) Events() <-chan BlockCommitted {
+	return s.events
+}
+
+// Close stops the subscription, unblocking the write path if it was waiting on it. Events
+// still buffered can be drained from `Events` until the channel is closed.
+func (s *BlockCommittedSubscription) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.bus.unsubscribe(s)
+	})
+}
+
+// Subscribe registers a new subscription to the `BlockCommitted` events, so embedding
+// applications (metrics exporters, cache invalidators, replication) are notified of each
+// committed block without wrapping `WriteBatch` themselves.
+//
+// Events are buffered up to `bufferSize`, once the buffer is full, the write path blocks
+// until the subscriber consumes events (or closes the subscription), so no event is ever
+// lost. Subscribers must then keep up with the writes, or close their subscription.
+func (fdb *FluxDB) Subscribe(bufferSize int) *BlockCommittedSubscription {
+	return fdb.events.subscribe(bufferSize)
+}
+
+type eventBus struct {
+	lock          sync.RWMutex
+	subscriptions []*BlockCommittedSubscription
+}
+
+func (b *eventBus) subscribe(bufferSize int) *BlockCommittedSubscription {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+
+	subscription := &BlockCommittedSubscription{
+		bus:    b,
+		events: make(chan BlockCommitted, bufferSize),
+		closed: make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.subscriptions = append(b.subscriptions, subscription)
+	return subscription
+}
+
+func (b *eventBus) unsubscribe(subscription *BlockCommittedSubscription) {
+	// Publishing holds the read lock, it's released once the closed subscription is skipped
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i, candidate := range b.subscriptions {
+		if candidate == subscription {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			break
+		}
+	}
+
+	close(subscription.events)
+}
+
+func (b *eventBus) hasSubscriptions() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return len(b.subscriptions) > 0
+}
+
+func (b *eventBus) publishBlocksCommitted(requests []*WriteRequest) {
+	if !b.hasSubscriptions() {
+		return
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, request := range requests {
+		event := BlockCommitted{
+			Height:   request.Height,
+			BlockRef: request.BlockRef,
+			Stats: BlockCommittedStats{
+				SingletEntryCount: len(request.SingletEntries),
+				TabletRowCount:    len(request.TabletRows),
+			},
+		}
+
+		for _, subscription := range b.subscriptions {
+			select {
+			case subscription.events <- event:
+			case <-subscription.closed:
+			}
+		}
+	}
+}
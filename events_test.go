@@ -0,0 +1,64 @@
+package fluxdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe_BlockCommitted(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	subscription := db.Subscribe(10)
+	blocked := db.Subscribe(0)
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeBatchOfRequests(t, db,
+			&WriteRequest{
+				Height:         1,
+				BlockRef:       bstream.NewBlockRef("00000001aa", 1),
+				SingletEntries: []SingletEntry{singlet.entry(t, 1, "s #1")},
+				TabletRows:     []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 1, "002", "r #1")},
+			},
+			&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2)},
+		)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("write should be blocked by the unbuffered subscription")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	blocked.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write should have been unblocked once the subscription was closed")
+	}
+
+	_, open := <-blocked.Events()
+	assert.False(t, open, "closed subscription events should be closed")
+
+	first := <-subscription.Events()
+	assert.Equal(t, uint64(1), first.Height)
+	assert.Equal(t, "00000001aa", first.BlockRef.ID())
+	assert.Equal(t, BlockCommittedStats{SingletEntryCount: 1, TabletRowCount: 2}, first.Stats)
+
+	second := <-subscription.Events()
+	assert.Equal(t, uint64(2), second.Height)
+
+	subscription.Close()
+	subscription.Close()
+
+	require.False(t, db.events.hasSubscriptions())
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/shutter"
+	"go.uber.org/zap"
+)
+
+// ReplicaReader is a serving replica read through a `FanOutReader`.
+type ReplicaReader struct {
+	Name   string
+	Reader Reader
+
+	// HeadBlock returns the head block of the replica, only required when lagging replicas
+	// exclusion is enabled, see `FanOutReader.EnableLagExclusion`
+	HeadBlock func(ctx context.Context) bstream.BlockRef
+}
+
+type fanOutReplica struct {
+	*ReplicaReader
+
+	// Accessed atomically, 1 when the replica head block lags too much to serve reads
+	lagging uint32
+}
+
+func (r *fanOutReplica) isLagging() bool {
+	return atomic.LoadUint32(&r.lagging) == 1
+}
+
+// FanOutReader is a `Reader` spreading the reads, round-robin, across multiple serving replicas.
+// A read failing on a replica is retried on the next one. Optionally, reads are hedged (see
+// `SetHedgeDelay`) and replicas whose head block lags are excluded (see `EnableLagExclusion`).
+// Remote replicas are read through the `client` package, see `client.DialFanOut`.
+type FanOutReader struct {
+	*shutter.Shutter
+
+	replicas   []*fanOutReplica
+	hedgeDelay time.Duration
+
+	// Accessed atomically, index of the replica serving the next read
+	next uint32
+}
+
+var _ Reader = (*FanOutReader)(nil)
+
+func NewFanOutReader(replicas []*ReplicaReader) *FanOutReader {
+	r := &FanOutReader{Shutter: shutter.New()}
+	for _, replica := range replicas {
+		r.replicas = append(r.replicas, &fanOutReplica{ReplicaReader: replica})
+	}
+
+	return r
+}
+
+// SetHedgeDelay enables hedged reads, when a replica did not answer a read after `delay`, the
+// same read is also sent to the next replica, and so on, the first answer being used and the
+// other reads being cancelled. This trades extra load for lower tail latencies.
+func (r *FanOutReader) SetHedgeDelay(delay time.Duration) {
+	r.hedgeDelay = delay
+}
+
+// EnableLagExclusion checks the head block of all replicas every `checkInterval`, excluding from
+// the reads the replicas whose head block is more than `maxHeadLag` blocks behind the most
+// advanced replica, until they catch up. When all replicas are excluded, all are used. The checks
+// stop when the reader is shut down.
+func (r *FanOutReader) EnableLagExclusion(maxHeadLag uint64, checkInterval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.OnTerminating(func(_ error) {
+		cancel()
+	})
+
+	r.checkLagging(ctx, maxHeadLag)
+
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.checkLagging(ctx, maxHeadLag)
+			}
+		}
+	}()
+}
+
+func (r *FanOutReader) checkLagging(ctx context.Context, maxHeadLag uint64) {
+	heads := make([]uint64, len(r.replicas))
+	known := make([]bool, len(r.replicas))
+
+	var highest uint64
+	for i, replica := range r.replicas {
+		head := replica.HeadBlock(ctx)
+		if head == nil || bstream.EqualsBlockRefs(head, bstream.BlockRefEmpty) {
+			continue
+		}
+
+		heads[i], known[i] = head.Num(), true
+		if heads[i] > highest {
+			highest = heads[i]
+		}
+	}
+
+	for i, replica := range r.replicas {
+		lagging := !known[i] || heads[i]+maxHeadLag < highest
+
+		var value uint32
+		if lagging {
+			value = 1
+		}
+
+		if previous := atomic.SwapUint32(&replica.lagging, value); previous != value {
+			zlog.Info("replica lagging state changed",
+				zap.String("replica", replica.Name),
+				zap.Bool("lagging", lagging),
+				zap.Uint64("head_block_num", heads[i]),
+				zap.Uint64("highest_head_block_num", highest),
+			)
+		}
+	}
+}
+
+func (r *FanOutReader) ReadTabletAt(ctx context.Context, height uint64, tablet Tablet, speculativeWrites []*WriteRequest) ([]TabletRow, error) {
+	out, err := r.read(ctx, func(ctx context.Context, reader Reader) (interface{}, error) {
+		return reader.ReadTabletAt(ctx, height, tablet, speculativeWrites)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.([]TabletRow), nil
+}
+
+func (r *FanOutReader) ReadTabletRowAt(ctx context.Context, height uint64, tablet Tablet, primaryKey TabletRowPrimaryKey, speculativeWrites []*WriteRequest) (TabletRow, error) {
+	out, err := r.read(ctx, func(ctx context.Context, reader Reader) (interface{}, error) {
+		return reader.ReadTabletRowAt(ctx, height, tablet, primaryKey, speculativeWrites)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	row, _ := out.(TabletRow)
+	return row, nil
+}
+
+func (r *FanOutReader) ReadSingletEntryAt(ctx context.Context, singlet Singlet, height uint64, speculativeWrites []*WriteRequest) (SingletEntry, error) {
+	out, err := r.read(ctx, func(ctx context.Context, reader Reader) (interface{}, error) {
+		return reader.ReadSingletEntryAt(ctx, singlet, height, speculativeWrites)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entry, _ := out.(SingletEntry)
+	return entry, nil
+}
+
+// candidates returns the replicas to use for a read, in order, the available ones starting
+// from the next one in round-robin order, all of them if none is available.
+func (r *FanOutReader) candidates() (out []*fanOutReplica) {
+	start := int(atomic.AddUint32(&r.next, 1)-1) % len(r.replicas)
+	for i := range r.replicas {
+		replica := r.replicas[(start+i)%len(r.replicas)]
+		if !replica.isLagging() {
+			out = append(out, replica)
+		}
+	}
+
+	if len(out) == 0 {
+		for i := range r.replicas {
+			out = append(out, r.replicas[(start+i)%len(r.replicas)])
+		}
+	}
+
+	return out
+}
+
+type fanOutResult struct {
+	replica *fanOutReplica
+	value   interface{}
+	err     error
+}
+
+func (r *FanOutReader) read(ctx context.Context, readFunc func(ctx context.Context, reader Reader) (interface{}, error)) (interface{}, error) {
+	if len(r.replicas) == 0 {
+		return nil, errors.New("no replica to read from")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	candidates := r.candidates()
+	results := make(chan *fanOutResult, len(candidates))
+
+	launched := 0
+	launch := func() {
+		replica := candidates[launched]
+		launched++
+
+		go func() {
+			value, err := readFunc(ctx, replica.Reader)
+			results <- &fanOutResult{replica: replica, value: value, err: err}
+		}()
+	}
+
+	var hedge <-chan time.Time
+	resetHedge := func() {
+		if r.hedgeDelay > 0 && launched < len(candidates) {
+			hedge = time.After(r.hedgeDelay)
+		} else {
+			hedge = nil
+		}
+	}
+
+	launch()
+	resetHedge()
+
+	var lastErr error
+	for pending := 1; pending > 0; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case <-hedge:
+			zlog.Debug("hedging read", zap.String("replica", candidates[launched].Name))
+			launch()
+			pending++
+			resetHedge()
+
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				return result.value, nil
+			}
+
+			zlog.Debug("read failed on replica", zap.String("replica", result.replica.Name), zap.Error(result.err))
+			lastErr = result.err
+
+			if launched < len(candidates) {
+				launch()
+				pending++
+				resetHedge()
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("read failed on all %d replicas tried: %w", launched, lastErr)
+}
@@ -0,0 +1,98 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testReplicaReader struct {
+	Reader
+
+	delay time.Duration
+	err   error
+	reads int32
+	entry SingletEntry
+}
+
+func (r *testReplicaReader) ReadSingletEntryAt(ctx context.Context, singlet Singlet, height uint64, speculativeWrites []*WriteRequest) (SingletEntry, error) {
+	atomic.AddInt32(&r.reads, 1)
+
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return r.entry, r.err
+}
+
+func TestFanOutReader_RoundRobinAndFailover(t *testing.T) {
+	singlet := newTestSinglet("sgl")
+	entry := singlet.entry(t, 1, "value")
+
+	healthy := &testReplicaReader{entry: entry}
+	failing := &testReplicaReader{err: errors.New("unavailable")}
+
+	reader := NewFanOutReader([]*ReplicaReader{{Name: "a", Reader: healthy}, {Name: "b", Reader: failing}})
+	for i := 0; i < 4; i++ {
+		actual, err := reader.ReadSingletEntryAt(context.Background(), singlet, 1, nil)
+		require.NoError(t, err)
+		assert.Equal(t, entry, actual)
+	}
+
+	assert.Equal(t, int32(4), healthy.reads)
+	assert.Equal(t, int32(2), failing.reads, "one read out of two starts on the failing replica")
+
+	_, err := NewFanOutReader([]*ReplicaReader{{Name: "b", Reader: failing}}).ReadSingletEntryAt(context.Background(), singlet, 1, nil)
+	assert.EqualError(t, err, "read failed on all 1 replicas tried: unavailable")
+}
+
+func TestFanOutReader_Hedging(t *testing.T) {
+	singlet := newTestSinglet("sgl")
+
+	slow := &testReplicaReader{delay: 5 * time.Second, entry: singlet.entry(t, 1, "slow")}
+	fast := &testReplicaReader{entry: singlet.entry(t, 1, "fast")}
+
+	reader := NewFanOutReader([]*ReplicaReader{{Name: "slow", Reader: slow}, {Name: "fast", Reader: fast}})
+	reader.SetHedgeDelay(10 * time.Millisecond)
+
+	start := time.Now()
+	actual, err := reader.ReadSingletEntryAt(context.Background(), singlet, 1, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, fast.entry, actual)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestFanOutReader_LagExclusion(t *testing.T) {
+	singlet := newTestSinglet("sgl")
+
+	upToDate := &testReplicaReader{entry: singlet.entry(t, 1, "value")}
+	lagging := &testReplicaReader{entry: singlet.entry(t, 1, "value")}
+
+	headOf := func(num uint64) func(ctx context.Context) bstream.BlockRef {
+		return func(ctx context.Context) bstream.BlockRef { return bstream.NewBlockRef("", num) }
+	}
+
+	reader := NewFanOutReader([]*ReplicaReader{
+		{Name: "up-to-date", Reader: upToDate, HeadBlock: headOf(100)},
+		{Name: "lagging", Reader: lagging, HeadBlock: headOf(80)},
+	})
+	reader.EnableLagExclusion(10, time.Hour)
+	defer reader.Shutdown(nil)
+
+	for i := 0; i < 4; i++ {
+		_, err := reader.ReadSingletEntryAt(context.Background(), singlet, 1, nil)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(4), upToDate.reads)
+	assert.Equal(t, int32(0), lagging.reads)
+}
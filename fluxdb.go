@@ -31,10 +31,49 @@ type FluxDB struct {
 	blockMapper BlockMapper
 	blockFilter func(blk *bstream.Block) error
 
-	idxCache              *indexCache
-	disableIndexing       bool
+	sourceOptions   SourceOptions
+	irreversibility IrreversibilityCondition
+	pipelineName    string
+
+	idxCache        *indexCache
+	disableIndexing bool
+	indexOnly       bool
+	asyncIndexer    *asyncIndexer
+	hotKeys         *hotKeysSampler
+	writeElider     *writeElider
+	rowSizeLimit    *rowSizeLimit
+	indexRepairs    *indexRepairs
+
+	tabletRowOrder   TabletRowOrder
+	readInterceptors []ReadInterceptor
+	auditLog         *auditLog
+	backup           *incrementalBackup
+
+	pipelinedFlushes bool
+	events           eventBus
+	warmUp           *cacheWarmUp
+	committedReads   *committedReads
+	blockIDIndex     bool
+	blockTimeIndex   bool
+	writerLease      *storeLease
+	retentionPolicy  *RetentionPolicy
+	indexFetch       IndexFetchOptions
+	readLimiter      *readLimiter
+	readCoalescer    *readCoalescer
+	missingKeys      *missingKeysCache
+	tabletExistence  *tabletExistenceCache
+	collectionStats  *collectionStatsTracker
+	readOnly         bool
+
+	deferIndexing         bool
+	deferIndexingInterval int
+	deferredBlockCount    int
 	ignoreIndexRangeStart uint64
 	ignoreIndexRangeStop  uint64
+	primaryKeyBloomRate   float64
+
+	// The handler of the pipeline, see `NewHandler`
+	pipelineHandler *FluxDBHandler
 
 	SpeculativeWritesFetcher func(ctx context.Context, headBlockID string, upToHeight uint64) (speculativeWrites []*WriteRequest)
 	HeadBlock                func(ctx context.Context) bstream.BlockRef
@@ -43,6 +82,13 @@ type FluxDB struct {
 	shardCount int
 	stopBlock  uint64
 
+	// Assigns the singlets and tablets to shards when sharding, see `SetShardFunction`
+	shardFunctionName string
+	shardFunction     ShardFunction
+
+	// The shard count of the sharded injection writing the store, see `DiscoverShards`
+	discoveredShardCount int
+
 	ready bool
 }
 
@@ -53,7 +99,16 @@ func New(kvStore store.KVStore, blockFilter func(blk *bstream.Block) error, bloc
 		blockFilter:     blockFilter,
 		blockMapper:     blockMapper,
 		idxCache:        newIndexCache(),
+		indexRepairs:    newIndexRepairs(),
 		disableIndexing: disableIndexing,
+
+		shardFunctionName: DefaultShardFunction,
+		shardFunction:     shardOfKey,
+
+		sourceOptions: SourceOptions{
+			FileSourceParallelDownloads: defaultFileSourceParallelDownloads,
+			LiveSourceBufferSize:        defaultLiveSourceBufferSize,
+		},
 	}
 }
 
@@ -66,6 +121,8 @@ func (fdb *FluxDB) Launch(disablePipeline bool) {
 		}
 	})
 
+	fdb.launchCacheWarmUp()
+
 	if disablePipeline {
 		zlog.Info("not using a pipeline, waiting forever (serve mode)")
 		fdb.SpeculativeWritesFetcher = func(ctx context.Context, headBlockID string, upToHeight uint64) (speculativeWrites []*WriteRequest) {
@@ -105,6 +162,20 @@ func (fdb *FluxDB) SetSharding(shardIndex, shardCount int) {
 	fdb.shardCount = shardCount
 }
 
+// SetShardFunction selects, by name, the function the shards being injected were produced with,
+// see `Sharder#SetShardFunction`, the default one being used when `name` is empty. It's validated
+// against the sharding config of the shards.
+func (fdb *FluxDB) SetShardFunction(name string) error {
+	name, function, err := lookupShardFunction(name)
+	if err != nil {
+		return err
+	}
+
+	fdb.shardFunctionName = name
+	fdb.shardFunction = function
+	return nil
+}
+
 func (fdb *FluxDB) SetStopBlock(stopBlock uint64) {
 	fdb.stopBlock = stopBlock
 }
@@ -114,6 +185,66 @@ func (fdb *FluxDB) SetIgnoreIndexRange(startBlock, stopBlock uint64) {
 	fdb.ignoreIndexRangeStop = stopBlock
 }
 
+// SetIndexOnly configures the write path to assume rows already exist in the store. When
+// enabled, singlet entries and tablet rows are not written anymore, only index snapshots
+// and last written checkpoints are (re)built. Useful for recovery runs after changing index
+// frequency or fixing index bugs.
+func (fdb *FluxDB) SetIndexOnly(indexOnly bool) {
+	fdb.indexOnly = indexOnly
+}
+
+// SetTabletRowOrder configures the order, by primary key, of the rows returned by the tablet
+// reads, ascending by default.
+func (fdb *FluxDB) SetTabletRowOrder(order TabletRowOrder) {
+	fdb.tabletRowOrder = order
+}
+
+// EnableAsyncIndexing moves tablet index generation off the write path into a background
+// indexer, fed by a queue of at most `queueSize` indexing schedules. While the background
+// index of a tablet is not written yet, reads fall back to scanning from its previous index.
+func (fdb *FluxDB) EnableAsyncIndexing(queueSize int) {
+	fdb.asyncIndexer = newAsyncIndexer(fdb, queueSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fdb.OnTerminating(func(_ error) {
+		cancel()
+	})
+
+	go fdb.asyncIndexer.run(ctx)
+}
+
+// SetDeferIndexing enables bulk-load mode where tablet indexes are not built inline
+// anymore while writing. Instead, tablets needing an index are accumulated and indexed
+// once at their latest written height, either every `interval` written blocks (when
+// `interval` is not 0) or once the process is ready (close to real-time), at which point
+// inline indexing resumes.
+//
+// When using this mode outside of a live pipeline, `IndexTables` must be called at the
+// end of the bulk-load to build the remaining deferred indexes.
+func (fdb *FluxDB) SetDeferIndexing(interval int) {
+	fdb.deferIndexing = true
+	fdb.deferIndexingInterval = interval
+}
+
+// EnablePipelinedFlushes overlaps the writes of a batch to the storage engine with the
+// processing of the next blocks, full batches are handed over to a background flush while the
+// next ones are being filled. At most one background flush is in flight at any time and the
+// last written checkpoint is still always flushed after the rows it covers.
+func (fdb *FluxDB) EnablePipelinedFlushes() {
+	fdb.pipelinedFlushes = true
+}
+
+// FlushReport describes a batch of writes flushed to the storage engine, see `OnFlush`.
+type FlushReport = store.FlushReport
+
+// OnFlush registers a listener called after each batch of writes successfully flushed to the
+// storage engine, with the amount of mutations, their size and duration, broken down per storage
+// table. Listeners are called synchronously on the write path and must return quickly. Returns
+// false, the listener being never called, when the storage engine does not report its flushes.
+func (fdb *FluxDB) OnFlush(listener func(report FlushReport)) bool {
+	return store.NotifyFlushes(fdb.store, listener)
+}
+
 func (fdb *FluxDB) IsSharding() bool {
 	return fdb.shardCount != 0
 }
@@ -122,12 +253,15 @@ func (fdb *FluxDB) Close() error {
 	return fdb.store.Close()
 }
 
+// IsReady returns whether the process crossed the "close to real-time" threshold and its
+// cache warm-up, if any, completed.
 func (fdb *FluxDB) IsReady() bool {
-	return fdb.ready
+	return fdb.ready && fdb.warmUp.isCompleted()
 }
 
 // SetReady marks the process as ready, meaning it has crossed the
 // "close to real-time" threshold.
 func (fdb *FluxDB) SetReady() {
 	fdb.ready = true
+	fdb.recordReady()
 }
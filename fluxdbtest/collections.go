@@ -0,0 +1,131 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdbtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb"
+	"github.com/stretchr/testify/require"
+)
+
+// The identifiers of the test collections, registered when this package is imported, they
+// must not be used by the collections of the code under test.
+const (
+	TabletCollection  uint16 = 0xEEE0
+	SingletCollection uint16 = 0xEEE1
+
+	TabletCollectionName  = "tst"
+	SingletCollectionName = "sts"
+)
+
+func init() {
+	fluxdb.RegisterTabletFactory(TabletCollection, TabletCollectionName, func(identifier []byte) (fluxdb.Tablet, error) {
+		if len(identifier) < 3 {
+			return nil, fmt.Errorf("test tablet identifier must be at least 3 bytes, got %d", len(identifier))
+		}
+
+		return Tablet(identifier[0:3]), nil
+	})
+
+	fluxdb.RegisterSingletFactory(SingletCollection, SingletCollectionName, func(identifier []byte) (fluxdb.Singlet, error) {
+		if len(identifier) < 3 {
+			return nil, fmt.Errorf("test singlet identifier must be at least 3 bytes, got %d", len(identifier))
+		}
+
+		return Singlet(identifier[0:3]), nil
+	})
+}
+
+// Tablet is a test tablet, identified by a 3 characters name, whose rows have a 3 bytes
+// primary key and a raw value.
+type Tablet string
+
+func NewTablet(name string) Tablet {
+	if len(name) != 3 {
+		panic("test tablet name must always be 3 characters long")
+	}
+
+	return Tablet(name)
+}
+
+func (t Tablet) Collection() uint16 { return TabletCollection }
+
+func (t Tablet) Identifier() []byte { return []byte(t) }
+
+func (t Tablet) Row(height uint64, primaryKey []byte, value []byte) (fluxdb.TabletRow, error) {
+	if len(primaryKey) != 3 {
+		return nil, fmt.Errorf("test tablet row primary key must always contain 3 bytes")
+	}
+
+	return TabletRow{fluxdb.NewBaseTabletRow(t, height, primaryKey, value)}, nil
+}
+
+// MustRow returns the row of the tablet, failing the test if the primary key is not 3 bytes, an
+// empty value is a deletion.
+func (t Tablet) MustRow(tt *testing.T, height uint64, primaryKey string, value string) fluxdb.TabletRow {
+	row, err := t.Row(height, []byte(primaryKey), []byte(value))
+	require.NoError(tt, err)
+
+	return row
+}
+
+func (t Tablet) String() string {
+	return TabletCollectionName + ":" + string(t)
+}
+
+type TabletRow struct {
+	fluxdb.BaseTabletRow
+}
+
+func (r TabletRow) String() string {
+	return r.Stringify(string(r.PrimaryKey()))
+}
+
+// Singlet is a test singlet, identified by a 3 characters name, whose entries have a raw value.
+type Singlet string
+
+func NewSinglet(name string) Singlet {
+	if len(name) != 3 {
+		panic("test singlet name must always be 3 characters long")
+	}
+
+	return Singlet(name)
+}
+
+func (s Singlet) Collection() uint16 { return SingletCollection }
+
+func (s Singlet) Identifier() []byte { return []byte(s) }
+
+func (s Singlet) Entry(height uint64, value []byte) (fluxdb.SingletEntry, error) {
+	return SingletEntry{fluxdb.NewBaseSingletEntry(s, height, value)}, nil
+}
+
+// MustEntry returns the entry of the singlet, an empty value is a deletion.
+func (s Singlet) MustEntry(tt *testing.T, height uint64, value string) fluxdb.SingletEntry {
+	entry, err := s.Entry(height, []byte(value))
+	require.NoError(tt, err)
+
+	return entry
+}
+
+func (s Singlet) String() string {
+	return SingletCollectionName + ":" + string(s)
+}
+
+type SingletEntry struct {
+	fluxdb.BaseSingletEntry
+}
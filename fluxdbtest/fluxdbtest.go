@@ -0,0 +1,64 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fluxdbtest provides the scaffolding to test code embedding FluxDB against an
+// isolated, on-disk temporary, instance, along with simple test collections, see `Tablet` and
+// `Singlet`.
+package fluxdbtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/dfuse-io/fluxdb/store/storetest"
+	"github.com/stretchr/testify/require"
+)
+
+// NewTestDB returns a FluxDB instance backed by a fresh badger store in a temporary directory,
+// the returned function closes it and deletes the directory.
+func NewTestDB(t *testing.T) (*fluxdb.FluxDB, func()) {
+	kvStore, closer := storetest.NewKVStore(t)
+
+	return fluxdb.New(kvStore, nil, nil, false), closer
+}
+
+// WriteBatchOfRequests writes the requests in a single batch, failing the test on error. The
+// requests without a block reference get the empty one.
+func WriteBatchOfRequests(t *testing.T, db *fluxdb.FluxDB, requests ...*fluxdb.WriteRequest) {
+	for _, request := range requests {
+		if request.BlockRef == nil {
+			request.BlockRef = bstream.BlockRefEmpty
+		}
+	}
+
+	require.NoError(t, db.WriteBatch(context.Background(), requests))
+}
+
+// SingletEntries returns a write request of the singlet entries at `height`.
+func SingletEntries(height uint64, entries ...fluxdb.SingletEntry) *fluxdb.WriteRequest {
+	return &fluxdb.WriteRequest{
+		Height:         height,
+		SingletEntries: entries,
+	}
+}
+
+// TabletRows returns a write request of the tablet rows at `height`.
+func TabletRows(height uint64, rows ...fluxdb.TabletRow) *fluxdb.WriteRequest {
+	return &fluxdb.WriteRequest{
+		Height:     height,
+		TabletRows: rows,
+	}
+}
@@ -0,0 +1,39 @@
+package fluxdbtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTestDB(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := NewTablet("tbl")
+	singlet := NewSinglet("sgl")
+
+	WriteBatchOfRequests(t, db,
+		TabletRows(1, tablet.MustRow(t, 1, "001", "a"), tablet.MustRow(t, 1, "002", "b")),
+		SingletEntries(2, singlet.MustEntry(t, 2, "c")),
+		TabletRows(3, tablet.MustRow(t, 3, "001", "")),
+	)
+
+	rows, err := db.ReadTabletAt(ctx, 3, tablet, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, []byte("002"), rows[0].PrimaryKey())
+	assert.Equal(t, []byte("b"), rows[0].(TabletRow).Value())
+
+	rows, err = db.ReadTabletAt(ctx, 1, tablet, nil)
+	require.NoError(t, err)
+	assert.Len(t, rows, 2)
+
+	entry, err := db.ReadSingletEntryAt(ctx, singlet, 3, nil)
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, []byte("c"), entry.(SingletEntry).Value())
+}
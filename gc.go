@@ -0,0 +1,188 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// orphanChunksCollector is implemented by the stores chunking the values exceeding the maximum
+// value size of their backend, see `kv.KVStore.CollectOrphanChunks`.
+type orphanChunksCollector interface {
+	CollectOrphanChunks(ctx context.Context, dryRun bool) (count int, byteSize int, err error)
+}
+
+// GarbageReport is the outcome of `CollectGarbage`.
+type GarbageReport struct {
+	CheckpointHeight uint64
+
+	// TornKeyCount is the amount of singlet entries, tablet rows and index snapshots written
+	// above the last written checkpoint (see `CheckConsistency`), e.g. by a rolled back run
+	TornKeyCount int
+
+	// OrphanIndexCount is the amount of index snapshots of tablets without any row
+	OrphanIndexCount int
+
+	// OrphanChunkCount is the amount of chunks of values overwritten or deleted, only collected
+	// when the store chunks its values, the chunks of the garbage rows being included unless
+	// in dry run
+	OrphanChunkCount int
+
+	// ReclaimedBytes is the total size of the keys and values of the garbage, a chunked garbage
+	// row being accounted for both with its whole value and with its chunks
+	ReclaimedBytes int
+
+	DryRun bool
+}
+
+type garbageIndexCandidate struct {
+	key       []byte
+	tabletKey TabletKey
+}
+
+// CollectGarbage deletes the keys that can never be read, i.e. the keys written above the last
+// written checkpoint, the index snapshots of the tablets without any row and, when the store
+// chunks its values, the chunks no longer referenced by their value. When `dryRun` is true, the
+// garbage is only reported.
+//
+// **Important** This scans the whole store, it must not run while writing, the keys being
+// flushed before the checkpoint covering them.
+func (fdb *FluxDB) CollectGarbage(ctx context.Context, dryRun bool) (*GarbageReport, error) {
+	if fdb.IsSharding() {
+		return nil, errors.New("garbage collection is not supported when sharding")
+	}
+
+	checkpointHeight, _, err := fdb.FetchLastWrittenCheckpoint(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch last written checkpoint: %w", err)
+	}
+
+	report := &GarbageReport{CheckpointHeight: checkpointHeight, DryRun: dryRun}
+
+	var garbage [][]byte
+	var indexCandidates []*garbageIndexCandidate
+	tabletsWithRows := map[string]bool{}
+
+	// Only the keys are scanned, the values are fetched for the garbage keys alone, see
+	// `garbageByteSize`
+	err = fdb.store.ScanTableKeys(ctx, store.RowsTable, nil, nil, func(key []byte) error {
+		shardKey, height, isIndex, err := selfCheckKey(key)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case height > checkpointHeight:
+			report.TornKeyCount++
+			garbage = append(garbage, append([]byte(nil), key...))
+
+		case isIndex:
+			indexCandidates = append(indexCandidates, &garbageIndexCandidate{
+				key:       append([]byte(nil), key...),
+				tabletKey: TabletKey(shardKey),
+			})
+
+		default:
+			if _, isSinglet := singletFactories[collectionFromKey(key)]; !isSinglet {
+				tabletsWithRows[string(shardKey)] = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan rows: %w", err)
+	}
+
+	for _, candidate := range indexCandidates {
+		if !tabletsWithRows[string(candidate.tabletKey)] {
+			report.OrphanIndexCount++
+			garbage = append(garbage, candidate.key)
+		}
+	}
+
+	if report.ReclaimedBytes, err = fdb.garbageByteSize(ctx, garbage); err != nil {
+		return nil, err
+	}
+
+	if !dryRun && len(garbage) > 0 {
+		var deleteErr error
+		for start := 0; start < len(garbage) && deleteErr == nil; start += selfCheckRepairBatchSize {
+			end := start + selfCheckRepairBatchSize
+			if end > len(garbage) {
+				end = len(garbage)
+			}
+
+			deleteErr = fdb.store.DeleteTableKeys(ctx, store.RowsTable, garbage[start:end])
+		}
+
+		fdb.recordAuditEvent(ctx, "collect_garbage", map[string]interface{}{
+			"checkpoint_height":  checkpointHeight,
+			"torn_key_count":     report.TornKeyCount,
+			"orphan_index_count": report.OrphanIndexCount,
+		}, &deleteErr)
+		if deleteErr != nil {
+			return report, fmt.Errorf("delete garbage rows: %w", deleteErr)
+		}
+	}
+
+	// Collected last, the chunks of the values just deleted being orphans too
+	if collector, ok := fdb.store.(orphanChunksCollector); ok {
+		count, byteSize, err := collector.CollectOrphanChunks(ctx, dryRun)
+		if err != nil {
+			return report, fmt.Errorf("collect orphan chunks: %w", err)
+		}
+
+		report.OrphanChunkCount = count
+		report.ReclaimedBytes += byteSize
+	}
+
+	zlog.Info("garbage collected",
+		zap.Uint64("checkpoint_height", report.CheckpointHeight),
+		zap.Int("torn_key_count", report.TornKeyCount),
+		zap.Int("orphan_index_count", report.OrphanIndexCount),
+		zap.Int("orphan_chunk_count", report.OrphanChunkCount),
+		zap.Int("reclaimed_bytes", report.ReclaimedBytes),
+		zap.Bool("dry_run", dryRun),
+	)
+
+	return report, nil
+}
+
+// garbageByteSize returns the total size of the garbage keys and of their values, fetched by
+// pages, the table prefix being part of the size of the keys.
+func (fdb *FluxDB) garbageByteSize(ctx context.Context, garbage [][]byte) (byteSize int, err error) {
+	for start := 0; start < len(garbage); start += selfCheckRepairBatchSize {
+		end := start + selfCheckRepairBatchSize
+		if end > len(garbage) {
+			end = len(garbage)
+		}
+
+		err := fdb.store.FetchTabletRows(ctx, garbage[start:end], func(key []byte, value []byte) error {
+			byteSize += 1 + len(key) + len(value)
+			return nil
+		})
+		if err != nil {
+			return byteSize, fmt.Errorf("fetch garbage rows: %w", err)
+		}
+	}
+
+	return byteSize, nil
+}
@@ -0,0 +1,77 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+	index := NewTabletIndex()
+	index.AtHeight = 10
+	index.PrimaryKeyToHeight.put([]byte("001"), 10)
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:         10,
+			BlockRef:       bstream.NewBlockRef("0000000aaa", 10),
+			TabletRows:     []TabletRow{tablet.row(t, 10, "001", "a")},
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), index)},
+		},
+	)
+
+	report, err := db.CollectGarbage(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, &GarbageReport{CheckpointHeight: 10, DryRun: true}, report)
+
+	// An index snapshot of a tablet without rows and keys written above the checkpoint
+	orphanIndex := NewTabletIndex()
+	orphanIndex.AtHeight = 9
+	tornIndex := NewTabletIndex()
+	tornIndex.AtHeight = 11
+
+	garbageKeys := [][]byte{
+		KeyForSingletEntry(newIndexSingletEntry(newIndexSinglet(newTestTablet("emp")), orphanIndex)),
+		KeyForTabletRow(tablet.row(t, 11, "002", "b")),
+		KeyForSingletEntry(newIndexSingletEntry(newIndexSinglet(tablet), tornIndex)),
+	}
+
+	batch := db.store.NewBatch(zlog)
+	for _, key := range garbageKeys {
+		batch.SetRow(key, []byte{0x00})
+	}
+	require.NoError(t, batch.Flush(ctx))
+
+	// The table prefix and the value of each key
+	garbageByteSize := 0
+	for _, key := range garbageKeys {
+		garbageByteSize += 1 + len(key) + 1
+	}
+
+	report, err = db.CollectGarbage(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.TornKeyCount)
+	assert.Equal(t, 1, report.OrphanIndexCount)
+	assert.Equal(t, garbageByteSize, report.ReclaimedBytes)
+
+	report, err = db.CollectGarbage(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.TornKeyCount)
+	assert.Equal(t, 1, report.OrphanIndexCount)
+
+	report, err = db.CollectGarbage(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, &GarbageReport{CheckpointHeight: 10, DryRun: true}, report)
+
+	rows, err := db.ReadTabletAt(ctx, 10, tablet, nil)
+	require.NoError(t, err)
+	assert.Len(t, rows, 1)
+}
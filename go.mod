@@ -26,6 +26,7 @@ require (
 	go.opencensus.io v0.22.3
 	go.uber.org/multierr v1.5.0
 	go.uber.org/zap v1.15.0
+	google.golang.org/grpc v1.26.0
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
 
@@ -0,0 +1,279 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+)
+
+// The amount of buckets the sliding window is divided into, the window slides one bucket at a time
+const hotKeysBucketCount = 6
+
+// The amount of leading bytes of a row key used to group rows together, it spans the collection,
+// and for most collections, the beginning of the tablet/singlet identifier which is what
+// determines the storage engine's key range a row ends up in
+const hotKeysRowPrefixBytes = 10
+
+type hotKeysOperation int
+
+const (
+	hotKeysRead hotKeysOperation = iota
+	hotKeysWrite
+)
+
+func (o hotKeysOperation) String() string {
+	if o == hotKeysWrite {
+		return "write"
+	}
+
+	return "read"
+}
+
+// HotKey is a tablet or a row prefix along with its estimated amount of operations
+// within the sliding window.
+type HotKey struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// HotKeysReport contains the top hottest tablets and row prefixes, for reads and writes,
+// observed over the sliding window. Counts are estimated from the sampled operations.
+type HotKeysReport struct {
+	WindowSeconds float64 `json:"window_seconds"`
+	SampleRate    int     `json:"sample_rate"`
+
+	ReadTablets      []*HotKey `json:"read_tablets"`
+	ReadRowPrefixes  []*HotKey `json:"read_row_prefixes"`
+	WriteTablets     []*HotKey `json:"write_tablets"`
+	WriteRowPrefixes []*HotKey `json:"write_row_prefixes"`
+}
+
+// EnableHotKeysSampling samples one out of `sampleRate` read and write keys and keeps track of
+// the `topN` hottest tablets and row prefixes over a sliding window of `window` duration. Useful
+// to diagnose storage engine hotspotting caused by skewed tablet keys.
+func (fdb *FluxDB) EnableHotKeysSampling(sampleRate int, window time.Duration, topN int) {
+	fdb.hotKeys = newHotKeysSampler(sampleRate, window, topN)
+}
+
+// HotKeys returns the hottest tablets and row prefixes over the sliding window, returns `nil`
+// when hot keys sampling is not enabled.
+func (fdb *FluxDB) HotKeys() *HotKeysReport {
+	return fdb.hotKeys.report()
+}
+
+type hotKeysSampler struct {
+	// Accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	opCount uint64
+
+	sampleRate     uint64
+	topN           int
+	bucketDuration time.Duration
+
+	lock         sync.Mutex
+	buckets      []*hotKeysBucket
+	current      int
+	currentStart time.Time
+	now          func() time.Time
+}
+
+type hotKeysBucket struct {
+	tablets     [2]map[string]int
+	rowPrefixes [2]map[string]int
+}
+
+func newHotKeysBucket() *hotKeysBucket {
+	return &hotKeysBucket{
+		tablets:     [2]map[string]int{{}, {}},
+		rowPrefixes: [2]map[string]int{{}, {}},
+	}
+}
+
+func newHotKeysSampler(sampleRate int, window time.Duration, topN int) *hotKeysSampler {
+	if sampleRate <= 0 {
+		sampleRate = 1
+	}
+
+	if window < hotKeysBucketCount {
+		window = hotKeysBucketCount
+	}
+
+	s := &hotKeysSampler{
+		sampleRate:     uint64(sampleRate),
+		topN:           topN,
+		bucketDuration: window / hotKeysBucketCount,
+		buckets:        make([]*hotKeysBucket, hotKeysBucketCount),
+		now:            time.Now,
+	}
+
+	for i := range s.buckets {
+		s.buckets[i] = newHotKeysBucket()
+	}
+	s.currentStart = s.now()
+
+	return s
+}
+
+// sample records the operation on the row key (and its tablet, if any), only one out of
+// `sampleRate` operations is actually recorded. Safe to call on a `nil` sampler, in which
+// case nothing is recorded.
+func (s *hotKeysSampler) sample(operation hotKeysOperation, tablet Tablet, rowKey []byte) {
+	if s == nil || atomic.AddUint64(&s.opCount, 1)%s.sampleRate != 0 {
+		return
+	}
+
+	prefix := rowKey
+	if len(prefix) > hotKeysRowPrefixBytes {
+		prefix = prefix[:hotKeysRowPrefixBytes]
+	}
+
+	var tabletKey TabletKey
+	if tablet != nil {
+		tabletKey = KeyForTablet(tablet)
+	}
+
+	if len(rowKey) >= collectionBytes {
+		metrics.HotKeysSampledCount.Inc(operation.String(), collectionName(collectionFromKey(rowKey)))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.advance()
+
+	bucket := s.buckets[s.current]
+	bucket.rowPrefixes[operation][string(prefix)]++
+	if tabletKey != nil {
+		bucket.tablets[operation][string(tabletKey)]++
+	}
+}
+
+// advance rotates the buckets that are now out of the sliding window, must be called
+// with the lock held.
+func (s *hotKeysSampler) advance() {
+	elapsed := int(s.now().Sub(s.currentStart) / s.bucketDuration)
+	if elapsed <= 0 {
+		return
+	}
+
+	s.currentStart = s.currentStart.Add(time.Duration(elapsed) * s.bucketDuration)
+	if elapsed > len(s.buckets) {
+		elapsed = len(s.buckets)
+	}
+
+	for i := 0; i < elapsed; i++ {
+		s.current = (s.current + 1) % len(s.buckets)
+		s.buckets[s.current] = newHotKeysBucket()
+	}
+
+	for _, operation := range []hotKeysOperation{hotKeysRead, hotKeysWrite} {
+		hottest, total := s.hottest(operation)
+		if total == 0 {
+			metrics.HottestTabletShare.SetFloat64(0, operation.String())
+			continue
+		}
+
+		metrics.HottestTabletShare.SetFloat64(float64(hottest)/float64(total), operation.String())
+	}
+}
+
+// hottest returns the sampled count of the hottest tablet of the window for this operation
+// as well as the total sampled count of all tablets, must be called with the lock held.
+func (s *hotKeysSampler) hottest(operation hotKeysOperation) (hottest int, total int) {
+	for _, count := range s.aggregate(func(b *hotKeysBucket) map[string]int { return b.tablets[operation] }) {
+		total += count
+		if count > hottest {
+			hottest = count
+		}
+	}
+
+	return
+}
+
+func (s *hotKeysSampler) aggregate(counts func(b *hotKeysBucket) map[string]int) map[string]int {
+	out := map[string]int{}
+	for _, bucket := range s.buckets {
+		for key, count := range counts(bucket) {
+			out[key] += count
+		}
+	}
+
+	return out
+}
+
+func (s *hotKeysSampler) report() *HotKeysReport {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.advance()
+
+	tablets := func(operation hotKeysOperation) []*HotKey {
+		return s.top(s.aggregate(func(b *hotKeysBucket) map[string]int { return b.tablets[operation] }), func(key string) string {
+			return TabletKey(key).String()
+		})
+	}
+
+	rowPrefixes := func(operation hotKeysOperation) []*HotKey {
+		return s.top(s.aggregate(func(b *hotKeysBucket) map[string]int { return b.rowPrefixes[operation] }), func(key string) string {
+			return fmt.Sprintf("%x", key)
+		})
+	}
+
+	return &HotKeysReport{
+		WindowSeconds:    (s.bucketDuration * time.Duration(len(s.buckets))).Seconds(),
+		SampleRate:       int(s.sampleRate),
+		ReadTablets:      tablets(hotKeysRead),
+		ReadRowPrefixes:  rowPrefixes(hotKeysRead),
+		WriteTablets:     tablets(hotKeysWrite),
+		WriteRowPrefixes: rowPrefixes(hotKeysWrite),
+	}
+}
+
+func (s *hotKeysSampler) top(counts map[string]int, stringify func(key string) string) (out []*HotKey) {
+	for key, count := range counts {
+		out = append(out, &HotKey{Key: stringify(key), Count: count * int(s.sampleRate)})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count == out[j].Count {
+			return out[i].Key < out[j].Key
+		}
+
+		return out[i].Count > out[j].Count
+	})
+
+	if s.topN > 0 && len(out) > s.topN {
+		out = out[:s.topN]
+	}
+
+	return out
+}
+
+func collectionName(collection uint16) string {
+	if known, found := collections[collection]; found {
+		return known.Name
+	}
+
+	return fmt.Sprintf("0x%04X", collection)
+}
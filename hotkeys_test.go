@@ -0,0 +1,54 @@
+package fluxdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHotKeysSampler(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	sampler := newHotKeysSampler(2, 6*time.Minute, 1)
+	sampler.now = func() time.Time { return now }
+	sampler.currentStart = now
+
+	hot := newTestTablet("hot")
+	cold := newTestTablet("cld")
+
+	for i := 0; i < 8; i++ {
+		sampler.sample(hotKeysWrite, hot, KeyForTabletRowFromParts(hot, uint64(i), []byte("001")))
+	}
+	for i := 0; i < 2; i++ {
+		sampler.sample(hotKeysWrite, cold, KeyForTabletRowFromParts(cold, uint64(i), []byte("001")))
+	}
+	sampler.sample(hotKeysRead, cold, KeyForTabletAt(cold, 0))
+	sampler.sample(hotKeysRead, cold, KeyForTabletAt(cold, 0))
+
+	report := sampler.report()
+	require.NotNil(t, report)
+	assert.Equal(t, (6 * time.Minute).Seconds(), report.WindowSeconds)
+	assert.Equal(t, []*HotKey{{Key: "tst:hot", Count: 8}}, report.WriteTablets)
+	assert.Equal(t, []*HotKey{{Key: "tst:cld", Count: 2}}, report.ReadTablets)
+	require.Len(t, report.WriteRowPrefixes, 1)
+	assert.Equal(t, 8, report.WriteRowPrefixes[0].Count)
+
+	now = now.Add(5 * time.Minute)
+	sampler.sample(hotKeysWrite, cold, KeyForTabletRowFromParts(cold, 10, []byte("001")))
+	sampler.sample(hotKeysWrite, cold, KeyForTabletRowFromParts(cold, 11, []byte("001")))
+	assert.Equal(t, []*HotKey{{Key: "tst:hot", Count: 8}}, sampler.report().WriteTablets)
+
+	now = now.Add(1 * time.Minute)
+	assert.Equal(t, []*HotKey{{Key: "tst:cld", Count: 2}}, sampler.report().WriteTablets, "first bucket should have slid out of the window")
+
+	now = now.Add(1 * time.Hour)
+	assert.Empty(t, sampler.report().WriteTablets)
+}
+
+func TestHotKeysSampler_Disabled(t *testing.T) {
+	var sampler *hotKeysSampler
+	sampler.sample(hotKeysRead, newTestTablet("abc"), []byte("key"))
+
+	assert.Nil(t, sampler.report())
+}
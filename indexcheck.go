@@ -0,0 +1,148 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sync"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	"go.uber.org/zap"
+)
+
+// Index snapshots are prefixed by the crc32 checksum of the rest of the value, encoded as field
+// 1000 (fixed32) of the `TabletIndex` message, a field unknown to the message definition, so the
+// value stays a valid `TabletIndex` message for readers unaware of the checksum. Marshalled
+// messages never start with this field, index snapshots written before checksums were introduced
+// are thus recognized and loaded without verification.
+var indexChecksumTag = []byte{0xC5, 0x3E}
+
+const indexChecksumFieldSize = 2 + 4
+
+func withIndexChecksum(value []byte) []byte {
+	out := make([]byte, indexChecksumFieldSize+len(value))
+	copy(out, indexChecksumTag)
+	binary.LittleEndian.PutUint32(out[2:], crc32.ChecksumIEEE(value))
+	copy(out[indexChecksumFieldSize:], value)
+
+	return out
+}
+
+// verifyIndexChecksum returns an error if the index snapshot value has a checksum that does not
+// match its content, values without a checksum are never considered corrupted.
+func verifyIndexChecksum(value []byte) error {
+	if len(value) < indexChecksumFieldSize || !bytes.HasPrefix(value, indexChecksumTag) {
+		return nil
+	}
+
+	expected := binary.LittleEndian.Uint32(value[2:])
+	if actual := crc32.ChecksumIEEE(value[indexChecksumFieldSize:]); actual != expected {
+		return fmt.Errorf("checksum mismatch, expected %08x, got %08x", expected, actual)
+	}
+
+	return nil
+}
+
+// corruptedIndexError is returned when loading an index snapshot that is corrupted.
+type corruptedIndexError struct {
+	height uint64
+	err    error
+}
+
+func (e *corruptedIndexError) Error() string {
+	return fmt.Sprintf("corrupted index at height %d: %s", e.height, e.err)
+}
+
+func (e *corruptedIndexError) Unwrap() error {
+	return e.err
+}
+
+// indexRepairs tracks the tablets whose corrupted index snapshot is being rebuilt, so a tablet
+// read often triggers a single rebuild.
+type indexRepairs struct {
+	lock     sync.Mutex
+	inflight map[string]bool
+}
+
+func newIndexRepairs() *indexRepairs {
+	return &indexRepairs{inflight: map[string]bool{}}
+}
+
+func (r *indexRepairs) start(key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.inflight[key] {
+		return false
+	}
+
+	r.inflight[key] = true
+	return true
+}
+
+func (r *indexRepairs) done(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.inflight, key)
+}
+
+// scheduleIndexRepair rebuilds, in background, the corrupted index snapshot of the tablet at
+// `height` from the tablet rows, overwriting it.
+func (fdb *FluxDB) scheduleIndexRepair(tablet Tablet, height uint64) {
+	metrics.CorruptedIndexCount.Inc(collectionName(tablet.Collection()))
+
+	key := string(KeyForTablet(tablet))
+	if !fdb.indexRepairs.start(key) {
+		return
+	}
+
+	go func() {
+		defer fdb.indexRepairs.done(key)
+
+		if err := fdb.repairIndex(context.Background(), tablet, height); err != nil {
+			zlog.Warn("unable to repair corrupted tablet index", zap.Stringer("tablet", tablet), zap.Uint64("height", height), zap.Error(err))
+			return
+		}
+
+		zlog.Info("repaired corrupted tablet index", zap.Stringer("tablet", tablet), zap.Uint64("height", height))
+	}()
+}
+
+func (fdb *FluxDB) repairIndex(ctx context.Context, tablet Tablet, height uint64) (err error) {
+	defer func() {
+		fdb.recordAuditEvent(ctx, "repair_index", map[string]interface{}{"tablet": tablet.String(), "height": height}, &err)
+	}()
+
+	index, _, err := fdb.indexTablet(ctx, height, tablet, true, true, true)
+	if err != nil {
+		return fmt.Errorf("index tablet: %w", err)
+	}
+
+	batch := fdb.store.NewBatch(zlog)
+	if err := fdb.writeIndex(ctx, batch, index, newIndexSinglet(tablet)); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+
+	if err := batch.Flush(ctx); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	pbfluxdb "github.com/dfuse-io/pbgo/dfuse/fluxdb/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexChecksum(t *testing.T) {
+	legacy, err := proto.Marshal(&pbfluxdb.TabletIndex{SquelchedCount: 3})
+	require.NoError(t, err)
+	assert.NoError(t, verifyIndexChecksum(legacy), "values without checksum are never corrupted")
+
+	value := withIndexChecksum(legacy)
+	assert.NoError(t, verifyIndexChecksum(value))
+
+	// Readers unaware of the checksum must still be able to decode the value
+	decoded := &pbfluxdb.TabletIndex{}
+	require.NoError(t, proto.Unmarshal(value, decoded))
+	assert.Equal(t, uint64(3), decoded.SquelchedCount)
+
+	value[len(value)-1] ^= 0xFF
+	assert.Error(t, verifyIndexChecksum(value))
+}
+
+func TestReadTabletAt_CorruptedIndex(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 1, "002", "r #1")}},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), TabletRows: []TabletRow{tablet.row(t, 2, "002", "r #2")}},
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), TabletRows: []TabletRow{tablet.row(t, 3, "003", "r #3")}},
+	)
+
+	require.NoError(t, db.repairIndex(ctx, tablet, 2))
+
+	singlet := newIndexSinglet(tablet)
+	indexKey := KeyForSingletEntry(newIndexSingletEntry(singlet, &TabletIndex{AtHeight: 2}))
+	value, err := db.store.FetchTabletRow(ctx, indexKey)
+	require.NoError(t, err)
+
+	corrupted := append([]byte(nil), value...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+
+	batch := db.store.NewBatch(zlog)
+	batch.SetRow(indexKey, corrupted)
+	require.NoError(t, batch.Flush(ctx))
+
+	_, err = db.ReadSingletEntryAt(ctx, singlet, 3, nil)
+	require.Error(t, err)
+
+	rows, err := db.ReadTabletAt(ctx, 3, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{
+		tablet.row(t, 1, "001", "r #1"),
+		tablet.row(t, 2, "002", "r #2"),
+		tablet.row(t, 3, "003", "r #3"),
+	}, rows)
+
+	require.Eventually(t, func() bool {
+		_, err := db.ReadSingletEntryAt(ctx, singlet, 3, nil)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "corrupted index should have been rebuilt")
+
+	index, err := db.ReadTabletIndexAt(ctx, tablet, 3)
+	require.NoError(t, err)
+	require.NotNil(t, index)
+	assert.Equal(t, uint64(2), index.AtHeight)
+	assert.Equal(t, map[string]interface{}{"001": uint64(1), "002": uint64(2)}, index.PrimaryKeyToHeight.mappings)
+}
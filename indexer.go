@@ -0,0 +1,77 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// asyncIndexer builds tablet indexes in a background goroutine so that block commits
+// are not stalled by the serialization of large tablet indexes. Schedules are consumed
+// in order from a bounded queue, when the queue is full, the write path blocks until
+// the indexer catches up.
+//
+// Until the index of a tablet lands, reads of this tablet use its previous index (if
+// any) and scan the rows written since then.
+type asyncIndexer struct {
+	db    *FluxDB
+	queue chan map[string]uint64
+}
+
+func newAsyncIndexer(db *FluxDB, queueSize int) *asyncIndexer {
+	return &asyncIndexer{
+		db:    db,
+		queue: make(chan map[string]uint64, queueSize),
+	}
+}
+
+func (i *asyncIndexer) run(ctx context.Context) {
+	zlog.Info("starting background indexer", zap.Int("queue_size", cap(i.queue)))
+	for {
+		select {
+		case <-ctx.Done():
+			zlog.Info("background indexer terminated", zap.Int("dropped_schedule_count", len(i.queue)))
+			return
+		case schedule := <-i.queue:
+			if err := i.db.indexTablets(ctx, schedule); err != nil {
+				i.db.Shutdown(fmt.Errorf("background indexer: %w", err))
+				return
+			}
+		}
+	}
+}
+
+func (i *asyncIndexer) enqueue(ctx context.Context, schedule map[string]uint64) error {
+	if len(schedule) == 0 {
+		return nil
+	}
+
+	if len(i.queue) == cap(i.queue) {
+		zlog.Warn("background indexer queue full, waiting for indexer to catch up", zap.Int("queue_size", cap(i.queue)))
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-i.db.Terminating():
+		return errors.New("background indexer terminated")
+	case i.queue <- schedule:
+		return nil
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/abourget/llerrgroup"
+	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/logging"
+	"go.uber.org/zap"
+)
+
+// The amount of keys of each multi-get keeps the serialized rows of a chunk well below 1MB
+const defaultIndexFetchChunkSize = 5000
+const defaultIndexFetchParallelism = 4
+
+// IndexFetchOptions tunes how the tablet reads fetch the rows referenced by the tablet index,
+// by chunks of exact row keys, each one being a single multi-get, see `SetIndexFetchOptions`.
+type IndexFetchOptions struct {
+	// ChunkSize is the amount of row keys fetched by each multi-get, 0 meaning a default of 5000
+	ChunkSize int
+
+	// Parallelism is the amount of chunks fetched concurrently, 0 meaning a default of 4
+	Parallelism int
+
+	// ChunkTimeout is the deadline of the fetch of each chunk, 0 meaning none, a chunk not
+	// fetched in time fails the whole read
+	ChunkTimeout time.Duration
+}
+
+func (o IndexFetchOptions) chunkSize() int {
+	if o.ChunkSize <= 0 {
+		return defaultIndexFetchChunkSize
+	}
+
+	return o.ChunkSize
+}
+
+func (o IndexFetchOptions) parallelism() int {
+	if o.Parallelism <= 0 {
+		return defaultIndexFetchParallelism
+	}
+
+	return o.Parallelism
+}
+
+// SetIndexFetchOptions tunes the fetch of the rows referenced by the tablet index, large
+// tablets benefiting from a higher parallelism, the latency of each chunk being exported
+// through the `index_fetch_chunk_duration` metric.
+func (fdb *FluxDB) SetIndexFetchOptions(options IndexFetchOptions) {
+	fdb.indexFetch = options
+}
+
+// fetchTabletIndexRows fetches the rows of the tablet at `keys`, the exact row keys resolved by
+// its index, by chunks fetched concurrently. The rows are returned per chunk.
+func (fdb *FluxDB) fetchTabletIndexRows(ctx context.Context, tablet Tablet, keys [][]byte) ([][]TabletRow, error) {
+	chunkSize := fdb.indexFetch.chunkSize()
+	chunkCount := (len(keys) + chunkSize - 1) / chunkSize
+	logging.Logger(ctx, zlog).Debug("reading index rows chunks", zap.Int("chunk_count", chunkCount), zap.Int("parallelism", fdb.indexFetch.parallelism()))
+
+	rowsPerChunk := make([][]TabletRow, chunkCount)
+	eg := llerrgroup.New(fdb.indexFetch.parallelism())
+	for i := 0; i < chunkCount; i++ {
+		if eg.Stop() {
+			break
+		}
+
+		chunkEnd := (i + 1) * chunkSize
+		if chunkEnd > len(keys) {
+			chunkEnd = len(keys)
+		}
+
+		i, keysChunk := i, keys[i*chunkSize:chunkEnd]
+		eg.Go(func() error {
+			rows, err := fdb.fetchTabletIndexRowsChunk(ctx, tablet, keysChunk)
+			if err != nil {
+				return fmt.Errorf("reading tablet index rows chunk %d: %w", i, err)
+			}
+
+			rowsPerChunk[i] = rows
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return rowsPerChunk, nil
+}
+
+func (fdb *FluxDB) fetchTabletIndexRowsChunk(ctx context.Context, tablet Tablet, keys [][]byte) ([]TabletRow, error) {
+	if fdb.indexFetch.ChunkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fdb.indexFetch.ChunkTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	defer metrics.IndexFetchChunkDuration.ObserveSince(start, collectionName(tablet.Collection()))
+
+	rows := make([]TabletRow, 0, len(keys))
+	err := fdb.store.FetchTabletRows(ctx, keys, func(key []byte, value []byte) error {
+		if len(value) == 0 {
+			return fmt.Errorf("indexes mappings should not contain empty data, empty rows don't make sense in a tablet index, row %q", Key(key))
+		}
+
+		row, err := NewTabletRow(tablet, key, value)
+		if err != nil {
+			return fmt.Errorf("tablet index new row %q: %w", Key(key), err)
+		}
+
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("reading a tablet index yielded no row, had %d keys in chunk", len(keys))
+	}
+
+	return rows, nil
+}
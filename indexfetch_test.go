@@ -0,0 +1,55 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTabletAt_IndexFetchChunks(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	index := NewTabletIndex()
+	index.AtHeight = 2
+	for _, primaryKey := range []string{"001", "002", "003", "004", "005"} {
+		index.PrimaryKeyToHeight.put([]byte(primaryKey), 1)
+	}
+
+	writeBatchOfRequests(t, db,
+		tabletRows(1,
+			tablet.row(t, 1, "001", "a"),
+			tablet.row(t, 1, "002", "b"),
+			tablet.row(t, 1, "003", "c"),
+			tablet.row(t, 1, "004", "d"),
+			tablet.row(t, 1, "005", "e"),
+		),
+		singletEntries(2, newIndexSingletEntry(newIndexSinglet(tablet), index)),
+		tabletRows(3, tablet.row(t, 3, "003", "")),
+	)
+
+	expected := []TabletRow{
+		tablet.row(t, 1, "001", "a"),
+		tablet.row(t, 1, "002", "b"),
+		tablet.row(t, 1, "004", "d"),
+		tablet.row(t, 1, "005", "e"),
+	}
+
+	for _, options := range []IndexFetchOptions{
+		{},
+		{ChunkSize: 2, Parallelism: 3, ChunkTimeout: time.Minute},
+		{ChunkSize: 1, Parallelism: 1},
+	} {
+		db.SetIndexFetchOptions(options)
+
+		rows, err := db.ReadTabletAt(ctx, 3, tablet, nil)
+		require.NoError(t, err)
+		assert.Equal(t, expected, rows, "options %+v", options)
+	}
+}
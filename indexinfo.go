@@ -0,0 +1,72 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+)
+
+// IndexInfo describes the index snapshot of a tablet used by the reads at a given height, see
+// `TabletIndexInfo`.
+type IndexInfo struct {
+	// Found is false when the tablet has no index snapshot at or below the height, the reads then
+	// scan all the rows of the tablet
+	Found bool
+
+	// AtHeight is the height of the index snapshot, the rows written above it are scanned by the
+	// reads
+	AtHeight uint64
+
+	// PrimaryKeyCount is the amount of rows referenced by the index snapshot
+	PrimaryKeyCount uint64
+
+	// ByteSize is the size of the index snapshot as stored
+	ByteSize int
+
+	// SquelchCount is the amount of row versions, deletions included, folded into this index
+	// snapshot from the previous one
+	SquelchCount uint64
+}
+
+// TabletIndexInfo returns the statistics of the index snapshot used by the reads of the tablet
+// at `height`, to help diagnose a slow or stale tablet read. The index snapshot is read from the
+// store directly, bypassing the read interceptors. A corrupted index snapshot is reported as
+// an error, the reads ignore it and fall back to scanning the rows.
+func (fdb *FluxDB) TabletIndexInfo(ctx context.Context, tablet Tablet, height uint64) (*IndexInfo, error) {
+	singlet := newIndexSinglet(tablet)
+	key, value, err := fdb.store.FetchSingletEntry(ctx, KeyForSingletAt(singlet, height), KeyForSingletAt(singlet, 0))
+	if err != nil {
+		return nil, fmt.Errorf("fetch tablet index: %w", err)
+	}
+
+	if len(key) == 0 {
+		return &IndexInfo{}, nil
+	}
+
+	entry, err := NewSingletEntry(singlet, key, value)
+	if err != nil {
+		return nil, fmt.Errorf("tablet index %q: %w", Key(key), err)
+	}
+
+	index := entry.(indexSingletEntry).index
+	return &IndexInfo{
+		Found:           true,
+		AtHeight:        index.AtHeight,
+		PrimaryKeyCount: index.RowCount(),
+		ByteSize:        len(value),
+		SquelchCount:    index.SquelchCount,
+	}, nil
+}
@@ -0,0 +1,44 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTabletIndexInfo(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+
+	info, err := db.TabletIndexInfo(ctx, tablet, 10)
+	require.NoError(t, err)
+	assert.Equal(t, &IndexInfo{}, info)
+
+	index := NewTabletIndex()
+	index.AtHeight = 5
+	index.SquelchCount = 3
+	index.PrimaryKeyToHeight.put([]byte("001"), 2)
+	index.PrimaryKeyToHeight.put([]byte("002"), 5)
+
+	value, err := index.MarshalValue()
+	require.NoError(t, err)
+
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:         5,
+		TabletRows:     []TabletRow{tablet.row(t, 5, "002", "b")},
+		SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), index)},
+	})
+
+	info, err = db.TabletIndexInfo(ctx, tablet, 10)
+	require.NoError(t, err)
+	assert.Equal(t, &IndexInfo{Found: true, AtHeight: 5, PrimaryKeyCount: 2, ByteSize: len(value), SquelchCount: 3}, info)
+
+	info, err = db.TabletIndexInfo(ctx, tablet, 4)
+	require.NoError(t, err)
+	assert.False(t, info.Found, "index snapshot is above the height")
+}
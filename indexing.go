@@ -17,9 +17,11 @@ package fluxdb
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"sort"
+	"sync"
 
 	"github.com/dfuse-io/dtracing"
 	"github.com/dfuse-io/fluxdb/store"
@@ -38,12 +40,18 @@ func (fdb *FluxDB) IndexTables(ctx context.Context) error {
 	ctx, span := dtracing.StartSpan(ctx, "index tables")
 	defer span.End()
 
+	return fdb.indexTablets(ctx, fdb.idxCache.IndexingSchedule())
+}
+
+// indexTablets indexes all the tablets of the received schedule, a map of tablet key to
+// the height at which the index must be built.
+func (fdb *FluxDB) indexTablets(ctx context.Context, schedule map[string]uint64) error {
 	zlog := logging.Logger(ctx, zlog)
-	zlog.Debug("indexing tables")
+	zlog.Debug("indexing tables", zap.Int("tablet_count", len(schedule)))
 
 	batch := fdb.store.NewBatch(zlog)
 
-	for key, height := range fdb.idxCache.scheduleIndexing {
+	for key, height := range schedule {
 		tabletKey := TabletKey(key)
 		tablet, err := NewTablet(tabletKey)
 		if err != nil {
@@ -67,7 +75,7 @@ func (fdb *FluxDB) IndexTables(ctx context.Context) error {
 			if index != nil {
 				fdb.idxCache.CacheIndex(tabletKey, index)
 			}
-			delete(fdb.idxCache.scheduleIndexing, string(tabletKey))
+			fdb.idxCache.IndexingCompleted(tabletKey, height)
 
 			continue
 		}
@@ -86,8 +94,8 @@ func (fdb *FluxDB) IndexTables(ctx context.Context) error {
 
 		zlog.Debug("caching index in index cache", zap.Stringer("index_singlet", indexSinglet))
 		fdb.idxCache.CacheIndex(tabletKey, index)
-		fdb.idxCache.ResetCounter(tabletKey)
-		delete(fdb.idxCache.scheduleIndexing, string(tabletKey))
+		fdb.idxCache.SubtractCount(tabletKey, fdb.idxCache.ScheduledCount(tabletKey))
+		fdb.idxCache.IndexingCompleted(tabletKey, height)
 	}
 
 	if err := batch.Flush(ctx); err != nil {
@@ -117,6 +125,15 @@ func (fdb *FluxDB) ReindexTablets(ctx context.Context, height uint64, lowerBound
 		return len(indexKeysPerTablet), indexCount, nil
 	}
 
+	defer func() {
+		fdb.recordAuditEvent(ctx, "reindex_tablets", map[string]interface{}{
+			"height":       height,
+			"lower_bound":  tabletString(lowerBound),
+			"tablet_count": len(indexKeysPerTablet),
+			"index_count":  indexCount,
+		}, &err)
+	}()
+
 	batch := fdb.store.NewBatch(zlog)
 	for _, key := range orderedIndexTablets {
 		entries := indexKeysPerTablet[key]
@@ -215,6 +232,10 @@ func (fdb *FluxDB) ReindexTablet(ctx context.Context, height uint64, tablet Tabl
 	}
 
 	err = batch.Flush(ctx)
+	fdb.recordAuditEvent(ctx, "reindex_tablet", map[string]interface{}{
+		"tablet": tablet.String(),
+		"height": indexEntry.Height(),
+	}, &err)
 	if err != nil {
 		return nil, false, fmt.Errorf("write index: %w", err)
 	}
@@ -222,6 +243,52 @@ func (fdb *FluxDB) ReindexTablet(ctx context.Context, height uint64, tablet Tabl
 	return reindex, true, nil
 }
 
+// ForceIndexTablet immediately builds and writes an index snapshot of the tablet at the last
+// written height, regardless of the amount of mutations since its previous index snapshot. It
+// is meant for operators anticipating heavy read traffic on a tablet known to be large, so its
+// reads stop scanning the rows written since the previous index snapshot.
+func (fdb *FluxDB) ForceIndexTablet(ctx context.Context, tablet Tablet) (*TabletIndex, error) {
+	// Counted first, the mutations counted afterwards being possibly above the indexed height
+	tabletKey := KeyForTablet(tablet)
+	indexedCount := fdb.idxCache.GetCount(tabletKey)
+
+	height, _, err := fdb.FetchLastWrittenCheckpoint(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch last written checkpoint: %w", err)
+	}
+
+	if height == 0 {
+		return nil, errors.New("nothing written yet, there is nothing to index")
+	}
+
+	zlog.Info("forcing tablet index", zap.Stringer("tablet", tablet), zap.Uint64("height", height))
+
+	// The cached index is skipped, it's updated in place when indexing and the pipeline owns it
+	index, _, err := fdb.indexTablet(ctx, height, tablet, true, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("index tablet: %w", err)
+	}
+
+	batch := fdb.store.NewBatch(zlog)
+	if err := fdb.writeIndex(ctx, batch, index, newIndexSingletFromKey(tabletKey)); err != nil {
+		return nil, fmt.Errorf("write index: %w", err)
+	}
+
+	err = batch.Flush(ctx)
+	fdb.recordAuditEvent(ctx, "force_index_tablet", map[string]interface{}{
+		"tablet": tablet.String(),
+		"height": height,
+	}, &err)
+	if err != nil {
+		return nil, fmt.Errorf("write index: %w", err)
+	}
+
+	fdb.idxCache.CacheIndexIfNewer(tabletKey, index)
+	fdb.idxCache.SubtractCount(tabletKey, indexedCount)
+
+	return index, nil
+}
+
 func (fdb *FluxDB) indexTablet(ctx context.Context, height uint64, tablet Tablet, forceIndex bool, skipFromCache bool, skipFromStore bool) (index *TabletIndex, skipped bool, err error) {
 	tabletKey := KeyForTablet(tablet)
 
@@ -239,6 +306,14 @@ func (fdb *FluxDB) indexTablet(ctx context.Context, height uint64, tablet Tablet
 
 		var err error
 		index, err = fdb.fetchIndex(ctx, indexSinglet, height-1)
+
+		// The index is rebuilt from scratch when the previous one is corrupted
+		var corrupted *corruptedIndexError
+		if errors.As(err, &corrupted) {
+			zlog.Warn("previous tablet index corrupted, indexing tablet from scratch", zap.Stringer("tablet", tablet), zap.Error(err))
+			index, err = nil, nil
+		}
+
 		if err != nil {
 			return nil, false, fmt.Errorf("get index %s at height %d: %w", tablet, height, err)
 		}
@@ -344,6 +419,17 @@ func (fdb *FluxDB) PruneTabletIndexes(ctx context.Context, pruneFrequency int, h
 		zap.Int("index_count", indexCount),
 	)
 
+	if !dryRun {
+		defer func() {
+			fdb.recordAuditEvent(ctx, "prune_tablet_indexes", map[string]interface{}{
+				"frequency":           pruneFrequency,
+				"height":              height,
+				"lower_bound":         tabletString(lowerBound),
+				"deleted_index_count": deletedIndexCount,
+			}, &err)
+		}()
+	}
+
 	batch := fdb.store.NewBatch(zlog)
 	for _, tabletKey := range orderedIndexTablets {
 		indexes := indexKeysPerTablet[tabletKey]
@@ -376,6 +462,9 @@ func (fdb *FluxDB) PruneTabletIndexes(ctx context.Context, pruneFrequency int, h
 				}
 
 				batch.PurgeRow(KeyForSingletEntry(entry))
+				if fdb.primaryKeyBloomRate != 0 {
+					batch.PurgeRow(KeyForSingletAt(newPrimaryKeyBloomSinglet(tablet), entry.Height()))
+				}
 			}
 		}
 
@@ -456,12 +545,24 @@ func (fdb *FluxDB) ReadTabletIndexAt(ctx context.Context, tablet Tablet, height
 	zlog.Debug("fetching tablet index from database", zap.Stringer("tablet", tablet), zap.Uint64("height", height))
 
 	indexEntry, err := fdb.ReadSingletEntryAt(ctx, newIndexSinglet(tablet), height, nil)
+
+	// A corrupted index must never lead to wrong results, the read falls back to a rows scan
+	var corrupted *corruptedIndexError
+	if errors.As(err, &corrupted) {
+		zlog.Warn("tablet index corrupted, falling back to rows scan and rebuilding it", zap.Stringer("tablet", tablet), zap.Error(err))
+		fdb.scheduleIndexRepair(tablet, corrupted.height)
+		return nil, nil
+	}
+
 	if err != nil {
 		return nil, fmt.Errorf("unable to read entry: %w", err)
 	}
 
 	if indexEntry != nil {
-		return indexEntry.(indexSingletEntry).index, nil
+		index := indexEntry.(indexSingletEntry).index
+		store.ReadStatsFromContext(ctx).RecordIndexSnapshot(index.AtHeight)
+
+		return index, nil
 	}
 
 	return nil, nil
@@ -480,13 +581,34 @@ func (fdb *FluxDB) writeIndex(ctx context.Context, batch store.Batch, index *Tab
 	}
 
 	batch.SetRow(KeyForSingletEntry(indexEntry), value)
+	fdb.missingKeys.forgetSinglet(singlet)
+
+	fdb.writePrimaryKeyBloom(batch, index, singlet.tabletKey)
 	return nil
 }
 
 type indexCache struct {
+	lock sync.Mutex
+
 	lastIndexes      map[string]*TabletIndex
 	lastCounters     map[string]int
 	scheduleIndexing map[string]uint64
+
+	// pendingIndexing holds the tablets handed off to the background indexer and not
+	// yet indexed, they must not be scheduled again until the indexer is done with them.
+	pendingIndexing map[string]bool
+
+	// scheduledCounts holds the mutations count of the scheduled (or pending) tablets when
+	// last scheduled, i.e. the mutations at or below their scheduled height, which are the
+	// ones covered by their index once built.
+	scheduledCounts map[string]int
+
+	// adaptive enables the tracking of reads in `readStats`, used to tighten or relax
+	// how often each tablet is indexed, see `IndexingPolicy`. At most `maxReadStats` tablets
+	// are tracked.
+	adaptive     bool
+	readStats    map[string]*tabletReadStats
+	maxReadStats int
 }
 
 func newIndexCache() *indexCache {
@@ -494,42 +616,109 @@ func newIndexCache() *indexCache {
 		lastIndexes:      make(map[string]*TabletIndex),
 		lastCounters:     make(map[string]int),
 		scheduleIndexing: make(map[string]uint64),
+		pendingIndexing:  make(map[string]bool),
+		scheduledCounts:  make(map[string]int),
+		maxReadStats:     maxTabletReadStats,
 	}
 }
 
 func (t *indexCache) GetIndex(key TabletKey) *TabletIndex {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	return t.lastIndexes[string(key)]
 }
 
 func (t *indexCache) CacheIndex(key TabletKey, tableIndex *TabletIndex) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lastIndexes[string(key)] = tableIndex
+}
+
+// CacheIndexIfNewer caches the index unless a more recent one is already cached.
+func (t *indexCache) CacheIndexIfNewer(key TabletKey, tableIndex *TabletIndex) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if cached, found := t.lastIndexes[string(key)]; found && cached.AtHeight >= tableIndex.AtHeight {
+		return
+	}
+
 	t.lastIndexes[string(key)] = tableIndex
 }
 
 func (t *indexCache) GetCount(key TabletKey) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	return t.lastCounters[string(key)]
 }
 
 func (t *indexCache) IncCount(key TabletKey) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	t.lastCounters[string(key)]++
 }
 
-func (t *indexCache) ResetCounter(key TabletKey) {
-	t.lastCounters[string(key)] = 0
+// SubtractCount removes the mutations covered by an index just built from the mutations count
+// of the tablet, the ones written above the index height being kept.
+func (t *indexCache) SubtractCount(key TabletKey, indexedCount int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lastCounters[string(key)] -= indexedCount
+	if t.lastCounters[string(key)] < 0 {
+		t.lastCounters[string(key)] = 0
+	}
+
+	if stats := t.readStats[string(key)]; stats != nil {
+		stats.decay()
+	}
 }
 
 func (t *indexCache) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	t.lastIndexes = make(map[string]*TabletIndex)
 	t.lastCounters = make(map[string]int)
 	t.scheduleIndexing = make(map[string]uint64)
+	t.pendingIndexing = make(map[string]bool)
+	t.scheduledCounts = make(map[string]int)
+	if t.adaptive {
+		t.readStats = make(map[string]*tabletReadStats)
+	}
 }
 
 // This algorithm determines the space between the indexes
 func (t *indexCache) shouldTriggerIndexing(key TabletKey) bool {
-	return t.shouldIndex(key, t.lastIndexes[string(key)])
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.pendingIndexing[string(key)] {
+		return false
+	}
+
+	mutatedRowsCount := t.indexingPolicy(key).effectiveMutations(t.lastCounters[string(key)])
+
+	return shouldIndexMutations(mutatedRowsCount, t.lastIndexes[string(key)])
 }
 
 // shouldIndex determines if the following tablet and its previous tablet index (could be nil)
-// should be indexed again.
+// should be indexed again, see `shouldIndexMutations` for the actual algorithm. The mutations
+// count is first adjusted according to the tablet's indexing policy.
+func (t *indexCache) shouldIndex(key TabletKey, previousIndex *TabletIndex) bool {
+	t.lock.Lock()
+	mutatedRowsCount := t.indexingPolicy(key).effectiveMutations(t.lastCounters[string(key)])
+	t.lock.Unlock()
+
+	return shouldIndexMutations(mutatedRowsCount, previousIndex)
+}
+
+// shouldIndexMutations determines if a tablet with `mutatedRowsCount` mutations since its
+// previous tablet index (could be nil) should be indexed again.
 //
 // The algorithm is as follow:
 //  If there is less than 25K mutations, skip
@@ -543,9 +732,7 @@ func (t *indexCache) shouldTriggerIndexing(key TabletKey) bool {
 //      If the previous index has more than 200K rows =>
 //         If there is greater than 100K mutations, index
 //         Otherwise, skip
-func (t *indexCache) shouldIndex(key TabletKey, previousIndex *TabletIndex) bool {
-	mutatedRowsCount := t.lastCounters[string(key)]
-
+func shouldIndexMutations(mutatedRowsCount int, previousIndex *TabletIndex) bool {
 	// If there is less than 25K mutations, wheter or not a previous index existed, we are not ready to index this tablet
 	if mutatedRowsCount < 25000 {
 		return false
@@ -575,11 +762,78 @@ func (t *indexCache) shouldIndex(key TabletKey, previousIndex *TabletIndex) bool
 }
 
 func (t *indexCache) ScheduleIndex(key TabletKey, height uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.pendingIndexing[string(key)] {
+		return
+	}
+
 	t.scheduleIndexing[string(key)] = height
+	t.scheduledCounts[string(key)] = t.lastCounters[string(key)]
+}
+
+// ScheduledCount returns the mutations count of the tablet when it was last scheduled, see
+// `scheduledCounts`.
+func (t *indexCache) ScheduledCount(key TabletKey) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.scheduledCounts[string(key)]
 }
 
+// IndexingSchedule returns a copy of the current indexing schedule, a map of tablet key to
+// the height at which the index must be built.
 func (t *indexCache) IndexingSchedule() map[string]uint64 {
-	return t.scheduleIndexing
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	schedule := make(map[string]uint64, len(t.scheduleIndexing))
+	for key, height := range t.scheduleIndexing {
+		schedule[key] = height
+	}
+
+	return schedule
+}
+
+func (t *indexCache) HasScheduledIndexing() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return len(t.scheduleIndexing) > 0
+}
+
+// DrainIndexingSchedule returns the current indexing schedule and clears it, marking
+// each tablet as pending until `IndexingCompleted` is called for it.
+func (t *indexCache) DrainIndexingSchedule() map[string]uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	schedule := t.scheduleIndexing
+	for key := range schedule {
+		t.pendingIndexing[key] = true
+	}
+
+	t.scheduleIndexing = make(map[string]uint64)
+	return schedule
+}
+
+// IndexingCompleted removes the tablet from the schedule (only if it's still scheduled at
+// `height`) as well as from the pending tablets.
+func (t *indexCache) IndexingCompleted(key TabletKey, height uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	scheduledHeight, scheduled := t.scheduleIndexing[string(key)]
+	if scheduled && scheduledHeight == height {
+		delete(t.scheduleIndexing, string(key))
+	}
+
+	if !scheduled || scheduledHeight == height {
+		delete(t.scheduledCounts, string(key))
+	}
+
+	delete(t.pendingIndexing, string(key))
 }
 
 var indexSingletCollection uint16 = 0xFFFF
@@ -619,9 +873,13 @@ func (s indexSinglet) Identifier() []byte {
 }
 
 func (s indexSinglet) Entry(height uint64, value []byte) (SingletEntry, error) {
+	if err := verifyIndexChecksum(value); err != nil {
+		return nil, &corruptedIndexError{height: height, err: err}
+	}
+
 	indexProto := pbfluxdb.TabletIndex{}
 	if err := proto.Unmarshal(value, &indexProto); err != nil {
-		return nil, fmt.Errorf("unmarshal index: %w", err)
+		return nil, &corruptedIndexError{height: height, err: fmt.Errorf("unmarshal index: %w", err)}
 	}
 
 	index := &TabletIndex{
@@ -691,13 +949,16 @@ func (m *primaryKeyToHeightMap) delete(k []byte) {
 	m.bytesMap.delete(k)
 }
 
-func (m *primaryKeyToHeightMap) rowKeys(tablet Tablet, height uint64) (keys [][]byte) {
-	keys = make([][]byte, m.len())
+// rowKeys returns the keys of the rows referenced by the index whose primary key matches the
+// filter, all of them when it's nil.
+func (m *primaryKeyToHeightMap) rowKeys(tablet Tablet, filter *TabletRowFilter) (keys [][]byte) {
+	keys = make([][]byte, 0, m.len())
 
-	i := 0
-	for primaryKey, height := range m.mappings {
-		keys[i] = KeyForTabletRowFromParts(tablet, height.(uint64), []byte(primaryKey))
-		i++
+	for key, height := range m.mappings {
+		primaryKey := []byte(key)
+		if filter.matches(primaryKey) {
+			keys = append(keys, KeyForTabletRowFromParts(tablet, height.(uint64), primaryKey))
+		}
 	}
 
 	return
@@ -0,0 +1,249 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// IndexingPolicy determines how often a tablet is indexed relative to the default
+// mutations thresholds used when indexing tablets.
+type IndexingPolicy int
+
+const (
+	// IndexingPolicyDefault uses the default mutations thresholds.
+	IndexingPolicyDefault IndexingPolicy = iota
+
+	// IndexingPolicyTight is used for tablets that are read often and expensively, each
+	// mutation counts as `tightIndexingFactor` mutations so index snapshots are taken
+	// more often, reducing the amount of rows scanned on each read.
+	IndexingPolicyTight
+
+	// IndexingPolicyRelaxed is used for tablets that are never read, `relaxedIndexingFactor`
+	// mutations are needed to count as a single one so fewer index snapshots are taken.
+	IndexingPolicyRelaxed
+)
+
+const (
+	tightIndexingFactor   = 5
+	relaxedIndexingFactor = 4
+
+	// A tablet is considered read often when it has been read at least this amount of times
+	tightIndexingMinReadCount = 10
+
+	// A tablet is considered expensive to read when each read scans on average at least this
+	// amount of rows past its last index
+	tightIndexingMinScannedRowsPerRead = 5000
+
+	// At most this amount of tablets have their reads tracked, past it the least read ones are
+	// forgotten, see `indexCache.pruneReadStats`
+	maxTabletReadStats = 100000
+)
+
+func (p IndexingPolicy) String() string {
+	switch p {
+	case IndexingPolicyTight:
+		return "tight"
+	case IndexingPolicyRelaxed:
+		return "relaxed"
+	default:
+		return "default"
+	}
+}
+
+// effectiveMutations returns the mutations count, adjusted for the policy, that should be
+// fed to the indexing thresholds algorithm.
+func (p IndexingPolicy) effectiveMutations(mutatedRowsCount int) int {
+	switch p {
+	case IndexingPolicyTight:
+		return mutatedRowsCount * tightIndexingFactor
+	case IndexingPolicyRelaxed:
+		return mutatedRowsCount / relaxedIndexingFactor
+	default:
+		return mutatedRowsCount
+	}
+}
+
+// tabletReadStats accumulates the reads performed on a tablet since the adaptive
+// indexing was enabled. Each time the tablet is indexed, the stats are halved so
+// that older reads weight less than recent ones in the learned policy.
+type tabletReadStats struct {
+	readCount       int
+	scannedRowCount int
+}
+
+func (s *tabletReadStats) decay() {
+	s.readCount /= 2
+	s.scannedRowCount /= 2
+}
+
+func indexingPolicyFor(stats *tabletReadStats) IndexingPolicy {
+	if stats == nil || stats.readCount == 0 {
+		return IndexingPolicyRelaxed
+	}
+
+	if stats.readCount >= tightIndexingMinReadCount && stats.scannedRowCount/stats.readCount >= tightIndexingMinScannedRowsPerRead {
+		return IndexingPolicyTight
+	}
+
+	return IndexingPolicyDefault
+}
+
+// TabletIndexingPolicy is the indexing policy learned for a given tablet along with the
+// statistics used to determine it.
+type TabletIndexingPolicy struct {
+	Tablet          string `json:"tablet"`
+	Policy          string `json:"policy"`
+	ReadCount       int    `json:"read_count"`
+	ScannedRowCount int    `json:"scanned_row_count"`
+	MutationCount   int    `json:"mutation_count"`
+}
+
+// EnableAdaptiveIndexing tracks the reads performed on each tablet to adapt how often
+// it is indexed. Tablets read often that requires scanning a lot of rows past their last
+// index are indexed more frequently while tablets that are only written to are indexed
+// less frequently.
+func (fdb *FluxDB) EnableAdaptiveIndexing() {
+	fdb.idxCache.EnableAdaptive()
+}
+
+// TabletIndexingPolicies returns the indexing policy currently learned for each tablet
+// known to the index cache, ordered by tablet. Returns nothing when adaptive indexing
+// is not enabled.
+func (fdb *FluxDB) TabletIndexingPolicies() []*TabletIndexingPolicy {
+	return fdb.idxCache.IndexingPolicies()
+}
+
+func (fdb *FluxDB) recordTabletRead(tablet Tablet, scannedRowCount int) {
+	fdb.idxCache.RecordRead(KeyForTablet(tablet), scannedRowCount)
+}
+
+func (t *indexCache) EnableAdaptive() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.adaptive = true
+	if t.readStats == nil {
+		t.readStats = make(map[string]*tabletReadStats)
+	}
+}
+
+func (t *indexCache) RecordRead(key TabletKey, scannedRowCount int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.adaptive {
+		return
+	}
+
+	stats, found := t.readStats[string(key)]
+	if !found {
+		if t.maxReadStats > 0 && len(t.readStats) >= t.maxReadStats {
+			t.pruneReadStats()
+		}
+
+		stats = &tabletReadStats{}
+		t.readStats[string(key)] = stats
+	}
+
+	stats.readCount++
+	stats.scannedRowCount += scannedRowCount
+}
+
+// pruneReadStats decays the read stats of all the tracked tablets, forgetting the ones left with
+// no read, until there is room for a new tablet. The tablets read the most are kept, the
+// forgotten ones going back to the relaxed policy of never read tablets. Must be called with the
+// lock held.
+func (t *indexCache) pruneReadStats() {
+	for len(t.readStats) >= t.maxReadStats {
+		for key, stats := range t.readStats {
+			stats.decay()
+			if stats.readCount == 0 {
+				delete(t.readStats, key)
+			}
+		}
+	}
+
+	zlog.Debug("pruned tablets read stats", zap.Int("tracked_tablet_count", len(t.readStats)))
+}
+
+// IndexingPolicy returns the indexing policy of the tablet, always the default one unless the
+// adaptive indexing is enabled.
+func (t *indexCache) IndexingPolicy(key TabletKey) IndexingPolicy {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.indexingPolicy(key)
+}
+
+// AverageScannedRowCount returns the average amount of rows scanned past the last index by the
+// reads of the tablet, `false` if no read of the tablet was recorded.
+func (t *indexCache) AverageScannedRowCount(key TabletKey) (int, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	stats := t.readStats[string(key)]
+	if stats == nil || stats.readCount == 0 {
+		return 0, false
+	}
+
+	return stats.scannedRowCount / stats.readCount, true
+}
+
+// indexingPolicy must be called with the lock held.
+func (t *indexCache) indexingPolicy(key TabletKey) IndexingPolicy {
+	if !t.adaptive {
+		return IndexingPolicyDefault
+	}
+
+	return indexingPolicyFor(t.readStats[string(key)])
+}
+
+func (t *indexCache) IndexingPolicies() (out []*TabletIndexingPolicy) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.adaptive {
+		return nil
+	}
+
+	keys := map[string]bool{}
+	for key := range t.lastCounters {
+		keys[key] = true
+	}
+	for key := range t.readStats {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		policy := &TabletIndexingPolicy{
+			Tablet:        TabletKey(key).String(),
+			Policy:        t.indexingPolicy(TabletKey(key)).String(),
+			MutationCount: t.lastCounters[key],
+		}
+
+		if stats := t.readStats[key]; stats != nil {
+			policy.ReadCount = stats.readCount
+			policy.ScannedRowCount = stats.scannedRowCount
+		}
+
+		out = append(out, policy)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Tablet < out[j].Tablet })
+	return out
+}
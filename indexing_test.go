@@ -15,6 +15,7 @@
 package fluxdb
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -216,3 +217,137 @@ func TestShouldTriggerIndexing(t *testing.T) {
 		})
 	}
 }
+
+func TestIndexCache_DrainIndexingSchedule(t *testing.T) {
+	cache := newIndexCache()
+	tabletKey := KeyForTablet(testTablet("a"))
+
+	cache.ScheduleIndex(tabletKey, 10)
+	assert.True(t, cache.HasScheduledIndexing())
+
+	schedule := cache.DrainIndexingSchedule()
+	assert.Equal(t, map[string]uint64{string(tabletKey): 10}, schedule)
+	assert.False(t, cache.HasScheduledIndexing())
+
+	cache.lastCounters[string(tabletKey)] = 25000
+	assert.False(t, cache.shouldTriggerIndexing(tabletKey), "pending tablet should not trigger indexing")
+
+	cache.ScheduleIndex(tabletKey, 20)
+	assert.False(t, cache.HasScheduledIndexing(), "pending tablet should not be scheduled again")
+
+	cache.IndexingCompleted(tabletKey, 10)
+	assert.True(t, cache.shouldTriggerIndexing(tabletKey))
+
+	cache.ScheduleIndex(tabletKey, 20)
+	assert.True(t, cache.HasScheduledIndexing())
+}
+
+func TestIndexCache_MutationsAboveIndexedHeightKept(t *testing.T) {
+	cache := newIndexCache()
+	tabletKey := KeyForTablet(testTablet("a"))
+
+	for i := 0; i < 100; i++ {
+		cache.IncCount(tabletKey)
+	}
+	cache.ScheduleIndex(tabletKey, 10)
+	cache.DrainIndexingSchedule()
+
+	// Written while the background indexer builds the index at height 10
+	for i := 0; i < 30; i++ {
+		cache.IncCount(tabletKey)
+	}
+
+	cache.SubtractCount(tabletKey, cache.ScheduledCount(tabletKey))
+	cache.IndexingCompleted(tabletKey, 10)
+
+	assert.Equal(t, 30, cache.GetCount(tabletKey), "mutations above the index height must still be counted")
+	assert.Equal(t, 0, cache.ScheduledCount(tabletKey))
+}
+
+func TestIndexCache_AdaptiveIndexing(t *testing.T) {
+	readTablet := KeyForTablet(newTestTablet("aaa"))
+	writeOnlyTablet := KeyForTablet(newTestTablet("bbb"))
+
+	cache := newIndexCache()
+	cache.lastCounters[string(readTablet)] = 5000
+	cache.lastCounters[string(writeOnlyTablet)] = 25000
+
+	assert.False(t, cache.shouldTriggerIndexing(readTablet))
+	assert.True(t, cache.shouldTriggerIndexing(writeOnlyTablet), "default policy when adaptive indexing is disabled")
+	assert.Nil(t, cache.IndexingPolicies())
+
+	cache.EnableAdaptive()
+	for i := 0; i < tightIndexingMinReadCount; i++ {
+		cache.RecordRead(readTablet, tightIndexingMinScannedRowsPerRead)
+	}
+
+	assert.True(t, cache.shouldTriggerIndexing(readTablet), "read often and expensively, should be indexed more often")
+	assert.False(t, cache.shouldTriggerIndexing(writeOnlyTablet), "never read, should be indexed less often")
+
+	assert.Equal(t, []*TabletIndexingPolicy{
+		{Tablet: readTablet.String(), Policy: "tight", ReadCount: 10, ScannedRowCount: 50000, MutationCount: 5000},
+		{Tablet: writeOnlyTablet.String(), Policy: "relaxed", MutationCount: 25000},
+	}, cache.IndexingPolicies())
+
+	cache.SubtractCount(readTablet, cache.GetCount(readTablet))
+	assert.Equal(t, 5, cache.IndexingPolicies()[0].ReadCount, "older reads should decay once indexed")
+	assert.Equal(t, "default", cache.IndexingPolicies()[0].Policy)
+}
+
+func TestIndexCache_ReadStatsCapped(t *testing.T) {
+	cache := newIndexCache()
+	cache.maxReadStats = 3
+	cache.EnableAdaptive()
+
+	hotTablet := KeyForTablet(newTestTablet("hot"))
+	for i := 0; i < 4; i++ {
+		cache.RecordRead(hotTablet, 100)
+	}
+
+	for _, name := range []string{"aaa", "bbb", "ccc", "ddd"} {
+		cache.RecordRead(KeyForTablet(newTestTablet(name)), 100)
+		assert.LessOrEqual(t, len(cache.readStats), 3)
+	}
+
+	require.Contains(t, cache.readStats, string(hotTablet), "most read tablet should be kept")
+	assert.Equal(t, 2, cache.readStats[string(hotTablet)].readCount, "kept tablets reads should have decayed")
+	assert.Contains(t, cache.readStats, string(KeyForTablet(newTestTablet("ddd"))), "new tablet should be tracked")
+
+	_, found := cache.AverageScannedRowCount(KeyForTablet(newTestTablet("aaa")))
+	assert.False(t, found, "least read tablet should have been forgotten")
+}
+
+func TestForceIndexTablet(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	_, err := db.ForceIndexTablet(ctx, tablet)
+	require.Error(t, err, "nothing written yet")
+
+	writeBatchOfRequests(t, db,
+		tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b")),
+		tabletRows(2, tablet.row(t, 2, "002", ""), tablet.row(t, 2, "003", "c")),
+	)
+
+	info, err := db.TabletIndexInfo(ctx, tablet, 2)
+	require.NoError(t, err)
+	require.False(t, info.Found, "below the mutation count threshold")
+
+	index, err := db.ForceIndexTablet(ctx, tablet)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), index.AtHeight)
+	assert.Equal(t, uint64(4), index.SquelchCount)
+
+	info, err = db.TabletIndexInfo(ctx, tablet, 2)
+	require.NoError(t, err)
+	assert.Equal(t, true, info.Found)
+	assert.Equal(t, uint64(2), info.AtHeight)
+	assert.Equal(t, uint64(2), info.PrimaryKeyCount)
+
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "a"), tablet.row(t, 2, "003", "c")}, rows)
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+)
+
+// Operations of the intercepted reads, see `ReadRequest`
+const (
+	ReadOperationTablet       = "read_tablet"
+	ReadOperationTabletRow    = "read_tablet_row"
+	ReadOperationSingletEntry = "read_singlet_entry"
+)
+
+// ReadRequest describes a read about to be performed on behalf of a caller, see `ReadInterceptor`.
+type ReadRequest struct {
+	Caller    string
+	Operation string
+	Height    uint64
+
+	// Tablet is the tablet read, `nil` for singlet entry reads
+	Tablet Tablet
+
+	// Singlet is the singlet read, `nil` for tablet reads
+	Singlet Singlet
+}
+
+// ReadInterceptor is called before each read performed on behalf of a caller (see `WithCaller`),
+// so multi-tenant deployments can enforce per-caller quotas. Returning an error rejects the read,
+// the error being returned by the read, blocking delays it (the context of the read must be
+// honored).
+type ReadInterceptor interface {
+	InterceptRead(ctx context.Context, request *ReadRequest) error
+}
+
+// ReadInterceptorFunc is an adapter allowing the use of an ordinary function as a `ReadInterceptor`.
+type ReadInterceptorFunc func(ctx context.Context, request *ReadRequest) error
+
+func (f ReadInterceptorFunc) InterceptRead(ctx context.Context, request *ReadRequest) error {
+	return f(ctx, request)
+}
+
+type callerContextKey struct{}
+type interceptedContextKey struct{}
+
+// WithCaller returns a context carrying the identity of the caller (e.g. an API key) on behalf of
+// which the reads performed with it are, handed to the read interceptors. Reads performed
+// without a caller are internal ones, never intercepted.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerContextKey{}, caller)
+}
+
+// CallerFromContext returns the caller identity set with `WithCaller`, if any.
+func CallerFromContext(ctx context.Context) (caller string, found bool) {
+	caller, found = ctx.Value(callerContextKey{}).(string)
+	return
+}
+
+// AddReadInterceptor adds an interceptor called before the reads performed on behalf of a
+// caller, in the order they were added. Must be called before serving reads.
+func (fdb *FluxDB) AddReadInterceptor(interceptor ReadInterceptor) {
+	fdb.readInterceptors = append(fdb.readInterceptors, interceptor)
+}
+
+// interceptRead runs the read interceptors, if the read is performed on behalf of a caller. The
+// returned context must be used for the read, the reads it performs internally (e.g. the one of
+// the tablet index) are then not intercepted again.
+func (fdb *FluxDB) interceptRead(ctx context.Context, operation string, tablet Tablet, singlet Singlet, height uint64) (context.Context, error) {
+	if len(fdb.readInterceptors) == 0 || ctx.Value(interceptedContextKey{}) != nil {
+		return ctx, nil
+	}
+
+	caller, found := CallerFromContext(ctx)
+	if !found {
+		return ctx, nil
+	}
+
+	request := &ReadRequest{Caller: caller, Operation: operation, Height: height, Tablet: tablet, Singlet: singlet}
+	for _, interceptor := range fdb.readInterceptors {
+		if err := interceptor.InterceptRead(ctx, request); err != nil {
+			metrics.RejectedReadCount.Inc(operation)
+			return ctx, fmt.Errorf("read rejected: %w", err)
+		}
+	}
+
+	return context.WithValue(ctx, interceptedContextKey{}, true), nil
+}
@@ -0,0 +1,59 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadInterceptor(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:         1,
+		BlockRef:       bstream.NewBlockRef("00000001aa", 1),
+		SingletEntries: []SingletEntry{singlet.entry(t, 1, "s #1")},
+		TabletRows:     []TabletRow{tablet.row(t, 1, "001", "r #1")},
+	})
+
+	errQuotaExceeded := errors.New("quota exceeded")
+
+	var requests []ReadRequest
+	db.AddReadInterceptor(ReadInterceptorFunc(func(ctx context.Context, request *ReadRequest) error {
+		requests = append(requests, *request)
+		if request.Caller == "blocked" {
+			return errQuotaExceeded
+		}
+
+		return nil
+	}))
+
+	_, err := db.ReadTabletAt(ctx, 1, tablet, nil)
+	require.NoError(t, err)
+	assert.Len(t, requests, 0, "reads without caller must not be intercepted")
+
+	callerCtx := WithCaller(ctx, "key-1")
+	_, err = db.ReadTabletAt(callerCtx, 1, tablet, nil)
+	require.NoError(t, err)
+	_, err = db.ReadTabletRowAt(callerCtx, 1, tablet, testTabletRowPrimaryKey("001"), nil)
+	require.NoError(t, err)
+	_, err = db.ReadSingletEntryAt(callerCtx, singlet, 1, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []ReadRequest{
+		{Caller: "key-1", Operation: ReadOperationTablet, Height: 1, Tablet: tablet},
+		{Caller: "key-1", Operation: ReadOperationTabletRow, Height: 1, Tablet: tablet},
+		{Caller: "key-1", Operation: ReadOperationSingletEntry, Height: 1, Singlet: singlet},
+	}, requests, "reads performed internally must not be intercepted again")
+
+	_, err = db.ReadTabletAt(WithCaller(ctx, "blocked"), 1, tablet, nil)
+	assert.True(t, errors.Is(err, errQuotaExceeded))
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// The checkpoint table key under which the irreversibility condition of the pipeline writing the
+// store is persisted, must not start with `shard-` since this prefix is reserved to the shards
+// last written checkpoint.
+var irreversibilityConditionKey = []byte("config-irreversibility")
+
+const confirmationDepthPrefix = "confirmation-depth:"
+
+// ErrIrreversibilityConditionMismatch is the error returned by `CheckIrreversibilityCondition`
+// when the store was written with another irreversibility condition than the configured one.
+var ErrIrreversibilityConditionMismatch = errors.New("irreversibility condition mismatch")
+
+// IrreversibilityCondition defines when the pipeline considers a block irreversible, and so
+// writes it, see `SetIrreversibilityCondition`. The zero value is the native condition, the last
+// irreversible block being the one reported by each block (its `LibNum`).
+type IrreversibilityCondition struct {
+	// ConfirmationDepth, when non-zero, considers a block irreversible once that many blocks
+	// were produced on top of it, the last irreversible block of each block being its number
+	// minus the depth, whatever the block reports, for chains without native finality
+	ConfirmationDepth uint64
+}
+
+// ParseIrreversibilityCondition parses the condition from its string form, either `native` (or
+// an empty string) or `confirmation-depth:<blocks>`.
+func ParseIrreversibilityCondition(in string) (IrreversibilityCondition, error) {
+	if in == "" || in == "native" {
+		return IrreversibilityCondition{}, nil
+	}
+
+	if !strings.HasPrefix(in, confirmationDepthPrefix) {
+		return IrreversibilityCondition{}, fmt.Errorf("unknown irreversibility condition %q, valid values are native and confirmation-depth:<blocks>", in)
+	}
+
+	depth, err := strconv.ParseUint(strings.TrimPrefix(in, confirmationDepthPrefix), 10, 64)
+	if err != nil || depth == 0 {
+		return IrreversibilityCondition{}, fmt.Errorf("invalid irreversibility condition %q, confirmation depth must be a positive amount of blocks", in)
+	}
+
+	return IrreversibilityCondition{ConfirmationDepth: depth}, nil
+}
+
+// IsNative returns whether the last irreversible block is the one reported by each block.
+func (c IrreversibilityCondition) IsNative() bool {
+	return c.ConfirmationDepth == 0
+}
+
+func (c IrreversibilityCondition) String() string {
+	if c.IsNative() {
+		return "native"
+	}
+
+	return confirmationDepthPrefix + strconv.FormatUint(c.ConfirmationDepth, 10)
+}
+
+// Apply sets the last irreversible block number of `blk` according to the condition, it must be
+// applied to each block before it reaches the forkable handler. `BuildPipeline` applies the one
+// set with `SetIrreversibilityCondition`, `BuildReprocessingPipeline` only alters the blocks with
+// its block filter, which must apply it.
+func (c IrreversibilityCondition) Apply(blk *bstream.Block) {
+	if c.IsNative() {
+		return
+	}
+
+	blk.LibNum = 0
+	if blk.Number > c.ConfirmationDepth {
+		blk.LibNum = blk.Number - c.ConfirmationDepth
+	}
+}
+
+// SetIrreversibilityCondition configures the irreversibility condition of the pipeline, must be
+// called before `BuildPipeline`. With a non-native condition, the irreversibility checker is not
+// configured on the forkable handler, it would move the last irreversible block natively.
+func (fdb *FluxDB) SetIrreversibilityCondition(condition IrreversibilityCondition) {
+	fdb.irreversibility = condition
+}
+
+// CheckIrreversibilityCondition validates that the store was written with the configured
+// irreversibility condition (see `SetIrreversibilityCondition`), returning an error wrapping
+// `ErrIrreversibilityConditionMismatch` otherwise, the blocks already written being irreversible
+// according to the persisted one. When the store has no irreversibility condition yet, it's
+// persisted if `persist` is true. Stores written before the condition was persisted are assumed
+// to have been written with the native one.
+func (fdb *FluxDB) CheckIrreversibilityCondition(ctx context.Context, persist bool) error {
+	configured := fdb.irreversibility.String()
+
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, irreversibilityConditionKey)
+	if errors.Is(err, store.ErrNotFound) {
+		height, _, err := fdb.FetchLastWrittenCheckpoint(ctx)
+		if err != nil {
+			return fmt.Errorf("fetch last written block: %w", err)
+		}
+
+		if height > 0 && !fdb.irreversibility.IsNative() {
+			return fmt.Errorf("store was written with the native irreversibility condition but configured one is %q: %w", configured, ErrIrreversibilityConditionMismatch)
+		}
+
+		if !persist {
+			return nil
+		}
+
+		zlog.Info("persisting irreversibility condition", zap.String("condition", configured))
+		return fdb.writeIrreversibilityCondition(ctx, configured)
+	}
+
+	if err != nil {
+		return fmt.Errorf("fetch persisted irreversibility condition: %w", err)
+	}
+
+	if persisted := string(value); persisted != configured {
+		return fmt.Errorf("store was written with irreversibility condition %q but configured one is %q: %w", persisted, configured, ErrIrreversibilityConditionMismatch)
+	}
+
+	return nil
+}
+
+func (fdb *FluxDB) writeIrreversibilityCondition(ctx context.Context, condition string) error {
+	batch := fdb.store.NewBatch(zlog)
+	batch.SetLastCheckpoint(irreversibilityConditionKey, []byte(condition))
+
+	if err := batch.Flush(ctx); err != nil {
+		return fmt.Errorf("write irreversibility condition: %w", err)
+	}
+
+	return nil
+}
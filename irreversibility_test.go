@@ -0,0 +1,87 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIrreversibilityCondition(t *testing.T) {
+	tests := []struct {
+		in          string
+		expected    IrreversibilityCondition
+		expectedErr string
+	}{
+		{"", IrreversibilityCondition{}, ""},
+		{"native", IrreversibilityCondition{}, ""},
+		{"confirmation-depth:12", IrreversibilityCondition{ConfirmationDepth: 12}, ""},
+		{"confirmation-depth:0", IrreversibilityCondition{}, `invalid irreversibility condition "confirmation-depth:0", confirmation depth must be a positive amount of blocks`},
+		{"confirmation-depth:abc", IrreversibilityCondition{}, `invalid irreversibility condition "confirmation-depth:abc", confirmation depth must be a positive amount of blocks`},
+		{"finality", IrreversibilityCondition{}, `unknown irreversibility condition "finality", valid values are native and confirmation-depth:<blocks>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			condition, err := ParseIrreversibilityCondition(test.in)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, condition)
+
+			if test.in != "" {
+				assert.Equal(t, test.in, condition.String())
+			}
+		})
+	}
+}
+
+func TestIrreversibilityCondition_Apply(t *testing.T) {
+	blk := &bstream.Block{Number: 100, LibNum: 99}
+	IrreversibilityCondition{}.Apply(blk)
+	assert.Equal(t, uint64(99), blk.LibNum)
+
+	IrreversibilityCondition{ConfirmationDepth: 12}.Apply(blk)
+	assert.Equal(t, uint64(88), blk.LibNum)
+
+	blk = &bstream.Block{Number: 5, LibNum: 4}
+	IrreversibilityCondition{ConfirmationDepth: 12}.Apply(blk)
+	assert.Equal(t, uint64(0), blk.LibNum)
+}
+
+func TestCheckIrreversibilityCondition(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.SetIrreversibilityCondition(IrreversibilityCondition{ConfirmationDepth: 12})
+	require.NoError(t, db.CheckIrreversibilityCondition(ctx, false))
+	require.NoError(t, db.CheckIrreversibilityCondition(ctx, true))
+
+	db.SetIrreversibilityCondition(IrreversibilityCondition{})
+	err := db.CheckIrreversibilityCondition(ctx, true)
+	assert.True(t, errors.Is(err, ErrIrreversibilityConditionMismatch), "expected irreversibility condition mismatch, got %s", err)
+	assert.EqualError(t, err, `store was written with irreversibility condition "confirmation-depth:12" but configured one is "native": irreversibility condition mismatch`)
+}
+
+func TestCheckIrreversibilityCondition_WrittenBeforePersisted(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a")))
+
+	db.SetIrreversibilityCondition(IrreversibilityCondition{ConfirmationDepth: 12})
+	err := db.CheckIrreversibilityCondition(ctx, true)
+	assert.True(t, errors.Is(err, ErrIrreversibilityConditionMismatch), "expected irreversibility condition mismatch, got %s", err)
+
+	db.SetIrreversibilityCondition(IrreversibilityCondition{})
+	require.NoError(t, db.CheckIrreversibilityCondition(ctx, true))
+}
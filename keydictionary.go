@@ -0,0 +1,63 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dfuse-io/fluxdb/store/keydict"
+)
+
+// KeyDictionaryIdentities returns the identities compressed by a `keydict.KVStore`, the tablets
+// of the received tablet collections, all the registered ones when none is received, whose
+// identifier is repeated in every one of their row keys.
+//
+// The dictionary must be enabled before any row of the collections is written, and never
+// disabled afterwards, see `keydict.KVStore`.
+func KeyDictionaryIdentities(tabletCollections ...uint16) (keydict.Identities, error) {
+	if len(tabletCollections) == 0 {
+		for collection := range tabletFactories {
+			tabletCollections = append(tabletCollections, collection)
+		}
+		sort.Slice(tabletCollections, func(i, j int) bool { return tabletCollections[i] < tabletCollections[j] })
+	}
+
+	for _, collection := range tabletCollections {
+		if _, found := tabletFactories[collection]; !found {
+			return keydict.Identities{}, fmt.Errorf("collection 0x%04X is not a registered tablet collection", collection)
+		}
+	}
+
+	return keydict.Identities{Collections: tabletCollections, Length: tabletKeyLength}, nil
+}
+
+// tabletKeyLength returns the length of the tablet key the row key starts with. The tablet
+// factories expect enough bytes for the tablet identifier, the partial keys (e.g. range bounds)
+// they could panic on are invalid.
+func tabletKeyLength(key []byte) (length int, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("invalid tablet key %q: %v", Key(key), recovered)
+		}
+	}()
+
+	tablet, err := NewTablet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(KeyForTablet(tablet)), nil
+}
@@ -0,0 +1,72 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/keydict"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyDictionary(t *testing.T) {
+	raw, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	identities, err := KeyDictionaryIdentities(testTabletCollection)
+	require.NoError(t, err)
+
+	dictionaryStore, err := keydict.NewStore(ctx, raw.store, identities)
+	require.NoError(t, err)
+	db := New(dictionaryStore, nil, nil, false)
+
+	first, second := newTestTablet("ccc"), newTestTablet("aaa")
+	writeBatchOfRequests(t, db,
+		tabletRows(1, first.row(t, 1, "001", "a"), second.row(t, 1, "001", "b")),
+		tabletRows(2, first.row(t, 2, "002", "c")),
+	)
+
+	rows, err := db.ReadTabletAt(ctx, 2, first, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "c", rows[1].(testTabletRow).data())
+
+	var keyLengths []int
+	require.NoError(t, raw.store.ScanTableKeys(ctx, store.RowsTable, KeyForTablet(first)[:2], nil, func(key []byte) error {
+		if collectionFromKey(key) == testTabletCollection {
+			keyLengths = append(keyLengths, len(key))
+		}
+		return nil
+	}))
+	assert.Equal(t, []int{17, 17, 17}, keyLengths, "collection, identifier, height and primary key")
+
+	// Cross-tablet scans receive the rows in tablet order
+	var tablets []string
+	require.NoError(t, db.store.ScanTableKeys(ctx, store.RowsTable, nil, nil, func(key []byte) error {
+		if collectionFromKey(key) == testTabletCollection {
+			tablet, err := NewTablet(key)
+			require.NoError(t, err)
+			tablets = append(tablets, tablet.String())
+		}
+		return nil
+	}))
+	assert.Equal(t, []string{"tst:aaa", "tst:ccc", "tst:ccc"}, tablets)
+}
+
+func TestKeyDictionaryIdentities(t *testing.T) {
+	_, err := KeyDictionaryIdentities(0x1234)
+	assert.EqualError(t, err, "collection 0x1234 is not a registered tablet collection")
+
+	identities, err := KeyDictionaryIdentities()
+	require.NoError(t, err)
+	assert.Contains(t, identities.Collections, testTabletCollection)
+
+	length, err := identities.Length(KeyForTabletAt(newTestTablet("tbl"), 10))
+	require.NoError(t, err)
+	assert.Equal(t, 5, length)
+
+	_, err = identities.Length([]byte{0xFF, 0xF2, 't'})
+	assert.Error(t, err, "partial tablet key")
+}
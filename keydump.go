@@ -0,0 +1,233 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// ValueDecoder turns the raw value of a singlet entry or tablet row into a human readable form.
+type ValueDecoder func(value []byte) (string, error)
+
+var valueDecoders = map[uint16]ValueDecoder{}
+
+// RegisterValueDecoder registers the decoder used by `DumpKey` to pretty-print the values of
+// the singlet entries or tablet rows of the received collection.
+func RegisterValueDecoder(collection uint16, decoder ValueDecoder) {
+	valueDecoders[collection] = decoder
+}
+
+// KeyDump is the decoded form of a raw key, and of its value, as stored in the underlying KV
+// store, see `DumpKey`.
+type KeyDump struct {
+	Table string
+	Kind  string
+
+	// Collection, element (tablet or singlet), height and primary key are only set for keys of
+	// the rows table, the primary key only for tablet rows
+	Collection *Collection
+	Element    string
+	Height     uint64
+	PrimaryKey []byte
+
+	// The checkpoint table key, only set for keys of the checkpoint table
+	Checkpoint string
+
+	Value string
+}
+
+// DumpKey identifies the collection, tablet or singlet, height and primary key of a key of the
+// storage table, the raw keys as stored in the underlying KV store being split by the storage
+// engine (see `kv.UnpackKey`). The value is optional, when `decodeValue` is true, it's
+// pretty-printed using the decoder registered for its collection (see `RegisterValueDecoder`),
+// otherwise it's hex encoded.
+func DumpKey(table store.Table, tableKey []byte, value []byte, decodeValue bool) (*KeyDump, error) {
+	if !table.IsKnown() {
+		return nil, fmt.Errorf("unknown table %s", table)
+	}
+
+	if len(tableKey) < 1 {
+		return nil, fmt.Errorf("invalid key length, expected at least 1 byte, got %d", len(tableKey))
+	}
+
+	dump := &KeyDump{Table: table.String()}
+
+	var err error
+	switch table {
+	case store.RowsTable:
+		err = dump.dumpRow(tableKey, value, decodeValue)
+	case store.CheckpointsTable:
+		err = dump.dumpCheckpoint(tableKey, value, decodeValue)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dump, nil
+}
+
+func (d *KeyDump) dumpRow(key []byte, value []byte, decodeValue bool) error {
+	if len(key) <= collectionBytes {
+		return fmt.Errorf("invalid row key length, expected more than %d bytes, got %d", collectionBytes, len(key))
+	}
+
+	collectionID := collectionFromKey(key)
+	collection, found := collections[collectionID]
+	if !found {
+		return fmt.Errorf("unknown collection 0x%04X", collectionID)
+	}
+	d.Collection = &collection
+
+	if _, isSinglet := singletFactories[collectionID]; isSinglet {
+		d.Kind = "singlet entry"
+
+		singlet, err := NewSinglet(key)
+		if err != nil {
+			return fmt.Errorf("new singlet: %w", err)
+		}
+
+		// The value is decoded separately, a singlet entry is not always constructible without it
+		singletIdentifierEnd := collectionBytes + len(singlet.Identifier())
+		if len(key) < singletIdentifierEnd+heightBytes {
+			return fmt.Errorf("invalid key length, expected at least %d bytes, got %d", singletIdentifierEnd+heightBytes, len(key))
+		}
+
+		d.Element = singlet.String()
+		d.Height = ^bigEndian.Uint64(key[singletIdentifierEnd:])
+	} else {
+		d.Kind = "tablet row"
+
+		row, err := NewTabletRowFromStorage(key, nil)
+		if err != nil {
+			return fmt.Errorf("new tablet row: %w", err)
+		}
+
+		d.Element = row.Tablet().String()
+		d.Height = row.Height()
+		d.PrimaryKey = row.PrimaryKey()
+	}
+
+	d.Value = dumpValue(value, decodeValue, func() (string, error) {
+		if collectionID == indexSingletCollection {
+			return dumpIndexValue(key, value)
+		}
+
+		return DecodeValue(collectionID, value)
+	})
+
+	return nil
+}
+
+func dumpIndexValue(key []byte, value []byte) (string, error) {
+	entry, err := NewSingletEntryFromStorage(key, value)
+	if err != nil {
+		return "", err
+	}
+
+	index := entry.(indexSingletEntry).index
+	return fmt.Sprintf("index at height %d with %d rows (squelched %d)", index.AtHeight, index.RowCount(), index.SquelchCount), nil
+}
+
+func (d *KeyDump) dumpCheckpoint(key []byte, value []byte, decodeValue bool) error {
+	d.Kind = "checkpoint"
+	d.Checkpoint = string(key)
+
+	d.Value = dumpValue(value, decodeValue, func() (string, error) {
+		switch {
+		case bytes.Equal(key, shardingConfigKey), bytes.Equal(key, chainIdentityKey):
+			return string(value), nil
+
+		case bytes.Equal(key, schemaVersionKey):
+			if len(value) != 4 {
+				return "", fmt.Errorf("invalid schema version value %x, expected 4 bytes", value)
+			}
+
+			return fmt.Sprintf("schema version %d", bigEndian.Uint32(value)), nil
+
+		case strings.HasPrefix(d.Checkpoint, schemaMigrationProgressPrefix):
+			return fmt.Sprintf("migration progress %x", value), nil
+
+		case strings.HasPrefix(d.Checkpoint, "lock-"):
+			holder, epoch, expiresAt, err := unmarshalLease(value)
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("held by %q (epoch %d) until %s", holder, epoch, expiresAt.UTC()), nil
+		}
+
+		height, block, err := unmarshalCheckpoint(value)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("height %d at block %s", height, block), nil
+	})
+
+	return nil
+}
+
+func dumpValue(value []byte, decodeValue bool, decode func() (string, error)) string {
+	if value == nil {
+		return ""
+	}
+
+	if len(value) == 0 {
+		return "<deleted>"
+	}
+
+	if !decodeValue {
+		return hex.EncodeToString(value)
+	}
+
+	decoded, err := decode()
+	if err != nil {
+		return fmt.Sprintf("#Error<Undecodable value %x: %s>", value, err)
+	}
+
+	return decoded
+}
+
+func (d *KeyDump) String() string {
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "table:       %s\n", d.Table)
+	fmt.Fprintf(builder, "kind:        %s\n", d.Kind)
+
+	if d.Collection != nil {
+		fmt.Fprintf(builder, "collection:  %s (0x%04X)\n", d.Collection.Name, d.Collection.Identifier)
+		fmt.Fprintf(builder, "element:     %s\n", d.Element)
+		fmt.Fprintf(builder, "height:      %d (%016x)\n", d.Height, d.Height)
+	}
+
+	if d.PrimaryKey != nil {
+		fmt.Fprintf(builder, "primary key: %s (%q)\n", hex.EncodeToString(d.PrimaryKey), d.PrimaryKey)
+	}
+
+	if d.Checkpoint != "" {
+		fmt.Fprintf(builder, "checkpoint:  %s\n", d.Checkpoint)
+	}
+
+	if d.Value != "" {
+		fmt.Fprintf(builder, "value:       %s\n", d.Value)
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,144 @@
+package fluxdb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	pbfluxdb "github.com/dfuse-io/pbgo/dfuse/fluxdb/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpKey(t *testing.T) {
+	checkpoint, err := proto.Marshal(&pbfluxdb.Checkpoint{Height: 10, Block: &pbbstream.BlockRef{Id: "000000000000000aa", Num: 10}})
+	require.NoError(t, err)
+
+	RegisterValueDecoder(testSingletCollection, func(value []byte) (string, error) {
+		if string(value) == "bad" {
+			return "", fmt.Errorf("bad value")
+		}
+
+		return "decoded " + string(value), nil
+	})
+	defer delete(valueDecoders, testSingletCollection)
+
+	tests := []struct {
+		name          string
+		table         store.Table
+		key           string
+		value         []byte
+		decodeValue   bool
+		expectedDump  *KeyDump
+		expectedError string
+	}{
+		{
+			name:  "tablet row",
+			table: store.RowsTable,
+			key:   "fff2616263000000000000000a676869",
+			expectedDump: &KeyDump{
+				Table: "rows", Kind: "tablet row", Collection: &Collection{testTabletCollection, "tst"},
+				Element: "tst:abc", Height: 10, PrimaryKey: []byte("ghi"),
+			},
+		},
+		{
+			name:  "tablet row, value not decoded",
+			table: store.RowsTable,
+			key:   "fff2616263000000000000000a676869",
+			value: []byte("v1"),
+			expectedDump: &KeyDump{
+				Table: "rows", Kind: "tablet row", Collection: &Collection{testTabletCollection, "tst"},
+				Element: "tst:abc", Height: 10, PrimaryKey: []byte("ghi"), Value: "7631",
+			},
+		},
+		{
+			name:        "tablet row, deletion",
+			table:       store.RowsTable,
+			key:         "fff2616263000000000000000a676869",
+			value:       []byte{},
+			decodeValue: true,
+			expectedDump: &KeyDump{
+				Table: "rows", Kind: "tablet row", Collection: &Collection{testTabletCollection, "tst"},
+				Element: "tst:abc", Height: 10, PrimaryKey: []byte("ghi"), Value: "<deleted>",
+			},
+		},
+		{
+			name:        "singlet entry, registered decoder",
+			table:       store.RowsTable,
+			key:         "fff1616263fffffffffffffff5",
+			value:       []byte("v1"),
+			decodeValue: true,
+			expectedDump: &KeyDump{
+				Table: "rows", Kind: "singlet entry", Collection: &Collection{testSingletCollection, "sts"},
+				Element: "sts:abc", Height: 10, Value: "decoded v1",
+			},
+		},
+		{
+			name:        "singlet entry, decoder error",
+			table:       store.RowsTable,
+			key:         "fff1616263fffffffffffffff5",
+			value:       []byte("bad"),
+			decodeValue: true,
+			expectedDump: &KeyDump{
+				Table: "rows", Kind: "singlet entry", Collection: &Collection{testSingletCollection, "sts"},
+				Element: "sts:abc", Height: 10, Value: "#Error<Undecodable value 626164: bad value>",
+			},
+		},
+		{
+			name:        "checkpoint",
+			table:       store.CheckpointsTable,
+			key:         hex.EncodeToString([]byte("checkpoint")),
+			value:       checkpoint,
+			decodeValue: true,
+			expectedDump: &KeyDump{
+				Table: "checkpoint", Kind: "checkpoint", Checkpoint: "checkpoint", Value: "height 10 at block #10 (000000000000000aa)",
+			},
+		},
+		{
+			name:        "shard lease",
+			table:       store.CheckpointsTable,
+			key:         hex.EncodeToString([]byte("lock-shard-001")),
+			value:       append([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3}, []byte("owner")...),
+			decodeValue: true,
+			expectedDump: &KeyDump{
+				Table: "checkpoint", Kind: "checkpoint", Checkpoint: "lock-shard-001", Value: `held by "owner" (epoch 3) until 1970-01-01 00:00:00 +0000 UTC`,
+			},
+		},
+		{
+			name:        "schema version",
+			table:       store.CheckpointsTable,
+			key:         hex.EncodeToString([]byte("meta-schema-version")),
+			value:       []byte{0, 0, 0, 2},
+			decodeValue: true,
+			expectedDump: &KeyDump{
+				Table: "checkpoint", Kind: "checkpoint", Checkpoint: "meta-schema-version", Value: "schema version 2",
+			},
+		},
+		{name: "unknown table", table: 0x04, key: "fff2", expectedError: "unknown table 0x04"},
+		{name: "unknown collection", table: store.RowsTable, key: "0001616263", expectedError: "unknown collection 0x0001"},
+		{name: "too short", table: store.RowsTable, key: "", expectedError: "invalid key length, expected at least 1 byte, got 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dump, err := DumpKey(test.table, mustHex(t, test.key), test.value, test.decodeValue)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedDump, dump)
+		})
+	}
+}
+
+func mustHex(t *testing.T, in string) []byte {
+	out, err := hex.DecodeString(in)
+	require.NoError(t, err)
+
+	return out
+}
@@ -0,0 +1,271 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// leaseSettleDelay is the delay waited after writing a lease before reading it back to
+// confirm ownership, the store has no compare-and-set semantics so when two replicas acquire
+// the same lease concurrently, the last writer wins and the other one backs off.
+var leaseSettleDelay = 1 * time.Second
+
+// storeLease is a lock on a store wide resource (a shard, the writer, see `newLease`), backed by
+// a key in the checkpoint table of the store, that is held by a single owner until it expires.
+// The owner keeps the lease alive by renewing it periodically (heartbeat), a lease not renewed
+// within its TTL (because its holder died) can be acquired by another owner.
+//
+// Each acquisition bumps the epoch of the lease, used as a fencing token: the store has no
+// compare-and-set semantics, so a renewal racing with an acquisition by another owner can leave
+// both believing they hold the lease, the holder must thus confirm it still holds the lease with
+// its epoch (see `check`) before each write it protects.
+//
+// The lease value is `<expires at (unix nano) 8 bytes><epoch 8 bytes><owner>`.
+type storeLease struct {
+	db       *FluxDB
+	key      []byte
+	owner    string
+	ttl      time.Duration
+	takeover bool
+
+	lock      sync.Mutex
+	epoch     uint64
+	expiresAt time.Time
+	lostErr   error
+}
+
+func newShardLease(db *FluxDB, shardIndex int, owner string, ttl time.Duration, takeover bool) *storeLease {
+	return newLease(db, []byte(fmt.Sprintf("lock-shard-%03d", shardIndex)), owner, ttl, takeover)
+}
+
+// newLease returns a lease on an arbitrary checkpoint table key, which must start with `lock-` so
+// it's handled as a lease by the tools (e.g. not copied by `CopyStore`).
+func newLease(db *FluxDB, key []byte, owner string, ttl time.Duration, takeover bool) *storeLease {
+	return &storeLease{
+		db:       db,
+		key:      key,
+		owner:    owner,
+		ttl:      ttl,
+		takeover: takeover,
+	}
+}
+
+// acquire obtains the lease, failing if it's currently held by another owner and not
+// expired yet, unless takeover was requested in which case the lease is forcefully taken.
+func (l *storeLease) acquire(ctx context.Context) error {
+	holder, epoch, expiresAt, err := l.read(ctx)
+	if err != nil {
+		return fmt.Errorf("read lease: %w", err)
+	}
+
+	if holder != "" && holder != l.owner && time.Now().Before(expiresAt) {
+		if !l.takeover {
+			return fmt.Errorf("lease %q is held by %q until %s, another injector is probably running for this shard", l.key, holder, expiresAt)
+		}
+
+		zlog.Warn("taking over lease held by another owner", zap.ByteString("lease", l.key), zap.String("holder", holder), zap.Time("expires_at", expiresAt))
+	}
+
+	l.lock.Lock()
+	l.epoch = epoch + 1
+	l.lock.Unlock()
+
+	if err := l.write(ctx); err != nil {
+		return fmt.Errorf("write lease: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(leaseSettleDelay):
+	}
+
+	if err := l.check(ctx); err != nil {
+		return fmt.Errorf("lease %q was concurrently acquired: %w", l.key, err)
+	}
+
+	zlog.Info("acquired lease", zap.ByteString("lease", l.key), zap.String("owner", l.owner), zap.Uint64("epoch", epoch+1), zap.Duration("ttl", l.ttl))
+	return nil
+}
+
+// check confirms the lease is still held by this owner, with the epoch it acquired, failing with
+// a `*leaseLostError` otherwise. It's called before each write the lease protects.
+func (l *storeLease) check(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	holder, epoch, _, err := l.read(ctx)
+	if err != nil {
+		return fmt.Errorf("read lease: %w", err)
+	}
+
+	if holder != l.owner || epoch != l.currentEpoch() {
+		return &leaseLostError{lease: string(l.key), holder: holder}
+	}
+
+	return nil
+}
+
+func (l *storeLease) currentEpoch() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.epoch
+}
+
+// keepAlive renews the lease periodically until the context is done, calling `onLost` if the
+// lease is taken over by another owner or if it could not be renewed before expiring.
+func (l *storeLease) keepAlive(ctx context.Context, onLost func(err error)) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := l.renew(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			l.lock.Lock()
+			expired := time.Now().After(l.expiresAt)
+			l.lock.Unlock()
+
+			var lostErr *leaseLostError
+			if errors.As(err, &lostErr) || expired {
+				l.lock.Lock()
+				l.lostErr = err
+				l.lock.Unlock()
+
+				onLost(err)
+				return
+			}
+
+			zlog.Warn("unable to renew lease, will retry", zap.ByteString("lease", l.key), zap.Error(err))
+		}
+	}
+}
+
+func (l *storeLease) renew(ctx context.Context) error {
+	if err := l.check(ctx); err != nil {
+		return err
+	}
+
+	return l.write(ctx)
+}
+
+// release deletes the lease, only if it's still held by this owner.
+func (l *storeLease) release(ctx context.Context) error {
+	var lostErr *leaseLostError
+	if err := l.check(ctx); err != nil {
+		if !errors.As(err, &lostErr) {
+			return err
+		}
+
+		zlog.Info("not releasing lease held by another owner", zap.ByteString("lease", l.key), zap.String("holder", lostErr.holder))
+		return nil
+	}
+
+	if err := l.db.store.DeleteTableKeys(ctx, store.CheckpointsTable, [][]byte{l.key}); err != nil {
+		return fmt.Errorf("delete lease: %w", err)
+	}
+
+	zlog.Info("released lease", zap.ByteString("lease", l.key), zap.String("owner", l.owner))
+	return nil
+}
+
+// expired returns whether the lease expired, or was never acquired, without being renewed.
+func (l *storeLease) expired() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return !time.Now().Before(l.expiresAt)
+}
+
+// err returns the reason why the lease was lost, if it was.
+func (l *storeLease) err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.lostErr
+}
+
+func (l *storeLease) read(ctx context.Context) (holder string, epoch uint64, expiresAt time.Time, err error) {
+	value, err := l.db.store.FetchLastWrittenCheckpoint(ctx, l.key)
+	if errors.Is(err, store.ErrNotFound) {
+		return "", 0, time.Time{}, nil
+	}
+
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+
+	return unmarshalLease(value)
+}
+
+func unmarshalLease(value []byte) (holder string, epoch uint64, expiresAt time.Time, err error) {
+	if len(value) < 16 {
+		return "", 0, time.Time{}, fmt.Errorf("invalid lease value %x, expected at least 16 bytes", value)
+	}
+
+	return string(value[16:]), bigEndian.Uint64(value[8:]), time.Unix(0, int64(bigEndian.Uint64(value))), nil
+}
+
+func (l *storeLease) write(ctx context.Context) error {
+	expiresAt := time.Now().Add(l.ttl)
+
+	value := make([]byte, 16+len(l.owner))
+	bigEndian.PutUint64(value, uint64(expiresAt.UnixNano()))
+	bigEndian.PutUint64(value[8:], l.currentEpoch())
+	copy(value[16:], l.owner)
+
+	batch := l.db.store.NewBatch(zlog)
+	batch.SetLastCheckpoint(l.key, value)
+	if err := batch.Flush(ctx); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	l.expiresAt = expiresAt
+	l.lock.Unlock()
+
+	return nil
+}
+
+type leaseLostError struct {
+	lease  string
+	holder string
+}
+
+func (e *leaseLostError) Error() string {
+	if e.holder == "" {
+		return fmt.Sprintf("lease %q was released by another owner", e.lease)
+	}
+
+	return fmt.Sprintf("lease %q was taken over by %q", e.lease, e.holder)
+}
@@ -0,0 +1,143 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreLease(t *testing.T) {
+	defer func(previous time.Duration) { leaseSettleDelay = previous }(leaseSettleDelay)
+	leaseSettleDelay = 0
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	first := newShardLease(db, 1, "first", time.Minute, false)
+	require.NoError(t, first.acquire(ctx))
+	require.NoError(t, first.acquire(ctx), "re-acquiring an owned lease should work")
+
+	second := newShardLease(db, 1, "second", time.Minute, false)
+	assert.Error(t, second.acquire(ctx), "lease held by another owner")
+
+	other := newShardLease(db, 2, "second", time.Minute, false)
+	require.NoError(t, other.acquire(ctx), "lease of another shard should be independent")
+
+	takeover := newShardLease(db, 1, "second", time.Minute, true)
+	require.NoError(t, takeover.acquire(ctx))
+
+	var lostErr *leaseLostError
+	assert.True(t, errors.As(first.renew(ctx), &lostErr), "first owner should have lost its lease")
+	require.NoError(t, first.release(ctx))
+
+	holder, _, _, err := takeover.read(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "second", holder, "release by a previous owner should not delete the lease")
+
+	db.shardCount = 2
+	_, err = db.fetchAllShardProgressStats(ctx)
+	require.NoError(t, err, "leases should not be confused with shard checkpoints")
+
+	require.NoError(t, takeover.release(ctx))
+	holder, _, _, err = takeover.read(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "", holder)
+}
+
+func TestStoreLease_Expired(t *testing.T) {
+	defer func(previous time.Duration) { leaseSettleDelay = previous }(leaseSettleDelay)
+	leaseSettleDelay = 0
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	require.NoError(t, newShardLease(db, 0, "dead", time.Millisecond, false).acquire(ctx))
+	time.Sleep(5 * time.Millisecond)
+
+	require.NoError(t, newShardLease(db, 0, "alive", time.Minute, false).acquire(ctx), "expired lease should be acquirable")
+}
+
+func TestStoreLease_KeepAliveLost(t *testing.T) {
+	defer func(previous time.Duration) { leaseSettleDelay = previous }(leaseSettleDelay)
+	leaseSettleDelay = 0
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	lease := newShardLease(db, 0, "first", 30*time.Millisecond, false)
+	require.NoError(t, lease.acquire(ctx))
+
+	lost := make(chan error, 1)
+	go lease.keepAlive(ctx, func(err error) { lost <- err })
+
+	require.NoError(t, newShardLease(db, 0, "second", time.Minute, true).acquire(ctx))
+
+	select {
+	case err := <-lost:
+		assert.Error(t, err)
+		assert.Equal(t, err, lease.err())
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease should have been lost")
+	}
+}
+
+func TestStoreLease_Fencing(t *testing.T) {
+	defer func(previous time.Duration) { leaseSettleDelay = previous }(leaseSettleDelay)
+	leaseSettleDelay = 0
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	first := newShardLease(db, 0, "first", time.Minute, false)
+	require.NoError(t, first.acquire(ctx))
+	require.NoError(t, first.check(ctx))
+
+	// The same owner acquiring the lease again from another process bumps its epoch, fencing
+	// off the previous acquisition even though the owner is the same
+	restarted := newShardLease(db, 0, "first", time.Minute, false)
+	require.NoError(t, restarted.acquire(ctx))
+
+	var lostErr *leaseLostError
+	assert.True(t, errors.As(first.check(ctx), &lostErr), "previous acquisition should be fenced off")
+	assert.True(t, errors.As(first.renew(ctx), &lostErr), "previous acquisition should not be renewed")
+	require.NoError(t, restarted.check(ctx))
+
+	// Releasing a fenced off acquisition leaves the lease in place
+	require.NoError(t, first.release(ctx))
+	require.NoError(t, restarted.check(ctx))
+
+	var nilLease *storeLease
+	assert.NoError(t, nilLease.check(ctx))
+}
+
+func TestStoreLease_ReleaseExactKey(t *testing.T) {
+	defer func(previous time.Duration) { leaseSettleDelay = previous }(leaseSettleDelay)
+	leaseSettleDelay = 0
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	short := newLease(db, []byte("lock-a"), "owner", time.Minute, false)
+	long := newLease(db, []byte("lock-ab"), "owner", time.Minute, false)
+	require.NoError(t, short.acquire(ctx))
+	require.NoError(t, long.acquire(ctx))
+
+	require.NoError(t, short.release(ctx))
+
+	holder, _, _, err := short.read(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "", holder)
+
+	holder, _, _, err = long.read(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "owner", holder, "a lease prefixed by a released one should be left in place")
+}
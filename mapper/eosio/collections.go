@@ -0,0 +1,202 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eosio
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb"
+)
+
+// Collections registered by this package, importing it reserves those identifiers
+const (
+	ContractStateCollection uint16 = 0xE000
+	PermissionCollection    uint16 = 0xE001
+)
+
+const (
+	contractStateCollectionName = "cst"
+	permissionCollectionName    = "perm"
+)
+
+var bigEndian = binary.BigEndian
+
+func init() {
+	fluxdb.RegisterTabletFactory(ContractStateCollection, contractStateCollectionName, func(identifier []byte) (fluxdb.Tablet, error) {
+		if len(identifier) < 24 {
+			return nil, fmt.Errorf("contract state tablet identifier: expected at least 24 bytes, got %d", len(identifier))
+		}
+
+		return ContractStateTablet{
+			Contract: bigEndian.Uint64(identifier),
+			Scope:    bigEndian.Uint64(identifier[8:]),
+			Table:    bigEndian.Uint64(identifier[16:]),
+		}, nil
+	})
+
+	fluxdb.RegisterSingletFactory(PermissionCollection, permissionCollectionName, func(identifier []byte) (fluxdb.Singlet, error) {
+		if len(identifier) < 16 {
+			return nil, fmt.Errorf("permission singlet identifier: expected at least 16 bytes, got %d", len(identifier))
+		}
+
+		return PermissionSinglet{
+			Account:    bigEndian.Uint64(identifier),
+			Permission: bigEndian.Uint64(identifier[8:]),
+		}, nil
+	})
+}
+
+// ContractStateTablet holds the rows of a contract table within a scope, the rows primary key
+// being the row primary key of the contract table (8 bytes).
+type ContractStateTablet struct {
+	Contract uint64
+	Scope    uint64
+	Table    uint64
+}
+
+// NewContractStateTablet returns the tablet of the contract table within the scope, all being
+// EOSIO names.
+func NewContractStateTablet(contract, scope, table string) (ContractStateTablet, error) {
+	names, err := stringsToNames(contract, scope, table)
+	if err != nil {
+		return ContractStateTablet{}, err
+	}
+
+	return ContractStateTablet{Contract: names[0], Scope: names[1], Table: names[2]}, nil
+}
+
+func (t ContractStateTablet) Collection() uint16 {
+	return ContractStateCollection
+}
+
+func (t ContractStateTablet) Identifier() []byte {
+	out := make([]byte, 24)
+	bigEndian.PutUint64(out, t.Contract)
+	bigEndian.PutUint64(out[8:], t.Scope)
+	bigEndian.PutUint64(out[16:], t.Table)
+
+	return out
+}
+
+func (t ContractStateTablet) Row(height uint64, primaryKey []byte, value []byte) (fluxdb.TabletRow, error) {
+	if len(primaryKey) != 8 {
+		return nil, fmt.Errorf("contract state row primary key: expected 8 bytes, got %d", len(primaryKey))
+	}
+
+	if len(value) != 0 && len(value) < 8 {
+		return nil, fmt.Errorf("contract state row value: expected at least 8 bytes (the payer), got %d", len(value))
+	}
+
+	return ContractStateRow{fluxdb.NewBaseTabletRow(t, height, primaryKey, value)}, nil
+}
+
+func (t ContractStateTablet) String() string {
+	return contractStateCollectionName + ":" + NameToString(t.Contract) + ":" + NameToString(t.Scope) + ":" + NameToString(t.Table)
+}
+
+// ContractStateRow is a row of a contract table, its value is the payer of the row (8 bytes)
+// followed by the row data, as serialized by the contract.
+type ContractStateRow struct {
+	fluxdb.BaseTabletRow
+}
+
+// NewContractStateRow returns the row of the tablet at `height`, a deletion when `data` is `nil`.
+func NewContractStateRow(tablet ContractStateTablet, height uint64, primaryKey uint64, payer uint64, data []byte) ContractStateRow {
+	key := make([]byte, 8)
+	bigEndian.PutUint64(key, primaryKey)
+
+	var value []byte
+	if data != nil {
+		value = make([]byte, 8+len(data))
+		bigEndian.PutUint64(value, payer)
+		copy(value[8:], data)
+	}
+
+	return ContractStateRow{fluxdb.NewBaseTabletRow(tablet, height, key, value)}
+}
+
+// Payer returns the account paying the RAM of the row, 0 for a deletion.
+func (r ContractStateRow) Payer() uint64 {
+	if r.IsDeletion() {
+		return 0
+	}
+
+	return bigEndian.Uint64(r.Value())
+}
+
+// Data returns the row data as serialized by the contract, `nil` for a deletion.
+func (r ContractStateRow) Data() []byte {
+	if r.IsDeletion() {
+		return nil
+	}
+
+	return r.Value()[8:]
+}
+
+func (r ContractStateRow) String() string {
+	return r.Stringify(NameToString(bigEndian.Uint64(r.PrimaryKey())))
+}
+
+// PermissionSinglet holds a permission of an account, its entries value being the permission
+// as serialized by the chain.
+type PermissionSinglet struct {
+	Account    uint64
+	Permission uint64
+}
+
+// NewPermissionSinglet returns the singlet of the account permission, both being EOSIO names.
+func NewPermissionSinglet(account, permission string) (PermissionSinglet, error) {
+	names, err := stringsToNames(account, permission)
+	if err != nil {
+		return PermissionSinglet{}, err
+	}
+
+	return PermissionSinglet{Account: names[0], Permission: names[1]}, nil
+}
+
+func (s PermissionSinglet) Collection() uint16 {
+	return PermissionCollection
+}
+
+func (s PermissionSinglet) Identifier() []byte {
+	out := make([]byte, 16)
+	bigEndian.PutUint64(out, s.Account)
+	bigEndian.PutUint64(out[8:], s.Permission)
+
+	return out
+}
+
+func (s PermissionSinglet) Entry(height uint64, value []byte) (fluxdb.SingletEntry, error) {
+	return fluxdb.NewBaseSingletEntry(s, height, value), nil
+}
+
+func (s PermissionSinglet) String() string {
+	return permissionCollectionName + ":" + NameToString(s.Account) + ":" + NameToString(s.Permission)
+}
+
+func stringsToNames(names ...string) ([]uint64, error) {
+	out := make([]uint64, len(names))
+	for i, name := range names {
+		value, err := StringToName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		out[i] = value
+	}
+
+	return out, nil
+}
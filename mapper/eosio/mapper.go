@@ -0,0 +1,165 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eosio
+
+import (
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+)
+
+type Operation int
+
+const (
+	OperationInsert Operation = iota
+	OperationUpdate
+	OperationRemove
+)
+
+func (o Operation) String() string {
+	switch o {
+	case OperationInsert:
+		return "insert"
+	case OperationUpdate:
+		return "update"
+	case OperationRemove:
+		return "remove"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(o))
+	}
+}
+
+// DBOp is a change to a row of a contract table, as found in the execution traces of a block.
+// `NewData` and `Payer` are ignored for `OperationRemove`.
+type DBOp struct {
+	Operation  Operation
+	Code       string
+	Scope      string
+	Table      string
+	PrimaryKey string
+	Payer      string
+	NewData    []byte
+}
+
+// PermOp is a change to a permission of an account, as found in the execution traces of a
+// block. `NewData` is ignored for `OperationRemove`.
+type PermOp struct {
+	Operation  Operation
+	Account    string
+	Permission string
+	NewData    []byte
+}
+
+// BlockChanges are the state changes of a block, in execution order.
+type BlockChanges struct {
+	DBOps   []*DBOp
+	PermOps []*PermOp
+}
+
+// BlockDecoder extracts the state changes of an EOSIO block, keeping this package free of the
+// chain specific block model (e.g. `pbcodec.Block` of `dfuse-eosio`).
+type BlockDecoder func(blk *bstream.Block) (*BlockChanges, error)
+
+// BlockMapper is a reference `fluxdb.BlockMapper` turning the contract table rows changes of a
+// block into `ContractStateCollection` tablet rows and the account permission changes into
+// `PermissionCollection` singlet entries. When a row or a permission is changed more than once
+// in a block, only its final state is written.
+type BlockMapper struct {
+	decoder BlockDecoder
+}
+
+func NewBlockMapper(decoder BlockDecoder) *BlockMapper {
+	return &BlockMapper{decoder: decoder}
+}
+
+func (m *BlockMapper) Map(rawBlk *bstream.Block) (*fluxdb.WriteRequest, error) {
+	changes, err := m.decoder(rawBlk)
+	if err != nil {
+		return nil, fmt.Errorf("decode block %s: %w", rawBlk, err)
+	}
+
+	builder := fluxdb.NewWriteRequestFor(rawBlk).KeepLastMutations()
+	if changes == nil {
+		return builder.Build()
+	}
+
+	height := builder.Height()
+	for _, op := range changes.DBOps {
+		row, err := contractStateRow(height, op)
+		if err != nil {
+			return nil, fmt.Errorf("db op %s %s:%s:%s:%s: %w", op.Operation, op.Code, op.Scope, op.Table, op.PrimaryKey, err)
+		}
+
+		builder.AppendRow(row)
+	}
+
+	for _, op := range changes.PermOps {
+		entry, err := permissionEntry(height, op)
+		if err != nil {
+			return nil, fmt.Errorf("perm op %s %s@%s: %w", op.Operation, op.Account, op.Permission, err)
+		}
+
+		builder.AppendEntry(entry)
+	}
+
+	return builder.Build()
+}
+
+func contractStateRow(height uint64, op *DBOp) (fluxdb.TabletRow, error) {
+	tablet, err := NewContractStateTablet(op.Code, op.Scope, op.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryKey, err := StringToName(op.PrimaryKey)
+	if err != nil {
+		return nil, fmt.Errorf("primary key: %w", err)
+	}
+
+	if op.Operation == OperationRemove {
+		return NewContractStateRow(tablet, height, primaryKey, 0, nil), nil
+	}
+
+	payer, err := StringToName(op.Payer)
+	if err != nil {
+		return nil, fmt.Errorf("payer: %w", err)
+	}
+
+	data := op.NewData
+	if data == nil {
+		// A `nil` data would turn the row into a deletion
+		data = []byte{}
+	}
+
+	return NewContractStateRow(tablet, height, primaryKey, payer, data), nil
+}
+
+func permissionEntry(height uint64, op *PermOp) (fluxdb.SingletEntry, error) {
+	singlet, err := NewPermissionSinglet(op.Account, op.Permission)
+	if err != nil {
+		return nil, err
+	}
+
+	if op.Operation == OperationRemove {
+		return singlet.Entry(height, nil)
+	}
+
+	if len(op.NewData) == 0 {
+		return nil, fmt.Errorf("permission data is required")
+	}
+
+	return singlet.Entry(height, op.NewData)
+}
@@ -0,0 +1,76 @@
+package eosio
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockMapper_Map(t *testing.T) {
+	blockTime := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	blk := &bstream.Block{Id: "00000005aa", Number: 5, Timestamp: blockTime}
+
+	mapper := NewBlockMapper(func(blk *bstream.Block) (*BlockChanges, error) {
+		return &BlockChanges{
+			DBOps: []*DBOp{
+				{Operation: OperationInsert, Code: "eosio.token", Scope: "alice", Table: "accounts", PrimaryKey: "eos", Payer: "alice", NewData: []byte{0x01}},
+				{Operation: OperationRemove, Code: "eosio.token", Scope: "bob", Table: "accounts", PrimaryKey: "eos"},
+				{Operation: OperationUpdate, Code: "eosio.token", Scope: "alice", Table: "accounts", PrimaryKey: "eos", Payer: "alice", NewData: []byte{0x02}},
+			},
+			PermOps: []*PermOp{
+				{Operation: OperationInsert, Account: "alice", Permission: "active", NewData: []byte{0x03}},
+				{Operation: OperationRemove, Account: "alice", Permission: "custom"},
+			},
+		}, nil
+	})
+
+	req, err := mapper.Map(blk)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(5), req.Height)
+	assert.Equal(t, blk.AsRef(), req.BlockRef)
+	assert.Equal(t, blockTime, req.BlockTime)
+
+	require.Len(t, req.TabletRows, 2, "last change of a row in a block wins")
+
+	row := req.TabletRows[0].(ContractStateRow)
+	assert.Equal(t, "cst:eosio.token:alice:accounts", row.Tablet().(ContractStateTablet).String())
+	assert.Equal(t, "alice", NameToString(row.Payer()))
+	assert.Equal(t, []byte{0x02}, row.Data())
+
+	assert.True(t, req.TabletRows[1].IsDeletion())
+	assert.Equal(t, "cst:eosio.token:bob:accounts", req.TabletRows[1].Tablet().(ContractStateTablet).String())
+
+	require.Len(t, req.SingletEntries, 2)
+	assert.Equal(t, "perm:alice:active", req.SingletEntries[0].Singlet().(PermissionSinglet).String())
+	assert.False(t, req.SingletEntries[0].IsDeletion())
+	assert.True(t, req.SingletEntries[1].IsDeletion())
+
+	// Rows round-trip through their storage form
+	value, err := row.MarshalValue()
+	require.NoError(t, err)
+
+	stored, err := fluxdb.NewTabletRowFromStorage(fluxdb.KeyForTabletRow(row), value)
+	require.NoError(t, err)
+	assert.Equal(t, row, stored)
+}
+
+func TestBlockMapper_Map_Errors(t *testing.T) {
+	blk := &bstream.Block{Id: "00000005aa", Number: 5}
+
+	_, err := NewBlockMapper(func(blk *bstream.Block) (*BlockChanges, error) {
+		return nil, errors.New("boom")
+	}).Map(blk)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "boom")
+
+	_, err = NewBlockMapper(func(blk *bstream.Block) (*BlockChanges, error) {
+		return &BlockChanges{DBOps: []*DBOp{{Operation: OperationInsert, Code: "INVALID", Scope: "a", Table: "t", PrimaryKey: "k", Payer: "a"}}}, nil
+	}).Map(blk)
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eosio
+
+import (
+	"fmt"
+	"strings"
+)
+
+const nameCharmap = ".12345abcdefghijklmnopqrstuvwxyz"
+
+// StringToName encodes an EOSIO name (e.g. `eosio.token`) into its 64-bit form, as used in the
+// tablet and singlet identifiers and row primary keys of this package.
+func StringToName(name string) (uint64, error) {
+	if len(name) > 13 {
+		return 0, fmt.Errorf("invalid name %q: longer than 13 characters", name)
+	}
+
+	var value uint64
+	for i := 0; i < len(name); i++ {
+		index := strings.IndexByte(nameCharmap, name[i])
+		if index < 0 {
+			return 0, fmt.Errorf("invalid name %q: character %q is not allowed", name, name[i])
+		}
+
+		symbol := uint64(index)
+
+		if i < 12 {
+			value |= symbol << (64 - 5*(i+1))
+		} else {
+			// The 13th character only has 4 bits available
+			if symbol > 0x0F {
+				return 0, fmt.Errorf("invalid name %q: 13th character %q must be one of %q", name, name[i], nameCharmap[0:16])
+			}
+
+			value |= symbol
+		}
+	}
+
+	return value, nil
+}
+
+// NameToString decodes the 64-bit form of an EOSIO name, see `StringToName`.
+func NameToString(value uint64) string {
+	out := make([]byte, 13)
+
+	out[12] = nameCharmap[value&0x0F]
+	value >>= 4
+	for i := 11; i >= 0; i-- {
+		out[i] = nameCharmap[value&0x1F]
+		value >>= 5
+	}
+
+	return strings.TrimRight(string(out), ".")
+}
@@ -0,0 +1,38 @@
+package eosio
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringToName(t *testing.T) {
+	tests := []struct {
+		name          string
+		expected      uint64
+		expectedError bool
+	}{
+		{"", 0, false},
+		{"eosio", 6138663577826885632, false},
+		{"eosio.token", 6138663591592764928, false},
+		{"zzzzzzzzzzzzj", 0xFFFFFFFFFFFFFFFF, false},
+		{"zzzzzzzzzzzzk", 0, true},
+		{"EOSIO", 0, true},
+		{"eosio.token.a.", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := StringToName(test.name)
+			if test.expectedError {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, value)
+			assert.Equal(t, test.name, NameToString(value))
+		})
+	}
+}
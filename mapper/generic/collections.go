@@ -0,0 +1,189 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generic
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dfuse-io/fluxdb"
+)
+
+// JSONPayloadCodec is the name of the payload codec registered for the collections of the
+// generic mapper, their values being already JSON.
+const JSONPayloadCodec = "json"
+
+// RegisterCollections registers the tablet and singlet factories of the collections of the
+// configuration, as well as their value decoder and `JSONPayloadCodec` payload codec. Like
+// `fluxdb.RegisterTabletFactory`, it panics if a collection identifier is already registered.
+func RegisterCollections(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	for _, collection := range config.Collections {
+		collection := collection
+
+		switch collection.Kind {
+		case TabletCollectionKind:
+			fluxdb.RegisterTabletFactory(collection.Identifier, collection.Name, func(identifier []byte) (fluxdb.Tablet, error) {
+				parts, _, err := decodeParts(identifier, collection.IdentifierParts)
+				if err != nil {
+					return nil, fmt.Errorf("%s tablet identifier: %w", collection.Name, err)
+				}
+
+				return Tablet{collection: collection, parts: parts}, nil
+			})
+		case SingletCollectionKind:
+			fluxdb.RegisterSingletFactory(collection.Identifier, collection.Name, func(identifier []byte) (fluxdb.Singlet, error) {
+				parts, _, err := decodeParts(identifier, collection.IdentifierParts)
+				if err != nil {
+					return nil, fmt.Errorf("%s singlet identifier: %w", collection.Name, err)
+				}
+
+				return Singlet{collection: collection, parts: parts}, nil
+			})
+		}
+
+		fluxdb.RegisterValueDecoder(collection.Identifier, func(value []byte) (string, error) {
+			return string(value), nil
+		})
+
+		fluxdb.RegisterPayloadCodec(collection.Identifier, JSONPayloadCodec, func(value []byte) (json.RawMessage, error) {
+			if !json.Valid(value) {
+				return nil, fmt.Errorf("value is not valid JSON")
+			}
+
+			return json.RawMessage(value), nil
+		})
+	}
+
+	return nil
+}
+
+// Tablet is a tablet of a tablet collection of the generic mapper, identified by the strings
+// extracted from the events (see `Rule.Identifier`), its rows primary key being made of the
+// strings extracted by `Rule.PrimaryKey` and its rows value being JSON.
+type Tablet struct {
+	collection *CollectionConfig
+	parts      []string
+}
+
+// Parts returns the identifier parts of the tablet, in the order of `Rule.Identifier`.
+func (t Tablet) Parts() []string {
+	return t.parts
+}
+
+func (t Tablet) Collection() uint16 {
+	return t.collection.Identifier
+}
+
+func (t Tablet) Identifier() []byte {
+	return encodeParts(t.parts)
+}
+
+func (t Tablet) Row(height uint64, primaryKey []byte, value []byte) (fluxdb.TabletRow, error) {
+	if _, _, err := decodeParts(primaryKey, -1); err != nil {
+		return nil, fmt.Errorf("%s row primary key: %w", t.collection.Name, err)
+	}
+
+	return TabletRow{fluxdb.NewBaseTabletRow(t, height, primaryKey, value)}, nil
+}
+
+func (t Tablet) String() string {
+	return t.collection.Name + ":" + strings.Join(t.parts, ":")
+}
+
+type TabletRow struct {
+	fluxdb.BaseTabletRow
+}
+
+// PrimaryKeyParts returns the primary key parts of the row, in the order of `Rule.PrimaryKey`.
+func (r TabletRow) PrimaryKeyParts() []string {
+	parts, _, _ := decodeParts(r.PrimaryKey(), -1)
+	return parts
+}
+
+func (r TabletRow) String() string {
+	return r.Stringify(strings.Join(r.PrimaryKeyParts(), ":"))
+}
+
+// Singlet is a singlet of a singlet collection of the generic mapper, identified by the strings
+// extracted from the events (see `Rule.Identifier`), its entries value being JSON.
+type Singlet struct {
+	collection *CollectionConfig
+	parts      []string
+}
+
+// Parts returns the identifier parts of the singlet, in the order of `Rule.Identifier`.
+func (s Singlet) Parts() []string {
+	return s.parts
+}
+
+func (s Singlet) Collection() uint16 {
+	return s.collection.Identifier
+}
+
+func (s Singlet) Identifier() []byte {
+	return encodeParts(s.parts)
+}
+
+func (s Singlet) Entry(height uint64, value []byte) (fluxdb.SingletEntry, error) {
+	return fluxdb.NewBaseSingletEntry(s, height, value), nil
+}
+
+func (s Singlet) String() string {
+	return s.collection.Name + ":" + strings.Join(s.parts, ":")
+}
+
+// maxPartLength is the maximal length of an identifier or primary key part, each part being
+// prefixed by its length on a single byte.
+const maxPartLength = 255
+
+func encodeParts(parts []string) []byte {
+	length := 0
+	for _, part := range parts {
+		length += 1 + len(part)
+	}
+
+	out := make([]byte, 0, length)
+	for _, part := range parts {
+		out = append(out, byte(len(part)))
+		out = append(out, part...)
+	}
+
+	return out
+}
+
+// decodeParts decodes `count` parts out of `in`, or all of them when `count` is negative, and
+// returns them along with the amount of bytes read.
+func decodeParts(in []byte, count int) (parts []string, read int, err error) {
+	for count < 0 && read < len(in) || len(parts) < count {
+		if read >= len(in) {
+			return nil, 0, fmt.Errorf("expected %d parts, got %d", count, len(parts))
+		}
+
+		length := int(in[read])
+		if read+1+length > len(in) {
+			return nil, 0, fmt.Errorf("part #%d: expected %d bytes, got %d", len(parts), length, len(in)-read-1)
+		}
+
+		parts = append(parts, string(in[read+1:read+1+length]))
+		read += 1 + length
+	}
+
+	return parts, read, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+type CollectionKind string
+
+const (
+	TabletCollectionKind  CollectionKind = "tablet"
+	SingletCollectionKind CollectionKind = "singlet"
+)
+
+// Config is the configuration of the generic mapper, the collections it writes to along with
+// the extraction rules turning the events of a block into tablet rows and singlet entries of
+// those collections. Its JSON form looks like:
+//
+// ```
+// {"collections": [{"identifier": 1, "name": "bal", "kind": "tablet", "identifier_parts": 1}],
+// "rules": [{"collection": "bal", "events": "transactions.*.events.*", "match": {"type": "transfer"},
+// "identifier": ["data.token"], "primary_key": ["data.to"], "value": "data.balance"}]}
+// ```
+type Config struct {
+	Collections []*CollectionConfig `json:"collections"`
+	Rules       []*Rule             `json:"rules"`
+}
+
+// CollectionConfig describes a collection written by the generic mapper, its tablets or
+// singlets are identified by `IdentifierParts` strings extracted from the events.
+type CollectionConfig struct {
+	Identifier      uint16         `json:"identifier"`
+	Name            string         `json:"name"`
+	Kind            CollectionKind `json:"kind"`
+	IdentifierParts int            `json:"identifier_parts"`
+}
+
+// Rule extracts a tablet row or a singlet entry out of each event of a block matching it.
+//
+// All paths are `.` separated field names (or array indices) into the block payload JSON
+// document, `*` expanding to all the elements of an array (or values of an object). The `Events`
+// path (the whole document when empty) is the only one accepting `*`, the other paths are
+// relative to each event and must resolve to a single node, scalar for the `Match`, `Identifier`
+// and `PrimaryKey` ones.
+type Rule struct {
+	// Collection is the name of the collection written to, as declared in `Config.Collections`
+	Collection string `json:"collection"`
+
+	Events string `json:"events"`
+
+	// Match restricts the rule to the events whose field at each path is equal to the value
+	Match map[string]string `json:"match,omitempty"`
+
+	Identifier []string `json:"identifier"`
+
+	// PrimaryKey is required for tablet collections and forbidden for singlet ones
+	PrimaryKey []string `json:"primary_key,omitempty"`
+
+	// Value is the path of the node stored, in its JSON form, as the row or entry value, the
+	// whole event when empty
+	Value string `json:"value,omitempty"`
+
+	// Delete turns the extracted rows or entries into deletions, `Value` is then ignored
+	Delete bool `json:"delete,omitempty"`
+}
+
+// LoadConfig reads the generic mapper configuration, in its JSON form, from `filename`.
+func LoadConfig(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("unmarshal config: %w", err)
+	}
+
+	return config, nil
+}
+
+// Validate returns an error if the configuration is inconsistent, e.g. a rule referencing an
+// undeclared collection or extracting the wrong amount of identifier parts.
+func (c *Config) Validate() error {
+	_, err := c.compile()
+	return err
+}
+
+func (c *Config) collection(name string) *CollectionConfig {
+	for _, collection := range c.Collections {
+		if collection.Name == name {
+			return collection
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) compile() ([]*rule, error) {
+	identifiers := map[uint16]bool{}
+	names := map[string]bool{}
+	for _, collection := range c.Collections {
+		if collection.Name == "" {
+			return nil, fmt.Errorf("collection 0x%04X: name is required", collection.Identifier)
+		}
+
+		if identifiers[collection.Identifier] || names[collection.Name] {
+			return nil, fmt.Errorf("collection %s (0x%04X): declared more than once", collection.Name, collection.Identifier)
+		}
+
+		if collection.Kind != TabletCollectionKind && collection.Kind != SingletCollectionKind {
+			return nil, fmt.Errorf("collection %s: invalid kind %q, expected %q or %q", collection.Name, collection.Kind, TabletCollectionKind, SingletCollectionKind)
+		}
+
+		if collection.IdentifierParts < 1 {
+			return nil, fmt.Errorf("collection %s: expected at least 1 identifier part, got %d", collection.Name, collection.IdentifierParts)
+		}
+
+		identifiers[collection.Identifier] = true
+		names[collection.Name] = true
+	}
+
+	rules := make([]*rule, len(c.Rules))
+	for i, config := range c.Rules {
+		compiled, err := compileRule(c, config)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", i, err)
+		}
+
+		rules[i] = compiled
+	}
+
+	return rules, nil
+}
+
+type rule struct {
+	collection *CollectionConfig
+	events     path
+	match      map[string]path
+	identifier []path
+	primaryKey []path
+	value      path
+	delete     bool
+
+	// The expected value of each `match` path
+	matchValues map[string]string
+}
+
+func compileRule(config *Config, in *Rule) (*rule, error) {
+	collection := config.collection(in.Collection)
+	if collection == nil {
+		return nil, fmt.Errorf("unknown collection %q", in.Collection)
+	}
+
+	if len(in.Identifier) != collection.IdentifierParts {
+		return nil, fmt.Errorf("collection %s expects %d identifier parts, got %d", collection.Name, collection.IdentifierParts, len(in.Identifier))
+	}
+
+	switch collection.Kind {
+	case TabletCollectionKind:
+		if len(in.PrimaryKey) == 0 {
+			return nil, fmt.Errorf("tablet collection %s requires a primary key", collection.Name)
+		}
+	case SingletCollectionKind:
+		if len(in.PrimaryKey) != 0 {
+			return nil, fmt.Errorf("singlet collection %s does not accept a primary key", collection.Name)
+		}
+	}
+
+	out := &rule{
+		collection:  collection,
+		events:      parsePath(in.Events),
+		match:       map[string]path{},
+		matchValues: in.Match,
+		delete:      in.Delete,
+	}
+
+	var err error
+	for field := range in.Match {
+		if out.match[field], err = parseFieldPath(field); err != nil {
+			return nil, fmt.Errorf("match: %w", err)
+		}
+	}
+
+	if out.identifier, err = parseFieldPaths(in.Identifier); err != nil {
+		return nil, fmt.Errorf("identifier: %w", err)
+	}
+
+	if out.primaryKey, err = parseFieldPaths(in.PrimaryKey); err != nil {
+		return nil, fmt.Errorf("primary key: %w", err)
+	}
+
+	if out.value, err = parseFieldPath(in.Value); err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+
+	return out, nil
+}
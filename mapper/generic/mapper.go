@@ -0,0 +1,174 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// PayloadDecoder returns the JSON document of the payload of a block, the extraction rules are
+// applied to it.
+type PayloadDecoder func(blk *bstream.Block) ([]byte, error)
+
+// ProtoPayloadDecoder returns a `PayloadDecoder` turning the protobuf message returned by
+// `decoder` (e.g. the chain specific block model) into JSON, using the field names of the
+// `.proto` definition.
+func ProtoPayloadDecoder(decoder func(blk *bstream.Block) (proto.Message, error)) PayloadDecoder {
+	return func(blk *bstream.Block) ([]byte, error) {
+		message, err := decoder(blk)
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(message)
+		if err != nil {
+			return nil, fmt.Errorf("marshal %T: %w", message, err)
+		}
+
+		return []byte(out), nil
+	}
+}
+
+// BlockMapper is a reference `fluxdb.BlockMapper` turning the events of the blocks into tablet
+// rows and singlet entries according to configurable extraction rules (see `Config`), for
+// prototyping new chain integrations without writing a custom mapper first. The collections of
+// the configuration must be registered, see `RegisterCollections`.
+//
+// The rules are applied in order to the block payload, and the events of each rule in document
+// order, when a row or an entry is extracted more than once from a block, only the last one is
+// written.
+type BlockMapper struct {
+	rules   []*rule
+	decoder PayloadDecoder
+}
+
+func NewBlockMapper(config *Config, decoder PayloadDecoder) (*BlockMapper, error) {
+	rules, err := config.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &BlockMapper{rules: rules, decoder: decoder}, nil
+}
+
+func (m *BlockMapper) Map(rawBlk *bstream.Block) (*fluxdb.WriteRequest, error) {
+	payload, err := m.decoder(rawBlk)
+	if err != nil {
+		return nil, fmt.Errorf("decode block %s payload: %w", rawBlk, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("unmarshal block %s payload: %w", rawBlk, err)
+	}
+
+	builder := fluxdb.NewWriteRequestFor(rawBlk).KeepLastMutations()
+	for i, rule := range m.rules {
+		for j, event := range rule.events.collect(document, nil) {
+			if !rule.matches(event) {
+				continue
+			}
+
+			if err := rule.extract(builder, event); err != nil {
+				return nil, fmt.Errorf("rule #%d: event #%d: %w", i, j, err)
+			}
+		}
+	}
+
+	return builder.Build()
+}
+
+func (r *rule) matches(event interface{}) bool {
+	for field, fieldPath := range r.match {
+		value, err := fieldPath.lookupScalar(event)
+		if err != nil || value != r.matchValues[field] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *rule) extract(builder *fluxdb.WriteRequestBuilder, event interface{}) error {
+	height := builder.Height()
+
+	identifier, err := lookupParts(event, r.identifier)
+	if err != nil {
+		return fmt.Errorf("identifier: %w", err)
+	}
+
+	var value []byte
+	if !r.delete {
+		node, found := r.value.lookup(event)
+		if !found {
+			return fmt.Errorf("value: field %q not found", r.value)
+		}
+
+		if value, err = json.Marshal(node); err != nil {
+			return fmt.Errorf("value: %w", err)
+		}
+	}
+
+	if r.collection.Kind == SingletCollectionKind {
+		entry, err := Singlet{collection: r.collection, parts: identifier}.Entry(height, value)
+		if err != nil {
+			return err
+		}
+
+		builder.AppendEntry(entry)
+		return nil
+	}
+
+	primaryKey, err := lookupParts(event, r.primaryKey)
+	if err != nil {
+		return fmt.Errorf("primary key: %w", err)
+	}
+
+	row, err := Tablet{collection: r.collection, parts: identifier}.Row(height, encodeParts(primaryKey), value)
+	if err != nil {
+		return err
+	}
+
+	builder.AppendRow(row)
+	return nil
+}
+
+func lookupParts(event interface{}, paths []path) ([]string, error) {
+	parts := make([]string, len(paths))
+	for i, fieldPath := range paths {
+		part, err := fieldPath.lookupScalar(event)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(part) > maxPartLength {
+			return nil, fmt.Errorf("field %q: value longer than %d bytes", fieldPath, maxPartLength)
+		}
+
+		parts[i] = part
+	}
+
+	return parts, nil
+}
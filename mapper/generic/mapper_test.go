@@ -0,0 +1,131 @@
+package generic
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testConfig = &Config{
+	Collections: []*CollectionConfig{
+		{Identifier: 0xE100, Name: "bal", Kind: TabletCollectionKind, IdentifierParts: 1},
+		{Identifier: 0xE101, Name: "acct", Kind: SingletCollectionKind, IdentifierParts: 1},
+	},
+	Rules: []*Rule{
+		{Collection: "bal", Events: "transactions.*.events.*", Match: map[string]string{"type": "transfer"}, Identifier: []string{"data.token"}, PrimaryKey: []string{"data.to"}, Value: "data.balance"},
+		{Collection: "bal", Events: "transactions.*.events.*", Match: map[string]string{"type": "burn"}, Identifier: []string{"data.token"}, PrimaryKey: []string{"data.from"}, Delete: true},
+		{Collection: "acct", Events: "accounts.*", Identifier: []string{"name"}},
+	},
+}
+
+func init() {
+	if err := RegisterCollections(testConfig); err != nil {
+		panic(err)
+	}
+}
+
+const testPayload = `{
+	"transactions": [
+		{"events": [
+			{"type": "transfer", "data": {"token": "abc", "to": "alice", "balance": 10}},
+			{"type": "approve", "data": {"token": "abc", "to": "bob"}},
+			{"type": "transfer", "data": {"token": "abc", "to": "alice", "balance": 12}}
+		]},
+		{"events": [
+			{"type": "burn", "data": {"token": "xyz", "from": "carol"}}
+		]}
+	],
+	"accounts": [{"name": "dave", "created": true}]
+}`
+
+func jsonPayload(payload string) PayloadDecoder {
+	return func(blk *bstream.Block) ([]byte, error) { return []byte(payload), nil }
+}
+
+func TestBlockMapper_Map(t *testing.T) {
+	mapper, err := NewBlockMapper(testConfig, jsonPayload(testPayload))
+	require.NoError(t, err)
+
+	blk := &bstream.Block{Id: "00000007aa", Number: 7}
+	req, err := mapper.Map(blk)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(7), req.Height)
+	assert.Equal(t, blk.AsRef(), req.BlockRef)
+
+	require.Len(t, req.TabletRows, 2, "last extraction of a row in a block wins")
+	assert.Equal(t, "bal:abc:0000000000000007:alice", req.TabletRows[0].(TabletRow).String())
+	assert.Equal(t, []byte("12"), req.TabletRows[0].(TabletRow).Value())
+	assert.Equal(t, "bal:xyz:0000000000000007:carol", req.TabletRows[1].(TabletRow).String())
+	assert.True(t, req.TabletRows[1].IsDeletion())
+
+	require.Len(t, req.SingletEntries, 1)
+	assert.Equal(t, "acct:dave", req.SingletEntries[0].Singlet().(Singlet).String())
+
+	value, err := req.SingletEntries[0].MarshalValue()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "dave", "created": true}`, string(value))
+
+	// Rows and entries round-trip through their storage form
+	stored, err := fluxdb.NewTabletRowFromStorage(fluxdb.KeyForTabletRow(req.TabletRows[0]), []byte("12"))
+	require.NoError(t, err)
+	assert.Equal(t, req.TabletRows[0], stored)
+	assert.Equal(t, []string{"alice"}, stored.(TabletRow).PrimaryKeyParts())
+
+	storedEntry, err := fluxdb.NewSingletEntryFromStorage(fluxdb.KeyForSingletEntry(req.SingletEntries[0]), value)
+	require.NoError(t, err)
+	assert.Equal(t, req.SingletEntries[0], storedEntry)
+
+	decoded, err := fluxdb.DecodeTabletRows(req.TabletRows[0:1], JSONPayloadCodec)
+	require.NoError(t, err)
+	assert.Equal(t, json.RawMessage("12"), decoded[0].Value)
+}
+
+func TestBlockMapper_Map_Errors(t *testing.T) {
+	mapper, err := NewBlockMapper(testConfig, jsonPayload(`{"transactions": [{"events": [{"type": "transfer", "data": {"token": "abc", "balance": 1}}]}]}`))
+	require.NoError(t, err)
+
+	_, err = mapper.Map(&bstream.Block{Id: "00000007aa", Number: 7})
+	assert.EqualError(t, err, `rule #0: event #0: primary key: field "data.to" not found`)
+
+	mapper, err = NewBlockMapper(testConfig, jsonPayload(`{"accounts": [{"name": {"nested": true}}]}`))
+	require.NoError(t, err)
+
+	_, err = mapper.Map(&bstream.Block{Id: "00000007aa", Number: 7})
+	assert.EqualError(t, err, `rule #2: event #0: identifier: field "name": expected a string, number or boolean, got map[string]interface {}`)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	collections := []*CollectionConfig{
+		{Identifier: 1, Name: "tbl", Kind: TabletCollectionKind, IdentifierParts: 1},
+		{Identifier: 2, Name: "sgl", Kind: SingletCollectionKind, IdentifierParts: 2},
+	}
+
+	tests := []struct {
+		name          string
+		rule          *Rule
+		expectedError string
+	}{
+		{"valid", &Rule{Collection: "tbl", Identifier: []string{"a"}, PrimaryKey: []string{"b"}}, ""},
+		{"unknown collection", &Rule{Collection: "unknown"}, `rule #0: unknown collection "unknown"`},
+		{"identifier parts", &Rule{Collection: "sgl", Identifier: []string{"a"}}, "rule #0: collection sgl expects 2 identifier parts, got 1"},
+		{"tablet without primary key", &Rule{Collection: "tbl", Identifier: []string{"a"}}, "rule #0: tablet collection tbl requires a primary key"},
+		{"singlet with primary key", &Rule{Collection: "sgl", Identifier: []string{"a", "b"}, PrimaryKey: []string{"c"}}, "rule #0: singlet collection sgl does not accept a primary key"},
+		{"wildcard in field", &Rule{Collection: "tbl", Identifier: []string{"a.*"}, PrimaryKey: []string{"b"}}, `rule #0: identifier: path "a.*": wildcard "*" is only accepted in the events path`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := (&Config{Collections: collections, Rules: []*Rule{test.rule}}).Validate()
+			if test.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
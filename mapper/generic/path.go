@@ -0,0 +1,135 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generic
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const wildcard = "*"
+
+// path is a `.` separated path into a JSON document decoded with `json.Decoder.UseNumber`, see
+// `Rule` for the syntax, the empty path being the document itself.
+type path []string
+
+func parsePath(in string) path {
+	if in == "" {
+		return nil
+	}
+
+	return strings.Split(in, ".")
+}
+
+func parseFieldPath(in string) (path, error) {
+	out := parsePath(in)
+	for _, segment := range out {
+		if segment == wildcard {
+			return nil, fmt.Errorf("path %q: wildcard %q is only accepted in the events path", in, wildcard)
+		}
+	}
+
+	return out, nil
+}
+
+func parseFieldPaths(in []string) (out []path, err error) {
+	out = make([]path, len(in))
+	for i, field := range in {
+		if out[i], err = parseFieldPath(field); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func (p path) String() string {
+	return strings.Join(p, ".")
+}
+
+// collect appends to `out` all the nodes of `node` at this path, in document order (object
+// values expanded by a wildcard being in key order).
+func (p path) collect(node interface{}, out []interface{}) []interface{} {
+	if len(p) == 0 {
+		return append(out, node)
+	}
+
+	switch value := node.(type) {
+	case map[string]interface{}:
+		if p[0] == wildcard {
+			keys := make([]string, 0, len(value))
+			for key := range value {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				out = p[1:].collect(value[key], out)
+			}
+			return out
+		}
+
+		if child, found := value[p[0]]; found {
+			return p[1:].collect(child, out)
+		}
+
+	case []interface{}:
+		if p[0] == wildcard {
+			for _, child := range value {
+				out = p[1:].collect(child, out)
+			}
+			return out
+		}
+
+		if index, err := strconv.Atoi(p[0]); err == nil && index >= 0 && index < len(value) {
+			return p[1:].collect(value[index], out)
+		}
+	}
+
+	return out
+}
+
+// lookup returns the node of `node` at this path, which must not contain any wildcard.
+func (p path) lookup(node interface{}) (interface{}, bool) {
+	nodes := p.collect(node, nil)
+	if len(nodes) == 0 {
+		return nil, false
+	}
+
+	return nodes[0], true
+}
+
+// lookupScalar returns the string form of the scalar node (string, number or boolean) of `node`
+// at this path.
+func (p path) lookupScalar(node interface{}) (string, error) {
+	value, found := p.lookup(node)
+	if !found {
+		return "", fmt.Errorf("field %q not found", p)
+	}
+
+	switch scalar := value.(type) {
+	case string:
+		return scalar, nil
+	case json.Number:
+		return scalar.String(), nil
+	case bool:
+		return strconv.FormatBool(scalar), nil
+	default:
+		return "", fmt.Errorf("field %q: expected a string, number or boolean, got %T", p, value)
+	}
+}
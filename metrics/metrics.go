@@ -22,3 +22,52 @@ var MetricSet = dmetrics.NewSet()
 
 var HeadBlockTimeDrift = MetricSet.NewHeadTimeDrift("statedb")
 var HeadBlockNumber = MetricSet.NewHeadBlockNumber("statedb")
+
+var LastWrittenBlockNumber = MetricSet.NewGauge("last_written_block_number", "Number of the last block written to the store")
+var LastWrittenBlockTimeDrift = MetricSet.NewGauge("last_written_block_time_drift", "Number of seconds between now and the timestamp of the last block written to the store")
+var HeadBlockDrift = MetricSet.NewGauge("head_block_drift", "Number of blocks the last block written to the store is behind the head block of the source")
+var ShardLag = MetricSet.NewGaugeVec("shard_lag", []string{"shard"}, "Number of blocks the last block written by a shard is behind the one of the most advanced shard")
+
+var HotKeysSampledCount = MetricSet.NewCounterVec("hot_keys_sampled_count", []string{"operation", "collection"}, "Number of read/write keys sampled for hot keys detection, per collection")
+var HottestTabletShare = MetricSet.NewGaugeVec("hottest_tablet_share", []string{"operation"}, "Share of the sampled read/write operations of the sliding window that hit the hottest tablet")
+
+var FlushThreshold = MetricSet.NewGaugeVec("flush_threshold", []string{"backend"}, "Amount of changes a batch accumulates before being flushed, adapted to the backend latency and error rate")
+var FlushDuration = MetricSet.NewHistogramVec("flush_duration", []string{"backend"}, "Duration of the flushes of batch mutations to the backend")
+var FlushErrorCount = MetricSet.NewCounterVec("flush_error_count", []string{"backend"}, "Number of failed flushes of batch mutations to the backend")
+var FlushRejectedKeyCount = MetricSet.NewCounterVec("flush_rejected_key_count", []string{"backend", "table"}, "Number of keys rejected by the backend, isolated by retrying failed flushes by partitions, per storage table")
+
+var RejectedReadCount = MetricSet.NewCounterVec("rejected_read_count", []string{"operation"}, "Number of reads rejected by a read interceptor, per read operation")
+
+var CorruptedIndexCount = MetricSet.NewCounterVec("corrupted_index_count", []string{"collection"}, "Number of reads that found a corrupted tablet index, falling back to a rows scan, per collection of the tablet")
+
+var OversizedRowCount = MetricSet.NewCounterVec("oversized_row_count", []string{"collection", "policy"}, "Number of singlet entries and tablet rows whose value exceeded the maximum row size, per collection and policy applied")
+
+var ElidedWriteCount = MetricSet.NewCounterVec("elided_write_count", []string{"collection"}, "Number of singlet entries and tablet rows not written because identical to the last value written at the same key")
+
+var FlushedMutationCount = MetricSet.NewCounterVec("flushed_mutation_count", []string{"backend", "table"}, "Number of keys written by batch flushes to the backend, per storage table")
+var FlushedDeletionCount = MetricSet.NewCounterVec("flushed_deletion_count", []string{"backend", "table"}, "Number of keys deleted by batch flushes to the backend, per storage table")
+var FlushedBytes = MetricSet.NewCounterVec("flushed_bytes", []string{"backend", "table"}, "Size in bytes of the keys and values written and of the keys deleted by batch flushes to the backend, per storage table")
+
+var DualWriteDivergenceCount = MetricSet.NewCounterVec("dual_write_divergence_count", []string{"operation"}, "Number of writes that succeeded on the primary store but failed on the secondary store in dual-write mode, any divergence requires re-syncing the secondary store")
+
+var ShadowReadCount = MetricSet.NewCounterVec("shadow_read_count", []string{"operation"}, "Number of sampled reads mirrored against the secondary store in shadow-read mode")
+var ShadowReadDivergenceCount = MetricSet.NewCounterVec("shadow_read_divergence_count", []string{"operation"}, "Number of mirrored reads whose secondary store result differed from the primary store one in shadow-read mode")
+
+var IndexFetchChunkDuration = MetricSet.NewHistogramVec("index_fetch_chunk_duration", []string{"collection"}, "Duration of the fetch of each chunk of the rows referenced by a tablet index, per collection of the tablet")
+
+var PipelineHeadBlockNumber = MetricSet.NewGaugeVec("pipeline_head_block_number", []string{"pipeline"}, "Number of the head block of the source of a named pipeline, when several pipelines run in the same process")
+var PipelineLastWrittenBlockNumber = MetricSet.NewGaugeVec("pipeline_last_written_block_number", []string{"pipeline"}, "Number of the last block written to the store by a named pipeline, when several pipelines run in the same process")
+var PipelineLastWrittenBlockTimeDrift = MetricSet.NewGaugeVec("pipeline_last_written_block_time_drift", []string{"pipeline"}, "Number of seconds between now and the timestamp of the last block written to the store by a named pipeline, when several pipelines run in the same process")
+var PipelineHeadBlockDrift = MetricSet.NewGaugeVec("pipeline_head_block_drift", []string{"pipeline"}, "Number of blocks the last block written by a named pipeline is behind the head block of its source, when several pipelines run in the same process")
+var PipelineReady = MetricSet.NewGaugeVec("pipeline_ready", []string{"pipeline"}, "Whether a named pipeline crossed the close to real-time threshold (1) or not (0), when several pipelines run in the same process")
+
+var StoreOperationCount = MetricSet.NewCounterVec("store_operation_count", []string{"backend", "operation"}, "Number of operations performed on the backend, per operation, when store operation metrics are enabled")
+var StoreOperationDuration = MetricSet.NewHistogramVec("store_operation_duration", []string{"backend", "operation"}, "Duration of the operations performed on the backend until their last item was read, per operation, when store operation metrics are enabled")
+var StoreOperationErrorCount = MetricSet.NewCounterVec("store_operation_error_count", []string{"backend", "operation", "code"}, "Number of operations performed on the backend that failed, per operation and error code, when store operation metrics are enabled")
+
+var QueuedReadCount = MetricSet.NewGauge("queued_read_count", "Number of heavy reads waiting for a slot of the concurrent reads limit")
+var TooManyRequestsCount = MetricSet.NewCounter("too_many_requests_count", "Number of heavy reads rejected because no slot of the concurrent reads limit freed up within the queue timeout")
+var MissingKeysCacheHitCount = MetricSet.NewCounter("missing_keys_cache_hit_count", "Number of tablet and singlet reads answered, for the heights known to have no row, from the missing keys cache")
+var TabletExistenceCacheHitCount = MetricSet.NewCounter("tablet_existence_cache_hit_count", "Number of tablet existence probes answered from the tablet existence cache")
+var PrimaryKeyBloomExclusionCount = MetricSet.NewCounter("primary_key_bloom_exclusion_count", "Number of tablet row reads whose primary key was excluded by the primary key bloom filter of the tablet, saving the fetch of its index")
+var CoalescedReadCount = MetricSet.NewCounter("coalesced_read_count", "Number of tablet reads served by the concurrent identical read in flight instead of being resolved, when read coalescing is enabled")
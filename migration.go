@@ -0,0 +1,295 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// The store metadata lives in the checkpoint table, under keys prefixed by `meta-`, alongside
+// the other store wide configurations (see `shardingConfigKey`).
+var (
+	schemaVersionKey              = []byte("meta-schema-version")
+	schemaMigrationProgressPrefix = "meta-migration-"
+	schemaMigrationLockKey        = []byte("lock-schema-migration")
+)
+
+// schemaMigrationLeaseTTL is the TTL of the lease held while migrating, renewed periodically,
+// so a migration is resumed by another instance shortly after its owner died.
+var schemaMigrationLeaseTTL = 1 * time.Minute
+
+// MigrationCheckpoint persists the progress of a migration, an interrupted migration is resumed
+// from its last checkpointed progress. It fails when the migration lease was lost, the migration
+// must then stop.
+type MigrationCheckpoint func(ctx context.Context, progress []byte) error
+
+// Migration upgrades the storage schema (i.e. the key/value formats) from `Version - 1` to
+// `Version`, see `RegisterMigration`.
+type Migration struct {
+	Version     uint32
+	Description string
+
+	// Run applies the migration, resuming after `progress` which is the last progress
+	// checkpointed by a previous interrupted run, `nil` when starting from scratch. It must
+	// be idempotent from a checkpointed progress, since the work done after it is re-applied.
+	Run func(ctx context.Context, db *FluxDB, progress []byte, checkpoint MigrationCheckpoint) error
+}
+
+var migrations = map[uint32]*Migration{}
+
+// RegisterMigration registers the migration upgrading the storage schema to `migration.Version`,
+// versions must be registered contiguously starting at 1. The schema version of this binary is
+// the highest registered version (see `SchemaVersion`), the registered migrations are applied to
+// stores with a lower version by `MigrateSchema`.
+func RegisterMigration(migration *Migration) {
+	if migration.Version == 0 {
+		panic(fmt.Errorf("migration %q: version 0 is reserved to stores predating schema versioning", migration.Description))
+	}
+
+	if migration.Run == nil {
+		panic(fmt.Errorf("migration %d: run function is required", migration.Version))
+	}
+
+	if existing, found := migrations[migration.Version]; found {
+		panic(fmt.Errorf("migration %d already registered (%q)", migration.Version, existing.Description))
+	}
+
+	migrations[migration.Version] = migration
+}
+
+// SchemaVersion returns the storage schema version of this binary, i.e. the highest registered
+// migration version, 0 when none is.
+func SchemaVersion() (version uint32) {
+	for candidate := range migrations {
+		if candidate > version {
+			version = candidate
+		}
+	}
+
+	return
+}
+
+// pendingMigrations returns, in order, the migrations upgrading the schema from `version` to
+// `SchemaVersion()`.
+func pendingMigrations(version uint32) ([]*Migration, error) {
+	var pending []*Migration
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+
+	for i, migration := range pending {
+		if expected := version + uint32(i) + 1; migration.Version != expected {
+			return nil, fmt.Errorf("migration %d is not registered, cannot upgrade to version %d", expected, migration.Version)
+		}
+	}
+
+	return pending, nil
+}
+
+// ReadSchemaVersion returns the storage schema version of the store, `found` is false when the
+// store has none, i.e. when it's empty or predates schema versioning.
+func (fdb *FluxDB) ReadSchemaVersion(ctx context.Context) (version uint32, found bool, err error) {
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, schemaVersionKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, fmt.Errorf("fetch schema version: %w", err)
+	}
+
+	if len(value) != 4 {
+		return 0, false, fmt.Errorf("invalid schema version value %x, expected 4 bytes", value)
+	}
+
+	return bigEndian.Uint32(value), true, nil
+}
+
+// CheckSchemaVersion returns an error when the store schema version is newer than the one of
+// this binary, which would then misread the data. A store with an older version is accepted, its
+// migrations being pending, see `MigrateSchema`.
+func (fdb *FluxDB) CheckSchemaVersion(ctx context.Context) error {
+	version, found, err := fdb.ReadSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	supported := SchemaVersion()
+	if version > supported {
+		return fmt.Errorf("store schema version %d is newer than the version %d supported by this binary", version, supported)
+	}
+
+	if found && version < supported {
+		zlog.Warn("store schema version is older than the version of this binary, migrations are pending", zap.Uint32("version", version), zap.Uint32("supported_version", supported))
+	}
+
+	return nil
+}
+
+// MigrateSchema upgrades the store to the schema version of this binary, applying in order the
+// registered migrations it's missing. An empty store is simply stamped with the current version
+// while a store without any version predates schema versioning and is migrated from version 0.
+//
+// The migrations are applied under a lease owned by `owner`, so a single instance of the fleet
+// migrates at a time, the other ones failing to start while it's held. Each migration
+// checkpoints its progress, an interrupted migration being resumed from its last checkpoint.
+// The store version is bumped once each migration completes.
+func (fdb *FluxDB) MigrateSchema(ctx context.Context, owner string) error {
+	if err := fdb.CheckSchemaVersion(ctx); err != nil {
+		return err
+	}
+
+	target := SchemaVersion()
+	version, found, err := fdb.ReadSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if found && version == target {
+		zlog.Debug("store schema is up to date", zap.Uint32("version", version))
+		return nil
+	}
+
+	lease := newLease(fdb, schemaMigrationLockKey, owner, schemaMigrationLeaseTTL, false)
+	if err := lease.acquire(ctx); err != nil {
+		return fmt.Errorf("acquire schema migration lease: %w", err)
+	}
+
+	defer func() {
+		if err := lease.release(context.Background()); err != nil {
+			zlog.Warn("unable to release schema migration lease", zap.Error(err))
+		}
+	}()
+
+	// Deferred after the release, so the lease is no longer kept alive when released
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go lease.keepAlive(ctx, func(err error) {
+		zlog.Error("schema migration lease lost, stopping migration", zap.Error(err))
+		cancel()
+	})
+
+	// Another instance may have migrated the store while we were waiting for the lease
+	if version, found, err = fdb.ReadSchemaVersion(ctx); err != nil {
+		return err
+	}
+
+	if !found {
+		empty, err := fdb.IsEmpty(ctx)
+		if err != nil {
+			return err
+		}
+
+		if empty {
+			zlog.Info("stamping empty store with current schema version", zap.Uint32("version", target))
+			return fdb.writeSchemaVersion(ctx, target)
+		}
+	}
+
+	pending, err := pendingMigrations(version)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		// Only reached by a store predating schema versioning when no migration is registered
+		return fdb.writeSchemaVersion(ctx, target)
+	}
+
+	for _, migration := range pending {
+		if err := fdb.runMigration(ctx, migration, lease); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+	}
+
+	return nil
+}
+
+func (fdb *FluxDB) runMigration(ctx context.Context, migration *Migration, lease *storeLease) error {
+	progressKey := []byte(fmt.Sprintf("%s%010d", schemaMigrationProgressPrefix, migration.Version))
+
+	progress, err := fdb.store.FetchLastWrittenCheckpoint(ctx, progressKey)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("fetch progress: %w", err)
+	}
+
+	zlog.Info("running schema migration",
+		zap.Uint32("version", migration.Version),
+		zap.String("description", migration.Description),
+		zap.Bool("resuming", progress != nil),
+	)
+
+	start := time.Now()
+	checkpoint := func(ctx context.Context, progress []byte) error {
+		if err := lease.err(); err != nil {
+			return fmt.Errorf("schema migration lease lost: %w", err)
+		}
+
+		batch := fdb.store.NewBatch(zlog)
+		batch.SetLastCheckpoint(progressKey, progress)
+
+		if err := batch.Flush(ctx); err != nil {
+			return fmt.Errorf("write progress: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := migration.Run(ctx, fdb, progress, checkpoint); err != nil {
+		return err
+	}
+
+	if err := lease.err(); err != nil {
+		return fmt.Errorf("schema migration lease lost: %w", err)
+	}
+
+	if err := fdb.writeSchemaVersion(ctx, migration.Version); err != nil {
+		return err
+	}
+
+	// The progress key is fixed-width, deleting it by prefix only affects this migration progress
+	if err := fdb.store.DeleteShardsCheckpoint(ctx, progressKey); err != nil {
+		return fmt.Errorf("delete progress: %w", err)
+	}
+
+	zlog.Info("schema migration completed", zap.Uint32("version", migration.Version), zap.Duration("elapsed", time.Since(start)))
+	return nil
+}
+
+func (fdb *FluxDB) writeSchemaVersion(ctx context.Context, version uint32) error {
+	value := make([]byte, 4)
+	bigEndian.PutUint32(value, version)
+
+	batch := fdb.store.NewBatch(zlog)
+	batch.SetLastCheckpoint(schemaVersionKey, value)
+
+	if err := batch.Flush(ctx); err != nil {
+		return fmt.Errorf("write schema version: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withMigrations(t *testing.T, registered ...*Migration) func() {
+	previousMigrations, previousDelay := migrations, leaseSettleDelay
+	migrations, leaseSettleDelay = map[uint32]*Migration{}, 0
+
+	for _, migration := range registered {
+		RegisterMigration(migration)
+	}
+
+	return func() {
+		migrations, leaseSettleDelay = previousMigrations, previousDelay
+	}
+}
+
+func writeTestCheckpoint(t *testing.T, db *FluxDB, height uint64) {
+	batch := db.store.NewBatch(zlog)
+	require.NoError(t, db.setLastCheckpoint(batch, height, bstream.NewBlockRef("00000001aa", height)))
+	require.NoError(t, batch.Flush(context.Background()))
+}
+
+func TestMigrateSchema_EmptyStoreIsStamped(t *testing.T) {
+	ran := false
+	defer withMigrations(t, &Migration{Version: 1, Run: func(ctx context.Context, db *FluxDB, progress []byte, checkpoint MigrationCheckpoint) error {
+		ran = true
+		return nil
+	}})()
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	require.NoError(t, db.MigrateSchema(ctx, "test"))
+	assert.False(t, ran, "empty store should not be migrated")
+
+	version, found, err := db.ReadSchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint32(1), version)
+}
+
+func TestMigrateSchema_ResumesFromProgress(t *testing.T) {
+	var applied []uint32
+	failOnce := true
+
+	defer withMigrations(t,
+		&Migration{Version: 2, Description: "second", Run: func(ctx context.Context, db *FluxDB, progress []byte, checkpoint MigrationCheckpoint) error {
+			if progress == nil {
+				require.NoError(t, checkpoint(ctx, []byte("half")))
+			}
+
+			if failOnce {
+				failOnce = false
+				return errors.New("interrupted")
+			}
+
+			assert.Equal(t, []byte("half"), progress)
+			applied = append(applied, 2)
+			return nil
+		}},
+		&Migration{Version: 1, Description: "first", Run: func(ctx context.Context, db *FluxDB, progress []byte, checkpoint MigrationCheckpoint) error {
+			assert.Nil(t, progress)
+			applied = append(applied, 1)
+			return nil
+		}},
+	)()
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	writeTestCheckpoint(t, db, 10)
+
+	assert.EqualError(t, db.MigrateSchema(ctx, "test"), "migration 2 (second): interrupted")
+
+	version, found, err := db.ReadSchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint32(1), version, "first migration should have been committed")
+
+	require.NoError(t, db.MigrateSchema(ctx, "test"))
+	assert.Equal(t, []uint32{1, 2}, applied)
+
+	version, _, err = db.ReadSchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), version)
+
+	require.NoError(t, db.MigrateSchema(ctx, "test"))
+	assert.Equal(t, []uint32{1, 2}, applied, "up to date store should not be migrated again")
+}
+
+func TestMigrateSchema_Locked(t *testing.T) {
+	defer withMigrations(t, &Migration{Version: 1, Run: func(ctx context.Context, db *FluxDB, progress []byte, checkpoint MigrationCheckpoint) error {
+		return nil
+	}})()
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	require.NoError(t, newLease(db, schemaMigrationLockKey, "other", time.Minute, false).acquire(ctx))
+	assert.Error(t, db.MigrateSchema(ctx, "test"))
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	defer withMigrations(t)()
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	require.NoError(t, db.CheckSchemaVersion(ctx))
+
+	require.NoError(t, db.writeSchemaVersion(ctx, 3))
+	assert.EqualError(t, db.CheckSchemaVersion(ctx), "store schema version 3 is newer than the version 0 supported by this binary")
+	assert.Error(t, db.MigrateSchema(ctx, "test"))
+}
+
+func TestPendingMigrations(t *testing.T) {
+	run := func(ctx context.Context, db *FluxDB, progress []byte, checkpoint MigrationCheckpoint) error {
+		return nil
+	}
+	defer withMigrations(t, &Migration{Version: 1, Run: run}, &Migration{Version: 3, Run: run})()
+
+	_, err := pendingMigrations(0)
+	assert.EqualError(t, err, "migration 2 is not registered, cannot upgrade to version 3")
+
+	_, err = pendingMigrations(1)
+	assert.EqualError(t, err, "migration 2 is not registered, cannot upgrade to version 3")
+
+	pending, err := pendingMigrations(2)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, uint32(3), pending[0].Version)
+
+	assert.Panics(t, func() { RegisterMigration(&Migration{Version: 1, Run: run}) })
+	assert.Panics(t, func() { RegisterMigration(&Migration{Version: 0, Run: run}) })
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/logging"
+	"go.uber.org/zap"
+)
+
+// EnableMissingKeysCache remembers, for up to `capacity` tablets and singlets (least recently
+// used ones are evicted first), that they have no row (respectively entry) at or below a height,
+// so the repeated reads of nonexistent ones (e.g. queries for contract tables that were never
+// written) do not scan the store again. A read at or below the remembered height is answered
+// from memory, a read above it only scans the heights above it. Must be called before serving
+// reads.
+//
+// Only the heights that were committed (see `FetchSafeServeBlock`) when a read started are
+// remembered, blocks being written in order, no row appears at or below them afterwards. The
+// writes performed by this instance invalidate the tablets and singlets they touch, the ones
+// performed below the committed height by other processes (e.g. a repair of the store) are not
+// seen until restarted.
+func (fdb *FluxDB) EnableMissingKeysCache(capacity int) {
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	fdb.missingKeys = &missingKeysCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// missingKeysCache is a bounded cache of the height at or below which a tablet or singlet,
+// identified by its key, has no row, safe for concurrent use.
+type missingKeysCache struct {
+	// Accessed atomically, the highest committed height seen so far, it only ever grows
+	committed uint64
+
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type missingKey struct {
+	key    string
+	height uint64
+}
+
+// lookup returns the height at or below which the tablet or singlet has no row, `found` being
+// false when unknown. Safe to call on a `nil` cache, in which case nothing is ever known.
+func (c *missingKeysCache) lookup(key []byte) (height uint64, found bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, found := c.entries[string(key)]
+	if !found {
+		return 0, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*missingKey).height, true
+}
+
+// record remembers that the tablet or singlet has no row at or below `height`.
+func (c *missingKeysCache) record(key []byte, height uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, found := c.entries[string(key)]; found {
+		c.order.MoveToFront(element)
+
+		missing := element.Value.(*missingKey)
+		if height > missing.height {
+			missing.height = height
+		}
+		return
+	}
+
+	c.entries[string(key)] = c.order.PushFront(&missingKey{key: string(key), height: height})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*missingKey).key)
+	}
+}
+
+// forgetTablet drops what's known about the tablet, written to. Safe to call on a `nil` cache.
+func (c *missingKeysCache) forgetTablet(tablet Tablet) {
+	if c == nil {
+		return
+	}
+
+	c.forget(KeyForTablet(tablet))
+}
+
+// forgetSinglet drops what's known about the singlet, written to. Safe to call on a `nil` cache.
+func (c *missingKeysCache) forgetSinglet(singlet Singlet) {
+	if c == nil {
+		return
+	}
+
+	c.forget(KeyForSinglet(singlet))
+}
+
+func (c *missingKeysCache) forget(key []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, found := c.entries[string(key)]; found {
+		c.order.Remove(element)
+		delete(c.entries, string(key))
+	}
+}
+
+// committedHeight returns the highest committed height seen so far, a read started after it was
+// seen can prove the absence of rows up to it. Safe to call on a `nil` cache.
+func (c *missingKeysCache) committedHeight() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&c.committed)
+}
+
+func (c *missingKeysCache) advance(height uint64) {
+	for {
+		current := atomic.LoadUint64(&c.committed)
+		if height <= current || atomic.CompareAndSwapUint64(&c.committed, current, height) {
+			return
+		}
+	}
+}
+
+// recordMissingKeysCacheHit accounts for a read answered from the missing keys cache.
+func recordMissingKeysCacheHit(ctx context.Context) {
+	metrics.MissingKeysCacheHitCount.Inc()
+	store.ReadStatsFromContext(ctx).RecordCacheHit()
+}
+
+// recordMissing remembers that the read at `height` of the tablet or singlet (identified by its
+// key) found no row, up to `committed`, the committed height seen before the read started, the
+// rows of the blocks committed since could have been missed. Safe to call on a `nil` cache.
+func (fdb *FluxDB) recordMissing(ctx context.Context, key []byte, height uint64, committed uint64) {
+	if fdb.missingKeys == nil || fdb.IsSharding() {
+		return
+	}
+
+	if height > committed {
+		// The next reads can prove the absence of rows up to the current committed height
+		current, _, err := fdb.FetchSafeServeBlock(ctx)
+		if err != nil {
+			logging.Logger(ctx, zlog).Debug("unable to refresh committed height of missing keys cache", zap.Error(err))
+		} else {
+			fdb.missingKeys.advance(current)
+		}
+
+		height = committed
+	}
+
+	if height == 0 {
+		return
+	}
+
+	fdb.missingKeys.record(key, height)
+}
@@ -0,0 +1,119 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnableMissingKeysCache_Tablet(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+	missing := newTestTablet("mis")
+	writeBatchOfRequests(t, db,
+		tabletRows(1, tablet.row(t, 1, "001", "a")),
+		tabletRows(2, tablet.row(t, 2, "002", "b")),
+	)
+
+	db.EnableMissingKeysCache(10)
+
+	read := func(height uint64, tablet Tablet) ([]TabletRow, *store.ReadStats) {
+		stats := &store.ReadStats{}
+		rows, err := db.ReadTabletAt(store.WithReadStats(ctx, stats), height, tablet, nil)
+		require.NoError(t, err)
+
+		return rows, stats
+	}
+
+	// The committed height is not known yet by the first read, it's only learned from it
+	rows, stats := read(2, missing)
+	assert.Empty(t, rows)
+	assert.Equal(t, 0, stats.CacheHitCount())
+
+	rows, stats = read(2, missing)
+	assert.Empty(t, rows)
+	assert.Equal(t, 0, stats.CacheHitCount())
+
+	rows, stats = read(1, missing)
+	assert.Empty(t, rows)
+	assert.Equal(t, 1, stats.CacheHitCount())
+	assert.Equal(t, 0, stats.ScanCount())
+
+	rows, _ = read(2, tablet)
+	assert.Len(t, rows, 2)
+
+	// Writing to the tablet invalidates what's known about it
+	writeBatchOfRequests(t, db, tabletRows(3, missing.row(t, 3, "001", "c")))
+	_, found := db.missingKeys.lookup(KeyForTablet(missing))
+	assert.False(t, found)
+
+	rows, _ = read(3, missing)
+	require.Len(t, rows, 1)
+	assert.Equal(t, uint64(3), rows[0].Height())
+}
+
+func TestEnableMissingKeysCache_Singlet(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	singlet := newTestSinglet("sgl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, SingletEntries: []SingletEntry{newTestSinglet("oth").entry(t, 1, "o")}},
+		&WriteRequest{Height: 2},
+	)
+
+	db.EnableMissingKeysCache(10)
+
+	for i := 0; i < 2; i++ {
+		entry, err := db.ReadSingletEntryAt(ctx, singlet, 2, nil)
+		require.NoError(t, err)
+		assert.Nil(t, entry)
+	}
+
+	stats := &store.ReadStats{}
+	entry, err := db.ReadSingletEntryAt(store.WithReadStats(ctx, stats), singlet, 2, nil)
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+	assert.Equal(t, 1, stats.CacheHitCount())
+
+	writeBatchOfRequests(t, db, &WriteRequest{Height: 3, SingletEntries: []SingletEntry{singlet.entry(t, 3, "s")}})
+
+	entry, err = db.ReadSingletEntryAt(ctx, singlet, 3, nil)
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, uint64(3), entry.Height())
+}
+
+func TestMissingKeysCache_Eviction(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.EnableMissingKeysCache(2)
+	cache := db.missingKeys
+
+	cache.record([]byte("a"), 10)
+	cache.record([]byte("b"), 10)
+	cache.record([]byte("a"), 5)
+
+	height, found := cache.lookup([]byte("a"))
+	assert.True(t, found)
+	assert.Equal(t, uint64(10), height, "the highest height is kept")
+
+	// The least recently used key is evicted first
+	cache.record([]byte("c"), 10)
+	_, found = cache.lookup([]byte("b"))
+	assert.False(t, found)
+	_, found = cache.lookup([]byte("a"))
+	assert.True(t, found)
+
+	var disabled *missingKeysCache
+	_, found = disabled.lookup([]byte("a"))
+	assert.False(t, found)
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/abourget/llerrgroup"
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/logging"
+	"go.uber.org/zap"
+)
+
+// ParallelScanTabletRows calls `onRow` with each row of the tablet at `height`, like
+// `ReadTabletAt` would return them, without ever holding the whole tablet in memory, for
+// analytics jobs dumping large tablets. The rows are read with up to `parallelism` concurrent
+// scans. The rows written above the tablet index are scanned by height ranges, each range
+// resolving the last version of its primary keys, the ranges being then merged in height order.
+// The rows referenced by the tablet index and not overridden by the ones above it are then
+// fetched by chunks (see `SetIndexFetchOptions` for their size), each chunk being handed to
+// `onRow` as soon as fetched.
+//
+// The calls to `onRow` are serialized, in no particular order. Return `store.BreakScan` from
+// `onRow` to stop the scan early.
+//
+// **Important** Only the rows written above the tablet index are held in memory, a tablet not
+// indexed recently is better indexed first, see `ForceIndexTablet`.
+func (fdb *FluxDB) ParallelScanTabletRows(ctx context.Context, tablet Tablet, height uint64, parallelism int, onRow func(row TabletRow) error) error {
+	if parallelism <= 0 {
+		return errors.New("invalid parallelism, must be greater than 0")
+	}
+
+	ctx, err := fdb.interceptRead(ctx, ReadOperationTablet, tablet, nil, height)
+	if err != nil {
+		return err
+	}
+
+	if height, err = fdb.committedReadHeight(ctx, height, nil); err != nil {
+		return err
+	}
+
+	release, err := fdb.readLimiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	zlogger := logging.Logger(ctx, zlog)
+	idx, err := fdb.ReadTabletIndexAt(ctx, tablet, height)
+	if err != nil {
+		return fmt.Errorf("fetch tablet index: %w", err)
+	}
+
+	deltaStartHeight := uint64(0)
+	if idx != nil {
+		deltaStartHeight = idx.AtHeight + 1
+	}
+
+	delta, err := fdb.parallelScanTabletDelta(ctx, tablet, deltaStartHeight, height, parallelism)
+	if err != nil {
+		return err
+	}
+
+	fdb.recordTabletRead(tablet, len(delta))
+	zlogger.Debug("parallel scanning tablet rows",
+		zap.Stringer("tablet", tablet),
+		zap.Uint64("height", height),
+		zap.Uint64("index_row_count", idx.RowCount()),
+		zap.Int("delta_row_count", len(delta)),
+		zap.Int("parallelism", parallelism),
+	)
+
+	// Once `onRow` failed, the chunks fetched concurrently must not be handed to it anymore
+	var onRowLock sync.Mutex
+	var onRowErr error
+	emit := func(rows []TabletRow) error {
+		onRowLock.Lock()
+		defer onRowLock.Unlock()
+
+		if onRowErr != nil {
+			return onRowErr
+		}
+
+		for _, row := range rows {
+			if onRowErr = onRow(row); onRowErr != nil {
+				return onRowErr
+			}
+		}
+
+		return nil
+	}
+
+	if idx != nil {
+		filter := &TabletRowFilter{Match: func(primaryKey []byte) bool {
+			_, overridden := delta[string(primaryKey)]
+			return !overridden
+		}}
+
+		keys := idx.PrimaryKeyToHeight.rowKeys(tablet, filter)
+		chunkSize := fdb.indexFetch.chunkSize()
+
+		eg := llerrgroup.New(parallelism)
+		for start := 0; start < len(keys); start += chunkSize {
+			if eg.Stop() {
+				break
+			}
+
+			end := start + chunkSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			keysChunk := keys[start:end]
+			eg.Go(func() error {
+				rows, err := fdb.fetchTabletIndexRowsChunk(ctx, tablet, keysChunk)
+				if err != nil {
+					return fmt.Errorf("reading tablet index rows chunk: %w", err)
+				}
+
+				return emit(rows)
+			})
+		}
+
+		if err := eg.Wait(); err != nil {
+			if err == store.BreakScan {
+				return nil
+			}
+
+			return err
+		}
+	}
+
+	rows := make([]TabletRow, 0, len(delta))
+	for _, row := range delta {
+		if !row.IsDeletion() {
+			rows = append(rows, row)
+		}
+	}
+
+	if err := emit(rows); err != nil && err != store.BreakScan {
+		return err
+	}
+
+	return nil
+}
+
+// parallelScanTabletDelta returns the last version, deletions included, of each primary key of
+// the tablet rows stored within [fromHeight, toHeight], scanned by `parallelism` height ranges
+// concurrently.
+func (fdb *FluxDB) parallelScanTabletDelta(ctx context.Context, tablet Tablet, fromHeight, toHeight uint64, parallelism int) (map[string]TabletRow, error) {
+	if fromHeight > toHeight {
+		return map[string]TabletRow{}, nil
+	}
+
+	rangeSize := (toHeight-fromHeight)/uint64(parallelism) + 1
+	rowsPerRange := make([]map[string]TabletRow, parallelism)
+
+	eg := llerrgroup.New(parallelism)
+	for i := 0; i < parallelism; i++ {
+		rangeStart := fromHeight + uint64(i)*rangeSize
+		if rangeStart > toHeight || rangeStart < fromHeight {
+			break
+		}
+
+		rangeEnd := rangeStart + rangeSize - 1
+		if rangeEnd > toHeight || rangeEnd < rangeStart {
+			rangeEnd = toHeight
+		}
+
+		i := i
+		eg.Go(func() error {
+			rows := map[string]TabletRow{}
+			err := fdb.store.ScanTabletRows(ctx, KeyForTabletAt(tablet, rangeStart), KeyForTabletAt(tablet, rangeEnd+1), func(key []byte, value []byte) error {
+				row, err := NewTabletRow(tablet, key, value)
+				if err != nil {
+					return fmt.Errorf("tablet new row %q: %w", Key(key), err)
+				}
+
+				rows[string(row.PrimaryKey())] = row
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("scan tablet rows [%d, %d]: %w", rangeStart, rangeEnd, err)
+			}
+
+			rowsPerRange[i] = rows
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	delta := rowsPerRange[0]
+	for _, rows := range rowsPerRange[1:] {
+		for primaryKey, row := range rows {
+			delta[primaryKey] = row
+		}
+	}
+
+	return delta, nil
+}
@@ -0,0 +1,74 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelScanTabletRows(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+	db.SetIndexFetchOptions(IndexFetchOptions{ChunkSize: 2})
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b"), tablet.row(t, 1, "003", "c")),
+		tabletRows(2, tablet.row(t, 2, "004", "d"), tablet.row(t, 2, "005", "e")),
+	)
+
+	_, err := db.ForceIndexTablet(ctx, tablet)
+	require.NoError(t, err)
+
+	writeBatchOfRequests(t, db,
+		tabletRows(3, tablet.row(t, 3, "001", "f"), tablet.row(t, 3, "002", "")),
+		tabletRows(4, tablet.row(t, 4, "006", "g"), tablet.row(t, 4, "007", "h")),
+		tabletRows(5, tablet.row(t, 5, "006", ""), tablet.row(t, 5, "008", "i")),
+		tabletRows(6, tablet.row(t, 6, "002", "j")),
+	)
+
+	for _, height := range []uint64{1, 2, 4, 6} {
+		expected, err := db.ReadTabletAt(ctx, height, tablet, nil)
+		require.NoError(t, err)
+
+		for _, parallelism := range []int{1, 2, 3, 8} {
+			var rows []TabletRow
+			err := db.ParallelScanTabletRows(ctx, tablet, height, parallelism, func(row TabletRow) error {
+				rows = append(rows, row)
+				return nil
+			})
+			require.NoError(t, err)
+
+			sortTabletRows(rows, TabletRowOrderAscending)
+			assert.Equal(t, expected, rows, "height %d, parallelism %d", height, parallelism)
+		}
+	}
+
+	count := 0
+	err = db.ParallelScanTabletRows(ctx, tablet, 6, 2, func(row TabletRow) error {
+		count++
+		return store.BreakScan
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	err = db.ParallelScanTabletRows(ctx, tablet, 6, 0, nil)
+	assert.EqualError(t, err, "invalid parallelism, must be greater than 0")
+}
+
+func TestParallelScanTabletRows_Empty(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	var rows []TabletRow
+	err := db.ParallelScanTabletRows(context.Background(), newTestTablet("tbl"), 10, 4, func(row TabletRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+}
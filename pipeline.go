@@ -25,7 +25,7 @@ import (
 	"github.com/dfuse-io/bstream/blockstream"
 	"github.com/dfuse-io/bstream/forkable"
 	"github.com/dfuse-io/dstore"
-	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/fluxdb/store"
 	pbblockmeta "github.com/dfuse-io/pbgo/dfuse/blockmeta/v1"
 	"go.uber.org/zap"
 )
@@ -87,6 +87,48 @@ func BuildReprocessingPipeline(
 	), nil
 }
 
+// SourceOptions tunes the bstream source built by `BuildPipeline`, trading catch-up throughput
+// for memory, the zero value of each field meaning its default.
+type SourceOptions struct {
+	// FileSourceParallelDownloads is the amount of blocks files downloaded (and preprocessed)
+	// concurrently by the file source, defaults to 2
+	FileSourceParallelDownloads int
+
+	// LiveSourceBufferSize is the amount of blocks buffered by the live source while the file
+	// source catches up, defaults to 250
+	LiveSourceBufferSize int
+
+	// DisableLiveSource only streams blocks from the blocks store, the live source is never
+	// joined, e.g. for catch-up only runs
+	DisableLiveSource bool
+
+	// ForkableOptions are appended to the options of the forkable handler, after the default ones
+	ForkableOptions []forkable.Option
+
+	// FileSourceOptions and JoiningSourceOptions are appended to the options of the file and
+	// joining sources, after the default ones
+	FileSourceOptions    []bstream.FileSourceOption
+	JoiningSourceOptions []bstream.JoiningSourceOption
+}
+
+const (
+	defaultFileSourceParallelDownloads = 2
+	defaultLiveSourceBufferSize        = 250
+)
+
+// SetSourceOptions configures how `BuildPipeline` builds the source, must be called before it.
+func (fdb *FluxDB) SetSourceOptions(options SourceOptions) {
+	if options.FileSourceParallelDownloads <= 0 {
+		options.FileSourceParallelDownloads = defaultFileSourceParallelDownloads
+	}
+
+	if options.LiveSourceBufferSize <= 0 {
+		options.LiveSourceBufferSize = defaultLiveSourceBufferSize
+	}
+
+	fdb.sourceOptions = options
+}
+
 func (fdb *FluxDB) BuildPipeline(
 	blockMeta pbblockmeta.BlockIDClient,
 	getBlockID bstream.EternalSourceStartBackAtBlock,
@@ -95,8 +137,11 @@ func (fdb *FluxDB) BuildPipeline(
 	blockStreamAddr string,
 ) {
 	fdbPreprocessor := NewPreprocessBlock(fdb.blockMapper)
+	options := fdb.sourceOptions
 
 	preprocessor := bstream.PreprocessFunc(func(blk *bstream.Block) (interface{}, error) {
+		fdb.irreversibility.Apply(blk)
+
 		if fdb.blockFilter != nil {
 			err := fdb.blockFilter(blk)
 			if err != nil {
@@ -117,40 +162,60 @@ func (fdb *FluxDB) BuildPipeline(
 			forkableOptions = append(forkableOptions, forkable.WithExclusiveLIB(startBlock))
 		}
 
-		if blockMeta != nil {
+		if blockMeta != nil && fdb.irreversibility.IsNative() {
 			zlog.Info("configuring irreversibility checker on forkable handler")
 			forkableOptions = append(forkableOptions, forkable.WithIrreversibilityChecker(blockMeta, 5*time.Second))
 		}
 
+		forkableOptions = append(forkableOptions, options.ForkableOptions...)
+
 		// no need for a gate here, since we are starting with ExclusiveLIB, so at startBlock+1
-		forkHandler := forkable.New(h, forkableOptions...)
+		var forkHandler bstream.Handler = forkable.New(h, forkableOptions...)
+		if pipeline := fdb.pipelineHandler; pipeline != nil && pipeline.resumedHeadBlock != nil && bstream.EqualsBlockRefs(startBlock, pipeline.resumedHeadBlock) {
+			// Resumed from the source cursor, the forkable only knows its head block
+			forkHandler = &sourceCursorGuard{handler: pipeline, headBlock: startBlock, next: forkHandler}
+		}
 
 		liveSourceFactory := bstream.SourceFactory(func(subHandler bstream.Handler) bstream.Source {
 			return blockstream.NewSource(
 				context.Background(),
 				blockStreamAddr,
-				250,
+				options.LiveSourceBufferSize,
 				bstream.NewPreprocessor(preprocessor, subHandler),
 			)
 		})
 
 		fileSourceFactory := bstream.SourceFactory(func(subHandler bstream.Handler) bstream.Source {
+			startBlockNum := startBlock.Num()
+			if options.DisableLiveSource && bstream.EqualsBlockRefs(startBlock, bstream.BlockRefEmpty) {
+				// Without the joining source, nothing else targets the first streamable block
+				startBlockNum = bstream.GetProtocolFirstStreamableBlock
+			}
+
 			fs := bstream.NewFileSource(
 				blocksStore,
-				startBlock.Num(),
-				2,
+				startBlockNum,
+				options.FileSourceParallelDownloads,
 				preprocessor,
 				subHandler,
+				options.FileSourceOptions...,
 			)
 
 			return fs
 		})
 
-		return bstream.NewJoiningSource(fileSourceFactory, liveSourceFactory, forkHandler,
+		if options.DisableLiveSource {
+			zlog.Info("live source disabled, streaming blocks from the blocks store only")
+			return fileSourceFactory(forkHandler)
+		}
+
+		joiningOptions := []bstream.JoiningSourceOption{
 			bstream.JoiningSourceLogger(zlog),
 			bstream.JoiningSourceTargetBlockID(startBlock.ID()),
 			bstream.JoiningSourceTargetBlockNum(bstream.GetProtocolFirstStreamableBlock),
-		)
+		}
+
+		return bstream.NewJoiningSource(fileSourceFactory, liveSourceFactory, forkHandler, append(joiningOptions, options.JoiningSourceOptions...)...)
 	})
 
 	fdb.source = bstream.NewDelegatingEternalSource(sf, getBlockID, handler, bstream.EternalSourceWithLogger(zlog))
@@ -175,14 +240,37 @@ type FluxDBHandler struct {
 	batchWritableRows int
 
 	lastBlockIDCheck time.Time
+
+	// The reversible segment the pipeline resumed from, written with the first irreversible step
+	// following it, see `resumeFromSourceCursor`
+	resumedWrites         []*WriteRequest
+	resumedHeadBlock      bstream.BlockRef
+	sourceCursorForkedOut bool
+
+	// Last block known to be written to the store, its time is only known when written by this handler
+	lastWrittenBlockNum  uint64
+	lastWrittenBlockTime time.Time
+
+	// Held while processing a block, so pausing the pipeline waits for the block being processed
+	processLock sync.Mutex
+
+	// Closed when the pipeline is resumed, `nil` while not paused, see `PausePipeline`
+	pauseLock sync.Mutex
+	resumed   chan struct{}
 }
 
+// NewHandler returns the handler of the pipeline writing to (or, when writes are not enabled,
+// following) the store of `db`, it becomes the pipeline paused and resumed by `db` (see
+// `PausePipeline`).
 func NewHandler(db *FluxDB) *FluxDBHandler {
-	return &FluxDBHandler{
+	handler := &FluxDBHandler{
 		db:        db,
 		ctx:       context.Background(),
 		headBlock: bstream.BlockRefEmpty,
 	}
+
+	db.pipelineHandler = handler
+	return handler
 }
 
 func (p *FluxDBHandler) EnableWrites() {
@@ -194,17 +282,35 @@ func (p *FluxDBHandler) EnableWriteOnEachIrreversibleStep() {
 }
 
 func (p *FluxDBHandler) InitializeStartBlockID() (startBlock bstream.BlockRef, err error) {
-	_, startBlock, err = p.db.FetchLastWrittenCheckpoint(p.ctx)
+	_, startBlock, err = p.db.fetchResumeCheckpoint(p.ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	zlog.Info("initializing pipeline forkdb", zap.Stringer("block", startBlock))
 	p.serverForkDB = forkable.NewForkDB(forkable.ForkDBWithLogger(zlog))
-	if !bstream.EqualsBlockRefs(startBlock, bstream.BlockRefEmpty) {
+
+	// The speculative writes are rebuilt along the fork database, from the streamed blocks
+	p.speculativeReadsLock.Lock()
+	p.speculativeWrites = nil
+	p.headBlock = bstream.BlockRefEmpty
+	p.speculativeReadsLock.Unlock()
+
+	p.resumedWrites = nil
+	p.resumedHeadBlock = nil
+	if bstream.EqualsBlockRefs(startBlock, bstream.BlockRefEmpty) {
 		// If we are the empty block ref, we are going to initialize ourselves later on in the pipeline when we
 		// receive the first streamable block of the chain.
-		p.serverForkDB.InitLIB(startBlock)
+		return startBlock, nil
+	}
+
+	p.serverForkDB.InitLIB(startBlock)
+
+	// Only the writer resumes from the source cursor, the reversible blocks are written by it
+	if p.writeEnabled {
+		if headBlock := p.resumeFromSourceCursor(p.ctx, startBlock); headBlock != nil {
+			return headBlock, nil
+		}
 	}
 
 	return startBlock, nil
@@ -250,7 +356,42 @@ func (p *FluxDBHandler) updateSpeculativeWrites(newHeadBlock bstream.BlockRef) {
 	p.headBlock = newHeadBlock
 }
 
+// pruneSpeculativeWrites drops the speculative writes at or below `irreversibleHeight`, they are
+// now part of the store (deletions included) and re-applying them on top of it is wasted work.
+func (p *FluxDBHandler) pruneSpeculativeWrites(irreversibleHeight uint64) {
+	p.speculativeReadsLock.Lock()
+	defer p.speculativeReadsLock.Unlock()
+
+	var retained []*WriteRequest
+	for _, write := range p.speculativeWrites {
+		if write.Height > irreversibleHeight {
+			retained = append(retained, write)
+		}
+	}
+
+	p.speculativeWrites = retained
+}
+
+// updateDriftMetrics refreshes the gauges comparing the last written block to the source head
+// block, called on each new head block so the time drift keeps growing while writes are stalled.
+func (p *FluxDBHandler) updateDriftMetrics(headBlockNum uint64) {
+	if headBlockNum >= p.lastWrittenBlockNum {
+		p.db.recordHeadBlockDrift(headBlockNum - p.lastWrittenBlockNum)
+	}
+
+	if !p.lastWrittenBlockTime.IsZero() {
+		p.db.recordLastWrittenBlockTimeDrift(time.Since(p.lastWrittenBlockTime))
+	}
+}
+
 func (p *FluxDBHandler) ProcessBlock(rawBlk *bstream.Block, rawObj interface{}) error {
+	if err := p.waitWhilePaused(); err != nil {
+		return err
+	}
+
+	p.processLock.Lock()
+	defer p.processLock.Unlock()
+
 	blkRef := rawBlk.AsRef()
 	if rawBlk.Num()%600 == 0 || traceEnabled {
 		zlog.Info("processing block (printed each 600 blocks)", zap.Stringer("block", blkRef))
@@ -262,9 +403,8 @@ func (p *FluxDBHandler) ProcessBlock(rawBlk *bstream.Block, rawObj interface{})
 	switch fObj.Step {
 	case forkable.StepNew:
 
-		metrics.HeadBlockTimeDrift.SetBlockTime(rawBlk.Time())
-		metrics.HeadBlockNumber.SetUint64(rawBlk.Num())
-		if !p.db.IsReady() {
+		p.db.recordHeadBlock(rawBlk.Num(), rawBlk.Time())
+		if !p.db.ready {
 			if isNearRealtime(rawBlk, time.Now()) && !bstream.EqualsBlockRefs(p.HeadBlock(context.Background()), bstream.BlockRefEmpty) {
 				zlog.Info("realtime blocks flowing, marking process as ready")
 				p.db.SetReady()
@@ -281,6 +421,7 @@ func (p *FluxDBHandler) ProcessBlock(rawBlk *bstream.Block, rawObj interface{})
 		}
 
 		p.updateSpeculativeWrites(rawBlk)
+		p.updateDriftMetrics(rawBlk.Num())
 
 	case forkable.StepIrreversible:
 		if fObj.StepCount-1 != fObj.StepIndex { // last irreversible block in multi-block step
@@ -294,6 +435,12 @@ func (p *FluxDBHandler) ProcessBlock(rawBlk *bstream.Block, rawObj interface{})
 				p.batchClose = now.Add(1 * time.Second) // Always flush at least the previous LIB
 			}
 
+			// The reversible segment resumed from precedes the first blocks the forkable knows of
+			for _, req := range p.takeResumedWrites() {
+				p.batchWrites = append(p.batchWrites, req)
+				p.batchWritableRows += len(req.SingletEntries) + len(req.TabletRows)
+			}
+
 			zlog.Debug("accumulating write request from irreversible blocks", zap.Stringer("block", rawBlk), zap.Int("block_count", len(fObj.StepBlocks)))
 			for _, newIrrBlk := range fObj.StepBlocks {
 				req := newIrrBlk.Obj.(*WriteRequest)
@@ -303,25 +450,9 @@ func (p *FluxDBHandler) ProcessBlock(rawBlk *bstream.Block, rawObj interface{})
 			}
 
 			if p.batchWritableRows > 5000 || now.After(p.batchClose) || p.writeOnEachIrreversibleStep {
-				defer func() {
-					p.batchWrites = nil
-					p.batchWritableRows = 0
-				}()
-
-				err := p.db.WriteBatch(p.ctx, p.batchWrites)
-				if err != nil {
+				if err := p.writeBatch(p.ctx); err != nil {
 					return err
 				}
-
-				timePerBlock := time.Now().Sub(p.batchOpen) / time.Duration(len(p.batchWrites))
-				zlog.Info("wrote irreversible segment of blocks starting here",
-					zap.Stringer("block", blkRef),
-					zap.Uint64("height", rawBlk.Num()),
-					zap.Duration("batch_elapsed", time.Now().Sub(p.batchOpen)),
-					zap.Duration("batch_elapsed_per_block", timePerBlock),
-					zap.Int("batch_write_count", len(p.batchWrites)),
-					zap.Int("batch_writable_row_count", p.batchWritableRows),
-				)
 			}
 
 			p.serverForkDB.MoveLIB(blkRef)
@@ -330,18 +461,22 @@ func (p *FluxDBHandler) ProcessBlock(rawBlk *bstream.Block, rawObj interface{})
 			// Don't ask more than once each 2 seconds..
 			if p.lastBlockIDCheck.Before(time.Now().Add(-2 * time.Second)) {
 				// FIXME (height): Will need to be revisited here for height support
-				_, lastWrittenBlock, err := p.db.FetchLastWrittenCheckpoint(p.ctx)
+				irreversibleHeight, irreversibleBlock, err := p.db.LastIrreversibleBlock(p.ctx)
 				if err != nil {
 					return err
 				}
 
-				if lastWrittenBlock.ID() != p.serverForkDB.LIBID() {
-					zlog.Debug("writer's LIB updated, advancing server forkDB in return",
-						zap.Stringer("block", lastWrittenBlock),
-						zap.Uint64("height", lastWrittenBlock.Num()),
+				if irreversibleBlock.ID() != p.serverForkDB.LIBID() {
+					zlog.Debug("writer's LIB updated, advancing server forkDB and pruning speculative writes in return",
+						zap.Stringer("block", irreversibleBlock),
+						zap.Uint64("height", irreversibleHeight),
 					)
 
-					p.serverForkDB.MoveLIB(lastWrittenBlock)
+					p.serverForkDB.MoveLIB(irreversibleBlock)
+					p.pruneSpeculativeWrites(irreversibleHeight)
+
+					p.lastWrittenBlockNum = irreversibleBlock.Num()
+					p.db.recordLastWrittenBlock(p.lastWrittenBlockNum)
 				}
 
 				p.lastBlockIDCheck = time.Now()
@@ -355,6 +490,42 @@ func (p *FluxDBHandler) ProcessBlock(rawBlk *bstream.Block, rawObj interface{})
 	return nil
 }
 
+// writeBatch writes the accumulated irreversible blocks, the batch is only reset once written.
+func (p *FluxDBHandler) writeBatch(ctx context.Context) error {
+	// A batch committed without the keys rejected by the backend, logged by the write, is not
+	// retried, the writer would otherwise stall on them
+	lastWrite := p.batchWrites[len(p.batchWrites)-1]
+	cursor, err := p.sourceCursor(lastWrite)
+	if err != nil {
+		return fmt.Errorf("source cursor: %w", err)
+	}
+
+	var rejected *store.ErrRejectedKeys
+	if err := p.db.writeBatch(ctx, p.batchWrites, cursor); err != nil && !errors.As(err, &rejected) {
+		return err
+	}
+
+	p.pruneSpeculativeWrites(lastWrite.Height)
+
+	p.lastWrittenBlockNum = lastWrite.BlockRef.Num()
+	p.lastWrittenBlockTime = lastWrite.BlockTime
+	p.updateDriftMetrics(p.HeadBlock(ctx).Num())
+
+	timePerBlock := time.Now().Sub(p.batchOpen) / time.Duration(len(p.batchWrites))
+	zlog.Info("wrote irreversible segment of blocks starting here",
+		zap.Stringer("block", lastWrite.BlockRef),
+		zap.Uint64("height", lastWrite.Height),
+		zap.Duration("batch_elapsed", time.Now().Sub(p.batchOpen)),
+		zap.Duration("batch_elapsed_per_block", timePerBlock),
+		zap.Int("batch_write_count", len(p.batchWrites)),
+		zap.Int("batch_writable_row_count", p.batchWritableRows),
+	)
+
+	p.batchWrites = nil
+	p.batchWritableRows = 0
+	return nil
+}
+
 func isNearRealtime(blk *bstream.Block, now time.Time) bool {
 	return now.Add(-15 * time.Second).Before(blk.Time())
 }
@@ -0,0 +1,15 @@
+package fluxdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetSourceOptions(t *testing.T) {
+	db := New(nil, nil, nil, false)
+	assert.Equal(t, SourceOptions{FileSourceParallelDownloads: 2, LiveSourceBufferSize: 250}, db.sourceOptions)
+
+	db.SetSourceOptions(SourceOptions{FileSourceParallelDownloads: 8, DisableLiveSource: true})
+	assert.Equal(t, SourceOptions{FileSourceParallelDownloads: 8, LiveSourceBufferSize: 250, DisableLiveSource: true}, db.sourceOptions)
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"time"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+)
+
+// SetPipelineName names the pipeline of this instance, for processes running several of them
+// (one per chain, each one writing into its own namespace of a shared store, see the
+// `store/namespace` package). The pipeline metrics are then exported per pipeline name (the
+// `pipeline_*` metrics) instead of by the process wide ones, which would be overwritten by each
+// pipeline in turn.
+func (fdb *FluxDB) SetPipelineName(name string) {
+	fdb.pipelineName = name
+}
+
+// PipelineName returns the name of the pipeline, empty when not named, see `SetPipelineName`.
+func (fdb *FluxDB) PipelineName() string {
+	return fdb.pipelineName
+}
+
+func (fdb *FluxDB) recordHeadBlock(num uint64, blockTime time.Time) {
+	if fdb.pipelineName != "" {
+		metrics.PipelineHeadBlockNumber.SetUint64(num, fdb.pipelineName)
+		return
+	}
+
+	metrics.HeadBlockTimeDrift.SetBlockTime(blockTime)
+	metrics.HeadBlockNumber.SetUint64(num)
+}
+
+func (fdb *FluxDB) recordLastWrittenBlock(num uint64) {
+	if fdb.pipelineName != "" {
+		metrics.PipelineLastWrittenBlockNumber.SetUint64(num, fdb.pipelineName)
+		return
+	}
+
+	metrics.LastWrittenBlockNumber.SetUint64(num)
+}
+
+func (fdb *FluxDB) recordLastWrittenBlockTimeDrift(drift time.Duration) {
+	if fdb.pipelineName != "" {
+		metrics.PipelineLastWrittenBlockTimeDrift.SetFloat64(drift.Seconds(), fdb.pipelineName)
+		return
+	}
+
+	metrics.LastWrittenBlockTimeDrift.SetFloat64(drift.Seconds())
+}
+
+func (fdb *FluxDB) recordHeadBlockDrift(drift uint64) {
+	if fdb.pipelineName != "" {
+		metrics.PipelineHeadBlockDrift.SetUint64(drift, fdb.pipelineName)
+		return
+	}
+
+	metrics.HeadBlockDrift.SetUint64(drift)
+}
+
+func (fdb *FluxDB) recordReady() {
+	if fdb.pipelineName != "" {
+		metrics.PipelineReady.SetUint64(1, fdb.pipelineName)
+	}
+}
@@ -0,0 +1,49 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store/namespace"
+	"github.com/dfuse-io/fluxdb/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacedInstances(t *testing.T) {
+	kvStore, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	dbs := map[string]*FluxDB{}
+	for i, name := range []string{"eth", "bsc"} {
+		namespaced, err := namespace.NewStore(kvStore, name)
+		require.NoError(t, err)
+
+		db := New(namespaced, nil, nil, false)
+		db.SetPipelineName(name)
+		dbs[name] = db
+
+		height := uint64(10 * (i + 1))
+		writeBatchOfRequests(t, db, tabletRows(height, tablet.row(t, height, "001", name)))
+	}
+
+	for name, db := range dbs {
+		assert.Equal(t, name, db.PipelineName())
+
+		rows, err := db.ReadTabletAt(ctx, 100, tablet, nil)
+		require.NoError(t, err)
+		require.Len(t, rows, 1)
+		assert.Equal(t, name, rows[0].(testTabletRow).data())
+	}
+
+	height, _, err := dbs["eth"].FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), height)
+
+	height, _, err = dbs["bsc"].FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), height)
+}
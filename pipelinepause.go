@@ -0,0 +1,126 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// ErrNoPipeline is returned when pausing or resuming the pipeline of an instance without one,
+// see `NewHandler`.
+var ErrNoPipeline = errors.New("no pipeline handler")
+
+// PausePipeline stops the pipeline from consuming blocks, so writes can be quiesced during a
+// maintenance of the storage engine without restarting the process. The block being processed,
+// if any, is completed first, then the irreversible blocks accumulated in the current batch are
+// written, persisting the last written checkpoint the pipeline restarts from. The pipeline stays
+// paused until `ResumePipeline` is called, pausing an already paused pipeline flushes nothing.
+//
+// When the pending writes cannot be flushed, the pipeline is not paused and the error is
+// returned.
+func (fdb *FluxDB) PausePipeline(ctx context.Context) error {
+	if fdb.pipelineHandler == nil {
+		return ErrNoPipeline
+	}
+
+	return fdb.pipelineHandler.pause(ctx)
+}
+
+// ResumePipeline resumes the pipeline paused by `PausePipeline`, resuming a pipeline that is not
+// paused does nothing.
+func (fdb *FluxDB) ResumePipeline(ctx context.Context) error {
+	if fdb.pipelineHandler == nil {
+		return ErrNoPipeline
+	}
+
+	fdb.pipelineHandler.resume()
+	return nil
+}
+
+// IsPipelinePaused returns whether the pipeline is paused, see `PausePipeline`.
+func (fdb *FluxDB) IsPipelinePaused() bool {
+	return fdb.pipelineHandler != nil && fdb.pipelineHandler.paused()
+}
+
+func (p *FluxDBHandler) pause(ctx context.Context) error {
+	p.pauseLock.Lock()
+	alreadyPaused := p.resumed != nil
+	if !alreadyPaused {
+		p.resumed = make(chan struct{})
+	}
+	p.pauseLock.Unlock()
+
+	if alreadyPaused {
+		return nil
+	}
+
+	// Waits for the block being processed, the next ones wait for the pipeline to be resumed
+	p.processLock.Lock()
+	defer p.processLock.Unlock()
+
+	if p.writeEnabled && len(p.batchWrites) > 0 {
+		if err := p.writeBatch(ctx); err != nil {
+			p.resume()
+			return fmt.Errorf("flush pending writes: %w", err)
+		}
+	}
+
+	zlog.Info("pipeline paused", zap.Uint64("last_written_block_num", p.lastWrittenBlockNum))
+	return nil
+}
+
+func (p *FluxDBHandler) resume() {
+	p.pauseLock.Lock()
+	defer p.pauseLock.Unlock()
+
+	if p.resumed == nil {
+		return
+	}
+
+	close(p.resumed)
+	p.resumed = nil
+	zlog.Info("pipeline resumed")
+}
+
+func (p *FluxDBHandler) paused() bool {
+	p.pauseLock.Lock()
+	defer p.pauseLock.Unlock()
+
+	return p.resumed != nil
+}
+
+// waitWhilePaused blocks while the pipeline is paused, returning `ErrCleanSourceStop` if the
+// instance terminates in the meantime.
+func (p *FluxDBHandler) waitWhilePaused() error {
+	p.pauseLock.Lock()
+	resumed := p.resumed
+	p.pauseLock.Unlock()
+
+	if resumed == nil {
+		return nil
+	}
+
+	zlog.Info("pipeline paused, waiting to be resumed")
+	select {
+	case <-resumed:
+		return nil
+	case <-p.db.Terminating():
+		return ErrCleanSourceStop
+	}
+}
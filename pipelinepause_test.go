@@ -0,0 +1,70 @@
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPausePipeline(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	assert.Equal(t, ErrNoPipeline, db.PausePipeline(ctx))
+
+	handler := NewHandler(db)
+	handler.EnableWrites()
+	handler.serverForkDB = forkable.NewForkDB()
+
+	tablet := newTestTablet("tbl")
+	irreversibleBlock := func(num uint64) error {
+		blk := &bstream.Block{Id: fmt.Sprintf("%08xaa", num), Number: num, PreviousId: fmt.Sprintf("%08xaa", num-1)}
+		request := &WriteRequest{Height: num, BlockRef: blk.AsRef(), TabletRows: []TabletRow{tablet.row(t, num, "001", "a")}}
+
+		return handler.ProcessBlock(blk, &forkable.ForkableObject{
+			Step:       forkable.StepIrreversible,
+			StepCount:  1,
+			StepBlocks: []*forkable.ForkableBlock{{Block: blk, Obj: request}},
+		})
+	}
+
+	require.NoError(t, irreversibleBlock(1))
+	_, lastWrittenBlock, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, bstream.BlockRefEmpty, lastWrittenBlock, "block is accumulated in the current batch")
+
+	require.NoError(t, db.PausePipeline(ctx))
+	assert.True(t, db.IsPipelinePaused())
+
+	height, _, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), height, "pending writes are flushed when pausing")
+
+	require.NoError(t, db.PausePipeline(ctx), "pausing twice is a no-op")
+
+	processed := make(chan error)
+	go func() { processed <- irreversibleBlock(2) }()
+
+	select {
+	case <-processed:
+		t.Fatal("block should not be processed while the pipeline is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, db.ResumePipeline(ctx))
+	assert.False(t, db.IsPipelinePaused())
+
+	select {
+	case err := <-processed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("block should be processed once the pipeline is resumed")
+	}
+}
@@ -25,6 +25,15 @@ func NewPreprocessBlock(mapper BlockMapper) bstream.PreprocessFunc {
 			zlog.Info("pre-processing block (printed each 600 blocks)", zap.Stringer("block", rawBlk))
 		}
 
-		return mapper.Map(rawBlk)
+		request, err := mapper.Map(rawBlk)
+		if err != nil {
+			return nil, err
+		}
+
+		if request != nil && request.BlockTime.IsZero() {
+			request.BlockTime = rawBlk.Time()
+		}
+
+		return request, nil
 	}
 }
@@ -0,0 +1,148 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/logging"
+	"go.uber.org/zap"
+)
+
+var primaryKeyBloomSingletCollection uint16 = 0xFFFB
+var primaryKeyBloomSingletCollectionName string = "pkbloom"
+
+func init() {
+	registerSingletFactory(primaryKeyBloomSingletCollection, primaryKeyBloomSingletCollectionName, func(identifier []byte) (Singlet, error) {
+		// Like the index singlet, our identifier is the full `TabletKey` of the tablet
+		tablet, err := NewTablet(identifier)
+		if err != nil {
+			return nil, fmt.Errorf("primary key bloom tablet: %w", err)
+		}
+
+		return newPrimaryKeyBloomSinglet(tablet), nil
+	})
+}
+
+// EnablePrimaryKeyBloomFilters writes, along with each tablet index snapshot, a bloom filter of
+// the primary keys of the rows the tablet has at the height of the snapshot, sized so a primary
+// key absent from the tablet is reported as possibly present with a probability of
+// `falsePositiveRate` (e.g. 0.01, about 10 bits per row), and uses them to answer the reads of a
+// single row (see `ReadTabletRowAt`) whose primary key was definitely absent at the height of the
+// filter without fetching the index, only the rows written since being scanned. A possibly
+// present primary key is read through the index, like when no filter was written.
+//
+// Must be enabled on the writer, so the filters are written, and on the readers, so they are
+// used. The indexes written before it was enabled have no filter, the reads falling back to the
+// index until the tablets are indexed again.
+func (fdb *FluxDB) EnablePrimaryKeyBloomFilters(falsePositiveRate float64) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+
+	fdb.primaryKeyBloomRate = falsePositiveRate
+}
+
+// writePrimaryKeyBloom adds to the batch the bloom filter of the primary keys of the index
+// snapshot, written at the same height. Does nothing when the filters are not enabled.
+func (fdb *FluxDB) writePrimaryKeyBloom(batch store.Batch, index *TabletIndex, tabletKey TabletKey) {
+	if fdb.primaryKeyBloomRate == 0 {
+		return
+	}
+
+	filter := newBloomFilter(int(index.RowCount()), fdb.primaryKeyBloomRate)
+	if index.PrimaryKeyToHeight != nil {
+		for primaryKey := range index.PrimaryKeyToHeight.mappings {
+			filter.add([]byte(primaryKey))
+		}
+	}
+
+	singlet := newPrimaryKeyBloomSingletFromKey(tabletKey)
+	batch.SetRow(KeyForSingletAt(singlet, index.AtHeight), filter.marshal())
+	fdb.missingKeys.forgetSinglet(singlet)
+}
+
+// excludedByPrimaryKeyBloom returns whether the tablet had definitely no row at `primaryKey` as
+// of `bloomHeight`, the height of its latest primary key bloom filter at or below `height`. A
+// missing or corrupted filter excludes nothing, the read falling back to the index.
+//
+// An excluded key is not free: it still costs the fetch of the filter singlet, then a scan of
+// the rows written from `bloomHeight+1` up to the read height, the rows written since the filter
+// being unknown to it. Only the fetch and decoding of the index snapshot are saved.
+func (fdb *FluxDB) excludedByPrimaryKeyBloom(ctx context.Context, tablet Tablet, height uint64, primaryKey []byte) (bloomHeight uint64, excluded bool, err error) {
+	if fdb.primaryKeyBloomRate == 0 {
+		return 0, false, nil
+	}
+
+	entry, err := fdb.fetchSingletEntry(ctx, newPrimaryKeyBloomSinglet(tablet), height)
+	if err != nil {
+		return 0, false, fmt.Errorf("fetch primary key bloom: %w", err)
+	}
+
+	if entry == nil {
+		return 0, false, nil
+	}
+
+	filter, err := unmarshalBloomFilter(entry.(primaryKeyBloomSingletEntry).Value())
+	if err != nil {
+		logging.Logger(ctx, zlog).Warn("primary key bloom filter corrupted, falling back to index", zap.Stringer("tablet", tablet), zap.Uint64("height", entry.Height()), zap.Error(err))
+		return 0, false, nil
+	}
+
+	if filter.contains(primaryKey) {
+		return 0, false, nil
+	}
+
+	metrics.PrimaryKeyBloomExclusionCount.Inc()
+	return entry.Height(), true, nil
+}
+
+// primaryKeyBloomSinglet holds the bloom filters of the primary keys of a tablet, written at the
+// height of the index snapshot they were computed from, see `EnablePrimaryKeyBloomFilters`.
+type primaryKeyBloomSinglet struct {
+	tabletKey TabletKey
+}
+
+func newPrimaryKeyBloomSinglet(forTablet Tablet) primaryKeyBloomSinglet {
+	return newPrimaryKeyBloomSingletFromKey(KeyForTablet(forTablet))
+}
+
+func newPrimaryKeyBloomSingletFromKey(tabletKey TabletKey) primaryKeyBloomSinglet {
+	return primaryKeyBloomSinglet{tabletKey: tabletKey}
+}
+
+func (s primaryKeyBloomSinglet) Collection() uint16 {
+	return primaryKeyBloomSingletCollection
+}
+
+func (s primaryKeyBloomSinglet) Identifier() []byte {
+	return s.tabletKey
+}
+
+func (s primaryKeyBloomSinglet) Entry(height uint64, value []byte) (SingletEntry, error) {
+	// The filter is only decoded when used, a corrupted one must not fail the read
+	return primaryKeyBloomSingletEntry{BaseSingletEntry: NewBaseSingletEntry(s, height, value)}, nil
+}
+
+func (s primaryKeyBloomSinglet) String() string {
+	return primaryKeyBloomSingletCollectionName + ":" + s.tabletKey.String()
+}
+
+type primaryKeyBloomSingletEntry struct {
+	BaseSingletEntry
+}
@@ -0,0 +1,110 @@
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnablePrimaryKeyBloomFilters(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	db.EnablePrimaryKeyBloomFilters(0)
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b")))
+
+	_, err := db.ForceIndexTablet(ctx, tablet)
+	require.NoError(t, err)
+
+	writeBatchOfRequests(t, db, tabletRows(2, tablet.row(t, 2, "003", "c")))
+
+	read := func(primaryKey string) (TabletRow, *store.ReadStats) {
+		stats := &store.ReadStats{}
+		row, err := db.ReadTabletRowAt(store.WithReadStats(ctx, stats), 2, tablet, testTabletRowPrimaryKey(primaryKey), nil)
+		require.NoError(t, err)
+
+		return row, stats
+	}
+
+	row, stats := read("004")
+	assert.Nil(t, row)
+	assert.Equal(t, 0, stats.IndexSnapshotCount(), "absent row excluded without fetching the index")
+
+	row, stats = read("003")
+	require.NotNil(t, row)
+	assert.Equal(t, uint64(2), row.Height(), "rows written since the filter are scanned")
+	assert.Equal(t, 0, stats.IndexSnapshotCount())
+
+	row, stats = read("001")
+	require.NotNil(t, row)
+	assert.Equal(t, uint64(1), row.Height())
+	assert.Equal(t, 1, stats.IndexSnapshotCount())
+
+	// A corrupted filter excludes nothing, the reads fall back to the index
+	batch := db.store.NewBatch(zlog)
+	batch.SetRow(KeyForSingletAt(newPrimaryKeyBloomSinglet(tablet), 1), []byte("corrupted"))
+	require.NoError(t, batch.Flush(ctx))
+
+	row, stats = read("004")
+	assert.Nil(t, row)
+	assert.Equal(t, 1, stats.IndexSnapshotCount())
+
+	row, _ = read("002")
+	require.NotNil(t, row)
+	assert.Equal(t, uint64(1), row.Height())
+}
+
+func TestBloomFilter_Marshal(t *testing.T) {
+	filter := newBloomFilter(100, 0.01)
+	for i := 0; i < 100; i++ {
+		filter.add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	value := filter.marshal()
+	decoded, err := unmarshalBloomFilter(value)
+	require.NoError(t, err)
+	assert.Equal(t, filter, decoded)
+
+	value[len(value)-1] ^= 0xFF
+	_, err = unmarshalBloomFilter(value)
+	assert.Error(t, err)
+
+	_, err = unmarshalBloomFilter([]byte("short"))
+	assert.EqualError(t, err, "invalid bloom filter length 5")
+}
+
+func TestEnablePrimaryKeyBloomFilters_ExcludedKeyCost(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	db.EnablePrimaryKeyBloomFilters(0)
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b"), tablet.row(t, 1, "003", "c")))
+
+	_, err := db.ForceIndexTablet(ctx, tablet)
+	require.NoError(t, err)
+
+	writeBatchOfRequests(t, db,
+		tabletRows(2, tablet.row(t, 2, "004", "d")),
+		tabletRows(3, tablet.row(t, 3, "005", "e")),
+	)
+
+	stats := &store.ReadStats{}
+	row, err := db.ReadTabletRowAt(store.WithReadStats(ctx, stats), 3, tablet, testTabletRowPrimaryKey("006"), nil)
+	require.NoError(t, err)
+	assert.Nil(t, row)
+
+	// The bloom filter singlet, then the rows written above its height, the rows below are skipped
+	assert.Equal(t, 0, stats.IndexSnapshotCount())
+	assert.Equal(t, 2, stats.ScanCount(), "singlet fetch and rows scan")
+	assert.Equal(t, 1+2, stats.KeyCount())
+}
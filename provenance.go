@@ -0,0 +1,170 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// The collections whose tablet row values carry the provenance of the row, see
+// `EnableTabletRowProvenance` for details.
+var tabletRowProvenanceCollections = map[uint16]bool{}
+
+// The flags of the provenance header of the tablet row values
+const (
+	provenanceFlagPresent    = 0x01
+	provenanceFlagHexBlockID = 0x02
+)
+
+// RowProvenance identifies the mutation that produced a tablet row version.
+type RowProvenance struct {
+	BlockID          string
+	TransactionIndex uint32
+}
+
+func (p RowProvenance) String() string {
+	return fmt.Sprintf("%s#%d", p.BlockID, p.TransactionIndex)
+}
+
+// EnableTabletRowProvenance prefixes the values of the rows of the received tablet collection
+// with their provenance, attached to the written rows with `WithRowProvenance`, so the rows
+// read back can state which block and transaction last mutated them (see `TabletRowProvenance`).
+// The header costs a single byte for rows without provenance, the block ID being stored in its
+// binary form when it's hex encoded. The provenance of deletions is not persisted.
+//
+// **Important** This changes the storage format of the collection rows, it must be enabled
+// before any row of the collection is written and must never be disabled afterwards.
+func EnableTabletRowProvenance(collection uint16) {
+	if _, found := tabletFactories[collection]; !found {
+		panic(fmt.Errorf("collection 0x%04X is not a registered tablet collection, register its factory first", collection))
+	}
+
+	tabletRowProvenanceCollections[collection] = true
+}
+
+func tabletRowProvenanceEnabled(collection uint16) bool {
+	return tabletRowProvenanceCollections[collection]
+}
+
+type provenanceTabletRow struct {
+	TabletRow
+	provenance RowProvenance
+}
+
+// WithRowProvenance attaches the provenance to the row, persisted along with it when written if
+// its collection has provenance enabled (see `EnableTabletRowProvenance`).
+func WithRowProvenance(row TabletRow, provenance RowProvenance) TabletRow {
+	return &provenanceTabletRow{TabletRow: UnwrapTabletRow(row), provenance: provenance}
+}
+
+// TabletRowProvenance returns the provenance of the row, `found` being false when it has none.
+func TabletRowProvenance(row TabletRow) (provenance RowProvenance, found bool) {
+	if wrapped, ok := row.(*provenanceTabletRow); ok {
+		return wrapped.provenance, true
+	}
+
+	return RowProvenance{}, false
+}
+
+// UnwrapTabletRow returns the row as constructed by its tablet, the rows with a provenance being
+// wrapped to carry it.
+func UnwrapTabletRow(row TabletRow) TabletRow {
+	if wrapped, ok := row.(*provenanceTabletRow); ok {
+		return wrapped.TabletRow
+	}
+
+	return row
+}
+
+// marshalTabletRowValue returns the value of the row as stored, prefixed with its provenance
+// header when its collection has provenance enabled. Deletions are always stored empty.
+func marshalTabletRowValue(row TabletRow) ([]byte, error) {
+	if row.IsDeletion() {
+		return nil, nil
+	}
+
+	value, err := row.MarshalValue()
+	if err != nil {
+		return nil, err
+	}
+
+	if !tabletRowProvenanceEnabled(row.Tablet().Collection()) {
+		if _, found := TabletRowProvenance(row); found {
+			return nil, fmt.Errorf("row %s has a provenance but its collection 0x%04X does not have provenance enabled", row, row.Tablet().Collection())
+		}
+
+		return value, nil
+	}
+
+	provenance, found := TabletRowProvenance(row)
+	if !found {
+		return append([]byte{0x00}, value...), nil
+	}
+
+	flags := byte(provenanceFlagPresent)
+	blockID := []byte(provenance.BlockID)
+	if decoded, err := hex.DecodeString(provenance.BlockID); err == nil && hex.EncodeToString(decoded) == provenance.BlockID {
+		flags |= provenanceFlagHexBlockID
+		blockID = decoded
+	}
+
+	out := make([]byte, 1, 1+2*binary.MaxVarintLen32+len(blockID)+len(value))
+	out[0] = flags
+	out = appendUvarint(out, uint64(provenance.TransactionIndex))
+	out = appendUvarint(out, uint64(len(blockID)))
+	out = append(out, blockID...)
+
+	return append(out, value...), nil
+}
+
+// splitTabletRowProvenance splits a stored value of a row of a collection with provenance
+// enabled into the provenance, if any, and the value of the row.
+func splitTabletRowProvenance(stored []byte) (provenance *RowProvenance, value []byte, err error) {
+	if len(stored) == 0 {
+		return nil, nil, nil
+	}
+
+	flags, rest := stored[0], stored[1:]
+	if flags&provenanceFlagPresent == 0 {
+		return nil, rest, nil
+	}
+
+	transactionIndex, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, nil, errors.New("invalid provenance transaction index")
+	}
+	rest = rest[n:]
+
+	blockIDLength, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < blockIDLength {
+		return nil, nil, errors.New("invalid provenance block id")
+	}
+	rest = rest[n:]
+
+	blockID := string(rest[:blockIDLength])
+	if flags&provenanceFlagHexBlockID != 0 {
+		blockID = hex.EncodeToString(rest[:blockIDLength])
+	}
+
+	return &RowProvenance{BlockID: blockID, TransactionIndex: uint32(transactionIndex)}, rest[blockIDLength:], nil
+}
+
+func appendUvarint(out []byte, value uint64) []byte {
+	var buffer [binary.MaxVarintLen64]byte
+	return append(out, buffer[:binary.PutUvarint(buffer[:], value)]...)
+}
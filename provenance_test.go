@@ -0,0 +1,110 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTabletRowProvenance(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	EnableTabletRowProvenance(testTabletCollection)
+	defer delete(tabletRowProvenanceCollections, testTabletCollection)
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:   1,
+			BlockRef: bstream.NewBlockRef("00000001aa", 1),
+			TabletRows: []TabletRow{
+				WithRowProvenance(tablet.row(t, 1, "001", "a"), RowProvenance{BlockID: "00000001aa", TransactionIndex: 3}),
+				WithRowProvenance(tablet.row(t, 1, "002", "b"), RowProvenance{BlockID: "not-hex", TransactionIndex: 300}),
+				tablet.row(t, 1, "003", "c"),
+			},
+		},
+		&WriteRequest{
+			Height:     2,
+			BlockRef:   bstream.NewBlockRef("00000002aa", 2),
+			TabletRows: []TabletRow{WithRowProvenance(tablet.row(t, 2, "003", ""), RowProvenance{BlockID: "00000002aa"})},
+		},
+	)
+
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+
+	provenance, found := TabletRowProvenance(rows[0])
+	require.True(t, found)
+	assert.Equal(t, RowProvenance{BlockID: "00000001aa", TransactionIndex: 3}, provenance)
+	assert.Equal(t, tablet.row(t, 1, "001", "a"), UnwrapTabletRow(rows[0]))
+
+	row, err := db.ReadTabletRowAt(ctx, 2, tablet, testTabletRowPrimaryKey("002"), nil)
+	require.NoError(t, err)
+
+	provenance, found = TabletRowProvenance(row)
+	require.True(t, found)
+	assert.Equal(t, RowProvenance{BlockID: "not-hex", TransactionIndex: 300}, provenance)
+	assert.Equal(t, tablet.row(t, 1, "002", "b"), UnwrapTabletRow(row))
+
+	row, err = db.ReadTabletRowAt(ctx, 1, tablet, testTabletRowPrimaryKey("003"), nil)
+	require.NoError(t, err)
+
+	_, found = TabletRowProvenance(row)
+	assert.False(t, found)
+	assert.Equal(t, tablet.row(t, 1, "003", "c"), row)
+}
+
+func TestTabletRowProvenance_ProtoRoundTrip(t *testing.T) {
+	EnableTabletRowProvenance(testTabletCollection)
+	defer delete(tabletRowProvenanceCollections, testTabletCollection)
+
+	tablet := newTestTablet("tbl")
+	request := &WriteRequest{
+		Height:     1,
+		BlockRef:   bstream.NewBlockRef("00000001aa", 1),
+		TabletRows: []TabletRow{WithRowProvenance(tablet.row(t, 1, "001", "a"), RowProvenance{BlockID: "00000001aa", TransactionIndex: 7})},
+	}
+
+	protoRequest, err := request.ToProto()
+	require.NoError(t, err)
+
+	decoded, err := NewWriteRequestFromProto(protoRequest)
+	require.NoError(t, err)
+	assert.Equal(t, request.TabletRows, decoded.TabletRows)
+}
+
+func TestTabletRowProvenance_CollectionNotEnabled(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	err := db.WriteBatch(context.Background(), []*WriteRequest{{
+		Height:     1,
+		BlockRef:   bstream.NewBlockRef("00000001aa", 1),
+		TabletRows: []TabletRow{WithRowProvenance(tablet.row(t, 1, "001", "a"), RowProvenance{BlockID: "00000001aa"})},
+	}})
+	assert.Error(t, err)
+}
+
+func TestSplitTabletRowProvenance(t *testing.T) {
+	_, _, err := splitTabletRowProvenance([]byte{provenanceFlagPresent, 0x01, 0x05, 0xaa})
+	assert.Equal(t, errors.New("invalid provenance block id"), err)
+
+	provenance, value, err := splitTabletRowProvenance([]byte{0x00, 'a'})
+	require.NoError(t, err)
+	assert.Nil(t, provenance)
+	assert.Equal(t, []byte("a"), value)
+}
+
+func TestEnableTabletRowProvenance_UnknownCollection(t *testing.T) {
+	panicked, value := didPanic(func() { EnableTabletRowProvenance(0xEEEE) })
+	require.True(t, panicked)
+	assert.Equal(t, errors.New("collection 0xEEEE is not a registered tablet collection, register its factory first"), value)
+}
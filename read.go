@@ -19,9 +19,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math"
 	"sort"
 
+	"github.com/abourget/llerrgroup"
 	"github.com/dfuse-io/bstream"
 	"github.com/dfuse-io/dtracing"
 	"github.com/dfuse-io/fluxdb/store"
@@ -31,77 +31,187 @@ import (
 	"go.uber.org/zap"
 )
 
+// TabletRowOrder is the order of the rows returned by the tablet reads, see `SetTabletRowOrder`.
+type TabletRowOrder int
+
+const (
+	// TabletRowOrderAscending sorts the rows by ascending primary key bytes, the default
+	TabletRowOrderAscending TabletRowOrder = iota
+
+	// TabletRowOrderDescending sorts the rows by descending primary key bytes
+	TabletRowOrderDescending
+)
+
+func (o TabletRowOrder) String() string {
+	switch o {
+	case TabletRowOrderAscending:
+		return "ascending"
+	case TabletRowOrderDescending:
+		return "descending"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(o))
+	}
+}
+
+// ParseTabletRowOrder returns the order named `name`, as returned by `TabletRowOrder.String`.
+func ParseTabletRowOrder(name string) (TabletRowOrder, error) {
+	for _, order := range []TabletRowOrder{TabletRowOrderAscending, TabletRowOrderDescending} {
+		if order.String() == name {
+			return order, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown tablet row order %q, valid values are ascending and descending", name)
+}
+
+func sortTabletRows(rows []TabletRow, order TabletRowOrder) {
+	if order == TabletRowOrderDescending {
+		sort.Slice(rows, func(i, j int) bool { return bytes.Compare(rows[i].PrimaryKey(), rows[j].PrimaryKey()) > 0 })
+		return
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return bytes.Compare(rows[i].PrimaryKey(), rows[j].PrimaryKey()) < 0 })
+}
+
+// ReadTabletAt returns the rows of the tablet at `height`, with the speculative writes applied
+// over them. The rows are always sorted by primary key, in the order configured through
+// `SetTabletRowOrder`, whether they were resolved from the tablet index, scanned or come from
+// the speculative writes.
 func (fdb *FluxDB) ReadTabletAt(
 	ctx context.Context,
 	height uint64,
 	tablet Tablet,
 	speculativeWrites []*WriteRequest,
+) ([]TabletRow, error) {
+	return fdb.ReadTabletAtWithFilter(ctx, height, tablet, nil, speculativeWrites)
+}
+
+// TabletRowFilter restricts the rows of a tablet read by `ReadTabletAtWithFilter` to those
+// whose primary key matches all of its set criteria.
+type TabletRowFilter struct {
+	// Prefix, when set, only keeps the primary keys starting with it
+	Prefix []byte
+
+	// Start and End, when set, only keep the primary keys in the `[Start, End)` range
+	Start []byte
+	End   []byte
+
+	// Match, when set, only keeps the primary keys for which it returns true
+	Match func(primaryKey []byte) bool
+}
+
+func (f *TabletRowFilter) matches(primaryKey []byte) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.Prefix != nil && !bytes.HasPrefix(primaryKey, f.Prefix) {
+		return false
+	}
+
+	if f.Start != nil && bytes.Compare(primaryKey, f.Start) < 0 {
+		return false
+	}
+
+	if f.End != nil && bytes.Compare(primaryKey, f.End) >= 0 {
+		return false
+	}
+
+	return f.Match == nil || f.Match(primaryKey)
+}
+
+// ReadTabletAtWithFilter reads the rows of the tablet at `height` whose primary key matches
+// the filter, all of them when it's nil. The rows referenced by the tablet index are filtered
+// before being fetched, so only the matching ones are retrieved from the store, the rows
+// written above the index are filtered as they are scanned.
+func (fdb *FluxDB) ReadTabletAtWithFilter(
+	ctx context.Context,
+	height uint64,
+	tablet Tablet,
+	filter *TabletRowFilter,
+	speculativeWrites []*WriteRequest,
 ) ([]TabletRow, error) {
 	ctx, span := dtracing.StartSpan(ctx, "read tablet", "tablet", tablet, "height", height)
 	defer span.End()
 
+	ctx, err := fdb.interceptRead(ctx, ReadOperationTablet, tablet, nil, height)
+	if err != nil {
+		return nil, err
+	}
+
+	if height, err = fdb.committedReadHeight(ctx, height, speculativeWrites); err != nil {
+		return nil, err
+	}
+
+	if err := fdb.checkSpeculativeWrites(ctx, speculativeWrites); err != nil {
+		return nil, err
+	}
+
+	if filter != nil || len(speculativeWrites) > 0 {
+		return fdb.readTablet(ctx, height, tablet, filter, speculativeWrites)
+	}
+
+	return fdb.readCoalescer.do(ctx, coalescedReadKey(tablet, height), func() ([]TabletRow, error) {
+		return fdb.readTablet(ctx, height, tablet, nil, nil)
+	})
+}
+
+// readTablet resolves the rows of the tablet at `height`, the read being already intercepted and
+// its height resolved.
+func (fdb *FluxDB) readTablet(
+	ctx context.Context,
+	height uint64,
+	tablet Tablet,
+	filter *TabletRowFilter,
+	speculativeWrites []*WriteRequest,
+) ([]TabletRow, error) {
+	release, err := fdb.readLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	zlogger := logging.Logger(ctx, zlog)
 	zlogger.Debug("reading tablet", zap.Stringer("tablet", tablet), zap.Uint64("height", height))
 
-	idx, err := fdb.ReadTabletIndexAt(ctx, tablet, height)
-	if err != nil {
-		return nil, fmt.Errorf("fetch tablet index: %w", err)
+	// A tablet known to have no row at or below `missingHeight` has no index either
+	committed := fdb.missingKeys.committedHeight()
+	missingHeight, knownMissing := fdb.missingKeys.lookup(KeyForTablet(tablet))
+
+	var idx *TabletIndex
+	if !knownMissing {
+		if idx, err = fdb.ReadTabletIndexAt(ctx, tablet, height); err != nil {
+			return nil, fmt.Errorf("fetch tablet index: %w", err)
+		}
 	}
 
 	startKey := KeyForTabletAt(tablet, 0)
 	endKey := KeyForTabletAt(tablet, height+1)
+	fdb.hotKeys.sample(hotKeysRead, tablet, startKey)
 
 	var rowByPrimaryKey *primaryKeyToTabletRowMap
-	if idx != nil {
+	if knownMissing {
+		zlogger.Debug("tablet known to be missing, only reading rows above", zap.Uint64("missing_height", missingHeight))
+		startKey = KeyForTabletAt(tablet, missingHeight+1)
+		rowByPrimaryKey = newPrimaryKeyToTabletRowMap(8)
+	} else if idx != nil {
 		idxRowCount := idx.RowCount()
 		zlogger.Debug("tablet index exists, reconciling it", zap.Uint64("height", idx.AtHeight), zap.Uint64("row_count", idxRowCount))
 		startKey = KeyForTabletAt(tablet, idx.AtHeight+1)
 
 		// Let's pre-allocated `rowByPrimaryKey`, it's likely to need at least as much rows as in the index itself
 		rowByPrimaryKey = newPrimaryKeyToTabletRowMap(int(idxRowCount))
-		keys := idx.PrimaryKeyToHeight.rowKeys(tablet, height)
+		keys := idx.PrimaryKeyToHeight.rowKeys(tablet, filter)
 
 		// Fetch all rows in the index.. could be millions
-		// We need to batch so that the RowList, when serialized, doesn't blow up 1MB
-		// We should batch in 10,000 key reads, we can parallelize those...
-		chunkSize := 5000
-		chunks := int(math.Ceil(float64(len(keys)) / float64(chunkSize)))
-
-		zlogger.Debug("reading index rows chunks", zap.Int("chunk_count", chunks))
-		for i := 0; i < chunks; i++ {
-			chunkStart := i * chunkSize
-			chunkEnd := (i + 1) * chunkSize
-			max := len(keys)
-			if max < chunkEnd {
-				chunkEnd = max
-			}
-
-			keysChunk := keys[chunkStart:chunkEnd]
-			zlogger.Debug("reading tablet index rows chunk", zap.Int("chunk_index", i), zap.Int("key_count", len(keysChunk)))
-
-			keyRead := false
-			err := fdb.store.FetchTabletRows(ctx, keysChunk, func(key []byte, value []byte) error {
-				if len(value) == 0 {
-					return fmt.Errorf("indexes mappings should not contain empty data, empty rows don't make sense in a tablet index, row %q", Key(key))
-				}
-
-				row, err := NewTabletRow(tablet, key, value)
-				if err != nil {
-					return fmt.Errorf("tablet index new row %q: %w", Key(key), err)
-				}
+		rowsPerChunk, err := fdb.fetchTabletIndexRows(ctx, tablet, keys)
+		if err != nil {
+			return nil, err
+		}
 
+		for _, rows := range rowsPerChunk {
+			for _, row := range rows {
 				rowByPrimaryKey.put(row.PrimaryKey(), row)
-
-				keyRead = true
-				return nil
-			})
-
-			if err != nil {
-				return nil, fmt.Errorf("reading tablet index rows chunk %d: %w", i, err)
-			}
-
-			if !keyRead {
-				return nil, fmt.Errorf("reading a tablet index yielded no row, had %d keys in chunk", len(keysChunk))
 			}
 		}
 
@@ -121,29 +231,53 @@ func (fdb *FluxDB) ReadTabletAt(
 	deletedCount := 0
 	updatedCount := 0
 
-	err = fdb.store.ScanTabletRows(ctx, startKey, endKey, func(key []byte, value []byte) error {
-		row, err := NewTabletRow(tablet, key, value)
-		if err != nil {
-			return fmt.Errorf("tablet new row %q: %w", Key(key), err)
-		}
+	scannedCount := 0
+	cacheHit := knownMissing && height <= missingHeight
+	if cacheHit {
+		recordMissingKeysCacheHit(ctx)
+	} else {
+		err = fdb.store.ScanTabletRows(ctx, startKey, endKey, func(key []byte, value []byte) error {
+			scannedCount++
 
-		if row.IsDeletion() {
-			deletedCount++
-			rowByPrimaryKey.delete(row.PrimaryKey())
+			row, err := NewTabletRow(tablet, key, value)
+			if err != nil {
+				return fmt.Errorf("tablet new row %q: %w", Key(key), err)
+			}
 
-			return nil
-		}
+			if !filter.matches(row.PrimaryKey()) {
+				return nil
+			}
 
-		updatedCount++
-		rowByPrimaryKey.put(row.PrimaryKey(), row)
+			if row.IsDeletion() {
+				deletedCount++
+				rowByPrimaryKey.delete(row.PrimaryKey())
 
-		return nil
-	})
+				return nil
+			}
 
-	if err != nil {
-		return nil, err
+			updatedCount++
+			rowByPrimaryKey.put(row.PrimaryKey(), row)
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	if fdb.missingKeys != nil && !cacheHit {
+		switch {
+		case knownMissing && scannedCount > 0:
+			// The tablet exists now, its index must be used again
+			fdb.missingKeys.forgetTablet(tablet)
+		case idx == nil && scannedCount == 0:
+			fdb.recordMissing(ctx, KeyForTablet(tablet), height, committed)
+		}
+	}
+
+	fdb.recordTabletRead(tablet, deletedCount+updatedCount)
+
 	zlogger.Debug("reading tablet rows from speculative writes",
 		zap.Int("accumulated_row_count", rowByPrimaryKey.len()),
 		zap.Int("deleted_count", deletedCount),
@@ -153,7 +287,7 @@ func (fdb *FluxDB) ReadTabletAt(
 
 	for _, speculativeWrite := range speculativeWrites {
 		for _, speculativeRow := range speculativeWrite.TabletRows {
-			if !TabletEqual(tablet, speculativeRow.Tablet()) {
+			if !TabletEqual(tablet, speculativeRow.Tablet()) || !filter.matches(speculativeRow.PrimaryKey()) {
 				continue
 			}
 
@@ -170,7 +304,7 @@ func (fdb *FluxDB) ReadTabletAt(
 	zlogger.Debug("post-processing tablet rows", zap.Int("row_count", rowByPrimaryKey.len()))
 
 	rows := rowByPrimaryKey.values()
-	sort.Slice(rows, func(i, j int) bool { return bytes.Compare(rows[i].PrimaryKey(), rows[j].PrimaryKey()) < 0 })
+	sortTabletRows(rows, fdb.tabletRowOrder)
 
 	zlogger.Debug("finished reading tablet rows", zap.Int("deleted_count", deletedCount), zap.Int("updated_count", updatedCount))
 	return rows, nil
@@ -186,18 +320,46 @@ func (fdb *FluxDB) ReadTabletRowAt(
 	ctx, span := dtracing.StartSpan(ctx, "read tablet row", "tablet", tablet, "height", height, "primaryKey", primaryKey)
 	defer span.End()
 
+	ctx, err := fdb.interceptRead(ctx, ReadOperationTabletRow, tablet, nil, height)
+	if err != nil {
+		return nil, err
+	}
+
+	if height, err = fdb.committedReadHeight(ctx, height, speculativeWrites); err != nil {
+		return nil, err
+	}
+
+	if err := fdb.checkSpeculativeWrites(ctx, speculativeWrites); err != nil {
+		return nil, err
+	}
+
 	zlogger := logging.Logger(ctx, zlog)
 	zlogger.Debug("reading tablet row", zap.Stringer("tablet", tablet), zap.Uint64("height", height), zap.Stringer("primary_key", primaryKey))
 
-	idx, err := fdb.ReadTabletIndexAt(ctx, tablet, height)
+	primaryKeyBytes := primaryKey.Bytes()
+	bloomHeight, excluded, err := fdb.excludedByPrimaryKeyBloom(ctx, tablet, height, primaryKeyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("fetch tablet index: %w", err)
+		return nil, err
+	}
+
+	// The row was absent at the height of the bloom filter, only the rows written since matter
+	var idx *TabletIndex
+	if !excluded {
+		idx, err = fdb.ReadTabletIndexAt(ctx, tablet, height)
+		if err != nil {
+			return nil, fmt.Errorf("fetch tablet index: %w", err)
+		}
 	}
 
 	startKey := KeyForTabletAt(tablet, 0)
 	endKey := KeyForTabletAt(tablet, height+1)
+	fdb.hotKeys.sample(hotKeysRead, tablet, startKey)
+
+	if excluded {
+		zlogger.Debug("primary key excluded by bloom filter", zap.Uint64("height", bloomHeight))
+		startKey = KeyForTabletAt(tablet, bloomHeight+1)
+	}
 
-	primaryKeyBytes := primaryKey.Bytes()
 	var row TabletRow
 	if idx != nil {
 		idxRowCount := idx.RowCount()
@@ -305,19 +467,121 @@ func (fdb *FluxDB) ReadSingletEntryAt(
 	ctx, span := dtracing.StartSpan(ctx, "read singlet entry", "singlet", singlet, "height", height)
 	defer span.End()
 
+	ctx, err := fdb.interceptRead(ctx, ReadOperationSingletEntry, nil, singlet, height)
+	if err != nil {
+		return nil, err
+	}
+
+	if height, err = fdb.committedReadHeight(ctx, height, speculativeWrites); err != nil {
+		return nil, err
+	}
+
+	if err := fdb.checkSpeculativeWrites(ctx, speculativeWrites); err != nil {
+		return nil, err
+	}
+
+	entry, err := fdb.fetchSingletEntry(ctx, singlet, height)
+	if err != nil {
+		return nil, err
+	}
+
+	return applySpeculativeSingletEntries(ctx, singlet, entry, speculativeWrites), nil
+}
+
+// The amount of singlets fetched concurrently by `ReadSingletEntriesAt`
+const batchedSingletReadParallelism = 8
+
+// ReadSingletEntriesAt reads the entries of several singlets at `height`, like
+// `ReadSingletEntryAt` would for each of them, `entries[i]` being the one of `singlets[i]`,
+// `nil` when it has no entry. The singlets are fetched from the store concurrently, so the
+// latency of the read is the one of a single store round-trip instead of one per singlet.
+func (fdb *FluxDB) ReadSingletEntriesAt(
+	ctx context.Context,
+	singlets []Singlet,
+	height uint64,
+	speculativeWrites []*WriteRequest,
+) (entries []SingletEntry, err error) {
+	ctx, span := dtracing.StartSpan(ctx, "read singlet entries", "singlet_count", len(singlets), "height", height)
+	defer span.End()
+
+	contexts := make([]context.Context, len(singlets))
+	for i, singlet := range singlets {
+		if contexts[i], err = fdb.interceptRead(ctx, ReadOperationSingletEntry, nil, singlet, height); err != nil {
+			return nil, err
+		}
+	}
+
+	if height, err = fdb.committedReadHeight(ctx, height, speculativeWrites); err != nil {
+		return nil, err
+	}
+
+	if err := fdb.checkSpeculativeWrites(ctx, speculativeWrites); err != nil {
+		return nil, err
+	}
+
+	entries = make([]SingletEntry, len(singlets))
+	eg := llerrgroup.New(batchedSingletReadParallelism)
+	for i, singlet := range singlets {
+		if eg.Stop() {
+			break
+		}
+
+		i, singlet := i, singlet
+		eg.Go(func() error {
+			entry, err := fdb.fetchSingletEntry(contexts[i], singlet, height)
+			if err != nil {
+				return fmt.Errorf("singlet %s: %w", singlet, err)
+			}
+
+			entries[i] = applySpeculativeSingletEntries(contexts[i], singlet, entry, speculativeWrites)
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// fetchSingletEntry returns the entry of the singlet stored at or below `height`, `nil` when
+// there is none or when it's a deletion.
+func (fdb *FluxDB) fetchSingletEntry(ctx context.Context, singlet Singlet, height uint64) (entry SingletEntry, err error) {
 	// We are using inverted block num, so we are scanning from highest block num (request block num) to lowest block (0)
 	startKey := KeyForSingletAt(singlet, height)
 	endKey := KeyForSingletAt(singlet, 0)
+	fdb.hotKeys.sample(hotKeysRead, nil, startKey)
+
+	committed := fdb.missingKeys.committedHeight()
+	singletKey := KeyForSinglet(singlet)
+	missingHeight, knownMissing := fdb.missingKeys.lookup(singletKey)
+	if knownMissing {
+		if height <= missingHeight {
+			recordMissingKeysCacheHit(ctx)
+			return nil, nil
+		}
+
+		// There is no entry at or below the missing height, only the ones above it are fetched
+		endKey = KeyForSingletAt(singlet, missingHeight)
+	}
 
 	zlog := logging.Logger(ctx, zlog)
 	zlog.Debug("reading singlet entry from database", zap.Stringer("singlet", singlet), zap.Uint64("height", height), zap.Stringer("start_key", startKey), zap.Stringer("end_key", endKey))
 
-	var entry SingletEntry
 	key, value, err := fdb.store.FetchSingletEntry(ctx, startKey, endKey)
 	if err != nil {
 		return nil, fmt.Errorf("db fetch single entry: %w", err)
 	}
 
+	if fdb.missingKeys != nil {
+		if len(key) == 0 {
+			fdb.recordMissing(ctx, singletKey, height, committed)
+		} else if knownMissing {
+			fdb.missingKeys.forgetSinglet(singlet)
+		}
+	}
+
 	// If there is a key set (record found) and the value is non-nil (it's NOT a deleted entry), then populated it
 	if len(key) > 0 && len(value) > 0 {
 		entry, err = NewSingletEntry(singlet, key, value)
@@ -326,6 +590,13 @@ func (fdb *FluxDB) ReadSingletEntryAt(
 		}
 	}
 
+	return entry, nil
+}
+
+// applySpeculativeSingletEntries returns the entry of the singlet once the speculative writes
+// are applied on top of `entry`, the one read from the store.
+func applySpeculativeSingletEntries(ctx context.Context, singlet Singlet, entry SingletEntry, speculativeWrites []*WriteRequest) SingletEntry {
+	zlog := logging.Logger(ctx, zlog)
 	zlog.Debug("reading singlet entry from speculative writes", zap.Bool("db_exist", entry != nil), zap.Int("speculative_write_count", len(speculativeWrites)))
 	for _, writeRequest := range speculativeWrites {
 		for _, speculativeEntry := range writeRequest.SingletEntries {
@@ -342,14 +613,19 @@ func (fdb *FluxDB) ReadSingletEntryAt(
 	}
 
 	zlog.Debug("finished reading singlet entry", zap.Bool("entry_exist", entry != nil))
-	return entry, nil
+	return entry
 }
 
 func (fdb *FluxDB) HasSeenAnyRowForTablet(ctx context.Context, tablet Tablet) (exists bool, err error) {
 	ctx, span := dtracing.StartSpan(ctx, "has seen tablet row", "tablet", tablet.String())
 	defer span.End()
 
-	return fdb.store.HasTabletRow(ctx, KeyForTabletAt(tablet, 0), KeyForTabletAt(tablet, math.MaxUint64))
+	if fdb.tabletExistence.contains(KeyForTablet(tablet)) {
+		recordTabletExistenceCacheHit(ctx)
+		return true, nil
+	}
+
+	return fdb.probeTabletExistence(ctx, tablet)
 }
 
 func (fdb *FluxDB) FetchLastWrittenCheckpoint(ctx context.Context) (height uint64, block bstream.BlockRef, err error) {
@@ -374,7 +650,106 @@ func (fdb *FluxDB) FetchLastWrittenCheckpoint(ctx context.Context) (height uint6
 	return
 }
 
+// FetchShardLastWrittenBlock returns the last block written by the shard of a sharded injection,
+// a 0 height along with `bstream.BlockRefEmpty` when the shard did not write anything yet.
+func (fdb *FluxDB) FetchShardLastWrittenBlock(ctx context.Context, shardIndex int) (height uint64, block bstream.BlockRef, err error) {
+	if shardIndex < 0 {
+		return 0, nil, fmt.Errorf("invalid shard index %d", shardIndex)
+	}
+
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, shardCheckpointKey(shardIndex))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return 0, bstream.BlockRefEmpty, nil
+		}
+
+		return 0, nil, fmt.Errorf("kv store: %w", err)
+	}
+
+	height, block, err = unmarshalCheckpoint(value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to unmarshal shard %d checkpoint: %w", shardIndex, err)
+	}
+
+	return
+}
+
+// FetchShardsSafeServeBlock returns the lowest last written block of the `shardCount` shards of
+// a sharded injection, the highest block fully written by all of them, so serving layers can
+// clamp the heights they are asked for to what's actually complete. An `*ErrHoleInShards` error
+// is returned while any shard did not write anything yet.
+//
+// The shards checkpoints are deleted once a sharded injection completed (see
+// `DeleteAllShardCheckpoints`), the last written checkpoint must be used from then on.
+func (fdb *FluxDB) FetchShardsSafeServeBlock(ctx context.Context, shardCount int) (height uint64, block bstream.BlockRef, err error) {
+	if shardCount <= 0 {
+		return 0, nil, fmt.Errorf("invalid shard count %d", shardCount)
+	}
+
+	missingShardIndex := -1
+	highestBlockNum := uint64(0)
+	for shardIndex := 0; shardIndex < shardCount; shardIndex++ {
+		shardHeight, shardBlock, err := fdb.FetchShardLastWrittenBlock(ctx, shardIndex)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if bstream.EqualsBlockRefs(shardBlock, bstream.BlockRefEmpty) {
+			if missingShardIndex == -1 {
+				missingShardIndex = shardIndex
+			}
+			continue
+		}
+
+		if shardBlock.Num() > highestBlockNum {
+			highestBlockNum = shardBlock.Num()
+		}
+
+		if block == nil || shardHeight < height {
+			height, block = shardHeight, shardBlock
+		}
+	}
+
+	if missingShardIndex != -1 {
+		return 0, bstream.BlockRefEmpty, &ErrHoleInShards{ShardIndex: missingShardIndex, ExpectedBlock: highestBlockNum}
+	}
+
+	return
+}
+
+// LastIrreversibleBlock returns the last irreversible block persisted by the writer, serving
+// layers can drop any speculative write at or below it since it's now part of the store. For
+// databases written before it was tracked, the last written checkpoint is returned instead.
+func (fdb *FluxDB) LastIrreversibleBlock(ctx context.Context) (height uint64, block bstream.BlockRef, err error) {
+	if fdb.IsSharding() {
+		return fdb.FetchLastWrittenCheckpoint(ctx)
+	}
+
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, lastIrreversibleRowKey)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return fdb.FetchLastWrittenCheckpoint(ctx)
+		}
+
+		return 0, nil, fmt.Errorf("kv store: %w", err)
+	}
+
+	height, block, err = unmarshalCheckpoint(value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to unmarshal last irreversible checkpoint: %w", err)
+	}
+
+	return
+}
+
+// CheckCleanDBForSharding ensures the live injector never wrote to the store before injecting
+// shards. Always passes in index-only mode, the rows being expected to exist already, see
+// `SetIndexOnly`.
 func (fdb *FluxDB) CheckCleanDBForSharding() error {
+	if fdb.indexOnly {
+		return nil
+	}
+
 	_, err := fdb.store.FetchLastWrittenCheckpoint(context.Background(), lastCheckpointRowKey)
 	if err != nil {
 		if errors.Is(err, store.ErrNotFound) {
@@ -395,12 +770,16 @@ func (fdb *FluxDB) finalCheckpointKey() []byte {
 
 func (fdb *FluxDB) lastCheckpointKey() []byte {
 	if fdb.IsSharding() {
-		return []byte(fmt.Sprintf("shard-%03d", fdb.shardIndex))
+		return shardCheckpointKey(fdb.shardIndex)
 	}
 
 	return lastCheckpointRowKey
 }
 
+func shardCheckpointKey(shardIndex int) []byte {
+	return []byte(fmt.Sprintf("shard-%03d", shardIndex))
+}
+
 func unmarshalCheckpoint(value []byte) (height uint64, block bstream.BlockRef, err error) {
 	var checkpoint pbfluxdb.Checkpoint
 	err = proto.Unmarshal(value, &checkpoint)
@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	"github.com/dfuse-io/derr"
+	"github.com/dfuse-io/fluxdb/store"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/trace"
@@ -86,6 +87,38 @@ func TestReadTabletAt_WithIndex(t *testing.T) {
 	require.Equal(t, []TabletRow{tablet.row(t, height, "002", "abc")}, rows)
 }
 
+func TestReadTabletAt_ReadStats(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	height := uint64(123)
+	tablet := newTestTablet("tbl")
+	index := NewTabletIndex()
+	index.AtHeight = height
+	index.SquelchCount = 1
+	index.PrimaryKeyToHeight.put([]byte("002"), height)
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{TabletRows: []TabletRow{tablet.row(t, height, "002", "abc")}},
+		&WriteRequest{SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), index)}},
+	)
+	writeBatchOfRequests(t, db, tabletRows(height+1, tablet.row(t, height+1, "003", "def")))
+
+	stats := &store.ReadStats{}
+	rows, err := db.ReadTabletAt(store.WithReadStats(context.Background(), stats), height+1, tablet, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+
+	indexHeight, found := stats.IndexSnapshot()
+	assert.True(t, found)
+	assert.Equal(t, height, indexHeight)
+
+	// The index singlet entry, the row it references and the row written above it
+	assert.Equal(t, 3, stats.KeyCount())
+	assert.Equal(t, 2, stats.ScanCount(), "the index singlet entry and the rows above the index")
+	assert.Greater(t, stats.ByteCount(), 0)
+}
+
 func TestReadTabletAt_IndexThenDeleted(t *testing.T) {
 	db, closer := NewTestDB(t)
 	defer closer()
@@ -143,6 +176,114 @@ func TestReadTabletAt_IndexThenDeletedThenSpeculativeInserted(t *testing.T) {
 	require.Equal(t, tablet.row(t, height+2, "002", "def"), rows[0])
 }
 
+func TestReadTabletAtWithFilter(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	index := NewTabletIndex()
+	index.AtHeight = 10
+	for _, primaryKey := range []string{"001", "002", "101"} {
+		index.PrimaryKeyToHeight.put([]byte(primaryKey), 10)
+	}
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:         10,
+			TabletRows:     []TabletRow{tablet.row(t, 10, "001", "a"), tablet.row(t, 10, "002", "b"), tablet.row(t, 10, "101", "c")},
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), index)},
+		},
+		tabletRows(11, tablet.row(t, 11, "102", "d"), tablet.row(t, 11, "201", "e"), tablet.row(t, 11, "001", "")),
+	)
+
+	speculativeWrites := []*WriteRequest{tabletRows(12, tablet.row(t, 12, "103", "f"), tablet.row(t, 12, "202", "g"))}
+
+	rows, err := db.ReadTabletAtWithFilter(context.Background(), 12, tablet, &TabletRowFilter{Prefix: []byte("1")}, speculativeWrites)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 10, "101", "c"), tablet.row(t, 11, "102", "d"), tablet.row(t, 12, "103", "f")}, rows)
+
+	var matched []string
+	filter := &TabletRowFilter{Start: []byte("002"), End: []byte("201"), Match: func(primaryKey []byte) bool {
+		matched = append(matched, string(primaryKey))
+		return string(primaryKey) != "101"
+	}}
+
+	rows, err = db.ReadTabletAtWithFilter(context.Background(), 11, tablet, filter, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 10, "002", "b"), tablet.row(t, 11, "102", "d")}, rows)
+	assert.ElementsMatch(t, []string{"002", "101", "102"}, matched)
+
+	rows, err = db.ReadTabletAtWithFilter(context.Background(), 11, tablet, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, rows, 4)
+}
+
+func TestReadTabletAt_Order(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	index := NewTabletIndex()
+	index.AtHeight = 10
+	for _, primaryKey := range []string{"003", "001", "005"} {
+		index.PrimaryKeyToHeight.put([]byte(primaryKey), 10)
+	}
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:         10,
+			TabletRows:     []TabletRow{tablet.row(t, 10, "003", "a"), tablet.row(t, 10, "001", "b"), tablet.row(t, 10, "005", "c")},
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), index)},
+		},
+		tabletRows(11, tablet.row(t, 11, "004", "d"), tablet.row(t, 11, "000", "e")),
+	)
+
+	speculativeWrites := []*WriteRequest{tabletRows(12, tablet.row(t, 12, "002", "f"), tablet.row(t, 12, "006", "g"))}
+
+	primaryKeys := func(rows []TabletRow) (out []string) {
+		for _, row := range rows {
+			out = append(out, string(row.PrimaryKey()))
+		}
+		return
+	}
+
+	rows, err := db.ReadTabletAt(context.Background(), 12, tablet, speculativeWrites)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"000", "001", "002", "003", "004", "005", "006"}, primaryKeys(rows))
+
+	db.SetTabletRowOrder(TabletRowOrderDescending)
+
+	rows, err = db.ReadTabletAt(context.Background(), 12, tablet, speculativeWrites)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"006", "005", "004", "003", "002", "001", "000"}, primaryKeys(rows))
+
+	rows, err = index.Rows(tablet)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"001", "003", "005"}, primaryKeys(rows))
+}
+
+func TestParseTabletRowOrder(t *testing.T) {
+	for _, order := range []TabletRowOrder{TabletRowOrderAscending, TabletRowOrderDescending} {
+		parsed, err := ParseTabletRowOrder(order.String())
+		require.NoError(t, err)
+		assert.Equal(t, order, parsed)
+	}
+
+	_, err := ParseTabletRowOrder("random")
+	assert.Error(t, err)
+}
+
+func TestPrimaryKeyToHeightMap_RowKeysWithFilter(t *testing.T) {
+	tablet := newTestTablet("tbl")
+	index := NewTabletIndex()
+	index.PrimaryKeyToHeight.put([]byte("001"), 1)
+	index.PrimaryKeyToHeight.put([]byte("101"), 2)
+
+	assert.Len(t, index.PrimaryKeyToHeight.rowKeys(tablet, nil), 2)
+	assert.Equal(t, [][]byte{KeyForTabletRowFromParts(tablet, 2, []byte("101"))}, index.PrimaryKeyToHeight.rowKeys(tablet, &TabletRowFilter{Prefix: []byte("1")}))
+	assert.Empty(t, index.PrimaryKeyToHeight.rowKeys(tablet, &TabletRowFilter{End: []byte("000")}))
+}
+
 func TestReadTabletRowAt_OnlyFromIndex(t *testing.T) {
 	db, closer := NewTestDB(t)
 	defer closer()
@@ -318,3 +459,33 @@ func fixedTraceID(hexInput string) (out trace.TraceID) {
 
 	return
 }
+
+func TestReadSingletEntriesAt(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	first := newTestSinglet("fst")
+	second := newTestSinglet("snd")
+	deleted := newTestSinglet("del")
+	empty := newTestSinglet("emp")
+
+	writeBatchOfRequests(t, db,
+		singletEntries(1, first.entry(t, 1, "a"), second.entry(t, 1, "b"), deleted.entry(t, 1, "c")),
+		singletEntries(2, first.entry(t, 2, "d"), deleted.entry(t, 2, "")),
+	)
+
+	speculativeWrites := []*WriteRequest{singletEntries(3, second.entry(t, 3, "e"))}
+
+	entries, err := db.ReadSingletEntriesAt(ctx, []Singlet{first, second, deleted, empty}, 3, speculativeWrites)
+	require.NoError(t, err)
+	assert.Equal(t, []SingletEntry{first.entry(t, 2, "d"), second.entry(t, 3, "e"), nil, nil}, entries)
+
+	entries, err = db.ReadSingletEntriesAt(ctx, []Singlet{deleted, first}, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []SingletEntry{deleted.entry(t, 1, "c"), first.entry(t, 1, "a")}, entries)
+
+	entries, err = db.ReadSingletEntriesAt(ctx, nil, 1, nil)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
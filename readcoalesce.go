@@ -0,0 +1,131 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// The error of the calls coalesced with a read that panicked, the panic being propagated to its
+// own caller only
+var errCoalescedReadPanicked = errors.New("coalesced tablet read panicked")
+
+// EnableReadCoalescing shares the resolution of a tablet among the concurrent `ReadTabletAt`
+// calls for the same tablet at the same height, the calls arriving while one is in flight wait
+// for its result instead of fetching the same rows again, collapsing the thundering herd of
+// identical requests hitting a popular tablet. The reads with a filter or speculative writes are
+// never coalesced. Must be called before serving reads.
+//
+// A coalesced call holds no read slot (see `SetMaxConcurrentReads`) and is recorded as a cache
+// hit in its read statistics. When the call in flight is canceled by its own context, the calls
+// waiting on it perform the read again.
+func (fdb *FluxDB) EnableReadCoalescing() {
+	fdb.readCoalescer = &readCoalescer{calls: map[string]*coalescedRead{}}
+}
+
+type readCoalescer struct {
+	lock  sync.Mutex
+	calls map[string]*coalescedRead
+}
+
+// coalescedRead is a read in flight, its result is set before `done` is closed.
+type coalescedRead struct {
+	done chan struct{}
+	rows []TabletRow
+	err  error
+}
+
+// do returns the result of `read`, performed once for all the concurrent calls with the same
+// key. A `nil` coalescer always performs the read.
+func (c *readCoalescer) do(ctx context.Context, key string, read func() ([]TabletRow, error)) ([]TabletRow, error) {
+	if c == nil {
+		return read()
+	}
+
+	for {
+		c.lock.Lock()
+		call, inFlight := c.calls[key]
+		if !inFlight {
+			call = &coalescedRead{done: make(chan struct{})}
+			c.calls[key] = call
+		}
+		c.lock.Unlock()
+
+		if !inFlight {
+			defer c.complete(key, call)
+
+			call.err = errCoalescedReadPanicked
+			call.rows, call.err = read()
+
+			return call.result()
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if isContextError(call.err) && ctx.Err() == nil {
+			// Canceled on behalf of its own caller only, let's read again
+			continue
+		}
+
+		metrics.CoalescedReadCount.Inc()
+		store.ReadStatsFromContext(ctx).RecordCacheHit()
+
+		return call.result()
+	}
+}
+
+// inFlight returns the amount of reads in flight.
+func (c *readCoalescer) inFlight() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.calls)
+}
+
+// complete releases the calls waiting on the read, its result must be set.
+func (c *readCoalescer) complete(key string, call *coalescedRead) {
+	c.lock.Lock()
+	delete(c.calls, key)
+	c.lock.Unlock()
+
+	close(call.done)
+}
+
+// result returns the rows read, they are shared by the coalesced calls but not the slice, each
+// caller may reorder or truncate its own.
+func (r *coalescedRead) result() ([]TabletRow, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return append(make([]TabletRow, 0, len(r.rows)), r.rows...), nil
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func coalescedReadKey(tablet Tablet, height uint64) string {
+	return string(KeyForTabletAt(tablet, height))
+}
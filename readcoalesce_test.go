@@ -0,0 +1,91 @@
+package fluxdb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnableReadCoalescing(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b")))
+
+	db.EnableReadCoalescing()
+
+	// The single read slot is held, the first read waits for it while the others coalesce
+	db.SetMaxConcurrentReads(1, 0)
+	release, err := db.readLimiter.acquire(ctx)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	stats := make([]*store.ReadStats, 5)
+	for i := range stats {
+		stats[i] = &store.ReadStats{}
+
+		wg.Add(1)
+		go func(stats *store.ReadStats) {
+			defer wg.Done()
+
+			rows, err := db.ReadTabletAt(store.WithReadStats(ctx, stats), 1, tablet, nil)
+			assert.NoError(t, err)
+			assert.Len(t, rows, 2)
+		}(stats[i])
+
+		if i == 0 {
+			require.Eventually(t, func() bool { return db.readCoalescer.inFlight() == 1 }, time.Second, time.Millisecond)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	release()
+	wg.Wait()
+
+	coalesced := 0
+	for _, stats := range stats {
+		coalesced += stats.CacheHitCount()
+	}
+	assert.Equal(t, 4, coalesced)
+	assert.Equal(t, 0, db.readCoalescer.inFlight())
+}
+
+func TestReadCoalescer_CanceledRead(t *testing.T) {
+	coalescer := &readCoalescer{calls: map[string]*coalescedRead{}}
+
+	ctx := context.Background()
+	canceledCtx, cancel := context.WithCancel(ctx)
+	started := make(chan struct{})
+
+	go coalescer.do(canceledCtx, "key", func() ([]TabletRow, error) {
+		close(started)
+		<-canceledCtx.Done()
+		return nil, canceledCtx.Err()
+	})
+	<-started
+
+	result := make(chan int)
+	go func() {
+		rows, err := coalescer.do(ctx, "key", func() ([]TabletRow, error) {
+			return []TabletRow{newTestTablet("tbl").row(t, 1, "001", "a")}, nil
+		})
+		assert.NoError(t, err)
+		result <- len(rows)
+	}()
+
+	// The waiting call reads again once the call in flight is canceled by its caller
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert.Equal(t, 1, <-result)
+
+	rows, err := (*readCoalescer)(nil).do(ctx, "key", func() ([]TabletRow, error) { return nil, nil })
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+}
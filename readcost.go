@@ -0,0 +1,139 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// Amount of rows read to determine the average size of the rows of a tablet
+const readCostSampleSize = 8
+
+// ReadCost is the predicted cost of a `ReadTabletAt` call, see `EstimateReadCost`.
+type ReadCost struct {
+	// IndexHeight is the height of the index snapshot the read starts from, 0 when the tablet
+	// has no index snapshot at the read height
+	IndexHeight uint64
+
+	// IndexedRowCount is the amount of rows of the index snapshot, fetched by key
+	IndexedRowCount int
+
+	// MaxScannedRowCount is the maximum amount of rows written past the index snapshot, all
+	// scanned, a new index snapshot being taken once reached
+	MaxScannedRowCount int
+
+	// EstimatedScannedRowCount is the amount of rows expected to be scanned past the index
+	// snapshot, the average of the previous reads of the tablet when known (adaptive indexing
+	// only), `MaxScannedRowCount` otherwise
+	EstimatedScannedRowCount int
+
+	// EstimatedKeyCount is the amount of keys expected to be fetched from the store
+	EstimatedKeyCount int
+
+	// EstimatedBytes is the amount of bytes expected to be transferred from the store, based on
+	// the average size of a sample of the rows of the tablet
+	EstimatedBytes int
+}
+
+// EstimateReadCost predicts the amount of keys fetched and bytes transferred by reading the
+// tablet at `height` with `ReadTabletAt`, using only the index snapshot metadata and a small
+// sample of the tablet rows, so API gateways can apply cost budgets before executing
+// expensive reads.
+func (fdb *FluxDB) EstimateReadCost(ctx context.Context, tablet Tablet, height uint64) (*ReadCost, error) {
+	index, err := fdb.ReadTabletIndexAt(ctx, tablet, height)
+	if err != nil {
+		return nil, fmt.Errorf("fetch tablet index: %w", err)
+	}
+
+	policy := fdb.idxCache.IndexingPolicy(KeyForTablet(tablet))
+	cost := &ReadCost{MaxScannedRowCount: maxMutationsBeforeIndexing(policy, index)}
+	if index != nil {
+		cost.IndexHeight = index.AtHeight
+		cost.IndexedRowCount = int(index.RowCount())
+	}
+
+	cost.EstimatedScannedRowCount = cost.MaxScannedRowCount
+	if average, found := fdb.idxCache.AverageScannedRowCount(KeyForTablet(tablet)); found && average < cost.MaxScannedRowCount {
+		cost.EstimatedScannedRowCount = average
+	}
+	cost.EstimatedKeyCount = cost.IndexedRowCount + cost.EstimatedScannedRowCount
+
+	averageRowSize, err := fdb.sampleAverageRowSize(ctx, tablet, height, index)
+	if err != nil {
+		return nil, fmt.Errorf("sample rows: %w", err)
+	}
+	cost.EstimatedBytes = cost.EstimatedKeyCount * averageRowSize
+
+	return cost, nil
+}
+
+// sampleAverageRowSize returns the average size, key and value, of a few rows of the tablet,
+// taken from the index snapshot when present, 0 if the tablet has no row.
+func (fdb *FluxDB) sampleAverageRowSize(ctx context.Context, tablet Tablet, height uint64, index *TabletIndex) (int, error) {
+	size, count := 0, 0
+	onRow := func(key []byte, value []byte) error {
+		size += len(key) + len(value)
+		count++
+
+		if count >= readCostSampleSize {
+			return store.BreakScan
+		}
+		return nil
+	}
+
+	if index != nil && index.RowCount() > 0 {
+		keys := make([][]byte, 0, readCostSampleSize)
+		for primaryKey, rowHeight := range index.PrimaryKeyToHeight.mappings {
+			keys = append(keys, KeyForTabletRowFromParts(tablet, rowHeight.(uint64), []byte(primaryKey)))
+			if len(keys) >= readCostSampleSize {
+				break
+			}
+		}
+
+		if err := fdb.store.FetchTabletRows(ctx, keys, onRow); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := fdb.store.ScanTabletRows(ctx, KeyForTabletAt(tablet, 0), KeyForTabletAt(tablet, height+1), onRow); err != nil {
+			return 0, err
+		}
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	return size / count, nil
+}
+
+// maxMutationsBeforeIndexing returns the amount of mutations after which a tablet whose last
+// index snapshot is `index` (possibly `nil`) is indexed again under `policy`, i.e. the smallest
+// amount for which `shouldIndexMutations` holds, the thresholds growing with the mutations.
+func maxMutationsBeforeIndexing(policy IndexingPolicy, index *TabletIndex) int {
+	shouldIndex := func(mutatedRowsCount int) bool {
+		return shouldIndexMutations(policy.effectiveMutations(mutatedRowsCount), index)
+	}
+
+	upperBound := 1
+	for !shouldIndex(upperBound) {
+		upperBound *= 2
+	}
+
+	return sort.Search(upperBound, shouldIndex)
+}
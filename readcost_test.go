@@ -0,0 +1,82 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateReadCost(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 1, "002", "r #1")}},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), TabletRows: []TabletRow{tablet.row(t, 2, "003", "r #2")}},
+	)
+
+	rowSize := len(KeyForTabletRowFromParts(tablet, 1, []byte("001"))) + len("r #1")
+
+	cost, err := db.EstimateReadCost(ctx, tablet, 2)
+	require.NoError(t, err)
+	assert.Equal(t, &ReadCost{
+		MaxScannedRowCount:       25000,
+		EstimatedScannedRowCount: 25000,
+		EstimatedKeyCount:        25000,
+		EstimatedBytes:           25000 * rowSize,
+	}, cost)
+
+	require.NoError(t, db.repairIndex(ctx, tablet, 1))
+
+	cost, err = db.EstimateReadCost(ctx, tablet, 2)
+	require.NoError(t, err)
+	assert.Equal(t, &ReadCost{
+		IndexHeight:              1,
+		IndexedRowCount:          2,
+		MaxScannedRowCount:       25000,
+		EstimatedScannedRowCount: 25000,
+		EstimatedKeyCount:        25002,
+		EstimatedBytes:           25002 * rowSize,
+	}, cost)
+
+	db.EnableAdaptiveIndexing()
+	cost, err = db.EstimateReadCost(ctx, tablet, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 100000, cost.MaxScannedRowCount, "tablet never read is indexed with the relaxed policy")
+
+	_, err = db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+
+	cost, err = db.EstimateReadCost(ctx, tablet, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cost.EstimatedScannedRowCount, "average of previous reads should be used when known")
+	assert.Equal(t, 3, cost.EstimatedKeyCount)
+
+	cost, err = db.EstimateReadCost(ctx, newTestTablet("emp"), 2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cost.EstimatedBytes, "tablet without rows")
+}
+
+func TestMaxMutationsBeforeIndexing(t *testing.T) {
+	indexOfSize := func(rowCount int) *TabletIndex {
+		index := NewTabletIndex()
+		for i := 0; i < rowCount; i++ {
+			index.PrimaryKeyToHeight.put([]byte{byte(i >> 16), byte(i >> 8), byte(i)}, 1)
+		}
+		return index
+	}
+
+	assert.Equal(t, 25000, maxMutationsBeforeIndexing(IndexingPolicyDefault, nil))
+	assert.Equal(t, 25000, maxMutationsBeforeIndexing(IndexingPolicyDefault, indexOfSize(10)))
+	assert.Equal(t, 60001, maxMutationsBeforeIndexing(IndexingPolicyDefault, indexOfSize(120000)))
+	assert.Equal(t, 100000, maxMutationsBeforeIndexing(IndexingPolicyDefault, indexOfSize(300000)))
+
+	assert.Equal(t, 5000, maxMutationsBeforeIndexing(IndexingPolicyTight, nil))
+	assert.Equal(t, 100000, maxMutationsBeforeIndexing(IndexingPolicyRelaxed, nil))
+	assert.Equal(t, 400000, maxMutationsBeforeIndexing(IndexingPolicyRelaxed, indexOfSize(300000)))
+}
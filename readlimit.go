@@ -0,0 +1,100 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+)
+
+// ErrTooManyRequests is returned by the heavy reads that waited longer than the queue timeout
+// for one of the concurrent reads slots, see `SetMaxConcurrentReads`. Serving layers should map
+// it to a retryable "too many requests" error.
+type ErrTooManyRequests struct {
+	MaxConcurrentReads int
+	Waited             time.Duration
+}
+
+func (e *ErrTooManyRequests) Error() string {
+	return fmt.Sprintf("too many requests, no read slot freed up out of %d after waiting %s", e.MaxConcurrentReads, e.Waited)
+}
+
+// SetMaxConcurrentReads limits the amount of heavy reads (full tablet resolutions, i.e.
+// `ReadTabletAt` and its variants, and `ParallelScanTabletRows`) performed concurrently to
+// `max`, protecting the store from read storms (e.g. clients retrying during an incident). The
+// reads above the limit are queued, failing with an `*ErrTooManyRequests` error when no slot
+// freed up within `queueTimeout`, 0 meaning they wait as long as their context allows. A `max`
+// of 0 removes the limit. Must be called before serving reads.
+//
+// A heavy read holds its slot until it returns, the callback of `ParallelScanTabletRows` must
+// then not perform heavy reads itself, it could otherwise wait on its own slot.
+func (fdb *FluxDB) SetMaxConcurrentReads(max int, queueTimeout time.Duration) {
+	if max <= 0 {
+		fdb.readLimiter = nil
+		return
+	}
+
+	fdb.readLimiter = &readLimiter{
+		slots:        make(chan struct{}, max),
+		queueTimeout: queueTimeout,
+	}
+}
+
+type readLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// acquire waits for a read slot, returning the function releasing it. A `nil` limiter never
+// waits.
+func (l *readLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	release = func() { <-l.slots }
+
+	// Fast path, no queueing (nor timer) when a slot is free
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	metrics.QueuedReadCount.Inc()
+	defer metrics.QueuedReadCount.Dec()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		metrics.TooManyRequestsCount.Inc()
+		return nil, &ErrTooManyRequests{MaxConcurrentReads: cap(l.slots), Waited: time.Since(start)}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetMaxConcurrentReads(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a")))
+
+	db.SetMaxConcurrentReads(1, 10*time.Millisecond)
+
+	release, err := db.readLimiter.acquire(ctx)
+	require.NoError(t, err)
+
+	_, err = db.ReadTabletAt(ctx, 1, tablet, nil)
+	var tooMany *ErrTooManyRequests
+	require.True(t, errors.As(err, &tooMany), "expected too many requests, got %v", err)
+	assert.Equal(t, 1, tooMany.MaxConcurrentReads)
+	assert.True(t, tooMany.Waited >= 10*time.Millisecond)
+
+	err = db.ParallelScanTabletRows(ctx, tablet, 1, 2, func(row TabletRow) error { return nil })
+	assert.True(t, errors.As(err, &tooMany), "expected too many requests, got %v", err)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	db.SetMaxConcurrentReads(1, 0)
+	blocked, err := db.readLimiter.acquire(ctx)
+	require.NoError(t, err)
+
+	_, err = db.ReadTabletAt(canceledCtx, 1, tablet, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	// A read queued until a slot frees up
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		blocked()
+	}()
+
+	rows, err := db.ReadTabletAt(ctx, 1, tablet, nil)
+	require.NoError(t, err)
+	assert.Len(t, rows, 1)
+
+	release()
+	db.SetMaxConcurrentReads(0, 0)
+	assert.Nil(t, db.readLimiter)
+}
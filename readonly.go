@@ -0,0 +1,49 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/readonly"
+)
+
+// SetReadOnly puts the instance in read-only mode, for serve-only replicas pointed at a store
+// owned by another writer. `WriteBatch` is rejected with a `*store.ErrReadOnly` error and the
+// store is wrapped in a read-only one (see the `readonly` package), so any other write (purges,
+// repairs, migrations, leases, ...) is rejected too, whatever the configuration. The pipeline
+// can still run to serve speculative writes, it fails as soon as it tries to write a block.
+//
+// Must be called right after `New`, before the instance is used, it cannot be reverted.
+func (fdb *FluxDB) SetReadOnly() {
+	if fdb.readOnly {
+		return
+	}
+
+	fdb.readOnly = true
+	fdb.store = readonly.NewStore(fdb.store)
+}
+
+// IsReadOnly returns whether the instance is in read-only mode, see `SetReadOnly`.
+func (fdb *FluxDB) IsReadOnly() bool {
+	return fdb.readOnly
+}
+
+func (fdb *FluxDB) checkWritable(operation string) error {
+	if fdb.readOnly {
+		return &store.ErrReadOnly{Operation: operation}
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db, tabletRows(1, tablet.row(t, 1, "001", "a")))
+
+	replica := New(db.store, nil, nil, false)
+	replica.SetReadOnly()
+	replica.SetReadOnly()
+	assert.True(t, replica.IsReadOnly())
+
+	rows, err := replica.ReadTabletAt(ctx, 1, tablet, nil)
+	require.NoError(t, err)
+	assert.Len(t, rows, 1)
+
+	var readOnly *store.ErrReadOnly
+	err = replica.WriteBatch(ctx, []*WriteRequest{tabletRows(2, tablet.row(t, 2, "002", "b"))})
+	require.True(t, errors.As(err, &readOnly))
+	assert.Equal(t, "write batch", readOnly.Operation)
+
+	// Writes bypassing `WriteBatch` are rejected by the store
+	assert.True(t, errors.As(replica.DeleteAllShardCheckpoints(ctx), &readOnly))
+
+	height, _, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), height)
+}
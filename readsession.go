@@ -0,0 +1,87 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+)
+
+// ReadSession pins a sequence of reads to a single block, the last block fully written to the
+// store when the session was created, so all of them observe the same consistent state while
+// the pipeline keeps writing newer blocks. It's meant for API endpoints answering with the
+// result of several queries, which must be consistent with each other.
+//
+// The rows of a block never change once written, a session can then be used for as long as
+// needed, as long as it stays within the history retention of the store (see
+// `SetRetentionPolicy`). It's safe for concurrent use.
+type ReadSession struct {
+	fdb    *FluxDB
+	height uint64
+	block  bstream.BlockRef
+}
+
+// NewReadSession returns a session whose reads are all performed at the last block fully
+// written to the store, see `FetchSafeServeBlock`.
+func (fdb *FluxDB) NewReadSession(ctx context.Context) (*ReadSession, error) {
+	height, block, err := fdb.FetchSafeServeBlock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch safe serve block: %w", err)
+	}
+
+	return &ReadSession{fdb: fdb, height: height, block: block}, nil
+}
+
+// Height returns the height all the reads of the session are performed at.
+func (s *ReadSession) Height() uint64 {
+	return s.height
+}
+
+// Block returns the block all the reads of the session observe, `bstream.BlockRefEmpty` when
+// the store was empty when the session was created.
+func (s *ReadSession) Block() bstream.BlockRef {
+	return s.block
+}
+
+// ReadTablet reads the rows of the tablet at the height of the session, see `ReadTabletAt`.
+func (s *ReadSession) ReadTablet(ctx context.Context, tablet Tablet) ([]TabletRow, error) {
+	return s.fdb.ReadTabletAt(ctx, s.height, tablet, nil)
+}
+
+// ReadTabletWithFilter reads the rows of the tablet matching the filter at the height of the
+// session, see `ReadTabletAtWithFilter`.
+func (s *ReadSession) ReadTabletWithFilter(ctx context.Context, tablet Tablet, filter *TabletRowFilter) ([]TabletRow, error) {
+	return s.fdb.ReadTabletAtWithFilter(ctx, s.height, tablet, filter, nil)
+}
+
+// ReadTabletRow reads a single row of the tablet at the height of the session, see
+// `ReadTabletRowAt`.
+func (s *ReadSession) ReadTabletRow(ctx context.Context, tablet Tablet, primaryKey TabletRowPrimaryKey) (TabletRow, error) {
+	return s.fdb.ReadTabletRowAt(ctx, s.height, tablet, primaryKey, nil)
+}
+
+// ReadSingletEntry reads the entry of the singlet at the height of the session, see
+// `ReadSingletEntryAt`.
+func (s *ReadSession) ReadSingletEntry(ctx context.Context, singlet Singlet) (SingletEntry, error) {
+	return s.fdb.ReadSingletEntryAt(ctx, singlet, s.height, nil)
+}
+
+// ReadSingletEntries reads the entries of several singlets at the height of the session, see
+// `ReadSingletEntriesAt`.
+func (s *ReadSession) ReadSingletEntries(ctx context.Context, singlets []Singlet) ([]SingletEntry, error) {
+	return s.fdb.ReadSingletEntriesAt(ctx, singlets, s.height, nil)
+}
@@ -0,0 +1,67 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSession(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	empty, err := db.NewReadSession(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), empty.Height())
+	assert.Equal(t, bstream.BlockRefEmpty, empty.Block())
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+	writeBatchOfRequests(t, db,
+		tabletRows(10, tablet.row(t, 10, "001", "a"), tablet.row(t, 10, "002", "b")),
+		singletEntries(10, singlet.entry(t, 10, "s1")),
+	)
+
+	session, err := db.NewReadSession(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), session.Height())
+
+	// The pipeline advances while the session is in use
+	writeBatchOfRequests(t, db,
+		tabletRows(20, tablet.row(t, 20, "001", ""), tablet.row(t, 20, "003", "c")),
+		singletEntries(20, singlet.entry(t, 20, "s2")),
+	)
+
+	rows, err := session.ReadTablet(ctx, tablet)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 10, "001", "a"), tablet.row(t, 10, "002", "b")}, rows)
+
+	row, err := session.ReadTabletRow(ctx, tablet, rawPrimaryKey([]byte("001")))
+	require.NoError(t, err)
+	require.NotNil(t, row)
+	assert.Equal(t, "a", row.(testTabletRow).data())
+
+	row, err = session.ReadTabletRow(ctx, tablet, rawPrimaryKey([]byte("003")))
+	require.NoError(t, err)
+	assert.Nil(t, row)
+
+	entry, err := session.ReadSingletEntry(ctx, singlet)
+	require.NoError(t, err)
+	assert.Equal(t, "s1", entry.(testSingletEntry).data())
+
+	entries, err := session.ReadSingletEntries(ctx, []Singlet{singlet})
+	require.NoError(t, err)
+	assert.Equal(t, "s1", entries[0].(testSingletEntry).data())
+
+	latest, err := db.NewReadSession(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), latest.Height())
+
+	rows, err = latest.ReadTabletWithFilter(ctx, tablet, &TabletRowFilter{Prefix: []byte("00")})
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 10, "002", "b"), tablet.row(t, 20, "003", "c")}, rows)
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+	"go.uber.org/zap"
+)
+
+// RebuildOptions are the options of `RebuildFromArchive`.
+type RebuildOptions struct {
+	// StartHeight is the first height written when the store is empty, the state below it must
+	// already be in the store (e.g. bootstrapped from a snapshot), 0 means the start of the archive
+	StartHeight uint64
+
+	// StopHeight is the last height written, 0 means the end of the archive
+	StopHeight uint64
+
+	// DecodeParallelism is the amount of archive objects decoded concurrently, ahead of the
+	// writes which are sequential, 0 means a default of 1
+	DecodeParallelism int
+
+	// OnProgress, when set, is called each time an archive object was written
+	OnProgress func(progress RebuildProgress)
+}
+
+// RebuildProgress reports the progress of `RebuildFromArchive`.
+type RebuildProgress struct {
+	Filename     string
+	RequestCount int
+	LastHeight   uint64
+	Elapsed      time.Duration
+}
+
+type decodedArchiveObject struct {
+	filename string
+	requests []*WriteRequest
+	err      error
+}
+
+// RebuildFromArchive writes the batches of an archive store, either an incremental backup (see
+// `EnableIncrementalBackup`) or the segments of a single shard (or snapshot), above the last
+// written checkpoint and up to `options.StopHeight`, returning the height of the last written
+// block. The archive objects are decoded concurrently, ahead of the writes. An interrupted
+// rebuild is resumed by running it again.
+//
+// When bulk-load mode is enabled (see `SetDeferIndexing`), the deferred indexes are built once
+// the whole archive was written.
+func (fdb *FluxDB) RebuildFromArchive(ctx context.Context, archiveStore dstore.Store, options RebuildOptions) (lastHeight uint64, err error) {
+	empty, err := fdb.IsEmpty(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	startAfter := uint64(0)
+	if !empty {
+		if lastHeight, _, err = fdb.FetchLastWrittenCheckpoint(ctx); err != nil {
+			return 0, fmt.Errorf("fetch last written checkpoint: %w", err)
+		}
+
+		startAfter = lastHeight
+	} else if options.StartHeight > 0 {
+		startAfter = options.StartHeight - 1
+	}
+
+	filenames, err := fdb.archiveFilenames(ctx, archiveStore, startAfter, options.StopHeight)
+	if err != nil {
+		return lastHeight, err
+	}
+
+	zlog.Info("rebuilding from archive",
+		zap.Uint64("last_height", lastHeight),
+		zap.Uint64("start_after", startAfter),
+		zap.Uint64("stop_height", options.StopHeight),
+		zap.Int("object_count", len(filenames)),
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	decoded := fdb.decodeArchiveObjects(ctx, archiveStore, filenames, startAfter, options.DecodeParallelism)
+
+	start := time.Now()
+	written := false
+	for object := range decoded {
+		if object.err != nil {
+			return lastHeight, object.err
+		}
+
+		// Objects can overlap when a backed up batch was retried
+		requests := object.requests
+		for len(requests) > 0 && written && requests[0].Height <= lastHeight {
+			requests = requests[1:]
+		}
+
+		for i, req := range requests {
+			if options.StopHeight != 0 && req.Height > options.StopHeight {
+				requests = requests[:i]
+				break
+			}
+		}
+
+		if len(requests) == 0 {
+			continue
+		}
+
+		if (!empty || written) && requests[0].Height != lastHeight+1 {
+			return lastHeight, fmt.Errorf("archive object %s resumes at height %d, we were expecting %d, there is a hole in the archive", object.filename, requests[0].Height, lastHeight+1)
+		}
+
+		if err := fdb.WriteBatch(ctx, requests); err != nil {
+			return lastHeight, fmt.Errorf("write batch %q: %w", object.filename, err)
+		}
+
+		lastHeight = requests[len(requests)-1].Height
+		written = true
+
+		if options.OnProgress != nil {
+			options.OnProgress(RebuildProgress{Filename: object.filename, RequestCount: len(requests), LastHeight: lastHeight, Elapsed: time.Since(start)})
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return lastHeight, err
+	}
+
+	if fdb.deferIndexing && written {
+		zlog.Info("building deferred indexes now that the archive was written")
+		if err := fdb.IndexTables(ctx); err != nil {
+			return lastHeight, fmt.Errorf("index deferred tables: %w", err)
+		}
+	}
+
+	zlog.Info("rebuilt from archive", zap.Uint64("last_height", lastHeight), zap.Duration("elapsed", time.Since(start)))
+	return lastHeight, nil
+}
+
+// archiveFilenames returns, in order, the names of the objects of the archive store containing
+// heights above `startAfter` and up to `stopHeight` (all of them when 0).
+func (fdb *FluxDB) archiveFilenames(ctx context.Context, archiveStore dstore.Store, startAfter, stopHeight uint64) (filenames []string, err error) {
+	err = archiveStore.Walk(ctx, "", "", func(filename string) error {
+		if filename == shardingConfigFilename {
+			return nil
+		}
+
+		first, last, err := parseFileName(filename)
+		if err != nil {
+			return err
+		}
+
+		if stopHeight != 0 && first > stopHeight {
+			return dstore.StopIteration
+		}
+
+		if last > startAfter {
+			filenames = append(filenames, filename)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("walking archive store: %w", err)
+	}
+
+	return filenames, nil
+}
+
+// decodeArchiveObjects decodes the requests above `startAfter` of the archive objects, up to
+// `parallelism` of them concurrently, and sends them in order on the returned channel, which is
+// closed once all were sent, on the first error or when the context is cancelled.
+func (fdb *FluxDB) decodeArchiveObjects(ctx context.Context, archiveStore dstore.Store, filenames []string, startAfter uint64, parallelism int) <-chan *decodedArchiveObject {
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	// Each object gets its own slot, the amount of in-flight slots bounds the decoded objects kept in memory
+	slots := make(chan chan *decodedArchiveObject, parallelism)
+	go func() {
+		defer close(slots)
+
+		for _, filename := range filenames {
+			slot := make(chan *decodedArchiveObject, 1)
+			select {
+			case <-ctx.Done():
+				return
+			case slots <- slot:
+			}
+
+			filename := filename
+			go func() {
+				requests, err := readArchiveObject(ctx, archiveStore, filename, startAfter)
+				slot <- &decodedArchiveObject{filename: filename, requests: requests, err: err}
+			}()
+		}
+	}()
+
+	out := make(chan *decodedArchiveObject)
+	go func() {
+		defer close(out)
+
+		for slot := range slots {
+			var object *decodedArchiveObject
+			select {
+			case <-ctx.Done():
+				return
+			case object = <-slot:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- object:
+			}
+
+			if object.err != nil {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// readArchiveObject reads the requests above `startAfter` of the archive object.
+func readArchiveObject(ctx context.Context, archiveStore dstore.Store, filename string, startAfter uint64) ([]*WriteRequest, error) {
+	reader, err := archiveStore.OpenObject(ctx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("open archive object %q: %w", filename, err)
+	}
+	defer reader.Close()
+
+	requests, err := ReadShard(reader, startAfter)
+	if err != nil {
+		return nil, fmt.Errorf("read archive object %q: %w", filename, err)
+	}
+
+	return requests, nil
+}
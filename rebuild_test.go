@@ -0,0 +1,63 @@
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildFromArchive(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	dir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	archiveStore, err := dstore.NewLocalStore(dir, "", "", true)
+	require.NoError(t, err)
+	db.EnableIncrementalBackup(archiveStore)
+
+	tablet := newTestTablet("tbl")
+	for height := uint64(1); height <= 6; height++ {
+		writeBatchOfRequests(t, db, &WriteRequest{
+			Height:     height,
+			BlockRef:   bstream.NewBlockRef(fmt.Sprintf("%08xaa", height), height),
+			TabletRows: []TabletRow{tablet.row(t, height, fmt.Sprintf("%03d", height), fmt.Sprintf("r #%d", height))},
+		})
+	}
+
+	rebuilt, closer := NewTestDB(t)
+	defer closer()
+	rebuilt.SetDeferIndexing(0)
+
+	var progresses []RebuildProgress
+	lastHeight, err := rebuilt.RebuildFromArchive(ctx, archiveStore, RebuildOptions{
+		StopHeight:        5,
+		DecodeParallelism: 3,
+		OnProgress:        func(progress RebuildProgress) { progresses = append(progresses, progress) },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), lastHeight)
+
+	require.Len(t, progresses, 5)
+	for i, progress := range progresses {
+		assert.Equal(t, uint64(i+1), progress.LastHeight, "objects are written in order")
+	}
+
+	expected, err := db.ReadTabletAt(ctx, 5, tablet, nil)
+	require.NoError(t, err)
+
+	rows, err := rebuilt.ReadTabletAt(ctx, 5, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, expected, rows)
+
+	lastHeight, err = rebuilt.RebuildFromArchive(ctx, archiveStore, RebuildOptions{DecodeParallelism: 2})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), lastHeight, "rebuild resumes after the last written checkpoint")
+}
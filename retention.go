@@ -0,0 +1,139 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetentionPolicy defines the history that must stay readable, see `SetRetentionPolicy`.
+type RetentionPolicy struct {
+	// HistoryBlocks is the amount of blocks below the last irreversible block whose reads must
+	// stay exact
+	HistoryBlocks uint64
+
+	// MinShadowedVersions is the minimum amount of shadowed versions a primary key must have for
+	// them to be compacted, so rarely updated rows are left alone, 0 meaning any
+	MinShadowedVersions int
+}
+
+// SetRetentionPolicy defines the history that must stay readable, the row versions only needed
+// by reads older than it may be compacted, see `CompactShadowedRows`.
+func (fdb *FluxDB) SetRetentionPolicy(policy RetentionPolicy) {
+	fdb.retentionPolicy = &policy
+}
+
+// ShadowedCompactionReport is the outcome of `CompactShadowedRows`.
+type ShadowedCompactionReport struct {
+	// Height is the last irreversible block height
+	Height uint64
+
+	// RetainedHeight is the lowest height whose reads must stay exact, according to the
+	// retention policy, only the tablets indexed at or below it are compacted
+	RetainedHeight uint64
+
+	TabletCount       int
+	ShadowedRowCount  int
+	DeletedIndexCount int
+}
+
+// EnableShadowedRowCompaction runs `CompactShadowedRows` in background every `interval`, until
+// FluxDB is terminated.
+func (fdb *FluxDB) EnableShadowedRowCompaction(interval time.Duration) {
+	fdb.runPeriodically(interval, "shadowed row compaction", func(ctx context.Context) error {
+		_, err := fdb.CompactShadowedRows(ctx, nil, false)
+		return err
+	})
+}
+
+// CompactShadowedRows deletes, for each tablet (starting at `lowerBound` when set), the row
+// versions shadowed by a more recent version of their primary key, both at or below the latest
+// index snapshot under the retained height of the retention policy (see `SetRetentionPolicy`).
+// Those versions are squelched by the index snapshot, reads at or above its height never see
+// them, only the versions resolved by the index snapshot and the ones written above it are
+// kept.
+//
+// **Important** This trades history for storage, reads of a compacted tablet below the height
+// of its covering index behave as if the compacted versions never existed. The older index
+// snapshots of a compacted tablet referencing one of the compacted rows are deleted too, the
+// others are kept.
+func (fdb *FluxDB) CompactShadowedRows(ctx context.Context, lowerBound Tablet, dryRun bool) (report *ShadowedCompactionReport, err error) {
+	if fdb.IsSharding() {
+		return nil, errors.New("shadowed row compaction is not supported when sharding")
+	}
+
+	if fdb.retentionPolicy == nil {
+		return nil, errors.New("no retention policy, set one first")
+	}
+
+	height, _, err := fdb.LastIrreversibleBlock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch last irreversible block: %w", err)
+	}
+
+	report = &ShadowedCompactionReport{Height: height}
+	if height <= fdb.retentionPolicy.HistoryBlocks {
+		return report, nil
+	}
+
+	report.RetainedHeight = height - fdb.retentionPolicy.HistoryBlocks
+	if !dryRun {
+		defer func() {
+			fdb.recordAuditEvent(ctx, "compact_shadowed_rows", map[string]interface{}{
+				"height":              height,
+				"retained_height":     report.RetainedHeight,
+				"lower_bound":         tabletString(lowerBound),
+				"tablet_count":        report.TabletCount,
+				"shadowed_row_count":  report.ShadowedRowCount,
+				"deleted_index_count": report.DeletedIndexCount,
+			}, &err)
+		}()
+	}
+
+	// Deletions are versions like any other, every version but the last one of the primary key
+	// goes, see `CompactTombstones` for the last deletions. Only the keys are needed.
+	minShadowedVersions := fdb.retentionPolicy.MinShadowedVersions
+	counts, err := fdb.compactTablets(ctx, report.RetainedHeight, lowerBound, false, dryRun, func(versions []rowVersion) int {
+		shadowed := len(versions) - 1
+		if shadowed == 0 || shadowed < minShadowedVersions {
+			return 0
+		}
+
+		return shadowed
+	})
+
+	report.TabletCount = counts.tabletCount
+	report.ShadowedRowCount = counts.rowCount
+	report.DeletedIndexCount = counts.deletedIndexCount
+	if err != nil {
+		return report, err
+	}
+
+	zlog.Info("shadowed rows compacted",
+		zap.Uint64("height", height),
+		zap.Uint64("retained_height", report.RetainedHeight),
+		zap.Int("tablet_count", report.TabletCount),
+		zap.Int("shadowed_row_count", report.ShadowedRowCount),
+		zap.Int("deleted_index_count", report.DeletedIndexCount),
+		zap.Bool("dry_run", dryRun),
+	)
+
+	return report, nil
+}
@@ -0,0 +1,96 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactShadowedRows(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+
+	olderIndex := NewTabletIndex()
+	olderIndex.AtHeight = 2
+	olderIndex.PrimaryKeyToHeight.put([]byte("001"), 2)
+	olderIndex.PrimaryKeyToHeight.put([]byte("002"), 1)
+	olderIndex.PrimaryKeyToHeight.put([]byte("003"), 1)
+
+	coveringIndex := NewTabletIndex()
+	coveringIndex.AtHeight = 4
+	coveringIndex.PrimaryKeyToHeight.put([]byte("001"), 3)
+	coveringIndex.PrimaryKeyToHeight.put([]byte("002"), 1)
+	coveringIndex.PrimaryKeyToHeight.put([]byte("003"), 1)
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b"), tablet.row(t, 1, "003", "c")}},
+		&WriteRequest{
+			Height:         2,
+			BlockRef:       bstream.NewBlockRef("00000002aa", 2),
+			TabletRows:     []TabletRow{tablet.row(t, 2, "001", "d")},
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), olderIndex)},
+		},
+		&WriteRequest{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), TabletRows: []TabletRow{tablet.row(t, 3, "001", "e")}},
+		&WriteRequest{
+			Height:         4,
+			BlockRef:       bstream.NewBlockRef("00000004aa", 4),
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), coveringIndex)},
+		},
+		&WriteRequest{Height: 5, BlockRef: bstream.NewBlockRef("00000005aa", 5), TabletRows: []TabletRow{tablet.row(t, 5, "003", "f")}},
+		&WriteRequest{Height: 6, BlockRef: bstream.NewBlockRef("00000006aa", 6), TabletRows: []TabletRow{tablet.row(t, 6, "001", "g")}},
+	)
+
+	_, err := db.CompactShadowedRows(ctx, nil, false)
+	require.Error(t, err, "no retention policy")
+
+	db.SetRetentionPolicy(RetentionPolicy{HistoryBlocks: 5})
+	report, err := db.CompactShadowedRows(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, &ShadowedCompactionReport{Height: 6, RetainedHeight: 1}, report, "no index snapshot below the retained height")
+
+	db.SetRetentionPolicy(RetentionPolicy{HistoryBlocks: 1, MinShadowedVersions: 3})
+	report, err = db.CompactShadowedRows(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, &ShadowedCompactionReport{Height: 6, RetainedHeight: 5}, report, "not enough shadowed versions")
+
+	readAll := func() (out [][]TabletRow) {
+		for height := uint64(4); height <= 6; height++ {
+			rows, err := db.ReadTabletAt(ctx, height, tablet, nil)
+			require.NoError(t, err)
+			out = append(out, rows)
+		}
+
+		return
+	}
+
+	retained := readAll()
+
+	db.SetRetentionPolicy(RetentionPolicy{HistoryBlocks: 1})
+	report, err = db.CompactShadowedRows(ctx, nil, true)
+	require.NoError(t, err)
+	assert.Equal(t, &ShadowedCompactionReport{Height: 6, RetainedHeight: 5, TabletCount: 1, ShadowedRowCount: 2, DeletedIndexCount: 1}, report)
+
+	report, err = db.CompactShadowedRows(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, &ShadowedCompactionReport{Height: 6, RetainedHeight: 5, TabletCount: 1, ShadowedRowCount: 2, DeletedIndexCount: 1}, report)
+
+	report, err = db.CompactShadowedRows(ctx, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, &ShadowedCompactionReport{Height: 6, RetainedHeight: 5}, report)
+
+	assert.Equal(t, retained, readAll(), "reads at or above the covering index are unaffected")
+
+	count, err := db.CountRowVersions(ctx, tablet, []byte("001"), 0, 6)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), count)
+
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "002", "b"), tablet.row(t, 1, "003", "c")}, rows, "history below the covering index no longer has the compacted rows")
+}
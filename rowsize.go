@@ -0,0 +1,109 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	"go.uber.org/zap"
+)
+
+// RowSizePolicy determines what happens to a singlet entry or tablet row whose value is larger
+// than the maximum row size, see `SetMaxRowSize`.
+type RowSizePolicy int
+
+const (
+	// RowSizePolicyReject fails the write with an `*ErrRowTooLarge` error
+	RowSizePolicyReject RowSizePolicy = iota
+
+	// RowSizePolicySkip does not write the row at all, as if it was not part of the write request
+	RowSizePolicySkip
+
+	// RowSizePolicyTruncate writes the first bytes of the value only, up to the maximum row size,
+	// the truncated value is most probably not decodable anymore, only use it for collections
+	// whose values tolerate it
+	RowSizePolicyTruncate
+)
+
+func (p RowSizePolicy) String() string {
+	switch p {
+	case RowSizePolicyReject:
+		return "reject"
+	case RowSizePolicySkip:
+		return "skip"
+	case RowSizePolicyTruncate:
+		return "truncate"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+// ParseRowSizePolicy returns the policy named `name`, as returned by `RowSizePolicy.String`.
+func ParseRowSizePolicy(name string) (RowSizePolicy, error) {
+	for _, policy := range []RowSizePolicy{RowSizePolicyReject, RowSizePolicySkip, RowSizePolicyTruncate} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown row size policy %q, valid values are reject, skip and truncate", name)
+}
+
+// ErrRowTooLarge is the error returned when writing a singlet entry or tablet row whose value is
+// larger than the maximum row size, under the `RowSizePolicyReject` policy.
+type ErrRowTooLarge struct {
+	Key     Key
+	Size    int
+	MaxSize int
+}
+
+func (e *ErrRowTooLarge) Error() string {
+	return fmt.Sprintf("row %s value of %d bytes exceeds maximum row size of %d bytes", e.Key, e.Size, e.MaxSize)
+}
+
+// SetMaxRowSize limits the size of the values of the written singlet entries and tablet rows to
+// `maxSize` bytes, the rows exceeding it being handled according to `policy`, so a single
+// misbehaving contract cannot write values breaking the storage engine limits later on.
+func (fdb *FluxDB) SetMaxRowSize(maxSize int, policy RowSizePolicy) {
+	fdb.rowSizeLimit = &rowSizeLimit{maxSize: maxSize, policy: policy}
+}
+
+type rowSizeLimit struct {
+	maxSize int
+	policy  RowSizePolicy
+}
+
+// enforce returns the value to write for the singlet entry or tablet row at `key`, `skip` being
+// true when the row must not be written at all. Safe to call on a `nil` limit, in which case
+// the value is always written as is.
+func (l *rowSizeLimit) enforce(key []byte, value []byte) (out []byte, skip bool, err error) {
+	if l == nil || len(value) <= l.maxSize {
+		return value, false, nil
+	}
+
+	metrics.OversizedRowCount.Inc(collectionName(collectionFromKey(key)), l.policy.String())
+
+	switch l.policy {
+	case RowSizePolicySkip:
+		zlog.Warn("skipping row exceeding maximum row size", zap.Stringer("key", Key(key)), zap.Int("size", len(value)), zap.Int("max_size", l.maxSize))
+		return nil, true, nil
+	case RowSizePolicyTruncate:
+		zlog.Warn("truncating row exceeding maximum row size", zap.Stringer("key", Key(key)), zap.Int("size", len(value)), zap.Int("max_size", l.maxSize))
+		return value[:l.maxSize], false, nil
+	default:
+		return nil, false, &ErrRowTooLarge{Key: Key(key), Size: len(value), MaxSize: l.maxSize}
+	}
+}
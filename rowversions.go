@@ -0,0 +1,125 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// CountRowVersions returns the amount of versions of the tablet row with the primary key stored
+// at a height within [fromHeight, toHeight], deletions included. Only the keys of the tablet rows
+// in the height range are scanned, the values are never transferred. For collections with row
+// ordinals enabled (see `EnableTabletRowOrdinals`), each version of the row within a block is
+// counted.
+//
+// **Important** The rows elided at write time (see `EnableWriteElision`) are not stored, so
+// they are not counted.
+func (fdb *FluxDB) CountRowVersions(ctx context.Context, tablet Tablet, primaryKey []byte, fromHeight, toHeight uint64) (count uint64, err error) {
+	if fromHeight > toHeight {
+		return 0, fmt.Errorf("invalid height range, from height %d is above to height %d", fromHeight, toHeight)
+	}
+
+	versionBytes := heightBytes
+	if tabletRowOrdinalsEnabled(tablet.Collection()) {
+		versionBytes += ordinalBytes
+	}
+
+	startKey := KeyForTabletAt(tablet, fromHeight)
+	endKey := keySuccessor(KeyForTablet(tablet))
+	if toHeight < math.MaxUint64 {
+		endKey = KeyForTabletAt(tablet, toHeight+1)
+	}
+
+	primaryKeyOffset := collectionBytes + len(tablet.Identifier()) + versionBytes
+	err = fdb.store.ScanTableKeys(ctx, store.RowsTable, startKey, endKey, func(key []byte) error {
+		if len(key) >= primaryKeyOffset && bytes.Equal(key[primaryKeyOffset:], primaryKey) {
+			count++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("scan tablet %s row keys: %w", tablet, err)
+	}
+
+	return count, nil
+}
+
+// DefaultActivityBucketSize is the height range covered by each bucket of the tablet activity
+// histogram, see `TabletActivityHistogram`.
+const DefaultActivityBucketSize = 10000
+
+// ActivityBucket is the write activity of a tablet over the heights [StartHeight, EndHeight].
+type ActivityBucket struct {
+	StartHeight uint64
+	EndHeight   uint64
+
+	// RowVersionCount is the amount of row versions, deletions included, written in the bucket
+	RowVersionCount uint64
+}
+
+// TabletActivityHistogram returns the write activity of the tablet within [fromHeight, toHeight]
+// grouped by buckets of `bucketSize` heights (e.g. `DefaultActivityBucketSize`), aligned on
+// multiples of it. Only the buckets with activity are returned, ordered by height. Like
+// `CountRowVersions`, only the keys of the tablet rows in the height range are scanned.
+func (fdb *FluxDB) TabletActivityHistogram(ctx context.Context, tablet Tablet, fromHeight, toHeight uint64, bucketSize uint64) (buckets []ActivityBucket, err error) {
+	if fromHeight > toHeight {
+		return nil, fmt.Errorf("invalid height range, from height %d is above to height %d", fromHeight, toHeight)
+	}
+
+	if bucketSize == 0 {
+		return nil, errors.New("invalid bucket size, must be greater than 0")
+	}
+
+	startKey := KeyForTabletAt(tablet, fromHeight)
+	endKey := keySuccessor(KeyForTablet(tablet))
+	if toHeight < math.MaxUint64 {
+		endKey = KeyForTabletAt(tablet, toHeight+1)
+	}
+
+	heightOffset := collectionBytes + len(tablet.Identifier())
+	err = fdb.store.ScanTableKeys(ctx, store.RowsTable, startKey, endKey, func(key []byte) error {
+		if len(key) < heightOffset+heightBytes {
+			return fmt.Errorf("invalid tablet row key %q: too short", Key(key))
+		}
+
+		height := bigEndian.Uint64(key[heightOffset:])
+		bucketStart := height - height%bucketSize
+
+		// Keys are ordered by height, a new bucket is always after the previous ones
+		if len(buckets) == 0 || buckets[len(buckets)-1].StartHeight != bucketStart {
+			bucketEnd := uint64(math.MaxUint64)
+			if bucketStart <= math.MaxUint64-bucketSize {
+				bucketEnd = bucketStart + bucketSize - 1
+			}
+
+			buckets = append(buckets, ActivityBucket{StartHeight: bucketStart, EndHeight: bucketEnd})
+		}
+
+		buckets[len(buckets)-1].RowVersionCount++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan tablet %s row keys: %w", tablet, err)
+	}
+
+	return buckets, nil
+}
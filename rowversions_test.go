@@ -0,0 +1,84 @@
+package fluxdb
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountRowVersions(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	otherTablet := newTestTablet("oth")
+	writeBatchOfRequests(t, db,
+		tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b")),
+		tabletRows(2, tablet.row(t, 2, "001", "c"), otherTablet.row(t, 2, "001", "d")),
+		tabletRows(3, tablet.row(t, 3, "001", "")),
+		tabletRows(5, tablet.row(t, 5, "001", "e"), tablet.row(t, 5, "002", "f")),
+	)
+
+	tests := []struct {
+		name       string
+		primaryKey string
+		fromHeight uint64
+		toHeight   uint64
+		expected   uint64
+	}{
+		{"all versions", "001", 0, math.MaxUint64, 4},
+		{"bounds are inclusive", "001", 2, 5, 3},
+		{"single height", "001", 3, 3, 1},
+		{"no version in range", "001", 4, 4, 0},
+		{"other primary key", "002", 0, 10, 2},
+		{"unknown primary key", "003", 0, 10, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, err := db.CountRowVersions(ctx, tablet, []byte(test.primaryKey), test.fromHeight, test.toHeight)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, count)
+		})
+	}
+
+	_, err := db.CountRowVersions(ctx, tablet, []byte("001"), 5, 4)
+	assert.EqualError(t, err, "invalid height range, from height 5 is above to height 4")
+}
+
+func TestTabletActivityHistogram(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		tabletRows(1, tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b")),
+		tabletRows(9, tablet.row(t, 9, "001", "")),
+		tabletRows(10, tablet.row(t, 10, "003", "c")),
+		tabletRows(35, tablet.row(t, 35, "001", "d")),
+		tabletRows(38, newTestTablet("oth").row(t, 38, "001", "e")),
+	)
+
+	buckets, err := db.TabletActivityHistogram(ctx, tablet, 0, math.MaxUint64, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []ActivityBucket{
+		{StartHeight: 0, EndHeight: 9, RowVersionCount: 3},
+		{StartHeight: 10, EndHeight: 19, RowVersionCount: 1},
+		{StartHeight: 30, EndHeight: 39, RowVersionCount: 1},
+	}, buckets)
+
+	buckets, err = db.TabletActivityHistogram(ctx, tablet, 5, 10, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []ActivityBucket{
+		{StartHeight: 0, EndHeight: 9, RowVersionCount: 1},
+		{StartHeight: 10, EndHeight: 19, RowVersionCount: 1},
+	}, buckets, "buckets stay aligned, only the rows within the range are counted")
+
+	_, err = db.TabletActivityHistogram(ctx, tablet, 0, 10, 0)
+	assert.EqualError(t, err, "invalid bucket size, must be greater than 0")
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// ValueValidator returns an error if the raw value of a singlet entry or tablet row is malformed.
+type ValueValidator func(value []byte) error
+
+var valueValidators = map[uint16]ValueValidator{}
+
+// RegisterValueValidator registers the validator of the values of the singlet entries or tablet
+// rows of the received collection, the writes containing a malformed value (deletions excluded)
+// fail with an `*ErrInvalidValue` error, so malformed rows are never stored.
+func RegisterValueValidator(collection uint16, validator ValueValidator) {
+	if _, found := collections[collection]; !found {
+		panic(fmt.Errorf("collection 0x%04X is not registered, register its factory first", collection))
+	}
+
+	valueValidators[collection] = validator
+}
+
+// ProtoPayloadCodec is the name of the payload codec registered by `RegisterValueSchema`.
+const ProtoPayloadCodec = "proto"
+
+// RegisterValueSchema registers `message` as the schema of the values of the singlet entries or
+// tablet rows of the received collection, the values are validated on write (see
+// `RegisterValueValidator`) and decoded to JSON by `DecodeValue` and `DumpKey` (see
+// `RegisterValueDecoder`) as well as by the `ProtoPayloadCodec` payload codec (see
+// `RegisterPayloadCodec`).
+func RegisterValueSchema(collection uint16, message proto.Message) {
+	RegisterValueValidator(collection, func(value []byte) error {
+		_, err := unmarshalSchemaValue(message, value)
+		return err
+	})
+
+	RegisterValueDecoder(collection, func(value []byte) (string, error) {
+		decoded, err := unmarshalSchemaValue(message, value)
+		if err != nil {
+			return "", err
+		}
+
+		return (&jsonpb.Marshaler{}).MarshalToString(decoded)
+	})
+
+	RegisterPayloadCodec(collection, ProtoPayloadCodec, func(value []byte) (json.RawMessage, error) {
+		decoded, err := unmarshalSchemaValue(message, value)
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := (&jsonpb.Marshaler{}).MarshalToString(decoded)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.RawMessage(out), nil
+	})
+}
+
+func unmarshalSchemaValue(message proto.Message, value []byte) (proto.Message, error) {
+	decoded := proto.Clone(message)
+	decoded.Reset()
+
+	if err := proto.Unmarshal(value, decoded); err != nil {
+		return nil, fmt.Errorf("unmarshal %T: %w", message, err)
+	}
+
+	return decoded, nil
+}
+
+// DecodeValue returns the human readable form of the raw value of a singlet entry or tablet row
+// of the collection, using the decoder registered for it (see `RegisterValueDecoder`), hex
+// encoded if there is none.
+func DecodeValue(collection uint16, value []byte) (string, error) {
+	decoder, found := valueDecoders[collection]
+	if !found {
+		return hex.EncodeToString(value), nil
+	}
+
+	return decoder(value)
+}
+
+// ErrInvalidValue is the error returned when writing a singlet entry or tablet row whose value
+// is rejected by the validator of its collection, see `RegisterValueValidator`.
+type ErrInvalidValue struct {
+	Key Key
+	Err error
+}
+
+func (e *ErrInvalidValue) Error() string {
+	return fmt.Sprintf("row %s value is invalid: %s", e.Key, e.Err)
+}
+
+func (e *ErrInvalidValue) Unwrap() error {
+	return e.Err
+}
+
+// validateValue returns an `*ErrInvalidValue` error if the value of the singlet entry or tablet
+// row at `key` is rejected by the validator of its collection, if any.
+func validateValue(key []byte, value []byte) error {
+	validator, found := valueValidators[collectionFromKey(key)]
+	if !found {
+		return nil
+	}
+
+	if err := validator(value); err != nil {
+		return &ErrInvalidValue{Key: Key(key), Err: err}
+	}
+
+	return nil
+}
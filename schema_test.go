@@ -0,0 +1,78 @@
+package fluxdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch_ValueValidator(t *testing.T) {
+	RegisterValueValidator(testTabletCollection, func(value []byte) error {
+		if strings.HasPrefix(string(value), "bad") {
+			return fmt.Errorf("bad value")
+		}
+
+		return nil
+	})
+	defer delete(valueValidators, testTabletCollection)
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1")}},
+	)
+
+	err := db.WriteBatch(ctx, []*WriteRequest{
+		{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), TabletRows: []TabletRow{tablet.row(t, 2, "001", "bad #2"), tablet.row(t, 2, "002", "r #2")}},
+	})
+
+	var invalidValue *ErrInvalidValue
+	require.True(t, errors.As(err, &invalidValue), "expected invalid value error, got %s", err)
+	assert.Equal(t, Key(KeyForTabletRowVersion(tablet, 2, LastTabletRowOrdinal, []byte("001"))), invalidValue.Key)
+
+	// Deletions have no value to validate
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), TabletRows: []TabletRow{tablet.row(t, 2, "001", "")}},
+	)
+
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+}
+
+func TestRegisterValueSchema(t *testing.T) {
+	RegisterValueSchema(testSingletCollection, &wrappers.StringValue{})
+	defer delete(valueValidators, testSingletCollection)
+	defer delete(valueDecoders, testSingletCollection)
+	defer delete(payloadCodecs, testSingletCollection)
+
+	value, err := proto.Marshal(&wrappers.StringValue{Value: "hello"})
+	require.NoError(t, err)
+
+	assert.NoError(t, valueValidators[testSingletCollection](value))
+	assert.Error(t, valueValidators[testSingletCollection]([]byte{0xFF, 0xFF}))
+
+	decoded, err := DecodeValue(testSingletCollection, value)
+	require.NoError(t, err)
+	assert.Equal(t, `"hello"`, decoded)
+
+	entry, err := DecodeSingletEntry(newTestSinglet("sgl").entry(t, 3, string(value)), ProtoPayloadCodec)
+	require.NoError(t, err)
+	assert.Equal(t, &DecodedSingletEntry{Height: 3, Value: json.RawMessage(`"hello"`)}, entry)
+
+	decoded, err = DecodeValue(testTabletCollection, []byte{0xAB})
+	require.NoError(t, err)
+	assert.Equal(t, "ab", decoded, "collections without decoder are hex encoded")
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+const selfCheckRepairBatchSize = 1000
+
+// ConsistencyReport is the outcome of `CheckConsistency`.
+type ConsistencyReport struct {
+	CheckpointHeight   uint64
+	HighestRowHeight   uint64
+	HighestIndexHeight uint64
+
+	// TornKeyCount is the amount of singlet entries, tablet rows and index snapshots written
+	// above the last written checkpoint, left behind by a flush that crashed before its
+	// checkpoint was written
+	TornKeyCount int
+	Repaired     bool
+}
+
+// IsConsistent returns whether the store is consistent, possibly once repaired.
+func (r *ConsistencyReport) IsConsistent() bool {
+	return r.TornKeyCount == 0 || r.Repaired
+}
+
+// CheckConsistency verifies that no singlet entry, tablet row nor index snapshot was written
+// above the last written checkpoint (the one of the current shard when sharding, considering
+// only the keys of the shard), which happens when the process crashed while flushing, the
+// checkpoint being always written after the rows it covers. When `repair` is true, the torn
+// keys are purged, they are written again when the blocks above the checkpoint are processed.
+//
+// **Important** This scans the whole rows table, it's meant to be run on start, before writing.
+func (fdb *FluxDB) CheckConsistency(ctx context.Context, repair bool) (*ConsistencyReport, error) {
+	checkpointHeight, _, err := fdb.FetchLastWrittenCheckpoint(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch last written checkpoint: %w", err)
+	}
+
+	report := &ConsistencyReport{CheckpointHeight: checkpointHeight}
+	var tornKeys [][]byte
+
+	err = fdb.store.ScanTableKeys(ctx, store.RowsTable, nil, nil, func(key []byte) error {
+		shardKey, height, isIndex, err := selfCheckKey(key)
+		if err != nil {
+			return err
+		}
+
+		if fdb.IsSharding() && fdb.shardFunction(shardKey, fdb.shardCount) != fdb.shardIndex {
+			return nil
+		}
+
+		if isIndex && height > report.HighestIndexHeight {
+			report.HighestIndexHeight = height
+		} else if !isIndex && height > report.HighestRowHeight {
+			report.HighestRowHeight = height
+		}
+
+		if height > checkpointHeight {
+			report.TornKeyCount++
+			if repair {
+				tornKeys = append(tornKeys, append([]byte(nil), key...))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan rows: %w", err)
+	}
+
+	if report.TornKeyCount > 0 && repair {
+		zlog.Warn("purging keys written above last written checkpoint", zap.Int("torn_key_count", report.TornKeyCount), zap.Uint64("checkpoint_height", checkpointHeight))
+		var purgeErr error
+		for start := 0; start < len(tornKeys) && purgeErr == nil; start += selfCheckRepairBatchSize {
+			end := start + selfCheckRepairBatchSize
+			if end > len(tornKeys) {
+				end = len(tornKeys)
+			}
+
+			purgeErr = fdb.store.DeleteTableKeys(ctx, store.RowsTable, tornKeys[start:end])
+		}
+
+		fdb.recordAuditEvent(ctx, "purge_torn_keys", map[string]interface{}{"checkpoint_height": checkpointHeight, "torn_key_count": report.TornKeyCount}, &purgeErr)
+		if purgeErr != nil {
+			return report, fmt.Errorf("purge torn keys: %w", purgeErr)
+		}
+
+		report.Repaired = true
+	}
+
+	zlog.Info("store consistency checked",
+		zap.Uint64("checkpoint_height", report.CheckpointHeight),
+		zap.Uint64("highest_row_height", report.HighestRowHeight),
+		zap.Uint64("highest_index_height", report.HighestIndexHeight),
+		zap.Int("torn_key_count", report.TornKeyCount),
+		zap.Bool("repaired", report.Repaired),
+	)
+
+	return report, nil
+}
+
+// selfCheckKey decodes the height of a singlet entry or tablet row key, along with the key
+// determining its shard, index snapshots and their primary key bloom filters belonging to the
+// shard of their tablet.
+func selfCheckKey(key []byte) (shardKey []byte, height uint64, isIndex bool, err error) {
+	if _, isSinglet := singletFactories[collectionFromKey(key)]; !isSinglet {
+		row, err := NewTabletRowFromStorage(key, nil)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("invalid tablet row key %q: %w", Key(key), err)
+		}
+
+		return KeyForTablet(row.Tablet()), row.Height(), false, nil
+	}
+
+	singlet, err := NewSinglet(key)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("invalid singlet entry key %q: %w", Key(key), err)
+	}
+
+	singletKey := KeyForSinglet(singlet)
+	if len(key) < len(singletKey)+heightBytes {
+		return nil, 0, false, fmt.Errorf("invalid singlet entry key %q: too short", Key(key))
+	}
+
+	height = ^bigEndian.Uint64(key[len(singletKey):])
+	if index, ok := singlet.(indexSinglet); ok {
+		return index.tabletKey, height, true, nil
+	}
+
+	// Written along with the index snapshots
+	if bloom, ok := singlet.(primaryKeyBloomSinglet); ok {
+		return bloom.tabletKey, height, true, nil
+	}
+
+	if blockTime, ok := singlet.(blockTimeSinglet); ok && blockTime.kind == blockTimeToHeight {
+		// Stored at a time, not a height, an entry written above the checkpoint is written again,
+		// identical, when its block is processed again
+		return singletKey, 0, false, nil
+	}
+
+	return singletKey, height, false, nil
+}
@@ -0,0 +1,64 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+	index := NewTabletIndex()
+	index.AtHeight = 10
+	index.PrimaryKeyToHeight.put([]byte("001"), 10)
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:         10,
+			BlockRef:       bstream.NewBlockRef("0000000aaa", 10),
+			TabletRows:     []TabletRow{tablet.row(t, 10, "001", "a")},
+			SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), index)},
+		},
+	)
+
+	report, err := db.CheckConsistency(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, &ConsistencyReport{CheckpointHeight: 10, HighestRowHeight: 10, HighestIndexHeight: 10}, report)
+	assert.True(t, report.IsConsistent())
+
+	// Simulates a flush that crashed after writing the rows of block 11 but before its checkpoint
+	tornIndex := NewTabletIndex()
+	tornIndex.AtHeight = 11
+	batch := db.store.NewBatch(zlog)
+	batch.SetRow(KeyForTabletRow(tablet.row(t, 11, "002", "b")), []byte("b"))
+	batch.SetRow(KeyForSingletEntry(newIndexSingletEntry(newIndexSinglet(tablet), tornIndex)), []byte{0x00})
+	require.NoError(t, batch.Flush(ctx))
+
+	report, err = db.CheckConsistency(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, &ConsistencyReport{CheckpointHeight: 10, HighestRowHeight: 11, HighestIndexHeight: 11, TornKeyCount: 2}, report)
+	assert.False(t, report.IsConsistent())
+
+	// Keys of other shards are not considered
+	db.SetSharding(1-shardOfKey(KeyForTablet(tablet), 2), 2)
+	report, err = db.CheckConsistency(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.TornKeyCount)
+	db.SetSharding(0, 0)
+
+	report, err = db.CheckConsistency(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.TornKeyCount)
+	assert.True(t, report.IsConsistent())
+
+	report, err = db.CheckConsistency(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, &ConsistencyReport{CheckpointHeight: 10, HighestRowHeight: 10, HighestIndexHeight: 10}, report)
+}
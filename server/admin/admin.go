@@ -0,0 +1,238 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin serves the operational endpoints of a FluxDB instance, meant to be mounted by
+// embedding applications on an internal listener, never exposed publicly:
+//
+//   - `GET /pipeline` returns the `PipelineStatus`
+//   - `POST /pipeline/pause` pauses the pipeline once its pending writes are flushed
+//   - `POST /pipeline/resume` resumes the paused pipeline
+//   - `POST /tablets/index?tablet=<tablet key hex>` forces an index snapshot of the tablet
+//   - `GET /collections/stats` returns the persisted write statistics of the collections
+//   - `GET /tablets/indexing-policies` returns the indexing policies learned by the adaptive
+//     indexing
+//   - `GET /hotkeys` returns the hottest tablets and row prefixes, when hot keys sampling is
+//     enabled
+package admin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/dfuse-io/fluxdb"
+	"go.uber.org/zap"
+)
+
+// Server serves the admin endpoints of a FluxDB instance.
+type Server struct {
+	db *fluxdb.FluxDB
+}
+
+func NewServer(db *fluxdb.FluxDB) *Server {
+	return &Server{db: db}
+}
+
+// PipelineStatus is the state of the pipeline as served by the endpoints, `Error` being set
+// when the requested operation failed.
+type PipelineStatus struct {
+	Paused bool   `json:"paused"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TabletIndexStatus is the index snapshot forced by the endpoint, `Error` being set when it
+// could not be built.
+type TabletIndexStatus struct {
+	Tablet          string `json:"tablet,omitempty"`
+	AtHeight        uint64 `json:"at_height,omitempty"`
+	PrimaryKeyCount uint64 `json:"primary_key_count,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// Handler returns the HTTP handler serving the admin endpoints, responding with JSON.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pipeline", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.servePipeline(w, nil)
+	})
+	mux.HandleFunc("/pipeline/pause", s.pipelineOperation(s.db.PausePipeline))
+	mux.HandleFunc("/pipeline/resume", s.pipelineOperation(s.db.ResumePipeline))
+	mux.HandleFunc("/tablets/index", s.forceIndexTablet)
+	mux.HandleFunc("/collections/stats", s.collectionWriteStats)
+	mux.HandleFunc("/tablets/indexing-policies", s.tabletIndexingPolicies)
+	mux.HandleFunc("/hotkeys", s.hotKeys)
+
+	return mux
+}
+
+func (s *Server) pipelineOperation(operation func(ctx context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.servePipeline(w, operation(r.Context()))
+	}
+}
+
+func (s *Server) servePipeline(w http.ResponseWriter, err error) {
+	status := &PipelineStatus{Paused: s.db.IsPipelinePaused()}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		zlog.Warn("pipeline operation failed", zap.Error(err))
+		status.Error = err.Error()
+
+		if errors.Is(err, fluxdb.ErrNoPipeline) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		zlog.Debug("unable to write pipeline status", zap.Error(err))
+	}
+}
+
+func (s *Server) forceIndexTablet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	tablet, err := tabletFromKeyHex(r.URL.Query().Get("tablet"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &TabletIndexStatus{Error: err.Error()})
+		return
+	}
+
+	index, err := s.db.ForceIndexTablet(r.Context(), tablet)
+	if err != nil {
+		zlog.Warn("force tablet index failed", zap.Stringer("tablet", tablet), zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, &TabletIndexStatus{Tablet: tablet.String(), Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &TabletIndexStatus{
+		Tablet:          tablet.String(),
+		AtHeight:        index.AtHeight,
+		PrimaryKeyCount: index.RowCount(),
+	})
+}
+
+// CollectionWriteStatsResponse holds the write statistics of the collections, see
+// `fluxdb.EnableCollectionWriteStats`, `Error` being set when they could not be fetched.
+type CollectionWriteStatsResponse struct {
+	Collections []*fluxdb.CollectionWriteStats `json:"collections"`
+	Error       string                         `json:"error,omitempty"`
+}
+
+func (s *Server) collectionWriteStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := s.db.FetchCollectionWriteStats(r.Context())
+	if err != nil {
+		zlog.Warn("fetch collection write stats failed", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, &CollectionWriteStatsResponse{Error: err.Error()})
+		return
+	}
+
+	if stats == nil {
+		stats = []*fluxdb.CollectionWriteStats{}
+	}
+
+	writeJSON(w, http.StatusOK, &CollectionWriteStatsResponse{Collections: stats})
+}
+
+// TabletIndexingPoliciesResponse holds the indexing policies learned for the tablets, see
+// `fluxdb.EnableAdaptiveIndexing`, empty when the adaptive indexing is not enabled.
+type TabletIndexingPoliciesResponse struct {
+	Policies []*fluxdb.TabletIndexingPolicy `json:"policies"`
+}
+
+func (s *Server) tabletIndexingPolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	policies := s.db.TabletIndexingPolicies()
+	if policies == nil {
+		policies = []*fluxdb.TabletIndexingPolicy{}
+	}
+
+	writeJSON(w, http.StatusOK, &TabletIndexingPoliciesResponse{Policies: policies})
+}
+
+// HotKeysResponse holds the hot keys report, see `fluxdb.EnableHotKeysSampling`, `Error` being
+// set when it is not available.
+type HotKeysResponse struct {
+	*fluxdb.HotKeysReport
+	Error string `json:"error,omitempty"`
+}
+
+func (s *Server) hotKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := s.db.HotKeys()
+	if report == nil {
+		writeJSON(w, http.StatusNotFound, &HotKeysResponse{Error: "hot keys sampling is not enabled"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &HotKeysResponse{HotKeysReport: report})
+}
+
+func tabletFromKeyHex(in string) (fluxdb.Tablet, error) {
+	if in == "" {
+		return nil, errors.New("missing tablet key, expected the hex encoded tablet key in the tablet query parameter")
+	}
+
+	key, err := hex.DecodeString(in)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tablet key: %w", err)
+	}
+
+	tablet, err := fluxdb.NewTablet(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tablet key: %w", err)
+	}
+
+	return tablet, nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zlog.Debug("unable to write response", zap.Error(err))
+	}
+}
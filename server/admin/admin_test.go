@@ -0,0 +1,201 @@
+package admin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/fluxdb"
+	"github.com/dfuse-io/fluxdb/fluxdbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Pipeline(t *testing.T) {
+	db, closer := fluxdbtest.NewTestDB(t)
+	defer closer()
+
+	server := httptest.NewServer(NewServer(db).Handler())
+	defer server.Close()
+
+	call := func(method string, path string) (int, *PipelineStatus) {
+		request, err := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, err)
+
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		status := &PipelineStatus{}
+		if response.StatusCode != http.StatusMethodNotAllowed {
+			require.NoError(t, json.NewDecoder(response.Body).Decode(status))
+		}
+
+		return response.StatusCode, status
+	}
+
+	code, status := call(http.MethodPost, "/pipeline/pause")
+	assert.Equal(t, http.StatusNotFound, code, "no pipeline yet")
+	assert.Equal(t, fluxdb.ErrNoPipeline.Error(), status.Error)
+
+	fluxdb.NewHandler(db)
+
+	code, status = call(http.MethodGet, "/pipeline")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, &PipelineStatus{Paused: false}, status)
+
+	code, _ = call(http.MethodGet, "/pipeline/pause")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, status = call(http.MethodPost, "/pipeline/pause")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, &PipelineStatus{Paused: true}, status)
+
+	code, status = call(http.MethodPost, "/pipeline/resume")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, &PipelineStatus{Paused: false}, status)
+}
+
+func TestServer_ForceIndexTablet(t *testing.T) {
+	db, closer := fluxdbtest.NewTestDB(t)
+	defer closer()
+
+	server := httptest.NewServer(NewServer(db).Handler())
+	defer server.Close()
+
+	call := func(tabletKey string) (int, *TabletIndexStatus) {
+		response, err := http.Post(server.URL+"/tablets/index?tablet="+tabletKey, "", nil)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		status := &TabletIndexStatus{}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(status))
+
+		return response.StatusCode, status
+	}
+
+	tablet := fluxdbtest.NewTablet("tbl")
+	fluxdbtest.WriteBatchOfRequests(t, db, fluxdbtest.TabletRows(1, tablet.MustRow(t, 1, "001", "a"), tablet.MustRow(t, 1, "002", "b")))
+
+	code, status := call("zz")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.NotEmpty(t, status.Error)
+
+	code, status = call(hex.EncodeToString(fluxdb.KeyForTablet(tablet)))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, &TabletIndexStatus{Tablet: tablet.String(), AtHeight: 1, PrimaryKeyCount: 2}, status)
+}
+
+func TestServer_CollectionWriteStats(t *testing.T) {
+	db, closer := fluxdbtest.NewTestDB(t)
+	defer closer()
+
+	db.EnableCollectionWriteStats(1)
+
+	server := httptest.NewServer(NewServer(db).Handler())
+	defer server.Close()
+
+	call := func() (int, *CollectionWriteStatsResponse) {
+		response, err := http.Get(server.URL + "/collections/stats")
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		stats := &CollectionWriteStatsResponse{}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(stats))
+
+		return response.StatusCode, stats
+	}
+
+	code, stats := call()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []*fluxdb.CollectionWriteStats{}, stats.Collections)
+
+	tablet := fluxdbtest.NewTablet("tbl")
+	fluxdbtest.WriteBatchOfRequests(t, db, fluxdbtest.TabletRows(1, tablet.MustRow(t, 1, "001", "a"), tablet.MustRow(t, 1, "002", "b")))
+
+	code, stats = call()
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, stats.Collections, 1)
+	assert.Equal(t, fluxdbtest.TabletCollection, stats.Collections[0].Collection)
+	assert.Equal(t, fluxdbtest.TabletCollectionName, stats.Collections[0].Name)
+	assert.Equal(t, uint64(2), stats.Collections[0].RowCount)
+}
+
+func TestServer_TabletIndexingPolicies(t *testing.T) {
+	db, closer := fluxdbtest.NewTestDB(t)
+	defer closer()
+
+	server := httptest.NewServer(NewServer(db).Handler())
+	defer server.Close()
+
+	call := func() (int, *TabletIndexingPoliciesResponse) {
+		response, err := http.Get(server.URL + "/tablets/indexing-policies")
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		policies := &TabletIndexingPoliciesResponse{}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(policies))
+
+		return response.StatusCode, policies
+	}
+
+	code, policies := call()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []*fluxdb.TabletIndexingPolicy{}, policies.Policies, "adaptive indexing not enabled")
+
+	db.EnableAdaptiveIndexing()
+
+	tablet := fluxdbtest.NewTablet("tbl")
+	fluxdbtest.WriteBatchOfRequests(t, db, fluxdbtest.TabletRows(1, tablet.MustRow(t, 1, "001", "a"), tablet.MustRow(t, 1, "002", "b")))
+
+	_, err := db.ReadTabletAt(context.Background(), 1, tablet, nil)
+	require.NoError(t, err)
+
+	code, policies = call()
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, policies.Policies, 1)
+	assert.Equal(t, fluxdb.KeyForTablet(tablet).String(), policies.Policies[0].Tablet)
+	assert.Equal(t, fluxdb.IndexingPolicyDefault.String(), policies.Policies[0].Policy)
+	assert.Equal(t, 1, policies.Policies[0].ReadCount)
+}
+
+func TestServer_HotKeys(t *testing.T) {
+	db, closer := fluxdbtest.NewTestDB(t)
+	defer closer()
+
+	server := httptest.NewServer(NewServer(db).Handler())
+	defer server.Close()
+
+	call := func() (int, *HotKeysResponse) {
+		response, err := http.Get(server.URL + "/hotkeys")
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		hotKeys := &HotKeysResponse{}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(hotKeys))
+
+		return response.StatusCode, hotKeys
+	}
+
+	code, hotKeys := call()
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.NotEmpty(t, hotKeys.Error)
+
+	db.EnableHotKeysSampling(1, time.Minute, 10)
+
+	tablet := fluxdbtest.NewTablet("tbl")
+	fluxdbtest.WriteBatchOfRequests(t, db, fluxdbtest.TabletRows(1, tablet.MustRow(t, 1, "001", "a")))
+
+	code, hotKeys = call()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, hotKeys.Error)
+	require.NotNil(t, hotKeys.HotKeysReport)
+	assert.Equal(t, float64(60), hotKeys.WindowSeconds)
+	assert.Equal(t, 1, hotKeys.SampleRate)
+	require.Len(t, hotKeys.WriteTablets, 1)
+	assert.Equal(t, tablet.String(), hotKeys.WriteTablets[0].Key)
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health serves the `/healthz` (liveness) and `/readyz` (readiness) endpoints of a
+// FluxDB instance, meant to be mounted by embedding applications for Kubernetes probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/fluxdb"
+	"go.uber.org/zap"
+)
+
+const defaultProbeInterval = 5 * time.Second
+const defaultProbeTimeout = 2 * time.Second
+
+// Checker periodically probes the store of a FluxDB instance and reports its health:
+//
+//   - `/healthz` fails when the last store probe failed (or none succeeded yet)
+//   - `/readyz` additionally fails while FluxDB is not ready or when the head drift, the amount of
+//     blocks the last written block is behind the head block, exceeds the configured maximum
+type Checker struct {
+	db            *fluxdb.FluxDB
+	probeInterval time.Duration
+	probeTimeout  time.Duration
+	maxHeadDrift  uint64
+
+	lock             sync.RWMutex
+	probed           bool
+	probeErr         error
+	lastWrittenBlock uint64
+}
+
+func NewChecker(db *fluxdb.FluxDB) *Checker {
+	return &Checker{
+		db:            db,
+		probeInterval: defaultProbeInterval,
+		probeTimeout:  defaultProbeTimeout,
+	}
+}
+
+// SetProbeInterval configures the delay between each store probe, defaults to 5s.
+func (c *Checker) SetProbeInterval(interval time.Duration) {
+	c.probeInterval = interval
+}
+
+// SetMaxHeadDrift configures the maximum amount of blocks the last written block can be
+// behind the head block before readiness fails, 0 (the default) disables the check.
+func (c *Checker) SetMaxHeadDrift(blocks uint64) {
+	c.maxHeadDrift = blocks
+}
+
+// Run probes the store every probe interval until the context is done.
+func (c *Checker) Run(ctx context.Context) {
+	for {
+		c.probe(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.probeInterval):
+		}
+	}
+}
+
+func (c *Checker) probe(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, c.probeTimeout)
+	defer cancel()
+
+	// Fetching the last written checkpoint is a single key read, cheap enough to be done often
+	_, lastWrittenBlock, err := c.db.FetchLastWrittenCheckpoint(ctx)
+	if err != nil {
+		zlog.Warn("store probe failed", zap.Error(err))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.probed = true
+	c.probeErr = err
+	if err == nil {
+		c.lastWrittenBlock = lastWrittenBlock.Num()
+	}
+}
+
+// Status is the health of the FluxDB instance as served by the endpoints.
+type Status struct {
+	Ready          bool   `json:"ready"`
+	StoreReachable bool   `json:"store_reachable"`
+	StoreError     string `json:"store_error,omitempty"`
+	HeadDrift      uint64 `json:"head_drift"`
+
+	Healthy bool `json:"healthy"`
+}
+
+// Status returns the current health, `live` is true for the liveness status, false for the
+// readiness one.
+func (c *Checker) Status(ctx context.Context, live bool) *Status {
+	c.lock.RLock()
+	status := &Status{
+		Ready:          c.db.IsReady(),
+		StoreReachable: c.probed && c.probeErr == nil,
+	}
+	if c.probeErr != nil {
+		status.StoreError = c.probeErr.Error()
+	}
+	lastWrittenBlock := c.lastWrittenBlock
+	c.lock.RUnlock()
+
+	if c.db.HeadBlock != nil {
+		if headBlock := c.db.HeadBlock(ctx); headBlock != nil && headBlock.Num() > lastWrittenBlock {
+			status.HeadDrift = headBlock.Num() - lastWrittenBlock
+		}
+	}
+
+	status.Healthy = status.StoreReachable
+	if !live {
+		status.Healthy = status.Healthy && status.Ready && (c.maxHeadDrift == 0 || status.HeadDrift <= c.maxHeadDrift)
+	}
+
+	return status
+}
+
+// Handler returns the HTTP handler serving `/healthz` and `/readyz`, responding with the
+// JSON `Status` and a 200 status code when healthy, 503 otherwise.
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, true)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, false)
+	})
+
+	return mux
+}
+
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, live bool) {
+	status := c.Status(r.Context(), live)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		zlog.Debug("unable to write health status", zap.Error(err))
+	}
+}
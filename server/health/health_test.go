@@ -0,0 +1,59 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb/fluxdbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecker(t *testing.T) {
+	db, closer := fluxdbtest.NewTestDB(t)
+	defer closer()
+
+	checker := NewChecker(db)
+	checker.SetMaxHeadDrift(10)
+	server := httptest.NewServer(checker.Handler())
+	defer server.Close()
+
+	get := func(path string) (int, *Status) {
+		response, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		status := &Status{}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(status))
+		return response.StatusCode, status
+	}
+
+	code, _ := get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "not healthy before the first store probe")
+
+	checker.probe(context.Background())
+
+	code, status := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.StoreReachable)
+
+	code, status = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, status.Ready)
+
+	db.SetReady()
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	db.HeadBlock = func(ctx context.Context) bstream.BlockRef { return bstream.NewBlockRef("00000064aa", 100) }
+	code, status = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, uint64(100), status.HeadDrift)
+
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code, "head drift should not affect liveness")
+}
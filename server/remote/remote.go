@@ -0,0 +1,362 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remote serves the read API of a FluxDB instance over gRPC, read by the `client`
+// package. The messages of the service are encoded in JSON (see `CodecName`), the rows and
+// entries they carry being in their storage format, so any collection registered on both sides
+// is served without a schema of its own.
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb"
+	"github.com/dfuse-io/logging"
+	pbfluxdb "github.com/dfuse-io/pbgo/dfuse/fluxdb/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// ServiceName is the name of the gRPC read service
+const ServiceName = "dfuse.fluxdb.v1.Reader"
+
+// The methods of the read service
+const (
+	MethodReadTablet       = "ReadTablet"
+	MethodReadTabletRow    = "ReadTabletRow"
+	MethodReadSingletEntry = "ReadSingletEntry"
+	MethodHeadBlock        = "HeadBlock"
+)
+
+// CodecName is the content subtype of the read service messages, the calls must be made with
+// `grpc.CallContentSubtype(CodecName)`.
+const CodecName = "fluxdb-json"
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return CodecName }
+
+// ReadRequest is a read of the tablet (`TabletKey`), of one of its rows (`PrimaryKey`) or of the
+// singlet (`SingletKey`) at `Height`.
+type ReadRequest struct {
+	Height            uint64              `json:"height"`
+	TabletKey         []byte              `json:"tablet_key,omitempty"`
+	PrimaryKey        []byte              `json:"primary_key,omitempty"`
+	SingletKey        []byte              `json:"singlet_key,omitempty"`
+	SpeculativeWrites []*SpeculativeWrite `json:"speculative_writes,omitempty"`
+}
+
+// SpeculativeWrite is a `fluxdb.WriteRequest` applied on top of the read, see
+// `EncodeSpeculativeWrites`.
+type SpeculativeWrite struct {
+	Height          uint64   `json:"height"`
+	BlockNum        uint64   `json:"block_num"`
+	BlockID         string   `json:"block_id,omitempty"`
+	PreviousBlockID string   `json:"previous_block_id,omitempty"`
+	TabletRows      []*Entry `json:"tablet_rows,omitempty"`
+	SingletEntries  []*Entry `json:"singlet_entries,omitempty"`
+}
+
+// ReadResponse holds the rows or the entry read, in their storage format, empty when there is
+// none.
+type ReadResponse struct {
+	Entries []*Entry `json:"entries,omitempty"`
+}
+
+// Entry is a tablet row or a singlet entry, in its storage format.
+type Entry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type HeadBlockRequest struct{}
+
+// HeadBlockResponse is the last block written to the store of the server, an empty block ID
+// meaning nothing was written yet.
+type HeadBlockResponse struct {
+	BlockNum uint64 `json:"block_num"`
+	BlockID  string `json:"block_id,omitempty"`
+}
+
+// Server serves the read API of a FluxDB instance.
+type Server struct {
+	db *fluxdb.FluxDB
+}
+
+func NewServer(db *fluxdb.FluxDB) *Server {
+	return &Server{db: db}
+}
+
+// Register registers the read service on the gRPC server.
+func (s *Server) Register(server *grpc.Server) {
+	server.RegisterService(&serviceDesc, s)
+}
+
+// serviceInterface is the type the service descriptor is registered for, see `Register`.
+type serviceInterface interface {
+	readTablet(ctx context.Context, request *ReadRequest) (*ReadResponse, error)
+	readTabletRow(ctx context.Context, request *ReadRequest) (*ReadResponse, error)
+	readSingletEntry(ctx context.Context, request *ReadRequest) (*ReadResponse, error)
+	headBlock(ctx context.Context, request *HeadBlockRequest) (*HeadBlockResponse, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*serviceInterface)(nil),
+	Methods: []grpc.MethodDesc{
+		readMethod(MethodReadTablet, serviceInterface.readTablet),
+		readMethod(MethodReadTabletRow, serviceInterface.readTabletRow),
+		readMethod(MethodReadSingletEntry, serviceInterface.readSingletEntry),
+		unaryMethod(MethodHeadBlock, func() interface{} { return &HeadBlockRequest{} }, func(srv serviceInterface, ctx context.Context, request interface{}) (interface{}, error) {
+			return srv.headBlock(ctx, request.(*HeadBlockRequest))
+		}),
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func readMethod(name string, read func(srv serviceInterface, ctx context.Context, request *ReadRequest) (*ReadResponse, error)) grpc.MethodDesc {
+	return unaryMethod(name, func() interface{} { return &ReadRequest{} }, func(srv serviceInterface, ctx context.Context, request interface{}) (interface{}, error) {
+		return read(srv, ctx, request.(*ReadRequest))
+	})
+}
+
+func unaryMethod(name string, newRequest func() interface{}, call func(srv serviceInterface, ctx context.Context, request interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			request := newRequest()
+			if err := dec(request); err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, request interface{}) (interface{}, error) {
+				return call(srv.(serviceInterface), ctx, request)
+			}
+
+			if interceptor == nil {
+				return handler(ctx, request)
+			}
+
+			return interceptor(ctx, request, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + name}, handler)
+		},
+	}
+}
+
+func (s *Server) readTablet(ctx context.Context, request *ReadRequest) (*ReadResponse, error) {
+	tablet, speculativeWrites, err := decodeTabletRead(request)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.ReadTabletAt(ctx, request.Height, tablet, speculativeWrites)
+	if err != nil {
+		return nil, readError(ctx, err)
+	}
+
+	return newReadResponse(&fluxdb.WriteRequest{TabletRows: rows})
+}
+
+func (s *Server) readTabletRow(ctx context.Context, request *ReadRequest) (*ReadResponse, error) {
+	tablet, speculativeWrites, err := decodeTabletRead(request)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := s.db.ReadTabletRowAt(ctx, request.Height, tablet, primaryKey(request.PrimaryKey), speculativeWrites)
+	if err != nil {
+		return nil, readError(ctx, err)
+	}
+
+	if row == nil {
+		return &ReadResponse{}, nil
+	}
+
+	return newReadResponse(&fluxdb.WriteRequest{TabletRows: []fluxdb.TabletRow{row}})
+}
+
+func (s *Server) readSingletEntry(ctx context.Context, request *ReadRequest) (*ReadResponse, error) {
+	singlet, err := fluxdb.NewSinglet(request.SingletKey)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid singlet key: %s", err)
+	}
+
+	speculativeWrites, err := decodeSpeculativeWrites(request.SpeculativeWrites)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := s.db.ReadSingletEntryAt(ctx, singlet, request.Height, speculativeWrites)
+	if err != nil {
+		return nil, readError(ctx, err)
+	}
+
+	if entry == nil {
+		return &ReadResponse{}, nil
+	}
+
+	return newReadResponse(&fluxdb.WriteRequest{SingletEntries: []fluxdb.SingletEntry{entry}})
+}
+
+func (s *Server) headBlock(ctx context.Context, _ *HeadBlockRequest) (*HeadBlockResponse, error) {
+	_, block, err := s.db.FetchLastWrittenCheckpoint(ctx)
+	if err != nil {
+		return nil, readError(ctx, err)
+	}
+
+	if bstream.EqualsBlockRefs(block, bstream.BlockRefEmpty) {
+		return &HeadBlockResponse{}, nil
+	}
+
+	return &HeadBlockResponse{BlockNum: block.Num(), BlockID: block.ID()}, nil
+}
+
+func decodeTabletRead(request *ReadRequest) (fluxdb.Tablet, []*fluxdb.WriteRequest, error) {
+	tablet, err := fluxdb.NewTablet(request.TabletKey)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid tablet key: %s", err)
+	}
+
+	speculativeWrites, err := decodeSpeculativeWrites(request.SpeculativeWrites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tablet, speculativeWrites, nil
+}
+
+func decodeSpeculativeWrites(encoded []*SpeculativeWrite) (out []*fluxdb.WriteRequest, err error) {
+	for i, write := range encoded {
+		request := &fluxdb.WriteRequest{
+			Height:          write.Height,
+			BlockRef:        bstream.BlockRefEmpty,
+			PreviousBlockID: write.PreviousBlockID,
+		}
+
+		if write.BlockID != "" {
+			request.BlockRef = bstream.NewBlockRef(write.BlockID, write.BlockNum)
+		}
+
+		for _, entry := range write.TabletRows {
+			row, err := fluxdb.NewTabletRowFromStorage(entry.Key, entry.Value)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid speculative write %d: tablet row: %s", i, err)
+			}
+
+			request.AppendTabletRow(row)
+		}
+
+		for _, entry := range write.SingletEntries {
+			singletEntry, err := fluxdb.NewSingletEntryFromStorage(entry.Key, entry.Value)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid speculative write %d: singlet entry: %s", i, err)
+			}
+
+			request.AppendSingletEntry(singletEntry)
+		}
+
+		out = append(out, request)
+	}
+
+	return out, nil
+}
+
+// EncodeSpeculativeWrites encodes the speculative writes of a read, see `ReadRequest`.
+func EncodeSpeculativeWrites(speculativeWrites []*fluxdb.WriteRequest) (out []*SpeculativeWrite, err error) {
+	for i, write := range speculativeWrites {
+		if write.BlockRef == nil {
+			withoutBlock := *write
+			withoutBlock.BlockRef = bstream.BlockRefEmpty
+			write = &withoutBlock
+		}
+
+		request, err := write.ToProto()
+		if err != nil {
+			return nil, fmt.Errorf("speculative write %d: %w", i, err)
+		}
+
+		out = append(out, &SpeculativeWrite{
+			Height:          write.Height,
+			BlockNum:        request.Block.Num,
+			BlockID:         request.Block.Id,
+			PreviousBlockID: write.PreviousBlockID,
+			TabletRows:      newEntries(request.TabletRows),
+			SingletEntries:  newEntries(request.SingletEntries),
+		})
+	}
+
+	return out, nil
+}
+
+func newEntries(writeEntries []*pbfluxdb.WriteEntry) (out []*Entry) {
+	for _, entry := range writeEntries {
+		out = append(out, &Entry{Key: entry.Key, Value: entry.Value})
+	}
+
+	return out
+}
+
+func newReadResponse(read *fluxdb.WriteRequest) (*ReadResponse, error) {
+	read.BlockRef = bstream.BlockRefEmpty
+
+	request, err := read.ToProto()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "encode read: %s", err)
+	}
+
+	return &ReadResponse{Entries: newEntries(append(request.TabletRows, request.SingletEntries...))}, nil
+}
+
+// readError turns the error of a read into a gRPC status, `codes.ResourceExhausted` for the
+// `fluxdb.ErrTooManyRequests` to retry later, `codes.FailedPrecondition` for the
+// `fluxdb.ErrSpeculativeForkMismatch` and `codes.OutOfRange` for the `fluxdb.ErrUncommittedHeight`.
+func readError(ctx context.Context, err error) error {
+	var tooManyRequests *fluxdb.ErrTooManyRequests
+	var forkMismatch *fluxdb.ErrSpeculativeForkMismatch
+	var uncommitted *fluxdb.ErrUncommittedHeight
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.As(err, &tooManyRequests):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.As(err, &forkMismatch):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.As(err, &uncommitted):
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+
+	logging.Logger(ctx, zlog).Warn("remote read failed", zap.Error(err))
+	return status.Error(codes.Internal, err.Error())
+}
+
+// primaryKey is the primary key of a row read remotely, in its storage format.
+type primaryKey []byte
+
+func (k primaryKey) Bytes() []byte  { return []byte(k) }
+func (k primaryKey) String() string { return fmt.Sprintf("%x", []byte(k)) }
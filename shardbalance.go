@@ -0,0 +1,239 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// ShardBalanceReport describes how the singlet entries and tablet rows are spread across the
+// shards of a sharded run, see `AnalyzeShardArchives` and `AnalyzeShardBalance`, so a pathological
+// skew (one shard taking much longer to inject than the others) is detected before injecting.
+type ShardBalanceReport struct {
+	Shards []*ShardBalance `json:"shards"`
+
+	// Skew is the byte count of the heaviest shard relative to the mean byte count of the shards,
+	// 1 meaning perfectly balanced
+	Skew float64 `json:"skew"`
+}
+
+// ShardBalance is the weight of a shard, along with its heaviest tablets.
+type ShardBalance struct {
+	ShardIndex        int `json:"shard_index"`
+	SingletEntryCount int `json:"singlet_entry_count"`
+	TabletRowCount    int `json:"tablet_row_count"`
+
+	// ByteCount is the size of the keys and values of the singlet entries and tablet rows
+	ByteCount int `json:"byte_count"`
+
+	// HeaviestTablets are the tablets of the shard with the highest byte count, heaviest first
+	HeaviestTablets []*TabletWeight `json:"heaviest_tablets"`
+}
+
+// TabletWeight is the amount of rows, deletions included, and bytes of a tablet.
+type TabletWeight struct {
+	Tablet     string `json:"tablet"`
+	Collection string `json:"collection"`
+	RowCount   int    `json:"row_count"`
+	ByteCount  int    `json:"byte_count"`
+}
+
+// AnalyzeShardArchives reads the segment files of the `shardCount` shards produced by the
+// `Sharder` in `shardsStore` (the root shards store, containing one directory per shard) and
+// reports their balance, with the `heaviestCount` heaviest tablets of each shard.
+func AnalyzeShardArchives(ctx context.Context, shardsStore dstore.Store, shardCount int, heaviestCount int) (*ShardBalanceReport, error) {
+	analyzer := newShardBalanceAnalyzer(shardCount)
+	for shardIndex := 0; shardIndex < shardCount; shardIndex++ {
+		err := shardsStore.Walk(ctx, shardDirectory(shardIndex)+"/", "", func(filename string) error {
+			if path.Base(filename) == shardingConfigFilename {
+				return nil
+			}
+
+			zlog.Debug("analyzing shard file", zap.String("filename", filename))
+			reader, err := shardsStore.OpenObject(ctx, filename)
+			if err != nil {
+				return fmt.Errorf("open shard file %q: %w", filename, err)
+			}
+			defer reader.Close()
+
+			requests, err := ReadShard(reader, 0)
+			if err != nil {
+				return fmt.Errorf("read shard file %q: %w", filename, err)
+			}
+
+			for _, request := range requests {
+				if err := analyzer.addRequest(shardIndex, request); err != nil {
+					return fmt.Errorf("shard file %q: %w", filename, err)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walk shard %d files: %w", shardIndex, err)
+		}
+	}
+
+	return analyzer.report(heaviestCount), nil
+}
+
+// AnalyzeShardBalance scans the singlet entries and tablet rows of the store and reports the
+// balance they would have if sharded in `shardCount` shards with the shard function of this
+// instance (see `SetShardFunction`), with the `heaviestCount` heaviest tablets of each shard, so
+// the shard count and function of a reprocessing can be assessed against the current data.
+//
+// **Important** This scans the whole rows table and keeps the weight of every tablet in memory.
+func (fdb *FluxDB) AnalyzeShardBalance(ctx context.Context, shardCount int, heaviestCount int) (*ShardBalanceReport, error) {
+	analyzer := newShardBalanceAnalyzer(shardCount)
+	err := fdb.store.ScanTable(ctx, store.RowsTable, nil, nil, func(key []byte, value []byte) error {
+		shardKey, _, isIndex, err := selfCheckKey(key)
+		if err != nil {
+			return err
+		}
+
+		// Index snapshots are derived from the rows, they are not part of the shards
+		if isIndex {
+			return nil
+		}
+
+		shardIndex := fdb.shardFunction(shardKey, shardCount)
+		if _, isSinglet := singletFactories[collectionFromKey(key)]; isSinglet {
+			analyzer.addSingletEntry(shardIndex, len(key)+len(value))
+			return nil
+		}
+
+		row, err := NewTabletRowFromStorage(key, value)
+		if err != nil {
+			return fmt.Errorf("invalid tablet row key %q: %w", Key(key), err)
+		}
+
+		analyzer.addTabletRow(shardIndex, row.Tablet(), len(key)+len(value))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan rows: %w", err)
+	}
+
+	return analyzer.report(heaviestCount), nil
+}
+
+type shardBalanceAnalyzer struct {
+	shards  []*ShardBalance
+	tablets []map[string]*TabletWeight
+}
+
+func newShardBalanceAnalyzer(shardCount int) *shardBalanceAnalyzer {
+	analyzer := &shardBalanceAnalyzer{
+		shards:  make([]*ShardBalance, shardCount),
+		tablets: make([]map[string]*TabletWeight, shardCount),
+	}
+
+	for i := range analyzer.shards {
+		analyzer.shards[i] = &ShardBalance{ShardIndex: i}
+		analyzer.tablets[i] = map[string]*TabletWeight{}
+	}
+
+	return analyzer
+}
+
+func (a *shardBalanceAnalyzer) addRequest(shardIndex int, request *WriteRequest) error {
+	for _, entry := range request.SingletEntries {
+		value, err := entry.MarshalValue()
+		if err != nil {
+			return fmt.Errorf("marshal singlet entry %s value: %w", entry, err)
+		}
+
+		a.addSingletEntry(shardIndex, len(KeyForSingletEntry(entry))+len(value))
+	}
+
+	for _, row := range request.TabletRows {
+		value, err := row.MarshalValue()
+		if err != nil {
+			return fmt.Errorf("marshal tablet row %s value: %w", row, err)
+		}
+
+		a.addTabletRow(shardIndex, row.Tablet(), len(KeyForTabletRow(row))+len(value))
+	}
+
+	return nil
+}
+
+func (a *shardBalanceAnalyzer) addSingletEntry(shardIndex int, byteCount int) {
+	shard := a.shards[shardIndex]
+	shard.SingletEntryCount++
+	shard.ByteCount += byteCount
+}
+
+func (a *shardBalanceAnalyzer) addTabletRow(shardIndex int, tablet Tablet, byteCount int) {
+	shard := a.shards[shardIndex]
+	shard.TabletRowCount++
+	shard.ByteCount += byteCount
+
+	key := string(KeyForTablet(tablet))
+	weight := a.tablets[shardIndex][key]
+	if weight == nil {
+		weight = &TabletWeight{Tablet: tablet.String(), Collection: collectionName(tablet.Collection())}
+		a.tablets[shardIndex][key] = weight
+	}
+
+	weight.RowCount++
+	weight.ByteCount += byteCount
+}
+
+func (a *shardBalanceAnalyzer) report(heaviestCount int) *ShardBalanceReport {
+	if heaviestCount < 0 {
+		heaviestCount = 0
+	}
+
+	report := &ShardBalanceReport{Shards: a.shards}
+
+	totalBytes, heaviestBytes := 0, 0
+	for i, shard := range a.shards {
+		totalBytes += shard.ByteCount
+		if shard.ByteCount > heaviestBytes {
+			heaviestBytes = shard.ByteCount
+		}
+
+		tablets := make([]*TabletWeight, 0, len(a.tablets[i]))
+		for _, weight := range a.tablets[i] {
+			tablets = append(tablets, weight)
+		}
+
+		sort.Slice(tablets, func(i, j int) bool {
+			if tablets[i].ByteCount == tablets[j].ByteCount {
+				return tablets[i].Tablet < tablets[j].Tablet
+			}
+			return tablets[i].ByteCount > tablets[j].ByteCount
+		})
+
+		if len(tablets) > heaviestCount {
+			tablets = tablets[:heaviestCount]
+		}
+		shard.HeaviestTablets = tablets
+	}
+
+	if totalBytes > 0 {
+		report.Skew = float64(heaviestBytes) / (float64(totalBytes) / float64(len(a.shards)))
+	}
+
+	return report
+}
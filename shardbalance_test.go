@@ -0,0 +1,63 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardBalance(t *testing.T) {
+	ctx := context.Background()
+
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	shardsStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+
+	sharder, err := NewSharder(shardsStore, "", 2, 1, 2)
+	require.NoError(t, err)
+
+	tablet1 := newTestTablet("tb1")
+	tablet2 := newTestTablet("tb2")
+	singlet := newTestSinglet("sg1")
+
+	requests := []*WriteRequest{
+		{Height: 1, SingletEntries: []SingletEntry{singlet.entry(t, 1, "s1")}, TabletRows: []TabletRow{tablet1.row(t, 1, "001", "a"), tablet2.row(t, 1, "001", "b")}},
+		{Height: 2, TabletRows: []TabletRow{tablet1.row(t, 2, "002", "cc")}},
+	}
+
+	streamBlock(t, sharder, "00000001aa", "", requests[0])
+	streamBlock(t, sharder, "00000002aa", "00000001aa", requests[1])
+	endBlock(t, sharder, "00000003aa")
+
+	report, err := AnalyzeShardArchives(ctx, shardsStore, 2, 1)
+	require.NoError(t, err)
+	require.Len(t, report.Shards, 2)
+
+	tablet1Shard := report.Shards[shardOfKey(KeyForTablet(tablet1), 2)]
+	require.Len(t, tablet1Shard.HeaviestTablets, 1)
+	assert.Equal(t, tablet1.String(), tablet1Shard.HeaviestTablets[0].Tablet)
+	assert.Equal(t, 2, tablet1Shard.HeaviestTablets[0].RowCount)
+
+	singletEntryCount, tabletRowCount := 0, 0
+	for _, shard := range report.Shards {
+		singletEntryCount += shard.SingletEntryCount
+		tabletRowCount += shard.TabletRowCount
+	}
+	assert.Equal(t, 1, singletEntryCount)
+	assert.Equal(t, 3, tabletRowCount)
+	assert.True(t, report.Skew >= 1)
+
+	// The live store analysis assigns the rows to the same shards
+	db, closer := NewTestDB(t)
+	defer closer()
+	writeBatchOfRequests(t, db, requests...)
+
+	live, err := db.AnalyzeShardBalance(ctx, 2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, report, live)
+}
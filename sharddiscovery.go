@@ -0,0 +1,126 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// ErrHoleInShards is the error returned when the progress of a shard of a sharded injection is
+// not contiguous, either because a shard did not write anything yet when computing the safe serve
+// block (see `FetchShardsSafeServeBlock`), or because a shard file is missing when injecting the
+// shard (see `ShardInjector`), in which case the range must be re-sharded.
+type ErrHoleInShards struct {
+	ShardIndex int `json:"shard_index"`
+
+	// ExpectedBlock is the block the shard was expected to continue from (or to have reached)
+	ExpectedBlock uint64 `json:"expected_block"`
+
+	// FoundBlock is the block the shard actually continues from, 0 when the shard has no progress
+	FoundBlock uint64 `json:"found_block"`
+
+	// Filename is the shard file starting after the hole, empty when the shard has no progress
+	Filename string `json:"filename,omitempty"`
+}
+
+func (e *ErrHoleInShards) Error() string {
+	if e.Filename == "" {
+		return fmt.Sprintf("hole in shards, shard %d has no progress, expected block %d", e.ShardIndex, e.ExpectedBlock)
+	}
+
+	return fmt.Sprintf("hole in shards, shard %d file %s starts at block %d, expected block %d", e.ShardIndex, e.Filename, e.FoundBlock, e.ExpectedBlock)
+}
+
+// DiscoverShards discovers, from the store, the amount of shards of the sharded injection
+// being written to it, 0 when the store is not being written by shards. The shard count is the
+// one of the persisted sharding configuration (see `CheckShardingConfig`), or else deduced from
+// the shards checkpoints. Once discovered, `FetchSafeServeBlock` accounts for the shards.
+func (fdb *FluxDB) DiscoverShards(ctx context.Context) (shardCount int, err error) {
+	highestShardIndex := -1
+	err = fdb.store.ScanLastShardsWrittenCheckpoint(ctx, []byte("shard-"), func(key []byte, _ []byte) error {
+		shardIndexRaw := string(bytes.TrimPrefix(key, []byte("shard-")))
+		shardIndex, err := strconv.Atoi(shardIndexRaw)
+		if err != nil {
+			return fmt.Errorf("invalid shard index %q: %w", shardIndexRaw, err)
+		}
+
+		if shardIndex > highestShardIndex {
+			highestShardIndex = shardIndex
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("scan shards checkpoints: %w", err)
+	}
+
+	if highestShardIndex < 0 {
+		fdb.discoveredShardCount = 0
+		return 0, nil
+	}
+
+	shardCount = highestShardIndex + 1
+
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, shardingConfigKey)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		// Injected before the sharding config was persisted, the shards without checkpoint yet are unknown
+
+	case err != nil:
+		return 0, fmt.Errorf("fetch persisted sharding config: %w", err)
+
+	default:
+		persisted := &ShardingConfig{}
+		if err := json.Unmarshal(value, persisted); err != nil {
+			return 0, fmt.Errorf("unmarshal persisted sharding config: %w", err)
+		}
+
+		if shardCount > persisted.ShardCount {
+			return 0, fmt.Errorf("shard %d checkpoint is outside the persisted sharding config (%s)", highestShardIndex, persisted)
+		}
+
+		shardCount = persisted.ShardCount
+	}
+
+	zlog.Info("discovered shards from store", zap.Int("shard_count", shardCount))
+	fdb.discoveredShardCount = shardCount
+	return shardCount, nil
+}
+
+// FetchSafeServeBlock returns the highest block fully written to the store, i.e. the last
+// written checkpoint or, while the store is written by the shards discovered by `DiscoverShards`,
+// the lowest last written block of the shards (see `FetchShardsSafeServeBlock`).
+func (fdb *FluxDB) FetchSafeServeBlock(ctx context.Context) (height uint64, block bstream.BlockRef, err error) {
+	if fdb.discoveredShardCount == 0 || fdb.IsSharding() {
+		return fdb.FetchLastWrittenCheckpoint(ctx)
+	}
+
+	// Once the sharded injection completed, the shards checkpoints are superseded by the last written checkpoint
+	height, block, err = fdb.FetchLastWrittenCheckpoint(ctx)
+	if err != nil || !bstream.EqualsBlockRefs(block, bstream.BlockRefEmpty) {
+		return height, block, err
+	}
+
+	return fdb.FetchShardsSafeServeBlock(ctx, fdb.discoveredShardCount)
+}
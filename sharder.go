@@ -17,25 +17,33 @@ package fluxdb
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path"
-	"time"
+	"strconv"
+	"sync"
 
-	"github.com/abourget/llerrgroup"
 	"github.com/dfuse-io/bstream"
 	"github.com/dfuse-io/bstream/forkable"
-	"github.com/dfuse-io/dbin"
 	"github.com/dfuse-io/dstore"
+	pbfluxdb "github.com/dfuse-io/pbgo/dfuse/fluxdb/v1"
 	"github.com/golang/protobuf/proto"
-	"github.com/minio/highwayhash"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
+var errShardingAborted = errors.New("sharding aborted")
+
 const shardBinaryContentType = "fwr"
 const shardBinaryVersion = 1
 
+// The default zero-padding width of the block numbers in segment file names, fits any 32-bit block num
+const defaultSegmentFilenamePadding = 10
+
+// The zero-padding width of the block numbers in segment file names fitting any 64-bit block num
+const maxSegmentFilenamePadding = 20
+
 type Sharder struct {
 	mapper           BlockMapper
 	shardsStore      dstore.Store
@@ -43,26 +51,42 @@ type Sharder struct {
 	startBlock       uint64
 	stopBlock        uint64
 	shardCount       int
+	collectionFilter map[uint16]bool
 
-	// A slice of shards, each shard is itself a slice of WriteRequest, one per block processed in this batch.
+	// Assigns the singlets and tablets to shards, see `SetShardFunction`
+	shardFunctionName string
+	shardFunction     ShardFunction
+
+	// One writer per shard, each one receiving the shard's WriteRequest, one per block processed in this batch.
 	// So, assuming 2 shards with 5 blocks, that would yield `[0][#5, #6, #7, #8, #9], [1][#5, #6, #7, #8, #9]`.
-	writers      []io.Writer
-	dbinEncoders []*dbin.Writer
-	statsByShard []stats
+	shardWriters     []*shardWriter
+	streamingUploads bool
+	statsByShard     []stats
+
+	// When non-zero, the current segment is cut as soon as one of its shards reaches this size
+	segmentByteBudget int
+	segmentStartBlock uint64
+	filenamePadding   int
+
+	// The shard writers of the previous segment, still completing in the background
+	completingWriters []*shardWriter
+
+	// The shards whose directory holds the sharding config already, written with their first segment
+	shardingConfigLock    sync.Mutex
+	shardingConfigWritten map[int]bool
 }
 
 type stats struct {
 	requestCount int
 	entriesCount int
 	rowsCount    int
+	byteSize     int
 	lastBlockRef bstream.BlockRef
 	lastHeight   uint64
 }
 
 func NewSharder(shardsStore dstore.Store, scratchDirectory string, shardCount int, startBlock, stopBlock uint64) (*Sharder, error) {
 	s := &Sharder{
-		writers:      make([]io.Writer, shardCount),
-		dbinEncoders: make([]*dbin.Writer, shardCount),
 		statsByShard: make([]stats, shardCount),
 
 		shardCount:       shardCount,
@@ -70,36 +94,92 @@ func NewSharder(shardsStore dstore.Store, scratchDirectory string, shardCount in
 		scratchDirectory: scratchDirectory,
 		startBlock:       startBlock,
 		stopBlock:        stopBlock,
+
+		segmentStartBlock: startBlock,
+		filenamePadding:   defaultSegmentFilenamePadding,
+
+		shardingConfigWritten: map[int]bool{},
 	}
 
+	s.shardFunctionName, s.shardFunction, _ = lookupShardFunction(DefaultShardFunction)
+
 	if scratchDirectory != "" {
 		if err := os.MkdirAll(scratchDirectory, os.ModePerm); err != nil {
 			return nil, fmt.Errorf("unable to create scratch directory: %w", err)
 		}
 	}
 
-	for i := 0; i < shardCount; i++ {
-		var writer io.Writer
-		if s.scratchDirectory == "" {
-			writer = bytes.NewBuffer(nil)
-		} else {
-			file, err := os.OpenFile(path.Join(s.scratchDirectory, fmt.Sprintf("shard-%03d-%s.dbin.tmp", i, segmentIdentifier(s.startBlock, s.stopBlock))), os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.ModePerm)
-			if err != nil {
-				return nil, fmt.Errorf("scratch directory for shard %d: %w", i, err)
-			}
-
-			writer = file
-		}
+	s.resetStats()
 
-		s.writers[i] = writer
+	return s, nil
+}
 
-		// This is coded to never fail, so we safely ignore the `err` return value
-		s.dbinEncoders[i] = dbin.NewWriter(writer)
-		s.dbinEncoders[i].WriteHeader(shardBinaryContentType, shardBinaryVersion)
-		s.statsByShard[i] = stats{requestCount: 0, entriesCount: 0, rowsCount: 0, lastBlockRef: bstream.BlockRefEmpty, lastHeight: 0}
+func (s *Sharder) resetStats() {
+	for i := 0; i < s.shardCount; i++ {
+		s.statsByShard[i] = stats{requestCount: 0, entriesCount: 0, rowsCount: 0, byteSize: 0, lastBlockRef: bstream.BlockRefEmpty, lastHeight: 0}
 	}
+}
 
-	return s, nil
+// SetSegmentByteBudget makes the sharder cut the segment files before reaching the stop block,
+// as soon as the segment of one of the shards reaches approximately `budget` bytes, the next
+// segment starting right after. All shards are cut at the same block. The budget is applied on
+// the encoded size of the segment, before compression by the shards store.
+//
+// Cutting segments requires knowing their last block before uploading them, so this is ignored
+// when streaming uploads.
+func (s *Sharder) SetSegmentByteBudget(budget int) {
+	s.segmentByteBudget = budget
+}
+
+// SetStreamingUploads makes the segment of each shard uploaded to the shards store while it's
+// being written, instead of being accumulated in memory (or in the scratch directory) and
+// uploaded once complete. Must be called before the first block is processed.
+func (s *Sharder) SetStreamingUploads(enabled bool) {
+	s.streamingUploads = enabled
+}
+
+// SetFilenamePadding configures the zero-padding width of the block numbers in the segment file
+// names, 10 by default. Segment files are injected in lexical order of their names, so the width
+// must be large enough for all start blocks of the run, chains with block numbers above 32-bit
+// should use 20, which fits any 64-bit block number.
+func (s *Sharder) SetFilenamePadding(width int) {
+	s.filenamePadding = width
+}
+
+// SetShardFunction selects, by name, the function assigning the singlets and tablets to shards,
+// see `RegisterShardFunction`, the default one being used when `name` is empty. The name is
+// recorded in the sharding config, the injectors must use the same function.
+func (s *Sharder) SetShardFunction(name string) error {
+	name, function, err := lookupShardFunction(name)
+	if err != nil {
+		return err
+	}
+
+	s.shardFunctionName = name
+	s.shardFunction = function
+	return nil
+}
+
+func (s *Sharder) startShardWriters() error {
+	if s.filenamePadding < 1 || s.filenamePadding > maxSegmentFilenamePadding {
+		return fmt.Errorf("invalid filename padding width %d, must be between 1 and %d", s.filenamePadding, maxSegmentFilenamePadding)
+	}
+
+	if digits := len(strconv.FormatUint(s.segmentStartBlock, 10)); digits > s.filenamePadding {
+		return fmt.Errorf("segment start block %d has more digits than the filename padding width %d, segment files would not be ordered correctly", s.segmentStartBlock, s.filenamePadding)
+	}
+
+	s.shardWriters = make([]*shardWriter, s.shardCount)
+	for i := 0; i < s.shardCount; i++ {
+		writer, err := s.newShardWriter(i)
+		if err != nil {
+			return err
+		}
+
+		s.shardWriters[i] = writer
+	}
+
+	return nil
 }
 
 func (s *Sharder) ProcessBlock(rawBlk *bstream.Block, rawObj interface{}) error {
@@ -112,6 +192,12 @@ func (s *Sharder) ProcessBlock(rawBlk *bstream.Block, rawObj interface{}) error
 		panic("unsupported, received step is not irreversible")
 	}
 
+	if s.shardWriters == nil {
+		if err := s.startShardWriters(); err != nil {
+			return fmt.Errorf("unable to start shard writers: %w", err)
+		}
+	}
+
 	unshardedRequest := fObj.Obj.(*WriteRequest)
 	if unshardedRequest.Height > s.stopBlock {
 		err := s.writeShards()
@@ -125,6 +211,10 @@ func (s *Sharder) ProcessBlock(rawBlk *bstream.Block, rawObj interface{}) error
 	// Compute the N shard write requests, 1 write request per shard, the slice index is the shard index
 	shardedRequests := make([]*WriteRequest, s.shardCount)
 	for _, entry := range unshardedRequest.SingletEntries {
+		if !s.retainsCollection(entry.Singlet().Collection()) {
+			continue
+		}
+
 		shardIndex := s.goesToShard(KeyForSinglet(entry.Singlet()))
 
 		var shardedRequest *WriteRequest
@@ -137,6 +227,10 @@ func (s *Sharder) ProcessBlock(rawBlk *bstream.Block, rawObj interface{}) error
 	}
 
 	for _, row := range unshardedRequest.TabletRows {
+		if !s.retainsCollection(row.Tablet().Collection()) {
+			continue
+		}
+
 		shardIndex := s.goesToShard(KeyForTablet(row.Tablet()))
 
 		var shardedRequest *WriteRequest
@@ -148,8 +242,11 @@ func (s *Sharder) ProcessBlock(rawBlk *bstream.Block, rawObj interface{}) error
 		shardedRequest.TabletRows = append(shardedRequest.TabletRows, row)
 	}
 
+	// The block time goes to a single shard, the one of its index, which is written once
+	blockTimeShardIndex := s.goesToShard(KeyForSinglet(blockTimeSinglet{kind: blockHeightToTime}))
+
 	// Loop over N shards computed above, and assign them correctly to the global shards slice
-	for shardIndex, encoder := range s.dbinEncoders {
+	for shardIndex, writer := range s.shardWriters {
 		shardedRequest := shardedRequests[shardIndex]
 		if shardedRequest == nil {
 			shardedRequest = &WriteRequest{}
@@ -157,21 +254,21 @@ func (s *Sharder) ProcessBlock(rawBlk *bstream.Block, rawObj interface{}) error
 
 		shardedRequest.Height = unshardedRequest.Height
 		shardedRequest.BlockRef = unshardedRequest.BlockRef
+		if shardIndex == blockTimeShardIndex {
+			shardedRequest.BlockTime = unshardedRequest.BlockTime
+		}
 
 		protoRequest, err := shardedRequest.ToProto()
 		if err != nil {
 			return fmt.Errorf("request to proto: %w", err)
 		}
 
-		message, err := proto.Marshal(protoRequest)
+		size, err := writeShardRequest(writer, protoRequest)
 		if err != nil {
-			return fmt.Errorf("marshal proto: %w", err)
-		}
-
-		if err = encoder.WriteMessage(message); err != nil {
-			return fmt.Errorf("encoding message: %w", err)
+			return fmt.Errorf("shard %d: %w", shardIndex, err)
 		}
 
+		s.statsByShard[shardIndex].byteSize += size
 		s.statsByShard[shardIndex].requestCount++
 		s.statsByShard[shardIndex].entriesCount += len(protoRequest.SingletEntries)
 		s.statsByShard[shardIndex].rowsCount += len(protoRequest.TabletRows)
@@ -179,61 +276,124 @@ func (s *Sharder) ProcessBlock(rawBlk *bstream.Block, rawObj interface{}) error
 		s.statsByShard[shardIndex].lastHeight = shardedRequest.Height
 	}
 
+	if s.shouldCutSegment(unshardedRequest.Height) {
+		if err := s.completeSegment(unshardedRequest.Height); err != nil {
+			return fmt.Errorf("unable to write shards segment to store: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// shouldCutSegment determines if the current segment should end at `height`, which is the
+// case when one of its shards exceeds the segment byte budget.
+func (s *Sharder) shouldCutSegment(height uint64) bool {
+	if s.segmentByteBudget <= 0 || s.streamingUploads || height >= s.stopBlock {
+		return false
+	}
+
+	for _, shardStats := range s.statsByShard {
+		if shardStats.byteSize >= s.segmentByteBudget {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeShardRequest queues the request for encoding in the shard and returns its encoded size.
+func writeShardRequest(writer *shardWriter, request *pbfluxdb.WriteRequest) (size int, err error) {
+	buffer := shardEncodeBufferPool.Get().(*proto.Buffer)
+
+	buffer.Reset()
+	if err := buffer.Marshal(request); err != nil {
+		shardEncodeBufferPool.Put(buffer)
+		return 0, fmt.Errorf("marshal proto: %w", err)
+	}
+
+	// Accounts for the message length prefix added by the encoder
+	size = len(buffer.Bytes()) + 4
+
+	// The shard writer returns the buffer to the pool once encoded
+	return size, writer.write(buffer)
+}
+
 var emptyHashKey [32]byte
 
 func (s *Sharder) goesToShard(key []byte) int {
-	bigInt := highwayhash.Sum64(key, emptyHashKey[:])
-	elementShard := bigInt % uint64(s.shardCount)
-	return int(elementShard)
+	return s.shardFunction(key, s.shardCount)
 }
 
 func (s *Sharder) writeShards() error {
-	eg := llerrgroup.New(12)
-	for shardIndex, writer := range s.writers {
-		if eg.Stop() {
-			break
+	if s.shardWriters == nil {
+		if err := s.startShardWriters(); err != nil {
+			return fmt.Errorf("unable to start shard writers: %w", err)
 		}
+	}
 
-		shardIndex := shardIndex
-		writer := writer
-
-		eg.Go(func() error {
-			baseName := path.Join(shardDirectory(shardIndex), segmentIdentifier(s.startBlock, s.stopBlock))
-
-			shardStats := s.statsByShard[shardIndex]
-			zlog.Info("encoding shard",
-				zap.String("base_name", baseName),
-				zap.Int("shard_index", shardIndex),
-				zap.Int("request_count", shardStats.requestCount),
-				zap.Int("entry_count", shardStats.entriesCount),
-				zap.Int("row_count", shardStats.rowsCount),
-				zap.Stringer("last_block", shardStats.lastBlockRef),
-				zap.Uint64("last_height", shardStats.lastHeight),
-			)
-
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-			defer cancel()
-
-			var err error
-			if v, ok := writer.(*bytes.Buffer); ok {
-				err = s.writeShardRequestsFromMemory(ctx, baseName, v)
-			} else if v, ok := writer.(*os.File); ok {
-				err = s.writeShardRequestsFromFile(ctx, baseName, v)
-			} else {
-				panic(fmt.Errorf("don't kown how to handle shard requests writer of type %T", writer))
-			}
-
-			if err != nil {
-				return fmt.Errorf("unable to correctly write shard %d: %w", shardIndex, err)
-			}
-
-			return nil
-		})
+	if err := s.completeSegment(s.stopBlock); err != nil {
+		return err
 	}
-	return eg.Wait()
+
+	return s.waitCompletingSegment()
+}
+
+// completeSegment completes the current segment of all shards, ending at `stopBlock`. The segment
+// is completed and uploaded in the background while the next one is being written, waiting first
+// for the previous segment to be done, so at most one segment is completing at any time.
+func (s *Sharder) completeSegment(stopBlock uint64) error {
+	for shardIndex, writer := range s.shardWriters {
+		shardStats := s.statsByShard[shardIndex]
+		zlog.Info("completing shard segment",
+			zap.Int("shard_index", shardIndex),
+			zap.Uint64("start_block", s.segmentStartBlock),
+			zap.Uint64("stop_block", stopBlock),
+			zap.Int("request_count", shardStats.requestCount),
+			zap.Int("entry_count", shardStats.entriesCount),
+			zap.Int("row_count", shardStats.rowsCount),
+			zap.Int("byte_size", shardStats.byteSize),
+			zap.Stringer("last_block", shardStats.lastBlockRef),
+			zap.Uint64("last_height", shardStats.lastHeight),
+		)
+
+		// Shard writers complete concurrently, so all of them are completed before waiting on any
+		writer.complete(path.Join(shardDirectory(shardIndex), s.segmentIdentifier(s.segmentStartBlock, stopBlock)))
+	}
+
+	err := s.waitCompletingSegment()
+
+	s.completingWriters = s.shardWriters
+	s.shardWriters = nil
+	s.segmentStartBlock = stopBlock + 1
+	s.resetStats()
+
+	return err
+}
+
+// Abort stops the sharding before the stop block is reached, the segment being written is
+// discarded, so no partial segment is left in the shards store, while the previous segment, if
+// still completing, is waited for. It's a no-op once the sharding completed.
+func (s *Sharder) Abort() error {
+	for _, writer := range s.shardWriters {
+		writer.abort(errShardingAborted)
+	}
+
+	for _, writer := range s.shardWriters {
+		writer.wait()
+	}
+	s.shardWriters = nil
+
+	return s.waitCompletingSegment()
+}
+
+func (s *Sharder) waitCompletingSegment() error {
+	var errs []error
+	for _, writer := range s.completingWriters {
+		errs = append(errs, writer.wait())
+	}
+
+	s.completingWriters = nil
+	return multierr.Combine(errs...)
 }
 
 func (s *Sharder) writeShardRequestsFromMemory(ctx context.Context, name string, buffer *bytes.Buffer) error {
@@ -278,6 +438,6 @@ func shardDirectory(shardIndex int) string {
 	return fmt.Sprintf("%03d", shardIndex)
 }
 
-func segmentIdentifier(startBlock, stopBlock uint64) string {
-	return fmt.Sprintf("%010d-%010d", startBlock, stopBlock)
+func (s *Sharder) segmentIdentifier(startBlock, stopBlock uint64) string {
+	return fmt.Sprintf("%0*d-%0*d", s.filenamePadding, startBlock, s.filenamePadding, stopBlock)
 }
@@ -0,0 +1,151 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/minio/highwayhash"
+)
+
+// DefaultShardFunction is the name of the shard function used when none is set, hashing the whole
+// singlet or tablet key, which spreads the singlets and tablets of all collections evenly.
+const DefaultShardFunction = shardingHashFunction
+
+// CollectionShardFunction is the name of the built-in shard function assigning all the singlets
+// and tablets of a collection to the same shard, the collection modulo the shard count, so the
+// related tablets of a collection are co-located.
+const CollectionShardFunction = "collection-modulo"
+
+// ShardFunction assigns a singlet or tablet to one of the `shardCount` shards given its key, see
+// `KeyForSinglet` and `KeyForTablet`, the key starting with the collection (2 bytes, big endian).
+// It must be deterministic, all sharders and injectors of a sharded run must agree on it.
+type ShardFunction func(key []byte, shardCount int) int
+
+var shardFunctions = map[string]ShardFunction{
+	DefaultShardFunction:    shardOfKey,
+	CollectionShardFunction: shardOfCollection,
+}
+
+// RegisterShardFunction registers, under `name`, a custom function assigning the singlets and
+// tablets to shards, selected with `Sharder#SetShardFunction` and `FluxDB#SetShardFunction`. The
+// name is recorded in the sharding config, validated by the injectors, so a function must never
+// change once shards were produced with it, a modified one must be registered under a new name.
+func RegisterShardFunction(name string, function ShardFunction) {
+	if name == "" || function == nil {
+		panic(fmt.Errorf("shard function name and function are required"))
+	}
+
+	if _, found := shardFunctions[name]; found {
+		panic(fmt.Errorf("shard function %q is already registered", name))
+	}
+
+	shardFunctions[name] = function
+}
+
+// lookupShardFunction returns the shard function registered under `name`, the default one when
+// `name` is empty.
+func lookupShardFunction(name string) (string, ShardFunction, error) {
+	if name == "" {
+		name = DefaultShardFunction
+	}
+
+	function, found := shardFunctions[name]
+	if !found {
+		return "", nil, fmt.Errorf("unknown shard function %q, register it first with RegisterShardFunction", name)
+	}
+
+	return name, function, nil
+}
+
+// shardOfKey returns the shard of a singlet or tablet key, see `KeyForSinglet` and `KeyForTablet`.
+func shardOfKey(key []byte, shardCount int) int {
+	bigInt := highwayhash.Sum64(key, emptyHashKey[:])
+	elementShard := bigInt % uint64(shardCount)
+	return int(elementShard)
+}
+
+func shardOfCollection(key []byte, shardCount int) int {
+	return int(bigEndian.Uint16(key) % uint16(shardCount))
+}
+
+// NewConsistentHashShardFunction returns a shard function placing each shard at `virtualNodes`
+// points of a hash ring, a key being assigned to the shard of the first point following its
+// hash. Unlike the default function, changing the shard count only moves about `1/shardCount` of
+// the singlets and tablets to other shards. It must be registered under a name recording the
+// amount of virtual nodes (e.g. `consistent-hash-128`), see `RegisterShardFunction`.
+func NewConsistentHashShardFunction(virtualNodes int) ShardFunction {
+	if virtualNodes <= 0 {
+		panic(fmt.Errorf("virtual nodes count must be positive, got %d", virtualNodes))
+	}
+
+	var lock sync.Mutex
+	rings := map[int]*hashRing{}
+
+	return func(key []byte, shardCount int) int {
+		lock.Lock()
+		ring := rings[shardCount]
+		if ring == nil {
+			ring = newHashRing(shardCount, virtualNodes)
+			rings[shardCount] = ring
+		}
+		lock.Unlock()
+
+		return ring.shardOf(highwayhash.Sum64(key, emptyHashKey[:]))
+	}
+}
+
+type hashRing struct {
+	points []uint64
+	shards []int
+}
+
+type hashRingPoint struct {
+	hash  uint64
+	shard int
+}
+
+func newHashRing(shardCount int, virtualNodes int) *hashRing {
+	points := make([]hashRingPoint, 0, shardCount*virtualNodes)
+	for shard := 0; shard < shardCount; shard++ {
+		for node := 0; node < virtualNodes; node++ {
+			label := strconv.Itoa(shard) + "-" + strconv.Itoa(node)
+			points = append(points, hashRingPoint{hash: highwayhash.Sum64([]byte(label), emptyHashKey[:]), shard: shard})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	ring := &hashRing{points: make([]uint64, len(points)), shards: make([]int, len(points))}
+	for i, point := range points {
+		ring.points[i] = point.hash
+		ring.shards[i] = point.shard
+	}
+
+	return ring
+}
+
+func (r *hashRing) shardOf(hash uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		// Wraps around the ring
+		i = 0
+	}
+
+	return r.shards[i]
+}
@@ -0,0 +1,95 @@
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardOfCollection(t *testing.T) {
+	for _, identifier := range []string{"tb1", "tb2", "tb3"} {
+		assert.Equal(t, int(testTabletCollection%3), shardOfCollection(KeyForTablet(newTestTablet(identifier)), 3))
+	}
+}
+
+func TestConsistentHashShardFunction(t *testing.T) {
+	function := NewConsistentHashShardFunction(64)
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("tablet-%d", i))
+
+		shard := function(key, 8)
+		require.True(t, shard >= 0 && shard < 8)
+		require.Equal(t, shard, function(key, 8), "deterministic")
+
+		if function(key, 9) != shard {
+			moved++
+		}
+	}
+
+	// Adding a 9th shard moves about a 9th of the keys, the default function moving about 8/9 of them
+	assert.True(t, moved > 0 && moved < 250, "moved %d keys out of 1000", moved)
+}
+
+func TestRegisterShardFunction(t *testing.T) {
+	assert.Panics(t, func() { RegisterShardFunction(DefaultShardFunction, shardOfKey) })
+	assert.Panics(t, func() { RegisterShardFunction("test-nil", nil) })
+
+	_, _, err := lookupShardFunction("test-unknown")
+	assert.Error(t, err)
+
+	name, _, err := lookupShardFunction("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultShardFunction, name)
+}
+
+func TestSharder_ShardFunction(t *testing.T) {
+	ctx := context.Background()
+
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	shardsStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+
+	sharder, err := NewSharder(shardsStore, "", 2, 1, 1)
+	require.NoError(t, err)
+	require.Error(t, sharder.SetShardFunction("test-unknown"))
+	require.NoError(t, sharder.SetShardFunction(CollectionShardFunction))
+
+	tablet1 := newTestTablet("tb1")
+	tablet2 := newTestTablet("tb2")
+
+	streamBlock(t, sharder, "00000001aa", "", writeRequest(nil, []TabletRow{
+		tablet1.row(t, 1, "001", "t1 r1 #1"),
+		tablet2.row(t, 1, "001", "t2 r1 #1"),
+	}))
+	endBlock(t, sharder, "00000002aa")
+
+	shardIndex := int(testTabletCollection % 2)
+	shardStore, err := dstore.NewLocalStore(path.Join(storeDir, fmt.Sprintf("%03d", shardIndex)), "", "", false)
+	require.NoError(t, err)
+
+	config, err := readShardingConfig(ctx, shardStore)
+	require.NoError(t, err)
+	assert.Equal(t, CollectionShardFunction, config.HashFunction)
+
+	db, closer := NewTestDB(t)
+	defer closer()
+	db.SetSharding(shardIndex, 2)
+
+	assert.Error(t, NewShardInjector(shardStore, db).Run(), "runtime shard function mismatch")
+
+	require.NoError(t, db.SetShardFunction(CollectionShardFunction))
+	require.NoError(t, NewShardInjector(shardStore, db).Run())
+
+	rows, err := db.ReadTabletAt(ctx, 1, tablet2, nil)
+	require.NoError(t, err)
+	assert.Len(t, rows, 1, "tablets of the collection are co-located in the same shard")
+}
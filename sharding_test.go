@@ -2,7 +2,9 @@ package fluxdb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -32,7 +34,67 @@ func TestSharding_ScratchDirectory(t *testing.T) {
 	runTests(t, dir)
 }
 
-func runTests(t *testing.T, scratchDirectory string) {
+func TestSharding_StreamingUploads(t *testing.T) {
+	runTests(t, "", func(s *Sharder) { s.SetStreamingUploads(true) })
+}
+
+func TestSharding_StreamingUploadsAborted(t *testing.T) {
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	localStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+	shardsStore := &partialWritesStore{Store: localStore}
+
+	sharder, err := NewSharder(shardsStore, "", 2, 1, 3)
+	require.NoError(t, err)
+	sharder.SetStreamingUploads(true)
+
+	tablet := newTestTablet("tb1")
+	streamBlock(t, sharder, "00000001aa", "", writeRequest(nil, []TabletRow{tablet.row(t, 1, "001", "t1 r1 #1")}))
+	streamBlock(t, sharder, "00000002aa", "", writeRequest(nil, []TabletRow{tablet.row(t, 2, "001", "t1 r1 #2")}))
+
+	// Stopped before the stop block, the segments streamed so far must not be left in the store
+	require.NoError(t, sharder.Abort())
+
+	var filenames []string
+	require.NoError(t, shardsStore.Walk(context.Background(), "", "", func(filename string) error {
+		filenames = append(filenames, filename)
+		return nil
+	}))
+	assert.Empty(t, filenames)
+
+	require.NoError(t, sharder.Abort(), "no-op once aborted")
+}
+
+// partialWritesStore writes the objects as they are read, leaving the object written up to the
+// failure of an upload, as some backends do.
+type partialWritesStore struct {
+	dstore.Store
+}
+
+func (s *partialWritesStore) WriteObject(ctx context.Context, base string, reader io.Reader) error {
+	filename := s.ObjectPath(base)
+	if err := os.MkdirAll(path.Dir(filename), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
+
+func TestSharding_SegmentByteBudget(t *testing.T) {
+	// Any non-empty block exceeds the budget, so each block ends up in its own segment
+	runTests(t, "", func(s *Sharder) { s.SetSegmentByteBudget(1) })
+}
+
+func runTests(t *testing.T, scratchDirectory string, options ...func(s *Sharder)) {
 	ctx := context.Background()
 
 	storeDir, cleanup := createTempDir(t, shardsStore)
@@ -45,6 +107,10 @@ func runTests(t *testing.T, scratchDirectory string) {
 	sharder, err := NewSharder(shardsStore, scratchDirectory, shardCount, 1, 3)
 	require.NoError(t, err)
 
+	for _, option := range options {
+		option(sharder)
+	}
+
 	tablet1 := newTestTablet("tb1")
 	tablet2 := newTestTablet("tb2")
 
@@ -75,6 +141,7 @@ func runTests(t *testing.T, scratchDirectory string) {
 	db, closer := NewTestDB(t)
 	defer closer()
 
+	db.EnableBlockTimeIndex()
 	db.shardCount = shardCount
 
 	// Injection of each shard is done individually, each store pointing into the shard directory directly
@@ -137,6 +204,20 @@ func runTests(t *testing.T, scratchDirectory string) {
 
 	tablet2Rows, err := db.ReadTabletAt(ctx, 3, tablet2, nil)
 	assert.Equal(t, []TabletRow{tablet2.row(t, 3, "001", "t2 r1 #3"), tablet2.row(t, 2, "002", "t2 r2 #2")}, tablet2Rows)
+
+	// The block time went through the shards
+	height, err = db.ResolveHeightForTime(ctx, testBlockTime(2).Add(500*time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), height)
+
+	blockTime, err := db.ResolveTimeForHeight(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, testBlockTime(3), blockTime)
+}
+
+// testBlockTime is the time of the test block `blockNum`, one second after the previous one.
+func testBlockTime(blockNum uint64) time.Time {
+	return time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(blockNum) * time.Second)
 }
 
 func errorsToStrings(errs []error) (out []string) {
@@ -152,6 +233,7 @@ func streamBlock(t *testing.T, sharder *Sharder, id, libID string, request *Writ
 	blk := bblock(id, libID)
 	request.Height = blk.Num()
 	request.BlockRef = blk.AsRef()
+	request.BlockTime = testBlockTime(blk.Num())
 
 	err := sharder.ProcessBlock(blk, fObj(request))
 	require.NoError(t, err)
@@ -212,3 +294,271 @@ func createTempDir(t *testing.T, input string) (string, func()) {
 	os.RemoveAll(input)
 	return input, func() {}
 }
+
+func TestShardsProgress(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	_, err := db.ShardsProgress(context.Background())
+	require.Error(t, err, "sharding should be configured")
+
+	db.shardCount = 3
+	writeShardCheckpoint(t, db, 0, 5, "00000005aa")
+	writeShardCheckpoint(t, db, 2, 3, "00000003aa")
+
+	progress, err := db.ShardsProgress(context.Background())
+	require.NoError(t, err)
+	require.Len(t, progress, 3)
+
+	assert.Equal(t, uint64(5), progress[0].LastBlock.Num())
+	assert.Equal(t, uint64(0), progress[0].Lag)
+	assert.Equal(t, bstream.BlockRefEmpty, progress[1].LastBlock)
+	assert.Equal(t, uint64(5), progress[1].Lag)
+	assert.Equal(t, 2, progress[2].ShardIndex)
+	assert.Equal(t, uint64(2), progress[2].Lag)
+}
+
+func TestFetchShardsSafeServeBlock(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	writer, writerCloser := NewTestDB(t)
+	defer writerCloser()
+	writer.store = db.store
+
+	writer.shardCount = 3
+	writeShardCheckpoint(t, writer, 0, 5, "00000005aa")
+	writeShardCheckpoint(t, writer, 2, 3, "00000003aa")
+
+	height, block, err := db.FetchShardLastWrittenBlock(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), height)
+	assert.Equal(t, "00000005aa", block.ID())
+
+	height, block, err = db.FetchShardLastWrittenBlock(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), height)
+	assert.Equal(t, bstream.BlockRefEmpty, block)
+
+	_, _, err = db.FetchShardsSafeServeBlock(ctx, 3)
+	var hole *ErrHoleInShards
+	require.True(t, errors.As(err, &hole), "a shard did not write anything yet")
+	assert.Equal(t, &ErrHoleInShards{ShardIndex: 1, ExpectedBlock: 5}, hole)
+
+	writeShardCheckpoint(t, writer, 1, 4, "00000004aa")
+
+	height, block, err = db.FetchShardsSafeServeBlock(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), height)
+	assert.Equal(t, "00000003aa", block.ID())
+
+	_, _, err = db.FetchShardsSafeServeBlock(ctx, 0)
+	assert.Error(t, err)
+}
+
+func TestDiscoverShards(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	shardCount, err := db.DiscoverShards(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, shardCount)
+
+	writer, writerCloser := NewTestDB(t)
+	defer writerCloser()
+	writer.store = db.store
+
+	writer.shardCount = 4
+	writeShardCheckpoint(t, writer, 0, 5, "00000005aa")
+	writeShardCheckpoint(t, writer, 2, 3, "00000003aa")
+
+	shardCount, err = db.DiscoverShards(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, shardCount, "deduced from the shards checkpoints")
+
+	_, _, err = db.FetchSafeServeBlock(ctx)
+	var hole *ErrHoleInShards
+	assert.True(t, errors.As(err, &hole))
+
+	require.NoError(t, writer.CheckShardingConfig(ctx, &ShardingConfig{ShardCount: 4, HashFunction: shardingHashFunction}))
+	writeShardCheckpoint(t, writer, 1, 4, "00000004aa")
+
+	shardCount, err = db.DiscoverShards(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 4, shardCount, "from the persisted sharding config")
+
+	_, _, err = db.FetchSafeServeBlock(ctx)
+	require.True(t, errors.As(err, &hole), "shard 3 did not write anything yet")
+	assert.Equal(t, &ErrHoleInShards{ShardIndex: 3, ExpectedBlock: 5}, hole)
+
+	writeShardCheckpoint(t, writer, 3, 6, "00000006aa")
+
+	height, block, err := db.FetchSafeServeBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), height)
+	assert.Equal(t, "00000003aa", block.ID())
+
+	require.NoError(t, writer.WriteShardingFinalCheckpoint(ctx, 6, bstream.NewBlockRefFromID("00000006aa")))
+
+	height, _, err = db.FetchSafeServeBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), height, "superseded by the final checkpoint")
+
+	writeShardCheckpoint(t, writer, 4, 6, "00000006aa")
+
+	_, err = db.DiscoverShards(ctx)
+	assert.Error(t, err, "shard outside of the persisted sharding config")
+}
+
+func TestWaitForAllShardsAligned(t *testing.T) {
+	defer func(previous time.Duration) { shardsAlignmentPollInterval = previous }(shardsAlignmentPollInterval)
+	shardsAlignmentPollInterval = 10 * time.Millisecond
+
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.shardCount = 2
+	writeShardCheckpoint(t, db, 0, 3, "00000003aa")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := db.WaitForAllShardsAligned(ctx, 3)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	done := make(chan error)
+	go func() {
+		stats, err := db.WaitForAllShardsAligned(context.Background(), 3)
+		if err == nil && stats.ReferenceBlockRef.Num() < 3 {
+			err = fmt.Errorf("unexpected reference block %s", stats.ReferenceBlockRef)
+		}
+		done <- err
+	}()
+
+	writeShardCheckpoint(t, db, 1, 2, "00000002aa")
+	writeShardCheckpoint(t, db, 1, 3, "00000003aa")
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shards should have been aligned")
+	}
+}
+
+func TestShardingConfig_WrittenOncePerShard(t *testing.T) {
+	ctx := context.Background()
+
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	shardsStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+
+	sharder, err := NewSharder(shardsStore, "", 2, 1, 1)
+	require.NoError(t, err)
+
+	configFile := path.Join(shardDirectory(0), shardingConfigFilename)
+	require.NoError(t, sharder.writeShardingConfig(ctx, 0))
+	require.NoError(t, shardsStore.DeleteObject(ctx, configFile))
+
+	require.NoError(t, sharder.writeShardingConfig(ctx, 0))
+	exists, err := shardsStore.FileExists(ctx, configFile)
+	require.NoError(t, err)
+	assert.False(t, exists, "config should only be written with the first segment of the shard")
+
+	require.NoError(t, sharder.writeShardingConfig(ctx, 1))
+	exists, err = shardsStore.FileExists(ctx, path.Join(shardDirectory(1), shardingConfigFilename))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestShardingConfig(t *testing.T) {
+	ctx := context.Background()
+
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	shardsStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+
+	sharder, err := NewSharder(shardsStore, "", 2, 1, 1)
+	require.NoError(t, err)
+	sharder.SetCollectionFilter([]uint16{testTabletCollection})
+
+	tablet := newTestTablet("tb1")
+	singlet := newTestSinglet("sg1")
+
+	streamBlock(t, sharder, "00000001aa", "", writeRequest(
+		[]SingletEntry{singlet.entry(t, 1, "s1 e #1")},
+		[]TabletRow{tablet.row(t, 1, "001", "t1 r1 #1")}),
+	)
+	endBlock(t, sharder, "00000002aa")
+
+	shardStore, err := dstore.NewLocalStore(path.Join(storeDir, "000"), "", "", false)
+	require.NoError(t, err)
+
+	config, err := readShardingConfig(ctx, shardStore)
+	require.NoError(t, err)
+	assert.Equal(t, &ShardingConfig{ShardCount: 2, HashFunction: shardingHashFunction, Collections: []uint16{testTabletCollection}}, config)
+
+	db, closer := NewTestDB(t)
+	defer closer()
+	db.SetSharding(0, 2)
+
+	require.NoError(t, NewShardInjector(shardStore, db).Run())
+	require.NoError(t, db.CheckShardingConfig(ctx, config), "persisted config should match")
+
+	otherShardStore, err := dstore.NewLocalStore(path.Join(storeDir, "001"), "", "", false)
+	require.NoError(t, err)
+
+	db.SetSharding(1, 2)
+	require.NoError(t, NewShardInjector(otherShardStore, db).Run())
+
+	db.SetSharding(0, 3)
+	assert.Error(t, db.CheckShardingConfig(ctx, config), "runtime shard count mismatch")
+
+	db.SetSharding(1, 2)
+	assert.Error(t, db.CheckShardingConfig(ctx, &ShardingConfig{ShardCount: 2, HashFunction: shardingHashFunction}), "collections mismatch")
+	assert.Error(t, db.CheckShardingConfig(ctx, &ShardingConfig{ShardCount: 2, HashFunction: "other", Collections: []uint16{testTabletCollection}}), "hash function mismatch")
+
+	entry, err := db.ReadSingletEntryAt(ctx, singlet, 1, nil)
+	require.NoError(t, err)
+	assert.Nil(t, entry, "singlet collection should have been filtered out when sharding")
+}
+
+func TestSharder_FilenamePadding(t *testing.T) {
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	shardsStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+
+	startBlock := uint64(1) << 34
+	sharder, err := NewSharder(shardsStore, "", 1, startBlock, startBlock+1)
+	require.NoError(t, err)
+
+	blk := bblock("00000001aa", "")
+	err = sharder.ProcessBlock(blk, fObj(&WriteRequest{Height: startBlock, BlockRef: bstream.NewBlockRef("00000001aa", startBlock)}))
+	require.Error(t, err, "start block does not fit default padding width")
+
+	sharder, err = NewSharder(shardsStore, "", 1, startBlock, startBlock+1)
+	require.NoError(t, err)
+	sharder.SetFilenamePadding(maxSegmentFilenamePadding)
+
+	assert.Equal(t, "00000000017179869184-00000000017179869185", sharder.segmentIdentifier(startBlock, startBlock+1))
+	require.NoError(t, sharder.writeShards())
+
+	exists, err := shardsStore.FileExists(context.Background(), "000/00000000017179869184-00000000017179869185")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// writeShardCheckpoint writes an empty block as shard `shardIndex`, moving its checkpoint.
+func writeShardCheckpoint(t *testing.T, db *FluxDB, shardIndex int, height uint64, blockID string) {
+	db.shardIndex = shardIndex
+	writeBatchOfRequests(t, db, &WriteRequest{Height: height, BlockRef: bstream.NewBlockRefFromID(blockID)})
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// The identifier of the default hashing function used by the Sharder to determine the shard of a
+// tablet/singlet, must be changed if `shardOfKey` is ever modified, see `DefaultShardFunction`.
+const shardingHashFunction = "highwayhash64-zero-key"
+
+// The file name of the sharding configuration, written by the Sharder alongside the segments of each shard
+const shardingConfigFilename = "sharding-config"
+
+// The checkpoint table key under which the sharding configuration is persisted in the store, must
+// not start with `shard-` since this prefix is reserved to the shards last written checkpoint.
+var shardingConfigKey = []byte("config-sharding")
+
+// ShardingConfig is the configuration used at sharding time. It's written next to the shards
+// segments and persisted in the destination store when injecting them, so all the injectors
+// of the same sharded run can be validated to use a compatible configuration.
+type ShardingConfig struct {
+	ShardCount   int    `json:"shard_count"`
+	HashFunction string `json:"hash_function"`
+
+	// Collections retained when sharding, all collections are retained when empty
+	Collections []uint16 `json:"collections,omitempty"`
+}
+
+func (c *ShardingConfig) String() string {
+	return fmt.Sprintf("shard count %d, hash function %q, collections %v", c.ShardCount, c.HashFunction, c.Collections)
+}
+
+func (c *ShardingConfig) validateAgainst(expected *ShardingConfig) error {
+	if c.ShardCount != expected.ShardCount {
+		return fmt.Errorf("shard count %d does not match expected shard count %d", c.ShardCount, expected.ShardCount)
+	}
+
+	if c.HashFunction != expected.HashFunction {
+		return fmt.Errorf("hash function %q does not match expected hash function %q", c.HashFunction, expected.HashFunction)
+	}
+
+	if len(c.Collections) != len(expected.Collections) {
+		return fmt.Errorf("collections %v do not match expected collections %v", c.Collections, expected.Collections)
+	}
+
+	for i, collection := range c.Collections {
+		if collection != expected.Collections[i] {
+			return fmt.Errorf("collections %v do not match expected collections %v", c.Collections, expected.Collections)
+		}
+	}
+
+	return nil
+}
+
+// CheckShardingConfig validates that the received sharding configuration is compatible with the
+// runtime sharding configuration of this instance as well as with the one persisted in the store,
+// persisting it if none was yet. An error is returned on any mismatch, injecting shards with
+// an incompatible configuration would produce a corrupted database once all shards are merged.
+func (fdb *FluxDB) CheckShardingConfig(ctx context.Context, config *ShardingConfig) error {
+	return fdb.checkShardingConfig(ctx, config, true)
+}
+
+func (fdb *FluxDB) checkShardingConfig(ctx context.Context, config *ShardingConfig, persist bool) error {
+	if fdb.IsSharding() && config.ShardCount != fdb.shardCount {
+		return fmt.Errorf("sharding config %s does not match runtime shard count %d", config, fdb.shardCount)
+	}
+
+	if fdb.IsSharding() && config.HashFunction != fdb.shardFunctionName {
+		return fmt.Errorf("sharding config %s does not match runtime shard function %q", config, fdb.shardFunctionName)
+	}
+
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, shardingConfigKey)
+	if errors.Is(err, store.ErrNotFound) {
+		if !persist {
+			return nil
+		}
+
+		zlog.Info("persisting sharding config", zap.Stringer("config", config))
+		return fdb.writeShardingConfig(ctx, config)
+	}
+
+	if err != nil {
+		return fmt.Errorf("fetch persisted sharding config: %w", err)
+	}
+
+	persisted := &ShardingConfig{}
+	if err := json.Unmarshal(value, persisted); err != nil {
+		return fmt.Errorf("unmarshal persisted sharding config: %w", err)
+	}
+
+	if err := config.validateAgainst(persisted); err != nil {
+		return fmt.Errorf("sharding config does not match persisted one (%s): %w", persisted, err)
+	}
+
+	return nil
+}
+
+func (fdb *FluxDB) writeShardingConfig(ctx context.Context, config *ShardingConfig) error {
+	value, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("marshal sharding config: %w", err)
+	}
+
+	batch := fdb.store.NewBatch(zlog)
+	batch.SetLastCheckpoint(shardingConfigKey, value)
+
+	if err := batch.Flush(ctx); err != nil {
+		return fmt.Errorf("write sharding config: %w", err)
+	}
+
+	return nil
+}
+
+// SetCollectionFilter configures the sharder to only retain the singlet entries and tablet rows
+// of the received collections, all others are dropped.
+func (s *Sharder) SetCollectionFilter(collections []uint16) {
+	s.collectionFilter = make(map[uint16]bool, len(collections))
+	for _, collection := range collections {
+		s.collectionFilter[collection] = true
+	}
+}
+
+func (s *Sharder) retainsCollection(collection uint16) bool {
+	return len(s.collectionFilter) == 0 || s.collectionFilter[collection]
+}
+
+// ShardingConfig returns the configuration used by this sharder.
+func (s *Sharder) ShardingConfig() *ShardingConfig {
+	config := &ShardingConfig{
+		ShardCount:   s.shardCount,
+		HashFunction: s.shardFunctionName,
+	}
+
+	for collection := range s.collectionFilter {
+		config.Collections = append(config.Collections, collection)
+	}
+	sort.Slice(config.Collections, func(i, j int) bool { return config.Collections[i] < config.Collections[j] })
+
+	return config
+}
+
+// writeShardingConfig writes the sharding config in the directory of the shard, once, along its
+// first segment. A failed write is retried with the next segment.
+func (s *Sharder) writeShardingConfig(ctx context.Context, shardIndex int) error {
+	s.shardingConfigLock.Lock()
+	written := s.shardingConfigWritten[shardIndex]
+	s.shardingConfigLock.Unlock()
+
+	if written {
+		return nil
+	}
+
+	value, err := json.Marshal(s.ShardingConfig())
+	if err != nil {
+		return fmt.Errorf("marshal sharding config: %w", err)
+	}
+
+	if err := s.shardsStore.WriteObject(ctx, path.Join(shardDirectory(shardIndex), shardingConfigFilename), bytes.NewReader(value)); err != nil {
+		return err
+	}
+
+	s.shardingConfigLock.Lock()
+	s.shardingConfigWritten[shardIndex] = true
+	s.shardingConfigLock.Unlock()
+
+	return nil
+}
+
+// readShardingConfig reads the sharding configuration written by the Sharder in the shard store,
+// returns `nil, nil` when the store does not contain any (i.e. produced by an older sharder).
+func readShardingConfig(ctx context.Context, shardStore dstore.Store) (*ShardingConfig, error) {
+	exists, err := shardStore.FileExists(ctx, shardingConfigFilename)
+	if err != nil {
+		return nil, fmt.Errorf("check sharding config existence: %w", err)
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	reader, err := shardStore.OpenObject(ctx, shardingConfigFilename)
+	if err != nil {
+		return nil, fmt.Errorf("open sharding config: %w", err)
+	}
+	defer reader.Close()
+
+	value, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read sharding config: %w", err)
+	}
+
+	config := &ShardingConfig{}
+	if err := json.Unmarshal(value, config); err != nil {
+		return nil, fmt.Errorf("unmarshal sharding config: %w", err)
+	}
+
+	return config, nil
+}
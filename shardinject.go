@@ -20,6 +20,7 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dfuse-io/dbin"
 	"github.com/dfuse-io/dstore"
@@ -32,10 +33,27 @@ import (
 type ShardInjector struct {
 	*shutter.Shutter
 
-	shardsStore dstore.Store
-	db          *FluxDB
+	shardsStore   dstore.Store
+	db            *FluxDB
+	watchInterval time.Duration
+	lease         *storeLease
+	mode          ShardInjectorMode
+	report        *ShardInjectionReport
+
+	// In verify mode, the last written checkpoint height, requests above it are not verified
+	verifyUpToHeight uint64
+
+	// The name of the last shard file injected, the next polls of the watch mode only look for
+	// the file following it instead of walking all the shard files again
+	lastInjectedFilename string
+
+	shardLagRefreshedAt time.Time
 }
 
+// The shard lag gauges are refreshed at most once per interval while injecting, refreshing them
+// scans the progress of all the shards
+const shardLagRefreshInterval = 30 * time.Second
+
 func NewShardInjector(shardsStore dstore.Store, db *FluxDB) *ShardInjector {
 	return &ShardInjector{
 		Shutter:     shutter.New(),
@@ -44,34 +62,256 @@ func NewShardInjector(shardsStore dstore.Store, db *FluxDB) *ShardInjector {
 	}
 }
 
+// SetWatchInterval turns the injector into a continuous process, instead of returning once
+// all shard files currently in the store were injected, it keeps watching the store every
+// `interval` for newly uploaded shard files and injects them as they appear. The injector
+// runs until it's shut down or until the stop block of the database is reached (when set).
+func (s *ShardInjector) SetWatchInterval(interval time.Duration) {
+	s.watchInterval = interval
+}
+
+// SetLease configures the injector to hold a lease on its shard while running, so two injector
+// replicas cannot concurrently write the same shard. The lease is identified by `owner`, and is
+// renewed periodically, it expires if not renewed within `ttl`, at which point another replica
+// is allowed to acquire it. When `takeover` is true, a lease currently held by another owner is
+// forcefully acquired, in which case the previous holder stops as soon as it notices.
+func (s *ShardInjector) SetLease(owner string, ttl time.Duration, takeover bool) {
+	s.lease = newShardLease(s.db, s.db.shardIndex, owner, ttl, takeover)
+}
+
+// SetMode configures what the injector does with the write requests decoded from the shard
+// files, either writing them (the default), reporting what would be written (dry-run) or
+// comparing them against the data already in the store (verify). In dry-run and verify modes,
+// nothing is written to the store and the injector always stops after a single pass.
+func (s *ShardInjector) SetMode(mode ShardInjectorMode) {
+	s.mode = mode
+}
+
+// Report returns the summary of the last run.
+func (s *ShardInjector) Report() *ShardInjectionReport {
+	return s.report
+}
+
 func (s *ShardInjector) Run() (err error) {
 	ctx, cancelInjector := context.WithCancel(context.Background())
 	s.OnTerminating(func(_ error) {
 		cancelInjector()
 	})
 
+	s.report = &ShardInjectionReport{Mode: s.mode.String()}
+
+	// The lease only protects writes, read only modes can safely run concurrently with an injector
+	if s.lease != nil && s.mode == ShardInjectorModeInject {
+		releaseLease, err := s.holdLease(ctx)
+		if err != nil {
+			return fmt.Errorf("acquire shard lease: %w", err)
+		}
+
+		defer func() {
+			releaseLease()
+			if leaseErr := s.lease.err(); leaseErr != nil {
+				err = fmt.Errorf("shard lease lost: %w", leaseErr)
+			}
+		}()
+	}
+
+	if err := s.checkShardingConfig(ctx); err != nil {
+		return fmt.Errorf("sharding config: %w", err)
+	}
+
+	return s.run(ctx)
+}
+
+// checkShardingConfig validates the sharding configuration written by the Sharder alongside the
+// shard files against the runtime and persisted ones, falling back to the runtime configuration
+// when shard files were produced by a sharder not writing its configuration.
+func (s *ShardInjector) checkShardingConfig(ctx context.Context) error {
+	config, err := readShardingConfig(ctx, s.shardsStore)
+	if err != nil {
+		return err
+	}
+
+	if config == nil {
+		zlog.Info("no sharding config found in shards store, validating runtime config only")
+		config = &ShardingConfig{ShardCount: s.db.shardCount, HashFunction: s.db.shardFunctionName}
+	}
+
+	// Only persist the sharding config when actually injecting, read only modes must not write anything
+	return s.db.checkShardingConfig(ctx, config, s.mode == ShardInjectorModeInject)
+}
+
+// holdLease acquires the lease and keeps it alive in the background, the returned function
+// stops renewing the lease and releases it. If the lease is lost while running, the injector
+// is shut down.
+func (s *ShardInjector) holdLease(ctx context.Context) (release func(), err error) {
+	if err := s.lease.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	keepAliveCtx, stopKeepAlive := context.WithCancel(ctx)
+	keepAliveDone := make(chan struct{})
+	go func() {
+		defer close(keepAliveDone)
+		s.lease.keepAlive(keepAliveCtx, func(err error) {
+			zlog.Error("shard lease lost, shutting down injector", zap.Error(err))
+			s.Shutdown(fmt.Errorf("shard lease lost: %w", err))
+		})
+	}()
+
+	return func() {
+		stopKeepAlive()
+		<-keepAliveDone
+
+		if s.lease.err() != nil {
+			return
+		}
+
+		if err := s.lease.release(context.Background()); err != nil {
+			zlog.Warn("unable to release shard lease, it will expire by itself", zap.Error(err))
+		}
+	}, nil
+}
+
+func (s *ShardInjector) run(ctx context.Context) (err error) {
 	// FIXME (height): Probably a revisit of the sharding will be required if we move off block to height directly. At the same time,
 	//                 it could still be bound to block and still use height
-	_, startAfter, err := s.db.FetchLastWrittenCheckpoint(ctx)
+	height, startAfter, err := s.db.fetchResumeCheckpoint(ctx)
 	if err != nil {
 		return err
 	}
 
-	zlog.Info("starting back shard injector", zap.Stringer("block", startAfter))
+	zlog.Info("starting back shard injector", zap.Stringer("mode", s.mode), zap.Stringer("block", startAfter), zap.Duration("watch_interval", s.watchInterval))
 	startAfterNum := uint64(startAfter.Num())
+	s.lastInjectedFilename = ""
+
+	if s.mode == ShardInjectorModeVerify {
+		// Verification covers all shard files, up to what was written in the store so far
+		s.verifyUpToHeight = height
+		startAfterNum = 0
+	}
+
+	for {
+		lastInjectedNum, err := s.injectShardFiles(ctx, startAfterNum)
+		if err != nil {
+			if s.watchInterval != 0 && ctx.Err() != nil {
+				zlog.Info("shard injector terminated while watching shards store", zap.Uint64("last_injected_block", lastInjectedNum))
+				return nil
+			}
+
+			return fmt.Errorf("walking shards store: %w", err)
+		}
+
+		if s.mode != ShardInjectorModeInject {
+			return s.completeReadOnlyRun()
+		}
+
+		if lastInjectedNum != startAfterNum {
+			s.refreshShardLag(ctx, true)
+		}
+
+		if s.db.deferIndexing && lastInjectedNum != startAfterNum {
+			zlog.Info("building deferred indexes now that all shard files were injected")
+			if err := s.db.IndexTables(ctx); err != nil {
+				return fmt.Errorf("index deferred tables: %w", err)
+			}
+		}
+
+		startAfterNum = lastInjectedNum
+		if s.watchInterval == 0 {
+			return nil
+		}
+
+		if s.db.stopBlock != 0 && startAfterNum >= s.db.stopBlock {
+			zlog.Info("shard injector reached stop block, no longer watching shards store", zap.Uint64("stop_block", s.db.stopBlock))
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			zlog.Info("shard injector terminated while watching shards store", zap.Uint64("last_injected_block", startAfterNum))
+			return nil
+		case <-time.After(s.watchInterval):
+		}
+	}
+}
+
+// refreshShardLag refreshes the shard lag gauges, at most once every `shardLagRefreshInterval`
+// unless forced. It only refreshes the gauges, a failure must not stop the injection.
+func (s *ShardInjector) refreshShardLag(ctx context.Context, force bool) {
+	if !s.db.IsSharding() || (!force && time.Since(s.shardLagRefreshedAt) < shardLagRefreshInterval) {
+		return
+	}
+
+	s.shardLagRefreshedAt = time.Now()
+	if _, err := s.db.fetchAllShardProgressStats(ctx); err != nil {
+		zlog.Warn("unable to fetch shards progress", zap.Error(err))
+	}
+}
+
+func (s *ShardInjector) completeReadOnlyRun() error {
+	zlog.Info("shard injector read only run completed", zap.Reflect("report", s.report))
+	if s.report.DivergenceCount > 0 {
+		return fmt.Errorf("found %d divergences between shard files and store", s.report.DivergenceCount)
+	}
+
+	return nil
+}
+
+// injectShardFiles injects all the shard files available in the store containing blocks after
+// `startAfterNum`, returning the last block injected. Once a shard file was injected, only the
+// files following it are looked for, one at a time, the shard files being contiguous.
+func (s *ShardInjector) injectShardFiles(ctx context.Context, startAfterNum uint64) (lastInjectedNum uint64, err error) {
+	lastInjectedNum = startAfterNum
+	for {
+		prefix := s.nextShardFilePrefix(lastInjectedNum)
+
+		injectedNum, err := s.walkShardFiles(ctx, prefix, lastInjectedNum)
+		if err != nil || prefix == "" || injectedNum == lastInjectedNum {
+			return injectedNum, err
+		}
+
+		lastInjectedNum = injectedNum
+	}
+}
+
+// nextShardFilePrefix returns the name prefix of the shard file following the last injected one,
+// its block numbers being zero-padded to the same width, or an empty prefix, matching all the
+// files, when no shard file was injected yet.
+func (s *ShardInjector) nextShardFilePrefix(lastInjectedNum uint64) string {
+	width := strings.Index(s.lastInjectedFilename, "-")
+	if width <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%0*d-", width, lastInjectedNum+1)
+}
+
+// walkShardFiles injects the shard files whose name starts with `prefix`, in order, returning the
+// last block injected.
+func (s *ShardInjector) walkShardFiles(ctx context.Context, prefix string, startAfterNum uint64) (lastInjectedNum uint64, err error) {
+	lastInjectedNum = startAfterNum
 
 	// This expects an ordered walking of all files, so it's an important requierements on the backing store
-	err = s.shardsStore.Walk(ctx, "", "", func(filename string) error {
+	err = s.shardsStore.Walk(ctx, prefix, "", func(filename string) error {
+		if filename == shardingConfigFilename {
+			return nil
+		}
+
 		fileFirst, fileLast, err := parseFileName(filename)
 		if err != nil {
 			return err
 		}
 
-		if fileFirst > startAfterNum+1 {
-			return fmt.Errorf("file %s starts at block %d, we were expecting to start right after %d, there is a hole in your block range files", filename, fileFirst, startAfter)
+		if fileFirst > lastInjectedNum+1 {
+			if s.watchInterval != 0 {
+				zlog.Info("shard file not contiguous, waiting for missing shard files to be uploaded", zap.String("filename", filename), zap.Uint64("start_after", lastInjectedNum))
+				return dstore.StopIteration
+			}
+
+			return &ErrHoleInShards{ShardIndex: s.db.shardIndex, ExpectedBlock: lastInjectedNum + 1, FoundBlock: fileFirst, Filename: filename}
 		}
-		if fileLast <= startAfterNum {
-			zlog.Info("skipping shard file", zap.String("filename", filename), zap.Uint64("start_after", startAfterNum))
+		if fileLast <= lastInjectedNum {
+			zlog.Debug("skipping shard file", zap.String("filename", filename), zap.Uint64("start_after", lastInjectedNum))
 			return nil
 		}
 
@@ -83,26 +323,48 @@ func (s *ShardInjector) Run() (err error) {
 		}
 		defer reader.Close()
 
-		requests, err := ReadShard(reader, startAfterNum)
+		requests, err := ReadShard(reader, lastInjectedNum)
 		if err != nil {
 			return fmt.Errorf("unable to read all write requests in batch %q: %w", filename, err)
 		}
 
-		if err := s.db.WriteBatch(ctx, requests); err != nil {
-			return fmt.Errorf("write batch %q: %w", filename, err)
+		switch s.mode {
+		case ShardInjectorModeDryRun, ShardInjectorModeVerify:
+			if err := validateShardRequests(filename, fileFirst, fileLast, requests); err != nil {
+				return err
+			}
+
+			if s.mode == ShardInjectorModeVerify {
+				if err := s.verifyRequests(ctx, requests, s.verifyUpToHeight); err != nil {
+					return fmt.Errorf("verify %q: %w", filename, err)
+				}
+			}
+
+		default:
+			// The renewals are not atomic, the lease is confirmed before each write it protects
+			if err := s.lease.check(ctx); err != nil {
+				return fmt.Errorf("shard lease: %w", err)
+			}
+
+			if err := s.db.WriteBatch(ctx, requests); err != nil {
+				return fmt.Errorf("write batch %q: %w", filename, err)
+			}
+
+			s.refreshShardLag(ctx, false)
 		}
 
-		startAfterNum = fileLast
+		s.report.addFile(requests)
+
+		lastInjectedNum = fileLast
+		s.lastInjectedFilename = filename
 		return nil
 	})
 
-	if err != nil {
-		return fmt.Errorf("walking shards store: %w", err)
-	}
-
-	return nil
+	return lastInjectedNum, err
 }
 
+// parseFileName parses the block range of a segment file name, block numbers are full 64-bit
+// values, zero-padded to any width.
 func parseFileName(filename string) (first, last uint64, err error) {
 	vals := strings.Split(filename, "-")
 	if len(vals) != 2 {
@@ -110,17 +372,15 @@ func parseFileName(filename string) (first, last uint64, err error) {
 		return
 	}
 
-	first64, err := strconv.ParseUint(vals[0], 10, 32)
+	first, err = strconv.ParseUint(vals[0], 10, 64)
 	if err != nil {
 		return 0, 0, err
 	}
-	first = uint64(first64)
 
-	last64, err := strconv.ParseUint(vals[1], 10, 32)
+	last, err = strconv.ParseUint(vals[1], 10, 64)
 	if err != nil {
 		return 0, 0, err
 	}
-	last = uint64(last64)
 
 	return
 }
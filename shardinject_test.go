@@ -15,9 +15,19 @@
 package fluxdb
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/dstore"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_parseFilename(t *testing.T) {
@@ -35,6 +45,20 @@ func Test_parseFilename(t *testing.T) {
 			expectLast:  103999999,
 			expectError: false,
 		},
+		{
+			name:        "64-bit",
+			in:          "00000000004294967296-18446744073709551615",
+			expectFirst: 4294967296,
+			expectLast:  18446744073709551615,
+			expectError: false,
+		},
+		{
+			name:        "overflow",
+			in:          "00000000000000000001-18446744073709551616",
+			expectFirst: 0,
+			expectLast:  0,
+			expectError: true,
+		},
 		{
 			name:        "not-numbers",
 			in:          "0103500000x-0234252444y",
@@ -65,3 +89,223 @@ func Test_parseFilename(t *testing.T) {
 	}
 
 }
+
+func TestShardInjector_WatchMode(t *testing.T) {
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	generateShardFile := func(dir string, startBlock, stopBlock uint64, blockIDs ...string) {
+		shardsStore, err := dstore.NewLocalStore(dir, "", "", true)
+		require.NoError(t, err)
+
+		sharder, err := NewSharder(shardsStore, "", 1, startBlock, stopBlock)
+		require.NoError(t, err)
+
+		tablet := newTestTablet("tbl")
+		for _, blockID := range blockIDs[:len(blockIDs)-1] {
+			num := bstream.NewBlockRefFromID(blockID).Num()
+			streamBlock(t, sharder, blockID, "", writeRequest(nil, []TabletRow{tablet.row(t, num, "001", blockID)}))
+		}
+		endBlock(t, sharder, blockIDs[len(blockIDs)-1])
+	}
+
+	generateShardFile(path.Join(storeDir, "first"), 1, 2, "00000001aa", "00000002aa", "00000003aa")
+	generateShardFile(path.Join(storeDir, "second"), 3, 4, "00000003aa", "00000004aa", "00000005aa")
+
+	watchedDir := path.Join(storeDir, "watched")
+	require.NoError(t, os.MkdirAll(watchedDir, os.ModePerm))
+
+	uploadShardFile := func(segment, filename string) {
+		content, err := ioutil.ReadFile(path.Join(storeDir, segment, "000", filename))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path.Join(watchedDir, filename), content, 0644))
+	}
+
+	waitForHeight := func(db *FluxDB, height uint64) {
+		require.Eventually(t, func() bool {
+			lastHeight, _, err := db.FetchLastWrittenCheckpoint(context.Background())
+			return err == nil && lastHeight == height
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	localStore, err := dstore.NewLocalStore(watchedDir, "", "", false)
+	require.NoError(t, err)
+	watchedStore := &walkRecordingStore{Store: localStore}
+
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	injector := NewShardInjector(watchedStore, db)
+	injector.SetWatchInterval(10 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		done <- injector.Run()
+	}()
+
+	uploadShardFile("first", "0000000001-0000000002")
+	waitForHeight(db, 2)
+
+	uploadShardFile("second", "0000000003-0000000004")
+	waitForHeight(db, 4)
+
+	injector.Shutdown(nil)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("injector should have terminated")
+	}
+
+	rows, err := db.ReadTabletAt(context.Background(), 4, newTestTablet("tbl"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{newTestTablet("tbl").row(t, 4, "001", "00000004aa")}, rows)
+
+	// Once the first shard file is injected, the polls only look for the file following the last injected one
+	prefixes := watchedStore.walkedPrefixes()
+	for len(prefixes) > 0 && prefixes[0] == "" {
+		prefixes = prefixes[1:]
+	}
+
+	require.Contains(t, prefixes, "0000000003-")
+	for _, prefix := range prefixes {
+		assert.Contains(t, []string{"0000000003-", "0000000005-"}, prefix)
+	}
+}
+
+// walkRecordingStore records the prefixes of the walks of the store.
+type walkRecordingStore struct {
+	dstore.Store
+
+	lock     sync.Mutex
+	prefixes []string
+}
+
+func (s *walkRecordingStore) Walk(ctx context.Context, prefix, ignoreSuffix string, f func(filename string) error) error {
+	s.lock.Lock()
+	s.prefixes = append(s.prefixes, prefix)
+	s.lock.Unlock()
+
+	return s.Store.Walk(ctx, prefix, ignoreSuffix, f)
+}
+
+func (s *walkRecordingStore) walkedPrefixes() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.prefixes...)
+}
+
+func TestShardInjector_HoleInShards(t *testing.T) {
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	shardsStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+
+	sharder, err := NewSharder(shardsStore, "", 1, 3, 4)
+	require.NoError(t, err)
+
+	tablet := newTestTablet("tbl")
+	streamBlock(t, sharder, "00000003aa", "", writeRequest(nil, []TabletRow{tablet.row(t, 3, "001", "a")}))
+	streamBlock(t, sharder, "00000004aa", "", writeRequest(nil, []TabletRow{tablet.row(t, 4, "001", "b")}))
+	endBlock(t, sharder, "00000005aa")
+
+	shardStore, err := dstore.NewLocalStore(path.Join(storeDir, "000"), "", "", false)
+	require.NoError(t, err)
+
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	err = NewShardInjector(shardStore, db).Run()
+
+	var hole *ErrHoleInShards
+	require.True(t, errors.As(err, &hole), "got %v", err)
+	assert.Equal(t, &ErrHoleInShards{ShardIndex: 0, ExpectedBlock: 1, FoundBlock: 3, Filename: "0000000003-0000000004"}, hole)
+}
+
+func TestShardInjector_DryRunAndVerify(t *testing.T) {
+	ctx := context.Background()
+
+	storeDir, cleanup := createTempDir(t, "")
+	defer cleanup()
+
+	shardsStore, err := dstore.NewLocalStore(storeDir, "", "", true)
+	require.NoError(t, err)
+
+	sharder, err := NewSharder(shardsStore, "", 1, 1, 2)
+	require.NoError(t, err)
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+
+	streamBlock(t, sharder, "00000001aa", "", writeRequest(
+		[]SingletEntry{singlet.entry(t, 1, "s #1")},
+		[]TabletRow{tablet.row(t, 1, "001", "r1 #1"), tablet.row(t, 1, "002", "r2 #1")}),
+	)
+	streamBlock(t, sharder, "00000002aa", "", writeRequest(nil, []TabletRow{tablet.row(t, 2, "001", "r1 #2")}))
+	endBlock(t, sharder, "00000003aa")
+
+	shardStore, err := dstore.NewLocalStore(path.Join(storeDir, "000"), "", "", false)
+	require.NoError(t, err)
+
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	dryRun := NewShardInjector(shardStore, db)
+	dryRun.SetMode(ShardInjectorModeDryRun)
+	require.NoError(t, dryRun.Run())
+	assert.Equal(t, &ShardInjectionReport{
+		Mode:              "dry-run",
+		FileCount:         1,
+		RequestCount:      2,
+		SingletEntryCount: 1,
+		TabletRowCount:    3,
+		FirstHeight:       1,
+		LastHeight:        2,
+	}, dryRun.Report())
+
+	height, _, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), height, "dry-run should not write anything")
+
+	require.NoError(t, NewShardInjector(shardStore, db).Run())
+
+	verify := NewShardInjector(shardStore, db)
+	verify.SetMode(ShardInjectorModeVerify)
+	require.NoError(t, verify.Run())
+	assert.Equal(t, 0, verify.Report().DivergenceCount)
+	assert.Equal(t, 2, verify.Report().RequestCount)
+
+	batch := db.store.NewBatch(zlog)
+	batch.SetRow(KeyForTabletRowFromParts(tablet, 2, []byte("001")), []byte("tampered"))
+	require.NoError(t, batch.Flush(ctx))
+
+	verify = NewShardInjector(shardStore, db)
+	verify.SetMode(ShardInjectorModeVerify)
+	assert.Error(t, verify.Run())
+	assert.Equal(t, 1, verify.Report().DivergenceCount)
+	require.Len(t, verify.Report().Divergences, 1)
+	assert.Contains(t, verify.Report().Divergences[0], "tst:tbl")
+}
+
+func TestShardInjector_RefreshShardLag(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	injector := NewShardInjector(nil, db)
+	injector.refreshShardLag(ctx, false)
+	assert.True(t, injector.shardLagRefreshedAt.IsZero(), "not sharding, nothing to refresh")
+
+	db.SetSharding(0, 2)
+	injector.refreshShardLag(ctx, false)
+	refreshedAt := injector.shardLagRefreshedAt
+	require.False(t, refreshedAt.IsZero())
+
+	injector.refreshShardLag(ctx, false)
+	assert.Equal(t, refreshedAt, injector.shardLagRefreshedAt, "refreshed at most once per interval")
+
+	injector.refreshShardLag(ctx, true)
+	assert.True(t, injector.shardLagRefreshedAt.After(refreshedAt), "forced refresh")
+}
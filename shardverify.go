@@ -0,0 +1,173 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// ShardInjectorMode determines what the ShardInjector does with the write requests decoded
+// from the shard files.
+type ShardInjectorMode int
+
+const (
+	// ShardInjectorModeInject writes the decoded write requests to the store, the default.
+	ShardInjectorModeInject ShardInjectorMode = iota
+
+	// ShardInjectorModeDryRun only decodes and validates the shard files, reporting what
+	// would be written without writing anything.
+	ShardInjectorModeDryRun
+
+	// ShardInjectorModeVerify compares the decoded write requests against the data already
+	// in the store, reporting any divergence, without writing anything.
+	ShardInjectorModeVerify
+)
+
+func (m ShardInjectorMode) String() string {
+	switch m {
+	case ShardInjectorModeDryRun:
+		return "dry-run"
+	case ShardInjectorModeVerify:
+		return "verify"
+	default:
+		return "inject"
+	}
+}
+
+// The maximum amount of divergences kept in the report, the total count is always accurate
+const maxReportedDivergences = 100
+
+// ShardInjectionReport summarizes what was (or would be) written by a ShardInjector run and,
+// in verify mode, the divergences found between the shard files and the store.
+type ShardInjectionReport struct {
+	Mode              string   `json:"mode"`
+	FileCount         int      `json:"file_count"`
+	RequestCount      int      `json:"request_count"`
+	SingletEntryCount int      `json:"singlet_entry_count"`
+	TabletRowCount    int      `json:"tablet_row_count"`
+	FirstHeight       uint64   `json:"first_height"`
+	LastHeight        uint64   `json:"last_height"`
+	DivergenceCount   int      `json:"divergence_count"`
+	Divergences       []string `json:"divergences,omitempty"`
+}
+
+func (r *ShardInjectionReport) addFile(requests []*WriteRequest) {
+	r.FileCount++
+	for _, request := range requests {
+		if r.FirstHeight == 0 {
+			r.FirstHeight = request.Height
+		}
+
+		r.LastHeight = request.Height
+		r.RequestCount++
+		r.SingletEntryCount += len(request.SingletEntries)
+		r.TabletRowCount += len(request.TabletRows)
+	}
+}
+
+func (r *ShardInjectionReport) addDivergence(format string, args ...interface{}) {
+	r.DivergenceCount++
+	if len(r.Divergences) < maxReportedDivergences {
+		r.Divergences = append(r.Divergences, fmt.Sprintf(format, args...))
+	}
+}
+
+// validateShardRequests ensures the write requests decoded from a shard file are ordered and
+// within the block range of the file.
+func validateShardRequests(filename string, fileFirst, fileLast uint64, requests []*WriteRequest) error {
+	var previousHeight uint64
+	for _, request := range requests {
+		if request.Height < fileFirst || request.Height > fileLast {
+			return fmt.Errorf("file %s contains request at height %d outside of its range [%d, %d]", filename, request.Height, fileFirst, fileLast)
+		}
+
+		if request.Height <= previousHeight {
+			return fmt.Errorf("file %s contains request at height %d following request at height %d, requests must be strictly ordered", filename, request.Height, previousHeight)
+		}
+
+		previousHeight = request.Height
+	}
+
+	return nil
+}
+
+// verifyRequests compares each singlet entry and tablet row of the write requests against the
+// value stored at the same key, recording any divergence in the report. Requests above
+// `upToHeight` (the last written checkpoint) are not expected to be in the store and are skipped.
+func (s *ShardInjector) verifyRequests(ctx context.Context, requests []*WriteRequest, upToHeight uint64) error {
+	for _, request := range requests {
+		if request.Height > upToHeight {
+			continue
+		}
+
+		for _, entry := range request.SingletEntries {
+			var expected []byte
+			if !entry.IsDeletion() {
+				value, err := entry.MarshalValue()
+				if err != nil {
+					return fmt.Errorf("singlet to proto: %w", err)
+				}
+				expected = value
+			}
+
+			if err := s.verifyKey(ctx, KeyForSingletEntry(entry), expected, entry); err != nil {
+				return err
+			}
+		}
+
+		ordinals := tabletRowOrdinals(request.TabletRows)
+		for i, row := range request.TabletRows {
+			expected, err := marshalTabletRowValue(row)
+			if err != nil {
+				return fmt.Errorf("tablet to proto: %w", err)
+			}
+
+			ordinal := uint32(LastTabletRowOrdinal)
+			if ordinals != nil {
+				ordinal = ordinals[i]
+			}
+
+			if err := s.verifyKey(ctx, KeyForTabletRowVersion(row.Tablet(), row.Height(), ordinal, row.PrimaryKey()), expected, row); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *ShardInjector) verifyKey(ctx context.Context, key []byte, expected []byte, element fmt.Stringer) error {
+	// Singlet entries and tablet rows are both stored in the rows table, fetching by exact key works for both
+	actual, err := s.db.store.FetchTabletRow(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		s.report.addDivergence("%s: missing from store", element)
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("fetch row %q: %w", Key(key), err)
+	}
+
+	if !bytes.Equal(actual, expected) {
+		s.report.addDivergence("%s: stored value %x differs from shard value %x", element, actual, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/dbin"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+// The amount of marshalled write requests queued per shard writer before the sharder blocks
+// waiting for the shard writer to catch up
+const shardWriterQueueSize = 64
+
+// The size of the buffer in front of each shard scratch file, so encoded messages are written
+// to disk in large chunks instead of one (or two) system calls per message
+const shardFileBufferSize = 1024 * 1024
+
+// Pool of the buffers write requests are marshalled into before being encoded in the shards,
+// avoids allocating a fresh buffer per write request per shard
+var shardEncodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return proto.NewBuffer(make([]byte, 0, 4096))
+	},
+}
+
+var shardFileBufferPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, shardFileBufferSize)
+	},
+}
+
+// shardFile is a shard scratch file along with the buffered writer in front of it.
+type shardFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func newShardFile(file *os.File) *shardFile {
+	writer := shardFileBufferPool.Get().(*bufio.Writer)
+	writer.Reset(file)
+
+	return &shardFile{Writer: writer, file: file}
+}
+
+// flush writes the buffered data to the file and returns the buffered writer to the pool, the
+// shard file must not be written to anymore afterward.
+func (f *shardFile) flush() error {
+	err := f.Writer.Flush()
+
+	f.Writer.Reset(nil)
+	shardFileBufferPool.Put(f.Writer)
+	f.Writer = nil
+
+	return err
+}
+
+// shardWriter encodes the write requests of a single shard into its segment and uploads the
+// segment to the shards store. Each shard writer runs in its own goroutine, so the encoding and
+// the upload of the segments of all shards overlap instead of running one after the other.
+//
+// The segment is accumulated in memory or in a scratch file and uploaded once complete, or when
+// streaming uploads are enabled, uploaded to the shards store while it's being encoded. A
+// streamed segment is uploaded under its final name, the dstore backends having no rename, so
+// the partial object of a failed or aborted segment is deleted (see `abort`).
+type shardWriter struct {
+	sharder    *Sharder
+	shardIndex int
+
+	// The object name of the segment, only known once completed unless streaming uploads
+	name string
+
+	requests chan *proto.Buffer
+	done     chan struct{}
+
+	writer  io.Writer
+	encoder *dbin.Writer
+
+	// Only set when streaming uploads, receives the outcome of the upload reading the pipe
+	uploaded chan error
+
+	lock sync.Mutex
+	err  error
+}
+
+func (s *Sharder) newShardWriter(shardIndex int) (*shardWriter, error) {
+	w := &shardWriter{
+		sharder:    s,
+		shardIndex: shardIndex,
+		requests:   make(chan *proto.Buffer, shardWriterQueueSize),
+		done:       make(chan struct{}),
+	}
+
+	switch {
+	case s.streamingUploads:
+		// Segments are never cut when streaming, so the segment always ends at the stop block
+		w.name = path.Join(shardDirectory(shardIndex), s.segmentIdentifier(s.segmentStartBlock, s.stopBlock))
+
+		reader, writer := io.Pipe()
+		w.writer = writer
+		w.uploaded = make(chan error, 1)
+
+		go func() {
+			err := s.shardsStore.WriteObject(context.Background(), w.name, reader)
+
+			// Unblocks the encoding side if the upload stopped before reading the whole segment
+			reader.CloseWithError(err)
+			w.uploaded <- err
+		}()
+
+	case s.scratchDirectory != "":
+		file, err := os.OpenFile(path.Join(s.scratchDirectory, fmt.Sprintf("shard-%03d-%0*d.dbin.tmp", shardIndex, s.filenamePadding, s.segmentStartBlock)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("scratch directory for shard %d: %w", shardIndex, err)
+		}
+
+		w.writer = newShardFile(file)
+
+	default:
+		w.writer = bytes.NewBuffer(nil)
+	}
+
+	w.encoder = dbin.NewWriter(w.writer)
+	go w.run()
+
+	return w, nil
+}
+
+// write queues the marshalled write request for encoding, the shard writer takes ownership of
+// the buffer and returns it to the pool once encoded. Returns the error of the shard writer, if
+// it failed.
+func (w *shardWriter) write(buffer *proto.Buffer) error {
+	if err := w.error(); err != nil {
+		shardEncodeBufferPool.Put(buffer)
+		return err
+	}
+
+	w.requests <- buffer
+	return nil
+}
+
+// complete signals that all write requests of the segment were written, the segment is then
+// completed and uploaded in the background under `name`, see `wait`.
+func (w *shardWriter) complete(name string) {
+	if w.uploaded == nil {
+		w.name = name
+	}
+
+	close(w.requests)
+}
+
+// abort discards the segment, no more write requests are written and the streamed upload, if
+// any, is aborted and its partial object deleted, see `wait`.
+func (w *shardWriter) abort(err error) {
+	w.setError(err)
+	close(w.requests)
+}
+
+// wait waits for the segment to be completed and uploaded, returns the error of the shard
+// writer, if it failed.
+func (w *shardWriter) wait() error {
+	<-w.done
+
+	return w.error()
+}
+
+func (w *shardWriter) run() {
+	defer close(w.done)
+
+	err := w.encoder.WriteHeader(shardBinaryContentType, shardBinaryVersion)
+	if err != nil {
+		w.setError(fmt.Errorf("encoding header: %w", err))
+	}
+
+	for buffer := range w.requests {
+		if err == nil {
+			if err = w.encoder.WriteMessage(buffer.Bytes()); err != nil {
+				w.setError(fmt.Errorf("encoding message: %w", err))
+			}
+		}
+
+		shardEncodeBufferPool.Put(buffer)
+	}
+
+	if err == nil {
+		// An aborted segment is discarded even when all its write requests were encoded
+		err = w.error()
+	}
+
+	if err != nil {
+		if pipe, ok := w.writer.(*io.PipeWriter); ok {
+			// Aborts the upload, a partial segment must never be left in the shards store
+			pipe.CloseWithError(err)
+			<-w.uploaded
+			w.deletePartialUpload()
+		}
+
+		return
+	}
+
+	if err := w.upload(); err != nil {
+		if w.uploaded != nil {
+			w.deletePartialUpload()
+		}
+
+		w.setError(fmt.Errorf("unable to correctly write shard %d: %w", w.shardIndex, err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	if err := w.sharder.writeShardingConfig(ctx, w.shardIndex); err != nil {
+		w.setError(fmt.Errorf("unable to write sharding config of shard %d: %w", w.shardIndex, err))
+	}
+}
+
+// deletePartialUpload deletes the object of a streamed upload that did not complete, the
+// backends possibly leaving the object written up to the failure.
+func (w *shardWriter) deletePartialUpload() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	exists, err := w.sharder.shardsStore.FileExists(ctx, w.name)
+	if err == nil && exists {
+		err = w.sharder.shardsStore.DeleteObject(ctx, w.name)
+	}
+
+	if err != nil {
+		zlog.Warn("unable to delete partial shard segment, it must be deleted before injecting the shard", zap.String("name", w.name), zap.Error(err))
+	}
+}
+
+func (w *shardWriter) upload() error {
+	switch v := w.writer.(type) {
+	case *io.PipeWriter:
+		v.Close()
+		return <-w.uploaded
+
+	case *shardFile:
+		if err := v.flush(); err != nil {
+			return fmt.Errorf("flush scratch file: %w", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		return w.sharder.writeShardRequestsFromFile(ctx, w.name, v.file)
+
+	case *bytes.Buffer:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		return w.sharder.writeShardRequestsFromMemory(ctx, w.name, v)
+	}
+
+	panic(fmt.Errorf("don't kown how to handle shard requests writer of type %T", w.writer))
+}
+
+func (w *shardWriter) error() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.err
+}
+
+func (w *shardWriter) setError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb/store"
+	pbfluxdb "github.com/dfuse-io/pbgo/dfuse/fluxdb/v1"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+// The checkpoint table key under which the source cursor of the pipeline is persisted
+var sourceCursorKey = []byte("meta-source-cursor")
+
+// CursorBlock is a block of the `SourceCursor`.
+type CursorBlock struct {
+	ID         string `json:"id"`
+	Num        uint64 `json:"num"`
+	PreviousID string `json:"previous_id,omitempty"`
+
+	// Request is the proto encoded write request of a block of the reversible segment
+	Request []byte `json:"request,omitempty"`
+}
+
+func newCursorBlock(ref bstream.BlockRef, previousID string) CursorBlock {
+	return CursorBlock{ID: ref.ID(), Num: ref.Num(), PreviousID: previousID}
+}
+
+// AsRef returns the reference of the block.
+func (b CursorBlock) AsRef() bstream.BlockRef {
+	return bstream.NewBlockRef(b.ID, b.Num)
+}
+
+// SourceCursor is the position of the pipeline in the chain, including its fork state, as of
+// its last write: the last irreversible block written, the head block and the blocks of the
+// reversible segment in between, with their write requests. It's written in the same batch as
+// the last written checkpoint, so both always agree.
+//
+// On restart, the pipeline resumes from the cursor: its fork database is seeded with the
+// reversible segment, served to the speculative reads right away, and the blocks are streamed
+// from the head block on. The reversible blocks are written once they become irreversible. When
+// the head block turns out to be forked out, the pipeline restarts from the last written block
+// instead, streaming the reversible segment again.
+type SourceCursor struct {
+	LIB       CursorBlock `json:"lib"`
+	HeadBlock CursorBlock `json:"head_block"`
+
+	ReversibleSegment []CursorBlock `json:"reversible_segment,omitempty"`
+}
+
+// FetchSourceCursor returns the source cursor persisted by the pipeline, `nil` when none was
+// persisted yet.
+func (fdb *FluxDB) FetchSourceCursor(ctx context.Context) (*SourceCursor, error) {
+	value, err := fdb.store.FetchLastWrittenCheckpoint(ctx, sourceCursorKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("fetch source cursor: %w", err)
+	}
+
+	cursor := &SourceCursor{}
+	if err := json.Unmarshal(value, cursor); err != nil {
+		return nil, fmt.Errorf("unmarshal source cursor: %w", err)
+	}
+
+	return cursor, nil
+}
+
+func setSourceCursor(batch store.Batch, cursor *SourceCursor) error {
+	value, err := json.Marshal(cursor)
+	if err != nil {
+		return fmt.Errorf("marshal source cursor: %w", err)
+	}
+
+	batch.SetLastCheckpoint(sourceCursorKey, value)
+	return nil
+}
+
+// sourceCursor returns the position of the handler once `lib`, the last block of the batch being
+// written, is written.
+func (p *FluxDBHandler) sourceCursor(lib *WriteRequest) (*SourceCursor, error) {
+	p.speculativeReadsLock.RLock()
+	defer p.speculativeReadsLock.RUnlock()
+
+	cursor := &SourceCursor{
+		LIB:       newCursorBlock(lib.BlockRef, lib.PreviousBlockID),
+		HeadBlock: newCursorBlock(p.headBlock, ""),
+	}
+
+	for _, write := range p.speculativeWrites {
+		if write.BlockRef == nil || write.Height <= lib.Height {
+			continue
+		}
+
+		protoRequest, err := write.ToProto()
+		if err != nil {
+			return nil, fmt.Errorf("request of block %s to proto: %w", write.BlockRef, err)
+		}
+
+		block := newCursorBlock(write.BlockRef, write.PreviousBlockID)
+		if block.Request, err = proto.Marshal(protoRequest); err != nil {
+			return nil, fmt.Errorf("marshal request of block %s: %w", write.BlockRef, err)
+		}
+
+		cursor.ReversibleSegment = append(cursor.ReversibleSegment, block)
+	}
+
+	return cursor, nil
+}
+
+// resumeFromSourceCursor seeds the fork database and the speculative writes with the reversible
+// segment of the persisted source cursor, returning the head block to stream from, `nil` when
+// the pipeline must restart from `lib`, the last written block.
+func (p *FluxDBHandler) resumeFromSourceCursor(ctx context.Context, lib bstream.BlockRef) bstream.BlockRef {
+	if p.sourceCursorForkedOut {
+		p.sourceCursorForkedOut = false
+		zlog.Info("source cursor head block forked out, restarting from the last written block", zap.Stringer("lib", lib))
+		return nil
+	}
+
+	cursor, err := p.db.FetchSourceCursor(ctx)
+	if err != nil {
+		zlog.Warn("unable to fetch source cursor, restarting from the last written block", zap.Error(err))
+		return nil
+	}
+
+	if cursor == nil || len(cursor.ReversibleSegment) == 0 {
+		return nil
+	}
+
+	if !bstream.EqualsBlockRefs(cursor.LIB.AsRef(), lib) {
+		zlog.Info("ignoring stale source cursor, it does not match the last written block", zap.Stringer("cursor_lib", cursor.LIB.AsRef()), zap.Stringer("lib", lib))
+		return nil
+	}
+
+	writes := make([]*WriteRequest, len(cursor.ReversibleSegment))
+	for i, block := range cursor.ReversibleSegment {
+		protoRequest := &pbfluxdb.WriteRequest{}
+		if err := proto.Unmarshal(block.Request, protoRequest); err != nil {
+			zlog.Warn("invalid source cursor request, restarting from the last written block", zap.Stringer("block", block.AsRef()), zap.Error(err))
+			return nil
+		}
+
+		if writes[i], err = NewWriteRequestFromProto(protoRequest); err != nil {
+			zlog.Warn("invalid source cursor request, restarting from the last written block", zap.Stringer("block", block.AsRef()), zap.Error(err))
+			return nil
+		}
+		writes[i].PreviousBlockID = block.PreviousID
+	}
+
+	for _, write := range writes {
+		p.serverForkDB.AddLink(write.BlockRef, bstream.NewBlockRef(write.PreviousBlockID, write.BlockRef.Num()-1), write)
+	}
+
+	p.speculativeReadsLock.Lock()
+	p.speculativeWrites = writes
+	p.headBlock = cursor.HeadBlock.AsRef()
+	p.speculativeReadsLock.Unlock()
+
+	p.resumedWrites = writes
+	p.resumedHeadBlock = cursor.HeadBlock.AsRef()
+
+	zlog.Info("resuming from source cursor",
+		zap.Stringer("lib", lib),
+		zap.Stringer("head_block", p.resumedHeadBlock),
+		zap.Int("reversible_block_count", len(writes)),
+	)
+
+	return p.resumedHeadBlock
+}
+
+// takeResumedWrites returns, once, the writes of the reversible segment the pipeline resumed
+// from, irreversible once the first block streamed after its head block is.
+func (p *FluxDBHandler) takeResumedWrites() []*WriteRequest {
+	writes := p.resumedWrites
+	p.resumedWrites = nil
+
+	return writes
+}
+
+// sourceCursorGuard sits in front of the forkable of a pipeline resumed from a source cursor,
+// failing the source when the head block of the cursor was forked out while stopped, the
+// forkable never linking the blocks of the new fork to it.
+type sourceCursorGuard struct {
+	handler   *FluxDBHandler
+	headBlock bstream.BlockRef
+	next      bstream.Handler
+	linked    bool
+}
+
+func (g *sourceCursorGuard) ProcessBlock(blk *bstream.Block, obj interface{}) error {
+	if !g.linked {
+		switch {
+		case blk.Num() == g.headBlock.Num()+1 && blk.PreviousID() == g.headBlock.ID():
+			g.linked = true
+
+		case blk.Num() > g.headBlock.Num()+1:
+			// The source restarts from the last written block, see `resumeFromSourceCursor`
+			g.handler.sourceCursorForkedOut = true
+			return fmt.Errorf("source cursor head block %s forked out, block %s does not follow it", g.headBlock, blk)
+		}
+	}
+
+	return g.next.ProcessBlock(blk, obj)
+}
@@ -0,0 +1,151 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceCursor(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	cursor, err := db.FetchSourceCursor(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, cursor)
+
+	handler := NewHandler(db)
+	handler.EnableWrites()
+	handler.EnableWriteOnEachIrreversibleStep()
+	handler.serverForkDB = forkable.NewForkDB()
+
+	handler.speculativeWrites = []*WriteRequest{
+		{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), PreviousBlockID: "00000001aa"},
+		{Height: 3, BlockRef: bstream.NewBlockRef("00000003aa", 3), PreviousBlockID: "00000002aa"},
+	}
+	handler.headBlock = bstream.NewBlockRef("00000003aa", 3)
+
+	blk := &bstream.Block{Id: "00000001aa", Number: 1, PreviousId: "00000000aa"}
+	request := &WriteRequest{Height: 1, BlockRef: blk.AsRef(), PreviousBlockID: "00000000aa"}
+	require.NoError(t, handler.ProcessBlock(blk, &forkable.ForkableObject{
+		Step:       forkable.StepIrreversible,
+		StepCount:  1,
+		StepBlocks: []*forkable.ForkableBlock{{Block: blk, Obj: request}},
+	}))
+
+	cursor, err = db.FetchSourceCursor(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, cursor)
+	assert.Equal(t, CursorBlock{ID: "00000001aa", Num: 1, PreviousID: "00000000aa"}, cursor.LIB)
+	assert.Equal(t, CursorBlock{ID: "00000003aa", Num: 3}, cursor.HeadBlock)
+	require.Len(t, cursor.ReversibleSegment, 2)
+	assert.Equal(t, "00000002aa", cursor.ReversibleSegment[0].ID)
+	assert.Equal(t, "00000003aa", cursor.ReversibleSegment[1].ID)
+	assert.NotEmpty(t, cursor.ReversibleSegment[1].Request)
+
+	// The pipeline resumes from the head block, the reversible segment being served right away
+	resumed := NewHandler(db)
+	resumed.EnableWrites()
+	resumed.EnableWriteOnEachIrreversibleStep()
+
+	startBlock, err := resumed.InitializeStartBlockID()
+	require.NoError(t, err)
+	assert.Equal(t, cursor.HeadBlock.AsRef(), startBlock)
+	assert.Equal(t, cursor.HeadBlock.AsRef(), resumed.HeadBlock(ctx))
+
+	speculativeWrites := resumed.FetchSpeculativeWrites(ctx, "00000003aa", 3)
+	require.Len(t, speculativeWrites, 2)
+	assert.Equal(t, uint64(2), speculativeWrites[0].Height)
+	assert.Equal(t, "00000001aa", speculativeWrites[0].PreviousBlockID)
+	assert.Equal(t, uint64(3), speculativeWrites[1].Height)
+
+	// The first irreversible block following the head block writes the resumed segment first
+	blk = &bstream.Block{Id: "00000004aa", Number: 4, PreviousId: "00000003aa"}
+	request = &WriteRequest{Height: 4, BlockRef: blk.AsRef(), PreviousBlockID: "00000003aa"}
+	require.NoError(t, resumed.ProcessBlock(blk, &forkable.ForkableObject{
+		Step:       forkable.StepIrreversible,
+		StepCount:  1,
+		StepBlocks: []*forkable.ForkableBlock{{Block: blk, Obj: request}},
+	}))
+
+	height, lastBlock, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), height)
+	assert.Equal(t, "00000004aa", lastBlock.ID())
+
+	cursor, err = db.FetchSourceCursor(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, CursorBlock{ID: "00000004aa", Num: 4, PreviousID: "00000003aa"}, cursor.LIB)
+}
+
+func TestSourceCursor_StaleOrForkedOut(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	writeBatchOfRequests(t, db, &WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1)})
+
+	batch := db.store.NewBatch(zlog)
+	require.NoError(t, setSourceCursor(batch, &SourceCursor{
+		LIB:               CursorBlock{ID: "00000001aa", Num: 1},
+		HeadBlock:         CursorBlock{ID: "00000002aa", Num: 2},
+		ReversibleSegment: []CursorBlock{newTestCursorBlock(t, &WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), PreviousBlockID: "00000001aa"})},
+	}))
+	require.NoError(t, batch.Flush(ctx))
+
+	handler := NewHandler(db)
+	startBlock, err := handler.InitializeStartBlockID()
+	require.NoError(t, err)
+	assert.Equal(t, "00000001aa", startBlock.ID(), "only the writer resumes from the source cursor")
+
+	handler.EnableWrites()
+	startBlock, err = handler.InitializeStartBlockID()
+	require.NoError(t, err)
+	assert.Equal(t, "00000002aa", startBlock.ID())
+
+	var processed []string
+	guard := &sourceCursorGuard{handler: handler, headBlock: startBlock, next: bstream.HandlerFunc(func(blk *bstream.Block, obj interface{}) error {
+		processed = append(processed, blk.ID())
+		return nil
+	})}
+
+	// A block of another fork at the height following the head block does not decide yet
+	require.NoError(t, guard.ProcessBlock(&bstream.Block{Id: "00000003bb", Number: 3, PreviousId: "00000002bb"}, nil))
+	assert.Error(t, guard.ProcessBlock(&bstream.Block{Id: "00000004bb", Number: 4, PreviousId: "00000003bb"}, nil))
+	assert.Equal(t, []string{"00000003bb"}, processed)
+
+	startBlock, err = handler.InitializeStartBlockID()
+	require.NoError(t, err)
+	assert.Equal(t, "00000001aa", startBlock.ID(), "head block forked out, restarting from the last written block")
+	assert.Empty(t, handler.FetchSpeculativeWrites(ctx, "", 2))
+
+	startBlock, err = handler.InitializeStartBlockID()
+	require.NoError(t, err)
+	guard = &sourceCursorGuard{handler: handler, headBlock: startBlock, next: bstream.HandlerFunc(func(blk *bstream.Block, obj interface{}) error { return nil })}
+	require.NoError(t, guard.ProcessBlock(&bstream.Block{Id: "00000003aa", Number: 3, PreviousId: "00000002aa"}, nil))
+	require.NoError(t, guard.ProcessBlock(&bstream.Block{Id: "00000004aa", Number: 4, PreviousId: "00000003aa"}, nil), "linked to the head block")
+
+	// A cursor not matching the last written block is ignored
+	writeBatchOfRequests(t, db, &WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2)})
+	startBlock, err = handler.InitializeStartBlockID()
+	require.NoError(t, err)
+	assert.Equal(t, "00000002aa", startBlock.ID())
+	assert.Nil(t, handler.resumedHeadBlock)
+}
+
+func newTestCursorBlock(t *testing.T, request *WriteRequest) CursorBlock {
+	protoRequest, err := request.ToProto()
+	require.NoError(t, err)
+
+	block := newCursorBlock(request.BlockRef, request.PreviousBlockID)
+	block.Request, err = proto.Marshal(protoRequest)
+	require.NoError(t, err)
+
+	return block
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/bstream"
+)
+
+// ErrSpeculativeForkMismatch is the error returned by the reads when the speculative writes
+// received do not extend the last block written to the store, e.g. when they were fetched for a
+// head block on a fork that got reverted by a deep reorg. Overlaying them on the store would
+// return rows mixing both forks, the speculative writes must be fetched again instead.
+type ErrSpeculativeForkMismatch struct {
+	// LastWrittenBlock is the last block written to the store
+	LastWrittenBlock bstream.BlockRef
+
+	// Block is the block of the first speculative write not connecting to the ones before it
+	Block bstream.BlockRef
+
+	// PreviousBlockID is the previous block of `Block`, the one it was expected to connect to
+	PreviousBlockID string
+}
+
+func (e *ErrSpeculativeForkMismatch) Error() string {
+	return fmt.Sprintf("speculative block #%d (%s) does not connect to last written block #%d (%s), its previous block is %s",
+		e.Block.Num(), e.Block.ID(), e.LastWrittenBlock.Num(), e.LastWrittenBlock.ID(), e.PreviousBlockID)
+}
+
+// checkSpeculativeWrites ensures the speculative writes extend the last block written to the
+// store. The speculative writes at or below the last written block are expected to be pruned
+// soon, only the one of the last written block itself can be verified. The writes above it must
+// form a chain starting at the last written block, the ones without a previous block ID (see
+// `WriteRequest.PreviousBlockID`) or block reference are not verified.
+func (fdb *FluxDB) checkSpeculativeWrites(ctx context.Context, speculativeWrites []*WriteRequest) error {
+	if len(speculativeWrites) == 0 {
+		return nil
+	}
+
+	_, lastWrittenBlock, err := fdb.FetchLastWrittenCheckpoint(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch last written checkpoint: %w", err)
+	}
+
+	if bstream.EqualsBlockRefs(lastWrittenBlock, bstream.BlockRefEmpty) {
+		return nil
+	}
+
+	parent := lastWrittenBlock
+	for _, write := range speculativeWrites {
+		if write.BlockRef == nil {
+			continue
+		}
+
+		blockNum := write.BlockRef.Num()
+		if blockNum < lastWrittenBlock.Num() {
+			continue
+		}
+
+		if blockNum == lastWrittenBlock.Num() {
+			if write.BlockRef.ID() != lastWrittenBlock.ID() {
+				return &ErrSpeculativeForkMismatch{LastWrittenBlock: lastWrittenBlock, Block: write.BlockRef, PreviousBlockID: write.PreviousBlockID}
+			}
+
+			continue
+		}
+
+		if write.PreviousBlockID != "" && write.PreviousBlockID != parent.ID() {
+			return &ErrSpeculativeForkMismatch{LastWrittenBlock: lastWrittenBlock, Block: write.BlockRef, PreviousBlockID: write.PreviousBlockID}
+		}
+
+		parent = write.BlockRef
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTabletAt_SpeculativeForkMismatch(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "a")}},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), PreviousBlockID: "00000001aa"},
+	)
+
+	speculativeWrite := func(id string, height uint64, previousID string, value string) *WriteRequest {
+		return &WriteRequest{
+			Height:          height,
+			BlockRef:        bstream.NewBlockRef(id, height),
+			PreviousBlockID: previousID,
+			TabletRows:      []TabletRow{tablet.row(t, height, "002", value)},
+		}
+	}
+
+	rows, err := db.ReadTabletAt(ctx, 4, tablet, []*WriteRequest{
+		speculativeWrite("00000002aa", 2, "00000001aa", "b"),
+		speculativeWrite("00000003aa", 3, "00000002aa", "c"),
+		speculativeWrite("00000004aa", 4, "", "d"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "a"), tablet.row(t, 4, "002", "d")}, rows)
+
+	tests := []struct {
+		name              string
+		speculativeWrites []*WriteRequest
+		expected          *ErrSpeculativeForkMismatch
+	}{
+		{
+			name:              "forked last written block",
+			speculativeWrites: []*WriteRequest{speculativeWrite("00000002bb", 2, "00000001aa", "b")},
+			expected:          &ErrSpeculativeForkMismatch{Block: bstream.NewBlockRef("00000002bb", 2), PreviousBlockID: "00000001aa"},
+		},
+		{
+			name:              "deep reorg",
+			speculativeWrites: []*WriteRequest{speculativeWrite("00000003bb", 3, "00000002bb", "c")},
+			expected:          &ErrSpeculativeForkMismatch{Block: bstream.NewBlockRef("00000003bb", 3), PreviousBlockID: "00000002bb"},
+		},
+		{
+			name: "disconnected speculative writes",
+			speculativeWrites: []*WriteRequest{
+				speculativeWrite("00000003aa", 3, "00000002aa", "c"),
+				speculativeWrite("00000004bb", 4, "00000003bb", "d"),
+			},
+			expected: &ErrSpeculativeForkMismatch{Block: bstream.NewBlockRef("00000004bb", 4), PreviousBlockID: "00000003bb"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := db.ReadTabletAt(ctx, 4, tablet, test.speculativeWrites)
+
+			var mismatch *ErrSpeculativeForkMismatch
+			require.True(t, errors.As(err, &mismatch), "got %v", err)
+			assert.Equal(t, test.expected.Block, mismatch.Block)
+			assert.Equal(t, test.expected.PreviousBlockID, mismatch.PreviousBlockID)
+			assert.Equal(t, bstream.NewBlockRef("00000002aa", 2), mismatch.LastWrittenBlock)
+
+			_, err = db.ReadTabletRowAt(ctx, 4, tablet, testTabletRowPrimaryKey("002"), test.speculativeWrites)
+			assert.True(t, errors.As(err, &mismatch))
+
+			_, err = db.ReadSingletEntryAt(ctx, newTestSinglet("sgl"), 4, test.speculativeWrites)
+			assert.True(t, errors.As(err, &mismatch))
+		})
+	}
+}
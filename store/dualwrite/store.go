@@ -0,0 +1,204 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dualwrite implements a `store.KVStore` writing to two underlying stores at once, a
+// primary one serving all reads and a secondary one being migrated to, enabling zero-downtime
+// backend migrations: the secondary is first caught up with `fluxdb.CopyStore` while writes
+// are duplicated, then the primary is swapped once both are in sync.
+package dualwrite
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// KVStore duplicates all writes to the secondary store and reads from the primary store only.
+//
+// A failure to write to the secondary store never fails the write path, the primary store
+// being the source of truth, it's instead counted as a divergence (see the
+// `dual_write_divergence_count` metric) and the secondary store must then be re-synced.
+type KVStore struct {
+	primary   store.KVStore
+	secondary store.KVStore
+}
+
+func NewStore(primary, secondary store.KVStore) *KVStore {
+	return &KVStore{primary: primary, secondary: secondary}
+}
+
+func (s *KVStore) Close() error {
+	return multierr.Append(s.primary.Close(), s.secondary.Close())
+}
+
+func (s *KVStore) NewBatch(logger *zap.Logger) store.Batch {
+	return &batch{
+		primary:   s.primary.NewBatch(logger),
+		secondary: s.secondary.NewBatch(logger),
+	}
+}
+
+// OnFlush registers the listener on the primary store only.
+func (s *KVStore) OnFlush(listener store.OnFlush) {
+	store.NotifyFlushes(s.primary, listener)
+}
+
+func (s *KVStore) HasTabletRow(ctx context.Context, keyStart, keyEnd []byte) (exists bool, err error) {
+	return s.primary.HasTabletRow(ctx, keyStart, keyEnd)
+}
+
+func (s *KVStore) FetchTabletRow(ctx context.Context, key []byte) (value []byte, err error) {
+	return s.primary.FetchTabletRow(ctx, key)
+}
+
+func (s *KVStore) FetchTabletRows(ctx context.Context, keys [][]byte, onKeyValue store.OnKeyValue) error {
+	return s.primary.FetchTabletRows(ctx, keys, onKeyValue)
+}
+
+func (s *KVStore) FetchSingletEntry(ctx context.Context, keyStart, keyEnd []byte) (key []byte, value []byte, err error) {
+	return s.primary.FetchSingletEntry(ctx, keyStart, keyEnd)
+}
+
+func (s *KVStore) ScanTabletRows(ctx context.Context, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	return s.primary.ScanTabletRows(ctx, keyStart, keyEnd, onKeyValue)
+}
+
+func (s *KVStore) ScanIndexKeys(ctx context.Context, prefix []byte, onKey store.OnKey) error {
+	return s.primary.ScanIndexKeys(ctx, prefix, onKey)
+}
+
+func (s *KVStore) FetchLastWrittenCheckpoint(ctx context.Context, key []byte) (value []byte, err error) {
+	return s.primary.FetchLastWrittenCheckpoint(ctx, key)
+}
+
+func (s *KVStore) ScanLastShardsWrittenCheckpoint(ctx context.Context, keyPrefix []byte, onKeyValue store.OnKeyValue) error {
+	return s.primary.ScanLastShardsWrittenCheckpoint(ctx, keyPrefix, onKeyValue)
+}
+
+func (s *KVStore) ScanTableKeys(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKey store.OnKey) error {
+	return s.primary.ScanTableKeys(ctx, table, keyStart, keyEnd, onKey)
+}
+
+func (s *KVStore) ScanTable(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	return s.primary.ScanTable(ctx, table, keyStart, keyEnd, onKeyValue)
+}
+
+func (s *KVStore) DeleteShardsCheckpoint(ctx context.Context, keyPrefix []byte) error {
+	if err := s.primary.DeleteShardsCheckpoint(ctx, keyPrefix); err != nil {
+		return err
+	}
+
+	if err := s.secondary.DeleteShardsCheckpoint(ctx, keyPrefix); err != nil {
+		diverged("delete_shards_checkpoint", err)
+	}
+
+	return nil
+}
+
+func (s *KVStore) DeleteTableKeys(ctx context.Context, table store.Table, keys [][]byte) error {
+	if err := s.primary.DeleteTableKeys(ctx, table, keys); err != nil {
+		return err
+	}
+
+	if err := s.secondary.DeleteTableKeys(ctx, table, keys); err != nil {
+		diverged("delete_table_keys", err)
+	}
+
+	return nil
+}
+
+func diverged(operation string, err error) {
+	metrics.DualWriteDivergenceCount.Inc(operation)
+	zlog.Warn("secondary store write failed, secondary store diverged from primary store and must be re-synced", zap.String("operation", operation), zap.Error(err))
+}
+
+type batch struct {
+	primary   store.Batch
+	secondary store.Batch
+}
+
+func (b *batch) PurgeRow(key []byte) {
+	b.primary.PurgeRow(key)
+	b.secondary.PurgeRow(key)
+}
+
+func (b *batch) SetRow(key []byte, value []byte) {
+	b.primary.SetRow(key, value)
+	b.secondary.SetRow(key, value)
+}
+
+func (b *batch) SetLastCheckpoint(key []byte, value []byte) {
+	b.primary.SetLastCheckpoint(key, value)
+	b.secondary.SetLastCheckpoint(key, value)
+}
+
+func (b *batch) SetTableRow(table store.Table, key []byte, value []byte) {
+	b.primary.SetTableRow(table, key, value)
+	b.secondary.SetTableRow(table, key, value)
+}
+
+func (b *batch) Reset() {
+	b.primary.Reset()
+	b.secondary.Reset()
+}
+
+// Flush flushes both batches simultaneously, only the primary's error is returned.
+func (b *batch) Flush(ctx context.Context) error {
+	var secondaryErr error
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		secondaryErr = b.secondary.Flush(ctx)
+	}()
+
+	err := b.primary.Flush(ctx)
+	wg.Wait()
+
+	if secondaryErr != nil {
+		diverged("flush", secondaryErr)
+	}
+
+	return err
+}
+
+// FlushIfFull lets the primary batch decide when to flush, the secondary batch is flushed along
+// so both always hold the same mutations.
+func (b *batch) FlushIfFull(ctx context.Context) (flushed bool, err error) {
+	flushed, err = b.primary.FlushIfFull(ctx)
+	if flushed {
+		b.flushSecondary(ctx)
+	}
+
+	return
+}
+
+func (b *batch) FlushIfFullAsync(ctx context.Context) (flushed bool, err error) {
+	flushed, err = b.primary.FlushIfFullAsync(ctx)
+	if flushed {
+		b.flushSecondary(ctx)
+	}
+
+	return
+}
+
+func (b *batch) flushSecondary(ctx context.Context) {
+	if err := b.secondary.Flush(ctx); err != nil {
+		diverged("flush", err)
+	}
+}
@@ -0,0 +1,88 @@
+package dualwrite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestKVStore_DualWrite(t *testing.T) {
+	primary, primaryCloser := storetest.NewKVStore(t)
+	defer primaryCloser()
+
+	secondary, secondaryCloser := storetest.NewKVStore(t)
+	defer secondaryCloser()
+
+	ctx := context.Background()
+	dual := NewStore(primary, secondary)
+
+	batch := dual.NewBatch(zlog)
+	batch.SetRow([]byte("a"), []byte("1"))
+	batch.SetRow([]byte("b"), []byte("2"))
+	batch.SetLastCheckpoint([]byte("checkpoint"), []byte("c"))
+	require.NoError(t, batch.Flush(ctx))
+
+	for _, kvStore := range []store.KVStore{primary, secondary} {
+		value, err := kvStore.FetchTabletRow(ctx, []byte("a"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("1"), value)
+
+		value, err = kvStore.FetchLastWrittenCheckpoint(ctx, []byte("checkpoint"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("c"), value)
+	}
+
+	require.NoError(t, dual.DeleteTableKeys(ctx, store.RowsTable, [][]byte{[]byte("b")}))
+	for _, kvStore := range []store.KVStore{primary, secondary} {
+		_, err := kvStore.FetchTabletRow(ctx, []byte("b"))
+		assert.Equal(t, store.ErrNotFound, err)
+	}
+
+	// Reads are served by the primary only
+	batch = secondary.NewBatch(zlog)
+	batch.SetRow([]byte("z"), []byte("secondary only"))
+	require.NoError(t, batch.Flush(ctx))
+
+	_, err := dual.FetchTabletRow(ctx, []byte("z"))
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestKVStore_SecondaryFailureDoesNotFailWrites(t *testing.T) {
+	primary, primaryCloser := storetest.NewKVStore(t)
+	defer primaryCloser()
+
+	ctx := context.Background()
+	dual := NewStore(primary, failingStore{})
+
+	batch := dual.NewBatch(zlog)
+	batch.SetRow([]byte("a"), []byte("1"))
+	require.NoError(t, batch.Flush(ctx))
+
+	value, err := dual.FetchTabletRow(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+}
+
+type failingStore struct {
+	store.KVStore
+}
+
+func (failingStore) NewBatch(logger *zap.Logger) store.Batch {
+	return failingBatch{}
+}
+
+type failingBatch struct {
+	store.Batch
+}
+
+func (failingBatch) SetRow(key []byte, value []byte) {}
+
+func (failingBatch) Flush(ctx context.Context) error {
+	return errors.New("secondary unavailable")
+}
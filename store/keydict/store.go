@@ -0,0 +1,794 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keydict implements a `store.KVStore` compressing the identities the rows keys start
+// with (e.g. the tablets, repeated in every one of their row keys) into short fixed-length
+// identifiers, for backends without key compression where they inflate the storage. The
+// identities are mapped to their identifier by a dictionary persisted in the key dictionary
+// table, the translation is transparent to the users of the store.
+package keydict
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+const collectionBytes = 2
+
+// The length of the identifiers replacing the identities in the physical keys
+const idBytes = 4
+
+// The amount of dictionary entries read at once when scanning a range spanning several
+// identities, the next ones being read only when the scan continues
+const dictionaryScanPageSize = 256
+
+// The dictionary table key of an identity, `i<identity>`, holding its identifier, the identities
+// are then walked in order
+var forwardPrefix = []byte("i")
+
+// Identities describes the identities the rows keys start with.
+type Identities struct {
+	// Collections are the collections (the first 2 bytes of the keys) whose keys all start with
+	// an identity, the collection being part of the identity
+	Collections []uint16
+
+	// Length returns the length of the identity `key` starts with, `key` being a key of one of
+	// the collections, an error when it does not start with a complete identity.
+	Length func(key []byte) (int, error)
+}
+
+// KVStore writes the keys of the compressed collections as `<collection><identifier><suffix>`,
+// the identity the key starts with being replaced by its identifier, and translates them back
+// when read. The other keys, and the tables other than the rows one, are left untouched.
+//
+// The keys of an identity keep their relative order, but the identities are ordered by
+// identifier in the underlying store, a range spanning several identities is then scanned by
+// identity, walking the dictionary, the keys being received in the same order as without the
+// dictionary. A scan budget (see `store.ErrScanBudgetExceeded`) applies to each of them.
+//
+// The whole dictionary is loaded in memory when the store is created, new identities are
+// assigned an identifier when their first key is written, their dictionary entries being
+// written by a flush of their own, completed before the rows referencing them are flushed. A
+// store must have a single writer, the identifiers assigned by another one are only picked up
+// by the reads, from the persisted dictionary.
+//
+// **Important** The dictionary must be enabled before any key of the compressed collections is
+// written, and never disabled afterwards, the keys are otherwise unreadable.
+type KVStore struct {
+	store.KVStore
+
+	identities  Identities
+	collections []uint16
+
+	lock        sync.RWMutex
+	ids         map[string]uint32
+	unpersisted map[uint32]bool
+	nextID      uint32
+	full        bool
+}
+
+// NewStore returns `inner` with the identities of the keys of the compressed collections
+// compressed, loading the persisted dictionary. It fails when the dictionary is empty while keys
+// of the compressed collections were already written.
+func NewStore(ctx context.Context, inner store.KVStore, identities Identities) (*KVStore, error) {
+	if len(identities.Collections) == 0 || identities.Length == nil {
+		return nil, errors.New("key dictionary requires at least one collection and an identity length function")
+	}
+
+	collections := append([]uint16(nil), identities.Collections...)
+	sort.Slice(collections, func(i, j int) bool { return collections[i] < collections[j] })
+
+	s := &KVStore{
+		KVStore:     inner,
+		identities:  identities,
+		collections: collections,
+		ids:         map[string]uint32{},
+		unpersisted: map[uint32]bool{},
+	}
+
+	err := inner.ScanTable(ctx, store.KeyDictionaryTable, forwardPrefix, prefixEnd(forwardPrefix), func(key []byte, value []byte) error {
+		if len(value) != idBytes {
+			return fmt.Errorf("invalid identifier of identity %q, expected %d bytes, got %d", store.Key(key[1:]), idBytes, len(value))
+		}
+
+		id := binary.BigEndian.Uint32(value)
+		s.cache(key[1:], id)
+		if id >= s.nextID {
+			s.nextID = id + 1
+			s.full = s.nextID == 0
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load key dictionary: %w", err)
+	}
+
+	if len(s.ids) == 0 {
+		for _, collection := range collections {
+			exists, err := inner.HasTabletRow(ctx, collectionKey(collection), prefixEnd(collectionKey(collection)))
+			if err != nil {
+				return nil, fmt.Errorf("check collection 0x%04X rows: %w", collection, err)
+			}
+
+			if exists {
+				return nil, fmt.Errorf("collection 0x%04X already has keys written without the key dictionary, it must be enabled before any is written", collection)
+			}
+		}
+	}
+
+	zlog.Info("loaded key dictionary", zap.Int("identity_count", len(s.ids)), zap.Int("collection_count", len(collections)))
+	return s, nil
+}
+
+// IdentityCount returns the amount of identities known to the dictionary.
+func (s *KVStore) IdentityCount() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.ids)
+}
+
+func (s *KVStore) NewBatch(logger *zap.Logger) store.Batch {
+	return &batch{Batch: s.KVStore.NewBatch(logger), store: s, logger: logger, entries: map[uint32][]byte{}}
+}
+
+// OnFlush registers the listener on the inner store, the dictionary entries being reported by
+// flushes of their own.
+func (s *KVStore) OnFlush(listener store.OnFlush) {
+	store.NotifyFlushes(s.KVStore, listener)
+}
+
+func (s *KVStore) HasTabletRow(ctx context.Context, keyStart, keyEnd []byte) (exists bool, err error) {
+	err = s.scan(ctx, keyStart, keyEnd, s.tableScanner(store.RowsTable, true), func(_ []byte, _ []byte) error {
+		exists = true
+		return store.BreakScan
+	})
+
+	return exists, err
+}
+
+func (s *KVStore) FetchTabletRow(ctx context.Context, key []byte) (value []byte, err error) {
+	physicalKey, found, err := s.physicalKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, store.ErrNotFound
+	}
+
+	return s.KVStore.FetchTabletRow(ctx, physicalKey)
+}
+
+func (s *KVStore) FetchTabletRows(ctx context.Context, keys [][]byte, onKeyValue store.OnKeyValue) error {
+	physicalKeys, logicalKeys, err := s.physicalKeys(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	return s.KVStore.FetchTabletRows(ctx, physicalKeys, func(key []byte, value []byte) error {
+		return onKeyValue(logicalKeys[string(key)], value)
+	})
+}
+
+func (s *KVStore) FetchSingletEntry(ctx context.Context, keyStart, keyEnd []byte) (key []byte, value []byte, err error) {
+	err = s.scan(ctx, keyStart, keyEnd, s.singletEntryScanner, func(entryKey []byte, entryValue []byte) error {
+		key = entryKey
+		value = entryValue
+		return store.BreakScan
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, value, nil
+}
+
+func (s *KVStore) ScanTabletRows(ctx context.Context, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	return s.scan(ctx, keyStart, keyEnd, s.KVStore.ScanTabletRows, onKeyValue)
+}
+
+func (s *KVStore) ScanIndexKeys(ctx context.Context, prefix []byte, onKey store.OnKey) error {
+	if len(prefix) >= collectionBytes && !s.compressed(prefix) {
+		return s.KVStore.ScanIndexKeys(ctx, prefix, onKey)
+	}
+
+	return s.scan(ctx, prefix, prefixEnd(prefix), s.tableScanner(store.RowsTable, true), func(key []byte, _ []byte) error {
+		return onKey(key)
+	})
+}
+
+func (s *KVStore) ScanTableKeys(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKey store.OnKey) error {
+	if table != store.RowsTable {
+		return s.KVStore.ScanTableKeys(ctx, table, keyStart, keyEnd, onKey)
+	}
+
+	return s.scan(ctx, keyStart, keyEnd, s.tableScanner(table, true), func(key []byte, _ []byte) error {
+		return onKey(key)
+	})
+}
+
+func (s *KVStore) ScanTable(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	if table != store.RowsTable {
+		return s.KVStore.ScanTable(ctx, table, keyStart, keyEnd, onKeyValue)
+	}
+
+	return s.scan(ctx, keyStart, keyEnd, s.tableScanner(table, false), onKeyValue)
+}
+
+// DeleteTableKeys deletes the keys from the table, the keys of the rows table whose identity is
+// not in the dictionary were never written and are skipped.
+func (s *KVStore) DeleteTableKeys(ctx context.Context, table store.Table, keys [][]byte) error {
+	if table != store.RowsTable {
+		return s.KVStore.DeleteTableKeys(ctx, table, keys)
+	}
+
+	physicalKeys, _, err := s.physicalKeys(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	return s.KVStore.DeleteTableKeys(ctx, table, physicalKeys)
+}
+
+func (s *KVStore) compressed(key []byte) bool {
+	if len(key) < collectionBytes {
+		return false
+	}
+
+	collection := binary.BigEndian.Uint16(key)
+	for _, compressed := range s.collections {
+		if compressed == collection {
+			return true
+		}
+	}
+
+	return false
+}
+
+// identity returns the identity `key` starts with, which must be a key of a compressed
+// collection.
+func (s *KVStore) identity(key []byte) ([]byte, error) {
+	length, err := s.identities.Length(key)
+	if err != nil {
+		return nil, fmt.Errorf("identity of key %q: %w", store.Key(key), err)
+	}
+
+	if length <= collectionBytes || length > len(key) {
+		return nil, fmt.Errorf("invalid identity length %d of key %q", length, store.Key(key))
+	}
+
+	return key[:length], nil
+}
+
+// physicalKey returns the key as written in the underlying store, `found` being false when the
+// identity it starts with is not in the dictionary, the key was then never written.
+func (s *KVStore) physicalKey(ctx context.Context, key []byte) (physicalKey []byte, found bool, err error) {
+	if !s.compressed(key) {
+		return key, true, nil
+	}
+
+	identity, err := s.identity(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	id, found, err := s.lookupID(ctx, identity)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	return physicalKeyOf(id, key, len(identity)), true, nil
+}
+
+// physicalKeys translates the keys, skipping the ones never written, the logical keys being
+// returned by physical key.
+func (s *KVStore) physicalKeys(ctx context.Context, keys [][]byte) (physicalKeys [][]byte, logicalKeys map[string][]byte, err error) {
+	physicalKeys = make([][]byte, 0, len(keys))
+	logicalKeys = make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		physicalKey, found, err := s.physicalKey(ctx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if found {
+			physicalKeys = append(physicalKeys, physicalKey)
+			logicalKeys[string(physicalKey)] = key
+		}
+	}
+
+	return physicalKeys, logicalKeys, nil
+}
+
+// lookupID returns the identifier of the identity, reading it from the persisted dictionary when
+// unknown, it could have been assigned by the writer after the dictionary was loaded.
+func (s *KVStore) lookupID(ctx context.Context, identity []byte) (id uint32, found bool, err error) {
+	s.lock.RLock()
+	id, found = s.ids[string(identity)]
+	s.lock.RUnlock()
+
+	if found {
+		return id, true, nil
+	}
+
+	key := append(append([]byte(nil), forwardPrefix...), identity...)
+	value, found, err := s.fetchDictionaryEntry(ctx, key)
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	if len(value) != idBytes {
+		return 0, false, fmt.Errorf("invalid identifier of identity %q, expected %d bytes, got %d", store.Key(identity), idBytes, len(value))
+	}
+
+	id = binary.BigEndian.Uint32(value)
+	s.lock.Lock()
+	s.cache(identity, id)
+	s.lock.Unlock()
+
+	return id, true, nil
+}
+
+func (s *KVStore) fetchDictionaryEntry(ctx context.Context, key []byte) (value []byte, found bool, err error) {
+	err = s.KVStore.ScanTable(ctx, store.KeyDictionaryTable, key, append(append([]byte(nil), key...), 0x00), func(_ []byte, entryValue []byte) error {
+		value = append([]byte(nil), entryValue...)
+		found = true
+		return store.BreakScan
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("fetch key dictionary entry %q: %w", store.Key(key), err)
+	}
+
+	return value, found, nil
+}
+
+// assign returns the identifier of the identity, assigning it the next one when unknown,
+// `unpersisted` being true as long as its dictionary entries were not flushed. It fails when
+// all identifiers are assigned.
+func (s *KVStore) assign(identity []byte) (id uint32, unpersisted bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if id, found := s.ids[string(identity)]; found {
+		return id, s.unpersisted[id], nil
+	}
+
+	if s.full {
+		return 0, false, fmt.Errorf("key dictionary is full, all %d bits identifiers are assigned", idBytes*8)
+	}
+
+	id = s.nextID
+	s.nextID++
+	s.full = s.nextID == 0
+
+	s.cache(identity, id)
+	s.unpersisted[id] = true
+
+	return id, true, nil
+}
+
+// persisted marks the dictionary entries of the identifiers as flushed.
+func (s *KVStore) persisted(ids []uint32) {
+	if len(ids) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, id := range ids {
+		delete(s.unpersisted, id)
+	}
+}
+
+// cache records the identity and its identifier, the lock must be held.
+func (s *KVStore) cache(identity []byte, id uint32) {
+	s.ids[string(identity)] = id
+}
+
+// scanner scans a physical range of the rows table, the keys received being physical ones.
+type scanner func(ctx context.Context, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error
+
+func (s *KVStore) tableScanner(table store.Table, keysOnly bool) scanner {
+	return func(ctx context.Context, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+		if keysOnly {
+			return s.KVStore.ScanTableKeys(ctx, table, keyStart, keyEnd, func(key []byte) error {
+				return onKeyValue(key, nil)
+			})
+		}
+
+		return s.KVStore.ScanTable(ctx, table, keyStart, keyEnd, onKeyValue)
+	}
+}
+
+func (s *KVStore) singletEntryScanner(ctx context.Context, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	key, value, err := s.KVStore.FetchSingletEntry(ctx, keyStart, keyEnd)
+	if err != nil || key == nil {
+		return err
+	}
+
+	if err := onKeyValue(key, value); err != nil && err != store.BreakScan {
+		return err
+	}
+
+	return nil
+}
+
+// scan scans the logical range [keyStart, keyEnd[ of the rows table, an empty `keyEnd` scanning
+// until the end of the table, the keys of the compressed collections being scanned by identity.
+// Like the underlying scans, returning `store.BreakScan` stops the scan without error.
+func (s *KVStore) scan(ctx context.Context, keyStart, keyEnd []byte, scan scanner, onKeyValue store.OnKeyValue) error {
+	stopped := false
+	onRow := func(key []byte, value []byte) error {
+		err := onKeyValue(key, value)
+		if err == store.BreakScan {
+			stopped = true
+		}
+
+		return err
+	}
+
+	cursor := keyStart
+	for _, collection := range s.collections {
+		start := collectionKey(collection)
+		end := prefixEnd(start)
+		if !beforeEnd(start, keyEnd) {
+			break
+		}
+
+		if end != nil && bytes.Compare(end, cursor) <= 0 {
+			continue
+		}
+
+		if bytes.Compare(cursor, start) < 0 {
+			if err := scan(ctx, cursor, start, onRow); err != nil || stopped {
+				return err
+			}
+
+			cursor = start
+		}
+
+		collectionEnd := keyEnd
+		if end != nil && beforeEnd(end, keyEnd) {
+			collectionEnd = end
+		}
+
+		if err := s.scanCollection(ctx, cursor, collectionEnd, scan, onRow); err != nil {
+			if err == store.BreakScan {
+				return nil
+			}
+
+			return err
+		}
+
+		if end == nil {
+			return nil
+		}
+		cursor = end
+	}
+
+	if !beforeEnd(cursor, keyEnd) {
+		return nil
+	}
+
+	return scan(ctx, cursor, keyEnd, onRow)
+}
+
+// scanCollection scans the logical range [keyStart, keyEnd[ of a compressed collection, identity
+// by identity in order, returning `store.BreakScan` when stopped by `onKeyValue`.
+func (s *KVStore) scanCollection(ctx context.Context, keyStart, keyEnd []byte, scan scanner, onKeyValue store.OnKeyValue) error {
+	dictionaryStart := append(append([]byte(nil), forwardPrefix...), keyStart...)
+
+	if length, err := s.identities.Length(keyStart); err == nil && length > collectionBytes && length <= len(keyStart) {
+		identity := keyStart[:length]
+		if len(keyEnd) > 0 && bytes.HasPrefix(keyEnd, identity) {
+			// The whole range is within a single identity
+			return s.scanIdentityFound(ctx, identity, keyStart[length:], keyEnd[length:], scan, onKeyValue)
+		}
+
+		if length < len(keyStart) {
+			// The range starts within the identity, the following ones are after the start key
+			if err := s.scanIdentityFound(ctx, identity, keyStart[length:], nil, scan, onKeyValue); err != nil {
+				return err
+			}
+		}
+	}
+
+	dictionaryEnd := prefixEnd(forwardPrefix)
+	if len(keyEnd) > 0 {
+		dictionaryEnd = append(append([]byte(nil), forwardPrefix...), keyEnd...)
+	}
+
+	type entry struct {
+		identity []byte
+		id       uint32
+	}
+
+	// The dictionary is read by page, so a scan stopped early does not read all of it
+	for {
+		var entries []entry
+		err := s.KVStore.ScanTable(ctx, store.KeyDictionaryTable, dictionaryStart, dictionaryEnd, func(key []byte, value []byte) error {
+			if len(value) != idBytes {
+				return fmt.Errorf("invalid identifier of identity %q, expected %d bytes, got %d", store.Key(key[1:]), idBytes, len(value))
+			}
+
+			entries = append(entries, entry{identity: append([]byte(nil), key[1:]...), id: binary.BigEndian.Uint32(value)})
+			if len(entries) >= dictionaryScanPageSize {
+				return store.BreakScan
+			}
+
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("scan key dictionary: %w", err)
+		}
+
+		for _, entry := range entries {
+			var suffixEnd []byte
+			if len(keyEnd) > 0 && bytes.HasPrefix(keyEnd, entry.identity) {
+				suffixEnd = keyEnd[len(entry.identity):]
+			}
+
+			if err := s.scanIdentity(ctx, entry.identity, entry.id, nil, suffixEnd, scan, onKeyValue); err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < dictionaryScanPageSize {
+			return nil
+		}
+
+		lastKey := append(append([]byte(nil), forwardPrefix...), entries[len(entries)-1].identity...)
+		dictionaryStart = append(lastKey, 0x00)
+	}
+}
+
+// scanIdentityFound scans the keys of the identity when it's in the dictionary.
+func (s *KVStore) scanIdentityFound(ctx context.Context, identity []byte, suffixStart, suffixEnd []byte, scan scanner, onKeyValue store.OnKeyValue) error {
+	id, found, err := s.lookupID(ctx, identity)
+	if err != nil || !found {
+		return err
+	}
+
+	return s.scanIdentity(ctx, identity, id, suffixStart, suffixEnd, scan, onKeyValue)
+}
+
+// scanIdentity scans the keys of the identity whose suffix is within [suffixStart, suffixEnd[, a
+// `nil` end scanning all of them, the physical keys being translated back. It returns
+// `store.BreakScan` when stopped by `onKeyValue`, the next identities must not be scanned.
+func (s *KVStore) scanIdentity(ctx context.Context, identity []byte, id uint32, suffixStart, suffixEnd []byte, scan scanner, onKeyValue store.OnKeyValue) error {
+	prefix := physicalKeyOf(id, identity, len(identity))
+
+	physicalStart := append(append([]byte(nil), prefix...), suffixStart...)
+	physicalEnd := prefixEnd(prefix)
+	if suffixEnd != nil {
+		physicalEnd = append(append([]byte(nil), prefix...), suffixEnd...)
+	}
+
+	stopped := false
+	err := scan(ctx, physicalStart, physicalEnd, func(key []byte, value []byte) error {
+		err := onKeyValue(logicalKeyOf(identity, key), value)
+		if err == store.BreakScan {
+			stopped = true
+		}
+
+		return err
+	})
+	if err == nil && stopped {
+		return store.BreakScan
+	}
+
+	var exceeded *store.ErrScanBudgetExceeded
+	if errors.As(err, &exceeded) && bytes.HasPrefix(exceeded.ResumeKey, prefix) {
+		exceeded.ResumeKey = logicalKeyOf(identity, exceeded.ResumeKey)
+	}
+
+	return err
+}
+
+// batch compresses the keys of the mutations, the dictionary entries of the identities whose
+// entries are not flushed yet are written by a flush of their own, before the mutations
+// referencing them are flushed.
+type batch struct {
+	store.Batch
+	store  *KVStore
+	logger *zap.Logger
+
+	// The dictionary entries (identity by identifier) to flush before the mutations
+	entries map[uint32][]byte
+
+	// The first failure translating a mutation, returned by the flushes until the batch is reset
+	err error
+}
+
+func (b *batch) PurgeRow(key []byte) {
+	if !b.store.compressed(key) {
+		b.Batch.PurgeRow(key)
+		return
+	}
+
+	identity, err := b.store.identity(key)
+	if err != nil {
+		b.fail(fmt.Errorf("purge row: invalid key of compressed collection: %w", err))
+		return
+	}
+
+	b.store.lock.RLock()
+	id, found := b.store.ids[string(identity)]
+	b.store.lock.RUnlock()
+
+	if !found {
+		// Never written, there is nothing to purge
+		return
+	}
+
+	b.Batch.PurgeRow(physicalKeyOf(id, key, len(identity)))
+}
+
+func (b *batch) SetRow(key []byte, value []byte) {
+	if !b.store.compressed(key) {
+		b.Batch.SetRow(key, value)
+		return
+	}
+
+	identity, err := b.store.identity(key)
+	if err != nil {
+		b.fail(fmt.Errorf("set row: invalid key of compressed collection: %w", err))
+		return
+	}
+
+	id, unpersisted, err := b.store.assign(identity)
+	if err != nil {
+		b.fail(fmt.Errorf("set row %q: %w", store.Key(key), err))
+		return
+	}
+
+	if unpersisted {
+		b.entries[id] = append([]byte(nil), identity...)
+	}
+
+	b.Batch.SetRow(physicalKeyOf(id, key, len(identity)), value)
+}
+
+func (b *batch) Flush(ctx context.Context) error {
+	if err := b.flushDictionary(ctx); err != nil {
+		return err
+	}
+
+	return b.Batch.Flush(ctx)
+}
+
+func (b *batch) FlushIfFull(ctx context.Context) (flushed bool, err error) {
+	if err := b.flushDictionary(ctx); err != nil {
+		return false, err
+	}
+
+	return b.Batch.FlushIfFull(ctx)
+}
+
+// FlushIfFullAsync hands the mutations over to a background flush, the dictionary entries they
+// reference being flushed beforehand, synchronously.
+func (b *batch) FlushIfFullAsync(ctx context.Context) (flushed bool, err error) {
+	if err := b.flushDictionary(ctx); err != nil {
+		return false, err
+	}
+
+	return b.Batch.FlushIfFullAsync(ctx)
+}
+
+func (b *batch) Reset() {
+	b.Batch.Reset()
+
+	b.entries = map[uint32][]byte{}
+	b.err = nil
+}
+
+// fail records the first failure translating a mutation, the mutation being dropped.
+func (b *batch) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// flushDictionary writes the dictionary entries of the mutations in a flush of their own, which
+// must complete before the mutations are flushed, marking them persisted. It returns the failure
+// translating a mutation, if any, nothing being flushed then.
+func (b *batch) flushDictionary(ctx context.Context) error {
+	if b.err != nil {
+		return b.err
+	}
+
+	if len(b.entries) == 0 {
+		return nil
+	}
+
+	dictionary := b.store.KVStore.NewBatch(b.logger)
+	ids := make([]uint32, 0, len(b.entries))
+	for id, identity := range b.entries {
+		dictionary.SetTableRow(store.KeyDictionaryTable, append(append([]byte(nil), forwardPrefix...), identity...), idKey(id))
+		ids = append(ids, id)
+	}
+
+	if err := dictionary.Flush(ctx); err != nil {
+		return fmt.Errorf("flush key dictionary entries: %w", err)
+	}
+
+	b.store.persisted(ids)
+	b.entries = map[uint32][]byte{}
+
+	return nil
+}
+
+func physicalKeyOf(id uint32, key []byte, identityLength int) []byte {
+	out := make([]byte, collectionBytes+idBytes+len(key)-identityLength)
+	copy(out, key[:collectionBytes])
+	copy(out[collectionBytes:], idKey(id))
+	copy(out[collectionBytes+idBytes:], key[identityLength:])
+
+	return out
+}
+
+func logicalKeyOf(identity []byte, physicalKey []byte) []byte {
+	suffix := physicalKey[collectionBytes+idBytes:]
+
+	out := make([]byte, len(identity)+len(suffix))
+	copy(out, identity)
+	copy(out[len(identity):], suffix)
+
+	return out
+}
+
+func collectionKey(collection uint16) []byte {
+	out := make([]byte, collectionBytes)
+	binary.BigEndian.PutUint16(out, collection)
+
+	return out
+}
+
+func idKey(id uint32) []byte {
+	out := make([]byte, idBytes)
+	binary.BigEndian.PutUint32(out, id)
+
+	return out
+}
+
+// prefixEnd returns the exclusive end of the keys starting with `prefix`, `nil` when they extend
+// until the end of the table.
+func prefixEnd(prefix []byte) []byte {
+	out := append([]byte(nil), prefix...)
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i] < 0xFF {
+			out[i]++
+			return out[:i+1]
+		}
+	}
+
+	return nil
+}
+
+// beforeEnd returns whether `key` is before the exclusive end of a range, an empty end being the
+// end of the table.
+func beforeEnd(key []byte, end []byte) bool {
+	return len(end) == 0 || bytes.Compare(key, end) < 0
+}
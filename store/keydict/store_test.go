@@ -0,0 +1,273 @@
+package keydict
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// The keys of the compressed collection 0x0001 start with a 3 bytes identifier
+var testIdentities = Identities{
+	Collections: []uint16{0x0001},
+	Length: func(key []byte) (int, error) {
+		if len(key) < 5 {
+			return 0, fmt.Errorf("key too short")
+		}
+
+		return 5, nil
+	},
+}
+
+func TestKVStore_Translation(t *testing.T) {
+	inner, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	dictionary, err := NewStore(ctx, inner, testIdentities)
+	require.NoError(t, err)
+
+	// Identifiers are assigned in write order, which differs from the identities order
+	batch := dictionary.NewBatch(zap.NewNop())
+	for _, key := range []string{"\x00\x01ccc/1", "\x00\x01aaa/1", "\x00\x01aaa/2", "\x00\x01bbb/1", "\x00\x00raw", "\x00\x02raw"} {
+		batch.SetRow([]byte(key), []byte("v:"+key[2:]))
+	}
+	require.NoError(t, batch.Flush(ctx))
+	assert.Equal(t, 3, dictionary.IdentityCount())
+
+	var physicalKeys []string
+	require.NoError(t, inner.ScanTableKeys(ctx, store.RowsTable, []byte{0x00, 0x01}, []byte{0x00, 0x02}, func(key []byte) error {
+		physicalKeys = append(physicalKeys, string(key))
+		return nil
+	}))
+	assert.Equal(t, []string{"\x00\x01\x00\x00\x00\x00/1", "\x00\x01\x00\x00\x00\x01/1", "\x00\x01\x00\x00\x00\x01/2", "\x00\x01\x00\x00\x00\x02/1"}, physicalKeys)
+
+	value, err := dictionary.FetchTabletRow(ctx, []byte("\x00\x01aaa/2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v:aaa/2"), value)
+
+	_, err = dictionary.FetchTabletRow(ctx, []byte("\x00\x01zzz/1"))
+	assert.Equal(t, store.ErrNotFound, err)
+
+	scan := func(keyStart, keyEnd string) (keys []string) {
+		require.NoError(t, dictionary.ScanTabletRows(ctx, []byte(keyStart), []byte(keyEnd), func(key []byte, value []byte) error {
+			assert.Equal(t, "v:"+string(key[2:]), string(value))
+			keys = append(keys, string(key))
+			return nil
+		}))
+		return
+	}
+
+	assert.Equal(t, []string{"\x00\x00raw", "\x00\x01aaa/1", "\x00\x01aaa/2", "\x00\x01bbb/1", "\x00\x01ccc/1", "\x00\x02raw"}, scan("", ""))
+	assert.Equal(t, []string{"\x00\x01aaa/2", "\x00\x01bbb/1"}, scan("\x00\x01aaa/2", "\x00\x01ccc"))
+	assert.Equal(t, []string{"\x00\x01aaa/1"}, scan("\x00\x01aaa/1", "\x00\x01aaa/2"))
+	assert.Equal(t, []string{"\x00\x01bbb/1", "\x00\x01ccc/1", "\x00\x02raw"}, scan("\x00\x01b", "\x00\x03"))
+
+	var keys []string
+	require.NoError(t, dictionary.ScanTableKeys(ctx, store.RowsTable, nil, nil, func(key []byte) error {
+		keys = append(keys, string(key))
+		return store.BreakScan
+	}))
+	assert.Equal(t, []string{"\x00\x00raw"}, keys)
+
+	key, value, err := dictionary.FetchSingletEntry(ctx, []byte("\x00\x01abc"), []byte("\x00\x02"))
+	require.NoError(t, err)
+	assert.Equal(t, "\x00\x01bbb/1", string(key))
+	assert.Equal(t, "v:bbb/1", string(value))
+
+	exists, err := dictionary.HasTabletRow(ctx, []byte("\x00\x01bbb/2"), []byte("\x00\x01ccc"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	keys = nil
+	require.NoError(t, dictionary.FetchTabletRows(ctx, [][]byte{[]byte("\x00\x01ccc/1"), []byte("\x00\x01zzz/1"), []byte("\x00\x00raw")}, func(key []byte, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"\x00\x01ccc/1", "\x00\x00raw"}, keys)
+
+	require.NoError(t, dictionary.DeleteTableKeys(ctx, store.RowsTable, [][]byte{[]byte("\x00\x01aaa/1"), []byte("\x00\x01zzz/1")}))
+	assert.Equal(t, []string{"\x00\x01aaa/2"}, scan("\x00\x01aaa", "\x00\x01aab"))
+
+	// A reopened store continues from the persisted dictionary
+	reopened, err := NewStore(ctx, inner, testIdentities)
+	require.NoError(t, err)
+	assert.Equal(t, 3, reopened.IdentityCount())
+
+	batch = reopened.NewBatch(zap.NewNop())
+	batch.SetRow([]byte("\x00\x01ddd/1"), []byte("v:ddd/1"))
+	batch.PurgeRow([]byte("\x00\x01ccc/1"))
+	require.NoError(t, batch.Flush(ctx))
+
+	physicalKeys = nil
+	require.NoError(t, inner.ScanTableKeys(ctx, store.RowsTable, []byte{0x00, 0x01}, []byte{0x00, 0x02}, func(key []byte) error {
+		physicalKeys = append(physicalKeys, string(key))
+		return nil
+	}))
+	assert.Equal(t, []string{"\x00\x01\x00\x00\x00\x01/2", "\x00\x01\x00\x00\x00\x02/1", "\x00\x01\x00\x00\x00\x03/1"}, physicalKeys)
+
+	// The identities assigned by the writer are picked up by the other instances' reads
+	value, err = dictionary.FetchTabletRow(ctx, []byte("\x00\x01ddd/1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v:ddd/1"), value)
+	assert.Equal(t, []string{"\x00\x01bbb/1", "\x00\x01ddd/1"}, scan("\x00\x01b", "\x00\x02"))
+}
+
+func TestKVStore_UnflushedEntriesRewritten(t *testing.T) {
+	inner, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	dictionary, err := NewStore(ctx, inner, testIdentities)
+	require.NoError(t, err)
+
+	// The first batch is discarded, its dictionary entry must be written by the next one
+	batch := dictionary.NewBatch(zap.NewNop())
+	batch.SetRow([]byte("\x00\x01aaa/1"), []byte("discarded"))
+	batch.Reset()
+
+	batch = dictionary.NewBatch(zap.NewNop())
+	batch.SetRow([]byte("\x00\x01aaa/2"), []byte("v:aaa/2"))
+	require.NoError(t, batch.Flush(ctx))
+
+	reopened, err := NewStore(ctx, inner, testIdentities)
+	require.NoError(t, err)
+
+	value, err := reopened.FetchTabletRow(ctx, []byte("\x00\x01aaa/2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v:aaa/2"), value)
+}
+
+func TestKVStore_DictionaryFlushedFirst(t *testing.T) {
+	inner, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	recording := &flushRecordingStore{KVStore: inner}
+	dictionary, err := NewStore(ctx, recording, testIdentities)
+	require.NoError(t, err)
+
+	batch := dictionary.NewBatch(zap.NewNop())
+	batch.SetRow([]byte("\x00\x01aaa/1"), []byte("v:aaa/1"))
+	batch.SetRow([]byte("\x00\x01bbb/1"), []byte("v:bbb/1"))
+	require.NoError(t, batch.Flush(ctx))
+
+	batch.SetRow([]byte("\x00\x01aaa/2"), []byte("v:aaa/2"))
+	require.NoError(t, batch.Flush(ctx))
+
+	assert.Equal(t, [][]store.Table{{store.KeyDictionaryTable, store.KeyDictionaryTable}, {store.RowsTable, store.RowsTable}, {store.RowsTable}}, recording.flushes, "the dictionary entries are flushed on their own, once")
+}
+
+func TestKVStore_InvalidKeyFailsFlush(t *testing.T) {
+	inner, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	dictionary, err := NewStore(ctx, inner, testIdentities)
+	require.NoError(t, err)
+
+	batch := dictionary.NewBatch(zap.NewNop())
+	batch.SetRow([]byte("\x00\x01aaa/1"), []byte("v:aaa/1"))
+	batch.SetRow([]byte("\x00\x01a"), []byte("invalid"))
+	assert.EqualError(t, batch.Flush(ctx), "set row: invalid key of compressed collection: identity of key \"000161\": key too short")
+
+	_, err = dictionary.FetchTabletRow(ctx, []byte("\x00\x01aaa/1"))
+	assert.Equal(t, store.ErrNotFound, err, "nothing is flushed")
+
+	batch.Reset()
+	batch.SetRow([]byte("\x00\x01aaa/1"), []byte("v:aaa/1"))
+	require.NoError(t, batch.Flush(ctx))
+
+	value, err := dictionary.FetchTabletRow(ctx, []byte("\x00\x01aaa/1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v:aaa/1"), value)
+}
+
+func TestKVStore_ScanAcrossDictionaryPages(t *testing.T) {
+	inner, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	dictionary, err := NewStore(ctx, inner, testIdentities)
+	require.NoError(t, err)
+
+	identityCount := dictionaryScanPageSize*2 + 10
+
+	batch := dictionary.NewBatch(zap.NewNop())
+	var expected []string
+	for i := 0; i < identityCount; i++ {
+		key := fmt.Sprintf("\x00\x01%03x/1", identityCount-i)
+		batch.SetRow([]byte(key), []byte("v"))
+		expected = append([]string{key}, expected...)
+	}
+	require.NoError(t, batch.Flush(ctx))
+
+	var keys []string
+	require.NoError(t, dictionary.ScanTableKeys(ctx, store.RowsTable, []byte{0x00, 0x01}, []byte{0x00, 0x02}, func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	assert.Equal(t, expected, keys)
+
+	keys = nil
+	require.NoError(t, dictionary.ScanTableKeys(ctx, store.RowsTable, []byte{0x00, 0x01}, []byte{0x00, 0x02}, func(key []byte) error {
+		keys = append(keys, string(key))
+		if len(keys) == dictionaryScanPageSize+1 {
+			return store.BreakScan
+		}
+
+		return nil
+	}))
+	assert.Equal(t, expected[:dictionaryScanPageSize+1], keys)
+}
+
+func TestNewStore_KeysWrittenWithoutDictionary(t *testing.T) {
+	inner, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	batch := inner.NewBatch(zap.NewNop())
+	batch.SetRow([]byte("\x00\x01aaa/1"), []byte("raw"))
+	require.NoError(t, batch.Flush(ctx))
+
+	_, err := NewStore(ctx, inner, testIdentities)
+	assert.EqualError(t, err, "collection 0x0001 already has keys written without the key dictionary, it must be enabled before any is written")
+}
+
+// flushRecordingStore records the tables of the mutations of each flush of its batches.
+type flushRecordingStore struct {
+	store.KVStore
+	flushes [][]store.Table
+}
+
+func (s *flushRecordingStore) NewBatch(logger *zap.Logger) store.Batch {
+	return &flushRecordingBatch{Batch: s.KVStore.NewBatch(logger), store: s}
+}
+
+type flushRecordingBatch struct {
+	store.Batch
+	store  *flushRecordingStore
+	tables []store.Table
+}
+
+func (b *flushRecordingBatch) SetRow(key []byte, value []byte) {
+	b.tables = append(b.tables, store.RowsTable)
+	b.Batch.SetRow(key, value)
+}
+
+func (b *flushRecordingBatch) SetTableRow(table store.Table, key []byte, value []byte) {
+	b.tables = append(b.tables, table)
+	b.Batch.SetTableRow(table, key, value)
+}
+
+func (b *flushRecordingBatch) Flush(ctx context.Context) error {
+	b.store.flushes = append(b.store.flushes, b.tables)
+	b.tables = nil
+
+	return b.Batch.Flush(ctx)
+}
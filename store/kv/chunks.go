@@ -0,0 +1,238 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	kv "github.com/dfuse-io/kvdb/store"
+)
+
+// Values larger than the maximum value size of the store are split in chunks written in the
+// chunks table, the value itself being replaced by a chunk header:
+//
+//	<magic (8 bytes)><chunk count (uint32)><total size (uint32)><crc32 of the value (uint32)>
+//
+// The chunk `i` of a value is written at key `<packed key of the value><i (uint32)>` of the chunks
+// table. The chunks are flushed on their own, completing before the flush of the header, so a
+// reader never sees a header whose chunks are not written yet.
+//
+// When a chunked value is overwritten with a smaller one or deleted, its chunks are left behind,
+// those orphan chunks are never read, they only waste space, see `CollectOrphanChunks`.
+var chunkHeaderMagic = []byte{0xFF, 'f', 'l', 'u', 'x', 'c', 'h', 'k'}
+
+const chunkHeaderSize = 8 + 4 + 4 + 4
+
+var bigEndian = binary.BigEndian
+
+// SetMaxValueSize enables the chunking of values larger than `size` bytes, for backends capping
+// the size of their values. Chunked values are transparently reassembled on read, whatever the
+// maximum value size configured, a value of 0 (the default) disables chunking.
+func (s *KVStore) SetMaxValueSize(size int) {
+	s.maxValueSize = size
+}
+
+// needsChunking returns whether the value must be chunked. A value starting with the chunk header
+// (or overflow reference) magic is always chunked, even when chunking is disabled, so it's never
+// mistaken for a header (or reference), a reassembled value being never resolved further.
+func (s *KVStore) needsChunking(value []byte) bool {
+	if s.maxValueSize > 0 && len(value) > s.maxValueSize {
+		return true
+	}
+
+	return bytes.HasPrefix(value, chunkHeaderMagic) || bytes.HasPrefix(value, overflowReferenceMagic)
+}
+
+func isChunkHeader(value []byte) bool {
+	return len(value) == chunkHeaderSize && bytes.HasPrefix(value, chunkHeaderMagic)
+}
+
+// putChunked adds the chunks of the value to the batch and returns the header to write in place
+// of the value.
+func (b *batch) putChunked(packedKey []byte, value []byte) (header []byte) {
+	chunkSize := b.store.maxValueSize
+	if chunkSize <= 0 {
+		chunkSize = len(value)
+	}
+
+	chunkCount := 0
+	for start := 0; start < len(value); start += chunkSize {
+		end := start + chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+
+		b.put(b.tableMutations[TblPrefixChunks], TblPrefixChunks, chunkKey(packedKey, chunkCount), value[start:end])
+		chunkCount++
+	}
+	b.mutationCount += chunkCount
+
+	header = make([]byte, chunkHeaderSize)
+	copy(header, chunkHeaderMagic)
+	bigEndian.PutUint32(header[8:], uint32(chunkCount))
+	bigEndian.PutUint32(header[12:], uint32(len(value)))
+	bigEndian.PutUint32(header[16:], crc32.ChecksumIEEE(value))
+
+	return header
+}
+
+// chunkKey returns the key (without its table prefix) of the chunk `index` of the value at the
+// packed key.
+func chunkKey(packedKey []byte, index int) []byte {
+	key := make([]byte, len(packedKey)+4)
+	copy(key, packedKey)
+	bigEndian.PutUint32(key[len(packedKey):], uint32(index))
+
+	return key
+}
+
+// fetchChunks fetches and reassembles the chunks of the value at the packed key, given its chunk
+// header.
+func (s *KVStore) fetchChunks(ctx context.Context, packedKey []byte, value []byte) ([]byte, error) {
+	chunkCount := int(bigEndian.Uint32(value[8:]))
+	totalSize := int(bigEndian.Uint32(value[12:]))
+	checksum := bigEndian.Uint32(value[16:])
+
+	chunkKeys := make([][]byte, chunkCount)
+	for i := range chunkKeys {
+		chunkKeys[i] = packKey(TblPrefixChunks, chunkKey(packedKey, i))
+	}
+
+	chunks := make([][]byte, chunkCount)
+	itr := s.db.BatchGet(ctx, chunkKeys)
+	for itr.Next() {
+		item := itr.Item()
+		if item.Value == nil {
+			continue
+		}
+
+		index := int(bigEndian.Uint32(item.Key[len(item.Key)-4:]))
+		if index < chunkCount {
+			chunks[index] = item.Value
+		}
+	}
+	if err := itr.Err(); err != nil {
+		return nil, fmt.Errorf("unable to fetch %d chunks of key %q: %w", chunkCount, Key(packedKey), err)
+	}
+
+	out := make([]byte, 0, totalSize)
+	for i, chunk := range chunks {
+		if chunk == nil {
+			return nil, fmt.Errorf("chunked value of key %q is incomplete: chunk %d of %d not found", Key(packedKey), i, chunkCount)
+		}
+
+		out = append(out, chunk...)
+	}
+
+	if len(out) != totalSize {
+		return nil, fmt.Errorf("chunked value of key %q is corrupted: expected %d bytes, got %d", Key(packedKey), totalSize, len(out))
+	}
+
+	if crc32.ChecksumIEEE(out) != checksum {
+		return nil, fmt.Errorf("chunked value of key %q is corrupted: checksum mismatch", Key(packedKey))
+	}
+
+	return out, nil
+}
+
+const orphanChunksDeleteBatchSize = 1000
+
+// CollectOrphanChunks deletes the chunks left behind by chunked values overwritten or deleted,
+// i.e. the chunks not referenced by the chunk header of their value, returning their amount and
+// total size (keys and values). When `dryRun` is true, they are only counted.
+//
+// **Important** The chunks being flushed before their header, the chunks of a value being written
+// are orphans until its header is flushed, this must not run while writing.
+func (s *KVStore) CollectOrphanChunks(ctx context.Context, dryRun bool) (count int, byteSize int, err error) {
+	var orphans [][]byte
+	deleteOrphans := func() error {
+		if dryRun || len(orphans) == 0 {
+			return nil
+		}
+
+		if err := s.db.BatchDelete(ctx, orphans); err != nil {
+			return fmt.Errorf("unable to delete %d orphan chunks: %w", len(orphans), err)
+		}
+
+		orphans = orphans[:0]
+		return nil
+	}
+
+	var parentKey []byte
+	parentChunkCount := 0
+
+	itr := s.db.Scan(ctx, []byte{TblPrefixChunks}, []byte{TblPrefixChunks + 1}, kv.Unlimited)
+	for itr.Next() {
+		item := itr.Item()
+
+		_, key := unpackKey(item.Key)
+		if len(key) <= 4 {
+			return count, byteSize, fmt.Errorf("invalid chunk key %q, expected more than 4 bytes", Key(key))
+		}
+
+		// The chunks of a value are contiguous, its header is fetched once for all of them
+		parent, index := key[:len(key)-4], int(bigEndian.Uint32(key[len(key)-4:]))
+		if parentKey == nil || !bytes.Equal(parent, parentKey) {
+			parentKey = append(parentKey[:0], parent...)
+			if parentChunkCount, err = s.fetchChunkCount(ctx, parentKey); err != nil {
+				return count, byteSize, err
+			}
+		}
+
+		if index < parentChunkCount {
+			continue
+		}
+
+		count++
+		byteSize += len(item.Key) + len(item.Value)
+		orphans = append(orphans, append([]byte(nil), item.Key...))
+
+		if len(orphans) >= orphanChunksDeleteBatchSize {
+			if err := deleteOrphans(); err != nil {
+				return count, byteSize, err
+			}
+		}
+	}
+
+	if err := itr.Err(); err != nil {
+		return count, byteSize, fmt.Errorf("unable to scan table %q: %w", tableName(TblPrefixChunks), err)
+	}
+
+	return count, byteSize, deleteOrphans()
+}
+
+// fetchChunkCount returns the amount of chunks referenced by the raw value at the packed key, 0
+// when the value does not exist or is not chunked.
+func (s *KVStore) fetchChunkCount(ctx context.Context, packedKey []byte) (int, error) {
+	value, err := s.db.Get(ctx, packedKey)
+	if errors.Is(err, kv.ErrNotFound) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch key %q: %w", Key(packedKey), err)
+	}
+
+	if !isChunkHeader(value) {
+		return 0, nil
+	}
+
+	return int(bigEndian.Uint32(value[8:])), nil
+}
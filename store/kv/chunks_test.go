@@ -0,0 +1,187 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	kv "github.com/dfuse-io/kvdb/store"
+	_ "github.com/dfuse-io/kvdb/store/badger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_ChunkedValues(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+	kvStore.SetMaxValueSize(4)
+
+	ctx := context.Background()
+	large := []byte("0123456789")
+	magic := append(append([]byte(nil), chunkHeaderMagic...), 0x01)
+
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), large)
+	batch.SetRow([]byte("b"), []byte("1234"))
+	batch.SetRow([]byte("c"), magic)
+	batch.SetLastCheckpoint([]byte("checkpoint"), large)
+	require.NoError(t, batch.Flush(ctx))
+
+	value, err := kvStore.FetchTabletRow(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, large, value)
+
+	value, err = kvStore.FetchLastWrittenCheckpoint(ctx, []byte("checkpoint"))
+	require.NoError(t, err)
+	assert.Equal(t, large, value)
+
+	values := map[string][]byte{}
+	require.NoError(t, kvStore.FetchTabletRows(ctx, [][]byte{[]byte("a"), []byte("c")}, func(key []byte, value []byte) error {
+		values[string(key)] = value
+		return nil
+	}))
+	assert.Equal(t, map[string][]byte{"a": large, "c": magic}, values)
+
+	values = map[string][]byte{}
+	require.NoError(t, kvStore.ScanTabletRows(ctx, []byte("a"), []byte("z"), func(key []byte, value []byte) error {
+		values[string(key)] = value
+		return nil
+	}))
+	assert.Equal(t, map[string][]byte{"a": large, "b": []byte("1234"), "c": magic}, values)
+
+	raw, err := kvStore.db.Get(ctx, packKey(TblPrefixRows, []byte("b")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1234"), raw, "values not exceeding the maximum value size are not chunked")
+
+	raw, err = kvStore.db.Get(ctx, packKey(TblPrefixRows, []byte("a")))
+	require.NoError(t, err)
+	assert.True(t, isChunkHeader(raw))
+
+	var chunkCount int
+	require.NoError(t, kvStore.scanRange(ctx, TblPrefixChunks, nil, nil, kv.Unlimited, true, func(_ []byte, _ []byte) error {
+		chunkCount++
+		return nil
+	}))
+	assert.Equal(t, 3+3+3, chunkCount)
+}
+
+func TestKVStore_ChunkedValues_Corrupted(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+	kvStore.SetMaxValueSize(4)
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), []byte("0123456789"))
+	require.NoError(t, batch.Flush(ctx))
+
+	packedKey := packKey(TblPrefixRows, []byte("a"))
+	require.NoError(t, kvStore.db.Put(ctx, packKey(TblPrefixChunks, chunkKey(packedKey, 1)), []byte("xxxx")))
+	require.NoError(t, kvStore.db.FlushPuts(ctx))
+
+	_, err := kvStore.FetchTabletRow(ctx, []byte("a"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+
+	require.NoError(t, kvStore.db.BatchDelete(ctx, packKeys(TblPrefixChunks, [][]byte{chunkKey(packedKey, 2)})))
+
+	_, err = kvStore.FetchTabletRow(ctx, []byte("a"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "chunk 2 of 3 not found")
+}
+
+func TestKVStore_ChunkedValues_ReadWithChunkingDisabled(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	large := bytes.Repeat([]byte("x"), 64)
+
+	kvStore.SetMaxValueSize(10)
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), large)
+	require.NoError(t, batch.Flush(ctx))
+
+	kvStore.SetMaxValueSize(0)
+	value, err := kvStore.FetchTabletRow(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, large, value)
+
+	_, err = kvStore.FetchTabletRow(ctx, []byte("b"))
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestKVStore_ChunkedValues_ChunksFlushedFirst(t *testing.T) {
+	kvStore, closer := newRejectingTestStore(t, func(key []byte, _ []byte) bool { return key[0] == TblPrefixRows })
+	defer closer()
+	kvStore.SetMaxValueSize(4)
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), []byte("0123456789"))
+	require.Error(t, batch.Flush(ctx))
+
+	// The chunks were flushed on their own, the failed flush of their header leaving them orphans
+	count, _, err := kvStore.CollectOrphanChunks(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	_, err = kvStore.FetchTabletRow(ctx, []byte("a"))
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+// newTestStore is `storetest.NewKVStore`, which cannot be used by the tests of this package, it
+// imports it.
+func newTestStore(t *testing.T) (*KVStore, func()) {
+	tmp, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+
+	kvStore, err := NewStore(fmt.Sprintf("badger://%s/test.db?createTables=true", tmp))
+	require.NoError(t, err)
+
+	return kvStore, func() {
+		kvStore.Close()
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestKVStore_CollectOrphanChunks(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+	kvStore.SetMaxValueSize(4)
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), []byte("0123456789"))
+	batch.SetRow([]byte("b"), []byte("0123456789"))
+	batch.SetRow([]byte("c"), []byte("0123456789"))
+	require.NoError(t, batch.Flush(ctx))
+
+	// Overwritten with fewer chunks, with an unchunked value and deleted
+	batch = kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), []byte("01234"))
+	batch.SetRow([]byte("b"), []byte("01"))
+	batch.PurgeRow([]byte("c"))
+	require.NoError(t, batch.Flush(ctx))
+
+	count, byteSize, err := kvStore.CollectOrphanChunks(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1+3+3, count)
+	assert.True(t, byteSize > 0)
+
+	count, _, err = kvStore.CollectOrphanChunks(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1+3+3, count)
+
+	count, _, err = kvStore.CollectOrphanChunks(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	value, err := kvStore.FetchTabletRow(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("01234"), value)
+}
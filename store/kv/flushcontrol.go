@@ -0,0 +1,104 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+)
+
+const (
+	initialFlushThreshold = 100
+	minFlushThreshold     = 10
+	maxFlushThreshold     = 5000
+
+	// Flushes slower than this shrink the threshold, flushes faster than half of it grow it
+	targetFlushLatency = 500 * time.Millisecond
+
+	// Flushes error rate, as an exponentially weighted moving average, above which the threshold shrinks
+	maxFlushErrorRate   = 0.05
+	flushErrorRateDecay = 0.1
+)
+
+// flushController adapts the amount of changes a batch accumulates before being flushed based on
+// the latency and error rate of the flushes observed on the backend. The threshold grows slowly
+// (additive increase) while flushes of full batches are fast and error free, and shrinks quickly
+// (multiplicative decrease) when they are slow or failing, converging to the highest throughput
+// the backend sustains without manual tuning.
+type flushController struct {
+	backend string
+
+	lock      sync.Mutex
+	threshold int
+	errorRate float64
+}
+
+func newFlushController(backend string) *flushController {
+	c := &flushController{
+		backend:   backend,
+		threshold: initialFlushThreshold,
+	}
+
+	metrics.FlushThreshold.SetUint64(uint64(c.threshold), backend)
+	return c
+}
+
+// Threshold returns the amount of changes above which a batch should be flushed.
+func (c *flushController) Threshold() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.threshold
+}
+
+// observe records the outcome of a flush of `changeCount` changes that took `latency`, adapting
+// the threshold accordingly.
+func (c *flushController) observe(changeCount int, latency time.Duration, err error) {
+	metrics.FlushDuration.ObserveDuration(latency, c.backend)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	failed := 0.0
+	if err != nil {
+		failed = 1.0
+		metrics.FlushErrorCount.Inc(c.backend)
+	}
+	c.errorRate = c.errorRate*(1-flushErrorRateDecay) + failed*flushErrorRateDecay
+
+	switch {
+	case err != nil || c.errorRate > maxFlushErrorRate || latency > targetFlushLatency:
+		c.threshold = c.threshold / 2
+		if c.threshold < minFlushThreshold {
+			c.threshold = minFlushThreshold
+		}
+
+	// Only grow on full batches, partial ones (final flushes) don't tell much about the backend capacity
+	case changeCount >= c.threshold && latency < targetFlushLatency/2:
+		increment := c.threshold / 10
+		if increment < 1 {
+			increment = 1
+		}
+
+		c.threshold += increment
+		if c.threshold > maxFlushThreshold {
+			c.threshold = maxFlushThreshold
+		}
+	}
+
+	metrics.FlushThreshold.SetUint64(uint64(c.threshold), c.backend)
+}
@@ -0,0 +1,46 @@
+package kv
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushController(t *testing.T) {
+	c := newFlushController("test")
+	assert.Equal(t, initialFlushThreshold, c.Threshold())
+
+	// Partial batches never grow the threshold
+	c.observe(initialFlushThreshold/2, time.Millisecond, nil)
+	assert.Equal(t, initialFlushThreshold, c.Threshold())
+
+	c.observe(initialFlushThreshold, time.Millisecond, nil)
+	assert.Equal(t, 110, c.Threshold())
+
+	// Within target latency but not fast enough to grow
+	c.observe(110, targetFlushLatency*3/4, nil)
+	assert.Equal(t, 110, c.Threshold())
+
+	c.observe(110, targetFlushLatency+time.Millisecond, nil)
+	assert.Equal(t, 55, c.Threshold())
+
+	c.observe(55, time.Millisecond, errors.New("unavailable"))
+	assert.Equal(t, 27, c.Threshold())
+
+	// Error rate is still too high right after a failure, fast flushes keep shrinking until it decays
+	c.observe(27, time.Millisecond, nil)
+	assert.Equal(t, 13, c.Threshold())
+
+	for i := 0; i < 10; i++ {
+		c.observe(10, time.Millisecond, errors.New("unavailable"))
+	}
+	assert.Equal(t, minFlushThreshold, c.Threshold())
+
+	c = newFlushController("test")
+	for i := 0; i < 1000; i++ {
+		c.observe(c.Threshold(), time.Millisecond, nil)
+	}
+	assert.Equal(t, maxFlushThreshold, c.Threshold())
+}
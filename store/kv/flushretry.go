@@ -0,0 +1,215 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+var errChunkRejected = errors.New("a chunk of the value was rejected")
+var errTooManyRejectedKeys = errors.New("too many rejected keys")
+
+// EnablePartitionedFlushRetry retries the failed flushes of batch mutations by partitions,
+// bisecting them until the keys rejected by the backend (e.g. key too large, quota exceeded) are
+// isolated, so the rest of the batch is committed instead of the whole batch failing again each
+// time it's retried, stalling the writer. The flush then fails with a `*store.ErrRejectedKeys`
+// listing the rejected keys, the batch being committed without them.
+//
+// The checkpoints are written once all the other keys are either written or rejected, a rejected
+// checkpoint (or key dictionary entry) still fails the flush. A row whose value has a rejected chunk is rejected too, it
+// would otherwise reference a missing chunk. Once more than `maxRejectedKeys` keys are rejected,
+// the failure is deemed not caused by specific keys (e.g. backend unavailable) and the flush
+// fails with its original error, 0 meaning a default of 100.
+func (s *KVStore) EnablePartitionedFlushRetry(maxRejectedKeys int) {
+	if maxRejectedKeys <= 0 {
+		maxRejectedKeys = 100
+	}
+
+	s.flushRetryMaxRejectedKeys = maxRejectedKeys
+}
+
+type rejectedMutation struct {
+	entry keyValue
+	err   error
+}
+
+// partitionedFlush isolates the mutations rejected by the backend by flushing them in ever
+// smaller partitions, down to a single key.
+type partitionedFlush struct {
+	batch       *batch
+	maxRejected int
+	rejected    []rejectedMutation
+}
+
+// retryPartitioned flushes again, by partitions, the mutations of the batch whose flush failed
+// with `cause`, see `EnablePartitionedFlushRetry`.
+func (b *batch) retryPartitioned(ctx context.Context, tableNames []byte, report *store.FlushReport, cause error) error {
+	b.zlog.Warn("flush of batch mutations failed, retrying by partitions to isolate rejected keys", zap.Int("mutation_count", b.mutationCount), zap.Error(cause))
+
+	retry := &partitionedFlush{batch: b, maxRejected: b.store.flushRetryMaxRejectedKeys}
+	rejectedValues := map[string]bool{}
+	for _, tblName := range tableNames {
+		if tblName == TblPrefixLastCheckpoint {
+			continue
+		}
+
+		if tblName == TblPrefixKeyDictionary {
+			// The rows written reference the dictionary entries, a rejected entry fails the flush
+			if err := b.putAndFlush(ctx, b.tableMutations[tblName].entries); err != nil {
+				return fmt.Errorf("apply key dictionary: %w", err)
+			}
+			continue
+		}
+
+		var entries []keyValue
+		for _, entry := range b.tableMutations[tblName].entries {
+			if rejectedValues[string(entry.key)] {
+				if err := retry.reject(entry, errChunkRejected); err != nil {
+					return fmt.Errorf("apply bulk: %w", cause)
+				}
+				continue
+			}
+
+			entries = append(entries, entry)
+		}
+
+		rejectedBefore := len(retry.rejected)
+		if err := retry.flush(ctx, entries); err != nil {
+			if errors.Is(err, errTooManyRejectedKeys) {
+				return fmt.Errorf("apply bulk: %w", cause)
+			}
+
+			return fmt.Errorf("apply bulk partition: %w", err)
+		}
+
+		if tblName == TblPrefixChunks {
+			// A chunk key is the packed key of its value followed by the chunk index
+			for _, rejected := range retry.rejected[rejectedBefore:] {
+				_, key := unpackKey(rejected.entry.key)
+				rejectedValues[string(key[:len(key)-4])] = true
+			}
+		}
+	}
+
+	// The checkpoints are written last, once all the other keys are either written or rejected
+	if checkpoints := b.tableMutations[TblPrefixLastCheckpoint].entries; len(checkpoints) > 0 {
+		if err := b.putAndFlush(ctx, checkpoints); err != nil {
+			return fmt.Errorf("apply checkpoints: %w", err)
+		}
+	}
+
+	if len(retry.rejected) == 0 {
+		b.zlog.Info("retried flush of batch mutations succeeded without rejected keys")
+		return nil
+	}
+
+	out := &store.ErrRejectedKeys{}
+	for _, rejected := range retry.rejected {
+		table, key := unpackKey(rejected.entry.key)
+		name := tableName(table)
+
+		tableReport := reportTable(report, table)
+		tableReport.MutationCount--
+		tableReport.ByteSize -= flushedSize(rejected.entry)
+		report.MutationCount--
+		report.ByteSize -= flushedSize(rejected.entry)
+
+		metrics.FlushRejectedKeyCount.Inc(b.store.backend, name)
+		out.Keys = append(out.Keys, store.RejectedKey{Table: name, Key: Key(key), Err: rejected.err})
+	}
+
+	b.zlog.Warn("committed batch mutations without the keys rejected by the backend", zap.Int("rejected_key_count", len(out.Keys)), zap.Error(out))
+	return out
+}
+
+// flush writes the entries, bisecting them when the backend fails to, until the rejected ones
+// are isolated.
+func (f *partitionedFlush) flush(ctx context.Context, entries []keyValue) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	err := f.batch.putAndFlush(ctx, entries)
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if len(entries) == 1 {
+		return f.reject(entries[0], err)
+	}
+
+	middle := len(entries) / 2
+	if err := f.flush(ctx, entries[:middle]); err != nil {
+		return err
+	}
+
+	return f.flush(ctx, entries[middle:])
+}
+
+func (f *partitionedFlush) reject(entry keyValue, err error) error {
+	f.rejected = append(f.rejected, rejectedMutation{entry: entry, err: err})
+	if len(f.rejected) > f.maxRejected {
+		return errTooManyRejectedKeys
+	}
+
+	return nil
+}
+
+func (b *batch) putAndFlush(ctx context.Context, entries []keyValue) error {
+	for _, entry := range entries {
+		if err := b.store.db.Put(ctx, entry.key, entry.value); err != nil {
+			return err
+		}
+	}
+
+	return b.store.db.FlushPuts(ctx)
+}
+
+// mergeRejectedKeys returns the keys rejected by all the errors, which must either be `nil` or a
+// `*store.ErrRejectedKeys`, `nil` if there is none.
+func mergeRejectedKeys(errs ...error) error {
+	var out *store.ErrRejectedKeys
+	for _, err := range errs {
+		var rejected *store.ErrRejectedKeys
+		if !errors.As(err, &rejected) {
+			continue
+		}
+
+		if out == nil {
+			out = &store.ErrRejectedKeys{}
+		}
+		out.Keys = append(out.Keys, rejected.Keys...)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+func isRejectedKeys(err error) bool {
+	var rejected *store.ErrRejectedKeys
+	return errors.As(err, &rejected)
+}
@@ -0,0 +1,148 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	kv "github.com/dfuse-io/kvdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rejectingStore fails the flushes of puts containing a key it rejects, discarding them
+type rejectingStore struct {
+	kv.KVStore
+
+	reject func(key []byte, value []byte) bool
+	puts   []kv.KV
+}
+
+func (s *rejectingStore) Put(ctx context.Context, key, value []byte) error {
+	s.puts = append(s.puts, kv.KV{Key: key, Value: value})
+	return nil
+}
+
+func (s *rejectingStore) FlushPuts(ctx context.Context) error {
+	puts := s.puts
+	s.puts = nil
+
+	for _, put := range puts {
+		if s.reject(put.Key, put.Value) {
+			return errors.New("key rejected")
+		}
+	}
+
+	for _, put := range puts {
+		if err := s.KVStore.Put(ctx, put.Key, put.Value); err != nil {
+			return err
+		}
+	}
+	return s.KVStore.FlushPuts(ctx)
+}
+
+func newRejectingTestStore(t *testing.T, reject func(key []byte, value []byte) bool) (*KVStore, func()) {
+	kvStore, closer := newTestStore(t)
+	kvStore.db = &rejectingStore{KVStore: kvStore.db, reject: reject}
+
+	return kvStore, closer
+}
+
+func TestKVStore_PartitionedFlushRetry(t *testing.T) {
+	kvStore, closer := newRejectingTestStore(t, func(key []byte, _ []byte) bool { return bytes.Contains(key, []byte("bad")) })
+	defer closer()
+	kvStore.EnablePartitionedFlushRetry(0)
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	for _, key := range []string{"a", "bad1", "c", "d", "bad2"} {
+		batch.SetRow([]byte(key), []byte(key+"-value"))
+	}
+	batch.SetLastCheckpoint([]byte("checkpoint"), []byte("10"))
+
+	var rejected *store.ErrRejectedKeys
+	require.True(t, errors.As(batch.Flush(ctx), &rejected))
+	require.Len(t, rejected.Keys, 2)
+	assert.Equal(t, "rows", rejected.Keys[0].Table)
+	assert.Equal(t, Key("bad1"), rejected.Keys[0].Key)
+	assert.Equal(t, Key("bad2"), rejected.Keys[1].Key)
+
+	for _, key := range []string{"a", "c", "d"} {
+		value, err := kvStore.FetchTabletRow(ctx, []byte(key))
+		require.NoError(t, err)
+		assert.Equal(t, []byte(key+"-value"), value)
+	}
+
+	_, err := kvStore.FetchTabletRow(ctx, []byte("bad1"))
+	assert.Equal(t, store.ErrNotFound, err)
+
+	value, err := kvStore.FetchLastWrittenCheckpoint(ctx, []byte("checkpoint"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("10"), value)
+
+	// The batch was committed, it's empty once flushed
+	require.NoError(t, batch.Flush(ctx))
+}
+
+func TestKVStore_PartitionedFlushRetry_RejectedChunk(t *testing.T) {
+	kvStore, closer := newRejectingTestStore(t, func(_ []byte, value []byte) bool { return bytes.Equal(value, []byte("89")) })
+	defer closer()
+	kvStore.SetMaxValueSize(4)
+	kvStore.EnablePartitionedFlushRetry(0)
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), []byte("0123456789"))
+	batch.SetRow([]byte("b"), []byte("0123"))
+
+	var rejected *store.ErrRejectedKeys
+	require.True(t, errors.As(batch.Flush(ctx), &rejected))
+	require.Len(t, rejected.Keys, 2)
+	assert.Equal(t, "chunks", rejected.Keys[0].Table)
+	assert.Equal(t, "rows", rejected.Keys[1].Table)
+	assert.Equal(t, Key("a"), rejected.Keys[1].Key)
+	assert.Equal(t, errChunkRejected, rejected.Keys[1].Err)
+
+	_, err := kvStore.FetchTabletRow(ctx, []byte("a"))
+	assert.Equal(t, store.ErrNotFound, err, "row referencing a rejected chunk")
+
+	value, err := kvStore.FetchTabletRow(ctx, []byte("b"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123"), value)
+}
+
+func TestKVStore_PartitionedFlushRetry_TooManyRejectedKeys(t *testing.T) {
+	kvStore, closer := newRejectingTestStore(t, func(key []byte, _ []byte) bool { return bytes.Contains(key, []byte("bad")) })
+	defer closer()
+	kvStore.EnablePartitionedFlushRetry(1)
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	for _, key := range []string{"a", "bad1", "bad2"} {
+		batch.SetRow([]byte(key), []byte(key+"-value"))
+	}
+
+	err := batch.Flush(ctx)
+	require.Error(t, err)
+	assert.False(t, isRejectedKeys(err))
+	assert.Contains(t, err.Error(), "key rejected")
+}
+
+func TestKVStore_FlushWithoutPartitionedRetry(t *testing.T) {
+	kvStore, closer := newRejectingTestStore(t, func(key []byte, _ []byte) bool { return bytes.Contains(key, []byte("bad")) })
+	defer closer()
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), []byte("a-value"))
+	batch.SetRow([]byte("bad"), []byte("bad-value"))
+
+	err := batch.Flush(ctx)
+	require.Error(t, err)
+	assert.False(t, isRejectedKeys(err))
+
+	_, err = kvStore.FetchTabletRow(ctx, []byte("a"))
+	assert.Equal(t, store.ErrNotFound, err)
+}
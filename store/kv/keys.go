@@ -0,0 +1,163 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"sync"
+)
+
+// The initial capacity of the pooled key buffers, grown as needed
+const keyBufferInitialCapacity = 64 * 1024
+
+// Buffers grown past this capacity are not returned to the pool, so a single huge batch
+// does not pin its memory forever
+const keyBufferMaxPooledCapacity = 16 * 1024 * 1024
+
+var keyBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &keyBuffer{data: make([]byte, 0, keyBufferInitialCapacity)}
+	},
+}
+
+// keyBuffer is an append-only arena of packed keys. The packed keys returned by `pack` are
+// sub-slices of the arena, when the arena grows, previously returned keys keep referencing
+// the old backing array so they remain valid, only one allocation is needed per growth
+// instead of one per key.
+//
+// Once released, the arena is reused by another batch, so packed keys must not be referenced
+// anymore, which is the case once the batch has been flushed to the storage engine.
+type keyBuffer struct {
+	data []byte
+}
+
+func acquireKeyBuffer() *keyBuffer {
+	return keyBufferPool.Get().(*keyBuffer)
+}
+
+func releaseKeyBuffer(buffer *keyBuffer) {
+	if cap(buffer.data) > keyBufferMaxPooledCapacity {
+		return
+	}
+
+	buffer.data = buffer.data[:0]
+	keyBufferPool.Put(buffer)
+}
+
+// pack appends the storage key of `key` in `table` to the arena and returns it.
+func (b *keyBuffer) pack(table byte, key []byte) []byte {
+	start := len(b.data)
+	b.data = append(b.data, table)
+	b.data = append(b.data, key...)
+
+	// Capping the capacity ensures an append on the packed key never overwrites the next one
+	return b.data[start:len(b.data):len(b.data)]
+}
+
+// discard removes `packedKey` from the arena, it must be the last packed key.
+func (b *keyBuffer) discard(packedKey []byte) {
+	b.data = b.data[:len(b.data)-len(packedKey)]
+}
+
+func packKey(table byte, key []byte) []byte {
+	out := make([]byte, 1+len(key))
+	out[0] = table
+	copy(out[1:], key)
+
+	return out
+}
+
+// packKeys packs all keys in a single contiguous allocation.
+func packKeys(table byte, keys [][]byte) [][]byte {
+	size := 0
+	for _, key := range keys {
+		size += 1 + len(key)
+	}
+
+	buffer := &keyBuffer{data: make([]byte, 0, size)}
+	kvKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		kvKeys[i] = buffer.pack(table, key)
+	}
+
+	return kvKeys
+}
+
+func unpackKey(packedKey []byte) (table byte, key []byte) {
+	if len(packedKey) < 1 {
+		return
+	}
+
+	return packedKey[0], packedKey[1:]
+}
+
+type keyValue struct {
+	key   []byte
+	value []byte
+}
+
+// keyToValueMap holds the last value set for each key, in insertion order of the keys. The
+// entries are indexed by a hash of their key, so inserting a key does not allocate a copy of it
+// as a `map[string]` index would, the keys with colliding hashes being chained.
+type keyToValueMap struct {
+	// The last inserted entry of each key hash
+	index   map[uint64]int
+	entries []keyValue
+
+	// The previous entry with the same key hash of each entry, -1 for the first one
+	collisions []int
+}
+
+func newKeyToValueMap() *keyToValueMap {
+	return &keyToValueMap{index: map[uint64]int{}}
+}
+
+// put sets the value of the key, returns `false` if the key was already present in which
+// case only its value is updated.
+func (m *keyToValueMap) put(key []byte, value []byte) (added bool) {
+	hash := keyHash(key)
+
+	previous, found := m.index[hash]
+	if !found {
+		previous = -1
+	}
+
+	for i := previous; i >= 0; i = m.collisions[i] {
+		if bytes.Equal(m.entries[i].key, key) {
+			m.entries[i].value = value
+			return false
+		}
+	}
+
+	m.index[hash] = len(m.entries)
+	m.entries = append(m.entries, keyValue{key: key, value: value})
+	m.collisions = append(m.collisions, previous)
+	return true
+}
+
+// keyHash is the 64 bits FNV-1a hash of the key.
+func keyHash(key []byte) uint64 {
+	hash := uint64(14695981039346656037)
+	for _, b := range key {
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+
+	return hash
+}
+
+func (m *keyToValueMap) len() int {
+	return len(m.entries)
+}
@@ -0,0 +1,76 @@
+package kv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyBuffer(t *testing.T) {
+	buffer := &keyBuffer{data: make([]byte, 0, 4)}
+
+	first := buffer.pack(TblPrefixRows, []byte("ab"))
+	second := buffer.pack(TblPrefixLastCheckpoint, []byte("cd"))
+	assert.Equal(t, []byte{TblPrefixRows, 'a', 'b'}, first)
+	assert.Equal(t, []byte{TblPrefixLastCheckpoint, 'c', 'd'}, second, "arena grown, previous keys must remain valid")
+
+	_ = append(first, 'x')
+	assert.Equal(t, []byte{TblPrefixLastCheckpoint, 'c', 'd'}, second, "appending to a packed key must not overwrite the next one")
+
+	third := buffer.pack(TblPrefixRows, []byte("ef"))
+	buffer.discard(third)
+	assert.Equal(t, []byte{TblPrefixRows, 'g'}, buffer.pack(TblPrefixRows, []byte("g")))
+	assert.Equal(t, []byte{TblPrefixLastCheckpoint, 'c', 'd'}, second)
+
+	keys := packKeys(TblPrefixRows, [][]byte{[]byte("a"), []byte("bc")})
+	assert.Equal(t, [][]byte{{TblPrefixRows, 'a'}, {TblPrefixRows, 'b', 'c'}}, keys)
+}
+
+func TestKeyToValueMap(t *testing.T) {
+	mappings := newKeyToValueMap()
+
+	assert.True(t, mappings.put([]byte("b"), []byte("1")))
+	assert.True(t, mappings.put([]byte("a"), []byte("2")))
+	assert.False(t, mappings.put([]byte("b"), []byte("3")))
+
+	assert.Equal(t, 2, mappings.len())
+	assert.Equal(t, []keyValue{
+		{key: []byte("b"), value: []byte("3")},
+		{key: []byte("a"), value: []byte("2")},
+	}, mappings.entries)
+}
+
+func TestKeyToValueMap_HashCollisions(t *testing.T) {
+	mappings := newKeyToValueMap()
+	mappings.put([]byte("a"), []byte("1"))
+	mappings.put([]byte("b"), []byte("2"))
+
+	// Forces all the keys under the same hash, as if they were colliding
+	mappings.index = map[uint64]int{keyHash([]byte("a")): 1, keyHash([]byte("b")): 1}
+	mappings.collisions = []int{-1, 0}
+
+	assert.False(t, mappings.put([]byte("a"), []byte("3")))
+	assert.False(t, mappings.put([]byte("b"), []byte("4")))
+	assert.Equal(t, []keyValue{
+		{key: []byte("a"), value: []byte("3")},
+		{key: []byte("b"), value: []byte("4")},
+	}, mappings.entries)
+}
+
+func TestKeyToValueMap_Allocations(t *testing.T) {
+	keys := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%04d", i)))
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		mappings := newKeyToValueMap()
+		for _, key := range keys {
+			mappings.put(key, nil)
+		}
+	})
+
+	// Only the growths of the index and of the entries allocate, not the keys inserted
+	assert.Less(t, allocs, float64(len(keys)/10))
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	kv "github.com/dfuse-io/kvdb/store"
+)
+
+// EnableOperationMetrics records the count, the latency and the errors of each operation this
+// store performs on its backend, see `NewMeteredStore`.
+func (s *KVStore) EnableOperationMetrics() {
+	s.db = NewMeteredStore(s.db, s.backend)
+}
+
+// NewMeteredStore decorates the `db` engine so each of its operations is counted, timed and its
+// errors classified by code in the `store_operation_*` metrics, labeled with `backend`. It
+// wraps any engine, making the performance of a backend observable without instrumenting it.
+//
+// The operations returning an iterator are timed until the iterator is exhausted, their items
+// being relayed through an iterator of the decorator.
+func NewMeteredStore(db kv.KVStore, backend string) kv.KVStore {
+	return &meteredStore{db: db, backend: backend}
+}
+
+type meteredStore struct {
+	db      kv.KVStore
+	backend string
+}
+
+func (s *meteredStore) Put(ctx context.Context, key, value []byte) (err error) {
+	defer s.observe("put", time.Now(), &err)
+	return s.db.Put(ctx, key, value)
+}
+
+func (s *meteredStore) FlushPuts(ctx context.Context) (err error) {
+	defer s.observe("flush_puts", time.Now(), &err)
+	return s.db.FlushPuts(ctx)
+}
+
+func (s *meteredStore) Get(ctx context.Context, key []byte) (value []byte, err error) {
+	defer s.observe("get", time.Now(), &err)
+	return s.db.Get(ctx, key)
+}
+
+func (s *meteredStore) BatchGet(ctx context.Context, keys [][]byte) *kv.Iterator {
+	return s.relay(ctx, "batch_get", s.db.BatchGet(ctx, keys))
+}
+
+func (s *meteredStore) Scan(ctx context.Context, start, exclusiveEnd []byte, limit int, options ...kv.ReadOption) *kv.Iterator {
+	return s.relay(ctx, "scan", s.db.Scan(ctx, start, exclusiveEnd, limit, options...))
+}
+
+func (s *meteredStore) Prefix(ctx context.Context, prefix []byte, limit int, options ...kv.ReadOption) *kv.Iterator {
+	return s.relay(ctx, "prefix", s.db.Prefix(ctx, prefix, limit, options...))
+}
+
+func (s *meteredStore) BatchPrefix(ctx context.Context, prefixes [][]byte, limit int, options ...kv.ReadOption) *kv.Iterator {
+	return s.relay(ctx, "batch_prefix", s.db.BatchPrefix(ctx, prefixes, limit, options...))
+}
+
+func (s *meteredStore) BatchDelete(ctx context.Context, keys [][]byte) (err error) {
+	defer s.observe("batch_delete", time.Now(), &err)
+	return s.db.BatchDelete(ctx, keys)
+}
+
+func (s *meteredStore) Close() error {
+	if closer, ok := s.db.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (s *meteredStore) relay(ctx context.Context, operation string, itr *kv.Iterator) *kv.Iterator {
+	start := time.Now()
+	out := kv.NewIterator(ctx)
+
+	go func() {
+		for itr.Next() {
+			if !out.PushItem(itr.Item()) {
+				// The consumer is gone, its context canceled, which is not an error of the backend
+				s.observe(operation, start, nil)
+				return
+			}
+		}
+
+		err := itr.Err()
+		s.observe(operation, start, &err)
+
+		if err != nil {
+			out.PushError(err)
+			return
+		}
+
+		out.PushFinished()
+	}()
+
+	return out
+}
+
+func (s *meteredStore) observe(operation string, start time.Time, err *error) {
+	metrics.StoreOperationCount.Inc(s.backend, operation)
+	metrics.StoreOperationDuration.ObserveDuration(time.Since(start), s.backend, operation)
+
+	if err != nil && *err != nil && *err != kv.ErrNotFound {
+		metrics.StoreOperationErrorCount.Inc(s.backend, operation, operationErrorCode(*err))
+	}
+}
+
+// operationErrorCode classifies `err` in a small set of codes, keeping the cardinality of the
+// error metric bounded whatever the errors of the backend.
+func operationErrorCode(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,60 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_OperationMetrics(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+
+	kvStore.EnableOperationMetrics()
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	for _, key := range []string{"a", "b", "c"} {
+		batch.SetRow([]byte(key), []byte(key+"1"))
+	}
+	require.NoError(t, batch.Flush(ctx))
+
+	value, err := kvStore.FetchTabletRow(ctx, []byte("b"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b1"), value)
+
+	_, err = kvStore.FetchTabletRow(ctx, []byte("z"))
+	assert.Equal(t, store.ErrNotFound, err)
+
+	var keys []string
+	require.NoError(t, kvStore.ScanTabletRows(ctx, []byte("a"), []byte("z"), func(key []byte, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+
+	keys = nil
+	require.NoError(t, kvStore.ScanTabletRows(ctx, []byte("a"), []byte("z"), func(key []byte, _ []byte) error {
+		keys = append(keys, string(key))
+		return store.BreakScan
+	}))
+	assert.Equal(t, []string{"a"}, keys, "interrupted scan")
+
+	keys = nil
+	require.NoError(t, kvStore.FetchTabletRows(ctx, [][]byte{[]byte("c"), []byte("y"), []byte("a")}, func(key []byte, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	assert.Equal(t, []string{"c", "a"}, keys)
+}
+
+func TestOperationErrorCode(t *testing.T) {
+	assert.Equal(t, "canceled", operationErrorCode(fmt.Errorf("scan: %w", context.Canceled)))
+	assert.Equal(t, "deadline_exceeded", operationErrorCode(context.DeadlineExceeded))
+	assert.Equal(t, "unknown", operationErrorCode(errors.New("unavailable")))
+}
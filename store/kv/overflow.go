@@ -0,0 +1,194 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// Row values larger than the overflow threshold are written as objects of the overflow dstore,
+// named after the hex encoded sha256 of the value, the value itself being replaced by an overflow
+// reference:
+//
+//	<magic (8 bytes)><size (uint32)><sha256 of the value (32 bytes)>
+//
+// The objects are always written before the references to them. Being content addressed, an
+// object can be referenced by multiple rows, objects are thus never deleted, even when the rows
+// referencing them are.
+var overflowReferenceMagic = []byte{0xFF, 'f', 'l', 'u', 'x', 'o', 'v', 'f'}
+
+const overflowReferenceSize = 8 + 4 + sha256.Size
+
+type overflowStorage struct {
+	store     dstore.Store
+	threshold int
+	cache     *overflowCache
+}
+
+// EnableOverflowStorage stores the row values (singlet entries, tablet rows and index snapshots)
+// larger than `threshold` bytes in the `payloadStore` instead of the KV store, keeping only a
+// reference to them in the KV store. Referenced values are transparently fetched on read, up to
+// `cacheSize` bytes of them being kept in memory.
+//
+// The overflow storage must be enabled to read values written while it was enabled.
+func (s *KVStore) EnableOverflowStorage(payloadStore dstore.Store, threshold int, cacheSize int) {
+	s.overflow = &overflowStorage{
+		store:     payloadStore,
+		threshold: threshold,
+		cache:     newOverflowCache(cacheSize),
+	}
+}
+
+func (s *KVStore) needsOverflow(table byte, value []byte) bool {
+	return s.overflow != nil && table == TblPrefixRows && len(value) > s.overflow.threshold
+}
+
+func isOverflowReference(value []byte) bool {
+	return len(value) == overflowReferenceSize && bytes.HasPrefix(value, overflowReferenceMagic)
+}
+
+// putOverflow adds the value to the objects written to the overflow storage on flush and returns
+// the reference to write in place of the value.
+func (b *batch) putOverflow(value []byte) (reference []byte) {
+	hash := sha256.Sum256(value)
+
+	reference = make([]byte, overflowReferenceSize)
+	copy(reference, overflowReferenceMagic)
+	bigEndian.PutUint32(reference[8:], uint32(len(value)))
+	copy(reference[12:], hash[:])
+
+	b.overflows.put([]byte(hex.EncodeToString(hash[:])), value)
+	return reference
+}
+
+func (b *batch) flushOverflows(ctx context.Context) error {
+	for _, entry := range b.overflows.entries {
+		name := string(entry.key)
+		if err := b.store.overflow.store.WriteObject(ctx, name, bytes.NewReader(entry.value)); err != nil {
+			return fmt.Errorf("unable to write overflow object %q: %w", name, err)
+		}
+
+		b.store.overflow.cache.add(name, entry.value)
+	}
+
+	return nil
+}
+
+// fetchOverflow fetches the value referenced by the overflow reference.
+func (s *KVStore) fetchOverflow(ctx context.Context, reference []byte) ([]byte, error) {
+	name := hex.EncodeToString(reference[12:])
+	if s.overflow == nil {
+		return nil, fmt.Errorf("value stored in overflow object %q but overflow storage is not enabled", name)
+	}
+
+	if value, found := s.overflow.cache.get(name); found {
+		store.ReadStatsFromContext(ctx).RecordCacheHit()
+		return value, nil
+	}
+
+	reader, err := s.overflow.store.OpenObject(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open overflow object %q: %w", name, err)
+	}
+	defer reader.Close()
+
+	value, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read overflow object %q: %w", name, err)
+	}
+
+	if len(value) != int(bigEndian.Uint32(reference[8:])) {
+		return nil, fmt.Errorf("overflow object %q is corrupted: expected %d bytes, got %d", name, bigEndian.Uint32(reference[8:]), len(value))
+	}
+
+	if hash := sha256.Sum256(value); !bytes.Equal(hash[:], reference[12:]) {
+		return nil, fmt.Errorf("overflow object %q is corrupted: hash mismatch", name)
+	}
+
+	s.overflow.cache.add(name, value)
+	return value, nil
+}
+
+// overflowCache keeps up to `capacity` bytes of overflow values in memory, least recently used
+// ones are evicted first, it's safe for concurrent use.
+type overflowCache struct {
+	lock     sync.Mutex
+	capacity int
+	size     int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type overflowValue struct {
+	name  string
+	value []byte
+}
+
+func newOverflowCache(capacity int) *overflowCache {
+	return &overflowCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *overflowCache) get(name string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, found := c.entries[name]
+	if !found {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*overflowValue).value, true
+}
+
+func (c *overflowCache) add(name string, value []byte) {
+	if len(value) > c.capacity {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, found := c.entries[name]; found {
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[name] = c.order.PushFront(&overflowValue{name: name, value: value})
+	c.size += len(value)
+
+	for c.size > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+
+		evicted := oldest.Value.(*overflowValue)
+		delete(c.entries, evicted.name)
+		c.size -= len(evicted.value)
+	}
+}
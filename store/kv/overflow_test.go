@@ -0,0 +1,124 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_OverflowStorage(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+
+	payloadStore, payloadCloser := newTestPayloadStore(t)
+	defer payloadCloser()
+
+	kvStore.EnableOverflowStorage(payloadStore, 16, 0)
+
+	ctx := context.Background()
+	large := bytes.Repeat([]byte("x"), 32)
+	reference := append(append([]byte(nil), overflowReferenceMagic...), 0x01)
+
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), large)
+	batch.SetRow([]byte("b"), []byte("small"))
+	batch.SetRow([]byte("c"), reference)
+	batch.SetLastCheckpoint([]byte("checkpoint"), large)
+	require.NoError(t, batch.Flush(ctx))
+
+	hash := sha256.Sum256(large)
+	exists, err := payloadStore.FileExists(ctx, hex.EncodeToString(hash[:]))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	raw, err := kvStore.db.Get(ctx, packKey(TblPrefixRows, []byte("a")))
+	require.NoError(t, err)
+	assert.True(t, isOverflowReference(raw))
+
+	raw, err = kvStore.db.Get(ctx, packKey(TblPrefixLastCheckpoint, []byte("checkpoint")))
+	require.NoError(t, err)
+	assert.Equal(t, large, raw, "only row values are stored in the overflow storage")
+
+	values := map[string][]byte{}
+	require.NoError(t, kvStore.ScanTabletRows(ctx, []byte("a"), []byte("z"), func(key []byte, value []byte) error {
+		values[string(key)] = value
+		return nil
+	}))
+	assert.Equal(t, map[string][]byte{"a": large, "b": []byte("small"), "c": reference}, values)
+
+	// Corrupting the object is detected since the value is not cached
+	require.NoError(t, payloadStore.DeleteObject(ctx, hex.EncodeToString(hash[:])))
+	require.NoError(t, payloadStore.WriteObject(ctx, hex.EncodeToString(hash[:]), bytes.NewReader(bytes.Repeat([]byte("y"), 32))))
+
+	_, err = kvStore.FetchTabletRow(ctx, []byte("a"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "hash mismatch")
+}
+
+func TestKVStore_OverflowStorage_Cache(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+
+	payloadStore, payloadCloser := newTestPayloadStore(t)
+	defer payloadCloser()
+
+	kvStore.EnableOverflowStorage(payloadStore, 16, 1024)
+
+	ctx := context.Background()
+	large := bytes.Repeat([]byte("x"), 32)
+
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), large)
+	require.NoError(t, batch.Flush(ctx))
+
+	hash := sha256.Sum256(large)
+	require.NoError(t, payloadStore.DeleteObject(ctx, hex.EncodeToString(hash[:])))
+
+	value, err := kvStore.FetchTabletRow(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, large, value, "value must be served from the cache")
+}
+
+func TestOverflowCache(t *testing.T) {
+	cache := newOverflowCache(10)
+
+	cache.add("a", []byte("aaaa"))
+	cache.add("b", []byte("bbbb"))
+	cache.add("huge", []byte("hugehugehuge"))
+
+	_, found := cache.get("a")
+	assert.True(t, found)
+
+	cache.add("c", []byte("cccc"))
+
+	_, found = cache.get("b")
+	assert.False(t, found, "least recently used value must have been evicted")
+
+	_, found = cache.get("huge")
+	assert.False(t, found, "values larger than the cache must not be cached")
+
+	value, found := cache.get("c")
+	assert.True(t, found)
+	assert.Equal(t, []byte("cccc"), value)
+	assert.Equal(t, 8, cache.size)
+}
+
+func newTestPayloadStore(t *testing.T) (dstore.Store, func()) {
+	tmp, err := ioutil.TempDir("", "overflow")
+	require.NoError(t, err)
+
+	payloadStore, err := dstore.NewLocalStore(tmp, "", "", true)
+	require.NoError(t, err)
+
+	return payloadStore, func() {
+		os.RemoveAll(tmp)
+	}
+}
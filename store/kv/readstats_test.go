@@ -0,0 +1,56 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_ReadStats(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+
+	payloadStore, payloadCloser := newTestPayloadStore(t)
+	defer payloadCloser()
+
+	kvStore.EnableOverflowStorage(payloadStore, 16, 1024)
+
+	large := bytes.Repeat([]byte("x"), 32)
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("a"), large)
+	batch.SetRow([]byte("b"), []byte("12"))
+	batch.SetRow([]byte("c"), []byte("1234"))
+	require.NoError(t, batch.Flush(context.Background()))
+
+	stats := &store.ReadStats{}
+	ctx := store.WithReadStats(context.Background(), stats)
+
+	_, err := kvStore.FetchTabletRow(ctx, []byte("b"))
+	require.NoError(t, err)
+
+	_, err = kvStore.FetchTabletRow(ctx, []byte("z"))
+	assert.Equal(t, store.ErrNotFound, err)
+
+	require.NoError(t, kvStore.FetchTabletRows(ctx, [][]byte{[]byte("c"), []byte("y")}, func(_ []byte, _ []byte) error { return nil }))
+	assert.Equal(t, 2, stats.KeyCount())
+	assert.Equal(t, 3+5, stats.ByteCount())
+	assert.Equal(t, 0, stats.ScanCount())
+
+	require.NoError(t, kvStore.ScanTabletRows(ctx, []byte("a"), []byte("z"), func(_ []byte, _ []byte) error { return nil }))
+	assert.Equal(t, 5, stats.KeyCount())
+	assert.Equal(t, 3+5+33+3+5, stats.ByteCount(), "overflow values are accounted for their actual size")
+	assert.Equal(t, 1, stats.ScanCount())
+	assert.Equal(t, 1, stats.CacheHitCount(), "written values are cached")
+
+	_, found := stats.IndexSnapshot()
+	assert.False(t, found)
+
+	// Reads without a collector are not recorded anywhere
+	_, err = kvStore.FetchTabletRow(context.Background(), []byte("b"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, stats.KeyCount())
+}
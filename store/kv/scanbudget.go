@@ -0,0 +1,83 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// SetScanBudget bounds each scan of tablet rows to `budget`, unless its context has its own
+// budget, see `store.WithScanBudget`. A scan exceeding its budget aborts with a
+// `*store.ErrScanBudgetExceeded` holding the key to resume it from.
+func (s *KVStore) SetScanBudget(budget store.ScanBudget) {
+	s.scanBudget = budget
+}
+
+func (s *KVStore) scanBudgetOf(ctx context.Context) store.ScanBudget {
+	if budget, found := store.ScanBudgetFromContext(ctx); found {
+		return budget
+	}
+
+	return s.scanBudget
+}
+
+// scanWithBudget runs the `scan` starting at `keyStart`, aborting it once `budget` is
+// exhausted. The budget is checked before each row so a scan completing within it never
+// fails, a scan blocked on the backend is aborted by the deadline of its context.
+func scanWithBudget(ctx context.Context, budget store.ScanBudget, keyStart []byte, onKeyValue store.OnKeyValue, scan func(ctx context.Context, onKeyValue store.OnKeyValue) error) error {
+	start := time.Now()
+	scanCtx := ctx
+	if budget.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		scanCtx, cancel = context.WithTimeout(ctx, budget.MaxDuration)
+		defer cancel()
+	}
+
+	scannedBytes := 0
+	resumeKey := append([]byte(nil), keyStart...)
+	exceeded := func() *store.ErrScanBudgetExceeded {
+		return &store.ErrScanBudgetExceeded{ResumeKey: resumeKey, ScannedBytes: scannedBytes, Elapsed: time.Since(start)}
+	}
+
+	var exceededErr *store.ErrScanBudgetExceeded
+	err := scan(scanCtx, func(key []byte, value []byte) error {
+		if (budget.MaxBytes > 0 && scannedBytes >= budget.MaxBytes) || (budget.MaxDuration > 0 && time.Since(start) >= budget.MaxDuration) {
+			resumeKey = append([]byte(nil), key...)
+			exceededErr = exceeded()
+			return exceededErr
+		}
+
+		scannedBytes += len(key) + len(value)
+
+		// The successor of the key, the scans being inclusive of their start key
+		resumeKey = append(append(resumeKey[:0], key...), 0x00)
+
+		return onKeyValue(key, value)
+	})
+
+	if exceededErr != nil {
+		return exceededErr
+	}
+
+	if err != nil && errors.Is(scanCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return exceeded()
+	}
+
+	return err
+}
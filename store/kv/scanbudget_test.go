@@ -0,0 +1,60 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_ScanBudget(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		batch.SetRow([]byte(key), []byte("1234"))
+	}
+	require.NoError(t, batch.Flush(ctx))
+
+	scan := func(ctx context.Context, start string) (keys []string, err error) {
+		err = kvStore.ScanTabletRows(ctx, []byte(start), []byte("z"), func(key []byte, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+
+		return
+	}
+
+	kvStore.SetScanBudget(store.ScanBudget{MaxBytes: 10})
+
+	keys, err := scan(ctx, "a")
+	var exceeded *store.ErrScanBudgetExceeded
+	require.True(t, errors.As(err, &exceeded), "got %v", err)
+	assert.Equal(t, []string{"a", "b"}, keys, "partial result")
+	assert.Equal(t, store.Key("c"), exceeded.ResumeKey)
+	assert.Equal(t, 10, exceeded.ScannedBytes)
+
+	keys, err = scan(ctx, string(exceeded.ResumeKey))
+	require.True(t, errors.As(err, &exceeded), "got %v", err)
+	assert.Equal(t, []string{"c", "d"}, keys)
+	assert.Equal(t, store.Key("e"), exceeded.ResumeKey)
+
+	keys, err = scan(ctx, string(exceeded.ResumeKey))
+	require.NoError(t, err, "completed within the budget")
+	assert.Equal(t, []string{"e"}, keys)
+
+	keys, err = scan(store.WithScanBudget(ctx, store.ScanBudget{}), "a")
+	require.NoError(t, err, "unbounded by its context")
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, keys)
+
+	keys, err = scan(store.WithScanBudget(ctx, store.ScanBudget{MaxDuration: time.Nanosecond}), "a")
+	require.True(t, errors.As(err, &exceeded), "got %v", err)
+	assert.Empty(t, keys)
+	assert.Equal(t, store.Key("a"), exceeded.ResumeKey)
+}
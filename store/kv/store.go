@@ -19,8 +19,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/dfuse-io/dtracing"
+	"github.com/dfuse-io/fluxdb/metrics"
 	"github.com/dfuse-io/fluxdb/store"
 	kv "github.com/dfuse-io/kvdb/store"
 	"github.com/dfuse-io/logging"
@@ -30,17 +34,44 @@ import (
 var TblPrefixName = map[byte]string{
 	TblPrefixRows:           "rows",
 	TblPrefixLastCheckpoint: "checkpoint",
+	TblPrefixChunks:         "chunks",
+	TblPrefixKeyDictionary:  "key-dictionary",
 }
 
 const (
 	TblPrefixRows           = 0x00
 	TblPrefixLastCheckpoint = 0x01
+	TblPrefixChunks         = 0x02
+
+	// The dictionary of the identities compressed in the rows keys, see the `keydict` package
+	TblPrefixKeyDictionary = 0x03
 )
 
 var TableMapper = map[byte]string{}
 
 type KVStore struct {
-	db kv.KVStore
+	db           kv.KVStore
+	backend      string
+	flushControl *flushController
+
+	// Values larger than this are chunked, see `SetMaxValueSize`
+	maxValueSize int
+
+	// Row values larger than its threshold are stored in it, see `EnableOverflowStorage`
+	overflow *overflowStorage
+
+	// Bounds the tablet rows scans without their own budget, see `SetScanBudget`
+	scanBudget store.ScanBudget
+
+	// Failed flushes are retried by partitions when non-zero, see `EnablePartitionedFlushRetry`
+	flushRetryMaxRejectedKeys int
+
+	flushListenersLock sync.RWMutex
+	flushListeners     []store.OnFlush
+
+	// Puts are buffered by the underlying engine until flushed, flushes of different batches
+	// (possibly in background) must not interleave
+	flushLock sync.Mutex
 }
 
 func NewStore(dsnString string) (*KVStore, error) {
@@ -49,8 +80,15 @@ func NewStore(dsnString string) (*KVStore, error) {
 		return nil, fmt.Errorf("cannot create new kv store: %w", err)
 	}
 
+	backend := "unknown"
+	if dsn, err := url.Parse(dsnString); err == nil && dsn.Scheme != "" {
+		backend = dsn.Scheme
+	}
+
 	return &KVStore{
-		db: store,
+		db:           store,
+		backend:      backend,
+		flushControl: newFlushController(backend),
 	}, nil
 
 }
@@ -66,8 +104,30 @@ func (s *KVStore) NewBatch(logger *zap.Logger) store.Batch {
 	return newBatch(s, logger)
 }
 
+func (s *KVStore) OnFlush(listener store.OnFlush) {
+	s.flushListenersLock.Lock()
+	defer s.flushListenersLock.Unlock()
+
+	s.flushListeners = append(s.flushListeners, listener)
+}
+
+func (s *KVStore) reportFlush(report *store.FlushReport) {
+	for table, tableReport := range report.Tables {
+		metrics.FlushedMutationCount.AddInt(tableReport.MutationCount, s.backend, table)
+		metrics.FlushedDeletionCount.AddInt(tableReport.DeletionCount, s.backend, table)
+		metrics.FlushedBytes.AddInt(tableReport.ByteSize, s.backend, table)
+	}
+
+	s.flushListenersLock.RLock()
+	defer s.flushListenersLock.RUnlock()
+
+	for _, listener := range s.flushListeners {
+		listener(*report)
+	}
+}
+
 func (s *KVStore) FetchSingletEntry(ctx context.Context, keyStart, keyEnd []byte) (key []byte, value []byte, err error) {
-	err = s.scanRange(ctx, TblPrefixRows, keyStart, keyEnd, 1, func(rowKey []byte, rowValue []byte) error {
+	err = s.scanRange(ctx, TblPrefixRows, keyStart, keyEnd, 1, false, func(rowKey []byte, rowValue []byte) error {
 		key = rowKey
 		value = rowValue
 
@@ -83,7 +143,7 @@ func (s *KVStore) FetchSingletEntry(ctx context.Context, keyStart, keyEnd []byte
 }
 
 func (s *KVStore) HasTabletRow(ctx context.Context, keyStart, keyEnd []byte) (exists bool, err error) {
-	err = s.scanRange(ctx, TblPrefixRows, keyStart, keyEnd, 1, func(_ []byte, _ []byte) error {
+	err = s.scanRange(ctx, TblPrefixRows, keyStart, keyEnd, 1, false, func(_ []byte, _ []byte) error {
 		exists = true
 		return store.BreakScan
 	})
@@ -104,7 +164,13 @@ func (s *KVStore) FetchTabletRows(ctx context.Context, keys [][]byte, onKeyValue
 }
 
 func (s *KVStore) ScanTabletRows(ctx context.Context, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
-	err := s.scanRange(ctx, TblPrefixRows, keyStart, keyEnd, kv.Unlimited, func(key []byte, value []byte) error {
+	if budget := s.scanBudgetOf(ctx); !budget.IsZero() {
+		return scanWithBudget(ctx, budget, keyStart, onKeyValue, func(ctx context.Context, onKeyValue store.OnKeyValue) error {
+			return s.ScanTabletRows(store.WithScanBudget(ctx, store.ScanBudget{}), keyStart, keyEnd, onKeyValue)
+		})
+	}
+
+	err := s.scanRange(ctx, TblPrefixRows, keyStart, keyEnd, kv.Unlimited, false, func(key []byte, value []byte) error {
 		err := onKeyValue(key, value)
 		if err == store.BreakScan {
 			return store.BreakScan
@@ -190,6 +256,59 @@ func (s *KVStore) DeleteShardsCheckpoint(ctx context.Context, keyPrefix []byte)
 	return s.db.BatchDelete(ctx, packKeys(TblPrefixLastCheckpoint, keys))
 }
 
+func (s *KVStore) ScanTableKeys(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKey store.OnKey) error {
+	return s.scanTable(ctx, table, keyStart, keyEnd, true, func(key []byte, _ []byte) error {
+		return onKey(key)
+	})
+}
+
+func (s *KVStore) ScanTable(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	return s.scanTable(ctx, table, keyStart, keyEnd, false, onKeyValue)
+}
+
+func (s *KVStore) scanTable(ctx context.Context, table store.Table, keyStart, keyEnd []byte, keyOnly bool, onKeyValue store.OnKeyValue) error {
+	prefix, err := tablePrefix(table)
+	if err != nil {
+		return err
+	}
+
+	err = s.scanRange(ctx, prefix, keyStart, keyEnd, kv.Unlimited, keyOnly, func(key []byte, value []byte) error {
+		err := onKeyValue(key, value)
+		if err == store.BreakScan {
+			return store.BreakScan
+		}
+
+		if err != nil {
+			return fmt.Errorf("on table key %q failed: %w", Key(key), err)
+		}
+
+		return nil
+	})
+
+	if err != nil && err != store.BreakScan {
+		return fmt.Errorf("unable to scan table %q keys [%q, %q[: %w", table, Key(keyStart), Key(keyEnd), err)
+	}
+
+	return nil
+}
+
+func (s *KVStore) DeleteTableKeys(ctx context.Context, table store.Table, keys [][]byte) error {
+	prefix, err := tablePrefix(table)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) <= 0 {
+		return nil
+	}
+
+	if err := s.db.BatchDelete(ctx, packKeys(prefix, keys)); err != nil {
+		return fmt.Errorf("unable to delete %d keys from table %q: %w", len(keys), table, err)
+	}
+
+	return nil
+}
+
 func (s *KVStore) fetchKey(ctx context.Context, table byte, key []byte) (out []byte, err error) {
 	kvKey := packKey(table, key)
 
@@ -199,12 +318,30 @@ func (s *KVStore) fetchKey(ctx context.Context, table byte, key []byte) (out []b
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("unable to fetch table %q key %q: %w", TblPrefixName[table], Key(key), err)
+		return nil, fmt.Errorf("unable to fetch table %q key %q: %w", tableName(table), Key(key), err)
+	}
+
+	if out, err = s.resolveValue(ctx, kvKey, out); err != nil {
+		return nil, err
 	}
 
+	store.ReadStatsFromContext(ctx).RecordKey(len(key) + len(out))
 	return out, nil
 }
 
+// resolveValue returns the value at the packed key as it was written, reassembling it when it was
+// chunked and fetching it when it was written in the overflow storage.
+func (s *KVStore) resolveValue(ctx context.Context, packedKey []byte, value []byte) ([]byte, error) {
+	switch {
+	case isChunkHeader(value):
+		return s.fetchChunks(ctx, packedKey, value)
+	case isOverflowReference(value):
+		return s.fetchOverflow(ctx, value)
+	}
+
+	return value, nil
+}
+
 func (s *KVStore) fetchKeys(batchCtx context.Context, table byte, keys [][]byte, onKeyValue store.OnKeyValue) error {
 	batchCtx, cancelBatch := context.WithCancel(batchCtx)
 	defer cancelBatch()
@@ -214,6 +351,7 @@ func (s *KVStore) fetchKeys(batchCtx context.Context, table byte, keys [][]byte,
 		kvKeys[i] = packKey(table, key)
 	}
 
+	stats := store.ReadStatsFromContext(batchCtx)
 	itr := s.db.BatchGet(batchCtx, kvKeys)
 
 	for itr.Next() {
@@ -223,8 +361,15 @@ func (s *KVStore) fetchKeys(batchCtx context.Context, table byte, keys [][]byte,
 			continue
 		}
 
+		value, err := s.resolveValue(batchCtx, itr.Item().Key, value)
+		if err != nil {
+			return err
+		}
+
 		_, key := unpackKey(itr.Item().Key)
-		err := onKeyValue(key, value)
+		stats.RecordKey(len(key) + len(value))
+
+		err = onKeyValue(key, value)
 		if err == store.BreakScan {
 			return nil
 		}
@@ -234,7 +379,7 @@ func (s *KVStore) fetchKeys(batchCtx context.Context, table byte, keys [][]byte,
 		}
 	}
 	if err := itr.Err(); err != nil {
-		return fmt.Errorf("unable to fetch table %q keys (%d): %w", TblPrefixName[table], len(keys), err)
+		return fmt.Errorf("unable to fetch table %q keys (%d): %w", tableName(table), len(keys), err)
 	}
 
 	return nil
@@ -251,28 +396,41 @@ func (s *KVStore) scanPrefix(ctx context.Context, table byte, prefixKey []byte,
 		readOptions = []kv.ReadOption{kv.KeyOnly()}
 	}
 
+	stats := store.ReadStatsFromContext(ctx)
+	stats.RecordScan()
+
 	itr := s.db.Prefix(itrCtx, kvPrefix, limit, readOptions...)
 	for itr.Next() {
 		item := itr.Item()
+		value := item.Value
+		if !keyOnly {
+			var err error
+			if value, err = s.resolveValue(itrCtx, item.Key, value); err != nil {
+				return err
+			}
+		}
+
 		t, key := unpackKey(item.Key)
-		err := onRow(key, item.Value)
+		stats.RecordKey(len(key) + len(value))
+
+		err := onRow(key, value)
 
 		if err == store.BreakScan {
 			return nil
 		}
 
 		if err != nil {
-			return fmt.Errorf("scan prefix: unable to process for table %q with key %q: %w", TblPrefixName[t], key, err)
+			return fmt.Errorf("scan prefix: unable to process for table %q with key %q: %w", tableName(t), key, err)
 		}
 	}
 	if err := itr.Err(); err != nil {
-		return fmt.Errorf("unable to scan table %q keys with prefix %q: %w", TblPrefixName[table], prefixKey, err)
+		return fmt.Errorf("unable to scan table %q keys with prefix %q: %w", tableName(table), prefixKey, err)
 	}
 
 	return nil
 }
 
-func (s *KVStore) scanRange(ctx context.Context, table byte, keyStart, keyEnd []byte, limit int, onRow func(key []byte, value []byte) error) error {
+func (s *KVStore) scanRange(ctx context.Context, table byte, keyStart, keyEnd []byte, limit int, keyOnly bool, onRow func(key []byte, value []byte) error) error {
 	logging.Logger(ctx, zlog).Debug("scanning range", zap.Stringer("start", Key(keyStart)), zap.Stringer("end", Key(keyEnd)))
 
 	startKey := packKey(table, keyStart)
@@ -288,213 +446,404 @@ func (s *KVStore) scanRange(ctx context.Context, table byte, keyStart, keyEnd []
 	scanCtx, cancelScan := context.WithCancel(ctx)
 	defer cancelScan()
 
-	itr := s.db.Scan(scanCtx, startKey, endKey, limit)
+	var readOptions []kv.ReadOption
+	if keyOnly {
+		readOptions = []kv.ReadOption{kv.KeyOnly()}
+	}
+
+	stats := store.ReadStatsFromContext(ctx)
+	stats.RecordScan()
+
+	itr := s.db.Scan(scanCtx, startKey, endKey, limit, readOptions...)
 
 	for itr.Next() {
 		item := itr.Item()
+		value := item.Value
+		if !keyOnly {
+			var err error
+			if value, err = s.resolveValue(scanCtx, item.Key, value); err != nil {
+				return err
+			}
+		}
+
 		t, key := unpackKey(item.Key)
-		err := onRow(key, item.Value)
+		stats.RecordKey(len(key) + len(value))
+
+		err := onRow(key, value)
 		if err == store.BreakScan {
 			return nil
 		}
 
 		if err != nil {
-			return fmt.Errorf("scan range: unable to process for table %q with key %q: %w", TblPrefixName[t], key, err)
+			return fmt.Errorf("scan range: unable to process for table %q with key %q: %w", tableName(t), key, err)
 		}
 	}
 
 	if err := itr.Err(); err != nil {
-		return fmt.Errorf("unable to scan table %q keys with start key %q and end key %q: %w", TblPrefixName[table], keyStart, keyEnd, err)
+		return fmt.Errorf("unable to scan table %q keys with start key %q and end key %q: %w", tableName(table), keyStart, keyEnd, err)
 	}
 
 	return nil
 }
 
 func (s *KVStore) scanInfiniteRange(ctx context.Context, table byte, keyStart []byte, limit int, onRow func(key []byte, value []byte) error) error {
-	return s.scanRange(ctx, table, keyStart, nil, limit, onRow)
+	return s.scanRange(ctx, table, keyStart, nil, limit, false, onRow)
 }
 
 type batch struct {
 	store              *KVStore
 	deletionCount      int
 	mutationCount      int
-	tableRowsDeletions map[string]bool
+	tableRowsDeletions *keyToValueMap
 	tableMutations     map[byte]*keyToValueMap
 
+	// Values written to the overflow storage on flush, keyed by object name
+	overflows *keyToValueMap
+
+	// Packed keys of the batch are all appended to this pooled buffer, avoiding an allocation
+	// per key, the buffer is recycled once the batch has been flushed
+	keys *keyBuffer
+
+	// The background flush of the previous mutations handed over by `FlushIfFullAsync`, if any
+	inflight *inflightFlush
+
 	zlog *zap.Logger
 }
 
+type inflightFlush struct {
+	done chan struct{}
+	err  error
+}
+
 func newBatch(store *KVStore, logger *zap.Logger) *batch {
 	batchSet := &batch{store: store, zlog: logger}
-	batchSet.Reset()
+	batchSet.reset()
 
 	return batchSet
 }
 
 func (b *batch) Reset() {
+	if err := b.waitInflight(); err != nil {
+		b.zlog.Debug("discarding failed background flush on reset", zap.Error(err))
+	}
+
+	b.reset()
+}
+
+func (b *batch) reset() {
+	if b.keys != nil {
+		releaseKeyBuffer(b.keys)
+	}
+
 	b.deletionCount = 0
 	b.mutationCount = 0
-	b.tableRowsDeletions = map[string]bool{}
+	b.keys = acquireKeyBuffer()
+	b.tableRowsDeletions = newKeyToValueMap()
 	b.tableMutations = map[byte]*keyToValueMap{
-		TblPrefixRows:           {mappings: map[string][]byte{}},
-		TblPrefixLastCheckpoint: {mappings: map[string][]byte{}},
+		TblPrefixRows:           newKeyToValueMap(),
+		TblPrefixLastCheckpoint: newKeyToValueMap(),
+		TblPrefixChunks:         newKeyToValueMap(),
+		TblPrefixKeyDictionary:  newKeyToValueMap(),
 	}
+	for _, table := range customTablePrefixes() {
+		b.tableMutations[table] = newKeyToValueMap()
+	}
+	b.overflows = newKeyToValueMap()
 }
 
-var maxTotalChangeCount = 100
-
-// FIXME: Instead of re-adding our custom logic of 100 max mutation count in there, we should
+// FIXME: Instead of re-adding our custom logic of max mutation count in there, we should
 //        instead rely on `kvdb.Batch` heuristics to determine if full or not. Only thing to consider
-//        when doing this refactoring (i.e. removing a flush on 100 rows written) is to make "100%"
+//        when doing this refactoring (i.e. removing a flush on threshold rows written) is to make "100%"
 //        sure that last checkpoint mutations are always ever written last!
+//
+// The threshold is adapted to the backend latency and error rate, see `flushController`.
 func (b *batch) FlushIfFull(ctx context.Context) (flushed bool, err error) {
-	if b.deletionCount+b.mutationCount <= maxTotalChangeCount {
+	if b.deletionCount+b.mutationCount <= b.store.flushControl.Threshold() {
 		// We are not there yet
 		return false, nil
 	}
 
 	b.zlog.Debug("flushing a full batch set", zap.Int("deletion_count", b.deletionCount), zap.Int("mutation_count", b.mutationCount))
 	if err := b.Flush(ctx); err != nil {
+		if isRejectedKeys(err) {
+			// Flushed nonetheless, without the rejected keys
+			return true, err
+		}
+
 		return false, fmt.Errorf("flushing batch set: %w", err)
 	}
 
 	return true, nil
 }
 
+func (b *batch) FlushIfFullAsync(ctx context.Context) (flushed bool, err error) {
+	if b.deletionCount+b.mutationCount <= b.store.flushControl.Threshold() {
+		// We are not there yet
+		return false, nil
+	}
+
+	// Double-buffering, the previous mutations must be written before handing over the current ones
+	inflightErr := b.waitInflight()
+	if inflightErr != nil && !isRejectedKeys(inflightErr) {
+		return false, fmt.Errorf("background flush: %w", inflightErr)
+	}
+
+	b.zlog.Debug("handing over a full batch set to background flush", zap.Int("deletion_count", b.deletionCount), zap.Int("mutation_count", b.mutationCount))
+	handover := &batch{
+		store:              b.store,
+		deletionCount:      b.deletionCount,
+		mutationCount:      b.mutationCount,
+		tableRowsDeletions: b.tableRowsDeletions,
+		tableMutations:     b.tableMutations,
+		overflows:          b.overflows,
+		keys:               b.keys,
+		zlog:               b.zlog,
+	}
+
+	// The handed over key buffer is now owned by the background flush, which releases it
+	b.keys = nil
+	b.reset()
+
+	inflight := &inflightFlush{done: make(chan struct{})}
+	go func() {
+		defer close(inflight.done)
+
+		inflight.err = handover.flush(ctx)
+		releaseKeyBuffer(handover.keys)
+	}()
+
+	b.inflight = inflight
+	return true, mergeRejectedKeys(inflightErr)
+}
+
+func (b *batch) waitInflight() error {
+	if b.inflight == nil {
+		return nil
+	}
+
+	<-b.inflight.done
+	err := b.inflight.err
+	b.inflight = nil
+
+	return err
+}
+
 func (b *batch) Flush(ctx context.Context) error {
+	// A background flush holds older mutations, it must complete first so the last checkpoint
+	// mutations are always written last
+	inflightErr := b.waitInflight()
+	if inflightErr != nil && !isRejectedKeys(inflightErr) {
+		return fmt.Errorf("background flush: %w", inflightErr)
+	}
+
+	err := b.flush(ctx)
+	if err != nil && !isRejectedKeys(err) {
+		return err
+	}
+
+	// Flushed, possibly without the keys rejected by the backend, see `EnablePartitionedFlushRetry`
+	b.reset()
+
+	return mergeRejectedKeys(inflightErr, err)
+}
+
+func (b *batch) flush(ctx context.Context) error {
 	ctx, span := dtracing.StartSpan(ctx, "flush batch set")
 	defer span.End()
 
+	b.store.flushLock.Lock()
+	defer b.store.flushLock.Unlock()
+
 	b.zlog.Debug("flushing batch set")
-	if err := b.flushDeletions(ctx); err != nil {
+	start := time.Now()
+	report := &store.FlushReport{Tables: map[string]*store.TableFlushReport{}}
+
+	if err := b.flushDeletions(ctx, report); err != nil {
 		return fmt.Errorf("flush deletions: %w", err)
 	}
 
-	if err := b.flushMutations(ctx); err != nil {
-		return fmt.Errorf("flush mutations: %w", err)
+	// The mutations were committed nonetheless when some keys were rejected
+	mutationsErr := b.flushMutations(ctx, report)
+	if mutationsErr != nil && !isRejectedKeys(mutationsErr) {
+		return fmt.Errorf("flush mutations: %w", mutationsErr)
 	}
 
-	b.Reset()
+	report.Duration = time.Since(start)
+	if report.MutationCount+report.DeletionCount > 0 {
+		b.store.reportFlush(report)
+	}
 
-	return nil
+	return mutationsErr
 }
 
-func (b *batch) flushDeletions(ctx context.Context) error {
-	if len(b.tableRowsDeletions) <= 0 {
+func (b *batch) flushDeletions(ctx context.Context, report *store.FlushReport) error {
+	if b.tableRowsDeletions.len() <= 0 {
 		return nil
 	}
 
 	tblName := byte(TblPrefixRows)
 
-	keys := make([][]byte, 0, len(b.tableRowsDeletions))
-	for rowKey, shouldDelete := range b.tableRowsDeletions {
-		if shouldDelete {
-			keys = append(keys, packKey(tblName, []byte(rowKey)))
-		}
+	keys := make([][]byte, 0, b.tableRowsDeletions.len())
+	for _, entry := range b.tableRowsDeletions.entries {
+		keys = append(keys, entry.key)
 	}
 
 	if err := b.store.db.BatchDelete(ctx, keys); err != nil {
 		return fmt.Errorf("batch delete: %w", err)
 	}
 
+	tableReport := reportTable(report, tblName)
+	for _, entry := range b.tableRowsDeletions.entries {
+		tableReport.DeletionCount++
+		tableReport.ByteSize += flushedSize(entry)
+		report.DeletionCount++
+		report.ByteSize += flushedSize(entry)
+	}
+
 	return nil
 }
 
-func (b *batch) flushMutations(ctx context.Context) error {
+func (b *batch) flushMutations(ctx context.Context, report *store.FlushReport) error {
+	// The overflow objects must be written before the rows referencing them
+	if err := b.flushOverflows(ctx); err != nil {
+		return err
+	}
+
 	tableNames := []byte{
+		// The dictionary entries must be written before the rows whose keys reference them
+		TblPrefixKeyDictionary,
 		TblPrefixRows,
+	}
+	tableNames = append(tableNames, customTablePrefixes()...)
+
+	// The table name `last` must always be the last table in this list!
+	tableNames = append(tableNames, TblPrefixLastCheckpoint)
+
+	start := time.Now()
+
+	// The chunks of the values are flushed on their own, before the values referencing them, a
+	// single flush not being atomic on all backends
+	if b.tableMutations[TblPrefixChunks].len() > 0 {
+		if err := b.putTables(ctx, []byte{TblPrefixChunks}, report); err != nil {
+			return err
+		}
+
+		if err := b.store.db.FlushPuts(ctx); err != nil {
+			return b.flushPutsFailed(ctx, append([]byte{TblPrefixChunks}, tableNames...), report, time.Since(start), err)
+		}
+	}
+
+	if err := b.putTables(ctx, tableNames, report); err != nil {
+		return err
+	}
 
-		// The table name `last` must always be the last table in this list!
-		TblPrefixLastCheckpoint,
+	err := b.store.db.FlushPuts(ctx)
+	if err != nil {
+		return b.flushPutsFailed(ctx, tableNames, report, time.Since(start), err)
 	}
 
+	b.store.flushControl.observe(b.mutationCount, time.Since(start), nil)
+	return nil
+}
+
+// putTables adds the mutations of the tables to the pending puts of the backend.
+func (b *batch) putTables(ctx context.Context, tableNames []byte, report *store.FlushReport) error {
 	for _, tblName := range tableNames {
 		muts := b.tableMutations[tblName]
 		if muts.len() <= 0 {
 			continue
 		}
 
-		b.zlog.Debug("applying bulk update", zap.String("table_name", TblPrefixName[tblName]), zap.Int("mutation_count", muts.len()))
+		b.zlog.Debug("applying bulk update", zap.String("table_name", tableName(tblName)), zap.Int("mutation_count", muts.len()))
 		ctx, span := dtracing.StartSpan(ctx, "apply bulk updates", "table", tblName, "mutation_count", muts.len())
 
-		for key, value := range muts.mappings {
-			err := b.store.db.Put(ctx, packKey(tblName, []byte(key)), value)
+		tableReport := reportTable(report, tblName)
+		for _, entry := range muts.entries {
+			err := b.store.db.Put(ctx, entry.key, entry.value)
 			if err != nil {
-				return fmt.Errorf("unable to add table %q key %q to tx: %w", tblName, key, err)
+				_, key := unpackKey(entry.key)
+				return fmt.Errorf("unable to add table %q key %q to tx: %w", tblName, Key(key), err)
 			}
+
+			tableReport.MutationCount++
+			tableReport.ByteSize += flushedSize(entry)
+			report.MutationCount++
+			report.ByteSize += flushedSize(entry)
 		}
 		span.End()
 	}
 
-	err := b.store.db.FlushPuts(ctx)
-	if err != nil {
-		return fmt.Errorf("apply bulk: %w", err)
-	}
-
 	return nil
 }
 
-func (b *batch) setTable(table byte, key []byte, value []byte) {
-	b.tableMutations[table].put(key, value)
-	b.mutationCount++
-}
-
-func (b *batch) PurgeRow(key []byte) {
-	b.tableRowsDeletions[string(key)] = true
-}
+// flushPutsFailed handles the failure of the flush of the tables not flushed yet, retrying it by
+// partitions when enabled.
+func (b *batch) flushPutsFailed(ctx context.Context, tableNames []byte, report *store.FlushReport, latency time.Duration, err error) error {
+	b.store.flushControl.observe(b.mutationCount, latency, err)
+	if b.store.flushRetryMaxRejectedKeys > 0 && ctx.Err() == nil {
+		return b.retryPartitioned(ctx, tableNames, report, err)
+	}
 
-func (b *batch) SetRow(key []byte, value []byte) {
-	b.setTable(TblPrefixRows, key, value)
+	return fmt.Errorf("apply bulk: %w", err)
 }
 
-func (b *batch) SetLastCheckpoint(key []byte, value []byte) {
-	b.setTable(TblPrefixLastCheckpoint, key, value)
+// flushedSize is the size of `entry` in the flush reports, its key being counted packed, as
+// stored, for the mutations and the deletions alike.
+func flushedSize(entry keyValue) int {
+	return len(entry.key) + len(entry.value)
 }
 
-func packKey(table byte, key []byte) []byte {
-	return append([]byte{table}, []byte(key)...)
-}
-
-func packKeys(table byte, keys [][]byte) [][]byte {
-	kvKeys := make([][]byte, len(keys))
-	for i, key := range keys {
-		kvKeys[i] = packKey(table, key)
+func reportTable(report *store.FlushReport, table byte) *store.TableFlushReport {
+	name := tableName(table)
+	if _, found := report.Tables[name]; !found {
+		report.Tables[name] = &store.TableFlushReport{}
 	}
-	return kvKeys
+
+	return report.Tables[name]
 }
 
-func unpackKey(packedKey []byte) (table byte, key []byte) {
-	if len(packedKey) < 1 {
-		return
+func (b *batch) setTable(table byte, key []byte, value []byte) {
+	if b.store.needsOverflow(table, value) {
+		value = b.putOverflow(value)
+	} else if b.store.needsChunking(value) {
+		value = b.putChunked(packKey(table, key), value)
 	}
 
-	return packedKey[0], packedKey[1:]
+	b.put(b.tableMutations[table], table, key, value)
+	b.mutationCount++
 }
 
-type Key = store.Key
-
-type keyToValueMap struct {
-	mappings map[string][]byte
+func (b *batch) PurgeRow(key []byte) {
+	b.put(b.tableRowsDeletions, TblPrefixRows, key, nil)
 }
 
-func (m *keyToValueMap) put(key []byte, value []byte) {
-	m.mappings[string(key)] = value
+func (b *batch) put(mappings *keyToValueMap, table byte, key []byte, value []byte) {
+	packedKey := b.keys.pack(table, key)
+	if !mappings.put(packedKey, value) {
+		// Key already in the batch, the packed key we just added is not referenced
+		b.keys.discard(packedKey)
+	}
 }
 
-func (m *keyToValueMap) get(key []byte) (value []byte, found bool) {
-	value, found = m.mappings[string(key)]
-	return
+func (b *batch) SetRow(key []byte, value []byte) {
+	b.setTable(TblPrefixRows, key, value)
 }
 
-func (m *keyToValueMap) has(key []byte) bool {
-	_, found := m.mappings[string(key)]
-	return found
-}
+func (b *batch) SetTableRow(table store.Table, key []byte, value []byte) {
+	if !table.IsCustom() && table != store.KeyDictionaryTable {
+		panic(fmt.Errorf("table %s is not a custom table, register it first with store.RegisterTable", table))
+	}
 
-func (m *keyToValueMap) delete(key []byte) {
-	delete(m.mappings, string(key))
+	prefix, err := tablePrefix(table)
+	if err != nil {
+		panic(err)
+	}
+
+	b.setTable(prefix, key, value)
 }
 
-func (m *keyToValueMap) len() int {
-	return len(m.mappings)
+func (b *batch) SetLastCheckpoint(key []byte, value []byte) {
+	b.setTable(TblPrefixLastCheckpoint, key, value)
 }
+
+type Key = store.Key
@@ -0,0 +1,88 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"fmt"
+
+	"github.com/dfuse-io/fluxdb/store"
+)
+
+// The table prefixes below this one are reserved for the FluxDB tables, the custom tables (see
+// `store.RegisterTable`) being stored under a prefix equal to their identifier
+const firstCustomTablePrefix = 0x10
+
+// tablePrefix returns the prefix of the physical table storing `table`.
+func tablePrefix(table store.Table) (byte, error) {
+	switch {
+	case table == store.RowsTable:
+		return TblPrefixRows, nil
+	case table == store.CheckpointsTable:
+		return TblPrefixLastCheckpoint, nil
+	case table == store.KeyDictionaryTable:
+		return TblPrefixKeyDictionary, nil
+	case table.IsCustom():
+		return byte(table), nil
+	}
+
+	return 0, fmt.Errorf("unknown table %s", table)
+}
+
+// UnpackKey splits a raw key as stored in the underlying KV store, prefixed by its physical
+// table prefix, into its table and its key within the table.
+func UnpackKey(rawKey []byte) (table store.Table, key []byte, err error) {
+	if len(rawKey) < 1 {
+		return 0, nil, fmt.Errorf("invalid empty key")
+	}
+
+	prefix, key := unpackKey(rawKey)
+	switch {
+	case prefix == TblPrefixRows:
+		return store.RowsTable, key, nil
+	case prefix == TblPrefixLastCheckpoint:
+		return store.CheckpointsTable, key, nil
+	case prefix == TblPrefixKeyDictionary:
+		return store.KeyDictionaryTable, key, nil
+	case isCustomTable(prefix):
+		return store.Table(prefix), key, nil
+	}
+
+	return 0, nil, fmt.Errorf("unknown table prefix 0x%02X", prefix)
+}
+
+// tableName returns the name of the physical table, the custom tables being named after their
+// registration.
+func tableName(prefix byte) string {
+	if name, found := TblPrefixName[prefix]; found {
+		return name
+	}
+
+	return store.Table(prefix).String()
+}
+
+// customTablePrefixes returns the prefixes of the custom tables, in order.
+func customTablePrefixes() []byte {
+	tables := store.CustomTables()
+	prefixes := make([]byte, len(tables))
+	for i, table := range tables {
+		prefixes[i] = byte(table)
+	}
+
+	return prefixes
+}
+
+func isCustomTable(prefix byte) bool {
+	return prefix >= firstCustomTablePrefix && store.Table(prefix).IsCustom()
+}
@@ -0,0 +1,106 @@
+package kv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCustomTable store.Table = 0xF0
+
+func init() {
+	store.RegisterTable(testCustomTable, "test-meta")
+}
+
+func TestRegisterTable(t *testing.T) {
+	assert.Equal(t, []store.Table{testCustomTable}, store.CustomTables())
+	assert.Equal(t, "test-meta", testCustomTable.String())
+	assert.Equal(t, "test-meta", tableName(byte(testCustomTable)))
+	assert.True(t, testCustomTable.IsCustom())
+	assert.False(t, store.RowsTable.IsCustom())
+
+	table, found := store.LookupTable("test-meta")
+	assert.True(t, found)
+	assert.Equal(t, testCustomTable, table)
+
+	assert.Panics(t, func() { store.RegisterTable(store.RowsTable, "other") }, "reserved table")
+	assert.Panics(t, func() { store.RegisterTable(0xFF, "other") }, "reserved table")
+	assert.Panics(t, func() { store.RegisterTable(testCustomTable, "other") }, "duplicated table")
+	assert.Panics(t, func() { store.RegisterTable(0xF1, "test-meta") }, "duplicated name")
+	assert.Panics(t, func() { store.RegisterTable(0xF1, "rows") }, "duplicated name")
+}
+
+func TestUnpackKey(t *testing.T) {
+	table, key, err := UnpackKey([]byte{TblPrefixRows, 'a'})
+	require.NoError(t, err)
+	assert.Equal(t, store.RowsTable, table)
+	assert.Equal(t, []byte("a"), key)
+
+	table, key, err = UnpackKey([]byte{byte(testCustomTable), 'b'})
+	require.NoError(t, err)
+	assert.Equal(t, testCustomTable, table)
+	assert.Equal(t, []byte("b"), key)
+
+	_, _, err = UnpackKey([]byte{TblPrefixChunks, 'c'})
+	assert.Error(t, err, "internal table")
+
+	_, _, err = UnpackKey(nil)
+	assert.Error(t, err)
+}
+
+func TestKVStore_CustomTable(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+
+	var report store.FlushReport
+	kvStore.OnFlush(func(flushed store.FlushReport) { report = flushed })
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	batch.SetTableRow(testCustomTable, []byte("a"), []byte("1"))
+	batch.SetTableRow(testCustomTable, []byte("b"), []byte("2"))
+	batch.SetRow([]byte("a"), []byte("row"))
+	require.NoError(t, batch.Flush(ctx))
+
+	assert.Panics(t, func() { batch.SetTableRow(store.RowsTable, []byte("a"), nil) }, "not a custom table")
+	assert.Equal(t, 2, report.Tables["test-meta"].MutationCount)
+
+	values := map[string]string{}
+	require.NoError(t, kvStore.ScanTable(ctx, testCustomTable, nil, nil, func(key []byte, value []byte) error {
+		values[string(key)] = string(value)
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, values)
+
+	require.NoError(t, kvStore.DeleteTableKeys(ctx, testCustomTable, [][]byte{[]byte("a")}))
+
+	var keys []string
+	require.NoError(t, kvStore.ScanTableKeys(ctx, testCustomTable, nil, nil, func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	assert.Equal(t, []string{"b"}, keys)
+}
+
+func TestKVStore_FlushReportByteSize(t *testing.T) {
+	kvStore, closer := newTestStore(t)
+	defer closer()
+
+	var report store.FlushReport
+	kvStore.OnFlush(func(flushed store.FlushReport) { report = flushed })
+
+	ctx := context.Background()
+	batch := kvStore.NewBatch(zlog)
+	batch.SetRow([]byte("abc"), []byte("12"))
+	batch.PurgeRow([]byte("def"))
+	require.NoError(t, batch.Flush(ctx))
+
+	// The keys of the mutations and of the deletions are both counted with their table prefix
+	assert.Equal(t, 1, report.Tables["rows"].MutationCount)
+	assert.Equal(t, 1, report.Tables["rows"].DeletionCount)
+	assert.Equal(t, (1+3+2)+(1+3), report.Tables["rows"].ByteSize)
+	assert.Equal(t, report.Tables["rows"].ByteSize, report.ByteSize)
+}
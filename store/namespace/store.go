@@ -0,0 +1,201 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package namespace implements a `store.KVStore` confined to a namespace of an underlying store,
+// so the data of several chains, each one written by its own pipeline, can share a single store
+// without ever seeing each other's keys, checkpoints included.
+package namespace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// KVStore prefixes all the keys it writes and reads with its namespace, `<name>/`, and strips it
+// from the keys it returns, the keys of each namespace keeping their relative order.
+//
+// **Important** A store must either be used through namespaces only or not at all, the keys
+// written outside of any namespace could otherwise collide with the namespaced ones.
+type KVStore struct {
+	inner  store.KVStore
+	prefix []byte
+	end    []byte
+}
+
+// NewStore returns the namespace `name` of `inner`, the name must be non-empty and must not
+// contain a `/`.
+func NewStore(inner store.KVStore, name string) (*KVStore, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid namespace %q, must be non-empty and must not contain a /", name)
+	}
+
+	prefix := []byte(name + "/")
+	end := append([]byte(name), '/'+1)
+
+	return &KVStore{inner: inner, prefix: prefix, end: end}, nil
+}
+
+// Name returns the name of the namespace.
+func (s *KVStore) Name() string {
+	return string(s.prefix[:len(s.prefix)-1])
+}
+
+// Close does nothing, the underlying store is shared by its namespaces and is closed by its
+// owner.
+func (s *KVStore) Close() error {
+	return nil
+}
+
+func (s *KVStore) NewBatch(logger *zap.Logger) store.Batch {
+	return &batch{Batch: s.inner.NewBatch(logger), store: s}
+}
+
+// OnFlush registers the listener on the underlying store, it's called for the flushes of all of
+// its namespaces.
+func (s *KVStore) OnFlush(listener store.OnFlush) {
+	store.NotifyFlushes(s.inner, listener)
+}
+
+func (s *KVStore) HasTabletRow(ctx context.Context, keyStart, keyEnd []byte) (exists bool, err error) {
+	return s.inner.HasTabletRow(ctx, s.key(keyStart), s.keyEnd(keyEnd))
+}
+
+func (s *KVStore) FetchTabletRow(ctx context.Context, key []byte) (value []byte, err error) {
+	return s.inner.FetchTabletRow(ctx, s.key(key))
+}
+
+func (s *KVStore) FetchTabletRows(ctx context.Context, keys [][]byte, onKeyValue store.OnKeyValue) error {
+	return s.inner.FetchTabletRows(ctx, s.keys(keys), s.onKeyValue(onKeyValue))
+}
+
+func (s *KVStore) FetchSingletEntry(ctx context.Context, keyStart, keyEnd []byte) (key []byte, value []byte, err error) {
+	key, value, err = s.inner.FetchSingletEntry(ctx, s.key(keyStart), s.keyEnd(keyEnd))
+	if err != nil || key == nil {
+		return key, value, err
+	}
+
+	return s.strip(key), value, nil
+}
+
+// ScanTabletRows scans the namespaced range, the resume key of a scan exceeding its budget (see
+// `store.ErrScanBudgetExceeded`) is stripped of the namespace too.
+func (s *KVStore) ScanTabletRows(ctx context.Context, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	err := s.inner.ScanTabletRows(ctx, s.key(keyStart), s.keyEnd(keyEnd), s.onKeyValue(onKeyValue))
+
+	var exceeded *store.ErrScanBudgetExceeded
+	if errors.As(err, &exceeded) && bytes.HasPrefix(exceeded.ResumeKey, s.prefix) {
+		exceeded.ResumeKey = s.strip(exceeded.ResumeKey)
+	}
+
+	return err
+}
+
+func (s *KVStore) ScanIndexKeys(ctx context.Context, prefix []byte, onKey store.OnKey) error {
+	return s.inner.ScanIndexKeys(ctx, s.key(prefix), s.onKey(onKey))
+}
+
+func (s *KVStore) FetchLastWrittenCheckpoint(ctx context.Context, key []byte) (value []byte, err error) {
+	return s.inner.FetchLastWrittenCheckpoint(ctx, s.key(key))
+}
+
+func (s *KVStore) ScanLastShardsWrittenCheckpoint(ctx context.Context, keyPrefix []byte, onKeyValue store.OnKeyValue) error {
+	return s.inner.ScanLastShardsWrittenCheckpoint(ctx, s.key(keyPrefix), s.onKeyValue(onKeyValue))
+}
+
+func (s *KVStore) DeleteShardsCheckpoint(ctx context.Context, keyPrefix []byte) error {
+	return s.inner.DeleteShardsCheckpoint(ctx, s.key(keyPrefix))
+}
+
+func (s *KVStore) ScanTableKeys(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKey store.OnKey) error {
+	return s.inner.ScanTableKeys(ctx, table, s.key(keyStart), s.keyEnd(keyEnd), s.onKey(onKey))
+}
+
+func (s *KVStore) ScanTable(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	return s.inner.ScanTable(ctx, table, s.key(keyStart), s.keyEnd(keyEnd), s.onKeyValue(onKeyValue))
+}
+
+func (s *KVStore) DeleteTableKeys(ctx context.Context, table store.Table, keys [][]byte) error {
+	return s.inner.DeleteTableKeys(ctx, table, s.keys(keys))
+}
+
+func (s *KVStore) key(key []byte) []byte {
+	out := make([]byte, len(s.prefix)+len(key))
+	copy(out, s.prefix)
+	copy(out[len(s.prefix):], key)
+
+	return out
+}
+
+// keyEnd returns the namespaced exclusive end of a range, an empty end being the end of the
+// namespace.
+func (s *KVStore) keyEnd(key []byte) []byte {
+	if len(key) == 0 {
+		return s.end
+	}
+
+	return s.key(key)
+}
+
+func (s *KVStore) keys(keys [][]byte) [][]byte {
+	out := make([][]byte, len(keys))
+	for i, key := range keys {
+		out[i] = s.key(key)
+	}
+
+	return out
+}
+
+func (s *KVStore) strip(key []byte) []byte {
+	return key[len(s.prefix):]
+}
+
+func (s *KVStore) onKey(onKey store.OnKey) store.OnKey {
+	return func(key []byte) error {
+		return onKey(s.strip(key))
+	}
+}
+
+func (s *KVStore) onKeyValue(onKeyValue store.OnKeyValue) store.OnKeyValue {
+	return func(key []byte, value []byte) error {
+		return onKeyValue(s.strip(key), value)
+	}
+}
+
+// batch namespaces the keys of the mutations, the flushes are the ones of the underlying batch.
+type batch struct {
+	store.Batch
+	store *KVStore
+}
+
+func (b *batch) PurgeRow(key []byte) {
+	b.Batch.PurgeRow(b.store.key(key))
+}
+
+func (b *batch) SetRow(key []byte, value []byte) {
+	b.Batch.SetRow(b.store.key(key), value)
+}
+
+func (b *batch) SetLastCheckpoint(key []byte, value []byte) {
+	b.Batch.SetLastCheckpoint(b.store.key(key), value)
+}
+
+func (b *batch) SetTableRow(table store.Table, key []byte, value []byte) {
+	b.Batch.SetTableRow(table, b.store.key(key), value)
+}
@@ -0,0 +1,82 @@
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestKVStore_Isolation(t *testing.T) {
+	inner, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	eth, err := NewStore(inner, "eth")
+	require.NoError(t, err)
+	bsc, err := NewStore(inner, "bsc")
+	require.NoError(t, err)
+
+	for i, namespaced := range []*KVStore{eth, bsc} {
+		batch := namespaced.NewBatch(zap.NewNop())
+		batch.SetRow([]byte("a"), []byte(fmt.Sprintf("%s-1", namespaced.Name())))
+		batch.SetRow([]byte("b"), []byte(fmt.Sprintf("%s-2", namespaced.Name())))
+		if i == 0 {
+			batch.SetRow([]byte("c"), []byte("eth-only"))
+		}
+		batch.SetLastCheckpoint([]byte("checkpoint"), []byte(namespaced.Name()))
+		require.NoError(t, batch.Flush(ctx))
+	}
+
+	value, err := eth.FetchTabletRow(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("eth-1"), value)
+
+	value, err = bsc.FetchLastWrittenCheckpoint(ctx, []byte("checkpoint"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bsc"), value)
+
+	_, err = bsc.FetchTabletRow(ctx, []byte("c"))
+	assert.Equal(t, store.ErrNotFound, err)
+
+	var keys []string
+	require.NoError(t, bsc.ScanTabletRows(ctx, []byte("a"), []byte("z"), func(key []byte, value []byte) error {
+		keys = append(keys, string(key)+"="+string(value))
+		return nil
+	}))
+	assert.Equal(t, []string{"a=bsc-1", "b=bsc-2"}, keys)
+
+	// An empty end scans until the end of the namespace, not of the table
+	keys = nil
+	require.NoError(t, eth.ScanTableKeys(ctx, store.RowsTable, nil, nil, func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+
+	key, value, err := eth.FetchSingletEntry(ctx, []byte("b"), []byte("z"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b"), key)
+	assert.Equal(t, []byte("eth-2"), value)
+
+	require.NoError(t, eth.DeleteTableKeys(ctx, store.RowsTable, [][]byte{[]byte("a")}))
+	_, err = eth.FetchTabletRow(ctx, []byte("a"))
+	assert.Equal(t, store.ErrNotFound, err)
+
+	value, err = bsc.FetchTabletRow(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bsc-1"), value)
+}
+
+func TestNewStore_InvalidName(t *testing.T) {
+	_, err := NewStore(nil, "")
+	assert.Error(t, err)
+
+	_, err = NewStore(nil, "eth/mainnet")
+	assert.EqualError(t, err, `invalid namespace "eth/mainnet", must be non-empty and must not contain a /`)
+}
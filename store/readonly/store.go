@@ -0,0 +1,90 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package readonly implements a `store.KVStore` decorator rejecting all writes, for serve-only
+// replicas pointed at a store owned by another writer, so no configuration mistake (e.g. an
+// inject mode or a startup repair enabled by accident) can ever write to it.
+package readonly
+
+import (
+	"context"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// KVStore serves all reads from the underlying store and rejects all writes with a
+// `*store.ErrReadOnly` error. The mutations can still be added to its batches, their flush is
+// rejected, so a write fails as a whole before anything reaches the underlying store.
+type KVStore struct {
+	store.KVStore
+}
+
+func NewStore(inner store.KVStore) *KVStore {
+	return &KVStore{KVStore: inner}
+}
+
+func (s *KVStore) NewBatch(logger *zap.Logger) store.Batch {
+	return &batch{}
+}
+
+func (s *KVStore) DeleteShardsCheckpoint(ctx context.Context, keyPrefix []byte) error {
+	return &store.ErrReadOnly{Operation: "delete shards checkpoint"}
+}
+
+func (s *KVStore) DeleteTableKeys(ctx context.Context, table store.Table, keys [][]byte) error {
+	return &store.ErrReadOnly{Operation: "delete table keys"}
+}
+
+// batch discards its mutations, a flush is rejected as soon as it holds any, flushing an empty
+// batch writes nothing.
+type batch struct {
+	mutated bool
+}
+
+func (b *batch) Flush(ctx context.Context) error {
+	if !b.mutated {
+		return nil
+	}
+
+	return &store.ErrReadOnly{Operation: "batch flush"}
+}
+
+func (b *batch) FlushIfFull(ctx context.Context) (flushed bool, err error) {
+	return false, b.Flush(ctx)
+}
+
+func (b *batch) FlushIfFullAsync(ctx context.Context) (flushed bool, err error) {
+	return false, b.Flush(ctx)
+}
+
+func (b *batch) PurgeRow(key []byte) {
+	b.mutated = true
+}
+
+func (b *batch) SetRow(key []byte, value []byte) {
+	b.mutated = true
+}
+
+func (b *batch) SetLastCheckpoint(key []byte, value []byte) {
+	b.mutated = true
+}
+
+func (b *batch) SetTableRow(table store.Table, key []byte, value []byte) {
+	b.mutated = true
+}
+
+func (b *batch) Reset() {
+	b.mutated = false
+}
@@ -0,0 +1,56 @@
+package readonly
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestKVStore_ReadOnly(t *testing.T) {
+	inner, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	ctx := context.Background()
+	batch := inner.NewBatch(zap.NewNop())
+	batch.SetRow([]byte("a"), []byte("v"))
+	require.NoError(t, batch.Flush(ctx))
+
+	readOnly := NewStore(inner)
+
+	value, err := readOnly.FetchTabletRow(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), value)
+
+	batch = readOnly.NewBatch(zap.NewNop())
+	require.NoError(t, batch.Flush(ctx), "nothing to write")
+
+	batch.SetRow([]byte("b"), []byte("v"))
+	_, err = batch.FlushIfFull(ctx)
+	assertReadOnly(t, err)
+	assertReadOnly(t, batch.Flush(ctx))
+
+	batch.Reset()
+	require.NoError(t, batch.Flush(ctx))
+
+	assertReadOnly(t, readOnly.DeleteTableKeys(ctx, store.RowsTable, [][]byte{[]byte("a")}))
+	assertReadOnly(t, readOnly.DeleteShardsCheckpoint(ctx, []byte("shard-")))
+
+	_, err = inner.FetchTabletRow(ctx, []byte("b"))
+	assert.Equal(t, store.ErrNotFound, err)
+
+	_, err = inner.FetchTabletRow(ctx, []byte("a"))
+	assert.NoError(t, err)
+}
+
+func assertReadOnly(t *testing.T, err error) {
+	t.Helper()
+
+	var readOnly *store.ErrReadOnly
+	assert.True(t, errors.As(err, &readOnly), "expected a read-only error, got %v", err)
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// ReadStats collects the cost of the reads performed with a context it's attached to, see
+// `WithReadStats`, so a serving layer can log or bill each request once its reads completed.
+// The recording methods are safe for concurrent use, reads fetching chunks concurrently, and do
+// nothing on a `nil` collector.
+type ReadStats struct {
+	lock sync.Mutex
+
+	keyCount           int
+	byteCount          int
+	scanCount          int
+	cacheHitCount      int
+	indexSnapshotCount int
+	indexHeight        uint64
+}
+
+type readStatsKey struct{}
+
+// WithReadStats returns a context recording the reads performed with it in `stats`.
+func WithReadStats(ctx context.Context, stats *ReadStats) context.Context {
+	return context.WithValue(ctx, readStatsKey{}, stats)
+}
+
+// ReadStatsFromContext returns the collector attached to the context by `WithReadStats`, `nil`
+// when there is none.
+func ReadStatsFromContext(ctx context.Context) *ReadStats {
+	stats, _ := ctx.Value(readStatsKey{}).(*ReadStats)
+	return stats
+}
+
+// RecordKey records a key fetched from the store along with its value, `byteCount` being the
+// size of both.
+func (s *ReadStats) RecordKey(byteCount int) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keyCount++
+	s.byteCount += byteCount
+}
+
+// RecordScan records a range or prefix scan of the store, whatever the amount of keys it
+// fetched.
+func (s *ReadStats) RecordScan() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.scanCount++
+}
+
+// RecordCacheHit records a value served from memory instead of being fetched.
+func (s *ReadStats) RecordCacheHit() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cacheHitCount++
+}
+
+// RecordIndexSnapshot records a read starting from the tablet index snapshot taken at `height`.
+func (s *ReadStats) RecordIndexSnapshot(height uint64) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.indexSnapshotCount++
+	s.indexHeight = height
+}
+
+// KeyCount returns the amount of keys fetched from the store, by scans or not.
+func (s *ReadStats) KeyCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.keyCount
+}
+
+// ByteCount returns the amount of key and value bytes fetched from the store.
+func (s *ReadStats) ByteCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.byteCount
+}
+
+// ScanCount returns the amount of range and prefix scans performed on the store.
+func (s *ReadStats) ScanCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.scanCount
+}
+
+// CacheHitCount returns the amount of values served from memory instead of being fetched.
+func (s *ReadStats) CacheHitCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.cacheHitCount
+}
+
+// IndexSnapshot returns the height of the last tablet index snapshot the reads started from,
+// `found` being false when none of them used one.
+func (s *ReadStats) IndexSnapshot() (height uint64, found bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.indexHeight, s.indexSnapshotCount > 0
+}
+
+// IndexSnapshotCount returns the amount of reads that started from a tablet index snapshot.
+func (s *ReadStats) IndexSnapshotCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.indexSnapshotCount
+}
+
+// MarshalLogObject logs the collected statistics, e.g. `zap.Object("read_stats", stats)`.
+func (s *ReadStats) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	encoder.AddInt("key_count", s.keyCount)
+	encoder.AddInt("byte_count", s.byteCount)
+	encoder.AddInt("scan_count", s.scanCount)
+	encoder.AddInt("cache_hit_count", s.cacheHitCount)
+	encoder.AddInt("index_snapshot_count", s.indexSnapshotCount)
+	if s.indexSnapshotCount > 0 {
+		encoder.AddUint64("index_height", s.indexHeight)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+)
+
+// ErrRejectedKeys is the error returned by a batch flush whose mutations were all written but
+// the keys rejected by the backend (e.g. key too large, quota exceeded), isolated by retrying the
+// flush by partitions. Unlike other flush errors, the batch was then committed and must not be
+// retried, the rejected keys are missing from the store.
+type ErrRejectedKeys struct {
+	Keys []RejectedKey
+}
+
+// RejectedKey is a key the backend refused to write, along with the error it returned.
+type RejectedKey struct {
+	// Table is the name of the storage table of the key
+	Table string
+	Key   Key
+	Err   error
+}
+
+func (e *ErrRejectedKeys) Error() string {
+	if len(e.Keys) == 0 {
+		return "no key rejected by the backend"
+	}
+
+	first := e.Keys[0]
+	return fmt.Sprintf("%d key(s) rejected by the backend, first one is table %q key %s: %s", len(e.Keys), first.Table, first.Key, first.Err)
+}
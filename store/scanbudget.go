@@ -0,0 +1,65 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ScanBudget bounds the resources a single scan of tablet rows may use, so a runaway scan
+// aborts instead of holding the backend iterator open for minutes.
+type ScanBudget struct {
+	// MaxBytes is the amount of key and value bytes the scan may stream, 0 meaning unbounded
+	MaxBytes int
+
+	// MaxDuration is the time the scan may take, 0 meaning unbounded
+	MaxDuration time.Duration
+}
+
+func (b ScanBudget) IsZero() bool {
+	return b.MaxBytes <= 0 && b.MaxDuration <= 0
+}
+
+// ErrScanBudgetExceeded is the error returned by a scan aborted because it exceeded its budget,
+// see `ScanBudget`. The rows received before the error are a partial result, the scan must be
+// resumed from `ResumeKey` to get the rest of them.
+type ErrScanBudgetExceeded struct {
+	// ResumeKey is the key (inclusive) the scan must be resumed from, it's the key of the first
+	// row not received
+	ResumeKey Key
+
+	ScannedBytes int
+	Elapsed      time.Duration
+}
+
+func (e *ErrScanBudgetExceeded) Error() string {
+	return fmt.Sprintf("scan budget exceeded after %d bytes in %s, resume from key %s", e.ScannedBytes, e.Elapsed, e.ResumeKey)
+}
+
+type scanBudgetKey struct{}
+
+// WithScanBudget returns a context bounding the scans done with it to `budget`, overriding the
+// default budget of the store, if any. A zero budget makes the scans unbounded.
+func WithScanBudget(ctx context.Context, budget ScanBudget) context.Context {
+	return context.WithValue(ctx, scanBudgetKey{}, budget)
+}
+
+// ScanBudgetFromContext returns the scan budget set on the context by `WithScanBudget`, if any.
+func ScanBudgetFromContext(ctx context.Context) (budget ScanBudget, found bool) {
+	budget, found = ctx.Value(scanBudgetKey{}).(ScanBudget)
+	return
+}
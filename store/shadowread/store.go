@@ -0,0 +1,372 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shadowread implements a `store.KVStore` decorator mirroring a sample of the reads
+// served by a primary store against a secondary store and reporting any divergence, used to
+// validate a migrated or repaired store before switching traffic to it.
+package shadowread
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+const defaultSampleRate = 0.01
+const maxInflightShadowReads = 16
+const shadowReadTimeout = 10 * time.Second
+
+// KVStore serves all reads and writes from the primary store. A sample of the successful reads
+// is replayed against the secondary store in the background, their results compared to the
+// primary ones, divergences are logged and counted (see the `shadow_read_divergence_count`
+// metric). Shadow reads never slow down the primary reads, they are skipped when too many
+// are already in flight.
+type KVStore struct {
+	primary   store.KVStore
+	secondary store.KVStore
+
+	sampleRate float64
+	inflight   chan struct{}
+	wg         sync.WaitGroup
+}
+
+func NewStore(primary, secondary store.KVStore) *KVStore {
+	return &KVStore{
+		primary:    primary,
+		secondary:  secondary,
+		sampleRate: defaultSampleRate,
+		inflight:   make(chan struct{}, maxInflightShadowReads),
+	}
+}
+
+// SetSampleRate configures the ratio, between 0 and 1, of the reads mirrored against the
+// secondary store, defaults to 0.01.
+func (s *KVStore) SetSampleRate(rate float64) {
+	s.sampleRate = rate
+}
+
+// Close waits for the shadow reads in flight, then closes both stores.
+func (s *KVStore) Close() error {
+	s.wg.Wait()
+
+	if err := s.secondary.Close(); err != nil {
+		zlog.Warn("unable to close secondary store", zap.Error(err))
+	}
+
+	return s.primary.Close()
+}
+
+func (s *KVStore) NewBatch(logger *zap.Logger) store.Batch {
+	return s.primary.NewBatch(logger)
+}
+
+func (s *KVStore) OnFlush(listener store.OnFlush) {
+	store.NotifyFlushes(s.primary, listener)
+}
+
+func (s *KVStore) DeleteShardsCheckpoint(ctx context.Context, keyPrefix []byte) error {
+	return s.primary.DeleteShardsCheckpoint(ctx, keyPrefix)
+}
+
+func (s *KVStore) DeleteTableKeys(ctx context.Context, table store.Table, keys [][]byte) error {
+	return s.primary.DeleteTableKeys(ctx, table, keys)
+}
+
+func (s *KVStore) HasTabletRow(ctx context.Context, keyStart, keyEnd []byte) (exists bool, err error) {
+	exists, err = s.primary.HasTabletRow(ctx, keyStart, keyEnd)
+	if err == nil && s.sampled() {
+		s.shadow("has_tablet_row", exists, func(ctx context.Context) (interface{}, error) {
+			return s.secondary.HasTabletRow(ctx, keyStart, keyEnd)
+		})
+	}
+
+	return
+}
+
+func (s *KVStore) FetchTabletRow(ctx context.Context, key []byte) (value []byte, err error) {
+	value, err = s.primary.FetchTabletRow(ctx, key)
+	if (err == nil || err == store.ErrNotFound) && s.sampled() {
+		s.shadow("fetch_tablet_row", newFetchResult(value, err), func(ctx context.Context) (interface{}, error) {
+			value, err := s.secondary.FetchTabletRow(ctx, key)
+			return newFetchResult(value, err), ignoreNotFound(err)
+		})
+	}
+
+	return
+}
+
+func (s *KVStore) FetchTabletRows(ctx context.Context, keys [][]byte, onKeyValue store.OnKeyValue) error {
+	if !s.sampled() {
+		return s.primary.FetchTabletRows(ctx, keys, onKeyValue)
+	}
+
+	collector := &collector{}
+	if err := s.primary.FetchTabletRows(ctx, keys, collector.wrap(onKeyValue)); err != nil {
+		return err
+	}
+
+	s.shadow("fetch_tablet_rows", collector.pairs, func(ctx context.Context) (interface{}, error) {
+		secondary := collector.secondary()
+		err := s.secondary.FetchTabletRows(ctx, keys, secondary.collect)
+		return secondary.pairs, err
+	})
+
+	return nil
+}
+
+func (s *KVStore) FetchSingletEntry(ctx context.Context, keyStart, keyEnd []byte) (key []byte, value []byte, err error) {
+	key, value, err = s.primary.FetchSingletEntry(ctx, keyStart, keyEnd)
+	if err == nil && s.sampled() {
+		s.shadow("fetch_singlet_entry", keyValue{key, value}, func(ctx context.Context) (interface{}, error) {
+			key, value, err := s.secondary.FetchSingletEntry(ctx, keyStart, keyEnd)
+			return keyValue{key, value}, err
+		})
+	}
+
+	return
+}
+
+func (s *KVStore) ScanTabletRows(ctx context.Context, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	if !s.sampled() {
+		return s.primary.ScanTabletRows(ctx, keyStart, keyEnd, onKeyValue)
+	}
+
+	collector := &collector{}
+	if err := s.primary.ScanTabletRows(ctx, keyStart, keyEnd, collector.wrap(onKeyValue)); err != nil {
+		return err
+	}
+
+	s.shadow("scan_tablet_rows", collector.pairs, func(ctx context.Context) (interface{}, error) {
+		secondary := collector.secondary()
+		err := s.secondary.ScanTabletRows(ctx, keyStart, keyEnd, secondary.collect)
+		return secondary.pairs, err
+	})
+
+	return nil
+}
+
+func (s *KVStore) ScanIndexKeys(ctx context.Context, prefix []byte, onKey store.OnKey) error {
+	if !s.sampled() {
+		return s.primary.ScanIndexKeys(ctx, prefix, onKey)
+	}
+
+	collector := &collector{}
+	if err := s.primary.ScanIndexKeys(ctx, prefix, collector.wrapKey(onKey)); err != nil {
+		return err
+	}
+
+	s.shadow("scan_index_keys", collector.pairs, func(ctx context.Context) (interface{}, error) {
+		secondary := collector.secondary()
+		err := s.secondary.ScanIndexKeys(ctx, prefix, secondary.collectKey)
+		return secondary.pairs, err
+	})
+
+	return nil
+}
+
+func (s *KVStore) FetchLastWrittenCheckpoint(ctx context.Context, key []byte) (value []byte, err error) {
+	value, err = s.primary.FetchLastWrittenCheckpoint(ctx, key)
+	if (err == nil || err == store.ErrNotFound) && s.sampled() {
+		s.shadow("fetch_last_written_checkpoint", newFetchResult(value, err), func(ctx context.Context) (interface{}, error) {
+			value, err := s.secondary.FetchLastWrittenCheckpoint(ctx, key)
+			return newFetchResult(value, err), ignoreNotFound(err)
+		})
+	}
+
+	return
+}
+
+func (s *KVStore) ScanLastShardsWrittenCheckpoint(ctx context.Context, keyPrefix []byte, onKeyValue store.OnKeyValue) error {
+	if !s.sampled() {
+		return s.primary.ScanLastShardsWrittenCheckpoint(ctx, keyPrefix, onKeyValue)
+	}
+
+	collector := &collector{}
+	if err := s.primary.ScanLastShardsWrittenCheckpoint(ctx, keyPrefix, collector.wrap(onKeyValue)); err != nil {
+		return err
+	}
+
+	s.shadow("scan_last_shards_written_checkpoint", collector.pairs, func(ctx context.Context) (interface{}, error) {
+		secondary := collector.secondary()
+		err := s.secondary.ScanLastShardsWrittenCheckpoint(ctx, keyPrefix, secondary.collect)
+		return secondary.pairs, err
+	})
+
+	return nil
+}
+
+func (s *KVStore) ScanTableKeys(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKey store.OnKey) error {
+	if !s.sampled() {
+		return s.primary.ScanTableKeys(ctx, table, keyStart, keyEnd, onKey)
+	}
+
+	collector := &collector{}
+	if err := s.primary.ScanTableKeys(ctx, table, keyStart, keyEnd, collector.wrapKey(onKey)); err != nil {
+		return err
+	}
+
+	s.shadow("scan_table_keys", collector.pairs, func(ctx context.Context) (interface{}, error) {
+		secondary := collector.secondary()
+		err := s.secondary.ScanTableKeys(ctx, table, keyStart, keyEnd, secondary.collectKey)
+		return secondary.pairs, err
+	})
+
+	return nil
+}
+
+func (s *KVStore) ScanTable(ctx context.Context, table store.Table, keyStart, keyEnd []byte, onKeyValue store.OnKeyValue) error {
+	if !s.sampled() {
+		return s.primary.ScanTable(ctx, table, keyStart, keyEnd, onKeyValue)
+	}
+
+	collector := &collector{}
+	if err := s.primary.ScanTable(ctx, table, keyStart, keyEnd, collector.wrap(onKeyValue)); err != nil {
+		return err
+	}
+
+	s.shadow("scan_table", collector.pairs, func(ctx context.Context) (interface{}, error) {
+		secondary := collector.secondary()
+		err := s.secondary.ScanTable(ctx, table, keyStart, keyEnd, secondary.collect)
+		return secondary.pairs, err
+	})
+
+	return nil
+}
+
+func (s *KVStore) sampled() bool {
+	return s.sampleRate > 0 && rand.Float64() < s.sampleRate
+}
+
+// shadow replays the read against the secondary store in the background and compares its
+// result against the primary one.
+func (s *KVStore) shadow(operation string, expected interface{}, read func(ctx context.Context) (interface{}, error)) {
+	select {
+	case s.inflight <- struct{}{}:
+	default:
+		zlog.Debug("too many shadow reads in flight, skipping", zap.String("operation", operation))
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.inflight
+			s.wg.Done()
+		}()
+
+		// The primary read context is likely done once its result was returned
+		ctx, cancel := context.WithTimeout(context.Background(), shadowReadTimeout)
+		defer cancel()
+
+		metrics.ShadowReadCount.Inc(operation)
+		actual, err := read(ctx)
+		if err != nil {
+			metrics.ShadowReadDivergenceCount.Inc(operation)
+			zlog.Warn("shadow read failed on secondary store", zap.String("operation", operation), zap.Error(err))
+			return
+		}
+
+		if !reflect.DeepEqual(expected, actual) {
+			metrics.ShadowReadDivergenceCount.Inc(operation)
+			zlog.Warn("shadow read diverged",
+				zap.String("operation", operation),
+				zap.Reflect("primary", expected),
+				zap.Reflect("secondary", actual),
+			)
+		}
+	}()
+}
+
+type keyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+type fetchResult struct {
+	Found bool
+	Value []byte
+}
+
+func newFetchResult(value []byte, err error) fetchResult {
+	if err == store.ErrNotFound {
+		return fetchResult{}
+	}
+
+	return fetchResult{Found: true, Value: value}
+}
+
+func ignoreNotFound(err error) error {
+	if err == store.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// collector records the key/values received by a read. When the caller stopped the primary
+// read early, the secondary one is stopped after the same amount of key/values.
+type collector struct {
+	pairs   []keyValue
+	stopped bool
+	limit   int
+}
+
+func (c *collector) wrap(onKeyValue store.OnKeyValue) store.OnKeyValue {
+	return func(key []byte, value []byte) error {
+		c.pairs = append(c.pairs, keyValue{append([]byte(nil), key...), append([]byte(nil), value...)})
+
+		err := onKeyValue(key, value)
+		if err != nil {
+			c.stopped = true
+		}
+
+		return err
+	}
+}
+
+func (c *collector) wrapKey(onKey store.OnKey) store.OnKey {
+	onKeyValue := c.wrap(func(key []byte, _ []byte) error { return onKey(key) })
+
+	return func(key []byte) error {
+		return onKeyValue(key, nil)
+	}
+}
+
+func (c *collector) secondary() *collector {
+	secondary := &collector{limit: -1}
+	if c.stopped {
+		secondary.limit = len(c.pairs)
+	}
+
+	return secondary
+}
+
+func (c *collector) collect(key []byte, value []byte) error {
+	if c.limit >= 0 && len(c.pairs) >= c.limit {
+		return store.BreakScan
+	}
+
+	c.pairs = append(c.pairs, keyValue{append([]byte(nil), key...), append([]byte(nil), value...)})
+	return nil
+}
+
+func (c *collector) collectKey(key []byte) error {
+	return c.collect(key, nil)
+}
@@ -0,0 +1,88 @@
+package shadowread
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_ShadowReads(t *testing.T) {
+	primary, primaryCloser := storetest.NewKVStore(t)
+	defer primaryCloser()
+
+	secondary, secondaryCloser := storetest.NewKVStore(t)
+	defer secondaryCloser()
+
+	ctx := context.Background()
+	writeRows(t, primary, "a", "b", "c")
+	writeRows(t, secondary, "a", "b", "d")
+
+	shadowStore := NewStore(primary, secondary)
+	shadowStore.SetSampleRate(1)
+
+	var keys []string
+	err := shadowStore.ScanTabletRows(ctx, []byte("a"), nil, func(key []byte, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	require.NoError(t, err)
+	shadowStore.wg.Wait()
+
+	// Reads are always served by the primary store
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+
+	value, err := shadowStore.FetchTabletRow(ctx, []byte("c"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), value)
+	shadowStore.wg.Wait()
+}
+
+func TestCollector_StoppedEarly(t *testing.T) {
+	primary, primaryCloser := storetest.NewKVStore(t)
+	defer primaryCloser()
+
+	secondary, secondaryCloser := storetest.NewKVStore(t)
+	defer secondaryCloser()
+
+	ctx := context.Background()
+	writeRows(t, primary, "a", "b", "c")
+	writeRows(t, secondary, "a", "b", "d")
+
+	primaryCollector := &collector{}
+	err := primary.ScanTabletRows(ctx, nil, nil, primaryCollector.wrap(func(key []byte, _ []byte) error {
+		if string(key) == "b" {
+			return store.BreakScan
+		}
+		return nil
+	}))
+	require.NoError(t, err)
+
+	secondaryCollector := primaryCollector.secondary()
+	require.NoError(t, secondary.ScanTabletRows(ctx, nil, nil, secondaryCollector.collect))
+
+	// Both reads stopped after the same amount of keys, hence the divergence past it is ignored
+	assert.Equal(t, []keyValue{{[]byte("a"), []byte("v")}, {[]byte("b"), []byte("v")}}, primaryCollector.pairs)
+	assert.Equal(t, primaryCollector.pairs, secondaryCollector.pairs)
+
+	completeCollector := (&collector{}).secondary()
+	require.NoError(t, secondary.ScanTabletRows(ctx, nil, nil, completeCollector.collect))
+	assert.Len(t, completeCollector.pairs, 3)
+}
+
+func TestNewFetchResult(t *testing.T) {
+	assert.Equal(t, fetchResult{}, newFetchResult(nil, store.ErrNotFound))
+	assert.Equal(t, fetchResult{Found: true, Value: []byte("v")}, newFetchResult([]byte("v"), nil))
+}
+
+func writeRows(t *testing.T, kvStore store.KVStore, keys ...string) {
+	batch := kvStore.NewBatch(zlog)
+	for _, key := range keys {
+		batch.SetRow([]byte(key), []byte("v"))
+	}
+
+	require.NoError(t, batch.Flush(context.Background()))
+}
@@ -18,6 +18,8 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -27,6 +29,17 @@ var BreakScan = errors.New("break scan")
 
 var ErrNotFound = errors.New("not found")
 
+// ErrReadOnly is the error returned by the writes to a read-only store, see the `readonly`
+// package, and by the writes of a FluxDB instance in read-only mode.
+type ErrReadOnly struct {
+	// Operation is the write operation rejected
+	Operation string
+}
+
+func (e *ErrReadOnly) Error() string {
+	return fmt.Sprintf("%s rejected, store is read-only", e.Operation)
+}
+
 type Key []byte
 
 func (k Key) String() string {
@@ -37,6 +50,13 @@ type Batch interface {
 	Flush(ctx context.Context) error
 	FlushIfFull(ctx context.Context) (flushed bool, err error)
 
+	// FlushIfFullAsync is like `FlushIfFull` but hands the mutations over to a background flush
+	// instead of waiting for it, so the batch can be refilled while the previous mutations are
+	// being written. At most one background flush is in flight, a new one (and `Flush`) first
+	// waits for the previous one to complete, so mutations are always written in order. An error
+	// of the background flush is returned by the next call to `FlushIfFullAsync` or `Flush`.
+	FlushIfFullAsync(ctx context.Context) (flushed bool, err error)
+
 	// PurgeRow is used to completely delete an element for the database.
 	//
 	// **Important** If a tablet row/singlet entry was deleted, you should use
@@ -50,9 +70,58 @@ type Batch interface {
 	SetRow(key []byte, value []byte)
 	SetLastCheckpoint(key []byte, value []byte)
 
+	// SetTableRow writes the key of a custom table, see `RegisterTable`, or of the key
+	// dictionary table, see the `keydict` package. Writing to any other table panics.
+	SetTableRow(table Table, key []byte, value []byte)
+
+	// Reset discards all mutations not yet flushed, waiting for the background flush, if any,
+	// to complete first.
 	Reset()
 }
 
+// FlushReport describes a batch successfully flushed to the underlying KV storage engine.
+type FlushReport struct {
+	MutationCount int
+	DeletionCount int
+
+	// ByteSize is the total size of the keys and values written and of the keys deleted, the
+	// keys being counted as stored, prefixed by their storage table
+	ByteSize int
+
+	// Tables is the breakdown of the flush per storage table
+	Tables map[string]*TableFlushReport
+
+	Duration time.Duration
+}
+
+type TableFlushReport struct {
+	MutationCount int
+	DeletionCount int
+	ByteSize      int
+}
+
+type OnFlush func(report FlushReport)
+
+// FlushNotifier is implemented by the KVStore reporting the batches they flush, it's optional,
+// see `NotifyFlushes`.
+type FlushNotifier interface {
+	// OnFlush registers a listener called after each batch successfully flushed, listeners are
+	// called synchronously on the flushing goroutine and must not block.
+	OnFlush(listener OnFlush)
+}
+
+// NotifyFlushes registers the listener on `s` when it implements `FlushNotifier`, returning
+// false when the store does not report its flushes.
+func NotifyFlushes(s KVStore, listener OnFlush) bool {
+	notifier, ok := s.(FlushNotifier)
+	if !ok {
+		return false
+	}
+
+	notifier.OnFlush(listener)
+	return true
+}
+
 type OnKey func(key []byte) error
 
 type OnKeyValue func(key []byte, value []byte) error
@@ -92,4 +161,14 @@ type KVStore interface {
 	ScanLastShardsWrittenCheckpoint(ctx context.Context, keyPrefix []byte, onKeyValue OnKeyValue) error
 
 	DeleteShardsCheckpoint(ctx context.Context, keyPrefix []byte) error
+
+	// ScanTableKeys scans the keys in range [keyStart, keyEnd[ of the storage table, an empty
+	// `keyEnd` scans until the end of the table.
+	ScanTableKeys(ctx context.Context, table Table, keyStart, keyEnd []byte, onKey OnKey) error
+
+	// ScanTable is like `ScanTableKeys` but also receives the values.
+	ScanTable(ctx context.Context, table Table, keyStart, keyEnd []byte, onKeyValue OnKeyValue) error
+
+	// DeleteTableKeys completely deletes the keys from the storage table, bypassing any batch.
+	DeleteTableKeys(ctx context.Context, table Table, keys [][]byte) error
 }
@@ -0,0 +1,42 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storetest provides fixtures for the tests of the stores and of the code using them.
+package storetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store/kv"
+	_ "github.com/dfuse-io/kvdb/store/badger"
+	"github.com/stretchr/testify/require"
+)
+
+// NewKVStore returns a fresh badger store in a temporary directory, the returned function closes
+// it and deletes the directory.
+func NewKVStore(t *testing.T) (*kv.KVStore, func()) {
+	tmp, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+
+	kvStore, err := kv.NewStore(fmt.Sprintf("badger://%s/test.db?createTables=true", tmp))
+	require.NoError(t, err)
+
+	return kvStore, func() {
+		kvStore.Close()
+		os.RemoveAll(tmp)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Table identifies a table of the KVStore, how the tables are laid out physically is up to the
+// storage engine.
+type Table byte
+
+const (
+	// RowsTable holds the tablet rows, the singlet entries and the indexes
+	RowsTable Table = iota + 1
+
+	// CheckpointsTable holds the last written, last irreversible and shards checkpoints
+	CheckpointsTable
+
+	// KeyDictionaryTable holds the dictionary of the identities compressed in the rows keys, see
+	// the `keydict` package
+	KeyDictionaryTable
+)
+
+// The tables below this one are reserved for the FluxDB tables
+const firstCustomTable Table = 0x10
+
+var tableNames = map[Table]string{
+	RowsTable:          "rows",
+	CheckpointsTable:   "checkpoint",
+	KeyDictionaryTable: "key-dictionary",
+}
+
+// The tables registered with `RegisterTable`, in order
+var customTables []Table
+
+// RegisterTable registers an additional table, for product specific data (e.g. metadata) stored
+// alongside the FluxDB tables. Its rows are written with `Batch.SetTableRow`, flushed after the
+// rows table and before the checkpoints table, and read with `KVStore.ScanTable`. The custom
+// tables are copied along with the FluxDB tables by `fluxdb.CopyStore` and are known to the
+// tooling, they are not part of the incremental backup which only holds the block writes.
+//
+// Tables must be registered at initialization, before any store is used, registering a
+// reserved table or an already registered table or name panics.
+func RegisterTable(table Table, name string) {
+	if table < firstCustomTable || table == 0xFF {
+		panic(fmt.Errorf("table 0x%02X is reserved, custom tables must be within 0x%02X and 0xFE", byte(table), byte(firstCustomTable)))
+	}
+
+	if actual, found := tableNames[table]; found {
+		panic(fmt.Errorf("table 0x%02X is already registered for %q, they all must be unique among registered ones", byte(table), actual))
+	}
+
+	for actualTable, actual := range tableNames {
+		if actual == name {
+			panic(fmt.Errorf("table name %q is already registered for table 0x%02X, they all must be unique among registered ones", name, byte(actualTable)))
+		}
+	}
+
+	tableNames[table] = name
+	customTables = append(customTables, table)
+	sort.Slice(customTables, func(i, j int) bool { return customTables[i] < customTables[j] })
+}
+
+// CustomTables returns the tables registered with `RegisterTable`, in order.
+func CustomTables() []Table {
+	return append([]Table(nil), customTables...)
+}
+
+// Tables returns all the known tables, the FluxDB ones then the custom ones, in order.
+func Tables() []Table {
+	return append([]Table{RowsTable, CheckpointsTable, KeyDictionaryTable}, customTables...)
+}
+
+// LookupTable returns the known table named `name`.
+func LookupTable(name string) (table Table, found bool) {
+	for table, tableName := range tableNames {
+		if tableName == name {
+			return table, true
+		}
+	}
+
+	return 0, false
+}
+
+// IsKnown determines if the table is a FluxDB table or a registered custom table.
+func (t Table) IsKnown() bool {
+	_, found := tableNames[t]
+	return found
+}
+
+// IsCustom determines if the table is a registered custom table, see `RegisterTable`.
+func (t Table) IsCustom() bool {
+	return t >= firstCustomTable && t.IsKnown()
+}
+
+func (t Table) String() string {
+	if name, found := tableNames[t]; found {
+		return name
+	}
+
+	return fmt.Sprintf("0x%02X", byte(t))
+}
@@ -38,6 +38,10 @@ type TabletFactory func(identifier []byte) (Tablet, error)
 
 var tabletFactories = map[uint16]TabletFactory{}
 
+// The collections whose tablet row keys carry a sub-block ordinal after the height, see
+// `EnableTabletRowOrdinals` for details.
+var tabletRowOrdinalCollections = map[uint16]bool{}
+
 // RegisterSingletFactory accepts a collection (and its name) as well as a TabletFactory for
 // this Tablet type and register it in the system so it's known to FluxDB internal components.
 func RegisterTabletFactory(collection uint16, collectionName string, factory TabletFactory) {
@@ -57,6 +61,29 @@ func registerTabletFactory(collection uint16, collectionName string, factory Tab
 	tabletFactories[collection] = factory
 }
 
+// EnableTabletRowOrdinals extends the height component of the row keys of the received tablet
+// collection with a sub-block ordinal, for protocols producing multiple mutations of the same
+// tablet row within a single height. Without it, only the last mutation of a row in a given
+// height is retained, with it, every mutation is kept as its own version.
+//
+// Each version of a row is written with its order of appearance in the write request as its
+// ordinal, except the last one of the height which always uses the `LastTabletRowOrdinal`
+// ordinal, so reads deterministically resolve to the last-in-block version.
+//
+// **Important** This changes the storage format of the collection rows, it must be enabled
+// before any row of the collection is written and must never be disabled afterwards.
+func EnableTabletRowOrdinals(collection uint16) {
+	if _, found := tabletFactories[collection]; !found {
+		panic(fmt.Errorf("collection 0x%04X is not a registered tablet collection, register its factory first", collection))
+	}
+
+	tabletRowOrdinalCollections[collection] = true
+}
+
+func tabletRowOrdinalsEnabled(collection uint16) bool {
+	return tabletRowOrdinalCollections[collection]
+}
+
 // Tablet is a height-aware temporal table containing all the rows at any given
 // height. Let's assume you have a token contract where the token and
 // there is multiple accounts owning this token. You could track the historical
@@ -218,6 +245,9 @@ func NewTabletRow(tablet Tablet, key []byte, value []byte) (TabletRow, error) {
 
 	heightOffset := collectionBytes + tabletIdentifierBytes
 	primaryKeyOffset := heightOffset + 8
+	if tabletRowOrdinalsEnabled(tablet.Collection()) {
+		primaryKeyOffset += ordinalBytes
+	}
 
 	if primaryKeyOffset >= len(key) {
 		return nil, fmt.Errorf("invalid key length, expected at least %d bytes, got %d", primaryKeyOffset+1, len(key))
@@ -236,7 +266,21 @@ func NewTabletRow(tablet Tablet, key []byte, value []byte) (TabletRow, error) {
 	height := bigEndian.Uint64(key[heightOffset:])
 	primaryKey := key[primaryKeyOffset:]
 
-	return tablet.Row(height, primaryKey, value)
+	if !tabletRowProvenanceEnabled(collection) {
+		return tablet.Row(height, primaryKey, value)
+	}
+
+	provenance, value, err := splitTabletRowProvenance(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid row provenance: %w", err)
+	}
+
+	row, err := tablet.Row(height, primaryKey, value)
+	if err != nil || provenance == nil {
+		return row, err
+	}
+
+	return WithRowProvenance(row, *provenance), nil
 }
 
 func NewTabletRowFromStorage(key []byte, value []byte) (TabletRow, error) {
@@ -255,25 +299,53 @@ func NewTabletRowFromStorage(key []byte, value []byte) (TabletRow, error) {
 // <collection (2 bytes)><tablet identifier (N bytes)><height (8 bytes)><row primary key (N bytes)>
 // ```
 //
+// For collections with row ordinals enabled (see `EnableTabletRowOrdinals`), the height is
+// followed by the sub-block ordinal:
+//
+// ```
+// <collection (2 bytes)><tablet identifier (N bytes)><height (8 bytes)><ordinal (4 bytes)><row primary key (N bytes)>
+// ```
+//
 // Only the tablet implementation knows how to turn its series of bytes into the correct implementation.
 type TabletRowKey []byte
 
+// LastTabletRowOrdinal is the ordinal of the last version of a tablet row within a height, for
+// collections with row ordinals enabled.
+const LastTabletRowOrdinal = math.MaxUint32
+
 func KeyForTabletRow(row TabletRow) (out TabletRowKey) {
 	return KeyForTabletRowFromParts(row.Tablet(), row.Height(), row.PrimaryKey())
 }
 
+// KeyForTabletRowFromParts returns the key of the row version resolved by reads at this
+// height, which for collections with row ordinals enabled is the one using the
+// `LastTabletRowOrdinal` ordinal.
 func KeyForTabletRowFromParts(tablet Tablet, height uint64, primaryKey []byte) (out TabletRowKey) {
+	return KeyForTabletRowVersion(tablet, height, LastTabletRowOrdinal, primaryKey)
+}
+
+// KeyForTabletRowVersion returns the key of the row version with the given sub-block ordinal,
+// the ordinal is ignored for collections without row ordinals enabled.
+func KeyForTabletRowVersion(tablet Tablet, height uint64, ordinal uint32, primaryKey []byte) (out TabletRowKey) {
 	collection := tablet.Collection()
 	tabletIdentifier := tablet.Identifier()
 
 	tabletIdentifierBytes := len(tabletIdentifier)
 	primaryKeyBytes := len(primaryKey)
 
-	out = make([]byte, collectionBytes+tabletIdentifierBytes+heightBytes+primaryKeyBytes)
+	versionBytes := heightBytes
+	if tabletRowOrdinalsEnabled(collection) {
+		versionBytes += ordinalBytes
+	}
+
+	out = make([]byte, collectionBytes+tabletIdentifierBytes+versionBytes+primaryKeyBytes)
 	copyCollection(out, collection)
 	copy(out[collectionBytes:], tabletIdentifier)
 	copyHeight(out[collectionBytes+tabletIdentifierBytes:], height)
-	copy(out[collectionBytes+tabletIdentifierBytes+heightBytes:], primaryKey)
+	if versionBytes > heightBytes {
+		bigEndian.PutUint32(out[collectionBytes+tabletIdentifierBytes+heightBytes:], ordinal)
+	}
+	copy(out[collectionBytes+tabletIdentifierBytes+versionBytes:], primaryKey)
 	return
 }
 
@@ -362,7 +434,7 @@ func (i *TabletIndex) RowCount() uint64 {
 // hydrating the value of each row (which means that row retrieved using this method
 // will all have `nil` as their value).
 //
-// This is usef mainly for printing purposes.
+// This is usef mainly for printing purposes. The rows are sorted by ascending primary key.
 func (i *TabletIndex) Rows(tablet Tablet) (rows []TabletRow, err error) {
 	count := i.RowCount()
 	if count <= 0 {
@@ -381,6 +453,7 @@ func (i *TabletIndex) Rows(tablet Tablet) (rows []TabletRow, err error) {
 		index++
 	}
 
+	sortTabletRows(rows, TabletRowOrderAscending)
 	return
 }
 
@@ -401,7 +474,7 @@ func (i *TabletIndex) MarshalValue() ([]byte, error) {
 		return nil, fmt.Errorf("marshal index: %w", err)
 	}
 
-	return value, nil
+	return withIndexChecksum(value), nil
 }
 
 type primaryKeyToTabletRowMap struct {
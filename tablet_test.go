@@ -153,6 +153,31 @@ func TestKeyForTabletRowParts(t *testing.T) {
 	}
 }
 
+func TestKeyForTabletRowVersion(t *testing.T) {
+	tablet := testTablet("abc")
+	assert.Equal(t, "fff2616263000000000000000a676869", hex.EncodeToString(KeyForTabletRowVersion(tablet, 10, 2, []byte("ghi"))), "ordinal ignored when not enabled")
+
+	EnableTabletRowOrdinals(testTabletCollection)
+	defer delete(tabletRowOrdinalCollections, testTabletCollection)
+
+	key := KeyForTabletRowVersion(tablet, 10, 2, []byte("ghi"))
+	assert.Equal(t, "fff2616263000000000000000a00000002676869", hex.EncodeToString(key))
+	assert.Equal(t, "fff2616263000000000000000affffffff676869", hex.EncodeToString(KeyForTabletRowFromParts(tablet, 10, []byte("ghi"))))
+
+	row, err := NewTabletRow(tablet, key, nil)
+	require.NoError(t, err)
+
+	expectedRow, err := tablet.Row(10, []byte("ghi"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, expectedRow, row)
+}
+
+func TestEnableTabletRowOrdinals_UnknownCollection(t *testing.T) {
+	panicked, value := didPanic(func() { EnableTabletRowOrdinals(0xEEEE) })
+	require.True(t, panicked)
+	assert.Equal(t, errors.New("collection 0xEEEE is not a registered tablet collection, register its factory first"), value)
+}
+
 func TestRegisterTabletFactory(t *testing.T) {
 	tests := []struct {
 		name             string
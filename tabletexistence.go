@@ -0,0 +1,199 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/abourget/llerrgroup"
+	"github.com/dfuse-io/dtracing"
+	"github.com/dfuse-io/fluxdb/metrics"
+	"github.com/dfuse-io/fluxdb/store"
+	"go.uber.org/zap"
+)
+
+// The amount of tablets probed concurrently by `HasSeenAnyRowForTablets`
+const batchedTabletExistenceParallelism = 8
+
+// EnableTabletExistenceCache remembers, in a bloom filter sized for `capacity` tablets, the
+// tablets known to have seen a row, so `HasSeenAnyRowForTablet` and `HasSeenAnyRowForTablets`
+// answer from memory for them. The filter is populated with the tablets written by this
+// instance, once their batch is flushed, and with the ones found by the probes. A tablet having
+// seen a row always has, so nothing ever needs to be invalidated.
+//
+// **Important** A bloom filter has false positives, a tablet that never saw a row is reported as
+// having seen one with a probability of at most `falsePositiveRate` (e.g. 0.000001). The filter
+// is cleared once `capacity` tablets were added to it, so this probability holds whatever the
+// amount of tablets probed. The tablets whose rows were all purged (e.g. by the retention policy)
+// are still reported as having seen a row.
+func (fdb *FluxDB) EnableTabletExistenceCache(capacity int, falsePositiveRate float64) {
+	fdb.tabletExistence = newTabletExistenceCache(capacity, falsePositiveRate)
+}
+
+// HasSeenAnyRowForTablets returns, for each tablet, whether it has seen any row, deletions
+// included, `exists[i]` being the one of `tablets[i]`. The tablets not known to exist by the
+// existence cache (see `EnableTabletExistenceCache`) are probed from the store concurrently, so
+// the latency is the one of a single store round-trip instead of one per tablet.
+func (fdb *FluxDB) HasSeenAnyRowForTablets(ctx context.Context, tablets []Tablet) (exists []bool, err error) {
+	ctx, span := dtracing.StartSpan(ctx, "has seen tablets row", "tablet_count", len(tablets))
+	defer span.End()
+
+	exists = make([]bool, len(tablets))
+	eg := llerrgroup.New(batchedTabletExistenceParallelism)
+	for i, tablet := range tablets {
+		if fdb.tabletExistence.contains(KeyForTablet(tablet)) {
+			recordTabletExistenceCacheHit(ctx)
+			exists[i] = true
+			continue
+		}
+
+		if eg.Stop() {
+			break
+		}
+
+		i, tablet := i, tablet
+		eg.Go(func() error {
+			found, err := fdb.probeTabletExistence(ctx, tablet)
+			if err != nil {
+				return fmt.Errorf("tablet %s: %w", tablet, err)
+			}
+
+			exists[i] = found
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return exists, nil
+}
+
+// probeTabletExistence checks the store for any row of the tablet, adding the tablet to the
+// existence cache when found.
+func (fdb *FluxDB) probeTabletExistence(ctx context.Context, tablet Tablet) (bool, error) {
+	exists, err := fdb.store.HasTabletRow(ctx, KeyForTabletAt(tablet, 0), KeyForTabletAt(tablet, math.MaxUint64))
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		fdb.tabletExistence.add(KeyForTablet(tablet))
+	}
+
+	return exists, nil
+}
+
+// recordTabletExistenceCacheHit accounts for an existence probe answered from the existence cache.
+func recordTabletExistenceCacheHit(ctx context.Context) {
+	metrics.TabletExistenceCacheHitCount.Inc()
+	store.ReadStatsFromContext(ctx).RecordCacheHit()
+}
+
+// tabletExistenceCache is a bloom filter of the tablets known to have seen a row, identified by
+// their key, safe for concurrent use. The tablets of the write batch in progress are pending
+// until it's flushed, the ones of a failed batch might not be in the store.
+type tabletExistenceCache struct {
+	lock     sync.RWMutex
+	filter   *bloomFilter
+	capacity int
+	count    int
+
+	// Only accessed by the writer
+	pending map[string]bool
+}
+
+func newTabletExistenceCache(capacity int, falsePositiveRate float64) *tabletExistenceCache {
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.000001
+	}
+
+	return &tabletExistenceCache{
+		filter:   newBloomFilter(capacity, falsePositiveRate),
+		capacity: capacity,
+		pending:  map[string]bool{},
+	}
+}
+
+// contains returns whether the tablet is known to have seen a row. Safe to call on a `nil` cache,
+// in which case nothing is ever known.
+func (c *tabletExistenceCache) contains(key []byte) bool {
+	if c == nil {
+		return false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.filter.contains(key)
+}
+
+// add remembers that the tablet has seen a row. Safe to call on a `nil` cache.
+func (c *tabletExistenceCache) add(key []byte) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.count >= c.capacity {
+		zlog.Info("tablet existence cache full, clearing it", zap.Int("capacity", c.capacity))
+		c.filter.clear()
+		c.count = 0
+	}
+
+	c.filter.add(key)
+	c.count++
+}
+
+// observe records a tablet written by the batch in progress. Safe to call on a `nil` cache.
+func (c *tabletExistenceCache) observe(tablet Tablet) {
+	if c == nil {
+		return
+	}
+
+	c.pending[string(KeyForTablet(tablet))] = true
+}
+
+// commit adds the tablets written by the batch once it was flushed. Safe to call on a `nil`
+// cache.
+func (c *tabletExistenceCache) commit() {
+	if c == nil {
+		return
+	}
+
+	for key := range c.pending {
+		c.add([]byte(key))
+	}
+	c.rollback()
+}
+
+// rollback drops the tablets written by a batch that failed. Safe to call on a `nil` cache.
+func (c *tabletExistenceCache) rollback() {
+	if c == nil {
+		return
+	}
+
+	c.pending = map[string]bool{}
+}
@@ -0,0 +1,102 @@
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasSeenAnyRowForTablets(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	written := newTestTablet("wri")
+	deleted := newTestTablet("del")
+	missing := newTestTablet("mis")
+	writeBatchOfRequests(t, db,
+		tabletRows(1, written.row(t, 1, "001", "a"), deleted.row(t, 1, "001", "b")),
+		tabletRows(2, deleted.row(t, 2, "001", "")),
+	)
+
+	exists, err := db.HasSeenAnyRowForTablets(ctx, []Tablet{missing, written, deleted})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true}, exists)
+
+	exists, err = db.HasSeenAnyRowForTablets(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, exists)
+}
+
+func TestEnableTabletExistenceCache(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	ctx := context.Background()
+	read := newTestTablet("rea")
+	written := newTestTablet("wri")
+	missing := newTestTablet("mis")
+	writeBatchOfRequests(t, db, tabletRows(1, read.row(t, 1, "001", "a")))
+
+	db.EnableTabletExistenceCache(100, 0)
+
+	// Populated on first read
+	stats := &store.ReadStats{}
+	exists, err := db.HasSeenAnyRowForTablet(store.WithReadStats(ctx, stats), read)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 0, stats.CacheHitCount())
+
+	// Populated at write time
+	writeBatchOfRequests(t, db, tabletRows(2, written.row(t, 2, "001", "b")))
+
+	stats = &store.ReadStats{}
+	exists, err = db.HasSeenAnyRowForTablet(store.WithReadStats(ctx, stats), missing)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	batch, err := db.HasSeenAnyRowForTablets(store.WithReadStats(ctx, stats), []Tablet{read, written, missing})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, batch)
+	assert.Equal(t, 2, stats.CacheHitCount())
+	assert.Equal(t, 2, stats.ScanCount(), "only the missing tablet is probed")
+}
+
+func TestTabletExistenceCache(t *testing.T) {
+	cache := newTabletExistenceCache(1000, 0.001)
+	assert.Equal(t, 10, cache.filter.hashCount)
+
+	for i := 0; i < 1000; i++ {
+		cache.add([]byte(fmt.Sprintf("known-%d", i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		require.True(t, cache.contains([]byte(fmt.Sprintf("known-%d", i))))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if cache.contains([]byte(fmt.Sprintf("unknown-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 50, "got %d false positives out of 10000", falsePositives)
+
+	// Cleared once full
+	cache.add([]byte("overflow"))
+	assert.True(t, cache.contains([]byte("overflow")))
+	assert.False(t, cache.contains([]byte("known-0")))
+
+	// A failed batch is not accounted for
+	cache.observe(newTestTablet("fai"))
+	cache.rollback()
+	cache.commit()
+	assert.False(t, cache.contains(KeyForTablet(newTestTablet("fai"))))
+
+	var disabled *tabletExistenceCache
+	assert.False(t, disabled.contains([]byte("known-0")))
+}
@@ -15,8 +15,10 @@
 package fluxdb
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/dfuse-io/bstream"
 	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
@@ -25,6 +27,7 @@ import (
 
 const collectionBytes = 2
 const heightBytes = 8
+const ordinalBytes = 4
 
 var collections = map[uint16]Collection{}
 
@@ -41,12 +44,31 @@ type BlockMapper interface {
 	Map(rawBlk *bstream.Block) (*WriteRequest, error)
 }
 
+// Reader is the read API of FluxDB, implemented by `*FluxDB` for embedded deployments, so
+// application code depending on it is decoupled from where the data is served from.
+type Reader interface {
+	ReadTabletAt(ctx context.Context, height uint64, tablet Tablet, speculativeWrites []*WriteRequest) ([]TabletRow, error)
+	ReadTabletRowAt(ctx context.Context, height uint64, tablet Tablet, primaryKey TabletRowPrimaryKey, speculativeWrites []*WriteRequest) (TabletRow, error)
+	ReadSingletEntryAt(ctx context.Context, singlet Singlet, height uint64, speculativeWrites []*WriteRequest) (SingletEntry, error)
+}
+
+var _ Reader = (*FluxDB)(nil)
+
 type WriteRequest struct {
 	SingletEntries []SingletEntry
 	TabletRows     []TabletRow
 
 	Height   uint64
 	BlockRef bstream.BlockRef
+
+	// PreviousBlockID is the ID of the block preceding `BlockRef`, used to ensure the speculative
+	// writes connect to the last written block (see `ErrSpeculativeForkMismatch`), not verified when empty
+	PreviousBlockID string
+
+	// BlockTime is the time of the block, used to index the written blocks by time when enabled
+	// (see `EnableBlockTimeIndex`), the block is not indexed by time when zero. Only its
+	// millisecond precision is kept by `ToProto`.
+	BlockTime time.Time
 }
 
 func NewWriteRequestFromProto(request *pbfluxdb.WriteRequest) (*WriteRequest, error) {
@@ -58,11 +80,25 @@ func NewWriteRequestFromProto(request *pbfluxdb.WriteRequest) (*WriteRequest, er
 	}
 
 	var err error
-	for i, entry := range request.SingletEntries {
-		if r.SingletEntries[i], err = NewSingletEntryFromStorage(entry.Key, entry.Value); err != nil {
+	entries := r.SingletEntries[:0]
+	for _, protoEntry := range request.SingletEntries {
+		entry, err := NewSingletEntryFromStorage(protoEntry.Key, protoEntry.Value)
+		if err != nil {
 			return nil, fmt.Errorf("singlet entry: %w", err)
 		}
+
+		// The block time is carried by its block time index entry, see `ToProto`
+		if timeEntry, ok := entry.(blockTimeSingletEntry); ok {
+			if timeEntry.Singlet().(blockTimeSinglet).kind == blockHeightToTime {
+				r.BlockTime = blockTimeFromIndex(timeEntry.value())
+			}
+
+			continue
+		}
+
+		entries = append(entries, entry)
 	}
+	r.SingletEntries = entries
 
 	for i, row := range request.TabletRows {
 		if r.TabletRows[i], err = NewTabletRowFromStorage(row.Key, row.Value); err != nil {
@@ -81,6 +117,9 @@ func (r *WriteRequest) AppendTabletRow(row TabletRow) {
 	r.TabletRows = append(r.TabletRows, row)
 }
 
+// ToProto returns the proto request of the write, which has no block time field, the block time,
+// if any, is carried as an extra singlet entry of the block time index instead, restored by
+// `NewWriteRequestFromProto`.
 func (r *WriteRequest) ToProto() (*pbfluxdb.WriteRequest, error) {
 	request := &pbfluxdb.WriteRequest{
 		SingletEntries: make([]*pbfluxdb.WriteEntry, len(r.SingletEntries)),
@@ -102,6 +141,15 @@ func (r *WriteRequest) ToProto() (*pbfluxdb.WriteRequest, error) {
 		}
 	}
 
+	if !r.BlockTime.IsZero() {
+		entry, err := singletEntryToProto(newBlockHeightToTimeEntry(r.BlockTime, r.Height))
+		if err != nil {
+			return nil, fmt.Errorf("block time entry: %w", err)
+		}
+
+		request.SingletEntries = append(request.SingletEntries, entry)
+	}
+
 	return request, nil
 }
 
@@ -110,7 +158,16 @@ func singletEntryToProto(entry SingletEntry) (*pbfluxdb.WriteEntry, error) {
 }
 
 func tabletRowToProto(row TabletRow) (*pbfluxdb.WriteEntry, error) {
-	return genericElementToProto(KeyForTabletRow(row), row)
+	// The stored value, so the provenance of the row, if any, is part of it
+	value, err := marshalTabletRowValue(row)
+	if err != nil {
+		return nil, fmt.Errorf("marshal value: %w", err)
+	}
+
+	return &pbfluxdb.WriteEntry{
+		Key:   KeyForTabletRow(row),
+		Value: value,
+	}, nil
 }
 
 type marshallerValue interface {
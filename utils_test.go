@@ -17,13 +17,10 @@ package fluxdb
 import (
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"testing"
 
-	"github.com/dfuse-io/fluxdb/store/kv"
+	"github.com/dfuse-io/fluxdb/store/storetest"
 	"github.com/dfuse-io/jsonpb"
-	_ "github.com/dfuse-io/kvdb/store/badger"
 	_ "github.com/dfuse-io/kvdb/store/bigkv"
 	pbfluxdb "github.com/dfuse-io/pbgo/dfuse/fluxdb/v1"
 	"github.com/golang/protobuf/proto"
@@ -31,18 +28,9 @@ import (
 )
 
 func NewTestDB(t *testing.T) (*FluxDB, func()) {
-	tmp, err := ioutil.TempDir("", "badger")
-	require.NoError(t, err)
-	kvStore, err := kv.NewStore(fmt.Sprintf("badger://%s/test.db?createTables=true", tmp))
-	require.NoError(t, err)
-
-	db := New(kvStore, nil, nil, false)
-	closer := func() {
-		db.Close()
-		os.RemoveAll(tmp)
-	}
+	kvStore, closer := storetest.NewKVStore(t)
 
-	return db, closer
+	return New(kvStore, nil, nil, false), closer
 }
 
 func TestCheckpoint_Unmarshal(t *testing.T) {
@@ -0,0 +1,116 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/abourget/llerrgroup"
+	"go.uber.org/zap"
+)
+
+const cacheWarmUpParallelism = 8
+
+type cacheWarmUp struct {
+	tablets     []Tablet
+	resolveRows bool
+
+	// Accessed atomically, 1 once the warm-up completed (successfully or not)
+	completed uint32
+}
+
+func (w *cacheWarmUp) isCompleted() bool {
+	return w == nil || atomic.LoadUint32(&w.completed) == 1
+}
+
+// EnableCacheWarmUp configures a warm-up phase, started when FluxDB is launched, preloading
+// the index snapshots of the received hot tablets at the last written height in the index
+// cache. When `resolveRows` is true, the rows of the tablets are also resolved, so the
+// storage engine's own caches are hot too. The process is not ready until the warm-up
+// completes, eliminating the latency spike of the first reads after a deploy.
+func (fdb *FluxDB) EnableCacheWarmUp(tablets []Tablet, resolveRows bool) {
+	fdb.warmUp = &cacheWarmUp{tablets: tablets, resolveRows: resolveRows}
+}
+
+func (fdb *FluxDB) launchCacheWarmUp() {
+	if fdb.warmUp == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fdb.OnTerminating(func(_ error) {
+		cancel()
+	})
+
+	go func() {
+		// A failed warm-up only means colder caches, it must not prevent the process from being ready
+		if err := fdb.warmUpCaches(ctx); err != nil {
+			zlog.Warn("cache warm-up failed, continuing with cold caches", zap.Error(err))
+		}
+	}()
+}
+
+func (fdb *FluxDB) warmUpCaches(ctx context.Context) error {
+	defer atomic.StoreUint32(&fdb.warmUp.completed, 1)
+
+	height, _, err := fdb.FetchLastWrittenCheckpoint(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch last written checkpoint: %w", err)
+	}
+
+	zlog.Info("warming up caches",
+		zap.Int("tablet_count", len(fdb.warmUp.tablets)),
+		zap.Bool("resolve_rows", fdb.warmUp.resolveRows),
+		zap.Uint64("height", height),
+	)
+
+	start := time.Now()
+	eg := llerrgroup.New(cacheWarmUpParallelism)
+	for _, tablet := range fdb.warmUp.tablets {
+		if eg.Stop() {
+			break
+		}
+
+		tablet := tablet
+		eg.Go(func() error {
+			index, err := fdb.ReadTabletIndexAt(ctx, tablet, height)
+			if err != nil {
+				return fmt.Errorf("read tablet %s index: %w", tablet, err)
+			}
+
+			if index != nil {
+				fdb.idxCache.CacheIndexIfNewer(KeyForTablet(tablet), index)
+			}
+
+			if fdb.warmUp.resolveRows {
+				if _, err := fdb.ReadTabletAt(ctx, height, tablet, nil); err != nil {
+					return fmt.Errorf("read tablet %s: %w", tablet, err)
+				}
+			}
+
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	zlog.Info("caches warmed up", zap.Int("tablet_count", len(fdb.warmUp.tablets)), zap.Duration("elapsed", time.Since(start)))
+	return nil
+}
@@ -0,0 +1,51 @@
+package fluxdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheWarmUp(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	height := uint64(123)
+	tablet := newTestTablet("tbl")
+	index := NewTabletIndex()
+	index.AtHeight = height
+	index.SquelchCount = 1
+	index.PrimaryKeyToHeight.put([]byte("002"), height)
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{TabletRows: []TabletRow{tablet.row(t, height, "002", "abc")}},
+		&WriteRequest{Height: height, BlockRef: bstream.NewBlockRef("0000007baa", height), SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), index)}},
+	)
+
+	db.EnableCacheWarmUp([]Tablet{tablet, newTestTablet("oth")}, true)
+	db.SetReady()
+	assert.False(t, db.IsReady(), "not ready until warmed up")
+
+	require.NoError(t, db.warmUpCaches(context.Background()))
+
+	assert.True(t, db.IsReady())
+	cached := db.idxCache.GetIndex(KeyForTablet(tablet))
+	require.NotNil(t, cached)
+	assert.Equal(t, height, cached.AtHeight)
+	assert.Nil(t, db.idxCache.GetIndex(KeyForTablet(newTestTablet("oth"))))
+}
+
+func TestIndexCache_CacheIndexIfNewer(t *testing.T) {
+	cache := newIndexCache()
+	key := KeyForTablet(newTestTablet("tbl"))
+
+	cache.CacheIndex(key, &TabletIndex{AtHeight: 10})
+	cache.CacheIndexIfNewer(key, &TabletIndex{AtHeight: 5})
+	assert.Equal(t, uint64(10), cache.GetIndex(key).AtHeight)
+
+	cache.CacheIndexIfNewer(key, &TabletIndex{AtHeight: 20})
+	assert.Equal(t, uint64(20), cache.GetIndex(key).AtHeight)
+}
@@ -17,14 +17,17 @@ package fluxdb
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dfuse-io/bstream"
 	"github.com/dfuse-io/dtracing"
+	"github.com/dfuse-io/fluxdb/metrics"
 	"github.com/dfuse-io/fluxdb/store"
 	"github.com/dfuse-io/logging"
 	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
@@ -36,42 +39,174 @@ import (
 
 var logWriteBlockStats = os.Getenv("STATEDB_SIZE_STATS") != ""
 
+// While writing a block, the batch is checked for fullness each time this amount of singlet
+// entries and tablet rows was added to it, splitting the mutations of huge blocks (airdrops)
+// across multiple flushes
+const writeBlockFlushCheckInterval = 1024
+
+// WriteBatch writes the requests, blocks following the last one written, in a single batch. The
+// keys rejected by the backend (see `kv.KVStore#EnablePartitionedFlushRetry`) are skipped, the
+// rest of the batch being committed, a `*store.ErrRejectedKeys` listing them is then returned
+// once the batch is fully committed, it must not be retried.
 func (fdb *FluxDB) WriteBatch(ctx context.Context, w []*WriteRequest) error {
+	return fdb.writeBatch(ctx, w, nil)
+}
+
+// writeBatch is `WriteBatch`, also writing the source cursor of the pipeline, when not `nil`,
+// along the last written checkpoint.
+func (fdb *FluxDB) writeBatch(ctx context.Context, w []*WriteRequest, cursor *SourceCursor) (err error) {
 	ctx, span := dtracing.StartSpan(ctx, "write batch", "write_request_count", len(w))
 	defer span.End()
 
+	defer func() {
+		fdb.auditWriteBatch(ctx, w, &err)
+
+		if err != nil {
+			// Some of the values recorded for write elision might not have made it to the store
+			fdb.writeElider.reset()
+			fdb.collectionStats.rollback()
+			fdb.tabletExistence.rollback()
+		}
+	}()
+
+	if err := fdb.checkWritable("write batch"); err != nil {
+		return err
+	}
+
+	if err := fdb.checkWriterLease(); err != nil {
+		return err
+	}
+
 	if err := fdb.isNextBlock(ctx, w[0].Height); err != nil {
 		return fmt.Errorf("next block check: %w", err)
 	}
 
+	if err := fdb.loadCollectionStats(ctx); err != nil {
+		return fmt.Errorf("load collection write stats: %w", err)
+	}
+
 	batch := fdb.store.NewBatch(zlog)
 
+	flushIfFull := batch.FlushIfFull
+	if fdb.pipelinedFlushes {
+		flushIfFull = batch.FlushIfFullAsync
+
+		defer func() {
+			if err != nil {
+				// Waits for the background flush, if any, it must not overlap a retry of this batch
+				batch.Reset()
+			}
+		}()
+	}
+
+	// The keys rejected by the backend are skipped, the rest of the batch being committed, see
+	// `kv.KVStore#EnablePartitionedFlushRetry`
+	rejected := &rejectedKeys{}
+	flushIfFull = rejected.skipping(flushIfFull)
+
+	aggregates := fdb.newAggregateWriter(w[0].Height)
 	for _, req := range w {
-		if err := fdb.writeBlock(ctx, batch, req); err != nil {
+		if err := fdb.writeBlock(ctx, batch, flushIfFull, aggregates, req); err != nil {
 			return fmt.Errorf("write block: %w", err)
 		}
 
-		if _, err := batch.FlushIfFull(ctx); err != nil {
+		if _, err := flushIfFull(ctx); err != nil {
 			return fmt.Errorf("flushing if full: %w", err)
 		}
 	}
 
-	if err := batch.Flush(ctx); err != nil {
+	// Only irreversible blocks are ever written, so the last one of the batch is the last
+	// irreversible block. Shards are partial, only the final checkpoint of a sharded run is.
+	if !fdb.IsSharding() {
+		last := w[len(w)-1]
+		if err := fdb.setCheckpoint(batch, lastIrreversibleRowKey, last.Height, last.BlockRef); err != nil {
+			return fmt.Errorf("set last irreversible checkpoint: %w", err)
+		}
+
+		if cursor != nil {
+			if err := setSourceCursor(batch, cursor); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Backed up before being committed, so a committed batch is always in the backup
+	if !fdb.IsSharding() {
+		if err := fdb.backup.write(ctx, w); err != nil {
+			return fmt.Errorf("incremental backup: %w", err)
+		}
+	}
+
+	// Confirmed right before the final flush, the one writing the checkpoint
+	if err := fdb.confirmWriterLease(ctx); err != nil {
+		return err
+	}
+
+	if err := rejected.skip(batch.Flush(ctx)); err != nil {
 		return fmt.Errorf("flush: %w", err)
 	}
 
-	if sched := fdb.idxCache.IndexingSchedule(); len(sched) != 0 {
-		err := fdb.IndexTables(ctx)
-		if err != nil {
-			return fmt.Errorf("index tables: %w", err)
+	if !fdb.IsSharding() {
+		last := w[len(w)-1]
+		if err := fdb.writeCommitMarker(ctx, last.Height, last.BlockRef); err != nil {
+			return fmt.Errorf("write commit marker: %w", err)
 		}
 	}
 
-	return nil
+	fdb.collectionStats.commit()
+	fdb.tabletExistence.commit()
+
+	// The blocks are counted toward the coarse checkpoint interval whether or not tablets are
+	// scheduled for indexing
+	deferIndexing := fdb.shouldDeferIndexing(len(w))
+	if fdb.idxCache.HasScheduledIndexing() && !deferIndexing {
+		if fdb.asyncIndexer != nil && !fdb.disableIndexing {
+			if err := fdb.asyncIndexer.enqueue(ctx, fdb.idxCache.DrainIndexingSchedule()); err != nil {
+				return fmt.Errorf("enqueue index tables: %w", err)
+			}
+		} else {
+			err := fdb.IndexTables(ctx)
+			if err != nil {
+				return fmt.Errorf("index tables: %w", err)
+			}
+		}
+	}
+
+	if !fdb.IsSharding() {
+		fdb.committedReads.advance(w[len(w)-1].Height)
+	}
+
+	fdb.recordLastWrittenBlock(w[len(w)-1].BlockRef.Num())
+	fdb.events.publishBlocksCommitted(w)
+	return rejected.err()
+}
+
+// shouldDeferIndexing determines, when bulk-load mode is active, if indexing of the scheduled
+// tablets should be deferred after `blockCount` more blocks were written.
+func (fdb *FluxDB) shouldDeferIndexing(blockCount int) bool {
+	if !fdb.deferIndexing {
+		return false
+	}
+
+	if fdb.ready {
+		zlog.Info("caught up with real-time, building deferred indexes and resuming inline indexing")
+		fdb.deferIndexing = false
+		return false
+	}
+
+	fdb.deferredBlockCount += blockCount
+	if fdb.deferIndexingInterval > 0 && fdb.deferredBlockCount >= fdb.deferIndexingInterval {
+		zlog.Info("building deferred indexes at coarse checkpoint", zap.Int("block_count", fdb.deferredBlockCount))
+		fdb.deferredBlockCount = 0
+		return false
+	}
+
+	return true
 }
 
 type shardProgressStats struct {
 	HighestHeight     uint64
+	HighestBlockNum   uint64
 	BlockRefByShard   map[int]bstream.BlockRef
 	ReferenceBlockRef bstream.BlockRef
 	FaultyShards      []int
@@ -95,6 +230,85 @@ func (fdb *FluxDB) VerifyAllShardsWritten(ctx context.Context) (*shardProgressSt
 	return stats, err
 }
 
+// shardsAlignmentPollInterval is the delay between each check of the shards progress when
+// waiting for all shards to be aligned
+var shardsAlignmentPollInterval = 5 * time.Second
+
+// WaitForAllShardsAligned polls the last written checkpoint of all shards until each one of
+// them has reached at least `minBlock`, returning the shards progress once it's the case. Returns
+// an error if the context is cancelled (or expires) before all shards have reached the block.
+//
+// Useful to gate the switch to serve mode on the completion of a sharded injection.
+func (fdb *FluxDB) WaitForAllShardsAligned(ctx context.Context, minBlock uint64) (*shardProgressStats, error) {
+	if fdb.shardCount <= 0 {
+		return nil, fmt.Errorf("sharding is not configured, shard count is %d", fdb.shardCount)
+	}
+
+	for {
+		stats, err := fdb.fetchAllShardProgressStats(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fetch shard progress: %w", err)
+		}
+
+		laggingShards := stats.laggingShards(minBlock)
+		if len(laggingShards) == 0 {
+			zlog.Info("all shards reached block", zap.Uint64("min_block", minBlock), zap.Stringer("reference_block", stats.ReferenceBlockRef))
+			return stats, nil
+		}
+
+		zlog.Debug("waiting for shards to reach block", zap.Uint64("min_block", minBlock), zap.Ints("lagging_shards", laggingShards))
+		select {
+		case <-ctx.Done():
+			return stats, fmt.Errorf("shards %v did not reach block #%d: %w", laggingShards, minBlock, ctx.Err())
+		case <-time.After(shardsAlignmentPollInterval):
+		}
+	}
+}
+
+func (s *shardProgressStats) laggingShards(minBlock uint64) (out []int) {
+	for shardIndex, shardBlock := range s.BlockRefByShard {
+		if bstream.EqualsBlockRefs(shardBlock, bstream.BlockRefEmpty) || shardBlock.Num() < minBlock {
+			out = append(out, shardIndex)
+		}
+	}
+
+	sort.Ints(out)
+	return out
+}
+
+// ShardProgress is the last block written by a shard of a sharded injection, along with the
+// amount of blocks it's behind the most advanced shard.
+type ShardProgress struct {
+	ShardIndex int
+	LastBlock  bstream.BlockRef
+	Lag        uint64
+}
+
+// ShardsProgress returns the progress of each shard, ordered by shard index. A shard that did
+// not write anything yet has an empty last block.
+func (fdb *FluxDB) ShardsProgress(ctx context.Context) ([]ShardProgress, error) {
+	if fdb.shardCount <= 0 {
+		return nil, fmt.Errorf("sharding is not configured, shard count is %d", fdb.shardCount)
+	}
+
+	stats, err := fdb.fetchAllShardProgressStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch shard progress: %w", err)
+	}
+
+	progress := make([]ShardProgress, fdb.shardCount)
+	for shardIndex := range progress {
+		lastBlock := stats.BlockRefByShard[shardIndex]
+		progress[shardIndex] = ShardProgress{
+			ShardIndex: shardIndex,
+			LastBlock:  lastBlock,
+			Lag:        stats.HighestBlockNum - lastBlock.Num(),
+		}
+	}
+
+	return progress, nil
+}
+
 func (fdb *FluxDB) fetchAllShardProgressStats(ctx context.Context) (*shardProgressStats, error) {
 	stats := &shardProgressStats{
 		BlockRefByShard:   map[int]bstream.BlockRef{},
@@ -153,7 +367,15 @@ func (fdb *FluxDB) fetchAllShardProgressStats(ctx context.Context) (*shardProgre
 		stats.BlockRefByShard[i] = seenBlock
 	}
 
+	for _, shardBlock := range stats.BlockRefByShard {
+		if shardBlock.Num() > stats.HighestBlockNum {
+			stats.HighestBlockNum = shardBlock.Num()
+		}
+	}
+
 	for shardIndex, shardBlock := range stats.BlockRefByShard {
+		metrics.ShardLag.SetUint64(stats.HighestBlockNum-shardBlock.Num(), strconv.Itoa(shardIndex))
+
 		if bstream.EqualsBlockRefs(shardBlock, bstream.BlockRefEmpty) {
 			stats.MissingShards = append(stats.MissingShards, shardIndex)
 		}
@@ -179,10 +401,18 @@ func (fdb *FluxDB) WriteShardingFinalCheckpoint(ctx context.Context, height uint
 		return fmt.Errorf("set last checkpoint: %w", err)
 	}
 
+	if err := fdb.setCheckpoint(batch, lastIrreversibleRowKey, height, block); err != nil {
+		return fmt.Errorf("set last irreversible checkpoint: %w", err)
+	}
+
 	if err := batch.Flush(ctx); err != nil {
 		return fmt.Errorf("flushing last block marker: %w", err)
 	}
 
+	if err := fdb.writeCommitMarker(ctx, height, block); err != nil {
+		return fmt.Errorf("write commit marker: %w", err)
+	}
+
 	return nil
 }
 
@@ -190,7 +420,11 @@ func (fdb *FluxDB) DeleteAllShardCheckpoints(ctx context.Context) error {
 	return fdb.store.DeleteShardsCheckpoint(ctx, []byte("shard-"))
 }
 
-func (fdb *FluxDB) writeBlock(ctx context.Context, batch store.Batch, w *WriteRequest) (err error) {
+// writeBlock adds the mutations of the write request to the batch, followed by its checkpoint.
+// The batch is flushed (using `flushIfFull`) while the mutations are added once it's full, so the
+// mutations of a huge block are split across multiple flushes, its checkpoint being always
+// written by the last one, so the block is never seen as written until all its mutations are.
+func (fdb *FluxDB) writeBlock(ctx context.Context, batch store.Batch, flushIfFull func(ctx context.Context) (bool, error), aggregates *aggregateWriter, w *WriteRequest) (err error) {
 	var stats *writeBlockStats
 	if logWriteBlockStats {
 		stats = &writeBlockStats{
@@ -200,17 +434,55 @@ func (fdb *FluxDB) writeBlock(ctx context.Context, batch store.Batch, w *WriteRe
 		}
 	}
 
+	mutationCount := 0
+	flushCount := 0
+	splitIfFull := func() error {
+		mutationCount++
+		if mutationCount%writeBlockFlushCheckInterval != 0 {
+			return nil
+		}
+
+		flushed, err := flushIfFull(ctx)
+		if err != nil {
+			return fmt.Errorf("flushing if full: %w", err)
+		}
+
+		if flushed {
+			flushCount++
+		}
+		return nil
+	}
+
 	for _, entry := range w.SingletEntries {
+		if fdb.indexOnly {
+			continue
+		}
+
 		var value []byte
 
+		key := KeyForSingletEntry(entry)
 		if !entry.IsDeletion() {
 			value, err = entry.MarshalValue()
 			if err != nil {
 				return fmt.Errorf("singlet to proto: %w", err)
 			}
+
+			if err := validateValue(key, value); err != nil {
+				return err
+			}
+
+			var skip bool
+			if value, skip, err = fdb.rowSizeLimit.enforce(key, value); err != nil {
+				return err
+			} else if skip {
+				continue
+			}
+		}
+
+		if fdb.writeElider.shouldElide(KeyForSinglet(entry.Singlet()), value) {
+			continue
 		}
 
-		key := KeyForSingletEntry(entry)
 		if logWriteBlockStats {
 			singletKey := entry.Singlet().String()
 			size := uint64(len(key) + len(value))
@@ -220,31 +492,81 @@ func (fdb *FluxDB) writeBlock(ctx context.Context, batch store.Batch, w *WriteRe
 			stats.SingleEntryCount++
 		}
 
+		fdb.collectionStats.observe(entry.Singlet().Collection(), len(key)+len(value), entry.IsDeletion())
+		fdb.hotKeys.sample(hotKeysWrite, nil, key)
+		fdb.missingKeys.forgetSinglet(entry.Singlet())
 		batch.SetRow(key, value)
+
+		if err := splitIfFull(); err != nil {
+			return err
+		}
 	}
 
-	for _, row := range w.TabletRows {
-		var value []byte
-		if !row.IsDeletion() {
-			value, err = row.MarshalValue()
+	ordinals := tabletRowOrdinals(w.TabletRows)
+	for i, row := range w.TabletRows {
+		tablet := row.Tablet()
+
+		// In index only mode, rows are already in the store, we only need to account for them in indexing
+		if !fdb.indexOnly {
+			ordinal := uint32(LastTabletRowOrdinal)
+			if ordinals != nil {
+				ordinal = ordinals[i]
+			}
+
+			key := KeyForTabletRowVersion(tablet, row.Height(), ordinal, row.PrimaryKey())
+
+			value, err := marshalTabletRowValue(row)
 			if err != nil {
 				return fmt.Errorf("tablet to proto: %w", err)
 			}
-		}
 
-		tablet := row.Tablet()
-		key := KeyForTabletRowFromParts(tablet, row.Height(), row.PrimaryKey())
+			if !row.IsDeletion() {
+				if err := validateValue(key, value); err != nil {
+					return err
+				}
+
+				// A skipped row is not in the store, so it must not be accounted for in indexing either
+				var skip bool
+				if value, skip, err = fdb.rowSizeLimit.enforce(key, value); err != nil {
+					return err
+				} else if skip {
+					continue
+				}
+			}
 
-		if logWriteBlockStats {
-			tabletKey := tablet.String()
-			size := uint64(len(key) + len(value))
+			// Only the last version of a row within a block can be elided, earlier ones are always
+			// written and make the next value of the row unknown to the elider.
+			elisionKey := append(KeyForTablet(tablet), row.PrimaryKey()...)
+			if ordinal != LastTabletRowOrdinal {
+				fdb.writeElider.forget(elisionKey)
+			} else if fdb.writeElider.shouldElide(elisionKey, value) {
+				// An elided row is not in the store, so it must not be accounted for in indexing either
+				continue
+			}
 
-			stats.TotalSize += size
-			stats.TotalSizePerTablet[tabletKey] = stats.TotalSizePerTablet[tabletKey] + size
-			stats.TabletRowCount++
-		}
+			if logWriteBlockStats {
+				tabletKey := tablet.String()
+				size := uint64(len(key) + len(value))
 
-		batch.SetRow(key, value)
+				stats.TotalSize += size
+				stats.TotalSizePerTablet[tabletKey] = stats.TotalSizePerTablet[tabletKey] + size
+				stats.TabletRowCount++
+			}
+
+			if err := aggregates.observe(ctx, row); err != nil {
+				return fmt.Errorf("tablet aggregate: %w", err)
+			}
+
+			fdb.collectionStats.observe(tablet.Collection(), len(key)+len(value), row.IsDeletion())
+			fdb.hotKeys.sample(hotKeysWrite, tablet, key)
+			fdb.missingKeys.forgetTablet(tablet)
+			fdb.tabletExistence.observe(tablet)
+			batch.SetRow(key, value)
+
+			if err := splitIfFull(); err != nil {
+				return err
+			}
+		}
 
 		if !fdb.disableIndexing {
 			// We could group `w.TabletRows` by tablet here greatly reducing the number of time
@@ -261,9 +583,57 @@ func (fdb *FluxDB) writeBlock(ctx context.Context, batch store.Batch, w *WriteRe
 		zlog.Info("write block stats", zap.Object("stats", stats))
 	}
 
+	if flushCount > 0 {
+		zlog.Info("block mutations split across multiple flushes", zap.Stringer("block", w.BlockRef), zap.Int("mutation_count", mutationCount), zap.Int("flush_count", flushCount+1))
+	}
+
+	aggregates.write(batch, w.Height)
+
+	if fdb.blockTimeIndex && !w.BlockTime.IsZero() {
+		for _, entry := range []blockTimeSingletEntry{newBlockTimeToHeightEntry(w.BlockTime, w.Height), newBlockHeightToTimeEntry(w.BlockTime, w.Height)} {
+			batch.SetRow(KeyForSingletEntry(entry), entry.Value())
+		}
+	}
+
+	if fdb.blockIDIndex && w.BlockRef != nil && w.BlockRef.ID() != "" {
+		entry := newBlockIDEntry(w.Height, w.BlockRef.ID())
+		batch.SetRow(KeyForSingletEntry(entry), entry.Value())
+	}
+
+	fdb.collectionStats.persistIfDue(batch, w.Height)
+
 	return fdb.setLastCheckpoint(batch, w.Height, w.BlockRef)
 }
 
+// tabletRowOrdinals returns the sub-block ordinal of each of the received rows, `nil` when none
+// of them belongs to a collection with row ordinals enabled. The last version of a row gets the
+// `LastTabletRowOrdinal` ordinal, earlier ones get their index in `rows`, which keeps them
+// ordered by appearance.
+func tabletRowOrdinals(rows []TabletRow) (ordinals []uint32) {
+	var lastVersions map[string]int
+	for i, row := range rows {
+		tablet := row.Tablet()
+		if !tabletRowOrdinalsEnabled(tablet.Collection()) {
+			continue
+		}
+
+		if ordinals == nil {
+			ordinals = make([]uint32, len(rows))
+			lastVersions = map[string]int{}
+		}
+
+		rowKey := string(KeyForTablet(tablet)) + string(row.PrimaryKey())
+		if previous, found := lastVersions[rowKey]; found {
+			ordinals[previous] = uint32(previous)
+		}
+
+		ordinals[i] = LastTabletRowOrdinal
+		lastVersions[rowKey] = i
+	}
+
+	return
+}
+
 type writeBlockStats struct {
 	Block               bstream.BlockRef
 	TotalSize           uint64
@@ -325,7 +695,7 @@ func (fdb *FluxDB) isNextBlock(ctx context.Context, writeHeight uint64) error {
 	zlogger := logging.Logger(ctx, zlog)
 	zlogger.Debug("checking if is next block", zap.Uint64("height", writeHeight))
 
-	_, lastBlock, err := fdb.FetchLastWrittenCheckpoint(ctx)
+	_, lastBlock, err := fdb.fetchResumeCheckpoint(ctx)
 	if err != nil {
 		return err
 	}
@@ -347,6 +717,43 @@ func (fdb *FluxDB) setFinalCheckpoint(batch store.Batch, height uint64, lastBloc
 	return fdb.setCheckpoint(batch, fdb.finalCheckpointKey(), height, lastBlock)
 }
 
+// rejectedKeys accumulates the keys rejected by the backend across the flushes of a batch.
+type rejectedKeys struct {
+	keys []store.RejectedKey
+}
+
+// skip returns `nil` when the batch was flushed without the keys rejected by the backend, which
+// are logged and accumulated, retrying the batch would only fail on them again.
+func (r *rejectedKeys) skip(err error) error {
+	var rejected *store.ErrRejectedKeys
+	if !errors.As(err, &rejected) {
+		return err
+	}
+
+	for _, key := range rejected.Keys {
+		zlog.Error("key rejected by the backend, skipped from the flushed batch", zap.String("table", key.Table), zap.Stringer("key", key.Key), zap.Error(key.Err))
+	}
+
+	r.keys = append(r.keys, rejected.Keys...)
+	return nil
+}
+
+func (r *rejectedKeys) skipping(flushIfFull func(ctx context.Context) (bool, error)) func(ctx context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		flushed, err := flushIfFull(ctx)
+		return flushed, r.skip(err)
+	}
+}
+
+// err returns a `*store.ErrRejectedKeys` listing all the keys skipped, `nil` if there is none.
+func (r *rejectedKeys) err() error {
+	if len(r.keys) == 0 {
+		return nil
+	}
+
+	return &store.ErrRejectedKeys{Keys: r.keys}
+}
+
 func (fdb *FluxDB) setCheckpoint(batch store.Batch, key []byte, height uint64, lastBlock bstream.BlockRef) error {
 	cellData, err := proto.Marshal(&pbfluxdb.Checkpoint{
 		Height: height,
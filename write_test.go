@@ -0,0 +1,526 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/fluxdb/store"
+	"github.com/dfuse-io/fluxdb/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWriteBatch_IndexOnly(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:         1,
+		BlockRef:       bstream.NewBlockRef("00000001aa", 1),
+		SingletEntries: []SingletEntry{singlet.entry(t, 1, "s #1")},
+		TabletRows:     []TabletRow{tablet.row(t, 1, "001", "r #1")},
+	})
+
+	// As if the tablet had enough mutations since its last index, so the next row triggers it
+	db.idxCache.lastCounters[string(KeyForTablet(tablet))] = 24999
+
+	db.SetIndexOnly(true)
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:         2,
+		BlockRef:       bstream.NewBlockRef("00000002aa", 2),
+		SingletEntries: []SingletEntry{singlet.entry(t, 2, "s #2")},
+		TabletRows:     []TabletRow{tablet.row(t, 2, "001", "r #2")},
+	})
+
+	height, block, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), height)
+	assert.Equal(t, "00000002aa", block.ID())
+
+	entry, err := db.ReadSingletEntryAt(ctx, singlet, 2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, singlet.entry(t, 1, "s #1"), entry)
+
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "r #1")}, rows)
+
+	// The index is built from the rows already in the store
+	index, err := db.ReadTabletIndexAt(ctx, tablet, 2)
+	require.NoError(t, err)
+	require.NotNil(t, index)
+	assert.Equal(t, uint64(2), index.AtHeight)
+	assert.Equal(t, map[string]interface{}{"001": uint64(1)}, index.PrimaryKeyToHeight.mappings)
+}
+
+func TestCheckCleanDBForSharding_IndexOnly(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	require.NoError(t, db.CheckCleanDBForSharding())
+
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:     1,
+		BlockRef:   bstream.NewBlockRef("00000001aa", 1),
+		TabletRows: []TabletRow{newTestTablet("tbl").row(t, 1, "001", "r #1")},
+	})
+	assert.Error(t, db.CheckCleanDBForSharding())
+
+	db.SetIndexOnly(true)
+	assert.NoError(t, db.CheckCleanDBForSharding(), "rows are expected to exist in index-only mode")
+}
+
+func TestShouldDeferIndexing(t *testing.T) {
+	db := &FluxDB{}
+	assert.False(t, db.shouldDeferIndexing(1), "not deferring by default")
+
+	db.SetDeferIndexing(10)
+	assert.True(t, db.shouldDeferIndexing(4))
+	assert.True(t, db.shouldDeferIndexing(5))
+	assert.False(t, db.shouldDeferIndexing(1), "interval reached, should index")
+	assert.True(t, db.shouldDeferIndexing(1), "interval counter should have been reset")
+
+	db.SetReady()
+	assert.False(t, db.shouldDeferIndexing(1), "ready, should index")
+	assert.False(t, db.deferIndexing, "ready, should have resumed inline indexing")
+}
+
+func TestWriteBatch_DeferredBlockCount(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.SetDeferIndexing(10)
+
+	// No tablet is scheduled for indexing, the blocks still count toward the interval
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1")}},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), TabletRows: []TabletRow{tablet.row(t, 2, "001", "r #2")}},
+	)
+
+	assert.False(t, db.idxCache.HasScheduledIndexing())
+	assert.Equal(t, 2, db.deferredBlockCount)
+}
+
+func TestWriteBatch_WriteElision(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.EnableWriteElision(10)
+
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:         1,
+			BlockRef:       bstream.NewBlockRef("00000001aa", 1),
+			SingletEntries: []SingletEntry{singlet.entry(t, 1, "s #1")},
+			TabletRows:     []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 1, "002", "r #1")},
+		},
+		&WriteRequest{
+			Height:         2,
+			BlockRef:       bstream.NewBlockRef("00000002aa", 2),
+			SingletEntries: []SingletEntry{singlet.entry(t, 2, "s #1")},
+			TabletRows:     []TabletRow{tablet.row(t, 2, "001", "r #1"), tablet.row(t, 2, "002", "r #2")},
+		},
+	)
+
+	entry, err := db.ReadSingletEntryAt(ctx, singlet, 2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, singlet.entry(t, 1, "s #1"), entry, "identical singlet entry should have been elided")
+
+	rows, err := db.ReadTabletAt(ctx, 2, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 2, "002", "r #2")}, rows)
+}
+
+func TestWriteBatch_MaxRowSize(t *testing.T) {
+	ctx := context.Background()
+	tablet := newTestTablet("tbl")
+	singlet := newTestSinglet("sgl")
+
+	request := &WriteRequest{
+		Height:         1,
+		BlockRef:       bstream.NewBlockRef("00000001aa", 1),
+		SingletEntries: []SingletEntry{singlet.entry(t, 1, "too large")},
+		TabletRows:     []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 1, "002", "too large")},
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		db, closer := NewTestDB(t)
+		defer closer()
+
+		db.SetMaxRowSize(4, RowSizePolicyReject)
+
+		err := db.WriteBatch(ctx, []*WriteRequest{request})
+		var tooLarge *ErrRowTooLarge
+		require.True(t, errors.As(err, &tooLarge))
+		assert.Equal(t, Key(KeyForSingletEntry(request.SingletEntries[0])), tooLarge.Key)
+		assert.Equal(t, 9, tooLarge.Size)
+		assert.Equal(t, 4, tooLarge.MaxSize)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		db, closer := NewTestDB(t)
+		defer closer()
+
+		db.SetMaxRowSize(4, RowSizePolicySkip)
+		writeBatchOfRequests(t, db, request)
+
+		entry, err := db.ReadSingletEntryAt(ctx, singlet, 1, nil)
+		require.NoError(t, err)
+		assert.Nil(t, entry)
+
+		rows, err := db.ReadTabletAt(ctx, 1, tablet, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "r #1")}, rows)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		db, closer := NewTestDB(t)
+		defer closer()
+
+		db.SetMaxRowSize(4, RowSizePolicyTruncate)
+		writeBatchOfRequests(t, db, request)
+
+		entry, err := db.ReadSingletEntryAt(ctx, singlet, 1, nil)
+		require.NoError(t, err)
+		assert.Equal(t, singlet.entry(t, 1, "too "), entry)
+
+		rows, err := db.ReadTabletAt(ctx, 1, tablet, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 1, "002", "too ")}, rows)
+	})
+}
+
+func TestParseRowSizePolicy(t *testing.T) {
+	for _, policy := range []RowSizePolicy{RowSizePolicyReject, RowSizePolicySkip, RowSizePolicyTruncate} {
+		parsed, err := ParseRowSizePolicy(policy.String())
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+
+	_, err := ParseRowSizePolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestWriteBatch_PipelinedFlushes(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.EnablePipelinedFlushes()
+
+	var flushLock sync.Mutex
+	flushCount := 0
+	db.OnFlush(func(report FlushReport) {
+		flushLock.Lock()
+		defer flushLock.Unlock()
+		flushCount++
+	})
+
+	tablet := newTestTablet("tbl")
+	var requests []*WriteRequest
+	for height := uint64(1); height <= 50; height++ {
+		request := &WriteRequest{Height: height, BlockRef: bstream.NewBlockRef(fmt.Sprintf("%08daa", height), height)}
+		for i := 0; i < 10; i++ {
+			request.AppendTabletRow(tablet.row(t, height, fmt.Sprintf("%03d", i), fmt.Sprintf("r #%d", height)))
+		}
+
+		requests = append(requests, request)
+	}
+
+	writeBatchOfRequests(t, db, requests...)
+	assert.True(t, flushCount > 1, "full batches should have been flushed in background")
+
+	height, _, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(50), height)
+
+	rows, err := db.ReadTabletAt(ctx, 50, tablet, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 10)
+	for _, row := range rows {
+		assert.Equal(t, "r #50", row.(testTabletRow).data())
+	}
+}
+
+func TestWriteBatch_LastIrreversibleBlock(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	height, block, err := db.LastIrreversibleBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), height)
+	assert.Equal(t, bstream.BlockRefEmpty, block)
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1")}},
+		&WriteRequest{Height: 2, BlockRef: bstream.NewBlockRef("00000002aa", 2), TabletRows: []TabletRow{tablet.row(t, 2, "001", "")}},
+	)
+
+	height, block, err = db.LastIrreversibleBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), height)
+	assert.Equal(t, "00000002aa", block.ID())
+
+	require.NoError(t, db.WriteShardingFinalCheckpoint(ctx, 5, bstream.NewBlockRef("00000005aa", 5)))
+
+	height, _, err = db.LastIrreversibleBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), height)
+}
+
+func TestWriteBatch_TabletRowOrdinals(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	EnableTabletRowOrdinals(testTabletCollection)
+	defer delete(tabletRowOrdinalCollections, testTabletCollection)
+
+	db.EnableWriteElision(10)
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db,
+		&WriteRequest{
+			Height:   1,
+			BlockRef: bstream.NewBlockRef("00000001aa", 1),
+			TabletRows: []TabletRow{
+				tablet.row(t, 1, "001", "r1 #1"),
+				tablet.row(t, 1, "002", "r2 #1"),
+				tablet.row(t, 1, "001", "r1 #2"),
+				tablet.row(t, 1, "001", "r1 #3"),
+			},
+		},
+		&WriteRequest{
+			Height:     2,
+			BlockRef:   bstream.NewBlockRef("00000002aa", 2),
+			TabletRows: []TabletRow{tablet.row(t, 2, "002", ""), tablet.row(t, 2, "002", "r2 #2")},
+		},
+		&WriteRequest{
+			Height:     3,
+			BlockRef:   bstream.NewBlockRef("00000003aa", 3),
+			TabletRows: []TabletRow{tablet.row(t, 3, "001", "r1 #4"), tablet.row(t, 3, "001", "r1 #3")},
+		},
+	)
+
+	var versions []string
+	err := db.store.ScanTabletRows(ctx, KeyForTabletAt(tablet, 1), KeyForTabletAt(tablet, 2), func(key []byte, value []byte) error {
+		versions = append(versions, string(value))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"r1 #1", "r1 #2", "r1 #3", "r2 #1"}, versions, "all versions of height 1 should be retained")
+
+	rows, err := db.ReadTabletAt(ctx, 1, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 1, "001", "r1 #3"), tablet.row(t, 1, "002", "r2 #1")}, rows)
+
+	rows, err = db.ReadTabletAt(ctx, 3, tablet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []TabletRow{tablet.row(t, 3, "001", "r1 #3"), tablet.row(t, 2, "002", "r2 #2")}, rows, "last version of a block should never be elided when earlier ones were written")
+
+	index := NewTabletIndex()
+	index.AtHeight = 3
+	index.PrimaryKeyToHeight.put([]byte("001"), 3)
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:         4,
+		BlockRef:       bstream.NewBlockRef("00000004aa", 4),
+		SingletEntries: []SingletEntry{newIndexSingletEntry(newIndexSinglet(tablet), index)},
+	})
+
+	row, err := db.ReadTabletRowAt(ctx, 4, tablet, testTabletRowPrimaryKey([]byte("001")), nil)
+	require.NoError(t, err)
+	assert.Equal(t, tablet.row(t, 3, "001", "r1 #3"), row)
+}
+
+func TestTabletRowOrdinals(t *testing.T) {
+	tablet := newTestTablet("tbl")
+	rows := []TabletRow{tablet.row(t, 1, "001", "a"), tablet.row(t, 1, "002", "b"), tablet.row(t, 1, "001", "c")}
+
+	assert.Nil(t, tabletRowOrdinals(rows), "no ordinals without any collection with row ordinals enabled")
+
+	EnableTabletRowOrdinals(testTabletCollection)
+	defer delete(tabletRowOrdinalCollections, testTabletCollection)
+
+	assert.Equal(t, []uint32{0, LastTabletRowOrdinal, LastTabletRowOrdinal}, tabletRowOrdinals(rows))
+}
+
+func TestWriteElider(t *testing.T) {
+	elider := newWriteElider(2)
+
+	assert.False(t, elider.shouldElide([]byte("aa"), []byte("1")))
+	assert.True(t, elider.shouldElide([]byte("aa"), []byte("1")))
+	assert.False(t, elider.shouldElide([]byte("aa"), []byte("2")))
+	assert.False(t, elider.shouldElide([]byte("aa"), nil), "deletion is not identical to previous value")
+	assert.True(t, elider.shouldElide([]byte("aa"), nil))
+	assert.False(t, elider.shouldElide([]byte("aa"), []byte{}), "empty value is not identical to a deletion")
+
+	assert.False(t, elider.shouldElide([]byte("bb"), []byte("1")))
+	assert.False(t, elider.shouldElide([]byte("cc"), []byte("1")))
+	assert.False(t, elider.shouldElide([]byte("aa"), []byte{}), "least recently written key should have been evicted")
+
+	elider.forget([]byte("cc"))
+	assert.False(t, elider.shouldElide([]byte("cc"), []byte("1")), "forgotten key should not be elided")
+
+	elider.reset()
+	assert.False(t, elider.shouldElide([]byte("cc"), []byte("1")))
+
+	var disabled *writeElider
+	assert.False(t, disabled.shouldElide([]byte("aa"), []byte("1")))
+	assert.False(t, disabled.shouldElide([]byte("aa"), []byte("1")))
+}
+
+func TestWriteBatch_OnFlush(t *testing.T) {
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	var reports []FlushReport
+	require.True(t, db.OnFlush(func(report FlushReport) {
+		reports = append(reports, report)
+	}))
+
+	tablet := newTestTablet("tbl")
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:     1,
+		BlockRef:   bstream.NewBlockRef("00000001aa", 1),
+		TabletRows: []TabletRow{tablet.row(t, 1, "001", "r #1"), tablet.row(t, 1, "002", "r #2")},
+	})
+
+	// Committed reads disabled, no commit marker flushed after the batch
+	require.Len(t, reports, 1)
+	report := reports[0]
+
+	assert.Equal(t, 4, report.MutationCount)
+	assert.Equal(t, 0, report.DeletionCount)
+	require.Contains(t, report.Tables, "rows")
+	require.Contains(t, report.Tables, "checkpoint")
+	assert.Equal(t, 2, report.Tables["rows"].MutationCount)
+	assert.Equal(t, 2, report.Tables["checkpoint"].MutationCount, "last written and last irreversible checkpoints")
+	assert.Equal(t, report.ByteSize, report.Tables["rows"].ByteSize+report.Tables["checkpoint"].ByteSize)
+	assert.True(t, report.Tables["rows"].ByteSize > 0)
+
+	// With committed reads, the batch then the commit marker in its own flush
+	db.EnableCommittedReads()
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:     2,
+		BlockRef:   bstream.NewBlockRef("00000002aa", 2),
+		TabletRows: []TabletRow{tablet.row(t, 2, "003", "r #3")},
+	})
+
+	require.Len(t, reports, 3)
+	assert.Equal(t, 1, reports[2].MutationCount)
+	require.Contains(t, reports[2].Tables, "checkpoint")
+}
+
+func TestWriteBatch_SplitHugeBlock(t *testing.T) {
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	var reports []FlushReport
+	db.OnFlush(func(report FlushReport) {
+		reports = append(reports, report)
+	})
+
+	tablet := newTestTablet("tbl")
+	rows := make([]TabletRow, 3*writeBlockFlushCheckInterval-1)
+	for i := range rows {
+		rows[i] = tablet.row(t, 1, string([]byte{byte(i >> 16), byte(i >> 8), byte(i)}), "r #1")
+	}
+
+	writeBatchOfRequests(t, db, &WriteRequest{
+		Height:     1,
+		BlockRef:   bstream.NewBlockRef("00000001aa", 1),
+		TabletRows: rows,
+	})
+
+	require.True(t, len(reports) > 2, "block mutations should have been split across multiple flushes")
+	assert.NotContains(t, reports[0].Tables, "checkpoint", "checkpoint must only be written with the last rows of the block")
+	assert.NotContains(t, reports[1].Tables, "checkpoint", "checkpoint must only be written with the last rows of the block")
+	assert.Contains(t, reports[2].Tables, "checkpoint")
+
+	height, _, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), height)
+
+	readRows, err := db.ReadTabletAt(ctx, 1, tablet, nil)
+	require.NoError(t, err)
+	assert.Len(t, readRows, len(rows))
+}
+
+// rejectingKeysStore reports a rejected key on each batch flush, as a backend would once the
+// partitioned flush retry isolated it, the rest of the batch being written.
+type rejectingKeysStore struct {
+	store.KVStore
+}
+
+func (s *rejectingKeysStore) NewBatch(logger *zap.Logger) store.Batch {
+	return &rejectingKeysBatch{Batch: s.KVStore.NewBatch(logger)}
+}
+
+type rejectingKeysBatch struct {
+	store.Batch
+}
+
+func (b *rejectingKeysBatch) Flush(ctx context.Context) error {
+	if err := b.Batch.Flush(ctx); err != nil {
+		return err
+	}
+
+	return &store.ErrRejectedKeys{Keys: []store.RejectedKey{{Table: "rows", Key: store.Key("rejected"), Err: errors.New("key too large")}}}
+}
+
+func TestWriteBatch_OnFlushUnsupported(t *testing.T) {
+	kvStore, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	// The wrapper hides the optional flush notifications of the store it wraps
+	db := New(&rejectingKeysStore{KVStore: kvStore}, nil, nil, false)
+	assert.False(t, db.OnFlush(func(report FlushReport) {}))
+}
+
+func TestWriteBatch_RejectedKeys(t *testing.T) {
+	ctx := context.Background()
+	kvStore, closer := storetest.NewKVStore(t)
+	defer closer()
+
+	db := New(&rejectingKeysStore{KVStore: kvStore}, nil, nil, false)
+
+	singlet := newTestSinglet("sgl")
+
+	err := db.WriteBatch(ctx, []*WriteRequest{{
+		Height:         1,
+		BlockRef:       bstream.NewBlockRef("00000001aa", 1),
+		SingletEntries: []SingletEntry{singlet.entry(t, 1, "s #1")},
+	}})
+
+	var rejected *store.ErrRejectedKeys
+	require.True(t, errors.As(err, &rejected), "got %v", err)
+	require.Len(t, rejected.Keys, 1)
+	assert.Equal(t, "rows", rejected.Keys[0].Table)
+
+	// The batch was committed without the rejected keys
+	entry, err := db.ReadSingletEntryAt(ctx, singlet, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, singlet.entry(t, 1, "s #1"), entry)
+
+	height, block, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), height)
+	assert.Equal(t, "00000001aa", block.ID())
+}
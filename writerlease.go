@@ -0,0 +1,115 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrWriterLeaseNotHeld is returned by `WriteBatch` when the writer lease is configured (see
+// `SetWriterLease`) but not held, either because it was never acquired or because it was lost.
+var ErrWriterLeaseNotHeld = errors.New("writer lease not held")
+
+// The key of the writer lease in the checkpoint table, see `newLease` for the constraints
+var writerLeaseKey = []byte("lock-writer")
+
+// SetWriterLease requires a lease on the store to be held, see `AcquireWriterLease`, before
+// `WriteBatch` is allowed, so a misconfigured second writer instance fails fast instead of
+// interleaving its writes (and last written checkpoints) with the ones of the running writer.
+// The lease is identified by `owner` and is renewed periodically, when not renewed within `ttl`
+// another owner is allowed to acquire it. When `takeover` is true, a lease currently held by
+// another owner is forcefully acquired, the other writer stops as soon as it notices.
+//
+// Sharded writes are not subject to the writer lease, the shards being written concurrently by
+// design, see `ShardInjector.SetLease` for their own lease.
+func (fdb *FluxDB) SetWriterLease(owner string, ttl time.Duration, takeover bool) {
+	fdb.writerLease = newLease(fdb, writerLeaseKey, owner, ttl, takeover)
+}
+
+// AcquireWriterLease acquires the writer lease configured with `SetWriterLease`, if any, and
+// keeps it alive until the instance terminates, releasing it then. If the lease is lost while
+// running, the instance is shut down.
+func (fdb *FluxDB) AcquireWriterLease(ctx context.Context) error {
+	lease := fdb.writerLease
+	if lease == nil {
+		return nil
+	}
+
+	if err := lease.acquire(ctx); err != nil {
+		return fmt.Errorf("acquire writer lease: %w", err)
+	}
+
+	keepAliveCtx, stopKeepAlive := context.WithCancel(context.Background())
+	go lease.keepAlive(keepAliveCtx, func(err error) {
+		zlog.Error("writer lease lost, shutting down", zap.Error(err))
+		fdb.Shutdown(fmt.Errorf("writer lease lost: %w", err))
+	})
+
+	fdb.OnTerminating(func(_ error) {
+		stopKeepAlive()
+
+		// A lost lease belongs to another owner now, there is nothing to release
+		if lease.err() != nil {
+			return
+		}
+
+		if err := lease.release(context.Background()); err != nil {
+			zlog.Warn("unable to release writer lease, it will expire by itself", zap.Error(err))
+		}
+	})
+
+	return nil
+}
+
+// checkWriterLease returns an error wrapping `ErrWriterLeaseNotHeld` when the writer lease is
+// configured and not currently held by this instance, as far as it knows locally, see
+// `confirmWriterLease`.
+func (fdb *FluxDB) checkWriterLease() error {
+	if fdb.writerLease == nil || fdb.IsSharding() {
+		return nil
+	}
+
+	if err := fdb.writerLease.err(); err != nil {
+		return fmt.Errorf("%w, lost: %s", ErrWriterLeaseNotHeld, err)
+	}
+
+	// Never acquired leases have a zero expiration, they are expired too
+	if fdb.writerLease.expired() {
+		return fmt.Errorf("%w, acquire it first or it expired without being renewed", ErrWriterLeaseNotHeld)
+	}
+
+	return nil
+}
+
+// confirmWriterLease re-reads the writer lease, when configured, returning an error wrapping
+// `ErrWriterLeaseNotHeld` when it's no longer held by this instance with the epoch it acquired.
+// The local expiry checked by `checkWriterLease` cannot tell a lease taken over by another
+// writer since the last renewal, it's thus called before writing the checkpoint.
+func (fdb *FluxDB) confirmWriterLease(ctx context.Context) error {
+	if fdb.writerLease == nil || fdb.IsSharding() {
+		return nil
+	}
+
+	if err := fdb.writerLease.check(ctx); err != nil {
+		return fmt.Errorf("%w: %s", ErrWriterLeaseNotHeld, err)
+	}
+
+	return nil
+}
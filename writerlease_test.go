@@ -0,0 +1,113 @@
+package fluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterLease(t *testing.T) {
+	defer func(previous time.Duration) { leaseSettleDelay = previous }(leaseSettleDelay)
+	leaseSettleDelay = 0
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	request := func(height uint64) []*WriteRequest {
+		return []*WriteRequest{{Height: height, BlockRef: bstream.NewBlockRef(fmt.Sprintf("%08xaa", height), height), TabletRows: []TabletRow{tablet.row(t, height, "001", "a")}}}
+	}
+
+	db.SetWriterLease("first", time.Minute, false)
+	assert.True(t, errors.Is(db.WriteBatch(ctx, request(1)), ErrWriterLeaseNotHeld), "lease not acquired yet")
+
+	require.NoError(t, db.AcquireWriterLease(ctx))
+	require.NoError(t, db.WriteBatch(ctx, request(1)))
+
+	second, secondCloser := NewTestDB(t)
+	defer secondCloser()
+	second.store = db.store
+
+	second.SetWriterLease("second", time.Minute, false)
+	assert.Error(t, second.AcquireWriterLease(ctx), "lease held by the first writer")
+	assert.True(t, errors.Is(second.WriteBatch(ctx, request(2)), ErrWriterLeaseNotHeld))
+
+	second.shardCount = 2
+	second.shardIndex = 1
+	assert.False(t, errors.Is(second.WriteBatch(ctx, request(2)), ErrWriterLeaseNotHeld), "sharded writes are not subject to the writer lease")
+	second.shardCount = 0
+	second.shardIndex = 0
+
+	// The lease is released once the writer terminates
+	db.Shutdown(nil)
+	second.SetWriterLease("second", time.Minute, false)
+	require.NoError(t, second.AcquireWriterLease(ctx))
+	require.NoError(t, second.WriteBatch(ctx, request(2)))
+}
+
+func TestWriterLease_Lost(t *testing.T) {
+	defer func(previous time.Duration) { leaseSettleDelay = previous }(leaseSettleDelay)
+	leaseSettleDelay = 0
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	db.SetWriterLease("first", 30*time.Millisecond, false)
+	require.NoError(t, db.AcquireWriterLease(ctx))
+
+	second, secondCloser := NewTestDB(t)
+	defer secondCloser()
+	second.store = db.store
+
+	second.SetWriterLease("second", time.Minute, true)
+	require.NoError(t, second.AcquireWriterLease(ctx))
+
+	select {
+	case <-db.Terminating():
+	case <-time.After(5 * time.Second):
+		t.Fatal("first writer should have been shut down after losing its lease")
+	}
+
+	assert.True(t, errors.Is(db.checkWriterLease(), ErrWriterLeaseNotHeld))
+	assert.NoError(t, second.checkWriterLease(), "taking over the lease should not release it when the previous writer terminates")
+}
+
+func TestWriterLease_TakenOverBeforeRenewal(t *testing.T) {
+	defer func(previous time.Duration) { leaseSettleDelay = previous }(leaseSettleDelay)
+	leaseSettleDelay = 0
+
+	ctx := context.Background()
+	db, closer := NewTestDB(t)
+	defer closer()
+
+	tablet := newTestTablet("tbl")
+	request := []*WriteRequest{{Height: 1, BlockRef: bstream.NewBlockRef("00000001aa", 1), TabletRows: []TabletRow{tablet.row(t, 1, "001", "a")}}}
+
+	// Renewed far less often than the test runs, the first writer cannot notice the takeover by itself
+	db.SetWriterLease("first", time.Hour, false)
+	require.NoError(t, db.AcquireWriterLease(ctx))
+
+	second, secondCloser := NewTestDB(t)
+	defer secondCloser()
+	second.store = db.store
+
+	second.SetWriterLease("second", time.Minute, true)
+	require.NoError(t, second.AcquireWriterLease(ctx))
+
+	require.NoError(t, db.checkWriterLease(), "the local expiry of the lease is still ahead")
+	assert.True(t, errors.Is(db.WriteBatch(ctx, request), ErrWriterLeaseNotHeld))
+
+	height, _, err := db.FetchLastWrittenCheckpoint(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), height, "the checkpoint must not be written without the lease")
+
+	require.NoError(t, second.WriteBatch(ctx, request))
+}